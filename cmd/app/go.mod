@@ -1,6 +1,6 @@
 module github.com/richardartoul/nola/cmd/app
 
-go 1.19
+go 1.21
 
 replace github.com/richardartoul/nola => ../../
 
@@ -25,6 +25,7 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/tetratelabs/wazero v1.0.1 // indirect
 	github.com/wapc/wapc-go v0.5.7 // indirect
+	github.com/wasmerio/wasmer-go v1.0.4 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.0.0-20221010170243-090e33056c14 // indirect
 	golang.org/x/xerrors v0.0.0-20220411194840-2f41105eb62f // indirect
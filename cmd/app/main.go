@@ -5,10 +5,15 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	_ "net/http/pprof"
 
+	"github.com/richardartoul/nola/durable"
+	"github.com/richardartoul/nola/durable/durablewazero"
 	"github.com/richardartoul/nola/virtual"
 	"github.com/richardartoul/nola/virtual/registry"
 	"github.com/richardartoul/nola/virtual/registry/fdbregistry"
@@ -23,8 +28,19 @@ var (
 	discoveryType               = flag.String("discoveryType", virtual.DiscoveryTypeLocalHost, "how the server should register itself with the discovery serice. Valid options: localhost|remote. Use localhost for local testing, use remote for multi-node setups")
 	registryType                = flag.String("registryBackend", "memory", "backend to use for the Registry. Validation options: memory|foundationdb")
 	foundationDBClusterFilePath = flag.String("foundationDBClusterFilePath", "", "path to use for the FoundationDB cluster file")
+	memorySnapshotPath          = flag.String("memoryRegistrySnapshotPath", "", "path of the file that the memory registry's state is periodically saved to and restored from on startup. Snapshots are disabled if empty")
+	wasmRuntime                 = flag.String("wasmRuntime", "wazero", "runtime to use for WASM modules. Valid options: wazero|wasmer (wasmer requires cgo)")
+	placementStrategy           = flag.String("placementStrategy", string(registry.PlacementStrategyFewestActors), "strategy the Registry uses to place new actor activations. Valid options: fewest_actors|rendezvous_hash|least_loaded")
+	drainTimeout                = flag.Duration("drainTimeout", 30*time.Second, "maximum amount of time to wait for in-flight invocations to complete when draining the server on SIGTERM/SIGINT")
+	enableCacheAdminAPI         = flag.Bool("enableCacheAdminAPI", false, "expose the activation cache admin API under /api/v1/cache/ for debugging routing. Disabled by default since it exposes routing internals")
 )
 
+// wasmRuntimes contains the constructors of the WASM runtimes that are available in
+// this build, keyed by name.
+var wasmRuntimes = map[string]func() durable.WASMRuntime{
+	"wazero": durablewazero.NewRuntime,
+}
+
 func main() {
 	flag.Parse()
 
@@ -32,13 +48,29 @@ func main() {
 		fmt.Printf(" --%s=%s\n", f.Name, f.Value.String())
 	})
 
-	var reg registry.Registry
+	var (
+		reg     registry.Registry
+		regOpts = registry.KVRegistryOptions{
+			PlacementStrategy: registry.PlacementStrategy(*placementStrategy),
+		}
+	)
 	switch *registryType {
 	case "memory":
-		reg = localregistry.NewLocalRegistry()
+		var err error
+		if *memorySnapshotPath != "" {
+			reg, err = localregistry.NewLocalRegistryWithSnapshots(
+				context.Background(), regOpts, localregistry.SnapshotOptions{
+					Store: localregistry.NewFileSnapshotStore(*memorySnapshotPath),
+				})
+		} else {
+			reg, err = localregistry.NewLocalRegistryWithOptions(regOpts)
+		}
+		if err != nil {
+			log.Fatalf("error creating local registry: %v\n", err)
+		}
 	case "foundationdb":
 		var err error
-		reg, err = fdbregistry.NewFoundationDBRegistry(*foundationDBClusterFilePath)
+		reg, err = fdbregistry.NewFoundationDBRegistryWithOptions(*foundationDBClusterFilePath, regOpts)
 		if err != nil {
 			log.Fatalf("error creating FoundationDB registry: %v\n", err)
 		}
@@ -46,6 +78,11 @@ func main() {
 		log.Fatalf("unknown registry type: %v", *registryType)
 	}
 
+	newWASMRuntime, ok := wasmRuntimes[*wasmRuntime]
+	if !ok {
+		log.Fatalf("unknown WASM runtime: %v", *wasmRuntime)
+	}
+
 	client := virtual.NewHTTPClient()
 
 	ctx, cc := context.WithTimeout(context.Background(), 10*time.Second)
@@ -54,13 +91,39 @@ func main() {
 			DiscoveryType: *discoveryType,
 			Port:          *port,
 		},
+		WASMRuntime: newWASMRuntime(),
 	})
 	cc()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	server := virtual.NewServer(reg, environment)
+	server := virtual.NewServerWithOptions(reg, environment, virtual.ServerOptions{
+		EnableCacheAdminAPI: *enableCacheAdminAPI,
+	})
+
+	// Drain the server before exiting so that its actors are handed off to other servers
+	// with minimal disruption. The HTTP server keeps running in the meantime so that
+	// invocations that are still routed here can be rerouted.
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-sigCh
+		log.Printf("received signal: %v, draining\n", sig)
+
+		ctx, cc := context.WithTimeout(context.Background(), *drainTimeout)
+		if err := environment.Drain(ctx); err != nil {
+			log.Printf("error draining: %v\n", err)
+		}
+		cc()
+		if err := environment.Close(); err != nil {
+			log.Printf("error closing environment: %v\n", err)
+		}
+		if err := reg.Close(context.Background()); err != nil {
+			log.Printf("error closing registry: %v\n", err)
+		}
+		os.Exit(0)
+	}()
 
 	log.Printf("listening on port: %d\n", *port)
 
@@ -0,0 +1,11 @@
+//go:build (amd64 || arm64) && !windows && cgo && !wasmtime
+
+package main
+
+import (
+	"github.com/richardartoul/nola/durable/durablewasmer"
+)
+
+func init() {
+	wasmRuntimes["wasmer"] = durablewasmer.NewRuntime
+}
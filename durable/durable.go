@@ -2,9 +2,50 @@ package durable
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 )
 
+// HostFn handles the waPC host calls made by the guest. All runtimes implement the waPC
+// protocol so the same HostFn can be used with any of them.
+type HostFn func(
+	ctx context.Context,
+	binding, namespace, operation string,
+	payload []byte,
+) ([]byte, error)
+
+// CompileOptions contains the options for compiling a module. Runtimes that don't
+// support one of the options must return an error from Compile when it's set instead
+// of silently ignoring it.
+type CompileOptions struct {
+	// Interrupts makes invocations of the module interruptible, both by their context
+	// being done and by running out of fuel.
+	Interrupts bool
+	// CompilationCacheDir is the directory in which compiled modules are persisted so
+	// they can be reused across restarts. If empty, compiled modules are not persisted.
+	CompilationCacheDir string
+	// MemoryLimitPages is the maximum size (in 64KiB pages) that the linear memory of
+	// each instance of the module can grow to. If 0, instances are only limited by the
+	// maximum size of WASM memories (4GiB).
+	MemoryLimitPages uint32
+}
+
+// WASMRuntime compiles WASM modules into Modules which can then be instantiated into
+// Objects and invoked.
+type WASMRuntime interface {
+	// Name returns the name of the runtime.
+	Name() string
+	// Compile compiles the provided WASM module bytes into a Module whose host calls
+	// are handled by host.
+	Compile(
+		ctx context.Context,
+		host HostFn,
+		moduleBytes []byte,
+		opts CompileOptions,
+	) (Module, error)
+}
+
 type Module interface {
 	Instantiate(
 		ctx context.Context,
@@ -25,6 +66,41 @@ type Object interface {
 	Hydrate(ctx context.Context, r io.Reader, readerSize int) error
 }
 
+// MemorySizer is implemented by Objects that can report how much linear memory they use.
+type MemorySizer interface {
+	// MemorySize returns the current size of the object's linear memory in bytes.
+	MemorySize() uint64
+}
+
+// TrapError is returned (wrapped) by Object.Invoke when the invocation was aborted by
+// the runtime, for example because the module panicked, accessed memory out of bounds or
+// ran out of fuel, as opposed to the module returning an error. The state of an object
+// whose invocation trapped is unknown.
+type TrapError struct {
+	// Reason is the runtime's description of the trap, for example "wasm error:
+	// unreachable".
+	Reason string
+	// Err is the error that was returned by the runtime.
+	Err error
+}
+
+func (e *TrapError) Error() string {
+	return fmt.Sprintf("module trapped: %s, err: %v", e.Reason, e.Err)
+}
+
+func (e *TrapError) Unwrap() error {
+	return e.Err
+}
+
+// AsTrapError returns the TrapError that err is (or wraps), if any.
+func AsTrapError(err error) (*TrapError, bool) {
+	var trapErr *TrapError
+	if errors.As(err, &trapErr) {
+		return trapErr, true
+	}
+	return nil, false
+}
+
 type Logger func(msg string)
 
 type OperationLogger func(operation string, payload []byte)
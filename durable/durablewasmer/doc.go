@@ -0,0 +1,4 @@
+// Package durablewasmer implements the durable interfaces on top of wasmer. wasmer
+// requires cgo and is only supported on amd64 and arm64 (excluding Windows), so the
+// package is empty on every other platform.
+package durablewasmer
@@ -0,0 +1,121 @@
+//go:build (amd64 || arm64) && !windows && cgo && !wasmtime
+
+package durablewasmer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/richardartoul/nola/durable"
+	"github.com/wapc/wapc-go"
+	"github.com/wapc/wapc-go/engines/wasmer"
+)
+
+var errUnsupportedCompileOption = errors.New("compile option is not supported by the wasmer runtime")
+
+type runtime struct{}
+
+// NewRuntime returns a durable.WASMRuntime backed by wasmer. Note that wasmer does not
+// support durable.CompileOptions.Interrupts (which fuel limits and invocation timeouts
+// depend on), durable.CompileOptions.CompilationCacheDir or
+// durable.CompileOptions.MemoryLimitPages. It also doesn't support mounting file systems
+// with durable.WithFS.
+func NewRuntime() durable.WASMRuntime {
+	return runtime{}
+}
+
+func (r runtime) Name() string {
+	return "wasmer"
+}
+
+func (r runtime) Compile(
+	ctx context.Context,
+	host durable.HostFn,
+	moduleBytes []byte,
+	opts durable.CompileOptions,
+) (durable.Module, error) {
+	if opts.Interrupts {
+		return nil, fmt.Errorf("%w: Interrupts", errUnsupportedCompileOption)
+	}
+	if opts.CompilationCacheDir != "" {
+		return nil, fmt.Errorf("%w: CompilationCacheDir", errUnsupportedCompileOption)
+	}
+	if opts.MemoryLimitPages > 0 {
+		return nil, fmt.Errorf("%w: MemoryLimitPages", errUnsupportedCompileOption)
+	}
+	return NewModule(ctx, wasmer.Engine(), host, moduleBytes)
+}
+
+// IsUnsupportedCompileOptionErr returns a boolean indicating whether the error is the
+// result of compiling a module with options that wasmer does not support.
+func IsUnsupportedCompileOptionErr(err error) bool {
+	return errors.Is(err, errUnsupportedCompileOption)
+}
+
+type module struct {
+	sync.Mutex
+	m         wapc.Module
+	instances map[string]wapc.Instance
+}
+
+func NewModule(
+	ctx context.Context,
+	engine wapc.Engine,
+	host func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error),
+	guestModuleBytes []byte,
+) (durable.Module, error) {
+	m, err := engine.New(ctx, host, guestModuleBytes, &wapc.ModuleConfig{
+		Logger: wapc.PrintlnLogger,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating new wasmer module from engine: %w", err)
+	}
+
+	return &module{
+		m:         m,
+		instances: make(map[string]wapc.Instance),
+	}, nil
+}
+
+func (m *module) Instantiate(
+	ctx context.Context,
+	id string,
+) (durable.Object, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	_, ok := m.instances[id]
+	if ok {
+		return nil, fmt.Errorf("instance with ID: %s already exists", id)
+	}
+
+	if _, ok := durable.FSFromContext(ctx); ok {
+		return nil, fmt.Errorf("%w: file systems cannot be mounted", errUnsupportedCompileOption)
+	}
+
+	instance, err := m.m.Instantiate(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("module: error instantiating instance: %w", err)
+	}
+	m.instances[id] = instance
+
+	return newObject(instance.(*wasmer.Instance), func() {
+		m.Lock()
+		defer m.Unlock()
+		delete(m.instances, id)
+	}), nil
+}
+
+func (d *module) Close(ctx context.Context) error {
+	d.Lock()
+	defer d.Unlock()
+	if len(d.instances) > 0 {
+		return fmt.Errorf("module: Close: cannot close with > 0 unclosed instances")
+	}
+	return d.m.Close(ctx)
+}
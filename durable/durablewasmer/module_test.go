@@ -0,0 +1,100 @@
+//go:build (amd64 || arm64) && !windows && cgo && !wasmtime
+
+package durablewasmer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/richardartoul/nola/durable"
+
+	"github.com/stretchr/testify/require"
+)
+
+var utilWasmBytes []byte
+
+func init() {
+	fBytes, err := os.ReadFile("../../testdata/tinygo/util/main.wasm")
+	if err != nil {
+		panic(err)
+	}
+	utilWasmBytes = fBytes
+}
+
+func TestDurable(t *testing.T) {
+	ctx := context.Background()
+
+	module, err := NewRuntime().Compile(ctx, testHost, utilWasmBytes, durable.CompileOptions{})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, module.Close(ctx))
+	}()
+
+	for i := 0; i < 2; i++ {
+		object, err := module.Instantiate(ctx, "a")
+		require.NoError(t, err)
+
+		// This function is not defined so this should error out.
+		_, err = object.Invoke(ctx, "does-not-exist", []byte("123"))
+		require.Error(t, err)
+
+		result, err := object.Invoke(ctx, "inc", nil)
+		require.NoError(t, err)
+
+		// Each iteration returns 1 because we're closing at the end.
+		require.Equal(t, int64(1), getCount(t, result))
+		require.NoError(t, object.Close(ctx))
+	}
+
+	object, err := module.Instantiate(ctx, "a")
+	require.NoError(t, err)
+
+	// Create some state.
+	_, err = object.Invoke(ctx, "inc", []byte("123"))
+	require.NoError(t, err)
+
+	// Snapshot the existing state, then close the object.
+	serBuf := bytes.NewBuffer(nil)
+	require.NoError(t, object.Snapshot(ctx, serBuf))
+	require.NoError(t, object.Close(ctx))
+
+	// Hydrate a new instance from the state we snapshotted previously.
+	object, err = module.Instantiate(ctx, "a")
+	require.NoError(t, err)
+	defer object.Close(ctx)
+	require.NoError(t, object.Hydrate(ctx, serBuf, serBuf.Len()))
+
+	// If Snapshot()/Hydrate() works then the next inc should take us to
+	// 2 instead of 1.
+	result, err := object.Invoke(ctx, "inc", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), getCount(t, result))
+}
+
+func TestUnsupportedCompileOptions(t *testing.T) {
+	ctx := context.Background()
+
+	for _, opts := range []durable.CompileOptions{
+		{Interrupts: true},
+		{CompilationCacheDir: t.TempDir()},
+	} {
+		_, err := NewRuntime().Compile(ctx, testHost, utilWasmBytes, opts)
+		require.True(t, IsUnsupportedCompileOptionErr(err))
+	}
+}
+
+func testHost(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+	return nil, fmt.Errorf(
+		"testHotNotImplemented [%s::%s::%s::%s)",
+		binding, namespace, operation, string(payload))
+}
+
+func getCount(t *testing.T, v []byte) int64 {
+	x, err := strconv.Atoi(string(v))
+	require.NoError(t, err)
+	return int64(x)
+}
@@ -0,0 +1,138 @@
+//go:build (amd64 || arm64) && !windows && cgo && !wasmtime
+
+package durablewasmer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/richardartoul/nola/durable"
+	"github.com/wapc/wapc-go/engines/wasmer"
+
+	wasmergo "github.com/wasmerio/wasmer-go/wasmer"
+)
+
+const (
+	wasmPageSize = 1 << 16
+)
+
+type object struct {
+	sync.Mutex
+	instance *wasmer.Instance
+	onClose  func()
+}
+
+func newObject(
+	instance *wasmer.Instance,
+	onClose func(),
+) *object {
+	return &object{
+		instance: instance,
+		onClose:  onClose,
+	}
+}
+
+func (o *object) Invoke(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+) ([]byte, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	result, err := o.instance.Invoke(ctx, operation, payload)
+	var trapErr *wasmergo.TrapError
+	if errors.As(err, &trapErr) {
+		return nil, &durable.TrapError{Reason: trapErr.Error(), Err: err}
+	}
+	return result, err
+}
+
+func (o *object) Close(ctx context.Context) error {
+	o.Lock()
+	defer o.Unlock()
+
+	o.onClose()
+	return o.instance.Close(ctx)
+}
+
+func (o *object) Snapshot(
+	ctx context.Context,
+	w io.Writer,
+) error {
+	o.Lock()
+	defer o.Unlock()
+
+	memory, err := o.memory()
+	if err != nil {
+		return fmt.Errorf("error snapshotting object: %w", err)
+	}
+	if _, err := w.Write(memory.Data()); err != nil {
+		return fmt.Errorf(
+			"error snapshotting object: write failed with error: %w", err)
+	}
+	return nil
+}
+
+func (o *object) SnapshotIncremental(
+	ctx context.Context,
+	prev []byte,
+	w io.Writer,
+) error {
+	return fmt.Errorf("SnapshotIncremental is not implemented for wasmer objects")
+}
+
+func (o *object) Hydrate(
+	ctx context.Context,
+	r io.Reader,
+	readerSize int,
+) error {
+	o.Lock()
+	defer o.Unlock()
+
+	memory, err := o.memory()
+	if err != nil {
+		return fmt.Errorf("error hydrating object: %w", err)
+	}
+	memSize := int(memory.DataSize())
+	if readerSize > memSize {
+		var (
+			additionalBytesNeeded = readerSize - memSize
+			additionalPagesNeeded = additionalBytesNeeded / wasmPageSize
+		)
+		if additionalBytesNeeded%wasmPageSize > 0 {
+			additionalPagesNeeded++
+		}
+		if !memory.Grow(wasmergo.Pages(additionalPagesNeeded)) {
+			return fmt.Errorf(
+				"error hydrating object: failed to grow memory by %d pages", additionalPagesNeeded)
+		}
+	}
+
+	// Very important we do this *after* calling memory.Grow, otherwise the
+	// memBytes slice may be "detached" from the underlying instance memory
+	// and our writes won't "write through".
+	memBytes := memory.Data()
+	// Zero out existing memory just in case.
+	for i := range memBytes {
+		memBytes[i] = 0
+	}
+
+	_, err = io.CopyN(bytes.NewBuffer(memBytes[:0]), r, int64(readerSize))
+	if err != nil {
+		return fmt.Errorf("error hydrating object: error copying bytes from reader to memory: %w", err)
+	}
+	return nil
+}
+
+func (o *object) memory() (*wasmergo.Memory, error) {
+	memory, err := o.instance.Unwrap().Exports.GetMemory("memory")
+	if err != nil {
+		return nil, fmt.Errorf("error getting instance memory: %w", err)
+	}
+	return memory, nil
+}
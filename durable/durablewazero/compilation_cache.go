@@ -0,0 +1,156 @@
+package durablewazero
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sync"
+
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/wapc/wapc-go"
+)
+
+const wazeroModulePath = "github.com/tetratelabs/wazero"
+
+// compilationCacheCtxKey is the key that is used to store/retrieve the compilation
+// cache directory from the context.
+type compilationCacheCtxKey struct{}
+
+// WithCompilationCache returns a context that makes NewModule persist compiled modules
+// in the provided directory (creating it if necessary) and reuse them in subsequent
+// calls, including calls made by other processes, so that modules only have to be
+// compiled once per machine instead of once per process.
+//
+// Compiled modules are keyed by the hash of the module bytes (after they're instrumented
+// for interrupts, if enabled) along with the wazero version and platform, so a module
+// whose bytes change is simply recompiled. Entries are never removed from the
+// directory so it should be pruned externally if modules change frequently.
+//
+// wazero's own file cache must not be shared by multiple runtimes, so every module is
+// compiled into a private staging directory that is then atomically renamed into place.
+// This makes it safe for any number of processes to share the same directory as long
+// as it lives on a single file system.
+func WithCompilationCache(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, compilationCacheCtxKey{}, dir)
+}
+
+// newModuleWithCompilationCache is the same as engine.New, except the module is loaded
+// from (or persisted in) the compilation cache in dir.
+func newModuleWithCompilationCache(
+	ctx context.Context,
+	dir string,
+	engine wapc.Engine,
+	host wapc.HostCallHandler,
+	guestModuleBytes []byte,
+	config *wapc.ModuleConfig,
+) (wapc.Module, error) {
+	entry, ok := compilationCacheEntry(ctx, dir, guestModuleBytes)
+	if !ok {
+		// Modules compiled with unknown function listeners can't be cached safely.
+		return engine.New(ctx, host, guestModuleBytes, config)
+	}
+
+	if _, err := os.Stat(entry); err == nil {
+		m, err := newModuleInCacheDir(ctx, entry, engine, host, guestModuleBytes, config)
+		if err == nil {
+			return m, nil
+		}
+		// The entry is unusable (for example it was modified externally), so fall
+		// through and replace it.
+		log.Printf(
+			"error loading module from compilation cache entry: %s, recompiling, err: %v",
+			entry, err)
+		if err := os.RemoveAll(entry); err != nil {
+			log.Printf("error removing compilation cache entry: %s, err: %v", entry, err)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating compilation cache dir: %s, err: %w", dir, err)
+	}
+	staging, err := os.MkdirTemp(dir, "staging-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating compilation cache staging dir: %w", err)
+	}
+	m, err := newModuleInCacheDir(ctx, staging, engine, host, guestModuleBytes, config)
+	if err != nil {
+		os.RemoveAll(staging)
+		return nil, err
+	}
+
+	// Renaming a directory on top of a non-empty directory fails, so if another process
+	// published the same entry concurrently we just keep theirs.
+	if err := os.Rename(staging, entry); err != nil {
+		os.RemoveAll(staging)
+		if _, statErr := os.Stat(entry); statErr != nil {
+			log.Printf("error publishing compilation cache entry: %s, err: %v", entry, err)
+		}
+	}
+	return m, nil
+}
+
+func newModuleInCacheDir(
+	ctx context.Context,
+	cacheDir string,
+	engine wapc.Engine,
+	host wapc.HostCallHandler,
+	guestModuleBytes []byte,
+	config *wapc.ModuleConfig,
+) (wapc.Module, error) {
+	ctx, err := experimental.WithCompilationCacheDirName(ctx, cacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring compilation cache dir: %s, err: %w", cacheDir, err)
+	}
+	return engine.New(ctx, host, guestModuleBytes, config)
+}
+
+// compilationCacheEntry returns the directory in which the compiled version of the
+// provided module bytes is cached. The second return value is false if the module can't
+// be cached.
+func compilationCacheEntry(ctx context.Context, dir string, guestModuleBytes []byte) (string, bool) {
+	if ctx.Value(experimental.FunctionListenerFactoryKey{}) != nil {
+		return "", false
+	}
+
+	// Modules that are compiled with interrupts are instrumented before they're compiled
+	// (see instrumentInterrupts), so their bytes already differ from the bytes of the
+	// same module without interrupts.
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00default\x00", wazeroVersion(), runtime.GOOS, runtime.GOARCH)
+	h.Write(guestModuleBytes)
+	return filepath.Join(dir, hex.EncodeToString(h.Sum(nil))), true
+}
+
+var (
+	wazeroVersionOnce sync.Once
+	wazeroVersionStr  string
+)
+
+// wazeroVersion returns the version of wazero that the binary was built with so that
+// upgrading wazero never reuses (and rewrites in place) entries published by another
+// version.
+func wazeroVersion() string {
+	wazeroVersionOnce.Do(func() {
+		wazeroVersionStr = "unknown"
+		info, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == wazeroModulePath {
+				if dep.Replace != nil {
+					dep = dep.Replace
+				}
+				wazeroVersionStr = dep.Version
+				return
+			}
+		}
+	})
+	return wazeroVersionStr
+}
@@ -0,0 +1,41 @@
+package durablewazero
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"unsafe"
+
+	"github.com/richardartoul/nola/durable"
+	"github.com/tetratelabs/wazero"
+	"github.com/wapc/wapc-go"
+	wapcwazero "github.com/wapc/wapc-go/engines/wazero"
+)
+
+// moduleConfigType is the type of the wapcwazero.Module field that contains the
+// configuration every instance of the module is instantiated with.
+var moduleConfigType = reflect.TypeOf((*wazero.ModuleConfig)(nil)).Elem()
+
+// instantiateWithFS instantiates m with fsys mounted as the root of its WASI file system.
+//
+// wapc-go instantiates every instance of a module with the same wazero.ModuleConfig and
+// doesn't expose it, so the config is swapped for the duration of the call. The caller
+// must ensure that m is not instantiated concurrently.
+func instantiateWithFS(ctx context.Context, m wapc.Module, fsys durable.FS) (wapc.Instance, error) {
+	wm, ok := m.(*wapcwazero.Module)
+	if !ok {
+		return nil, fmt.Errorf("cannot mount file system in module of type: %T", m)
+	}
+	field := reflect.ValueOf(wm).Elem().FieldByName("config")
+	if !field.IsValid() || field.Type() != moduleConfigType {
+		return nil, fmt.Errorf("cannot mount file system: unsupported version of wapc-go")
+	}
+
+	config := (*wazero.ModuleConfig)(unsafe.Pointer(field.UnsafeAddr()))
+	prev := *config
+	*config = prev.WithFS(fsys)
+	defer func() {
+		*config = prev
+	}()
+	return wm.Instantiate(ctx)
+}
@@ -0,0 +1,582 @@
+package durablewazero
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	// fuelGlobalName is the name of the global that instrumentInterrupts adds to modules
+	// to hold the fuel that remains for the running invocation.
+	fuelGlobalName = "__nola_fuel"
+	// interruptGlobalName is the name of the global that instrumentInterrupts adds to
+	// modules to interrupt the running invocation. It is 0 unless the invocation must be
+	// interrupted, in which case it is set to interruptValue.
+	interruptGlobalName = "__nola_interrupt"
+	// interruptValue is the value that the interrupt global is set to in order to
+	// interrupt the running invocation. It's negative when interpreted as an int64, which
+	// is what the injected check tests for.
+	interruptValue = uint64(1) << 63
+	// yieldInterval is the number of units of fuel after which the injected check yields
+	// to the Go scheduler.
+	yieldInterval = 1024
+)
+
+const (
+	wasmSectionCustom    = 0
+	wasmSectionImport    = 2
+	wasmSectionMemory    = 5
+	wasmSectionGlobal    = 6
+	wasmSectionExport    = 7
+	wasmSectionCode      = 10
+	wasmSectionDataCount = 12
+
+	wasmImportKindFunc   = 0
+	wasmImportKindTable  = 1
+	wasmImportKindMemory = 2
+	wasmImportKindGlobal = 3
+
+	wasmExportKindGlobal = 3
+
+	wasmValTypeI64 = 0x7E
+	wasmBlockEmpty = 0x40
+
+	wasmOpUnreachable = 0x00
+	wasmOpLoop        = 0x03
+	wasmOpIf          = 0x04
+	wasmOpEnd         = 0x0B
+	wasmOpDrop        = 0x1A
+	wasmOpGlobalGet   = 0x23
+	wasmOpGlobalSet   = 0x24
+	wasmOpMemoryGrow  = 0x40
+	wasmOpI32Const    = 0x41
+	wasmOpI64Const    = 0x42
+	wasmOpI64Eqz      = 0x50
+	wasmOpI64LtS      = 0x53
+	wasmOpI64Sub      = 0x7D
+	wasmOpI64And      = 0x83
+	wasmOpI64Or       = 0x84
+)
+
+var (
+	wasmHeader = []byte{0x00, 0x61, 0x73, 0x6D, 0x01, 0x00, 0x00, 0x00}
+
+	errUnexpectedEOF = errors.New("unexpected end of module")
+)
+
+// instrumentInterrupts returns a copy of the provided WASM module that can be interrupted
+// while it runs, even if it's spinning in a loop that never calls a function. wazero
+// v1.0.0-pre.6 can't interrupt running modules, so instead the module interrupts itself:
+//
+//   - Two mutable i64 globals are added and exported: fuelGlobalName, which starts out
+//     at math.MaxInt64, and interruptGlobalName, which starts out at 0.
+//   - A check is injected at the start of every function and of every loop (so that it
+//     runs on every iteration). The check consumes one unit of fuel, and executes the
+//     unreachable instruction (which makes the invocation trap) if the remaining fuel
+//     became negative or if the interrupt global was set to interruptValue.
+//   - Every yieldInterval units of fuel, the check executes memory.grow with a delta of
+//     0, which has no effect other than returning from the compiled code to wazero's Go
+//     code. This gives the Go scheduler the chance to preempt the invocation, which it
+//     can't do while compiled code runs, so that the goroutine that sets the interrupt
+//     global (and the garbage collector) can run even if GOMAXPROCS is 1. A memory with
+//     no pages is added to modules that have no memory for this purpose.
+//
+// The check is stack-neutral and doesn't introduce any branch targets, so the semantics
+// of the module are unchanged otherwise.
+func instrumentInterrupts(moduleBytes []byte) ([]byte, error) {
+	if !bytes.HasPrefix(moduleBytes, wasmHeader) {
+		return nil, errors.New("instrumentInterrupts: invalid WASM module header")
+	}
+
+	type section struct {
+		id      byte
+		content []byte
+	}
+	var (
+		r        = wasmReader{b: moduleBytes[len(wasmHeader):]}
+		sections []section
+	)
+	for !r.done() {
+		id, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		content, err := r.vec()
+		if err != nil {
+			return nil, fmt.Errorf("instrumentInterrupts: error reading section %d: %w", id, err)
+		}
+		sections = append(sections, section{id: id, content: content})
+	}
+
+	var (
+		numImportedGlobals, numGlobals uint32
+		hasMemory                      bool
+	)
+	for _, s := range sections {
+		var err error
+		switch s.id {
+		case wasmSectionImport:
+			numImportedGlobals, hasMemory, err = scanImports(s.content)
+		case wasmSectionMemory:
+			hasMemory = true
+		case wasmSectionGlobal:
+			numGlobals, err = (&wasmReader{b: s.content}).u32()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("instrumentInterrupts: error reading section %d: %w", s.id, err)
+		}
+	}
+	var (
+		fuelIdx      = numImportedGlobals + numGlobals
+		interruptIdx = fuelIdx + 1
+		check        = interruptCheck(fuelIdx, interruptIdx)
+	)
+
+	// Add the sections that the globals and their exports are appended to if the module
+	// doesn't have them, respecting the order of sections.
+	newSections := []byte{wasmSectionGlobal, wasmSectionExport}
+	if !hasMemory {
+		newSections = append(newSections, wasmSectionMemory)
+	}
+	for _, id := range newSections {
+		i, found := 0, false
+		for ; i < len(sections); i++ {
+			if sections[i].id == id {
+				found = true
+				break
+			}
+			if sections[i].id != wasmSectionCustom && wasmSectionOrder(sections[i].id) > wasmSectionOrder(id) {
+				break
+			}
+		}
+		if !found {
+			sections = append(sections[:i], append([]section{{id: id, content: []byte{0}}}, sections[i:]...)...)
+		}
+	}
+
+	for i, s := range sections {
+		var err error
+		switch s.id {
+		case wasmSectionGlobal:
+			sections[i].content, err = appendToVec(s.content, 2, func(b []byte) []byte {
+				b = append(b, wasmValTypeI64, 1, wasmOpI64Const)
+				b = appendS64(b, math.MaxInt64)
+				b = append(b, wasmOpEnd)
+				b = append(b, wasmValTypeI64, 1, wasmOpI64Const)
+				b = appendS64(b, 0)
+				return append(b, wasmOpEnd)
+			})
+		case wasmSectionMemory:
+			if !hasMemory {
+				// A memory with no pages (and no maximum).
+				sections[i].content, err = appendToVec(s.content, 1, func(b []byte) []byte {
+					return append(b, 0, 0)
+				})
+			}
+		case wasmSectionExport:
+			sections[i].content, err = appendToVec(s.content, 2, func(b []byte) []byte {
+				b = appendName(b, fuelGlobalName)
+				b = append(b, wasmExportKindGlobal)
+				b = appendU32(b, fuelIdx)
+				b = appendName(b, interruptGlobalName)
+				b = append(b, wasmExportKindGlobal)
+				return appendU32(b, interruptIdx)
+			})
+		case wasmSectionCode:
+			sections[i].content, err = instrumentCode(s.content, check)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("instrumentInterrupts: error instrumenting section %d: %w", s.id, err)
+		}
+	}
+
+	out := make([]byte, 0, len(moduleBytes)+len(moduleBytes)/4)
+	out = append(out, wasmHeader...)
+	for _, s := range sections {
+		out = append(out, s.id)
+		out = appendU32(out, uint32(len(s.content)))
+		out = append(out, s.content...)
+	}
+	return out, nil
+}
+
+// interruptCheck returns the instructions that are injected by instrumentInterrupts.
+// They're equivalent to:
+//
+//	fuel = fuel - 1
+//	if (fuel | interrupt) < 0 {
+//		unreachable
+//	}
+//	if fuel % yieldInterval == 0 {
+//		memory.grow(0)
+//	}
+func interruptCheck(fuelIdx, interruptIdx uint32) []byte {
+	var b []byte
+	b = append(b, wasmOpGlobalGet)
+	b = appendU32(b, fuelIdx)
+	b = append(b, wasmOpI64Const, 1, wasmOpI64Sub, wasmOpGlobalSet)
+	b = appendU32(b, fuelIdx)
+	b = append(b, wasmOpGlobalGet)
+	b = appendU32(b, fuelIdx)
+	b = append(b, wasmOpGlobalGet)
+	b = appendU32(b, interruptIdx)
+	b = append(b, wasmOpI64Or, wasmOpI64Const, 0, wasmOpI64LtS)
+	b = append(b, wasmOpIf, wasmBlockEmpty, wasmOpUnreachable, wasmOpEnd)
+	b = append(b, wasmOpGlobalGet)
+	b = appendU32(b, fuelIdx)
+	b = append(b, wasmOpI64Const)
+	b = appendS64(b, yieldInterval-1)
+	b = append(b, wasmOpI64And, wasmOpI64Eqz)
+	b = append(b, wasmOpIf, wasmBlockEmpty, wasmOpI32Const, 0, wasmOpMemoryGrow, 0, wasmOpDrop)
+	return append(b, wasmOpEnd)
+}
+
+// instrumentCode injects check at the start of every function body in the code section
+// and after every loop instruction.
+func instrumentCode(content []byte, check []byte) ([]byte, error) {
+	r := wasmReader{b: content}
+	numBodies, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+
+	out := appendU32(nil, numBodies)
+	for i := uint32(0); i < numBodies; i++ {
+		body, err := r.vec()
+		if err != nil {
+			return nil, fmt.Errorf("error reading function body %d: %w", i, err)
+		}
+		instrumented, err := instrumentBody(body, check)
+		if err != nil {
+			return nil, fmt.Errorf("error instrumenting function body %d: %w", i, err)
+		}
+		out = appendU32(out, uint32(len(instrumented)))
+		out = append(out, instrumented...)
+	}
+	if !r.done() {
+		return nil, errors.New("trailing bytes after function bodies")
+	}
+	return out, nil
+}
+
+func instrumentBody(body []byte, check []byte) ([]byte, error) {
+	r := wasmReader{b: body}
+	numLocals, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < numLocals; i++ {
+		if _, err := r.u32(); err != nil {
+			return nil, err
+		}
+		if _, err := r.byte(); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]byte, 0, len(body)+len(check))
+	out = append(out, body[:r.pos]...)
+	out = append(out, check...)
+	copied := r.pos
+	for !r.done() {
+		op, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if err := r.skipImmediates(op); err != nil {
+			return nil, fmt.Errorf("error decoding opcode 0x%02x at offset %d: %w", op, r.pos, err)
+		}
+		if op == wasmOpLoop {
+			out = append(out, body[copied:r.pos]...)
+			out = append(out, check...)
+			copied = r.pos
+		}
+	}
+	return append(out, body[copied:]...), nil
+}
+
+// scanImports returns the number of globals that are imported by the module (which
+// precede the globals defined by the module in the global index space), and whether the
+// module imports a memory.
+func scanImports(content []byte) (numGlobals uint32, hasMemory bool, err error) {
+	r := wasmReader{b: content}
+	numImports, err := r.u32()
+	if err != nil {
+		return 0, false, err
+	}
+
+	for i := uint32(0); i < numImports; i++ {
+		// Module and field names.
+		if _, err := r.vec(); err != nil {
+			return 0, false, err
+		}
+		if _, err := r.vec(); err != nil {
+			return 0, false, err
+		}
+		kind, err := r.byte()
+		if err != nil {
+			return 0, false, err
+		}
+		switch kind {
+		case wasmImportKindFunc:
+			_, err = r.u32()
+		case wasmImportKindTable:
+			if _, err = r.byte(); err == nil {
+				err = r.skipLimits()
+			}
+		case wasmImportKindMemory:
+			hasMemory = true
+			err = r.skipLimits()
+		case wasmImportKindGlobal:
+			numGlobals++
+			err = r.skip(2)
+		default:
+			err = fmt.Errorf("unsupported import kind: %d", kind)
+		}
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	return numGlobals, hasMemory, nil
+}
+
+// wasmSectionOrder returns a number that orders the section with the provided ID among
+// the (non-custom) sections of a module.
+func wasmSectionOrder(id byte) int {
+	if id == wasmSectionDataCount {
+		// The data count section goes between the element and code sections.
+		return 2*wasmSectionCode - 1
+	}
+	return 2 * int(id)
+}
+
+// appendToVec appends n elements (encoded by appendElems) to the encoded vector vec.
+func appendToVec(vec []byte, n uint32, appendElems func([]byte) []byte) ([]byte, error) {
+	r := wasmReader{b: vec}
+	count, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	out := appendU32(nil, count+n)
+	out = append(out, vec[r.pos:]...)
+	return appendElems(out), nil
+}
+
+func appendName(b []byte, name string) []byte {
+	b = appendU32(b, uint32(len(name)))
+	return append(b, name...)
+}
+
+func appendU32(b []byte, v uint32) []byte {
+	for {
+		c := byte(v & 0x7F)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func appendS64(b []byte, v int64) []byte {
+	for {
+		c := byte(v & 0x7F)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// wasmReader decodes the binary format of WASM modules.
+type wasmReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *wasmReader) done() bool {
+	return r.pos >= len(r.b)
+}
+
+func (r *wasmReader) byte() (byte, error) {
+	if r.done() {
+		return 0, errUnexpectedEOF
+	}
+	r.pos++
+	return r.b[r.pos-1], nil
+}
+
+func (r *wasmReader) skip(n int) error {
+	if len(r.b)-r.pos < n {
+		return errUnexpectedEOF
+	}
+	r.pos += n
+	return nil
+}
+
+// leb reads an (unsigned or signed) LEB128 encoded integer of up to 64 bits, and returns
+// its low 32 bits interpreted as unsigned.
+func (r *wasmReader) leb() (uint32, error) {
+	var v uint64
+	for shift := 0; shift < 70; shift += 7 {
+		c, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint64(c&0x7F) << shift
+		if c&0x80 == 0 {
+			return uint32(v), nil
+		}
+	}
+	return 0, errors.New("LEB128 integer is too long")
+}
+
+func (r *wasmReader) u32() (uint32, error) {
+	return r.leb()
+}
+
+// vec reads a vector of bytes that is prefixed with its length.
+func (r *wasmReader) vec() ([]byte, error) {
+	n, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	start := r.pos
+	if err := r.skip(int(n)); err != nil {
+		return nil, err
+	}
+	return r.b[start:r.pos], nil
+}
+
+func (r *wasmReader) skipLimits() error {
+	flags, err := r.byte()
+	if err != nil {
+		return err
+	}
+	if _, err := r.leb(); err != nil {
+		return err
+	}
+	if flags&1 != 0 {
+		_, err = r.leb()
+	}
+	return err
+}
+
+func (r *wasmReader) skipMemArg() error {
+	align, err := r.u32()
+	if err != nil {
+		return err
+	}
+	if align&0x40 != 0 {
+		// Multiple memories: the alignment is followed by the memory index.
+		if _, err := r.u32(); err != nil {
+			return err
+		}
+	}
+	_, err = r.leb()
+	return err
+}
+
+func (r *wasmReader) skipLEBs(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := r.leb(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipImmediates skips the immediate arguments of the instruction with opcode op.
+func (r *wasmReader) skipImmediates(op byte) error {
+	switch {
+	case op == 0x02 || op == wasmOpLoop || op == wasmOpIf:
+		// Block types are either a single byte (empty or a value type) or a (positive)
+		// type index encoded as a signed LEB128 integer, so both can be skipped alike.
+		_, err := r.leb()
+		return err
+	case op == 0x0C || op == 0x0D || op == 0x10 || op == 0x12 ||
+		(op >= 0x20 && op <= 0x26) || op == 0x3F || op == 0x40 ||
+		op == 0x41 || op == 0x42 || op == 0xD0 || op == 0xD2:
+		// Branches, calls, variable and table accesses, memory.size/grow, integer
+		// constants, ref.null and ref.func all have a single LEB128 immediate.
+		_, err := r.leb()
+		return err
+	case op == 0x0E:
+		// br_table.
+		n, err := r.u32()
+		if err != nil {
+			return err
+		}
+		return r.skipLEBs(int(n) + 1)
+	case op == 0x11 || op == 0x13:
+		// call_indirect and return_call_indirect.
+		return r.skipLEBs(2)
+	case op == 0x1C:
+		// Typed select.
+		n, err := r.u32()
+		if err != nil {
+			return err
+		}
+		return r.skip(int(n))
+	case op >= 0x28 && op <= 0x3E:
+		return r.skipMemArg()
+	case op == 0x43:
+		return r.skip(4)
+	case op == 0x44:
+		return r.skip(8)
+	case op == 0xFC:
+		return r.skipMiscImmediates()
+	case op == 0xFD:
+		return r.skipSIMDImmediates()
+	case op == 0x00 || op == 0x01 || op == 0x05 || op == wasmOpEnd || op == 0x0F ||
+		op == 0x1A || op == 0x1B || (op >= 0x45 && op <= 0xC4) || op == 0xD1:
+		return nil
+	default:
+		return errors.New("unsupported opcode")
+	}
+}
+
+// skipMiscImmediates skips the immediates of the instructions with the 0xFC prefix
+// (saturating truncations, bulk memory and table instructions).
+func (r *wasmReader) skipMiscImmediates() error {
+	op, err := r.u32()
+	if err != nil {
+		return err
+	}
+	switch {
+	case op <= 7:
+		return nil
+	case op == 8 || op == 10 || op == 12 || op == 14:
+		return r.skipLEBs(2)
+	case op <= 17:
+		return r.skipLEBs(1)
+	default:
+		return fmt.Errorf("unsupported opcode: 0xfc %d", op)
+	}
+}
+
+// skipSIMDImmediates skips the immediates of the instructions with the 0xFD prefix.
+func (r *wasmReader) skipSIMDImmediates() error {
+	op, err := r.u32()
+	if err != nil {
+		return err
+	}
+	switch {
+	case op <= 11 || op == 92 || op == 93:
+		return r.skipMemArg()
+	case op == 12 || op == 13:
+		return r.skip(16)
+	case op >= 21 && op <= 34:
+		return r.skip(1)
+	case op >= 84 && op <= 91:
+		if err := r.skipMemArg(); err != nil {
+			return err
+		}
+		return r.skip(1)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,169 @@
+package durablewazero
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/richardartoul/nola/durable"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/wapc/wapc-go"
+	"github.com/wapc/wapc-go/engines/wazero"
+)
+
+// ErrFuelExhausted is returned (wrapped) by invocations that run out of fuel before
+// they complete.
+var ErrFuelExhausted = errors.New("fuel exhausted")
+
+// interruptsCtxKey is the key that is used to store/retrieve whether modules should be
+// compiled with interrupts from the context.
+type interruptsCtxKey struct{}
+
+// fuelCtxKey is the key that is used to store/retrieve the per-invocation fuelGauge
+// from the context.
+type fuelCtxKey struct{}
+
+type fuelGauge struct {
+	sync.Mutex
+	remaining int64
+	// global is the fuel global of the instance that is running the invocation, if it's
+	// running. It holds the fuel that remains while the invocation runs.
+	global api.Global
+}
+
+// WithInterrupts returns a context that must be passed to NewModule for invocations of
+// the module to be interruptible. Invocations of modules compiled with interrupts:
+//
+//   - Consume one unit of fuel on every WASM function call and on every iteration of
+//     every loop, and fail with ErrFuelExhausted once the fuel provided to the invocation
+//     with WithFuel is exhausted.
+//   - Fail with the context's error once the invocation's context is done, instead of
+//     continuing to run in the background.
+//
+// Interrupts are checked at the start of every function and every loop iteration (see
+// instrumentInterrupts), so even modules that spin in a loop without calling any
+// function are interrupted. The checks add overhead to every function call and loop
+// iteration so they should only be enabled for modules that need them. Note that
+// invocations that are blocked in a host function are only interrupted once it returns.
+func WithInterrupts(ctx context.Context) context.Context {
+	return context.WithValue(ctx, interruptsCtxKey{}, true)
+}
+
+// WithFuel returns a context that limits invocations of modules compiled with
+// interrupts to the provided amount of fuel. Invocations with a context that has no fuel
+// are not limited.
+func WithFuel(ctx context.Context, fuel int64) context.Context {
+	return context.WithValue(ctx, fuelCtxKey{}, &fuelGauge{remaining: fuel})
+}
+
+// RemainingFuel returns the fuel remaining for the invocation associated with the
+// provided context. The second return value is false if the invocation is not limited.
+func RemainingFuel(ctx context.Context) (int64, bool) {
+	g, ok := ctx.Value(fuelCtxKey{}).(*fuelGauge)
+	if !ok {
+		return 0, false
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	remaining := g.remaining
+	if g.global != nil {
+		remaining = int64(g.global.Get())
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, true
+}
+
+func interruptsFromContext(ctx context.Context) bool {
+	interrupts, _ := ctx.Value(interruptsCtxKey{}).(bool)
+	return interrupts
+}
+
+// interruptGlobals are the globals of an instance of a module that was instrumented by
+// instrumentInterrupts.
+type interruptGlobals struct {
+	fuel      api.MutableGlobal
+	interrupt api.MutableGlobal
+}
+
+func newInterruptGlobals(instance wapc.Instance) (*interruptGlobals, error) {
+	var (
+		module         = instance.(*wazero.Instance).UnwrapModule()
+		fuel, ok1      = module.ExportedGlobal(fuelGlobalName).(api.MutableGlobal)
+		interrupt, ok2 = module.ExportedGlobal(interruptGlobalName).(api.MutableGlobal)
+	)
+	if !ok1 || !ok2 {
+		return nil, errors.New("instance does not export the interrupt globals")
+	}
+	return &interruptGlobals{fuel: fuel, interrupt: interrupt}, nil
+}
+
+// invoke calls fn (which must run the invocation on the instance that the globals belong
+// to) with the fuel of the invocation in ctx, and interrupts it once ctx is done.
+func (g *interruptGlobals) invoke(
+	ctx context.Context,
+	fn func() ([]byte, error),
+) ([]byte, error) {
+	gauge, limited := ctx.Value(fuelCtxKey{}).(*fuelGauge)
+	fuel := int64(math.MaxInt64)
+	if limited {
+		gauge.Lock()
+		fuel = gauge.remaining
+		gauge.global = g.fuel
+		gauge.Unlock()
+	}
+	g.fuel.Set(uint64(fuel))
+	g.interrupt.Set(0)
+
+	// The interrupt global is the only state that is shared with the goroutine that
+	// interrupts the invocation, and it's only written by that goroutine while the
+	// invocation runs.
+	var (
+		doneCh        = make(chan struct{})
+		interruptedCh = make(chan bool, 1)
+	)
+	if ctxDone := ctx.Done(); ctxDone != nil {
+		go func() {
+			select {
+			case <-ctxDone:
+				g.interrupt.Set(interruptValue)
+				interruptedCh <- true
+			case <-doneCh:
+				interruptedCh <- false
+			}
+		}()
+	} else {
+		interruptedCh <- false
+	}
+
+	result, err := fn()
+	close(doneCh)
+	interrupted := <-interruptedCh
+
+	remaining := int64(g.fuel.Get())
+	if limited {
+		gauge.Lock()
+		gauge.remaining = remaining
+		gauge.global = nil
+		gauge.Unlock()
+	}
+
+	switch {
+	case err == nil:
+		return result, nil
+	case interrupted:
+		return nil, fmt.Errorf("invocation interrupted: %w, err: %v", ctx.Err(), err)
+	case remaining < 0:
+		return nil, &durable.TrapError{
+			Reason: ErrFuelExhausted.Error(),
+			Err:    fmt.Errorf("%w: fuel: %d, err: %v", ErrFuelExhausted, fuel, err),
+		}
+	default:
+		return nil, err
+	}
+}
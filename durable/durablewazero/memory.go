@@ -0,0 +1,91 @@
+package durablewazero
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/richardartoul/nola/durable"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/assemblyscript"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	wapcwazero "github.com/wapc/wapc-go/engines/wazero"
+)
+
+// ErrMemoryLimitExceeded is returned (wrapped) by invocations that fail because the
+// instance tried to grow its memory beyond the limit provided with WithMemoryLimit.
+var ErrMemoryLimitExceeded = errors.New("memory limit exceeded")
+
+// memoryLimitCtxKey is the key that is used to store/retrieve the memory limit from the
+// context.
+type memoryLimitCtxKey struct{}
+
+// WithMemoryLimit returns a context that makes NewModule limit the linear memory of every
+// instance of the module to the provided number of 64KiB pages. The engine passed to
+// NewModule is replaced by a wazero engine whose runtime enforces the limit, and modules
+// that declare a minimum or maximum memory size larger than the limit fail to compile.
+//
+// The limit is enforced by failing the guest's attempts to grow its memory beyond it,
+// which makes guest allocators trap. Since there is no way to observe the failed
+// memory.grow itself, traps that happen once an instance's memory is larger than half
+// of the limit are reported as ErrMemoryLimitExceeded: allocators grow memory
+// geometrically so by then the next growth is the one that was refused.
+func WithMemoryLimit(ctx context.Context, pages uint32) context.Context {
+	return context.WithValue(ctx, memoryLimitCtxKey{}, pages)
+}
+
+func memoryLimitFromContext(ctx context.Context) uint32 {
+	pages, _ := ctx.Value(memoryLimitCtxKey{}).(uint32)
+	return pages
+}
+
+// newRuntimeWithMemoryLimit is the same as wapcwazero.DefaultRuntime, except the
+// runtime limits the memory of every instance to the provided number of pages.
+func newRuntimeWithMemoryLimit(pages uint32) wapcwazero.NewRuntime {
+	return func(ctx context.Context) (wazero.Runtime, error) {
+		r := wazero.NewRuntimeWithConfig(
+			ctx, wazero.NewRuntimeConfig().WithMemoryLimitPages(pages))
+
+		if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+			_ = r.Close(ctx)
+			return nil, err
+		}
+
+		envBuilder := r.NewHostModuleBuilder("env")
+		assemblyscript.NewFunctionExporter().WithAbortMessageDisabled().ExportFunctions(envBuilder)
+		if _, err := envBuilder.Instantiate(ctx, r); err != nil {
+			_ = r.Close(ctx)
+			return nil, err
+		}
+		return r, nil
+	}
+}
+
+// maybeMemoryLimitExceeded wraps err with ErrMemoryLimitExceeded if it is a trap that
+// was (most likely) caused by the instance running into its memory limit. See
+// WithMemoryLimit for details.
+func maybeMemoryLimitExceeded(err error, memoryBytes uint32, limitPages uint32) error {
+	if err == nil || limitPages == 0 || !isUnreachableTrap(err) {
+		return err
+	}
+	if uint64(memoryBytes)/wasmPageSize*2 <= uint64(limitPages) {
+		return err
+	}
+	return &durable.TrapError{
+		Reason: ErrMemoryLimitExceeded.Error(),
+		Err: fmt.Errorf(
+			"%w: limit: %d pages, memory: %d pages, err: %v",
+			ErrMemoryLimitExceeded, limitPages, memoryBytes/wasmPageSize, err),
+	}
+}
+
+// isUnreachableTrap returns whether err is the result of the guest executing the
+// unreachable instruction, which is what guest programs do when they abort.
+func isUnreachableTrap(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if err.Error() == "unreachable" {
+			return true
+		}
+	}
+	return false
+}
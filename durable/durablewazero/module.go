@@ -8,12 +8,15 @@ import (
 
 	"github.com/richardartoul/nola/durable"
 	"github.com/wapc/wapc-go"
+	wapcwazero "github.com/wapc/wapc-go/engines/wazero"
 )
 
 type module struct {
 	sync.Mutex
-	m         wapc.Module
-	instances map[string]wapc.Instance
+	m                wapc.Module
+	instances        map[string]wapc.Instance
+	memoryLimitPages uint32
+	interrupts       bool
 }
 
 func NewModule(
@@ -22,18 +25,40 @@ func NewModule(
 	host func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error),
 	guestModuleBytes []byte,
 ) (durable.Module, error) {
-	m, err := engine.New(ctx, host, guestModuleBytes, &wapc.ModuleConfig{
-		Logger: wapc.PrintlnLogger,
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
-	})
+	var (
+		config = &wapc.ModuleConfig{
+			Logger: wapc.PrintlnLogger,
+			Stdout: os.Stdout,
+			Stderr: os.Stderr,
+		}
+		m                wapc.Module
+		err              error
+		memoryLimitPages = memoryLimitFromContext(ctx)
+		interrupts       = interruptsFromContext(ctx)
+	)
+	if interrupts {
+		guestModuleBytes, err = instrumentInterrupts(guestModuleBytes)
+		if err != nil {
+			return nil, fmt.Errorf("error instrumenting module for interrupts: %w", err)
+		}
+	}
+	if memoryLimitPages > 0 {
+		engine = wapcwazero.EngineWithRuntime(newRuntimeWithMemoryLimit(memoryLimitPages))
+	}
+	if dir, ok := ctx.Value(compilationCacheCtxKey{}).(string); ok && dir != "" {
+		m, err = newModuleWithCompilationCache(ctx, dir, engine, host, guestModuleBytes, config)
+	} else {
+		m, err = engine.New(ctx, host, guestModuleBytes, config)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error creating new wazero module from engine: %w", err)
 	}
 
 	return &module{
-		m:         m,
-		instances: make(map[string]wapc.Instance),
+		m:                m,
+		instances:        make(map[string]wapc.Instance),
+		memoryLimitPages: memoryLimitPages,
+		interrupts:       interrupts,
 	}, nil
 }
 
@@ -49,17 +74,33 @@ func (m *module) Instantiate(
 		return nil, fmt.Errorf("instance with ID: %s already exists", id)
 	}
 
-	instance, err := m.m.Instantiate(ctx)
+	var (
+		instance wapc.Instance
+		err      error
+	)
+	if fsys, ok := durable.FSFromContext(ctx); ok {
+		instance, err = instantiateWithFS(ctx, m.m, fsys)
+	} else {
+		instance, err = m.m.Instantiate(ctx)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("module: error instantiating instance: %w", err)
 	}
+	var globals *interruptGlobals
+	if m.interrupts {
+		globals, err = newInterruptGlobals(instance)
+		if err != nil {
+			instance.Close(ctx)
+			return nil, fmt.Errorf("module: error instantiating instance: %w", err)
+		}
+	}
 	m.instances[id] = instance
 
 	return newObject(instance, func() {
 		m.Lock()
 		defer m.Unlock()
 		delete(m.instances, id)
-	}), nil
+	}, m.memoryLimitPages, globals), nil
 }
 
 func (d *module) Close(ctx context.Context) error {
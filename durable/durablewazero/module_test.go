@@ -4,10 +4,17 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/richardartoul/nola/durable"
 	"github.com/stretchr/testify/require"
 	"github.com/wapc/wapc-go/engines/wazero"
 )
@@ -76,6 +83,330 @@ func TestDurable(t *testing.T) {
 	require.Equal(t, int64(2), getCount(t, result))
 }
 
+func TestFuel(t *testing.T) {
+	ctx := context.Background()
+
+	module, err := NewModule(WithInterrupts(ctx), wazero.Engine(), testHost, utilWasmBytes)
+	require.NoError(t, err)
+	defer func() {
+		panicIfErr(module.Close(ctx))
+	}()
+
+	object, err := module.Instantiate(ctx, "a")
+	require.NoError(t, err)
+	defer object.Close(ctx)
+
+	// Invocations without fuel are not limited.
+	_, ok := RemainingFuel(ctx)
+	require.False(t, ok)
+	result, err := object.Invoke(ctx, "inc", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	// Invocations with enough fuel succeed and consume some of it.
+	fuelCtx := WithFuel(ctx, 1_000_000)
+	result, err = object.Invoke(fuelCtx, "inc", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), getCount(t, result))
+	remaining, ok := RemainingFuel(fuelCtx)
+	require.True(t, ok)
+	require.Less(t, remaining, int64(1_000_000))
+	require.Greater(t, remaining, int64(0))
+
+	// Invocations that run out of fuel fail with ErrFuelExhausted.
+	fuelCtx = WithFuel(ctx, 1)
+	_, err = object.Invoke(fuelCtx, "inc", nil)
+	require.ErrorIs(t, err, ErrFuelExhausted)
+	remaining, ok = RemainingFuel(fuelCtx)
+	require.True(t, ok)
+	require.Equal(t, int64(0), remaining)
+}
+
+func TestMemoryLimit(t *testing.T) {
+	ctx := context.Background()
+
+	// The util module's memory starts out at 2 pages.
+	_, err := NewModule(WithMemoryLimit(ctx, 1), wazero.Engine(), testHost, utilWasmBytes)
+	require.Error(t, err)
+
+	module, err := NewModule(WithMemoryLimit(ctx, 64), wazero.Engine(), testHost, utilWasmBytes)
+	require.NoError(t, err)
+	defer func() {
+		panicIfErr(module.Close(ctx))
+	}()
+
+	object, err := module.Instantiate(ctx, "a")
+	require.NoError(t, err)
+	defer object.Close(ctx)
+
+	// Invocations that fit within the limit succeed.
+	result, err := object.Invoke(ctx, "echo", make([]byte, 1<<20))
+	require.NoError(t, err)
+	require.Len(t, result, 1<<20)
+
+	// Invocations that need more memory than the limit fail with ErrMemoryLimitExceeded.
+	_, err = object.Invoke(ctx, "echo", make([]byte, 4<<20))
+	require.ErrorIs(t, err, ErrMemoryLimitExceeded)
+	trapErr, ok := durable.AsTrapError(err)
+	require.True(t, ok)
+	require.Equal(t, ErrMemoryLimitExceeded.Error(), trapErr.Reason)
+}
+
+// TestTrap ensures that traps are reported as durable.TrapError, but errors returned
+// by the module are not.
+func TestTrap(t *testing.T) {
+	ctx := context.Background()
+
+	module, err := NewModule(WithInterrupts(ctx), wazero.Engine(), testHost, utilWasmBytes)
+	require.NoError(t, err)
+	defer func() {
+		panicIfErr(module.Close(ctx))
+	}()
+
+	object, err := module.Instantiate(ctx, "a")
+	require.NoError(t, err)
+	defer object.Close(ctx)
+
+	_, err = object.Invoke(ctx, "fail", nil)
+	require.Error(t, err)
+	_, ok := durable.AsTrapError(err)
+	require.False(t, ok)
+
+	_, err = object.Invoke(WithFuel(ctx, 1), "inc", nil)
+	require.ErrorIs(t, err, ErrFuelExhausted)
+	trapErr, ok := durable.AsTrapError(err)
+	require.True(t, ok)
+	require.NotEmpty(t, trapErr.Reason)
+	require.NotContains(t, trapErr.Reason, "wasm stack trace")
+}
+
+func TestInterruptOnContextDone(t *testing.T) {
+	ctx := context.Background()
+
+	// The host function outlives the invocation's deadline, but returns successfully so
+	// the guest continues running after its context is done.
+	slowHost := func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
+		time.Sleep(50 * time.Millisecond)
+		return []byte("ok"), nil
+	}
+
+	for _, interrupts := range []bool{false, true} {
+		compileCtx := ctx
+		if interrupts {
+			compileCtx = WithInterrupts(ctx)
+		}
+		module, err := NewModule(compileCtx, wazero.Engine(), slowHost, utilWasmBytes)
+		require.NoError(t, err)
+
+		object, err := module.Instantiate(ctx, "a")
+		require.NoError(t, err)
+
+		invokeCtx, cc := context.WithTimeout(ctx, 10*time.Millisecond)
+		_, err = object.Invoke(invokeCtx, "invokeActor", []byte("{}"))
+		cc()
+		if interrupts {
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+		} else {
+			require.NoError(t, err)
+		}
+
+		require.NoError(t, object.Close(ctx))
+		require.NoError(t, module.Close(ctx))
+	}
+}
+
+// spinWasmBytes is a waPC module whose only operation spins forever in a loop that
+// doesn't call any function:
+//
+//	(module
+//	  (memory (export "memory") 1)
+//	  (func (export "__guest_call") (param i32 i32) (result i32)
+//	    (loop $spin (br $spin))
+//	    (i32.const 0)))
+var spinWasmBytes = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// Type section: (func (param i32 i32) (result i32)).
+	0x01, 0x07, 0x01, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7f,
+	// Function section.
+	0x03, 0x02, 0x01, 0x00,
+	// Memory section.
+	0x05, 0x03, 0x01, 0x00, 0x01,
+	// Export section: "__guest_call" and "memory".
+	0x07, 0x19, 0x02,
+	0x0c, 0x5f, 0x5f, 0x67, 0x75, 0x65, 0x73, 0x74, 0x5f, 0x63, 0x61, 0x6c, 0x6c, 0x00, 0x00,
+	0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00,
+	// Code section.
+	0x0a, 0x0b, 0x01, 0x09, 0x00, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x41, 0x00, 0x0b,
+}
+
+// TestInterruptLoop ensures that invocations that spin in a loop without calling any
+// function are interrupted, both by running out of fuel and by their context being done.
+func TestInterruptLoop(t *testing.T) {
+	ctx := context.Background()
+
+	module, err := NewModule(WithInterrupts(ctx), wazero.Engine(), testHost, spinWasmBytes)
+	require.NoError(t, err)
+	defer func() {
+		panicIfErr(module.Close(ctx))
+	}()
+
+	object, err := module.Instantiate(ctx, "a")
+	require.NoError(t, err)
+	defer object.Close(ctx)
+
+	fuelCtx := WithFuel(ctx, 1000)
+	_, err = object.Invoke(fuelCtx, "spin", nil)
+	require.ErrorIs(t, err, ErrFuelExhausted)
+	remaining, ok := RemainingFuel(fuelCtx)
+	require.True(t, ok)
+	require.Equal(t, int64(0), remaining)
+
+	invokeCtx, cc := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cc()
+	start := time.Now()
+	_, err = object.Invoke(invokeCtx, "spin", nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	_, ok = durable.AsTrapError(err)
+	require.False(t, ok)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestCompilationCache(t *testing.T) {
+	var (
+		ctx = context.Background()
+		dir = t.TempDir()
+	)
+
+	listEntries := func() []string {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+
+	invokeInc := func(compileCtx context.Context, moduleBytes []byte) {
+		module, err := NewModule(
+			WithCompilationCache(compileCtx, dir), wazero.Engine(), testHost, moduleBytes)
+		require.NoError(t, err)
+		object, err := module.Instantiate(ctx, "a")
+		require.NoError(t, err)
+		result, err := object.Invoke(ctx, "inc", nil)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), getCount(t, result))
+		require.NoError(t, object.Close(ctx))
+		require.NoError(t, module.Close(ctx))
+	}
+
+	// The first compilation should publish an entry (and no staging directories should
+	// be left behind).
+	invokeInc(ctx, utilWasmBytes)
+	entries := listEntries()
+	require.Len(t, entries, 1)
+	require.False(t, strings.HasPrefix(entries[0], "staging-"))
+
+	// Subsequent compilations of the same bytes should reuse it.
+	invokeInc(ctx, utilWasmBytes)
+	require.Equal(t, entries, listEntries())
+
+	// Changing the module bytes or the compilation options should create new entries.
+	modified := append(append([]byte(nil), utilWasmBytes...), 0, 4, 2, 'a', 'b', 0)
+	invokeInc(ctx, modified)
+	require.Len(t, listEntries(), 2)
+	invokeInc(WithInterrupts(ctx), utilWasmBytes)
+	require.Len(t, listEntries(), 3)
+
+	// Corrupted entries should be replaced instead of failing compilation.
+	var numCorrupted int
+	require.NoError(t, filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		numCorrupted++
+		return os.WriteFile(path, []byte("garbage"), 0o644)
+	}))
+	require.Equal(t, 3, numCorrupted)
+	invokeInc(ctx, utilWasmBytes)
+	require.Len(t, listEntries(), 3)
+}
+
+// TestInstantiateWithFS ensures that the file system provided with durable.WithFS is
+// mounted into the instance that is being instantiated, and only that instance.
+func TestInstantiateWithFS(t *testing.T) {
+	ctx := context.Background()
+
+	module, err := NewModule(ctx, wazero.Engine(), testHost, utilWasmBytes)
+	require.NoError(t, err)
+	defer func() {
+		panicIfErr(module.Close(ctx))
+	}()
+
+	fsA, fsB := &testFS{dir: t.TempDir()}, &testFS{dir: t.TempDir()}
+	for id, fsys := range map[string]*testFS{"a": fsA, "b": fsB, "c": nil} {
+		instantiateCtx := ctx
+		if fsys != nil {
+			instantiateCtx = durable.WithFS(ctx, fsys)
+		}
+		object, err := module.Instantiate(instantiateCtx, id)
+		require.NoError(t, err)
+		defer object.Close(ctx)
+
+		result, err := object.Invoke(ctx, "inc", nil)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), getCount(t, result))
+	}
+	// wazero opens the root of the file system when the instance is created.
+	require.Equal(t, []string{"."}, fsA.getOpened())
+	require.Equal(t, []string{"."}, fsB.getOpened())
+}
+
+// testFS is a durable.FS backed by a directory that records which files are opened.
+type testFS struct {
+	sync.Mutex
+	dir    string
+	opened []string
+}
+
+func (f *testFS) Open(name string) (fs.File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f *testFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	f.Lock()
+	f.opened = append(f.opened, name)
+	f.Unlock()
+	return os.OpenFile(filepath.Join(f.dir, name), flag, perm)
+}
+
+func (f *testFS) Mkdir(name string, perm fs.FileMode) error {
+	return os.Mkdir(filepath.Join(f.dir, name), perm)
+}
+
+func (f *testFS) Rename(from, to string) error {
+	return os.Rename(filepath.Join(f.dir, from), filepath.Join(f.dir, to))
+}
+
+func (f *testFS) Rmdir(name string) error {
+	return os.Remove(filepath.Join(f.dir, name))
+}
+
+func (f *testFS) Unlink(name string) error {
+	return os.Remove(filepath.Join(f.dir, name))
+}
+
+func (f *testFS) Utimes(name string, atimeSec, atimeNsec, mtimeSec, mtimeNsec int64) error {
+	return os.Chtimes(
+		filepath.Join(f.dir, name), time.Unix(atimeSec, atimeNsec), time.Unix(mtimeSec, mtimeNsec))
+}
+
+func (f *testFS) getOpened() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string(nil), f.opened...)
+}
+
 func testHost(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
 	return nil, fmt.Errorf(
 		"testHotNotImplemented [%s::%s::%s::%s)",
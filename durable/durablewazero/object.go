@@ -3,31 +3,45 @@ package durablewazero
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 	"sync"
 
+	"github.com/richardartoul/nola/durable"
+
 	"github.com/wapc/wapc-go"
 	"github.com/wapc/wapc-go/engines/wazero"
 )
 
 const (
 	wasmPageSize = 1 << 16
+	// wasmStackTraceSeparator separates the reason of wazero's traps from their stack
+	// trace.
+	wasmStackTraceSeparator = "\nwasm stack trace:"
 )
 
 type object struct {
 	sync.Mutex
-	instance wapc.Instance
-	onClose  func()
+	instance         wapc.Instance
+	onClose          func()
+	memoryLimitPages uint32
+	// interrupts is nil unless the module was compiled with interrupts.
+	interrupts *interruptGlobals
 }
 
 func newObject(
 	instance wapc.Instance,
 	onClose func(),
+	memoryLimitPages uint32,
+	interrupts *interruptGlobals,
 ) *object {
 	return &object{
-		instance: instance,
-		onClose:  onClose,
+		instance:         instance,
+		onClose:          onClose,
+		memoryLimitPages: memoryLimitPages,
+		interrupts:       interrupts,
 	}
 }
 
@@ -39,8 +53,58 @@ func (o *object) Invoke(
 	o.Lock()
 	defer o.Unlock()
 
+	if o.interrupts == nil {
+		return o.invokeWithLock(ctx, operation, payload)
+	}
+	return o.interrupts.invoke(ctx, func() ([]byte, error) {
+		return o.invokeWithLock(ctx, operation, payload)
+	})
+}
+
+func (o *object) invokeWithLock(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+) ([]byte, error) {
 	// TODO: Make byte ownership more clear?
-	return o.instance.Invoke(ctx, operation, payload)
+	result, err := o.instance.Invoke(ctx, operation, payload)
+	err = maybeTrap(err)
+	if err != nil && o.memoryLimitPages > 0 {
+		if memory := o.instance.(*wazero.Instance).UnwrapModule().Memory(); memory != nil {
+			err = maybeMemoryLimitExceeded(err, memory.Size(), o.memoryLimitPages)
+		}
+	}
+	return result, err
+}
+
+// MemorySize implements durable.MemorySizer.
+func (o *object) MemorySize() uint64 {
+	o.Lock()
+	defer o.Unlock()
+
+	memory := o.instance.(*wazero.Instance).UnwrapModule().Memory()
+	if memory == nil {
+		return 0
+	}
+	return uint64(memory.Size())
+}
+
+// maybeTrap wraps err with durable.TrapError if the invocation was aborted by wazero
+// instead of returning an error. Invocations that were interrupted because their context
+// was done are not considered traps.
+func maybeTrap(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	for curr := err; curr != nil; curr = errors.Unwrap(curr) {
+		// wazero reports traps (and panics in host functions) with the WASM stack trace
+		// appended to the reason.
+		reason, _, ok := strings.Cut(curr.Error(), wasmStackTraceSeparator)
+		if ok {
+			return &durable.TrapError{Reason: reason, Err: err}
+		}
+	}
+	return err
 }
 
 // TODO: Make this resilient to double-close.
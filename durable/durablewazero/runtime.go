@@ -0,0 +1,38 @@
+package durablewazero
+
+import (
+	"context"
+
+	"github.com/richardartoul/nola/durable"
+	"github.com/wapc/wapc-go/engines/wazero"
+)
+
+type wazeroRuntime struct{}
+
+// NewRuntime returns a durable.WASMRuntime backed by wazero. It supports all the
+// durable.CompileOptions.
+func NewRuntime() durable.WASMRuntime {
+	return wazeroRuntime{}
+}
+
+func (r wazeroRuntime) Name() string {
+	return "wazero"
+}
+
+func (r wazeroRuntime) Compile(
+	ctx context.Context,
+	host durable.HostFn,
+	moduleBytes []byte,
+	opts durable.CompileOptions,
+) (durable.Module, error) {
+	if opts.Interrupts {
+		ctx = WithInterrupts(ctx)
+	}
+	if opts.CompilationCacheDir != "" {
+		ctx = WithCompilationCache(ctx, opts.CompilationCacheDir)
+	}
+	if opts.MemoryLimitPages > 0 {
+		ctx = WithMemoryLimit(ctx, opts.MemoryLimitPages)
+	}
+	return NewModule(ctx, wazero.Engine(), host, moduleBytes)
+}
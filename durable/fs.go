@@ -0,0 +1,45 @@
+package durable
+
+import (
+	"context"
+	"io/fs"
+)
+
+// FS is a writable file system that can be mounted into the WASI context of an Object
+// with WithFS. Paths are slash-separated and relative to the root of the file system
+// (they're always valid according to fs.ValidPath). The semantics of the methods are
+// the same as their counterparts in the os package.
+type FS interface {
+	fs.FS
+
+	// OpenFile is like os.OpenFile. The returned file should implement io.Writer,
+	// io.Seeker and fs.ReadDirFile (for directories) to support the corresponding WASI
+	// functions.
+	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+	// Mkdir is like os.Mkdir.
+	Mkdir(name string, perm fs.FileMode) error
+	// Rename is like os.Rename.
+	Rename(from, to string) error
+	// Rmdir is like syscall.Rmdir.
+	Rmdir(name string) error
+	// Unlink is like syscall.Unlink.
+	Unlink(name string) error
+	// Utimes is like syscall.UtimesNano.
+	Utimes(name string, atimeSec, atimeNsec, mtimeSec, mtimeNsec int64) error
+}
+
+// fsCtxKey is the key that is used to store/retrieve the FS from the context.
+type fsCtxKey struct{}
+
+// WithFS returns a context that makes Module.Instantiate mount fsys as the root ("/")
+// of the WASI file system of the new Object. Runtimes that don't support mounting file
+// systems must return an error from Instantiate when one is provided.
+func WithFS(ctx context.Context, fsys FS) context.Context {
+	return context.WithValue(ctx, fsCtxKey{}, fsys)
+}
+
+// FSFromContext returns the FS that was provided with WithFS, if any.
+func FSFromContext(ctx context.Context) (FS, bool) {
+	fsys, ok := ctx.Value(fsCtxKey{}).(FS)
+	return fsys, ok && fsys != nil
+}
@@ -3,43 +3,107 @@ package virtual
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/richardartoul/nola/durable"
 	"github.com/richardartoul/nola/durable/durablewazero"
 	"github.com/richardartoul/nola/virtual/futures"
 	"github.com/richardartoul/nola/virtual/registry"
 	"github.com/richardartoul/nola/virtual/types"
 	"github.com/richardartoul/nola/wapcutils"
 
-	"github.com/wapc/wapc-go/engines/wazero"
 	"golang.org/x/sync/singleflight"
 )
 
+var (
+	errInvocationTimeout = errors.New("actor invocation timed out")
+	errActivationClosed  = errors.New("actor activation has already been closed")
+	// errActorAlreadyActivated is returned when an actor that is handed off to this
+	// server is already activated here.
+	errActorAlreadyActivated = errors.New("actor is already activated")
+)
+
+// maxInvokeAttemptsOnClosedActivation is the maximum number of times an invocation is
+// attempted if the activation it was routed to is closed concurrently.
+const maxInvokeAttemptsOnClosedActivation = 3
+
+// IsInvocationTimeoutErr returns a boolean indicating whether the error is the result of
+// an actor invocation exceeding EnvironmentOptions.InvokeTimeout.
+func IsInvocationTimeoutErr(err error) bool {
+	return errors.Is(err, errInvocationTimeout)
+}
+
 type activations struct {
 	sync.Mutex
 
 	// State.
+	// _modules only contains Go modules, WASM modules are cached in moduleCache.
 	_modules           map[types.NamespacedID]Module
+	moduleCache        *moduleCache
+	_descriptions      map[types.NamespacedIDNoType]*moduleDescription
 	_actors            map[types.NamespacedActorID]futures.Future[*activatedActor]
 	moduleFetchDeduper singleflight.Group
+	idleDeactivations  atomic.Uint64
+	selfDeactivations  atomic.Uint64
+	memoryLimitTraps   atomic.Uint64
+	leaseRevocations   atomic.Uint64
+	capacityRejections atomic.Uint64
+	mailboxStats       mailboxStats
 	serverState        struct {
 		sync.RWMutex
 		serverID      string
 		serverVersion int64
 	}
+	// _namespaceActivations contains the number of actors (but not workers) in _actors
+	// by namespace.
+	_namespaceActivations map[string]int
 
 	// Dependencies.
-	registry      registry.Registry
-	environment   Environment
-	goModules     map[types.NamespacedIDNoType]Module
-	customHostFns map[string]func([]byte) ([]byte, error)
-	gcActorsAfter time.Duration
+	registry            registry.Registry
+	environment         Environment
+	goModules           map[types.NamespacedIDNoType]Module
+	customHostFns       map[string]func([]byte) ([]byte, error)
+	gcActorsAfter       time.Duration
+	deactivationTimeout time.Duration
+	invokeTimeout       time.Duration
+	maxInvocationDepth  int
+	maxActivations      int
+	fuel                FuelOptions
+	memoryLimits        MemoryLimitOptions
+	wasmRuntime         durable.WASMRuntime
+	compilationCacheDir string
+	logger              *slog.Logger
+	metrics             *actorMetrics
+	fileSystems         *actorFileSystems
+	configs             *namespaceConfigs
+	idempotency         IdempotencyOptions
+	rateLimits          RateLimitOptions
+	recording           RecordingOptions
+	// scheduler is nil if invocations are not limited (see SchedulerOptions).
+	scheduler *invocationScheduler
+	// maxMailboxDepth is the value of EnvironmentOptions.MaxMailboxDepth.
+	maxMailboxDepth int
+	// persistInstantiatePayloads is the value of
+	// EnvironmentOptions.PersistInstantiatePayloads.
+	persistInstantiatePayloads bool
+	// membership is nil unless MembershipOptions.Enabled is set.
+	membership *membershipNotifier
+	quotas     *namespaceQuotas
+	egress     *httpEgress
+	quarantine *actorQuarantine
+	responses  *responseCaches
+	events     *lifecycleBus
+	// stateCompressor is nil if the state of actors is not compressed.
+	stateCompressor *stateCompressor
 }
 
 func newActivations(
@@ -47,20 +111,79 @@ func newActivations(
 	environment Environment,
 	customHostFns map[string]func([]byte) ([]byte, error),
 	gcActorsAfter time.Duration,
+	deactivationTimeout time.Duration,
+	invokeTimeout time.Duration,
+	maxInvocationDepth int,
+	fuel FuelOptions,
+	memoryLimits MemoryLimitOptions,
+	maxCachedModules int,
+	maxActivations int,
+	wasmRuntime durable.WASMRuntime,
+	compilationCacheDir string,
+	logger *slog.Logger,
+	metrics *actorMetrics,
+	fileSystems *actorFileSystems,
+	configs *namespaceConfigs,
+	idempotency IdempotencyOptions,
+	rateLimits RateLimitOptions,
+	persistInstantiatePayloads bool,
+	membership *membershipNotifier,
+	scheduler *invocationScheduler,
+	maxMailboxDepth int,
+	quotas *namespaceQuotas,
+	recording RecordingOptions,
+	egress *httpEgress,
+	quarantine *actorQuarantine,
+	responses *responseCaches,
+	events *lifecycleBus,
+	stateCompressor *stateCompressor,
 ) *activations {
 	if gcActorsAfter < 0 {
 		panic(fmt.Sprintf("[invariant violated] illegal value for gcActorsAfter: %d", gcActorsAfter))
 	}
+	if deactivationTimeout <= 0 {
+		panic(fmt.Sprintf("[invariant violated] illegal value for deactivationTimeout: %d", deactivationTimeout))
+	}
 
 	return &activations{
-		_modules: make(map[types.NamespacedID]Module),
-		_actors:  make(map[types.NamespacedActorID]futures.Future[*activatedActor]),
-
-		registry:      registry,
-		environment:   environment,
-		goModules:     make(map[types.NamespacedIDNoType]Module),
-		customHostFns: customHostFns,
-		gcActorsAfter: gcActorsAfter,
+		_modules:      make(map[types.NamespacedID]Module),
+		moduleCache:   newModuleCache(maxCachedModules),
+		_descriptions: make(map[types.NamespacedIDNoType]*moduleDescription),
+		_actors:       make(map[types.NamespacedActorID]futures.Future[*activatedActor]),
+
+		_namespaceActivations: make(map[string]int),
+
+		registry:            registry,
+		environment:         environment,
+		goModules:           make(map[types.NamespacedIDNoType]Module),
+		customHostFns:       customHostFns,
+		gcActorsAfter:       gcActorsAfter,
+		deactivationTimeout: deactivationTimeout,
+		invokeTimeout:       invokeTimeout,
+		maxInvocationDepth:  maxInvocationDepth,
+		maxActivations:      maxActivations,
+		fuel:                fuel,
+		memoryLimits:        memoryLimits,
+		wasmRuntime:         wasmRuntime,
+		compilationCacheDir: compilationCacheDir,
+		logger:              logger,
+		metrics:             metrics,
+		fileSystems:         fileSystems,
+		configs:             configs,
+		idempotency:         idempotency,
+		rateLimits:          rateLimits,
+		recording:           recording,
+		scheduler:           scheduler,
+		maxMailboxDepth:     maxMailboxDepth,
+
+		persistInstantiatePayloads: persistInstantiatePayloads,
+		membership:                 membership,
+		quotas:                     quotas,
+		egress:                     egress,
+		quarantine:                 quarantine,
+		responses:                  responses,
+		events:                     events,
+		stateCompressor:            stateCompressor,
 	}
 }
 
@@ -74,12 +197,119 @@ func (a *activations) registerGoModule(id types.NamespacedIDNoType, module Modul
 	return nil
 }
 
-// invoke has a lot of manual locking and unlocking. While error prone, this is intentional
+// ActivationStats contains statistics about the actors that are activated in an
+// environment.
+type ActivationStats struct {
+	// NumActivatedActors is the number of actors that are currently activated.
+	NumActivatedActors int
+	// IdleDeactivations is the total number of actors that have been deactivated because
+	// they were not invoked for longer than EnvironmentOptions.ActorIdleTimeout.
+	IdleDeactivations uint64
+	// SelfDeactivations is the total number of actors that have been deactivated because
+	// they requested it with HostCapabilities.DeactivateSelf().
+	SelfDeactivations uint64
+	// MemoryLimitTraps is the total number of actors that have been torn down because
+	// they ran into their memory limit (see EnvironmentOptions.MemoryLimits).
+	MemoryLimitTraps uint64
+	// LeaseRevocations is the total number of actors that have been deactivated because
+	// the server failed to renew their activation lease (see
+	// registry.KVRegistryOptions.ActivationLeaseDuration).
+	LeaseRevocations uint64
+	// MaxActivations is the value of EnvironmentOptions.MaxActivations.
+	MaxActivations int
+	// Utilization is NumActivatedActors divided by MaxActivations, or 0 if MaxActivations
+	// is unlimited.
+	Utilization float64
+	// CapacityRejections is the total number of activations that have been rejected
+	// because the server was at capacity (see EnvironmentOptions.MaxActivations).
+	CapacityRejections uint64
+	// MailboxDepth is the number of invocations that are currently waiting for the
+	// actors they invoke to process the previous invocations, across all actors.
+	MailboxDepth int
+	// MaxMailboxDepth is the value of EnvironmentOptions.MaxMailboxDepth.
+	MaxMailboxDepth int
+	// MailboxRejections is the total number of invocations that have been rejected
+	// because the mailbox of the actor was full (see EnvironmentOptions.MaxMailboxDepth).
+	MailboxRejections uint64
+	// Traps is the total number of invocations that failed because the actor trapped or
+	// panicked.
+	Traps uint64
+	// Quarantines is the total number of times that actors have been quarantined because
+	// they trapped too many times (see EnvironmentOptions.Quarantine).
+	Quarantines uint64
+	// ResponseCacheHits is the total number of invocations of cached operations that
+	// returned a cached response (see EnvironmentOptions.ResponseCache).
+	ResponseCacheHits uint64
+	// ResponseCacheMisses is the total number of invocations of cached operations that
+	// invoked the actor because their response was not cached.
+	ResponseCacheMisses uint64
+	// ResponseCacheHitRatio is ResponseCacheHits divided by the total number of
+	// invocations of cached operations, or 0 if there were none.
+	ResponseCacheHitRatio float64
+	// ResponseCacheInvalidations is the total number of times that the cached responses
+	// of an actor were invalidated by an operation that may modify its state.
+	ResponseCacheInvalidations uint64
+	// LifecycleEventsDropped is the total number of lifecycle events that were dropped
+	// because a subscriber didn't keep up (see Environment.SubscribeLifecycle).
+	LifecycleEventsDropped uint64
+	// StateBytesWritten is the total size of the values that actors have written to their
+	// KV storage since the state of actors is compressed (see
+	// EnvironmentOptions.StateCompression), before they were compressed.
+	StateBytesWritten uint64
+	// StateBytesStored is the total size of the values in StateBytesWritten once they were
+	// compressed.
+	StateBytesStored uint64
+	// StateCompressionRatio is StateBytesStored divided by StateBytesWritten, or 0 if no
+	// values were written. Lower is better.
+	StateCompressionRatio float64
+	// StateValuesCompressed is the number of values in StateBytesWritten that were stored
+	// compressed.
+	StateValuesCompressed uint64
+}
+
+// invoke invokes the operation on the actor, activating it first if necessary. If the
+// actor's activation is closed concurrently (for example because it was idle for too long)
+// then the invocation is retried so that it's served by a new activation instead of
+// failing.
+func (a *activations) invoke(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	operation string,
+	instantiatePayload []byte,
+	invokePayload []byte,
+	isTimer bool,
+) (io.ReadCloser, error) {
+	// Activated actors' modules are always described already, so invocations of
+	// operations that they don't support are rejected here. Otherwise they're rejected
+	// before the actor is instantiated.
+	moduleID := reference.ModuleID()
+	if err := a.cachedDescription(moduleID).validate(moduleID, operation); err != nil {
+		return nil, err
+	}
+	if !isTimer && reference.ActorID().IDType == types.IDTypeActor {
+		if err := a.quotas.admitInvocation(reference.Namespace()); err != nil {
+			return nil, fmt.Errorf("error invoking actor: %v, err: %w", reference, err)
+		}
+	}
+
+	for i := 1; ; i++ {
+		result, err := a.invokeOnce(
+			ctx, reference, operation, instantiatePayload, invokePayload, isTimer)
+		if errors.Is(err, errActivationClosed) && i < maxInvokeAttemptsOnClosedActivation {
+			// Activations are always removed from the map before (or while holding the
+			// activation's lock) they're closed, so retrying will create a new one.
+			continue
+		}
+		return result, err
+	}
+}
+
+// invokeOnce has a lot of manual locking and unlocking. While error prone, this is intentional
 // as we need to avoid holding the lock in certain paths that may end up doing expensive
 // or high latency operations. In addition, we need to ensure that the lock is not held while
 // actor.o.Invoke() is called because it may run for a long time, but also to avoid deadlocks
 // when one actor ends up invoking a function on another actor running in the same environment.
-func (a *activations) invoke(
+func (a *activations) invokeOnce(
 	ctx context.Context,
 	reference types.ActorReferenceVirtual,
 	operation string,
@@ -175,8 +405,8 @@ func (a *activations) invoke(
 	}
 
 	// Something weird happened. Just return an error and let the caller retry.
-	return nil, errors.New(
-		"[invariant violated] actor generation count too low after reactivation, caller should retry")
+	return nil, newRoutingError(errors.New(
+		"[invariant violated] actor generation count too low after reactivation, caller should retry"))
 }
 
 func (a *activations) invokeNotExistWithLock(
@@ -187,8 +417,90 @@ func (a *activations) invokeNotExistWithLock(
 	invokePayload []byte,
 	prevActor *activatedActor,
 ) (io.ReadCloser, error) {
+	actor, err := a.activateWithLock(ctx, reference, operation, instantiatePayload, prevActor, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return actor.invoke(ctx, operation, invokePayload, false, false)
+}
+
+// restore activates the actor with the in-memory state of its previous activation on
+// another server (see HandoffOptions). The actor's wapcutils.RestoreOperationName
+// operation is invoked with state before the activation becomes visible to other
+// invocations, so they wait until it completes instead of observing the actor before
+// its state is restored.
+//
+// An error is returned if the actor is already activated since it may have already
+// served invocations with the state it loaded on startup.
+func (a *activations) restore(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	state []byte,
+) error {
+	a.Lock()
+	if _, ok := a._actors[reference.ActorID()]; ok {
+		a.Unlock()
+		return fmt.Errorf("error restoring actor: %v, err: %w", reference, errActorAlreadyActivated)
+	}
+
+	_, err := a.activateWithLock(ctx, reference, wapcutils.RestoreOperationName, nil, nil, func(actor *activatedActor) error {
+		actor.Lock()
+		defer actor.Unlock()
+		result, err := actor.invokeWithLock(ctx, wapcutils.RestoreOperationName, state, false, nil)
+		if err != nil {
+			return fmt.Errorf("error invoking restore function: %w", err)
+		}
+		return result.Close()
+	})
+	return err
+}
+
+// activateWithLock activates the actor, which must not be in the map already. The lock
+// must be held, and it's released before the actor is instantiated. If onActivated is
+// not nil, it's called with the new activation before the activation becomes visible to
+// other invocations, and the activation fails if it returns an error. The activation
+// also fails, before the actor is instantiated, if the description of its module doesn't
+// list operation (which is the operation that triggered the activation).
+//
+// Activations of new actors fail with an error for which IsServerAtCapacityErr returns
+// true if the server is at capacity (see EnvironmentOptions.MaxActivations), and with an
+// error for which IsNamespaceQuotaExceededErr returns true if the actor's namespace is
+// out of quota (see EnvironmentOptions.NamespaceQuotas). Activations of actors that are
+// quarantined fail with an error for which IsActorQuarantinedErr returns true (see
+// EnvironmentOptions.Quarantine).
+func (a *activations) activateWithLock(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	operation string,
+	instantiatePayload []byte,
+	prevActor *activatedActor,
+	onActivated func(actor *activatedActor) error,
+) (*activatedActor, error) {
+	if err := a.quarantine.check(reference.ActorID()); err != nil {
+		a.Unlock()
+		return nil, fmt.Errorf("error activating actor: %v, err: %w", reference, err)
+	}
+	if prevActor == nil && reference.ActorID().IDType == types.IDTypeActor &&
+		a.maxActivations > 0 && len(a._actors) >= a.maxActivations {
+		// The registry placed the actor here before it learned that the server is at
+		// capacity.
+		a.Unlock()
+		a.capacityRejections.Add(1)
+		return nil, fmt.Errorf(
+			"error activating actor: %v, %d actors are activated: %w",
+			reference, a.maxActivations, errServerAtCapacity)
+	}
+	if prevActor == nil && reference.ActorID().IDType == types.IDTypeActor {
+		namespace := reference.Namespace()
+		if err := a.quotas.admitActivation(namespace, a._namespaceActivations[namespace]); err != nil {
+			a.Unlock()
+			return nil, fmt.Errorf("error activating actor: %v, err: %w", reference, err)
+		}
+	}
+
 	fut := futures.New[*activatedActor]()
-	a._actors[reference.ActorID()] = fut
+	a.putActorWithLock(reference.ActorID(), fut)
 	a.Unlock()
 
 	// GoSync since this goroutine needs to wait anyways.
@@ -207,24 +519,27 @@ func (a *activations) invokeNotExistWithLock(
 				// the future gets cleared from the map so that subsequent
 				// invocations will try to recreate the actor instead of
 				// receiving the same hard-coded over and over again.
-				delete(a._actors, reference.ActorID())
+				a.Lock()
+				a.deleteActorWithLock(reference.ActorID())
+				a.Unlock()
 			}
 		}()
 
-		module, err := a.ensureModule(ctx, reference.ModuleID())
+		timers := newActorTimers()
+		logger := a.logger.With(
+			"namespace", reference.Namespace(),
+			"moduleID", reference.ModuleID().ID,
+			"actorID", reference.ActorID().ID)
+		hostCapabilities := newHostCapabilities(
+			a.registry, a.environment, a, a.customHostFns, reference, a.getServerState, timers,
+			logger, a.metrics, a.configs, a.egress)
+		instantiatePayload, err := a.resolveInstantiatePayload(ctx, reference, instantiatePayload)
 		if err != nil {
-			return nil, fmt.Errorf(
-				"error ensuring module for reference: %v, err: %w",
-				reference, err)
+			return nil, err
 		}
-
-		hostCapabilities := newHostCapabilities(
-			a.registry, a.environment, a, a.customHostFns, reference, a.getServerState)
-		iActor, err := module.Instantiate(ctx, reference, instantiatePayload, hostCapabilities)
+		iActor, err := a.instantiate(ctx, reference, operation, instantiatePayload, hostCapabilities)
 		if err != nil {
-			return nil, fmt.Errorf(
-				"error instantiating actor: %s from module: %s, err: %w",
-				reference.ActorID(), reference.ModuleID(), err)
+			return nil, err
 		}
 		if err := assertActorIface(iActor); err != nil {
 			return nil, fmt.Errorf(
@@ -232,7 +547,7 @@ func (a *activations) invokeNotExistWithLock(
 				reference.ActorID(), reference.ModuleID(), err)
 		}
 
-		onGc := func() {
+		deactivate := func(reason string) {
 			a.Lock()
 			defer a.Unlock()
 
@@ -250,33 +565,156 @@ func (a *activations) invokeNotExistWithLock(
 			}
 
 			// The actor is in the map and the future pointers match so we know its the same
-			// instance of the actor that created this onGc function so we should remove it.
-			delete(a._actors, reference.ActorID())
+			// instance of the actor that created this deactivate function so we should
+			// remove it.
+			a.deleteActorWithLock(reference.ActorID())
+			a.events.publish(LifecycleEventDeactivated, reference.ActorID(), reason)
+		}
+		onDeactivate := func() {
+			deactivate("aborted")
+		}
+		onGc := func() {
+			a.idleDeactivations.Add(1)
+			deactivate("idle")
+		}
+		onMemoryLimitTrap := func() {
+			a.memoryLimitTraps.Add(1)
+			deactivate("memory_limit")
+		}
+		onSelfDeactivate := func() {
+			a.selfDeactivations.Add(1)
+			deactivate("self_deactivation")
+		}
+		onHandoff := func() {
+			deactivate("handoff")
 		}
 		actor, err = a.newActivatedActor(
-			ctx, iActor, reference, hostCapabilities, instantiatePayload, onGc)
+			ctx, iActor, reference, hostCapabilities, timers, instantiatePayload,
+			onGc, onDeactivate, onMemoryLimitTrap, onSelfDeactivate, onHandoff)
 		if err != nil {
 			return nil, fmt.Errorf("error activating actor: %w", err)
 		}
+		if onActivated != nil {
+			if err := onActivated(actor); err != nil {
+				actor.close(ctx)
+				return nil, fmt.Errorf("error activating actor: %w", err)
+			}
+		}
+		if reference.ActorID().IDType == types.IDTypeActor {
+			a.notifyMembershipSnapshot(actor)
+		}
+		reason := "activated"
+		if onActivated != nil {
+			reason = "restored"
+		} else if prevActor != nil {
+			reason = "generation_changed"
+		}
+		a.events.publish(LifecycleEventActivated, reference.ActorID(), reason)
 
 		return actor, nil
 	})
 
-	actor, err := fut.Wait()
+	return fut.Wait()
+}
+
+// putActorWithLock adds the actor to the map. The lock must be held.
+func (a *activations) putActorWithLock(
+	actorID types.NamespacedActorID,
+	fut futures.Future[*activatedActor],
+) {
+	if _, ok := a._actors[actorID]; !ok && actorID.IDType == types.IDTypeActor {
+		a._namespaceActivations[actorID.Namespace]++
+	}
+	a._actors[actorID] = fut
+}
+
+// deleteActorWithLock removes the actor from the map, if it's there. The lock must be
+// held.
+func (a *activations) deleteActorWithLock(actorID types.NamespacedActorID) {
+	if _, ok := a._actors[actorID]; !ok {
+		return
+	}
+	delete(a._actors, actorID)
+	if actorID.IDType == types.IDTypeActor {
+		a._namespaceActivations[actorID.Namespace]--
+		if a._namespaceActivations[actorID.Namespace] == 0 {
+			delete(a._namespaceActivations, actorID.Namespace)
+		}
+	}
+}
+
+// resolveInstantiatePayload returns the payload that a new activation of the actor should
+// be instantiated with. If instantiate payloads are persisted, the provided payload is
+// persisted (if any) and otherwise the previously persisted payload is returned.
+func (a *activations) resolveInstantiatePayload(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	instantiatePayload []byte,
+) ([]byte, error) {
+	actorID := reference.ActorID()
+	if !a.persistInstantiatePayloads || actorID.IDType != types.IDTypeActor {
+		return instantiatePayload, nil
+	}
+
+	if len(instantiatePayload) > 0 {
+		err := a.registry.PutInstantiatePayload(
+			ctx, reference.Namespace(), actorID.ID, actorID.Module, instantiatePayload)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error persisting instantiate payload of actor: %s, err: %w", actorID, err)
+		}
+		return instantiatePayload, nil
+	}
+
+	persisted, _, err := a.registry.GetInstantiatePayload(
+		ctx, reference.Namespace(), actorID.ID, actorID.Module)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf(
+			"error getting persisted instantiate payload of actor: %s, err: %w", actorID, err)
 	}
+	return persisted, nil
+}
 
-	return actor.invoke(ctx, operation, invokePayload, false, false)
+// instantiate creates a new in-memory instance of the actor from its module, unless the
+// module's description doesn't list operation. It retries if the actor's compiled module
+// is evicted from the module cache concurrently.
+func (a *activations) instantiate(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	operation string,
+	instantiatePayload []byte,
+	host HostCapabilities,
+) (Actor, error) {
+	for i := 0; ; i++ {
+		module, err := a.ensureModule(ctx, reference.ModuleID())
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error ensuring module for reference: %v, err: %w",
+				reference, err)
+		}
+		description := a.describe(ctx, reference.ModuleID(), module)
+		if err := description.validate(reference.ModuleID(), operation); err != nil {
+			return nil, err
+		}
+
+		actor, err := module.Instantiate(ctx, reference, instantiatePayload, host)
+		if errors.Is(err, errCompiledModuleEvicted) && i < 3 {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error instantiating actor: %s from module: %s, err: %w",
+				reference.ActorID(), reference.ModuleID(), err)
+		}
+		return actor, nil
+	}
 }
 
 func (a *activations) ensureModule(
 	ctx context.Context,
 	moduleID types.NamespacedID,
 ) (Module, error) {
-	a.Lock()
-	module, ok := a._modules[moduleID]
-	a.Unlock()
+	module, ok := a.getCachedModule(moduleID)
 	if ok {
 		return module, nil
 	}
@@ -284,12 +722,10 @@ func (a *activations) ensureModule(
 	// Module wasn't cached already, we need to go fetch it.
 	dedupeBy := fmt.Sprintf("%s-%s", moduleID.Namespace, moduleID.ID)
 	moduleI, err, _ := a.moduleFetchDeduper.Do(dedupeBy, func() (any, error) {
-		// Need to check map again once we get into singleflight context in case
-		// the actor was instantiated since we released the lock above and entered
-		// the singleflight context.
-		a.Lock()
-		module, ok := a._modules[moduleID]
-		a.Unlock()
+		// Need to check the caches again once we get into singleflight context in case
+		// the module was loaded since we checked above and entered the singleflight
+		// context.
+		module, ok := a.getCachedModule(moduleID)
 		if ok {
 			return module, nil
 		}
@@ -303,40 +739,52 @@ func (a *activations) ensureModule(
 				moduleID, err)
 		}
 
-		hostFn := newHostFnRouter(
-			a.registry, a.environment, a, a.customHostFns, moduleID.Namespace, moduleID.ID)
 		if len(moduleBytes) > 0 {
 			// WASM byte codes exists for the module so we should just use that.
-			// TODO: Hard-coded for now, but we should support using different runtimes with
-			//       configuration since we've already abstracted away the module/object
-			//       interfaces.
-			wazeroMod, err := durablewazero.NewModule(ctx, wazero.Engine(), hostFn, moduleBytes)
+			var (
+				fuelLimit        = a.fuel.limit(moduleID.Namespace, moduleID.ID)
+				memoryLimitPages = a.memoryLimits.limit(moduleID.Namespace, moduleID.ID)
+				interrupts       = fuelLimit > 0 || a.invokeTimeout > 0
+			)
+			cm, err := a.moduleCache.getOrCompile(
+				ctx, moduleID, moduleBytes, interrupts, memoryLimitPages,
+				func() (durable.Module, error) {
+					hostFn := newHostFnRouter(a.registry, a.environment, a, a.customHostFns)
+					return a.wasmRuntime.Compile(ctx, hostFn, moduleBytes, durable.CompileOptions{
+						Interrupts:          interrupts,
+						CompilationCacheDir: a.compilationCacheDir,
+						MemoryLimitPages:    memoryLimitPages,
+					})
+				})
 			if err != nil {
 				return nil, fmt.Errorf(
 					"error constructing module: %s from module bytes, err: %w",
 					moduleID, err)
 			}
 
-			// Wrap the wazero module so it implements Module.
-			module = wazeroModule{wazeroMod}
-		} else {
-			// No WASM code, must be a hard-coded Go module.
-			goModID := types.NewNamespacedIDNoType(moduleID.Namespace, moduleID.ID)
-			goMod, ok := a.goModules[goModID]
-			if !ok {
-				return nil, fmt.Errorf(
-					"error constructing module: %s, hard-coded Go module does not exist",
-					moduleID)
-			}
-			module = goMod
+			// Wrap the compiled module so it implements Module.
+			return wasmModule{
+				a.moduleCache, cm, fuelLimit, a.fileSystems,
+				a.recording.recorder(moduleID.Namespace, moduleID.ID)}, nil
+		}
+
+		// No WASM code, must be a hard-coded Go module.
+		goModID := types.NewNamespacedIDNoType(moduleID.Namespace, moduleID.ID)
+		a.Lock()
+		goMod, ok := a.goModules[goModID]
+		a.Unlock()
+		if !ok {
+			return nil, fmt.Errorf(
+				"error constructing module: %s, hard-coded Go module does not exist",
+				moduleID)
 		}
 
 		// Can set unconditionally without checking if it already exists since we're in
 		// the singleflight context.
 		a.Lock()
-		a._modules[moduleID] = module
+		a._modules[moduleID] = goMod
 		a.Unlock()
-		return module, nil
+		return goMod, nil
 	})
 	if err != nil {
 		return nil, err
@@ -345,16 +793,91 @@ func (a *activations) ensureModule(
 	return moduleI.(Module), nil
 }
 
+// getCachedModule returns the module with the provided ID if it has already been loaded.
+func (a *activations) getCachedModule(moduleID types.NamespacedID) (Module, bool) {
+	a.Lock()
+	module, ok := a._modules[moduleID]
+	a.Unlock()
+	if ok {
+		return module, true
+	}
+
+	cm, ok := a.moduleCache.get(moduleID)
+	if !ok {
+		return nil, false
+	}
+	return wasmModule{
+		a.moduleCache, cm, a.fuel.limit(moduleID.Namespace, moduleID.ID), a.fileSystems,
+		a.recording.recorder(moduleID.Namespace, moduleID.ID)}, true
+}
+
 func (a *activations) newActivatedActor(
 	ctx context.Context,
 	actor Actor,
 	reference types.ActorReferenceVirtual,
 	host HostCapabilities,
+	timers *actorTimers,
 	instantiatePayload []byte,
 	onGc func(),
+	onAbort func(),
+	onMemoryLimitTrap func(),
+	onSelfDeactivate func(),
+	onHandoff func(),
 ) (*activatedActor, error) {
+	var rateLimiter *tokenBucket
+	if actorID := reference.ActorID(); actorID.IDType == types.IDTypeActor {
+		rateLimiter = newTokenBucket(
+			a.rateLimits.limit(reference.Namespace(), actorID.Module), time.Now())
+	}
 	return newActivatedActor(
-		ctx, actor, reference, host, instantiatePayload, a.gcActorsAfter, onGc)
+		ctx, actor, reference, host, timers, instantiatePayload,
+		a.gcActorsAfter, a.deactivationTimeout, a.invokeTimeout,
+		newIdempotencyCache(a.idempotency), rateLimiter, a.scheduler,
+		newActorMailbox(a.maxMailboxDepth, &a.mailboxStats), a.quotas.get(reference.Namespace()),
+		a.quarantine, a.responses.newCache(reference.ModuleID(), a.cachedDescription(reference.ModuleID())),
+		onGc, onAbort, onMemoryLimitTrap, onSelfDeactivate, onHandoff)
+}
+
+func (a *activations) stats() ActivationStats {
+	stats := ActivationStats{
+		NumActivatedActors: a.numActivatedActors(),
+		IdleDeactivations:  a.idleDeactivations.Load(),
+		SelfDeactivations:  a.selfDeactivations.Load(),
+		MemoryLimitTraps:   a.memoryLimitTraps.Load(),
+		LeaseRevocations:   a.leaseRevocations.Load(),
+		MaxActivations:     a.maxActivations,
+		CapacityRejections: a.capacityRejections.Load(),
+		MailboxDepth:       int(a.mailboxStats.depth.Load()),
+		MaxMailboxDepth:    a.maxMailboxDepth,
+		MailboxRejections:  a.mailboxStats.rejections.Load(),
+		Traps:              a.quarantine.traps.Load(),
+		Quarantines:        a.quarantine.quarantines.Load(),
+
+		ResponseCacheHits:          a.responses.hits.Load(),
+		ResponseCacheMisses:        a.responses.misses.Load(),
+		ResponseCacheInvalidations: a.responses.invalidations.Load(),
+		LifecycleEventsDropped:     a.events.numDropped(),
+	}
+	if a.maxActivations > 0 {
+		stats.Utilization = float64(stats.NumActivatedActors) / float64(a.maxActivations)
+	}
+	if lookups := stats.ResponseCacheHits + stats.ResponseCacheMisses; lookups > 0 {
+		stats.ResponseCacheHitRatio = float64(stats.ResponseCacheHits) / float64(lookups)
+	}
+	a.stateCompressor.stats(&stats)
+	return stats
+}
+
+// namespaceActivations returns the number of actors (but not workers) that are activated
+// by namespace.
+func (a *activations) namespaceActivations() map[string]int {
+	a.Lock()
+	defer a.Unlock()
+	activations := make(map[string]int, len(a._namespaceActivations))
+	for namespace, n := range a._namespaceActivations {
+		activations[namespace] = n
+	}
+	return activations
 }
 
 func (a *activations) numActivatedActors() int {
@@ -363,6 +886,94 @@ func (a *activations) numActivatedActors() int {
 	return len(a._actors)
 }
 
+// deactivateAll stops hosting all the actors that are currently activated. The actors
+// are removed from the map immediately so that subsequent invocations will create new
+// activations, but they're closed in the background since each actor may take up to
+// the deactivation timeout to run its deactivation hooks. The returned channel is
+// closed once all of them have been closed. reason is the reason of the
+// LifecycleEventDeactivated events.
+func (a *activations) deactivateAll(reason string) <-chan struct{} {
+	a.Lock()
+	actorFs := make([]futures.Future[*activatedActor], 0, len(a._actors))
+	for actorID, actorF := range a._actors {
+		actorFs = append(actorFs, actorF)
+		a.deleteActorWithLock(actorID)
+		a.events.publish(LifecycleEventDeactivated, actorID, reason)
+	}
+	a.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(actorFs))
+	for _, actorF := range actorFs {
+		go func(actorF futures.Future[*activatedActor]) {
+			defer wg.Done()
+			actor, err := actorF.Wait()
+			if err != nil {
+				// Actor failed to activate, nothing to close.
+				return
+			}
+			if err := actor.close(context.Background()); err != nil {
+				log.Printf(
+					"error closing deactivated actor: %v, err: %v",
+					actor.reference(), err)
+			}
+		}(actorF)
+	}
+
+	doneCh := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(doneCh)
+	}()
+	return doneCh
+}
+
+// revokeLease stops hosting the actor because the server no longer holds its activation
+// lease, so that subsequent invocations that are routed here activate it again.
+func (a *activations) revokeLease(ctx context.Context, actor *activatedActor) {
+	closed, err := actor.closeAndRemove(ctx)
+	if err != nil {
+		log.Printf("error closing actor: %v with revoked lease, err: %v", actor.reference(), err)
+	}
+	if closed {
+		a.leaseRevocations.Add(1)
+	}
+}
+
+// activatedActor returns the actor with the provided ID if it's currently activated,
+// waiting for it if it's being activated.
+func (a *activations) activatedActor(actorID types.NamespacedActorID) (*activatedActor, bool) {
+	a.Lock()
+	actorF, ok := a._actors[actorID]
+	a.Unlock()
+	if !ok {
+		return nil, false
+	}
+	actor, err := actorF.Wait()
+	return actor, err == nil
+}
+
+// activatedActors returns the actors (but not the workers) that are currently
+// activated, waiting for the ones that are being activated.
+func (a *activations) activatedActors() []*activatedActor {
+	a.Lock()
+	actorFs := make([]futures.Future[*activatedActor], 0, len(a._actors))
+	for actorID, actorF := range a._actors {
+		if actorID.IDType == types.IDTypeActor {
+			actorFs = append(actorFs, actorF)
+		}
+	}
+	a.Unlock()
+
+	actors := make([]*activatedActor, 0, len(actorFs))
+	for _, actorF := range actorFs {
+		if actor, err := actorF.Wait(); err == nil {
+			actors = append(actors, actor)
+		}
+	}
+	return actors
+}
+
 func (a *activations) setServerState(
 	serverID string,
 	serverVersion int64,
@@ -387,13 +998,46 @@ type activatedActor struct {
 
 	// Don't access directly from outside this structs own method implementations,
 	// use methods like invoke() and close() instead.
-	_a          Actor
-	_reference  types.ActorReferenceVirtual
-	_host       HostCapabilities
-	_closed     bool
-	_lastInvoke time.Time
-	_gcAfter    time.Duration
-	_gcTimer    *time.Timer
+	_a                   Actor
+	_reference           types.ActorReferenceVirtual
+	_host                HostCapabilities
+	_timers              *actorTimers
+	_closed              bool
+	_lastInvoke          time.Time
+	_gcAfter             time.Duration
+	_gcTimer             *time.Timer
+	_deactivationTimeout time.Duration
+	_invokeTimeout       time.Duration
+	_onAbort             func()
+	_onMemoryLimitTrap   func()
+	_onSelfDeactivate    func()
+	_onHandoff           func()
+	// _idempotency is nil if the results of invocations with an idempotency key should
+	// not be remembered.
+	_idempotency *idempotencyCache
+	// _rateLimiter is nil if invocations of the actor are not rate limited.
+	_rateLimiter *tokenBucket
+	// _scheduler is nil if invocations are not limited (see SchedulerOptions).
+	_scheduler *invocationScheduler
+	// _mailbox serializes invocations in arrival order. Invocations must enter it before
+	// acquiring the lock, internal operations (like closing the actor) only acquire the
+	// lock.
+	_mailbox *actorMailbox
+	// _namespaceUsage is the usage of the actor's namespace that its memory counts
+	// against, or nil if it's not tracked.
+	_namespaceUsage *namespaceUsage
+	// _memoryBytes is the size of the actor's linear memory the last time it was
+	// measured, which is included in _namespaceUsage.
+	_memoryBytes int64
+	// _lastInvokedAt is the time at which the latest invocation of the activation
+	// started, or the zero time if it hasn't been invoked yet. Unlike _lastInvoke, it's
+	// not initialized to the time at which the actor was activated, and the startup
+	// operation doesn't count.
+	_lastInvokedAt time.Time
+	// _quarantine counts the traps of the actor, it's nil if they're not counted.
+	_quarantine *actorQuarantine
+	// _responses is nil if none of the actor's operations are cached.
+	_responses *responseCache
 }
 
 func newActivatedActor(
@@ -401,16 +1045,43 @@ func newActivatedActor(
 	actor Actor,
 	reference types.ActorReferenceVirtual,
 	host HostCapabilities,
+	timers *actorTimers,
 	instantiatePayload []byte,
 	gcAfter time.Duration,
+	deactivationTimeout time.Duration,
+	invokeTimeout time.Duration,
+	idempotency *idempotencyCache,
+	rateLimiter *tokenBucket,
+	scheduler *invocationScheduler,
+	mailbox *actorMailbox,
+	namespaceUsage *namespaceUsage,
+	quarantine *actorQuarantine,
+	responses *responseCache,
 	onGc func(),
+	onAbort func(),
+	onMemoryLimitTrap func(),
+	onSelfDeactivate func(),
+	onHandoff func(),
 ) (*activatedActor, error) {
 	a := &activatedActor{
-		_a:          actor,
-		_reference:  reference,
-		_host:       host,
-		_lastInvoke: time.Now(),
-		_gcAfter:    gcAfter,
+		_a:                   actor,
+		_reference:           reference,
+		_host:                host,
+		_timers:              timers,
+		_lastInvoke:          time.Now(),
+		_gcAfter:             gcAfter,
+		_deactivationTimeout: deactivationTimeout,
+		_invokeTimeout:       invokeTimeout,
+		_onAbort:             onAbort,
+		_onMemoryLimitTrap:   onMemoryLimitTrap,
+		_onSelfDeactivate:    onSelfDeactivate,
+		_onHandoff:           onHandoff,
+		_idempotency:         idempotency,
+		_scheduler:           scheduler,
+		_mailbox:             mailbox,
+		_namespaceUsage:      namespaceUsage,
+		_quarantine:          quarantine,
+		_responses:           responses,
 	}
 
 	var gcFunc func()
@@ -436,12 +1107,22 @@ func newActivatedActor(
 	}
 	gcTimer := time.AfterFunc(gcAfter, gcFunc)
 	a._gcTimer = gcTimer
-
-	_, err := a.invoke(ctx, wapcutils.StartupOperationName, instantiatePayload, false, false)
+	timers.fire = a.fireTimer
+
+	// The result of the startup operation is discarded so there is no point in streaming it,
+	// and the idempotency key (if any) belongs to the invocation that triggered the
+	// activation.
+	_, err := a.invoke(
+		withoutIdempotencyKey(withoutStreamingResponse(ctx)),
+		wapcutils.StartupOperationName, instantiatePayload, false, false)
 	if err != nil {
 		a.close(ctx)
 		return nil, fmt.Errorf("newActivatedActor: error invoking startup function: %w", err)
 	}
+	// The rate limiter is only set once the startup operation has been invoked so that it
+	// doesn't count against the actor's limit. This is safe because the actor is not
+	// visible to other goroutines until it's returned.
+	a._rateLimiter = rateLimiter
 
 	return a, nil
 }
@@ -456,18 +1137,139 @@ func (a *activatedActor) invoke(
 	alreadyLocked bool,
 	isClosing bool,
 ) (io.ReadCloser, error) {
+	if !alreadyLocked && !isClosing && a._rateLimiter != nil {
+		// Rejecting invocations before acquiring the lock ensures that invocations of a hot
+		// actor can't pile up behind it.
+		if retryAfter, ok := a._rateLimiter.take(time.Now()); !ok {
+			return nil, &ActorRateLimitedError{RetryAfter: retryAfter}
+		}
+	}
+
+	key, hasKey := idempotencyKeyFromContext(ctx)
+	hasKey = hasKey && !isClosing && a._idempotency != nil
+	var cacheTTL time.Duration
+	if !isClosing {
+		cacheTTL = a._responses.ttl(operation)
+	}
+	if !alreadyLocked && !isClosing && !hasKey && cacheTTL == 0 && isStreamingRequested(ctx) {
+		return a.invokeStreaming(ctx, operation, payload)
+	}
+
 	if !alreadyLocked {
+		if !isClosing {
+			if err := a._mailbox.enter(ctx); err != nil {
+				return nil, fmt.Errorf("actor: %v, operation: %s, err: %w", a._reference, operation, err)
+			}
+			defer a._mailbox.leave()
+		}
 		a.Lock()
 		defer a.Unlock()
 	}
+	if cacheTTL > 0 {
+		return a.invokeCachedWithLock(ctx, key, hasKey, operation, payload, cacheTTL)
+	}
+	if hasKey {
+		return a.invokeIdempotentWithLock(ctx, key, operation, payload)
+	}
+	return a.invokeWithLock(ctx, operation, payload, isClosing, nil)
+}
+
+// invokeCachedWithLock is the same as invokeWithLock (or invokeIdempotentWithLock if
+// hasKey is set), except it returns the cached response of a previous invocation of the
+// operation with the same payload (if it's still cached) instead of invoking the actor
+// again, and caches the response for ttl otherwise.
+func (a *activatedActor) invokeCachedWithLock(
+	ctx context.Context,
+	key string,
+	hasKey bool,
+	operation string,
+	payload []byte,
+	ttl time.Duration,
+) (io.ReadCloser, error) {
+	cacheKey := responseCacheKey(operation, payload)
+	if !a._closed {
+		if result, ok := a._responses.get(cacheKey, time.Now()); ok {
+			// Cache hits keep the actor from being GC'd like any other invocation.
+			a._lastInvoke = time.Now()
+			return io.NopCloser(bytes.NewReader(result)), nil
+		}
+	}
+
+	var (
+		stream io.ReadCloser
+		err    error
+	)
+	if hasKey {
+		stream, err = a.invokeIdempotentWithLock(ctx, key, operation, payload)
+	} else {
+		stream, err = a.invokeWithLock(ctx, operation, payload, false, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	result, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return nil, fmt.Errorf("error reading actor response from stream: %w", err)
+	}
+
+	a._responses.put(cacheKey, result, ttl, time.Now())
+	return io.NopCloser(bytes.NewReader(result)), nil
+}
+
+// invokeIdempotentWithLock is the same as invokeWithLock, except it returns the result
+// of the previous invocation with the same idempotency key (if it's still remembered)
+// instead of invoking the actor again. Holding the lock ensures that concurrent retries
+// with the same key are not executed more than once.
+func (a *activatedActor) invokeIdempotentWithLock(
+	ctx context.Context,
+	key string,
+	operation string,
+	payload []byte,
+) (io.ReadCloser, error) {
+	if result, ok := a._idempotency.get(key, time.Now()); ok {
+		return io.NopCloser(bytes.NewReader(result)), nil
+	}
+
+	stream, err := a.invokeWithLock(ctx, operation, payload, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	result, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return nil, fmt.Errorf("error reading actor response from stream: %w", err)
+	}
 
+	a._idempotency.put(key, result, time.Now())
+	return io.NopCloser(bytes.NewReader(result)), nil
+}
+
+// invokeWithLock is the same as invoke, except the lock must already be held. Chunks sent
+// by the actor with StreamSend() are sent to stream, or buffered if stream is nil.
+func (a *activatedActor) invokeWithLock(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+	isClosing bool,
+	stream *streamSender,
+) (io.ReadCloser, error) {
 	if a._closed {
-		return nil, fmt.Errorf("tried to invoke actor: %v which has already been closed", a._reference)
+		return nil, fmt.Errorf("tried to invoke actor: %v, err: %w", a._reference, errActivationClosed)
 	}
+	// The cached responses are invalidated before the invocation since it may modify the
+	// actor's state even if it fails.
+	a._responses.invalidate(operation)
 
 	// Set a._lastInvoke to now so that if the timer function runs after we release the lock it will
 	// immediately see that an invocation has run recently.
 	a._lastInvoke = time.Now()
+	ctx = withLastInvokedAt(ctx, a._lastInvokedAt)
+	if operation != wapcutils.StartupOperationName {
+		// The startup operation is invoked by the server when the actor is activated, so
+		// it doesn't count as an invocation.
+		a._lastInvokedAt = a._lastInvoke
+	}
 	if !isClosing {
 		// In addition, Reset the timer manually for the common case in which the actor has not expired
 		// yet which spares the runtime the cost of spawning a goroutine to run the GC function just to
@@ -478,52 +1280,311 @@ func (a *activatedActor) invoke(
 		a._gcTimer.Reset(a._gcAfter)
 	}
 
-	// Workers can't have KV storage because they're not global singletons like actors
-	// are. They're also not registered with the Registry explicitly, so we can skip
-	// this step in that case.
-	if a.reference().ActorID().IDType != types.IDTypeWorker {
-		result, err := a._host.Transact(ctx, func(tr registry.ActorKVTransaction) (any, error) {
-			streamActor, ok := a._a.(ActorStream)
-			if ok {
-				// This actor has support for the streaming interface so we should use that
-				// directly since its more efficient.
-				return streamActor.InvokeStream(ctx, operation, payload, tr)
-			}
+	if isClosing {
+		return a.invokeActor(ctx, operation, payload, stream)
+	}
+	return a.invokeWithLimitsWithLock(ctx, operation, payload, stream)
+}
 
-			// The actor doesn't support streaming responses, we'll convert the returned []byte
-			// to a stream ourselves.
-			return a._a.(ActorBytes).Invoke(ctx, operation, payload, tr)
-		})
+// invokeWithLimitsWithLock is the same as invokeActor, except the invocation waits to be
+// scheduled if the server is executing too many invocations already, the actor is torn
+// down if the invocation exceeds the invoke timeout or the actor's memory limit, and it's
+// deactivated once the invocation returns if the actor requested it with DeactivateSelf().
+func (a *activatedActor) invokeWithLimitsWithLock(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+	stream *streamSender,
+) (io.ReadCloser, error) {
+	if _, isNested := CallerFromContext(ctx); a._scheduler != nil && !isNested {
+		release, err := a._scheduler.acquire(
+			ctx, a._scheduler.priority(ctx, a._reference.Namespace()))
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("actor: %v, operation: %s, err: %w", a._reference, operation, err)
+		}
+		defer release()
+	}
+
+	var (
+		result       io.ReadCloser
+		err          error
+		deactivation = &selfDeactivation{}
+	)
+	ctx = withSelfDeactivation(ctx, deactivation)
+	defer func() {
+		if deactivation.requested.Load() && !a._closed {
+			go a.deactivateSelf()
 		}
+	}()
+	if a._invokeTimeout > 0 {
+		result, err = a.invokeWithTimeoutWithLock(ctx, operation, payload, stream)
+	} else {
+		result, err = a.invokeActor(ctx, operation, payload, stream)
+	}
+	a.measureMemoryWithLock()
+	var quarantined bool
+	if invokeErr, ok := AsInvokeError(err); ok && invokeErr.Category == InvokeErrorCategoryTrap {
+		quarantined = a._quarantine.recordTrap(a._reference.ActorID(), invokeErr.TrapReason)
+	}
+	if err != nil && errors.Is(err, durablewazero.ErrMemoryLimitExceeded) && !a._closed {
+		// The actor trapped while in an unknown state, and its memory can't be shrunk
+		// anyways, so start over with a new activation.
+		a.abortWithLock()
+		a._onMemoryLimitTrap()
+		return nil, fmt.Errorf("actor: %v, operation: %s, err: %w", a._reference, operation, err)
+	}
+	if quarantined && !a._closed {
+		// Stop the crash loop by tearing the actor down, it won't be activated again until
+		// its quarantine ends.
+		a.abortWithLock()
+		a._onAbort()
+	}
+	return result, err
+}
+
+// invokeStreaming is the same as invoke, except the chunks the actor sends with
+// StreamSend() are written to the returned stream as soon as they're produced. The lock is
+// held (in a separate goroutine) until the invocation completes, which includes waiting
+// for the caller to read every chunk, so that a slow reader pauses the actor instead of
+// the chunks piling up in memory.
+//
+// Errors that happen before the first chunk is sent are returned directly, afterwards
+// they're returned by the stream's Read method.
+func (a *activatedActor) invokeStreaming(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+) (io.ReadCloser, error) {
+	type invokeResult struct {
+		result io.ReadCloser
+		err    error
+	}
+	if err := a._mailbox.enter(ctx); err != nil {
+		return nil, fmt.Errorf("actor: %v, operation: %s, err: %w", a._reference, operation, err)
+	}
+	var (
+		stream, pr = newPipeStreamSender()
+		resultCh   = make(chan invokeResult, 1)
+	)
+	go func() {
+		defer a._mailbox.leave()
+		a.Lock()
+		defer a.Unlock()
 
-		if result == nil {
-			// Actor returned nil stream, convert it to an empty one.
-			return ioutil.NopCloser(bytes.NewReader(nil)), nil
+		result, err := a.invokeWithLock(ctx, operation, payload, false, stream)
+		if !stream.finish() {
+			// Nothing has been streamed yet so the result can be returned as-is.
+			resultCh <- invokeResult{result: result, err: err}
+			return
 		}
 
-		stream, ok := result.(io.ReadCloser)
-		if ok {
-			return stream, nil
+		if err == nil {
+			_, err = io.Copy(stream.pw, result)
+			result.Close()
 		}
+		// A nil error closes the stream with io.EOF.
+		stream.pw.CloseWithError(err)
+	}()
+
+	select {
+	case res := <-resultCh:
+		return res.result, res.err
+	case <-stream.startedCh:
+		return pr, nil
+	}
+}
+
+// fireTimer invokes the wapcutils.ReceiveTimerOperationName operation on the actor for
+// the provided timer. Unlike regular invocations, timer invocations don't count as
+// activity so they never prevent the actor from being GC'd.
+func (a *activatedActor) fireTimer(timer *actorTimer) {
+	if !a._timers.isRegistered(timer) {
+		return
+	}
+	defer a._timers.fired(timer)
+
+	payload, err := json.Marshal(wapcutils.ReceiveTimerRequest{Name: timer.name})
+	if err != nil {
+		log.Printf("error marshaling timer: %s payload for actor: %v, err: %v", timer.name, a._reference, err)
+		return
+	}
+
+	if err := a._mailbox.enter(context.Background()); err != nil {
+		log.Printf("error firing timer: %s for actor: %v, err: %v", timer.name, a._reference, err)
+		return
+	}
+	defer a._mailbox.leave()
+	a.Lock()
+	defer a.Unlock()
+	if a._closed {
+		return
+	}
+
+	result, err := a.invokeWithLimitsWithLock(
+		context.Background(), wapcutils.ReceiveTimerOperationName, payload, nil)
+	if err != nil {
+		log.Printf("error firing timer: %s for actor: %v, err: %v", timer.name, a._reference, err)
+		return
+	}
+	result.Close()
+}
+
+// invokeWithTimeoutWithLock is the same as invokeActor, except the invocation's context
+// is canceled if it does not complete within the invoke timeout. WASM actors are
+// interrupted when their context is canceled, but Go actors are expected to honor it
+// themselves. Note that the timeout only bounds producing the response stream, not
+// reading it.
+//
+// Actors that time out are torn down immediately without running their deactivation
+// hooks since they may have been interrupted while in an inconsistent state. Subsequent
+// invocations will reactivate them.
+func (a *activatedActor) invokeWithTimeoutWithLock(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+	stream *streamSender,
+) (io.ReadCloser, error) {
+	invokeCtx, cc := context.WithTimeout(ctx, a._invokeTimeout)
+	defer cc()
+
+	result, err := a.invokeActor(invokeCtx, operation, payload, stream)
+	if err == nil || invokeCtx.Err() != context.DeadlineExceeded || ctx.Err() != nil {
+		// Either the invocation succeeded, or it failed for reasons other than the
+		// invoke timeout (including the caller's context being done).
+		return result, err
+	}
+
+	a.abortWithLock()
+	a._onAbort()
+
+	return nil, fmt.Errorf(
+		"%w: actor: %v, operation: %s, timeout: %s, err: %v",
+		errInvocationTimeout, a._reference, operation, a._invokeTimeout, err)
+}
+
+// abortWithLock tears the actor down immediately without running its deactivation hooks.
+// Callers are responsible for removing it from the activations map afterwards.
+func (a *activatedActor) abortWithLock() {
+	a._closed = true
+	a.releaseMemoryWithLock()
+	a._gcTimer.Stop()
+	a._timers.close()
+	if err := a._a.Close(context.Background()); err != nil {
+		log.Printf("error closing aborted actor: %v, err: %v", a._reference, err)
+	}
+}
+
+// measureMemoryWithLock updates the memory usage of the actor's namespace with the current
+// size of the actor's linear memory. The lock must be held.
+func (a *activatedActor) measureMemoryWithLock() {
+	sizer, ok := a._a.(memorySizer)
+	if !ok || a._namespaceUsage == nil || a._closed {
+		return
+	}
+	size := sizer.memorySize()
+	a._namespaceUsage.memoryBytes.Add(size - a._memoryBytes)
+	a._memoryBytes = size
+}
+
+// releaseMemoryWithLock removes the actor's memory from the memory usage of its
+// namespace once it's closed. The lock must be held.
+func (a *activatedActor) releaseMemoryWithLock() {
+	if a._namespaceUsage != nil {
+		a._namespaceUsage.memoryBytes.Add(-a._memoryBytes)
+	}
+	a._memoryBytes = 0
+}
+
+// invokeActor invokes the operation on the underlying actor. It only accesses fields
+// that are immutable after construction so it does not require the lock to be held,
+// but callers are responsible for ensuring the actor is not invoked after it's closed.
+//
+// Chunks sent by the actor with StreamSend() are sent to stream, or buffered and returned
+// ahead of the actor's response if stream is nil.
+func (a *activatedActor) invokeActor(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+	stream *streamSender,
+) (io.ReadCloser, error) {
+	if stream == nil {
+		stream = newBufferedStreamSender()
+	}
+	// The idempotency key only applies to this invocation, not to the invocations that
+	// the actor makes while handling it.
+	ctx = withoutIdempotencyKey(ctx)
+	ctx = context.WithValue(ctx, streamSenderCtxKey{}, stream)
+	result, err := a.invokeUnderlying(ctx, operation, payload)
+	if err != nil {
+		return nil, err
+	}
+	return stream.prependBuffered(result), nil
+}
+
+// invokeUnderlying is the implementation of invokeActor.
+func (a *activatedActor) invokeUnderlying(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+) (io.ReadCloser, error) {
+	var (
+		result any
+		err    error
+	)
+	// Workers can't have KV storage because they're not global singletons like actors
+	// are. They're also not registered with the Registry explicitly, so we can skip
+	// this step in that case.
+	if a.reference().ActorID().IDType != types.IDTypeWorker {
+		result, err = a._host.Transact(ctx, func(tr registry.ActorKVTransaction) (any, error) {
+			return a.invokeRecovered(ctx, operation, payload, tr)
+		})
+	} else {
+		result, err = a.invokeRecovered(ctx, operation, payload, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch result := result.(type) {
+	case nil:
+		// Actor returned nil stream, convert it to an empty one.
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	case io.ReadCloser:
+		return result, nil
+	default:
 		return io.NopCloser(bytes.NewBuffer(result.([]byte))), nil
 	}
+}
+
+// invokeRecovered invokes the operation on the underlying actor and returns either its
+// response stream or its response []byte. Panics are recovered and returned as traps
+// (see recoverActorPanic).
+func (a *activatedActor) invokeRecovered(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+	tr registry.ActorKVTransaction,
+) (_ any, err error) {
+	defer recoverActorPanic(&err)
 
 	streamActor, ok := a._a.(ActorStream)
 	if ok {
 		// This actor has support for the streaming interface so we should use that
 		// directly since its more efficient.
-		return streamActor.InvokeStream(ctx, operation, payload, nil)
+		stream, err := streamActor.InvokeStream(ctx, operation, payload, tr)
+		if err != nil || stream == nil {
+			return nil, actorInvokeError(err)
+		}
+		return stream, nil
 	}
 
 	// The actor doesn't support streaming responses, we'll convert the returned []byte
 	// to a stream ourselves.
-	resp, err := a._a.(ActorBytes).Invoke(ctx, operation, payload, nil)
+	result, err := a._a.(ActorBytes).Invoke(ctx, operation, payload, tr)
 	if err != nil {
-		return nil, err
+		return nil, actorInvokeError(err)
 	}
-	return io.NopCloser(bytes.NewBuffer(resp)), nil
+	return result, nil
 }
 
 func (a *activatedActor) close(ctx context.Context) error {
@@ -537,18 +1598,95 @@ func (a *activatedActor) closeWithLock(ctx context.Context) error {
 		return nil
 	}
 
-	// TODO: We should let a retry policy be specific for this before the actor is finally
-	// evicted, but we just evict regardless of failure for now.
-	_, err := a.invoke(ctx, wapcutils.ShutdownOperationName, nil, true, true)
-	if err != nil {
-		log.Printf(
-			"error invoking shutdown operation for actor: %v during close: %v",
-			a._reference, err)
+	// Mark the actor as closed before running the deactivation hooks so that no
+	// further invocations can begin, even if we stop waiting for the hooks below.
+	a._closed = true
+	a.releaseMemoryWithLock()
+	a._gcTimer.Stop()
+	a._timers.close()
+
+	ctx, cc := context.WithTimeout(ctx, a._deactivationTimeout)
+	defer cc()
+
+	// Run the deactivation hooks in a separate goroutine so that a misbehaving actor
+	// that ignores the context can't block us forever. In that case the goroutine will
+	// still close the actor once the hooks eventually return.
+	closeErrCh := make(chan error, 1)
+	go func() {
+		if deactivator, ok := a._a.(ActorDeactivator); ok {
+			if err := deactivator.OnDeactivate(ctx); err != nil {
+				log.Printf(
+					"error invoking OnDeactivate for actor: %v during close: %v",
+					a._reference, err)
+			}
+		}
+
+		// TODO: We should let a retry policy be specific for this before the actor is finally
+		// evicted, but we just evict regardless of failure for now.
+		_, err := a.invokeActor(ctx, wapcutils.ShutdownOperationName, nil, nil)
+		if err != nil {
+			log.Printf(
+				"error invoking shutdown operation for actor: %v during close: %v",
+				a._reference, err)
+		}
+
+		closeErrCh <- a._a.Close(context.Background())
+	}()
+
+	select {
+	case err := <-closeErrCh:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf(
+			"actor: %v did not deactivate within: %s, err: %w",
+			a._reference, a._deactivationTimeout, ctx.Err())
 	}
+}
 
-	a._closed = true
+// closeAndRemove closes the actor and removes it from the activations map (if it's still
+// there). It returns whether the actor was closed by this call.
+func (a *activatedActor) closeAndRemove(ctx context.Context) (bool, error) {
+	a.Lock()
+	defer a.Unlock()
+	if a._closed {
+		return false, nil
+	}
+
+	err := a.closeWithLock(ctx)
+	a._onAbort()
+	return true, err
+}
 
-	return a._a.Close(ctx)
+// snapshotAndClose invokes the actor's wapcutils.SnapshotOperationName operation and
+// closes the actor without releasing the lock in between, so the actor can't be invoked
+// after its state is snapshotted. The actor is closed (and removed from the activations
+// map so that it can be restored) even if the snapshot fails.
+func (a *activatedActor) snapshotAndClose(ctx context.Context) ([]byte, error) {
+	a.Lock()
+	defer a.Unlock()
+	if a._closed {
+		return nil, fmt.Errorf("tried to snapshot actor: %v, err: %w", a._reference, errActivationClosed)
+	}
+
+	state, err := a.snapshotWithLock(ctx)
+	if closeErr := a.closeWithLock(ctx); closeErr != nil {
+		log.Printf("error closing snapshotted actor: %v, err: %v", a._reference, closeErr)
+	}
+	a._onHandoff()
+	return state, err
+}
+
+func (a *activatedActor) snapshotWithLock(ctx context.Context) ([]byte, error) {
+	result, err := a.invokeWithLock(ctx, wapcutils.SnapshotOperationName, nil, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error invoking snapshot function of actor: %v, err: %w", a._reference, err)
+	}
+	defer result.Close()
+	state, err := ioutil.ReadAll(result)
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot of actor: %v, err: %w", a._reference, err)
+	}
+	return state, nil
 }
 
 func assertActorIface(actor Actor) error {
@@ -0,0 +1,2175 @@
+package virtual
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/dgraph-io/ristretto"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// defaultMaxCachedActivations is the default value for
+	// ActivationsCacheOptions.MaxCachedActivations.
+	defaultMaxCachedActivations = 1e6 // 1 Million.
+	// maxHeldEnsureErrors is the maximum number of actors whose errors are held at once
+	// (see ActivationsCacheOptions.EnsureErrorHoldDuration).
+	maxHeldEnsureErrors = 1e5
+)
+
+var (
+	// defaultMaxConcurrentEnsureActivationCalls is the default value for
+	// ActivationsCacheOptions.MaxConcurrentEnsureCalls.
+	defaultMaxConcurrentEnsureActivationCalls = runtime.NumCPU() * 16
+	// defaultMaxConcurrentBackgroundRefreshes is the default value for
+	// ActivationsCacheOptions.MaxConcurrentBackgroundRefreshes.
+	defaultMaxConcurrentBackgroundRefreshes = runtime.NumCPU() * 4
+	// defaultActivationCacheTimeout is the default value for
+	// ActivationsCacheOptions.EnsureTimeout.
+	defaultActivationCacheTimeout = 5 * time.Second
+	// defaultCircuitBreakerCooldown is the default value for
+	// ActivationsCacheOptions.CircuitBreakerCooldown.
+	defaultCircuitBreakerCooldown = 5 * time.Second
+	// defaultEnsureRetryBaseBackoff is the default value for
+	// ActivationsCacheOptions.EnsureRetryBaseBackoff.
+	defaultEnsureRetryBaseBackoff = 50 * time.Millisecond
+	// defaultUnreachableServerBlacklistTTL is the default value for
+	// ActivationsCacheOptions.UnreachableServerBlacklistTTL.
+	defaultUnreachableServerBlacklistTTL = 10 * time.Second
+)
+
+// ErrRegistryUnavailable is returned when the activation of an actor can't be ensured
+// because the circuit breaker around the registry is open and there is no cached
+// activation for the actor to fall back to.
+var ErrRegistryUnavailable = errors.New("registry is unavailable: circuit breaker is open")
+
+// IsRegistryUnavailableErr returns a boolean indicating whether the error is an
+// instance of ErrRegistryUnavailable.
+func IsRegistryUnavailableErr(err error) bool {
+	return errors.Is(err, ErrRegistryUnavailable)
+}
+
+// ErrRegistryOverloaded is returned when the activation of an actor can't be ensured
+// because none of the MaxConcurrentEnsureCalls slots freed up within
+// ActivationsCacheOptions.MaxEnsureWait (and, if ServeStaleWhenOverloaded is set, there
+// is no cached activation for the actor to fall back to).
+var ErrRegistryOverloaded = errors.New("registry is overloaded: no EnsureActivation() slot freed up")
+
+// IsRegistryOverloadedErr returns a boolean indicating whether the error is an instance
+// of ErrRegistryOverloaded.
+func IsRegistryOverloadedErr(err error) bool {
+	return errors.Is(err, ErrRegistryOverloaded)
+}
+
+var bufPool = sync.Pool{
+	New: func() any {
+		return make([]byte, 0, 128)
+	},
+}
+
+// ActivationsCacheOptions contains the options for the activations cache.
+type ActivationsCacheOptions struct {
+	// MaxConcurrentEnsureCalls is the maximum number of concurrent calls to the
+	// registry's EnsureActivation() method that the cache will make in response to
+	// cache misses. Cache misses beyond this limit will block until a slot frees up
+	// (or their context expires). This prevents a burst of cache misses from DDOSing
+	// the registry.
+	//
+	// A value of 0 will be ignored and replaced with the default value of
+	// runtime.NumCPU() * 16. Deployments that talk to a remote registry with
+	// high latency will usually want to increase this value.
+	MaxConcurrentEnsureCalls int
+	// EnsureTimeout is the timeout for each call to the registry's EnsureActivation()
+	// method that is made by the cache, including the time spent waiting for one of
+	// the MaxConcurrentEnsureCalls slots to free up.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 5 seconds.
+	EnsureTimeout time.Duration
+	// MaxEnsureWait is the maximum amount of time that a cache miss will wait for one of
+	// the MaxConcurrentEnsureCalls slots to free up. Cache misses that can't acquire a
+	// slot within MaxEnsureWait fail fast with ErrRegistryOverloaded instead of queueing
+	// until EnsureTimeout (or their context) expires, which gives callers a clear signal
+	// that the registry can't keep up. See ActivationCacheStats.EnsureSemaphoreWaitTime
+	// for sizing MaxConcurrentEnsureCalls.
+	//
+	// A value of 0 disables the fast-fail, so cache misses wait for as long as their
+	// EnsureTimeout allows.
+	MaxEnsureWait time.Duration
+	// ServeStaleWhenOverloaded makes cache misses that fail with ErrRegistryOverloaded
+	// fall back to the actor's cached references if there are any, the same way they do
+	// while the circuit breaker is open. This only applies to entries that are still in
+	// the cache but that are being re-resolved in the foreground, for example because
+	// they're stale and DisableBackgroundRefresh is set.
+	ServeStaleWhenOverloaded bool
+	// NumFailoverCandidates is the number of failover candidates that the cache asks the
+	// registry for (see registry.EnsureActivationOptions.NumFailoverCandidates) and caches
+	// alongside every actor's references. When it's > 0, invocations that can't connect to
+	// the server that hosts the actor are retried on the candidates that are not
+	// blacklisted, in order, without consulting the registry.
+	//
+	// A candidate activates the actor without the registry placing it there, so the actor
+	// may briefly be activated on both servers if the original one is only unreachable
+	// from some of the servers in the cluster. Actor KV transactions remain fenced by the
+	// registry, but applications that can't tolerate duplicate in-memory activations
+	// should leave failover disabled.
+	//
+	// A value of 0 disables failover.
+	NumFailoverCandidates int
+	// UnreachableServerThreshold is the number of consecutive invocations that fail to
+	// connect to a server after which the server is considered unreachable. Servers that
+	// the RemoteClient's health checks report as unhealthy (see ServerHealthChecker) are
+	// considered unreachable right away. Unreachable servers are blacklisted for
+	// UnreachableServerBlacklistTTL (see Environment.BlacklistServer), which forces the
+	// actors that are cached on them to be resolved again instead of being routed to a
+	// server that is down until their cache entries expire.
+	//
+	// A value of 0 disables the detection of failed connections, but servers that are
+	// reported as unhealthy by health checks are still blacklisted.
+	UnreachableServerThreshold int
+	// UnreachableServerBlacklistTTL is how long unreachable servers are blacklisted for.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 10 seconds.
+	UnreachableServerBlacklistTTL time.Duration
+	// ReplicaSelectionPolicy is the policy that picks which of an actor's references the
+	// invocations that allow replica reads (see WithReplicaReads) are sent to, so that
+	// the reads of read-heavy actors can be spread across the extra replicas that the
+	// registry returns. Invocations that don't allow replica reads are always sent to
+	// the actor's primary activation (the first reference that is not a replica, see
+	// types.ActorReference.IsReplica), and so are all invocations of actors that only
+	// have one reference.
+	//
+	// Defaults to ReplicaSelectionPolicyPrimary if empty.
+	ReplicaSelectionPolicy ReplicaSelectionPolicy
+	// NegativeCacheTTL is the TTL for "negative" cache entries. When it is > 0, terminal
+	// errors returned by the registry's EnsureActivation() method (for example, because
+	// the actor's module does not exist) will be cached for NegativeCacheTTL and returned
+	// immediately to subsequent callers instead of hitting the registry again. This
+	// protects the registry from misbehaving clients that repeatedly invoke actors that
+	// can never be activated.
+	//
+	// Transient errors (timeouts, cancellations, etc) are never cached.
+	//
+	// A value of 0 disables negative caching.
+	NegativeCacheTTL time.Duration
+	// MaxCacheAge is a hard upper bound on how long an entry can be served from the
+	// cache, measured from when it was cached, regardless of its TTL. Entries that are
+	// older than MaxCacheAge are treated as a cache miss and re-resolved synchronously
+	// against the registry. This acts as a safety valve that guarantees actors will
+	// eventually stop being routed to servers that are permanently partitioned, even
+	// if the TTL is configured to be very long.
+	//
+	// A value of 0 disables the hard expiry.
+	MaxCacheAge time.Duration
+	// IdealCacheStaleness is how old a cache entry can get before it is considered
+	// stale. Stale entries are still served from the cache (so the registry is never
+	// in the critical path of a cache hit), but they also trigger a refresh in the
+	// background so that actor migrations are picked up well before the entry's TTL
+	// expires (see DisableBackgroundRefresh). Concurrent refreshes for the same actor
+	// are collapsed into one.
+	//
+	// A value of 0 disables background refreshes.
+	IdealCacheStaleness time.Duration
+	// RefreshJitter is the maximum amount of random jitter that will be added to the
+	// staleness of each cache entry (IdealCacheStaleness, or the namespace's staleness).
+	// Without jitter, all the entries that were cached at roughly the same time (for
+	// example, when a cluster cold-starts a lot of actors at once) also become stale at
+	// roughly the same time, and every server refreshes them against the registry in the
+	// same small window. The jitter is picked when an entry is cached, so each entry is
+	// refreshed once it's older than its staleness + rand(0, RefreshJitter).
+	//
+	// A value of 0 disables jitter.
+	RefreshJitter time.Duration
+	// SlowRegistryThreshold enables the slow registry detector, which tracks an
+	// exponentially weighted moving average of the latency of the cache's calls to the
+	// registry. While the average exceeds SlowRegistryThreshold the cache protects
+	// itself (and the registry) by leaning harder on cached entries: the staleness
+	// after which entries are refreshed (IdealCacheStaleness, or the namespace's
+	// staleness) and EnsureTimeout are both multiplied by how many times slower than
+	// SlowRegistryThreshold the registry is, up to MaxSlowRegistryStaleness and
+	// MaxSlowRegistryEnsureTimeout respectively. See the SlowRegistry fields of
+	// ActivationCacheStats for the current state of the detector.
+	//
+	// A value of 0 disables the detector.
+	SlowRegistryThreshold time.Duration
+	// MaxSlowRegistryStaleness is the maximum staleness that the slow registry detector
+	// extends the staleness of entries to.
+	//
+	// A value of 0 will be ignored and replaced with the default value of
+	// 10 * IdealCacheStaleness.
+	MaxSlowRegistryStaleness time.Duration
+	// MaxSlowRegistryEnsureTimeout is the maximum timeout that the slow registry
+	// detector widens EnsureTimeout to.
+	//
+	// A value of 0 will be ignored and replaced with the default value of
+	// 2 * EnsureTimeout.
+	MaxSlowRegistryEnsureTimeout time.Duration
+	// NamespaceCacheStaleness optionally overrides IdealCacheStaleness on a
+	// per-namespace basis. For example, namespaces that hold long-lived singleton
+	// actors that rarely move can tolerate much more staleness than namespaces with
+	// ephemeral actors that rebalance constantly. If it returns a value <= 0 then
+	// IdealCacheStaleness is used instead.
+	//
+	// It is called on every cache hit so it must be cheap and safe for concurrent use.
+	// Changing the value it returns at runtime only affects entries that are evaluated
+	// after the change.
+	NamespaceCacheStaleness func(namespace string) time.Duration
+	// MaxConcurrentBackgroundRefreshes is the maximum number of background refreshes of
+	// stale entries that can be in flight at once. Refreshes beyond this limit are
+	// dropped instead of queued (the stale entry will trigger another refresh the next
+	// time it is accessed) so that a burst of stale entries can't spawn an unbounded
+	// number of goroutines. Background refreshes also count against
+	// MaxConcurrentEnsureCalls when they call the registry.
+	//
+	// A value of 0 will be ignored and replaced with the default value of
+	// runtime.NumCPU() * 4.
+	MaxConcurrentBackgroundRefreshes int
+	// DisableBackgroundRefresh makes stale entries be re-resolved against the registry
+	// in the foreground, exactly like cache misses, instead of being served from the
+	// cache while they're refreshed in the background. This puts the registry back in
+	// the critical path of stale cache hits so it's mostly useful for tests that need to
+	// assert exactly when the registry is called.
+	DisableBackgroundRefresh bool
+	// Clock is used to timestamp cache entries and to determine their age. It's mostly
+	// useful for tests that need to advance time deterministically instead of sleeping.
+	//
+	// A value of nil will be ignored and replaced with the system's clock.
+	Clock Clock
+	// PooledCacheKeys makes cache lookups format the cache key into a buffer that is
+	// borrowed from a pool instead of allocating a new one. This saves a single small
+	// allocation per lookup (see BenchmarkActivationsCacheHit), which is marginal
+	// compared to the cost of an invocation, and the pooled buffer must never be
+	// retained after the lookup returns so it's disabled by default to rule out
+	// use-after-free bugs.
+	PooledCacheKeys bool
+	// MaxCachedActivations is the maximum number of actor activations that will be
+	// cached at once. Once the cache is full, entries will be evicted to make room for
+	// new ones.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 1 million.
+	// Memory-constrained nodes will usually want to lower this value.
+	//
+	// Strictly speaking, it's the maximum total cost of the cached entries, and each
+	// entry costs 1 unless it's configured otherwise (see ModuleCosts), so raising the
+	// cost of some entries reduces the number of entries that fit in the cache. See
+	// ActivationCacheStats.EffectiveCapacity.
+	MaxCachedActivations int64
+	// ModuleCosts contains the cost of caching the activations of the actors of each
+	// module. Under memory pressure the cache's admission and eviction policies weigh
+	// how often each entry is used against its cost, so activations with a higher cost
+	// are retained longer than the cheap ones that are used as often, which is useful
+	// for actors that are expensive to resolve again, like singletons and coordinators.
+	//
+	// The activations of modules that are not listed cost as much as the highest
+	// cost that the registry tagged their references with (see
+	// types.ActorReference.CacheCost), which is 1 by default. Costs higher than
+	// MaxCachedActivations are lowered to it since the entry wouldn't fit otherwise.
+	ModuleCosts map[types.NamespacedIDNoType]int64
+	// CircuitBreakerFailureThreshold is the number of consecutive failed calls to the
+	// registry's EnsureActivation() method after which the circuit breaker opens. While
+	// it's open, actor activations are resolved without calling the registry: cached
+	// references are returned if there are any (even if they're stale) and
+	// ErrRegistryUnavailable otherwise. Once CircuitBreakerCooldown has elapsed a single
+	// call is allowed through to probe the registry, and the breaker closes again if it
+	// succeeds.
+	//
+	// Terminal errors (for example, because the actor's module does not exist) and
+	// cancellations don't count as failures.
+	//
+	// A value of 0 disables the circuit breaker.
+	CircuitBreakerFailureThreshold int
+	// CircuitBreakerCooldown is how long the circuit breaker stays open before it lets a
+	// probe call through to the registry.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 5 seconds.
+	CircuitBreakerCooldown time.Duration
+	// EnsureRetryMaxAttempts is the maximum number of times the registry's
+	// EnsureActivation() method will be called for a single cache miss. Calls that fail
+	// with a retryable error (anything except terminal errors like the actor's module
+	// not existing, and the caller's context being done) are retried with exponential
+	// backoff to ride out transient registry failures like leader elections. Retries
+	// are bounded by EnsureTimeout: no attempt is made if the backoff would not end
+	// before the timeout expires.
+	//
+	// The MaxConcurrentEnsureCalls slot is held across retries (including the backoffs)
+	// so that a registry that is failing doesn't see more concurrent calls than one that
+	// is healthy. Note that the circuit breaker (if enabled) only counts the final
+	// result of each cache miss, not every attempt.
+	//
+	// A value of 0 or 1 disables retries.
+	EnsureRetryMaxAttempts int
+	// EnsureRetryBaseBackoff is the backoff before the first retry. It doubles for every
+	// subsequent retry.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 50
+	// milliseconds.
+	EnsureRetryBaseBackoff time.Duration
+	// EnsureRetryJitter is the maximum amount of random jitter that will be added to
+	// each backoff so that servers that hit the same registry failure don't all retry
+	// at the same time.
+	//
+	// A value of 0 disables jitter.
+	EnsureRetryJitter time.Duration
+	// EnsureErrorHoldDuration controls what happens to the concurrent cache misses for
+	// an actor (which are collapsed into a single call to the registry's
+	// EnsureActivation() method) when that call fails with a retryable error.
+	//
+	// When it's 0, the call is forgotten as soon as it fails so the next cache miss for
+	// the actor calls the registry again immediately. This minimizes the time it takes
+	// to recover from transient failures.
+	//
+	// When it's > 0, the error is held for EnsureErrorHoldDuration and returned to the
+	// cache misses for the actor in the meantime without calling the registry. This
+	// dampens retries while the registry is having an outage, at the cost of failing
+	// invocations for up to EnsureErrorHoldDuration after it recovers. Held errors don't
+	// count towards the circuit breaker (which dampens retries for all actors at once,
+	// whereas held errors are per actor), and terminal errors are never held since they
+	// are cached as negative entries instead (see NegativeCacheTTL).
+	EnsureErrorHoldDuration time.Duration
+	// OnEvict, if set, is called for every entry that expires or is evicted from the
+	// cache to make room for new entries, and for every entry that the cache's
+	// admission policy rejects. The evicted actor may very well still be activated on
+	// the servers it was cached with, but it will be resolved against the registry again
+	// the next time it's invoked, so this is useful for tracking cache churn or for
+	// proactively scheduling the deactivation of actors that are no longer being routed
+	// to. Entries that are deleted explicitly (for example, because their module was
+	// deleted or their server was blacklisted) are not reported.
+	//
+	// It is called synchronously from the cache's internal goroutine, so it must be
+	// fast, must not block, and must be safe for concurrent use.
+	OnEvict func(EvictedActivation)
+	// WatchRegistry makes the cache watch the registry for changes to the activations of
+	// actors (see registry.ActivationWatcher) and delete the entries that don't point to
+	// the actor's current activation anymore as soon as it changes, instead of routing
+	// invocations to the actor's previous activation until the entry goes stale or
+	// expires. The actors that are cached on servers that are removed from the registry
+	// (for example because their etcd lease expired) are resolved again as well. If the
+	// watch fails it is retried, and the cache falls back to staleness and expiry in the
+	// meantime.
+	//
+	// Every server receives every change to the registry's actors, so this should only
+	// be enabled with registries whose rate of changes the servers can keep up with. It
+	// has no effect if the registry can't watch for changes.
+	WatchRegistry bool
+}
+
+// EvictedActivation is an entry that was removed from the activations cache (see
+// ActivationsCacheOptions.OnEvict).
+type EvictedActivation struct {
+	Namespace string
+	ModuleID  string
+	ActorID   string
+	// References are the actor's cached references. They're empty if the entry was a
+	// negative entry (see ActivationsCacheOptions.NegativeCacheTTL), in which case Err
+	// is the cached error instead.
+	References []types.ActorReference
+	Err        error
+	// CachedAt is the time at which the entry was cached.
+	CachedAt time.Time
+	// RegistryVersionStamp is the registry versionstamp that the entry was resolved at,
+	// or 0 if it could not be determined.
+	RegistryVersionStamp int64
+	// Rejected indicates that the entry was rejected by the cache's admission policy
+	// instead of being evicted after it was admitted.
+	Rejected bool
+}
+
+// ActivationCacheStats contains point-in-time statistics about the activations cache.
+type ActivationCacheStats struct {
+	// Len is the number of entries currently in the cache.
+	Len int64
+	// Cost is the total cost of the entries currently in the cache (see
+	// ActivationsCacheOptions.ModuleCosts). It is the same as Len unless some entries cost
+	// more than 1, and it is what is compared against MaxCost to determine when the cache
+	// is full.
+	Cost int64
+	// MaxCost is the maximum total cost of the cache (MaxCachedActivations).
+	MaxCost int64
+	// EffectiveCapacity is the estimated number of entries that the cache can hold if
+	// the entries that are cached in the future cost as much as the current ones on
+	// average. It is MaxCost if the cache is empty or every entry costs 1.
+	EffectiveCapacity int64
+	// KeysEvicted is the total number of entries that have been removed from the cache,
+	// either because they expired or were evicted to make room for new entries.
+	KeysEvicted uint64
+	// EnsureCallsDeduped is the total number of callers that were deduplicated onto a
+	// registry EnsureActivation() call that was already in flight for the same actor
+	// instead of making their own.
+	EnsureCallsDeduped uint64
+	// EnsureCallsAbandoned is the total number of callers that stopped waiting for an
+	// in-flight EnsureActivation() call because their own context was done first.
+	EnsureCallsAbandoned uint64
+	// EnsureCallsRejected is the total number of registry EnsureActivation() calls that
+	// were not made because the circuit breaker was open.
+	EnsureCallsRejected uint64
+	// EnsureCallsRetried is the total number of registry EnsureActivation() calls that
+	// were retries of a call that failed with a retryable error.
+	EnsureCallsRetried uint64
+	// RefreshesDropped is the total number of background refreshes of stale entries that
+	// were not attempted because MaxConcurrentBackgroundRefreshes were already in flight.
+	RefreshesDropped uint64
+	// RefreshesSkipped is the total number of background refreshes of stale entries that
+	// did not call the registry's EnsureActivation() method because the registry's
+	// versionstamp had not changed since the entry was cached.
+	RefreshesSkipped uint64
+	// EnsureErrorsHeld is the total number of cache misses that were returned a held
+	// error (see ActivationsCacheOptions.EnsureErrorHoldDuration) instead of calling the
+	// registry's EnsureActivation() method.
+	EnsureErrorsHeld uint64
+	// StaleUpdatesRejected is the total number of results of EnsureActivation() calls
+	// that were not cached because the cache already held a result for the same actor
+	// that was resolved at a later registry versionstamp, for example because the call
+	// raced with a newer one or the registry's versionstamp regressed.
+	StaleUpdatesRejected uint64
+	// BlacklistedReferencesRejected is the total number of references that the
+	// registry returned even though they point to a blacklisted server, and that
+	// were therefore resolved again instead of being returned.
+	BlacklistedReferencesRejected uint64
+	// EnsureSemaphoreWaits is the total number of registry calls that had to wait for
+	// one of the MaxConcurrentEnsureCalls slots to free up.
+	EnsureSemaphoreWaits uint64
+	// EnsureSemaphoreWaitTime is the total amount of time that registry calls spent
+	// waiting for one of the MaxConcurrentEnsureCalls slots to free up. Dividing it by
+	// EnsureSemaphoreWaits gives the average wait, which should stay well below
+	// EnsureTimeout if MaxConcurrentEnsureCalls is sized correctly.
+	EnsureSemaphoreWaitTime time.Duration
+	// EnsureCallsOverloaded is the total number of registry calls that were not made
+	// because no MaxConcurrentEnsureCalls slot freed up within MaxEnsureWait.
+	EnsureCallsOverloaded uint64
+	// Failovers is the total number of invocations that were retried on a failover
+	// candidate because the server that hosts the actor couldn't be reached (see
+	// ActivationsCacheOptions.NumFailoverCandidates).
+	Failovers uint64
+	// UnreachableServers is the total number of times a server was blacklisted because it
+	// was unreachable (see ActivationsCacheOptions.UnreachableServerThreshold).
+	UnreachableServers uint64
+	// RegistryLatency is the exponentially weighted moving average of the latency of the
+	// cache's calls to the registry.
+	RegistryLatency time.Duration
+	// SlowRegistry indicates whether RegistryLatency currently exceeds
+	// ActivationsCacheOptions.SlowRegistryThreshold, in which case the following
+	// effective values are widened.
+	SlowRegistry bool
+	// EffectiveCacheStaleness is the staleness after which entries are currently
+	// refreshed (for namespaces without their own staleness).
+	EffectiveCacheStaleness time.Duration
+	// EffectiveEnsureTimeout is the current timeout of the calls to the registry.
+	EffectiveEnsureTimeout time.Duration
+}
+
+// Validate validates the ActivationsCacheOptions.
+func (a *ActivationsCacheOptions) Validate() error {
+	if a.MaxConcurrentEnsureCalls < 0 {
+		return fmt.Errorf("MaxConcurrentEnsureCalls must be >= 0, but was: %d", a.MaxConcurrentEnsureCalls)
+	}
+	if a.MaxConcurrentBackgroundRefreshes < 0 {
+		return fmt.Errorf(
+			"MaxConcurrentBackgroundRefreshes must be >= 0, but was: %d", a.MaxConcurrentBackgroundRefreshes)
+	}
+	if a.EnsureTimeout < 0 {
+		return fmt.Errorf("EnsureTimeout must be >= 0, but was: %s", a.EnsureTimeout)
+	}
+	if a.MaxEnsureWait < 0 {
+		return fmt.Errorf("MaxEnsureWait must be >= 0, but was: %s", a.MaxEnsureWait)
+	}
+	switch a.ReplicaSelectionPolicy {
+	case "", ReplicaSelectionPolicyPrimary, ReplicaSelectionPolicyRoundRobin,
+		ReplicaSelectionPolicyRandom, ReplicaSelectionPolicyLeastRecentlyUsed:
+	default:
+		return fmt.Errorf("unknown ReplicaSelectionPolicy: %s", a.ReplicaSelectionPolicy)
+	}
+	if a.NumFailoverCandidates < 0 {
+		return fmt.Errorf("NumFailoverCandidates must be >= 0, but was: %d", a.NumFailoverCandidates)
+	}
+	if a.UnreachableServerThreshold < 0 {
+		return fmt.Errorf(
+			"UnreachableServerThreshold must be >= 0, but was: %d", a.UnreachableServerThreshold)
+	}
+	if a.UnreachableServerBlacklistTTL < 0 {
+		return fmt.Errorf(
+			"UnreachableServerBlacklistTTL must be >= 0, but was: %s", a.UnreachableServerBlacklistTTL)
+	}
+	if a.NegativeCacheTTL < 0 {
+		return fmt.Errorf("NegativeCacheTTL must be >= 0, but was: %s", a.NegativeCacheTTL)
+	}
+	if a.MaxCacheAge < 0 {
+		return fmt.Errorf("MaxCacheAge must be >= 0, but was: %s", a.MaxCacheAge)
+	}
+	if a.IdealCacheStaleness < 0 {
+		return fmt.Errorf("IdealCacheStaleness must be >= 0, but was: %s", a.IdealCacheStaleness)
+	}
+	if a.RefreshJitter < 0 {
+		return fmt.Errorf("RefreshJitter must be >= 0, but was: %s", a.RefreshJitter)
+	}
+	if a.SlowRegistryThreshold < 0 {
+		return fmt.Errorf("SlowRegistryThreshold must be >= 0, but was: %s", a.SlowRegistryThreshold)
+	}
+	if a.MaxSlowRegistryStaleness < 0 {
+		return fmt.Errorf("MaxSlowRegistryStaleness must be >= 0, but was: %s", a.MaxSlowRegistryStaleness)
+	}
+	if a.MaxSlowRegistryEnsureTimeout < 0 {
+		return fmt.Errorf(
+			"MaxSlowRegistryEnsureTimeout must be >= 0, but was: %s", a.MaxSlowRegistryEnsureTimeout)
+	}
+	if a.MaxCachedActivations < 0 {
+		return fmt.Errorf("MaxCachedActivations must be >= 0, but was: %d", a.MaxCachedActivations)
+	}
+	for moduleID, cost := range a.ModuleCosts {
+		if cost < 1 {
+			return fmt.Errorf(
+				"ModuleCosts of module: %s/%s must be >= 1, but was: %d", moduleID.Namespace, moduleID.ID, cost)
+		}
+	}
+	if a.CircuitBreakerFailureThreshold < 0 {
+		return fmt.Errorf(
+			"CircuitBreakerFailureThreshold must be >= 0, but was: %d", a.CircuitBreakerFailureThreshold)
+	}
+	if a.CircuitBreakerCooldown < 0 {
+		return fmt.Errorf("CircuitBreakerCooldown must be >= 0, but was: %s", a.CircuitBreakerCooldown)
+	}
+	if a.EnsureRetryMaxAttempts < 0 {
+		return fmt.Errorf("EnsureRetryMaxAttempts must be >= 0, but was: %d", a.EnsureRetryMaxAttempts)
+	}
+	if a.EnsureRetryBaseBackoff < 0 {
+		return fmt.Errorf("EnsureRetryBaseBackoff must be >= 0, but was: %s", a.EnsureRetryBaseBackoff)
+	}
+	if a.EnsureRetryJitter < 0 {
+		return fmt.Errorf("EnsureRetryJitter must be >= 0, but was: %s", a.EnsureRetryJitter)
+	}
+	if a.EnsureErrorHoldDuration < 0 {
+		return fmt.Errorf("EnsureErrorHoldDuration must be >= 0, but was: %s", a.EnsureErrorHoldDuration)
+	}
+
+	return nil
+}
+
+// activationsCache caches the actor references returned by the registry's
+// EnsureActivation() method so that the environment does not have to consult
+// the registry for every single invocation.
+type activationsCache struct {
+	// Dependencies / configuration.
+	registry registry.Registry
+	ttl      time.Duration
+	disabled bool
+	opts     ActivationsCacheOptions
+
+	// State.
+	c         *ristretto.Cache
+	ensureSem *semaphore.Weighted
+	// refreshSem bounds the number of background refreshes that are in flight.
+	refreshSem *semaphore.Weighted
+	// deduper collapses concurrent registry calls for the same actor into one.
+	deduper singleflight.Group
+	// ensureCallsDeduped and ensureCallsAbandoned back the corresponding fields of
+	// ActivationCacheStats.
+	ensureCallsDeduped   atomic.Uint64
+	ensureCallsAbandoned atomic.Uint64
+	// breaker is the circuit breaker around the registry's EnsureActivation() method. It
+	// is nil if the circuit breaker is disabled.
+	breaker             *circuitBreaker
+	ensureCallsRejected atomic.Uint64
+	ensureCallsRetried  atomic.Uint64
+	refreshesSkipped    atomic.Uint64
+	refreshesDropped    atomic.Uint64
+	// heldErrs contains the errors that are held per cache key (see
+	// ActivationsCacheOptions.EnsureErrorHoldDuration).
+	heldErrs         heldEnsureErrors
+	ensureErrorsHeld atomic.Uint64
+	// blacklist contains the servers that were blacklisted with blacklistServer().
+	blacklist *serverBlacklist
+	// dialFailures counts the consecutive failed connections to every server (see
+	// ActivationsCacheOptions.UnreachableServerThreshold).
+	dialFailures       *dialFailures
+	unreachableServers atomic.Uint64
+	// index is a secondary index of the cache's keys that allows entries to be deleted
+	// by namespace or module since ristretto does not support prefix scans.
+	index activationsCacheIndex
+	// randInt63n is used to compute the per-entry refresh jitter and the retry backoff
+	// jitter. It is a field so that tests can inject a deterministic source of
+	// randomness. It must be safe for concurrent use.
+	randInt63n func(n int64) int64
+	// clock is used to timestamp cache entries and to determine their age. It defaults
+	// to ActivationsCacheOptions.Clock, but it is a field so that tests can also replace
+	// it after the cache is created.
+	clock Clock
+	// goAsync runs work that the cache does in the background, like refreshing stale
+	// entries. It is a field so that tests can control when the background work runs.
+	goAsync func(fn func())
+
+	staleUpdatesRejected          atomic.Uint64
+	blacklistedReferencesRejected atomic.Uint64
+	ensureSemWaits                atomic.Uint64
+	ensureSemWaitNanos            atomic.Int64
+	ensureCallsOverloaded         atomic.Uint64
+	failovers                     atomic.Uint64
+	// registryLatency tracks the latency of the calls to the registry for the slow
+	// registry detector (see ActivationsCacheOptions.SlowRegistryThreshold).
+	registryLatency registryLatencyTracker
+	// highestVersionStamp is the highest versionstamp returned by getVersionStamp().
+	highestVersionStamp atomic.Int64
+	// quotas limits the number of entries of each namespace (see
+	// NamespaceQuota.MaxCacheEntries). It's nil if they're not limited.
+	quotas *namespaceQuotas
+	// events publishes the placement changes that the cache observes, and the entries
+	// that are deleted from it. It's nil if lifecycle events are not published.
+	events *lifecycleBus
+}
+
+// ActivationKey identifies a single actor activation for the purposes of the
+// activations cache.
+type ActivationKey struct {
+	Namespace string
+	ModuleID  string
+	ActorID   string
+}
+
+// activationCacheEntry is the value that is stored in the activations cache for each
+// actor. Exactly one of references or err will be set. If err is set then the entry is
+// a "negative" entry that caches a terminal error returned by the registry.
+type activationCacheEntry struct {
+	references           []types.ActorReference
+	err                  error
+	cachedAt             time.Time
+	registryVersionStamp int64
+	// refreshJitter is added to the staleness of the entry so that entries that were
+	// cached together are not refreshed together (see RefreshJitter).
+	refreshJitter time.Duration
+
+	// Identify the entry so it can be removed from the index when it is evicted.
+	namespace string
+	moduleID  string
+	actorID   string
+	indexGen  uint64
+}
+
+// activationsCacheIndex maps namespace -> cache key -> indexed entry for every entry
+// in the cache.
+type activationsCacheIndex struct {
+	sync.Mutex
+	m map[string]map[string]activationsCacheIndexEntry
+	// gen is incremented every time a key is indexed so that evictions of an old
+	// entry for a key don't remove a newer entry for the same key from the index.
+	gen uint64
+}
+
+type activationsCacheIndexEntry struct {
+	moduleID string
+	gen      uint64
+	// versionStamp is the highest registry versionstamp that the entries cached for
+	// the key since it was indexed were resolved at.
+	versionStamp int64
+	// replicas is the state of the ReplicaSelectionPolicy for the key, if any. It's
+	// kept when the key's entry is refreshed.
+	replicas *replicaSelection
+}
+
+// activationWithMeta is the result of a call to ensureActivationWithMeta(). In addition
+// to the actor's references, it contains metadata that is useful for debugging routing
+// decisions.
+type activationWithMeta struct {
+	// References is the same as the value returned by ensureActivation().
+	References []types.ActorReference
+	// FromCache indicates whether References were served from the cache instead of
+	// being resolved against the registry by this call.
+	FromCache bool
+	// CachedAt is the time at which References were resolved against the registry
+	// and cached.
+	CachedAt time.Time
+	// RegistryVersionStamp is the registry versionstamp that was observed right after
+	// References were resolved against the registry. It will be 0 if the versionstamp
+	// could not be determined.
+	RegistryVersionStamp int64
+}
+
+func newActivationsCache(
+	registry registry.Registry,
+	ttl time.Duration,
+	disabled bool,
+	opts ActivationsCacheOptions,
+) (*activationsCache, error) {
+	if opts.MaxConcurrentEnsureCalls == 0 {
+		opts.MaxConcurrentEnsureCalls = defaultMaxConcurrentEnsureActivationCalls
+	}
+	if opts.EnsureTimeout == 0 {
+		opts.EnsureTimeout = defaultActivationCacheTimeout
+	}
+	if opts.MaxConcurrentBackgroundRefreshes == 0 {
+		opts.MaxConcurrentBackgroundRefreshes = defaultMaxConcurrentBackgroundRefreshes
+	}
+	if opts.Clock == nil {
+		opts.Clock = realClock{}
+	}
+	if opts.MaxCachedActivations == 0 {
+		opts.MaxCachedActivations = defaultMaxCachedActivations
+	}
+	if opts.CircuitBreakerCooldown == 0 {
+		opts.CircuitBreakerCooldown = defaultCircuitBreakerCooldown
+	}
+	if opts.EnsureRetryBaseBackoff == 0 {
+		opts.EnsureRetryBaseBackoff = defaultEnsureRetryBaseBackoff
+	}
+	if opts.UnreachableServerBlacklistTTL == 0 {
+		opts.UnreachableServerBlacklistTTL = defaultUnreachableServerBlacklistTTL
+	}
+	if opts.MaxSlowRegistryStaleness == 0 {
+		opts.MaxSlowRegistryStaleness = defaultMaxSlowRegistryStalenessFactor * opts.IdealCacheStaleness
+	}
+	if opts.MaxSlowRegistryEnsureTimeout == 0 {
+		opts.MaxSlowRegistryEnsureTimeout = defaultMaxSlowRegistryEnsureTimeoutFactor * opts.EnsureTimeout
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("error validating ActivationsCacheOptions: %w", err)
+	}
+
+	a := &activationsCache{
+		registry:   registry,
+		ttl:        ttl,
+		disabled:   disabled,
+		opts:       opts,
+		ensureSem:  semaphore.NewWeighted(int64(opts.MaxConcurrentEnsureCalls)),
+		refreshSem: semaphore.NewWeighted(int64(opts.MaxConcurrentBackgroundRefreshes)),
+		randInt63n: rand.Int63n,
+		clock:      opts.Clock,
+		goAsync:    func(fn func()) { go fn() },
+	}
+	a.index.m = make(map[string]map[string]activationsCacheIndexEntry)
+	if opts.CircuitBreakerFailureThreshold > 0 {
+		// Use a closure so that tests that replace a.clock also control the breaker.
+		a.breaker = newCircuitBreaker(
+			opts.CircuitBreakerFailureThreshold, opts.CircuitBreakerCooldown,
+			func() time.Time { return a.clock.Now() })
+	}
+	a.blacklist = newServerBlacklist(func() time.Time { return a.clock.Now() })
+	a.dialFailures = newDialFailures(opts.UnreachableServerThreshold)
+
+	c, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: opts.MaxCachedActivations * 10, // * 10 per the docs.
+		// Maximum number of entries in cache. Note that technically this is
+		// a measure in bytes, but we pass a cost of 1 by default (and ignore the
+		// internal cost of each item) to make it behave as a limit on number
+		// of activations. See entryCost().
+		MaxCost:            opts.MaxCachedActivations,
+		IgnoreInternalCost: true,
+		// Recommended default.
+		BufferItems: 64,
+		// Required for stats().
+		Metrics: true,
+		// Keep the index in sync with the cache when entries are evicted, expire, or
+		// are rejected by the admission policy.
+		OnEvict:  a.onEvict,
+		OnReject: a.onReject,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating ristretto cache: %w", err)
+	}
+	a.c = c
+
+	return a, nil
+}
+
+func (a *activationsCache) ensureActivation(
+	ctx context.Context,
+	namespace,
+	moduleID,
+	actorID string,
+) ([]types.ActorReference, error) {
+	meta, err := a.ensureActivationWithMeta(ctx, namespace, moduleID, actorID)
+	if err != nil {
+		return nil, err
+	}
+	return meta.References, nil
+}
+
+// ensureActivationWithMeta is the same as ensureActivation, except it also returns
+// metadata about where the actor's references came from.
+func (a *activationsCache) ensureActivationWithMeta(
+	ctx context.Context,
+	namespace,
+	moduleID,
+	actorID string,
+) (_ activationWithMeta, err error) {
+	ctx, span := startSpan(ctx, "nola.activationsCache.ensureActivation", namespace, moduleID, actorID)
+	defer func() {
+		span.end(err)
+	}()
+
+	if a.disabled {
+		span.setBool(AttributeCacheHit, false)
+		meta, err := a.ensureActivationAndUpdateCache(ctx, namespace, moduleID, actorID, nil)
+		if err != nil {
+			return activationWithMeta{}, err
+		}
+		return a.rejectBlacklisted(ctx, namespace, moduleID, actorID, nil, meta)
+	}
+
+	var cacheKey []byte
+	if a.opts.PooledCacheKeys {
+		bufIface := bufPool.Get()
+		defer bufPool.Put(bufIface)
+		cacheKey = formatActorCacheKey(bufIface.([]byte)[:0], namespace, moduleID, actorID)
+	} else {
+		cacheKey = formatActorCacheKey(nil, namespace, moduleID, actorID)
+	}
+
+	ace, ok := a.get(cacheKey)
+	if ok && ace.err == nil && a.blacklist.containsAny(ace.references) {
+		// Resolve the actor again so the registry can move it off the blacklisted
+		// server.
+		ok = false
+	}
+	if ok && ace.err == nil && a.opts.DisableBackgroundRefresh && a.isStale(namespace, ace) {
+		ok = false
+	}
+	span.setBool(AttributeCacheHit, ok)
+	if ok {
+		if ace.err != nil {
+			return activationWithMeta{}, ace.err
+		}
+		if a.isStale(namespace, ace) {
+			a.refreshInBackground(namespace, moduleID, actorID, ace)
+		}
+		return activationWithMeta{
+			References:           ace.references,
+			FromCache:            true,
+			CachedAt:             ace.cachedAt,
+			RegistryVersionStamp: ace.registryVersionStamp,
+		}, nil
+	}
+
+	meta, err := a.ensureActivationAndUpdateCache(ctx, namespace, moduleID, actorID, cacheKey)
+	if err != nil {
+		return activationWithMeta{}, err
+	}
+	return a.rejectBlacklisted(ctx, namespace, moduleID, actorID, cacheKey, meta)
+}
+
+// rejectBlacklisted returns meta unless its references point to a blacklisted server,
+// which can happen if the registry ignores the blacklist or if the (possibly shared)
+// call that resolved them started before the server was blacklisted. The actor is
+// resolved again, without deduplication, if they do, and an error is returned if the
+// registry still places it on a blacklisted server.
+func (a *activationsCache) rejectBlacklisted(
+	ctx context.Context,
+	namespace,
+	moduleID,
+	actorID string,
+	cacheKey []byte,
+	meta activationWithMeta,
+) (activationWithMeta, error) {
+	if !a.blacklist.containsAny(meta.References) {
+		return meta, nil
+	}
+	a.blacklistedReferencesRejected.Add(1)
+
+	meta, err := a.ensureActivationFromRegistry(ctx, namespace, moduleID, actorID, cacheKey)
+	if err != nil {
+		return activationWithMeta{}, err
+	}
+	if a.blacklist.containsAny(meta.References) {
+		a.blacklistedReferencesRejected.Add(1)
+		return activationWithMeta{}, fmt.Errorf(
+			"error ensuring activation of actor: %s, registry placed it on blacklisted server: %s",
+			actorID, meta.References[0].ServerID())
+	}
+	return meta, nil
+}
+
+// ensureActivationAtLeast is the same as ensureActivation, except the references it
+// returns are guaranteed to have been resolved against the registry at a versionstamp
+// >= minVersionStamp. Cached entries that were resolved at an earlier versionstamp are
+// treated as a cache miss and refreshed, so a caller that just changed an actor's
+// placement (for example, by rebalancing it) can pass the registry's versionstamp after
+// the change to make sure that it routes to the actor's new placement instead of a stale
+// cached one.
+//
+// An error is returned if the references can't be resolved at minVersionStamp, for
+// example because the circuit breaker is open and only stale references are cached.
+func (a *activationsCache) ensureActivationAtLeast(
+	ctx context.Context,
+	namespace,
+	moduleID,
+	actorID string,
+	minVersionStamp int64,
+) (_ []types.ActorReference, err error) {
+	if a.disabled {
+		// Every call is resolved against the registry anyways.
+		return a.ensureActivation(ctx, namespace, moduleID, actorID)
+	}
+
+	cacheKey := formatActorCacheKey(nil, namespace, moduleID, actorID)
+	if ace, ok := a.get(cacheKey); ok && ace.err == nil && ace.registryVersionStamp >= minVersionStamp {
+		return a.ensureActivation(ctx, namespace, moduleID, actorID)
+	}
+
+	ctx, span := startSpan(ctx, "nola.activationsCache.ensureActivationAtLeast", namespace, moduleID, actorID)
+	defer func() {
+		span.end(err)
+	}()
+
+	meta, err := a.refreshActivation(ctx, namespace, moduleID, actorID)
+	if err != nil {
+		return nil, err
+	}
+	if meta.RegistryVersionStamp < minVersionStamp {
+		// The refresh was collapsed into one that was already in flight, which may have
+		// resolved the actor before its placement changed, so resolve it again without
+		// deduplicating.
+		meta, err = a.ensureActivationFromRegistry(ctx, namespace, moduleID, actorID, cacheKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if meta.RegistryVersionStamp < minVersionStamp {
+		return nil, fmt.Errorf(
+			"error ensuring activation of actor: %s at versionstamp: %d, resolved at: %d",
+			actorID, minVersionStamp, meta.RegistryVersionStamp)
+	}
+	meta, err = a.rejectBlacklisted(ctx, namespace, moduleID, actorID, cacheKey, meta)
+	if err != nil {
+		return nil, err
+	}
+	return meta.References, nil
+}
+
+// lookupActivation returns the references of the provided actor's current activation
+// without causing it to be placed: cached references are returned if there are any, and
+// otherwise the registry's read-only LookupActivation() method is called. The result is
+// not cached. An empty slice is returned if the actor is not currently activated (or if
+// it's activated on a blacklisted server, since ensuring its activation would move it).
+func (a *activationsCache) lookupActivation(
+	ctx context.Context,
+	namespace,
+	moduleID,
+	actorID string,
+) (_ []types.ActorReference, err error) {
+	ctx, span := startSpan(ctx, "nola.activationsCache.lookupActivation", namespace, moduleID, actorID)
+	defer func() {
+		span.end(err)
+	}()
+
+	if !a.disabled {
+		ace, ok := a.get(formatActorCacheKey(nil, namespace, moduleID, actorID))
+		ok = ok && ace.err == nil && ace.moduleID == moduleID && !a.blacklist.containsAny(ace.references)
+		span.setBool(AttributeCacheHit, ok)
+		if ok {
+			return ace.references, nil
+		}
+	}
+
+	ctx, cc := a.withEnsureTimeout(ctx)
+	defer cc()
+	start := time.Now()
+	references, err := a.registry.LookupActivation(ctx, namespace, actorID, moduleID)
+	a.recordRegistryLatency(ctx, start, err)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error looking up activation of actor: %s in registry: %w", actorID, err)
+	}
+	if a.blacklist.containsAny(references) {
+		return []types.ActorReference{}, nil
+	}
+	return references, nil
+}
+
+// prefetchActivations warms the cache for all of the provided keys by concurrently
+// calling EnsureActivation() on the registry for each key that is not already cached, or
+// whose cached entry is stale or negative.
+// Concurrency is bounded by MaxConcurrentEnsureCalls. Errors are reported per-key in
+// the returned map (which will be empty if every key was prefetched successfully)
+// instead of failing the entire batch.
+func (a *activationsCache) prefetchActivations(
+	ctx context.Context,
+	keys []ActivationKey,
+) map[ActivationKey]error {
+	var (
+		errsMu sync.Mutex
+		errs   = make(map[ActivationKey]error)
+	)
+	if a.disabled || len(keys) == 0 {
+		return errs
+	}
+
+	numWorkers := a.opts.MaxConcurrentEnsureCalls
+	if len(keys) < numWorkers {
+		numWorkers = len(keys)
+	}
+
+	var (
+		wg     sync.WaitGroup
+		keysCh = make(chan ActivationKey)
+	)
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keysCh {
+				if err := a.prefetchActivation(ctx, key); err != nil {
+					errsMu.Lock()
+					errs[key] = err
+					errsMu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, key := range keys {
+		keysCh <- key
+	}
+	close(keysCh)
+	wg.Wait()
+
+	return errs
+}
+
+func (a *activationsCache) prefetchActivation(
+	ctx context.Context,
+	key ActivationKey,
+) error {
+	cacheKey := formatActorCacheKey(nil, key.Namespace, key.ModuleID, key.ActorID)
+	ace, ok := a.get(cacheKey)
+	if ok && ace.err == nil && !a.isStale(key.Namespace, ace) &&
+		!a.blacklist.containsAny(ace.references) {
+		// Already cached and fresh, nothing to do. Stale entries are refreshed and
+		// negative entries are resolved again since the caller explicitly asked for the
+		// actor to be warmed.
+		return nil
+	}
+
+	_, err := a.ensureActivationAndUpdateCache(
+		ctx, key.Namespace, key.ModuleID, key.ActorID, cacheKey)
+	return err
+}
+
+// refreshActivation is the same as ensureActivationWithMeta, except it always bypasses
+// the cache and re-resolves the actor's references against the registry, updating the
+// cache with the result. This is useful when the caller suspects that the cached
+// references are stale. Concurrent refreshes (and cache misses) for the same actor are
+// still collapsed into a single call to the registry.
+func (a *activationsCache) refreshActivation(
+	ctx context.Context,
+	namespace,
+	moduleID,
+	actorID string,
+) (activationWithMeta, error) {
+	var cacheKey []byte
+	if !a.disabled {
+		cacheKey = formatActorCacheKey(nil, namespace, moduleID, actorID)
+	}
+	return a.ensureActivationAndUpdateCache(ctx, namespace, moduleID, actorID, cacheKey)
+}
+
+// refreshInBackground asynchronously refreshes the stale cache entry, ace, for the
+// provided actor. If the registry's versionstamp has not changed since ace was cached
+// then the registry's placement decisions can't have changed either (this is the case
+// for registries like the DNS registry whose versionstamp only changes when the set of
+// servers does), so ace is re-cached as is without calling EnsureActivation().
+//
+// The refresh is dropped if MaxConcurrentBackgroundRefreshes are already in flight.
+func (a *activationsCache) refreshInBackground(
+	namespace, moduleID, actorID string,
+	ace activationCacheEntry,
+) {
+	if !a.refreshSem.TryAcquire(1) {
+		a.refreshesDropped.Add(1)
+		return
+	}
+
+	a.goAsync(func() {
+		defer a.refreshSem.Release(1)
+
+		// Compare against the registry's versionstamp directly since getVersionStamp()
+		// would hide a regression behind the entry's own versionstamp. The call is bounded
+		// like any other registry call so that an unresponsive registry can't hold on to
+		// the refresh slot.
+		ctx, cc := a.withEnsureTimeout(context.Background())
+		vs, err := a.registry.GetVersionStamp(ctx)
+		cc()
+		if err == nil && ace.registryVersionStamp > 0 && vs == ace.registryVersionStamp {
+			ace.cachedAt = a.clock.Now()
+			a.updateCache(formatActorCacheKey(nil, namespace, moduleID, actorID), ace)
+			a.refreshesSkipped.Add(1)
+			return
+		}
+
+		// Errors are ignored since the stale entry will continue to be served until it
+		// expires and the refresh will be attempted again on the next access.
+		a.refreshActivation(context.Background(), namespace, moduleID, actorID)
+	})
+}
+
+// ensureActivationAndUpdateCache calls EnsureActivation() on the registry and then
+// stores the result in the cache under cacheKey. Concurrent calls for the same
+// cacheKey are deduplicated so that only one of them calls the registry, but every
+// caller stops waiting as soon as its own context is done. If cacheKey is nil then the
+// cache will not be updated (and calls will not be deduplicated).
+func (a *activationsCache) ensureActivationAndUpdateCache(
+	ctx context.Context,
+	namespace,
+	moduleID,
+	actorID string,
+	cacheKey []byte,
+) (_ activationWithMeta, err error) {
+	ctx, span := startSpan(
+		ctx, "nola.activationsCache.ensureActivationAndUpdateCache", namespace, moduleID, actorID)
+	defer func() {
+		span.end(err)
+	}()
+
+	if cacheKey == nil {
+		return a.ensureActivationFromRegistry(ctx, namespace, moduleID, actorID, nil)
+	}
+
+	// The shared call runs with a context that is detached from the caller that started
+	// it so that the caller giving up does not fail the call for every other caller that
+	// is waiting on it. It is still bounded by EnsureTimeout, or by the deadline of the
+	// caller that started it if it's sooner, in which case the callers that were waiting
+	// on it and still have time left start a new call.
+	//
+	// The shared call may outlive this function so it must not reference cacheKey, which
+	// may be returned to bufPool when the caller returns.
+	var (
+		isLeader bool
+		key      = string(cacheKey)
+	)
+	if err, ok := a.heldErrs.get(key, a.clock.Now()); ok {
+		a.ensureErrorsHeld.Add(1)
+		return activationWithMeta{}, err
+	}
+	for {
+		resultCh := a.deduper.DoChan(key, func() (any, error) {
+			isLeader = true
+			meta, err := a.ensureActivationFromRegistry(
+				detachedContext{ctx}, namespace, moduleID, actorID, []byte(key))
+			if err != nil {
+				a.onSharedEnsureErr(key, err)
+			}
+			return meta, err
+		})
+		select {
+		case res := <-resultCh:
+			// Reading isLeader is safe because the function returned before the result was
+			// sent on the channel.
+			if !isLeader {
+				a.ensureCallsDeduped.Add(1)
+				if errors.Is(res.Err, errCallerDeadlineExceeded) && ctx.Err() == nil {
+					// The call was cut short by the deadline of the caller that started it
+					// (and forgotten by onSharedEnsureErr), but this caller can wait longer.
+					continue
+				}
+			}
+			if res.Err != nil {
+				return activationWithMeta{}, res.Err
+			}
+			return res.Val.(activationWithMeta), nil
+		case <-ctx.Done():
+			a.ensureCallsAbandoned.Add(1)
+			return activationWithMeta{}, fmt.Errorf(
+				"error waiting for activation of actor: %s to be ensured: %w",
+				actorID, ctx.Err())
+		}
+	}
+}
+
+// onSharedEnsureErr is called by the shared call for key when it fails with err, before
+// the callers that are waiting on it are notified. It either holds err or forgets the
+// call (see ActivationsCacheOptions.EnsureErrorHoldDuration).
+func (a *activationsCache) onSharedEnsureErr(key string, err error) {
+	if a.opts.EnsureErrorHoldDuration > 0 && !isTerminalEnsureActivationErr(err) &&
+		!IsRegistryUnavailableErr(err) && !IsRegistryOverloadedErr(err) &&
+		!errors.Is(err, errCallerDeadlineExceeded) {
+		// Errors returned while the circuit breaker is open are not held since the breaker
+		// is already dampening calls to the registry, and neither are errors of calls that
+		// were never made because the registry was overloaded or that were cut short by
+		// the deadline of the caller that made them.
+		a.heldErrs.put(key, err, a.clock.Now(), a.opts.EnsureErrorHoldDuration)
+		return
+	}
+	// Forgetting the call from within the call itself guarantees that it's this call
+	// that is forgotten and not a newer one for the same key.
+	a.deduper.Forget(key)
+}
+
+// heldEnsureErrors contains the errors that are held per cache key until they expire.
+type heldEnsureErrors struct {
+	sync.Mutex
+	m map[string]heldEnsureError
+}
+
+type heldEnsureError struct {
+	err   error
+	until time.Time
+}
+
+func (h *heldEnsureErrors) get(key string, now time.Time) (error, bool) {
+	h.Lock()
+	defer h.Unlock()
+	held, ok := h.m[key]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(held.until) {
+		delete(h.m, key)
+		return nil, false
+	}
+	return held.err, true
+}
+
+func (h *heldEnsureErrors) put(key string, err error, now time.Time, hold time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+	if h.m == nil {
+		h.m = make(map[string]heldEnsureError)
+	}
+	if len(h.m) >= maxHeldEnsureErrors {
+		// Errors are usually held for a short time so make room by dropping the expired
+		// ones, or all of them if none have expired yet.
+		for k, held := range h.m {
+			if !now.Before(held.until) {
+				delete(h.m, k)
+			}
+		}
+		if len(h.m) >= maxHeldEnsureErrors {
+			h.m = make(map[string]heldEnsureError)
+		}
+	}
+	h.m[key] = heldEnsureError{err: err, until: now.Add(hold)}
+}
+
+// errCallerDeadlineExceeded is wrapped by the errors of registry calls that timed out
+// because of the deadline of the caller that made them (see withEnsureTimeout).
+var errCallerDeadlineExceeded = errors.New("caller's deadline exceeded")
+
+// detachedContext is a context that carries the values of the context it wraps (like
+// the active span) but is never cancelled and has no deadline.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// ensureActivationFromRegistry is the non-deduplicated implementation of
+// ensureActivationAndUpdateCache.
+func (a *activationsCache) ensureActivationFromRegistry(
+	ctx context.Context,
+	namespace,
+	moduleID,
+	actorID string,
+	cacheKey []byte,
+) (activationWithMeta, error) {
+	if a.breaker != nil && !a.breaker.allow() {
+		a.ensureCallsRejected.Add(1)
+		return a.cachedActivationOrUnavailable(cacheKey, actorID)
+	}
+
+	ctx, cc := a.withEnsureTimeout(ctx)
+	defer cc()
+
+	// Acquire the semaphore before making the network call to avoid DDOSing the
+	// registry when there are a lot of cache misses at once.
+	if err := a.acquireEnsureSem(ctx); err != nil {
+		if a.breaker != nil {
+			// The registry was never called so this says nothing about its health.
+			a.breaker.skip()
+		}
+		if IsRegistryOverloadedErr(err) && a.opts.ServeStaleWhenOverloaded {
+			return a.cachedActivationOrErr(cacheKey, actorID, err)
+		}
+		return activationWithMeta{}, fmt.Errorf(
+			"error waiting to ensure activation of actor: %s in registry: %w",
+			actorID, err)
+	}
+	floor := a.highestVersionStamp.Load()
+	references, vs, err := a.ensureActivationInRegistryWithRetries(ctx, namespace, moduleID, actorID)
+	callerDeadlineExceeded := exceededCallerDeadline(ctx, err)
+	if a.breaker != nil {
+		if callerDeadlineExceeded {
+			// The registry was not given a full EnsureTimeout so this says nothing about
+			// its health either.
+			a.breaker.skip()
+		} else {
+			a.breaker.record(
+				err == nil || isTerminalEnsureActivationErr(err) || errors.Is(err, context.Canceled))
+		}
+	}
+	a.ensureSem.Release(1)
+	if err == nil {
+		vs = a.resolvedVersionStamp(ctx, floor, vs)
+	}
+	if callerDeadlineExceeded {
+		err = fmt.Errorf(
+			"error ensuring activation of actor: %s in registry: %w: %w",
+			actorID, errCallerDeadlineExceeded, err)
+	} else if err != nil {
+		err = fmt.Errorf(
+			"error ensuring activation of actor: %s in registry: %w",
+			actorID, err)
+	}
+
+	ace := activationCacheEntry{
+		references:           references,
+		err:                  err,
+		cachedAt:             a.clock.Now(),
+		registryVersionStamp: vs,
+		namespace:            namespace,
+		moduleID:             moduleID,
+		actorID:              actorID,
+	}
+	if cacheKey != nil {
+		a.updateCache(cacheKey, ace)
+	}
+	if err != nil {
+		return activationWithMeta{}, err
+	}
+	return activationWithMeta{
+		References:           references,
+		CachedAt:             ace.cachedAt,
+		RegistryVersionStamp: vs,
+	}, nil
+}
+
+// acquireEnsureSem acquires one of the MaxConcurrentEnsureCalls slots. It fails with
+// ErrRegistryOverloaded if MaxEnsureWait is set and no slot frees up within it.
+func (a *activationsCache) acquireEnsureSem(ctx context.Context) error {
+	if a.ensureSem.TryAcquire(1) {
+		return nil
+	}
+
+	waitCtx := ctx
+	if a.opts.MaxEnsureWait > 0 {
+		var cc context.CancelFunc
+		waitCtx, cc = context.WithTimeout(ctx, a.opts.MaxEnsureWait)
+		defer cc()
+	}
+	start := time.Now()
+	err := a.ensureSem.Acquire(waitCtx, 1)
+	a.ensureSemWaits.Add(1)
+	a.ensureSemWaitNanos.Add(int64(time.Since(start)))
+	if err != nil && ctx.Err() == nil {
+		// The wait budget expired before the caller's context did.
+		a.ensureCallsOverloaded.Add(1)
+		return ErrRegistryOverloaded
+	}
+	return err
+}
+
+// cachedActivationOrUnavailable is used instead of calling the registry while the
+// circuit breaker is open. It returns the cached references for cacheKey, regardless of
+// how stale they are, or ErrRegistryUnavailable if there are none.
+func (a *activationsCache) cachedActivationOrUnavailable(
+	cacheKey []byte,
+	actorID string,
+) (activationWithMeta, error) {
+	return a.cachedActivationOrErr(cacheKey, actorID, ErrRegistryUnavailable)
+}
+
+// cachedActivationOrErr returns the cached references for cacheKey, regardless of how
+// stale they are, or err if there are none.
+func (a *activationsCache) cachedActivationOrErr(
+	cacheKey []byte,
+	actorID string,
+	err error,
+) (activationWithMeta, error) {
+	if cacheKey != nil {
+		ace, ok := a.get(cacheKey)
+		if ok && ace.err == nil {
+			return activationWithMeta{
+				References:           ace.references,
+				CachedAt:             ace.cachedAt,
+				RegistryVersionStamp: ace.registryVersionStamp,
+			}, nil
+		}
+	}
+	return activationWithMeta{}, fmt.Errorf(
+		"error ensuring activation of actor: %s: %w", actorID, err)
+}
+
+// ensureActivationInRegistry calls EnsureActivation() on the registry. It also returns
+// the registry's versionstamp at which the references were resolved if the registry
+// implements registry.VersionStampedRegistry, and 0 otherwise.
+func (a *activationsCache) ensureActivationInRegistry(
+	ctx context.Context,
+	namespace,
+	moduleID,
+	actorID string,
+) (_ []types.ActorReference, _ int64, err error) {
+	ctx, span := startSpan(ctx, "nola.registry.EnsureActivation", namespace, moduleID, actorID)
+	defer func() {
+		span.end(err)
+	}()
+
+	var (
+		references []types.ActorReference
+		vs         int64
+		opts       = a.ensureActivationOptions()
+		start      = time.Now()
+	)
+	if vsr, ok := a.registry.(registry.VersionStampedRegistry); ok {
+		references, vs, err = vsr.EnsureActivationWithVersionStamp(
+			ctx, namespace, actorID, moduleID, opts)
+	} else {
+		references, err = a.registry.EnsureActivation(ctx, namespace, actorID, moduleID, opts)
+	}
+	a.recordRegistryLatency(ctx, start, err)
+	if err == nil && len(references) > 0 {
+		span.setString(AttributeServerID, references[0].ServerID())
+	}
+	return references, vs, err
+}
+
+// ensureActivationInRegistryWithRetries is the same as ensureActivationInRegistry, except
+// calls that fail with a retryable error are retried according to
+// ActivationsCacheOptions.EnsureRetryMaxAttempts.
+func (a *activationsCache) ensureActivationInRegistryWithRetries(
+	ctx context.Context,
+	namespace,
+	moduleID,
+	actorID string,
+) ([]types.ActorReference, int64, error) {
+	backoff := a.opts.EnsureRetryBaseBackoff
+	for attempt := 1; ; attempt++ {
+		references, vs, err := a.ensureActivationInRegistry(ctx, namespace, moduleID, actorID)
+		if err == nil || attempt >= a.opts.EnsureRetryMaxAttempts ||
+			!isRetryableEnsureActivationErr(ctx, err) {
+			return references, vs, err
+		}
+
+		wait := backoff
+		if a.opts.EnsureRetryJitter > 0 {
+			wait += time.Duration(a.randInt63n(int64(a.opts.EnsureRetryJitter)))
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= wait {
+			// The retry would time out anyways, return the actual error instead.
+			return references, 0, err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return references, 0, err
+		case <-timer.C:
+		}
+		a.ensureCallsRetried.Add(1)
+		backoff *= 2
+	}
+}
+
+// isRetryableEnsureActivationErr returns whether a call to EnsureActivation() that failed
+// with err should be retried.
+func isRetryableEnsureActivationErr(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	return !registry.IsModuleDoesNotExistErr(err) && !registry.IsActorDoesNotExistErr(err)
+}
+
+// blacklistServer makes every call to the registry's EnsureActivation() method avoid
+// serverID until ttl has elapsed, after which it is forgotten. Cached references that
+// point to serverID are resolved again the next time they're accessed so that actors can
+// be moved to a different server while serverID is blacklisted.
+func (a *activationsCache) blacklistServer(serverID string, ttl time.Duration) {
+	a.blacklist.add(serverID, ttl)
+}
+
+// invalidateActivation deletes the actor's cache entry unless its primary reference
+// points to the actor's activation after change (see ActivationsCacheOptions.WatchRegistry).
+// Changes that don't move the actor, like the renewal of its activation's lease, are
+// ignored so that they don't cause cache misses.
+func (a *activationsCache) invalidateActivation(change registry.ActivationChange) {
+	var (
+		actorID  = change.ActorID
+		cacheKey = formatActorCacheKey(nil, actorID.Namespace, actorID.Module, actorID.ID)
+	)
+	if ace, ok := a.get(cacheKey); ok && ace.err == nil && len(ace.references) > 0 {
+		ref := primaryReference(ace.references)
+		if change.ServerID != "" &&
+			ref.ServerID() == change.ServerID &&
+			ref.ServerVersion() == change.ServerVersion &&
+			ref.Generation() == change.Generation {
+			return
+		}
+	}
+	a.delete(actorID.Namespace, actorID.Module, actorID.ID)
+}
+
+// serverRemoved blacklists serverID for the heartbeat TTL because the registry removed it
+// (see ActivationsCacheOptions.WatchRegistry), so that the actors that are cached on it
+// are resolved again.
+func (a *activationsCache) serverRemoved(serverID string) {
+	a.blacklistServer(serverID, registry.HeartbeatTTL)
+}
+
+// reportDialFailure records that an invocation failed to connect to serverID, and
+// blacklists it once it failed UnreachableServerThreshold consecutive times.
+func (a *activationsCache) reportDialFailure(serverID string) {
+	if a.dialFailures.failed(serverID) {
+		a.markServerUnreachable(serverID)
+	}
+}
+
+// reportDialSuccess records that an invocation connected to serverID.
+func (a *activationsCache) reportDialSuccess(serverID string) {
+	a.dialFailures.succeeded(serverID)
+}
+
+// markServerUnreachable blacklists serverID for UnreachableServerBlacklistTTL so that the
+// actors that are cached on it are resolved again.
+func (a *activationsCache) markServerUnreachable(serverID string) {
+	a.unreachableServers.Add(1)
+	a.blacklistServer(serverID, a.opts.UnreachableServerBlacklistTTL)
+}
+
+// failoverCandidates returns the failover candidates of ref that don't point to a server
+// that is currently blacklisted, in the order in which they should be tried. Servers may
+// have been blacklisted since ref was cached, so the candidates are filtered every time.
+func (a *activationsCache) failoverCandidates(ref types.ActorReference) []types.ActorReference {
+	var candidates []types.ActorReference
+	for _, candidate := range ref.FailoverCandidates() {
+		if !a.blacklist.containsAny([]types.ActorReference{candidate}) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+// ensureActivationExcluding is the same as ensureActivation, except the cache is bypassed
+// and the registry is asked to activate the actor on a server other than serverID (even
+// if it's currently activated there). The result is cached. It's used to move actors off
+// servers that refused to activate them, for example because they're at capacity.
+func (a *activationsCache) ensureActivationExcluding(
+	ctx context.Context,
+	namespace,
+	moduleID,
+	actorID,
+	serverID string,
+) (_ []types.ActorReference, err error) {
+	ctx, span := startSpan(ctx, "nola.activationsCache.ensureActivationExcluding", namespace, moduleID, actorID)
+	defer func() {
+		span.end(err)
+	}()
+
+	ctx, cc := a.withEnsureTimeout(ctx)
+	defer cc()
+	opts := a.ensureActivationOptions()
+	opts.BlacklistedServerIDs = append(opts.BlacklistedServerIDs, serverID)
+	start := time.Now()
+	references, err := a.registry.EnsureActivation(ctx, namespace, actorID, moduleID, opts)
+	a.recordRegistryLatency(ctx, start, err)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error ensuring activation of actor: %s in registry: %w",
+			actorID, err)
+	}
+
+	if !a.disabled {
+		a.updateCache(formatActorCacheKey(nil, namespace, moduleID, actorID), activationCacheEntry{
+			references:           references,
+			cachedAt:             a.clock.Now(),
+			registryVersionStamp: a.getVersionStamp(ctx),
+			namespace:            namespace,
+			moduleID:             moduleID,
+			actorID:              actorID,
+		})
+	}
+	return references, nil
+}
+
+// ensureActivationOptions returns the options for calls to the registry's
+// EnsureActivation() and BulkEnsureActivation() methods.
+func (a *activationsCache) ensureActivationOptions() registry.EnsureActivationOptions {
+	return registry.EnsureActivationOptions{
+		BlacklistedServerIDs:  a.blacklist.serverIDs(),
+		NumFailoverCandidates: a.opts.NumFailoverCandidates,
+	}
+}
+
+// getVersionStamp returns the registry's current versionstamp, or 0 if it could not
+// be determined. It is only used for metadata so errors are not fatal.
+//
+// The versionstamp is never lower than the highest one that was returned before the call
+// started, even if the registry's versionstamp regressed (for example because it's derived
+// from the clocks of the servers and they're skewed, or because a registry node is
+// misbehaving). Whatever is resolved from the registry after the call is at least as
+// recent as what was resolved before it, and the cache would otherwise reject genuinely
+// newer results because they appear to be older (see activationsCacheIndex.addWithLock).
+func (a *activationsCache) getVersionStamp(ctx context.Context) int64 {
+	floor := a.highestVersionStamp.Load()
+	vs, err := a.registry.GetVersionStamp(ctx)
+	if err != nil {
+		return 0
+	}
+	return a.observeVersionStamp(floor, vs)
+}
+
+// resolvedVersionStamp returns the versionstamp of references that were resolved by a
+// registry call that started when floor was the highest versionstamp returned by
+// getVersionStamp(), where vs is the versionstamp that the call returned along with them.
+// If vs is 0 because the registry can't return it as part of the call then it's fetched
+// with a separate call instead, so callers should not hold on to ensureSem while calling
+// it.
+func (a *activationsCache) resolvedVersionStamp(ctx context.Context, floor, vs int64) int64 {
+	if vs <= 0 {
+		return a.getVersionStamp(ctx)
+	}
+	return a.observeVersionStamp(floor, vs)
+}
+
+// observeVersionStamp records vs, a versionstamp that was returned by a registry call
+// that started when floor was the highest one returned by getVersionStamp(), and returns
+// it raised to floor.
+func (a *activationsCache) observeVersionStamp(floor, vs int64) int64 {
+	if vs < floor {
+		return floor
+	}
+	for {
+		highest := a.highestVersionStamp.Load()
+		if vs <= highest || a.highestVersionStamp.CompareAndSwap(highest, vs) {
+			return vs
+		}
+	}
+}
+
+// ensureActivations is the same as ensureActivation, except it ensures the activation
+// of many actors in the same namespace and module at once. Actors that are not already
+// cached are ensured with a single call to the registry's BulkEnsureActivation() method
+// and the results are cached per-actor so that subsequent calls to ensureActivation()
+// will hit the cache. The returned results are in the same order as actorIDs.
+func (a *activationsCache) ensureActivations(
+	ctx context.Context,
+	namespace,
+	moduleID string,
+	actorIDs []string,
+) ([]registry.EnsureActivationResult, error) {
+	var (
+		results   = make([]registry.EnsureActivationResult, len(actorIDs))
+		missIdxs  []int
+		missIDs   []string
+		cacheKeys = make([][]byte, len(actorIDs))
+	)
+	for i, actorID := range actorIDs {
+		if a.disabled {
+			missIdxs = append(missIdxs, i)
+			missIDs = append(missIDs, actorID)
+			continue
+		}
+
+		cacheKeys[i] = formatActorCacheKey(nil, namespace, moduleID, actorID)
+		ace, ok := a.get(cacheKeys[i])
+		if ok && ace.err == nil && a.opts.DisableBackgroundRefresh && a.isStale(namespace, ace) {
+			ok = false
+		}
+		if ok && (ace.err != nil || !a.blacklist.containsAny(ace.references)) {
+			if ace.err == nil && a.isStale(namespace, ace) {
+				a.refreshInBackground(namespace, moduleID, actorID, ace)
+			}
+			results[i] = registry.EnsureActivationResult{References: ace.references, Err: ace.err}
+			continue
+		}
+		missIdxs = append(missIdxs, i)
+		missIDs = append(missIDs, actorID)
+	}
+	if len(missIDs) == 0 {
+		return results, nil
+	}
+
+	ctx, cc := a.withEnsureTimeout(ctx)
+	defer cc()
+
+	// The entire batch only counts as a single concurrent call against the semaphore
+	// since it results in a single request to the registry.
+	if err := a.acquireEnsureSem(ctx); err != nil {
+		return nil, fmt.Errorf(
+			"error waiting to ensure activation of %d actors in registry: %w",
+			len(missIDs), err)
+	}
+	var (
+		floor = a.highestVersionStamp.Load()
+		start = time.Now()
+	)
+	missResults, err := a.registry.BulkEnsureActivation(
+		ctx, namespace, moduleID, missIDs, a.ensureActivationOptions())
+	a.recordRegistryLatency(ctx, start, err)
+	a.ensureSem.Release(1)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error ensuring activation of %d actors in registry: %w",
+			len(missIDs), err)
+	}
+	if len(missResults) != len(missIDs) {
+		return nil, fmt.Errorf(
+			"registry returned %d results for bulk activation of %d actors",
+			len(missResults), len(missIDs))
+	}
+
+	var (
+		cachedAt = a.clock.Now()
+		// fetchedVS is the versionstamp for the results that the registry did not report
+		// one for. It's only fetched once for the entire batch.
+		fetchedVS = int64(-1)
+	)
+	for j, result := range missResults {
+		i := missIdxs[j]
+		vs := result.VersionStamp
+		if vs > 0 {
+			vs = a.observeVersionStamp(floor, vs)
+		} else if result.Err == nil {
+			if fetchedVS < 0 {
+				fetchedVS = a.getVersionStamp(ctx)
+			}
+			vs = fetchedVS
+		}
+		if result.Err != nil {
+			result.Err = fmt.Errorf(
+				"error ensuring activation of actor: %s in registry: %w",
+				actorIDs[i], result.Err)
+		}
+		if cacheKeys[i] != nil {
+			a.updateCache(cacheKeys[i], activationCacheEntry{
+				references:           result.References,
+				err:                  result.Err,
+				cachedAt:             cachedAt,
+				registryVersionStamp: vs,
+				namespace:            namespace,
+				moduleID:             moduleID,
+				actorID:              actorIDs[i],
+			})
+		}
+		results[i] = result
+	}
+
+	return results, nil
+}
+
+// updateCache stores the result of ensuring an actor's activation in the cache under
+// cacheKey. Errors are only cached (negatively) if they're terminal and negative
+// caching is enabled.
+//
+// Results that were resolved at a lower registry versionstamp than a result that was
+// previously cached for the same key are discarded so that slow calls that race with
+// faster ones (and registries whose versionstamp regresses) can't roll the cache back
+// to an older placement. Results whose versionstamp is unknown (0) are always cached.
+// The versionstamp is only tracked while the key is cached, so once its entry is
+// deleted or evicted any result can be cached again.
+func (a *activationsCache) updateCache(cacheKey []byte, ace activationCacheEntry) {
+	var ttl time.Duration
+	if ace.err != nil {
+		if a.opts.NegativeCacheTTL <= 0 || !isTerminalEnsureActivationErr(ace.err) {
+			return
+		}
+		ttl = a.opts.NegativeCacheTTL
+	} else {
+		// Set a TTL on the cache entry so that if the generation count increases
+		// it will eventually get reflected in the system even if its not immediate.
+		// Note that the purpose the generation count is is for code/setting upgrades
+		// so it does not need to take effect immediately.
+		ttl = a.ttl
+		if a.opts.RefreshJitter > 0 {
+			ace.refreshJitter = time.Duration(a.randInt63n(int64(a.opts.RefreshJitter)))
+		}
+	}
+
+	// Note that we need to copy the cache key before we call Set() since it may be
+	// returned to the pool when ensureActivation() returns.
+	key := string(cacheKey)
+
+	// The index's lock is held while the cache is updated so that concurrent updates
+	// for the same key reach the cache in the same order as they're indexed. Set()
+	// never blocks or calls the eviction callbacks (which need the lock) synchronously.
+	a.index.Lock()
+	defer a.index.Unlock()
+	// Keys that are cached already can always be updated, otherwise the namespace must
+	// have room for another entry.
+	keys := a.index.m[ace.namespace]
+	if _, ok := keys[key]; !ok && !a.quotas.admitCacheEntry(ace.namespace, len(keys)) {
+		return
+	}
+	gen, ok := a.index.addWithLock(ace.namespace, ace.moduleID, key, ace.registryVersionStamp)
+	if !ok {
+		a.staleUpdatesRejected.Add(1)
+		return
+	}
+	ace.indexGen = gen
+	if a.events.enabled() && ace.err == nil {
+		a.publishPlacementChange(key, ace)
+	}
+	if !a.c.SetWithTTL([]byte(key), ace, a.entryCost(ace), ttl) {
+		// Set was dropped so the entry will never be evicted.
+		a.index.removeWithLock(ace.namespace, key, ace.indexGen)
+	}
+}
+
+// publishPlacementChange publishes a LifecycleEventMigrated event if ace places its actor
+// on a different server than the entry that is currently cached for key. Actors that
+// move away from this server are not published since the server publishes their
+// deactivation (or handoff) itself.
+func (a *activationsCache) publishPlacementChange(key string, ace activationCacheEntry) {
+	prevI, ok := a.c.Get([]byte(key))
+	if !ok {
+		return
+	}
+	prev := prevI.(activationCacheEntry)
+	if prev.err != nil || len(prev.references) == 0 || len(ace.references) == 0 {
+		return
+	}
+	prevServerID, serverID := prev.references[0].ServerID(), ace.references[0].ServerID()
+	if prevServerID == serverID || prevServerID == a.events.serverID {
+		return
+	}
+	a.events.publishEvent(LifecycleEvent{
+		Type:             LifecycleEventMigrated,
+		Namespace:        ace.namespace,
+		ModuleID:         ace.moduleID,
+		ActorID:          ace.actorID,
+		ServerID:         serverID,
+		PreviousServerID: prevServerID,
+		Reason:           "placement_changed",
+	})
+}
+
+// entryCost returns the cost of caching ace (see ActivationsCacheOptions.ModuleCosts).
+// Negative entries always cost 1.
+func (a *activationsCache) entryCost(ace activationCacheEntry) int64 {
+	if ace.err != nil {
+		return 1
+	}
+	cost, ok := a.opts.ModuleCosts[types.NewNamespacedIDNoType(ace.namespace, ace.moduleID)]
+	if !ok {
+		cost = 1
+		for _, ref := range ace.references {
+			if ref.CacheCost() > cost {
+				cost = ref.CacheCost()
+			}
+		}
+	}
+	if cost > a.opts.MaxCachedActivations {
+		return a.opts.MaxCachedActivations
+	}
+	return cost
+}
+
+// delete removes the cache entry for the provided actor, if any.
+func (a *activationsCache) delete(namespace, moduleID, actorID string) {
+	key := formatActorCacheKey(nil, namespace, moduleID, actorID)
+	a.index.Lock()
+	defer a.index.Unlock()
+	if a.events.enabled() {
+		a.publishInvalidation(key, namespace, moduleID, actorID)
+	}
+	a.c.Del(key)
+	a.index.removeWithLock(namespace, string(key), 0)
+}
+
+// publishInvalidation publishes a LifecycleEventCacheInvalidated event if an entry is
+// cached for key. The index's lock must be held.
+func (a *activationsCache) publishInvalidation(key []byte, namespace, moduleID, actorID string) {
+	if _, ok := a.index.m[namespace][string(key)]; !ok {
+		return
+	}
+	var serverID string
+	if aceI, ok := a.c.Get(key); ok {
+		if ace := aceI.(activationCacheEntry); len(ace.references) > 0 {
+			serverID = ace.references[0].ServerID()
+		}
+	}
+	a.events.publishEvent(LifecycleEvent{
+		Type:      LifecycleEventCacheInvalidated,
+		Namespace: namespace,
+		ModuleID:  moduleID,
+		ActorID:   actorID,
+		ServerID:  serverID,
+		Reason:    "deleted",
+	})
+}
+
+// deleteNamespace removes the cache entries for all the actors in the provided
+// namespace. Note that entries that are being concurrently refreshed may be
+// re-added after they're deleted.
+func (a *activationsCache) deleteNamespace(namespace string) {
+	for _, key := range a.index.removeAll(namespace, func(string) bool { return true }) {
+		a.c.Del([]byte(key))
+	}
+}
+
+// deleteModule is the same as deleteNamespace, except it only removes the cache
+// entries for the actors of the provided module.
+func (a *activationsCache) deleteModule(namespace, moduleID string) {
+	keys := a.index.removeAll(namespace, func(entryModuleID string) bool {
+		return entryModuleID == moduleID
+	})
+	for _, key := range keys {
+		a.c.Del([]byte(key))
+	}
+}
+
+// onEvict is called by ristretto when an entry is removed from the cache for any
+// reason other than an explicit call to Del().
+func (a *activationsCache) onEvict(item *ristretto.Item) {
+	a.evicted(item, false)
+}
+
+// onReject is called by ristretto when an entry is rejected by its admission policy.
+func (a *activationsCache) onReject(item *ristretto.Item) {
+	a.evicted(item, true)
+}
+
+func (a *activationsCache) evicted(item *ristretto.Item, rejected bool) {
+	ace, ok := item.Value.(activationCacheEntry)
+	if !ok {
+		return
+	}
+	key := string(formatActorCacheKey(nil, ace.namespace, ace.moduleID, ace.actorID))
+	a.index.remove(ace.namespace, key, ace.indexGen)
+
+	if a.opts.OnEvict != nil {
+		a.opts.OnEvict(EvictedActivation{
+			Namespace:            ace.namespace,
+			ModuleID:             ace.moduleID,
+			ActorID:              ace.actorID,
+			References:           ace.references,
+			Err:                  ace.err,
+			CachedAt:             ace.cachedAt,
+			RegistryVersionStamp: ace.registryVersionStamp,
+			Rejected:             rejected,
+		})
+	}
+}
+
+// namespaceEntries returns the number of entries in the cache by namespace.
+func (a *activationsCache) namespaceEntries() map[string]int {
+	a.index.Lock()
+	defer a.index.Unlock()
+	entries := make(map[string]int, len(a.index.m))
+	for namespace, keys := range a.index.m {
+		entries[namespace] = len(keys)
+	}
+	return entries
+}
+
+// stats returns point-in-time statistics about the cache.
+func (a *activationsCache) stats() ActivationCacheStats {
+	var (
+		m                 = a.c.Metrics
+		length            = int64(m.KeysAdded() - m.KeysEvicted())
+		cost              = int64(m.CostAdded() - m.CostEvicted())
+		maxCost           = a.c.MaxCost()
+		effectiveCapacity = maxCost
+	)
+	if length > 0 && cost > length {
+		effectiveCapacity = maxCost * length / cost
+	}
+	return ActivationCacheStats{
+		Len:               length,
+		Cost:              cost,
+		MaxCost:           maxCost,
+		EffectiveCapacity: effectiveCapacity,
+		KeysEvicted:       m.KeysEvicted(),
+
+		EnsureCallsDeduped:   a.ensureCallsDeduped.Load(),
+		EnsureCallsAbandoned: a.ensureCallsAbandoned.Load(),
+		EnsureCallsRejected:  a.ensureCallsRejected.Load(),
+		EnsureCallsRetried:   a.ensureCallsRetried.Load(),
+		RefreshesSkipped:     a.refreshesSkipped.Load(),
+		RefreshesDropped:     a.refreshesDropped.Load(),
+		EnsureErrorsHeld:     a.ensureErrorsHeld.Load(),
+
+		StaleUpdatesRejected:          a.staleUpdatesRejected.Load(),
+		BlacklistedReferencesRejected: a.blacklistedReferencesRejected.Load(),
+
+		EnsureSemaphoreWaits:    a.ensureSemWaits.Load(),
+		EnsureSemaphoreWaitTime: time.Duration(a.ensureSemWaitNanos.Load()),
+		EnsureCallsOverloaded:   a.ensureCallsOverloaded.Load(),
+
+		Failovers:          a.failovers.Load(),
+		UnreachableServers: a.unreachableServers.Load(),
+
+		RegistryLatency:         a.registryLatency.average(),
+		SlowRegistry:            a.slowRegistryFactor() > 1,
+		EffectiveCacheStaleness: a.effectiveStaleness(a.opts.IdealCacheStaleness),
+		EffectiveEnsureTimeout:  a.ensureTimeout(),
+	}
+}
+
+// isStale returns whether ace is stale according to the staleness configured for
+// namespace plus the entry's refresh jitter.
+func (a *activationsCache) isStale(namespace string, ace activationCacheEntry) bool {
+	staleness := a.opts.IdealCacheStaleness
+	if a.opts.NamespaceCacheStaleness != nil {
+		if nsStaleness := a.opts.NamespaceCacheStaleness(namespace); nsStaleness > 0 {
+			staleness = nsStaleness
+		}
+	}
+	return staleness > 0 &&
+		a.clock.Now().Sub(ace.cachedAt) > a.effectiveStaleness(staleness)+ace.refreshJitter
+}
+
+// get returns the cache entry for cacheKey, if any. Entries that are older than
+// MaxCacheAge, or that reference an activation whose lease may have expired since they
+// were cached, are treated as a miss.
+func (a *activationsCache) get(cacheKey []byte) (activationCacheEntry, bool) {
+	aceI, ok := a.c.Get(cacheKey)
+	if !ok {
+		return activationCacheEntry{}, false
+	}
+
+	ace := aceI.(activationCacheEntry)
+	if a.isExpired(ace) {
+		return activationCacheEntry{}, false
+	}
+	return ace, true
+}
+
+// isExpired returns whether ace is older than MaxCacheAge, or than the lease of one of
+// its references.
+func (a *activationsCache) isExpired(ace activationCacheEntry) bool {
+	age := a.clock.Now().Sub(ace.cachedAt)
+	if a.opts.MaxCacheAge > 0 && age > a.opts.MaxCacheAge {
+		return true
+	}
+	for _, ref := range ace.references {
+		// The lease may have been renewed since, but the registry is the only one that
+		// knows so the entry needs to be resolved again.
+		if lease := ref.Lease(); !lease.IsZero() && age >= lease.Duration {
+			return true
+		}
+	}
+	return false
+}
+
+// isTerminalEnsureActivationErr returns a boolean indicating whether err is a terminal
+// error that will not go away if EnsureActivation() is retried with the same arguments,
+// and is therefore safe to cache negatively.
+func isTerminalEnsureActivationErr(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	return registry.IsModuleDoesNotExistErr(err) || registry.IsActorDoesNotExistErr(err)
+}
+
+// addWithLock indexes key for an entry that was resolved at versionStamp and returns the
+// generation it was indexed with. It returns false (and leaves the index untouched)
+// instead if key is already indexed for an entry that was resolved at a higher
+// versionstamp. The lock must be held.
+func (idx *activationsCacheIndex) addWithLock(
+	namespace, moduleID, key string,
+	versionStamp int64,
+) (uint64, bool) {
+	keys, ok := idx.m[namespace]
+	if !ok {
+		keys = make(map[string]activationsCacheIndexEntry)
+		idx.m[namespace] = keys
+	}
+	prev, ok := keys[key]
+	if ok && versionStamp != 0 && versionStamp < prev.versionStamp {
+		return 0, false
+	}
+	if versionStamp < prev.versionStamp {
+		versionStamp = prev.versionStamp
+	}
+
+	idx.gen++
+	keys[key] = activationsCacheIndexEntry{
+		moduleID:     moduleID,
+		gen:          idx.gen,
+		versionStamp: versionStamp,
+		replicas:     prev.replicas,
+	}
+	return idx.gen, true
+}
+
+// remove removes key from the index. If gen is not 0 then key will only be removed
+// if it was indexed with the same generation.
+func (idx *activationsCacheIndex) remove(namespace, key string, gen uint64) {
+	idx.Lock()
+	defer idx.Unlock()
+	idx.removeWithLock(namespace, key, gen)
+}
+
+// removeWithLock is the same as remove, except the lock must be held.
+func (idx *activationsCacheIndex) removeWithLock(namespace, key string, gen uint64) {
+	keys, ok := idx.m[namespace]
+	if !ok {
+		return
+	}
+	entry, ok := keys[key]
+	if !ok || (gen != 0 && entry.gen != gen) {
+		return
+	}
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(idx.m, namespace)
+	}
+}
+
+// removeAll removes all the keys in namespace whose module matches shouldRemove from
+// the index and returns them.
+func (idx *activationsCacheIndex) removeAll(
+	namespace string,
+	shouldRemove func(moduleID string) bool,
+) []string {
+	idx.Lock()
+	defer idx.Unlock()
+
+	keys := idx.m[namespace]
+	removed := make([]string, 0, len(keys))
+	for key, entry := range keys {
+		if shouldRemove(entry.moduleID) {
+			removed = append(removed, key)
+			delete(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		delete(idx.m, namespace)
+	}
+	return removed
+}
+
+// formatActorCacheKey appends the cache key for the provided actor to dst and
+// returns the result. If dst is nil then a new slice of exactly the right size is
+// allocated. The module is part of the key since actors with the same ID in different
+// modules are different actors.
+//
+// The namespace and the module are prefixed with their length (as uvarints) instead of
+// being separated by a delimiter, since IDs can contain any byte: otherwise two distinct
+// actors like ("ab", "c", "d") and ("a", "bc", "d") would map to the same key and the
+// invocations of one would be routed to the other. The actor ID is the remainder of the
+// key so it doesn't need a prefix.
+func formatActorCacheKey(dst []byte, namespace, moduleID, actorID string) []byte {
+	if dst == nil {
+		dst = make([]byte, 0, uvarintLen(len(namespace))+len(namespace)+
+			uvarintLen(len(moduleID))+len(moduleID)+len(actorID))
+	}
+	dst = binary.AppendUvarint(dst, uint64(len(namespace)))
+	dst = append(dst, namespace...)
+	dst = binary.AppendUvarint(dst, uint64(len(moduleID)))
+	dst = append(dst, moduleID...)
+	dst = append(dst, actorID...)
+	return dst
+}
+
+// uvarintLen returns the number of bytes that binary.AppendUvarint uses to encode n.
+func uvarintLen(n int) int {
+	l := 1
+	for ; n >= 0x80; n >>= 7 {
+		l++
+	}
+	return l
+}
@@ -0,0 +1,378 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	simNumSeeds = 10
+	simNumSteps = 200
+	// simSettleWindow is how long the simulation waits for the goroutines it started to
+	// stop making progress before it takes its next step.
+	simSettleWindow = 2 * time.Millisecond
+)
+
+var (
+	simServers = []string{"server1", "server2", "server3"}
+	simActors  = []string{"a", "b", "c"}
+)
+
+// TestActivationsCacheSimulation drives the activations cache with a simulated registry
+// under randomized (but seeded, so failures can be reproduced by re-running the seed)
+// interleavings of cache lookups, background refreshes, registry responses and faults
+// like errors, registries that ignore the blacklist and versionstamp regressions. The
+// simulation controls when every registry call returns and when every background refresh
+// runs, and asserts after every step that:
+//
+//  1. The cache never replaces an entry with one that was resolved at a lower registry
+//     versionstamp (unless the entry was deleted in between).
+//  2. No lookup ever returns a reference to a server that was blacklisted before the
+//     lookup started.
+func TestActivationsCacheSimulation(t *testing.T) {
+	for seed := int64(0); seed < simNumSeeds; seed++ {
+		t.Run(fmt.Sprintf("seed-%d", seed), func(t *testing.T) {
+			newCacheSim(t, seed).run(simNumSteps)
+		})
+	}
+}
+
+type cacheSim struct {
+	t     *testing.T
+	rand  *rand.Rand
+	cache *activationsCache
+	clock *fakeClock
+	reg   *simRegistry
+
+	// tasks is the background work that the cache scheduled but that has not run yet.
+	tasksMu sync.Mutex
+	tasks   []func()
+
+	// wg tracks the lookups and background tasks that were started by the simulation.
+	wg sync.WaitGroup
+	// progress is incremented every time a goroutine started by the simulation makes
+	// progress that the simulation can observe.
+	progressMu sync.Mutex
+	progress   int
+
+	// watermarks contains the highest versionstamp that was observed in the cache for
+	// every actor since it was last deleted.
+	watermarks map[string]int64
+}
+
+func newCacheSim(t *testing.T, seed int64) *cacheSim {
+	s := &cacheSim{
+		t:          t,
+		rand:       rand.New(rand.NewSource(seed)),
+		clock:      newFakeClock(),
+		watermarks: make(map[string]int64),
+	}
+	s.reg = &simRegistry{sim: s, versionStamp: 1}
+
+	c, err := newActivationsCache(s.reg, time.Hour, false, ActivationsCacheOptions{
+		IdealCacheStaleness:              time.Second,
+		EnsureTimeout:                    time.Hour,
+		MaxConcurrentEnsureCalls:         1000,
+		MaxConcurrentBackgroundRefreshes: 1000,
+	})
+	require.NoError(t, err)
+	c.clock = s.clock
+	c.goAsync = func(fn func()) {
+		s.tasksMu.Lock()
+		defer s.tasksMu.Unlock()
+		s.tasks = append(s.tasks, fn)
+	}
+	s.cache = c
+	return s
+}
+
+func (s *cacheSim) run(numSteps int) {
+	for i := 0; i < numSteps; i++ {
+		s.step()
+		s.settle()
+		s.checkVersionStamps()
+	}
+
+	// Let everything that is in flight complete so that no goroutines are leaked.
+	for {
+		done := make(chan struct{})
+		go func() {
+			s.wg.Wait()
+			close(done)
+		}()
+		s.settle()
+		select {
+		case <-done:
+			return
+		default:
+		}
+		s.reg.releaseAll()
+		s.runTasks()
+		<-time.After(simSettleWindow)
+	}
+}
+
+// step takes a single randomly chosen step of the simulation.
+func (s *cacheSim) step() {
+	actorID := simActors[s.rand.Intn(len(simActors))]
+	switch n := s.rand.Intn(100); {
+	case n < 25:
+		s.lookup(actorID, 0)
+	case n < 30:
+		// Lookups that require a minimum versionstamp bypass the deduplication of
+		// registry calls so they race with the ones that don't.
+		s.lookup(actorID, s.reg.getVersionStamp()-int64(s.rand.Intn(3)))
+	case n < 60:
+		s.reg.releaseOne()
+	case n < 75:
+		s.runTask()
+	case n < 82:
+		s.clock.advance(time.Duration(s.rand.Intn(2000)) * time.Millisecond)
+	case n < 86:
+		s.cache.blacklistServer(simServers[s.rand.Intn(len(simServers))], 24*time.Hour)
+	case n < 91:
+		// Versionstamp regressions, like those of a registry that fails over to a replica
+		// that is lagging behind.
+		s.reg.addVersionStamp(-int64(s.rand.Intn(3)))
+	case n < 97:
+		s.reg.addVersionStamp(int64(s.rand.Intn(3)))
+	default:
+		s.cache.delete("ns-1", "test-module", actorID)
+		delete(s.watermarks, actorID)
+	}
+}
+
+// lookup ensures the activation of the actor in the background and asserts that it
+// doesn't return a reference to a server that was blacklisted before it started.
+func (s *cacheSim) lookup(actorID string, minVersionStamp int64) {
+	blacklisted := s.cache.ensureActivationOptions().BlacklistedServerIDs
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.madeProgress()
+
+		var (
+			ctx  = context.Background()
+			refs []types.ActorReference
+			err  error
+		)
+		if minVersionStamp > 0 {
+			refs, err = s.cache.ensureActivationAtLeast(ctx, "ns-1", "test-module", actorID, minVersionStamp)
+		} else {
+			refs, err = s.cache.ensureActivation(ctx, "ns-1", "test-module", actorID)
+		}
+		if err != nil {
+			return
+		}
+		for _, ref := range refs {
+			for _, serverID := range blacklisted {
+				if ref.ServerID() == serverID {
+					s.t.Errorf(
+						"lookup of actor: %s returned blacklisted server: %s (blacklisted: %v)",
+						actorID, serverID, blacklisted)
+				}
+			}
+		}
+	}()
+}
+
+// runTask runs one of the background tasks that were scheduled by the cache, if any.
+func (s *cacheSim) runTask() {
+	s.tasksMu.Lock()
+	if len(s.tasks) == 0 {
+		s.tasksMu.Unlock()
+		return
+	}
+	i := s.rand.Intn(len(s.tasks))
+	task := s.tasks[i]
+	s.tasks = append(s.tasks[:i], s.tasks[i+1:]...)
+	s.tasksMu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.madeProgress()
+		task()
+	}()
+}
+
+// runTasks runs all the background tasks that were scheduled by the cache.
+func (s *cacheSim) runTasks() {
+	for {
+		s.tasksMu.Lock()
+		numTasks := len(s.tasks)
+		s.tasksMu.Unlock()
+		if numTasks == 0 {
+			return
+		}
+		s.runTask()
+	}
+}
+
+func (s *cacheSim) madeProgress() {
+	s.progressMu.Lock()
+	defer s.progressMu.Unlock()
+	s.progress++
+}
+
+// settle waits until the goroutines started by the simulation stop making progress,
+// which happens once they've all completed or are blocked on the simulated registry.
+func (s *cacheSim) settle() {
+	last := -1
+	for {
+		s.progressMu.Lock()
+		progress := s.progress
+		s.progressMu.Unlock()
+		if progress == last {
+			return
+		}
+		last = progress
+		<-time.After(simSettleWindow)
+	}
+}
+
+// checkVersionStamps asserts that the versionstamps of the cached entries never
+// decrease.
+func (s *cacheSim) checkVersionStamps() {
+	s.cache.c.Wait()
+	for _, actorID := range simActors {
+		v, ok := s.cache.c.Get(formatActorCacheKey(nil, "ns-1", "test-module", actorID))
+		if !ok {
+			continue
+		}
+		ace := v.(activationCacheEntry)
+		if ace.err != nil || ace.registryVersionStamp == 0 {
+			continue
+		}
+		require.GreaterOrEqual(
+			s.t, ace.registryVersionStamp, s.watermarks[actorID],
+			"cache of actor: %s regressed to a lower versionstamp", actorID)
+		s.watermarks[actorID] = ace.registryVersionStamp
+	}
+}
+
+// simRegistry is a registry whose EnsureActivation() calls block until the simulation
+// releases them with a randomly chosen response.
+type simRegistry struct {
+	registry.Registry
+
+	sim *cacheSim
+
+	sync.Mutex
+	versionStamp int64
+	pending      []*simEnsureCall
+}
+
+type simEnsureCall struct {
+	actorID string
+	opts    registry.EnsureActivationOptions
+	resp    chan simEnsureResponse
+}
+
+type simEnsureResponse struct {
+	refs []types.ActorReference
+	err  error
+}
+
+func (r *simRegistry) EnsureActivation(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+	opts registry.EnsureActivationOptions,
+) ([]types.ActorReference, error) {
+	call := &simEnsureCall{actorID: actorID, opts: opts, resp: make(chan simEnsureResponse, 1)}
+	r.Lock()
+	r.pending = append(r.pending, call)
+	r.Unlock()
+	r.sim.madeProgress()
+
+	select {
+	case resp := <-call.resp:
+		return resp.refs, resp.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r *simRegistry) GetVersionStamp(ctx context.Context) (int64, error) {
+	return r.getVersionStamp(), nil
+}
+
+func (r *simRegistry) getVersionStamp() int64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.versionStamp
+}
+
+func (r *simRegistry) addVersionStamp(delta int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.versionStamp += delta
+	if r.versionStamp < 1 {
+		r.versionStamp = 1
+	}
+}
+
+// releaseOne responds to one of the pending EnsureActivation() calls, if any.
+func (r *simRegistry) releaseOne() {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.pending) == 0 {
+		return
+	}
+	i := r.sim.rand.Intn(len(r.pending))
+	call := r.pending[i]
+	r.pending = append(r.pending[:i], r.pending[i+1:]...)
+	call.resp <- r.responseWithLock(call)
+}
+
+// releaseAll responds to all of the pending EnsureActivation() calls.
+func (r *simRegistry) releaseAll() {
+	r.Lock()
+	defer r.Unlock()
+	for _, call := range r.pending {
+		call.resp <- r.responseWithLock(call)
+	}
+	r.pending = nil
+}
+
+func (r *simRegistry) responseWithLock(call *simEnsureCall) simEnsureResponse {
+	if r.sim.rand.Intn(5) == 0 {
+		return simEnsureResponse{err: errors.New("injected error")}
+	}
+
+	eligible := make([]string, 0, len(simServers))
+	for _, serverID := range simServers {
+		blacklisted := false
+		for _, blacklistedID := range call.opts.BlacklistedServerIDs {
+			blacklisted = blacklisted || blacklistedID == serverID
+		}
+		if !blacklisted {
+			eligible = append(eligible, serverID)
+		}
+	}
+	if len(eligible) == 0 || r.sim.rand.Intn(5) == 0 {
+		// Misbehave by ignoring the blacklist.
+		eligible = simServers
+	}
+	serverID := eligible[r.sim.rand.Intn(len(eligible))]
+	ref, err := types.NewActorReference(
+		serverID, 1, serverID, "ns-1", "test-module", call.actorID, 1)
+	if err != nil {
+		return simEnsureResponse{err: err}
+	}
+	// Placements are made at increasing versionstamps.
+	r.versionStamp++
+	return simEnsureResponse{refs: []types.ActorReference{ref}}
+}
@@ -0,0 +1,1880 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestActivationsCacheMaxConcurrentEnsureCalls ensures that the activations cache never
+// makes more than MaxConcurrentEnsureCalls concurrent calls to the registry.
+func TestActivationsCacheMaxConcurrentEnsureCalls(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	reg.ensureDelay = 10 * time.Millisecond
+
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		MaxConcurrentEnsureCalls: 2,
+	})
+	require.NoError(t, err)
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, 20)
+	)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = c.ensureActivation(
+				context.Background(), "ns-1", "test-module", fmt.Sprintf("actor-%d", i))
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, int64(20), reg.numEnsureCalls.Load())
+	require.LessOrEqual(t, reg.maxInFlight.Load(), int64(2))
+}
+
+// TestActivationsCacheEnsureTimeout ensures that the configured EnsureTimeout is applied
+// to calls to the registry.
+func TestActivationsCacheEnsureTimeout(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	reg.ensureDelay = time.Hour
+
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		EnsureTimeout: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	require.Less(t, time.Since(start), time.Minute)
+}
+
+// TestActivationsCacheCallerDeadline ensures that cache misses don't wait on the registry
+// (and the registry isn't asked to work) for longer than the caller's deadline, that calls
+// cut short by the caller's deadline don't count against the registry, and that callers
+// that were waiting on such a call but have more time left make a new one.
+func TestActivationsCacheCallerDeadline(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	reg.ensureDelay = 500 * time.Millisecond
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		EnsureTimeout:                  5 * time.Second,
+		CircuitBreakerFailureThreshold: 1,
+		EnsureErrorHoldDuration:        time.Minute,
+	})
+	require.NoError(t, err)
+
+	ctx, cc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cc()
+	start := time.Now()
+	_, err = c.ensureActivation(ctx, "ns-1", "test-module", "a")
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	require.Less(t, time.Since(start), reg.ensureDelay)
+	require.LessOrEqual(t, time.Duration(reg.lastEnsureTimeout.Load()), 100*time.Millisecond)
+	require.Equal(t, circuitBreakerClosed, c.breaker.getState())
+	require.Equal(t, time.Duration(0), c.stats().RegistryLatency)
+
+	// The error is not held.
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), reg.numEnsureCalls.Load())
+
+	// A caller without a deadline that is waiting on the call of a caller with a deadline
+	// makes its own call once the other caller's deadline expires.
+	leaderErrCh := make(chan error, 1)
+	go func() {
+		ctx, cc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cc()
+		_, err := c.ensureActivation(ctx, "ns-1", "test-module", "b")
+		leaderErrCh <- err
+	}()
+	require.Eventually(t, func() bool {
+		return reg.inFlight.Load() == 1
+	}, 5*time.Second, time.Millisecond)
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "b")
+	require.NoError(t, err)
+	require.True(t, errors.Is(<-leaderErrCh, context.DeadlineExceeded))
+	require.Equal(t, int64(4), reg.numEnsureCalls.Load())
+	require.GreaterOrEqual(t, c.stats().EnsureCallsDeduped, uint64(1))
+}
+
+// TestActivationsCacheMaxEnsureWait ensures that cache misses fail fast with
+// ErrRegistryOverloaded (or fall back to the cached references) when no
+// MaxConcurrentEnsureCalls slot frees up within MaxEnsureWait.
+func TestActivationsCacheMaxEnsureWait(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	clock := newFakeClock()
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{
+		MaxConcurrentEnsureCalls: 1,
+		MaxEnsureWait:            10 * time.Millisecond,
+		ServeStaleWhenOverloaded: true,
+		IdealCacheStaleness:      time.Second,
+		DisableBackgroundRefresh: true,
+		Clock:                    clock,
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	cached, err := c.ensureActivation(ctx, "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	stats := c.stats()
+	require.Equal(t, uint64(0), stats.EnsureSemaphoreWaits)
+
+	// Saturate the semaphore with a call that blocks.
+	reg.ensureDelay = time.Hour
+	blockedCtx, cancelBlocked := context.WithCancel(ctx)
+	blockedDone := make(chan struct{})
+	go func() {
+		defer close(blockedDone)
+		c.ensureActivation(blockedCtx, "ns-1", "test-module", "blocked")
+	}()
+	require.Eventually(t, func() bool {
+		return reg.inFlight.Load() == 1
+	}, 5*time.Second, time.Millisecond)
+
+	start := time.Now()
+	_, err = c.ensureActivation(ctx, "ns-1", "test-module", "b")
+	require.True(t, IsRegistryOverloadedErr(err), err)
+	require.Less(t, time.Since(start), time.Second)
+
+	// Stale references are served instead of failing.
+	clock.advance(time.Minute)
+	refs, err := c.ensureActivation(ctx, "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.Equal(t, cached, refs)
+
+	stats = c.stats()
+	require.Equal(t, uint64(2), stats.EnsureCallsOverloaded)
+	require.Equal(t, uint64(2), stats.EnsureSemaphoreWaits)
+	require.GreaterOrEqual(t, stats.EnsureSemaphoreWaitTime, 20*time.Millisecond)
+
+	cancelBlocked()
+	<-blockedDone
+}
+
+// TestActivationsCacheDedupEnsureCalls ensures that concurrent calls for the same actor
+// are deduplicated onto a single registry call, and that callers whose context is
+// cancelled stop waiting for it without failing the other callers.
+func TestActivationsCacheDedupEnsureCalls(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	reg.ensureDelay = 500 * time.Millisecond
+
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{})
+	require.NoError(t, err)
+
+	ensureCancellable := func() (context.CancelFunc, chan error) {
+		ctx, cc := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := c.ensureActivation(ctx, "ns-1", "test-module", "a")
+			errCh <- err
+		}()
+		return cc, errCh
+	}
+
+	// Start the leader first so that it's the one whose context is used for the shared
+	// call.
+	cancelLeader, leaderErrCh := ensureCancellable()
+	require.Eventually(t, func() bool {
+		return reg.inFlight.Load() == 1
+	}, 5*time.Second, time.Millisecond)
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, 4)
+	)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+		}(i)
+	}
+	cancelFollower, followerErrCh := ensureCancellable()
+
+	// Give the followers a chance to join the in-flight call.
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	cancelLeader()
+	cancelFollower()
+	require.True(t, errors.Is(<-leaderErrCh, context.Canceled))
+	require.True(t, errors.Is(<-followerErrCh, context.Canceled))
+	require.Less(t, time.Since(start), reg.ensureDelay/2)
+
+	// The shared call should not have been cancelled along with the leader.
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+
+	stats := c.stats()
+	require.Equal(t, uint64(4), stats.EnsureCallsDeduped)
+	require.Equal(t, uint64(2), stats.EnsureCallsAbandoned)
+}
+
+// TestActivationsCacheCircuitBreaker ensures that the circuit breaker opens after too many
+// consecutive EnsureActivation() failures, falls back to cached references while open,
+// and probes the registry once the cooldown has elapsed.
+func TestActivationsCacheCircuitBreaker(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		CircuitBreakerFailureThreshold: 3,
+		CircuitBreakerCooldown:         10 * time.Second,
+	})
+	require.NoError(t, err)
+	clock := newFakeClock()
+	c.clock = clock
+
+	ctx := context.Background()
+	cached, err := c.ensureActivation(ctx, "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	c.c.Wait()
+
+	// Closed -> open after 3 consecutive failures.
+	reg.failEnsure.Store(true)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, circuitBreakerClosed, c.breaker.getState())
+		_, err := c.refreshActivation(ctx, "ns-1", "test-module", "a")
+		require.Error(t, err)
+		require.False(t, IsRegistryUnavailableErr(err))
+	}
+	require.Equal(t, circuitBreakerOpen, c.breaker.getState())
+	require.Equal(t, int64(4), reg.numEnsureCalls.Load())
+
+	// While open the registry is not called. Cached references are returned if there are
+	// any, and ErrRegistryUnavailable otherwise.
+	result, err := c.refreshActivation(ctx, "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.Equal(t, cached, result.References)
+	_, err = c.ensureActivation(ctx, "ns-1", "test-module", "b")
+	require.True(t, IsRegistryUnavailableErr(err), err)
+	require.Equal(t, int64(4), reg.numEnsureCalls.Load())
+	require.Equal(t, uint64(2), c.stats().EnsureCallsRejected)
+
+	// Open -> half-open -> open when the probe fails. Only one probe is allowed at a time.
+	clock.advance(10 * time.Second)
+	require.True(t, c.breaker.allow())
+	require.Equal(t, circuitBreakerHalfOpen, c.breaker.getState())
+	require.False(t, c.breaker.allow())
+	c.breaker.skip()
+	_, err = c.ensureActivation(ctx, "ns-1", "test-module", "b")
+	require.Error(t, err)
+	require.False(t, IsRegistryUnavailableErr(err))
+	require.Equal(t, int64(5), reg.numEnsureCalls.Load())
+	require.Equal(t, circuitBreakerOpen, c.breaker.getState())
+
+	// Open -> half-open -> closed when the probe succeeds.
+	reg.failEnsure.Store(false)
+	clock.advance(9 * time.Second)
+	_, err = c.ensureActivation(ctx, "ns-1", "test-module", "b")
+	require.True(t, IsRegistryUnavailableErr(err), err)
+	clock.advance(time.Second)
+	_, err = c.ensureActivation(ctx, "ns-1", "test-module", "b")
+	require.NoError(t, err)
+	require.Equal(t, circuitBreakerClosed, c.breaker.getState())
+	require.Equal(t, int64(6), reg.numEnsureCalls.Load())
+}
+
+// TestActivationsCacheEnsureRetries ensures that EnsureActivation() calls that fail with
+// retryable errors are retried with backoff, and that retries are bounded by the max
+// attempts and the ensure timeout.
+func TestActivationsCacheEnsureRetries(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		EnsureRetryMaxAttempts: 3,
+		EnsureRetryBaseBackoff: time.Millisecond,
+		EnsureRetryJitter:      time.Millisecond,
+	})
+	require.NoError(t, err)
+	var jitterCalls atomic.Int64
+	c.randInt63n = func(n int64) int64 {
+		jitterCalls.Add(1)
+		return n - 1
+	}
+
+	// Transient failures are retried.
+	ctx := context.Background()
+	reg.numEnsureFailures.Store(2)
+	_, err = c.ensureActivation(ctx, "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), reg.numEnsureCalls.Load())
+	require.Equal(t, uint64(2), c.stats().EnsureCallsRetried)
+	require.Equal(t, int64(2), jitterCalls.Load())
+
+	// Up to EnsureRetryMaxAttempts.
+	reg.numEnsureFailures.Store(3)
+	_, err = c.ensureActivation(ctx, "ns-1", "test-module", "b")
+	require.Error(t, err)
+	require.Equal(t, int64(6), reg.numEnsureCalls.Load())
+
+	// Terminal errors are not retried.
+	reg.numEnsureFailures.Store(0)
+	_, err = c.ensureActivation(ctx, "ns-1", "missing-module", "c")
+	require.True(t, registry.IsModuleDoesNotExistErr(err), err)
+	require.Equal(t, int64(7), reg.numEnsureCalls.Load())
+
+	// Retries that wouldn't complete before the ensure timeout are not attempted.
+	c, err = newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		EnsureTimeout:          100 * time.Millisecond,
+		EnsureRetryMaxAttempts: 3,
+		EnsureRetryBaseBackoff: time.Second,
+	})
+	require.NoError(t, err)
+	reg.numEnsureFailures.Store(1)
+	start := time.Now()
+	_, err = c.ensureActivation(ctx, "ns-1", "test-module", "d")
+	require.Error(t, err)
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, int64(8), reg.numEnsureCalls.Load())
+	require.Equal(t, uint64(0), c.stats().EnsureCallsRetried)
+}
+
+// TestActivationsCacheRegistryErrors ensures that the registry's sentinel errors can be
+// identified with errors.Is() through the cache's wrapping, including when they're
+// served from the negative cache.
+func TestActivationsCacheRegistryErrors(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	_, err := reg.RegisterModule(
+		ctx, "ns-1", "test-module", nil, registry.ModuleOptions{AllowEmptyModuleBytes: true})
+	require.NoError(t, err)
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		NegativeCacheTTL: time.Minute,
+	})
+	require.NoError(t, err)
+
+	_, err = c.ensureActivation(ctx, "ns-1", "test-module", "a")
+	require.ErrorIs(t, err, registry.ErrNoEligibleServers)
+
+	for i := 0; i < 2; i++ {
+		_, err = c.ensureActivation(ctx, "ns-1", "missing-module", "a")
+		require.ErrorIs(t, err, registry.ErrModuleNotFound)
+		c.c.Wait()
+	}
+}
+
+// TestActivationsCacheRefreshJitter ensures that entries that were cached at the same
+// time become stale at different times according to their refresh jitter.
+func TestActivationsCacheRefreshJitter(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	clock := newFakeClock()
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{
+		IdealCacheStaleness: time.Minute,
+		RefreshJitter:       time.Minute,
+		Clock:               clock,
+	})
+	require.NoError(t, err)
+	var jitterCalls atomic.Int64
+	c.randInt63n = func(n int64) int64 {
+		// 0 for the first entry and half of the jitter for the second one.
+		return n / 2 * (jitterCalls.Add(1) - 1)
+	}
+
+	var entries []activationCacheEntry
+	for _, actorID := range []string{"a", "b"} {
+		_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", actorID)
+		require.NoError(t, err)
+		c.c.Wait()
+		ace, ok := c.get(formatActorCacheKey(nil, "ns-1", "test-module", actorID))
+		require.True(t, ok)
+		entries = append(entries, ace)
+	}
+	require.Equal(t, entries[0].cachedAt, entries[1].cachedAt)
+	require.NotEqual(t, entries[0].refreshJitter, entries[1].refreshJitter)
+
+	clock.advance(time.Minute + time.Nanosecond)
+	require.True(t, c.isStale("ns-1", entries[0]))
+	require.False(t, c.isStale("ns-1", entries[1]))
+
+	clock.advance(30 * time.Second)
+	require.True(t, c.isStale("ns-1", entries[1]))
+}
+
+// TestActivationsCacheNegativeCaching ensures that terminal errors returned by the registry
+// are cached negatively, but transient errors are not.
+func TestActivationsCacheNegativeCaching(t *testing.T) {
+	t.Run("terminal", func(t *testing.T) {
+		reg := newTestCacheRegistry(t)
+		c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+			NegativeCacheTTL: time.Minute,
+		})
+		require.NoError(t, err)
+
+		for i := 0; i < 10; i++ {
+			_, err = c.ensureActivation(context.Background(), "ns-1", "does-not-exist", "a")
+			require.True(t, registry.IsModuleDoesNotExistErr(err), err)
+			c.c.Wait()
+		}
+		require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		reg := newTestCacheRegistry(t)
+		c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{})
+		require.NoError(t, err)
+
+		for i := 0; i < 10; i++ {
+			_, err = c.ensureActivation(context.Background(), "ns-1", "does-not-exist", "a")
+			require.True(t, registry.IsModuleDoesNotExistErr(err), err)
+			c.c.Wait()
+		}
+		require.Equal(t, int64(10), reg.numEnsureCalls.Load())
+	})
+
+	t.Run("transient", func(t *testing.T) {
+		reg := newTestCacheRegistry(t)
+		reg.ensureDelay = time.Hour
+		c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+			EnsureTimeout:    time.Millisecond,
+			NegativeCacheTTL: time.Minute,
+		})
+		require.NoError(t, err)
+
+		for i := 0; i < 10; i++ {
+			_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+			require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+			c.c.Wait()
+		}
+		require.Equal(t, int64(10), reg.numEnsureCalls.Load())
+	})
+}
+
+// TestActivationsCachePrefetch ensures that prefetching activations warms the cache,
+// skips keys that are already cached, and reports errors per-key.
+func TestActivationsCachePrefetch(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		MaxConcurrentEnsureCalls: 2,
+	})
+	require.NoError(t, err)
+
+	var (
+		keys = []ActivationKey{
+			{Namespace: "ns-1", ModuleID: "test-module", ActorID: "a"},
+			{Namespace: "ns-1", ModuleID: "test-module", ActorID: "b"},
+			{Namespace: "ns-1", ModuleID: "test-module", ActorID: "c"},
+		}
+		badKey = ActivationKey{Namespace: "ns-1", ModuleID: "does-not-exist", ActorID: "d"}
+	)
+	errs := c.prefetchActivations(context.Background(), append(keys, badKey))
+	require.Len(t, errs, 1)
+	require.True(t, registry.IsModuleDoesNotExistErr(errs[badKey]), errs[badKey])
+	require.Equal(t, int64(4), reg.numEnsureCalls.Load())
+	c.c.Wait()
+
+	// Keys that are already cached should be skipped.
+	errs = c.prefetchActivations(context.Background(), keys)
+	require.Empty(t, errs)
+	require.Equal(t, int64(4), reg.numEnsureCalls.Load())
+
+	// Subsequent activations should be served from the cache.
+	for _, key := range keys {
+		_, err := c.ensureActivation(
+			context.Background(), key.Namespace, key.ModuleID, key.ActorID)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(4), reg.numEnsureCalls.Load())
+}
+
+// TestActivationsCachePrefetchStaleAndNegative ensures that prefetching refreshes stale
+// entries and resolves negatively cached keys again instead of skipping them.
+func TestActivationsCachePrefetchStaleAndNegative(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	clock := newFakeClock()
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{
+		NegativeCacheTTL:    time.Hour,
+		IdealCacheStaleness: time.Minute,
+		Clock:               clock,
+	})
+	require.NoError(t, err)
+
+	var (
+		key    = ActivationKey{Namespace: "ns-1", ModuleID: "test-module", ActorID: "a"}
+		badKey = ActivationKey{Namespace: "ns-1", ModuleID: "does-not-exist", ActorID: "b"}
+	)
+	for i := 1; i <= 2; i++ {
+		errs := c.prefetchActivations(context.Background(), []ActivationKey{key, badKey})
+		require.Len(t, errs, 1)
+		require.True(t, registry.IsModuleDoesNotExistErr(errs[badKey]), errs[badKey])
+		c.c.Wait()
+		// The fresh entry is skipped the second time, but the negative one is not.
+		require.Equal(t, int64(i+1), reg.numEnsureCalls.Load())
+	}
+
+	clock.advance(time.Minute + time.Nanosecond)
+	errs := c.prefetchActivations(context.Background(), []ActivationKey{key})
+	require.Empty(t, errs)
+	require.Equal(t, int64(4), reg.numEnsureCalls.Load())
+}
+
+// TestActivationsCacheLookupActivation ensures that looking up activations never causes
+// actors to be placed and never populates the cache.
+func TestActivationsCacheLookupActivation(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{})
+	require.NoError(t, err)
+
+	references, err := c.lookupActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.Empty(t, references)
+	require.Equal(t, int64(0), reg.numEnsureCalls.Load())
+
+	// Activations that were ensured by another server are found in the registry.
+	ensured, err := reg.Registry.EnsureActivation(
+		context.Background(), "ns-1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	references, err = c.lookupActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.Equal(t, ensured, references)
+	c.c.Wait()
+	_, ok := c.get(formatActorCacheKey(nil, "ns-1", "test-module", "a"))
+	require.False(t, ok)
+
+	// Cached activations are returned without consulting the registry.
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "b")
+	require.NoError(t, err)
+	c.c.Wait()
+	require.NoError(t, reg.Registry.IncGeneration(context.Background(), "ns-1", "b", "test-module"))
+	references, err = c.lookupActivation(context.Background(), "ns-1", "test-module", "b")
+	require.NoError(t, err)
+	require.Len(t, references, 1)
+	require.Equal(t, uint64(1), references[0].Generation())
+
+	// Actors that are activated on blacklisted servers would be moved, so they're not
+	// reported.
+	c.blacklistServer("serverID1", time.Minute)
+	for _, actorID := range []string{"a", "b"} {
+		references, err = c.lookupActivation(context.Background(), "ns-1", "test-module", actorID)
+		require.NoError(t, err)
+		require.Empty(t, references)
+	}
+	require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+}
+
+// TestActivationsCacheEnsureActivations ensures that bulk activations only consult the
+// registry once for all the uncached actors and populate the cache per-actor.
+func TestActivationsCacheEnsureActivations(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		NegativeCacheTTL: time.Minute,
+	})
+	require.NoError(t, err)
+
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	c.c.Wait()
+	require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+
+	actorIDs := []string{"a", "b", "c"}
+	results, err := c.ensureActivations(context.Background(), "ns-1", "test-module", actorIDs)
+	require.NoError(t, err)
+	require.Len(t, results, len(actorIDs))
+	for i, result := range results {
+		require.NoError(t, result.Err)
+		require.Len(t, result.References, 1)
+		require.Equal(t, actorIDs[i], result.References[0].ActorID().ID)
+	}
+	require.Equal(t, int64(1), reg.numBulkEnsureCalls.Load())
+	require.Equal(t, []string{"b", "c"}, reg.lastBulkActorIDs)
+	c.c.Wait()
+
+	// Subsequent single-actor lookups should hit the cache.
+	for _, actorID := range actorIDs {
+		_, err := c.ensureActivation(context.Background(), "ns-1", "test-module", actorID)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+
+	// Per-actor errors should be reported without failing the whole batch.
+	results, err = c.ensureActivations(context.Background(), "ns-1", "does-not-exist", []string{"d"})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.True(t, registry.IsModuleDoesNotExistErr(results[0].Err), results[0].Err)
+}
+
+// TestActivationsCacheMaxCacheAge ensures that entries older than MaxCacheAge are
+// re-resolved against the registry even if their TTL has not expired yet.
+func TestActivationsCacheMaxCacheAge(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{
+		MaxCacheAge: time.Minute,
+	})
+	require.NoError(t, err)
+
+	clock := newFakeClock()
+	c.clock = clock
+
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	c.c.Wait()
+	require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+
+	// Still within MaxCacheAge, should hit the cache.
+	clock.advance(30 * time.Second)
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	c.c.Wait()
+	require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+
+	// Older than MaxCacheAge, should be re-resolved synchronously.
+	clock.advance(time.Minute)
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	c.c.Wait()
+	require.Equal(t, int64(2), reg.numEnsureCalls.Load())
+
+	// The re-resolved entry should be fresh again.
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), reg.numEnsureCalls.Load())
+}
+
+// TestActivationsCacheLeaseExpiry ensures that entries that reference an activation whose
+// lease may have expired are treated as stale.
+func TestActivationsCacheLeaseExpiry(t *testing.T) {
+	reg := newTestCacheRegistryWithOptions(t, registry.KVRegistryOptions{
+		ActivationLeaseDuration: time.Minute,
+	})
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{})
+	require.NoError(t, err)
+
+	clock := newFakeClock()
+	c.clock = clock
+
+	refs, err := c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	c.c.Wait()
+	require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+	require.False(t, refs[0].Lease().IsZero())
+
+	// Still within the lease, should hit the cache.
+	clock.advance(30 * time.Second)
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	c.c.Wait()
+	require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+
+	// The lease may have expired, should be re-resolved synchronously.
+	clock.advance(time.Minute)
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	c.c.Wait()
+	require.Equal(t, int64(2), reg.numEnsureCalls.Load())
+}
+
+// TestActivationsCacheEnsureActivationWithMeta ensures that the metadata returned
+// alongside actor references reflects whether they were served from the cache.
+func TestActivationsCacheEnsureActivationWithMeta(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{})
+	require.NoError(t, err)
+
+	miss, err := c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.Len(t, miss.References, 1)
+	require.False(t, miss.FromCache)
+	require.False(t, miss.CachedAt.IsZero())
+	require.Greater(t, miss.RegistryVersionStamp, int64(0))
+	c.c.Wait()
+
+	hit, err := c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.True(t, hit.FromCache)
+	require.Equal(t, miss.References, hit.References)
+	require.True(t, miss.CachedAt.Equal(hit.CachedAt))
+	require.Equal(t, miss.RegistryVersionStamp, hit.RegistryVersionStamp)
+}
+
+// TestActivationsCacheVersionStampedRegistry ensures that cache misses take the
+// versionstamp from the registry's EnsureActivation() call when it can return it, instead
+// of making a separate call to GetVersionStamp().
+func TestActivationsCacheVersionStampedRegistry(t *testing.T) {
+	reg := &versionStampedTestRegistry{testCacheRegistry: newTestCacheRegistry(t)}
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{})
+	require.NoError(t, err)
+
+	miss, err := c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.Greater(t, miss.RegistryVersionStamp, int64(0))
+	require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+	require.Equal(t, int64(0), reg.numGetVersionStampCalls.Load())
+
+	results, err := c.ensureActivations(context.Background(), "ns-1", "test-module", []string{"b", "c"})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, int64(0), reg.numGetVersionStampCalls.Load())
+}
+
+// TestActivationsCacheRefreshActivation ensures that forced refreshes bypass the cache,
+// but concurrent refreshes for the same actor are collapsed into fewer registry calls.
+func TestActivationsCacheRefreshActivation(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{})
+	require.NoError(t, err)
+
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	c.c.Wait()
+	require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+
+	meta, err := c.refreshActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.False(t, meta.FromCache)
+	require.Equal(t, int64(2), reg.numEnsureCalls.Load())
+	c.c.Wait()
+
+	reg.ensureDelay = 100 * time.Millisecond
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, 10)
+	)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = c.refreshActivation(context.Background(), "ns-1", "test-module", "a")
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	require.Less(t, reg.numEnsureCalls.Load(), int64(2+len(errs)))
+}
+
+// TestActivationsCacheIdealCacheStaleness ensures that entries are served from the cache
+// without calling the registry until they become stale, and that stale entries are still
+// served from the cache but trigger a background refresh.
+func TestActivationsCacheIdealCacheStaleness(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	clock := newFakeClock()
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{
+		IdealCacheStaleness: time.Minute,
+		Clock:               clock,
+	})
+	require.NoError(t, err)
+
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	c.c.Wait()
+	cachedAt := clock.Now()
+
+	clock.advance(time.Minute)
+	meta, err := c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.True(t, meta.FromCache)
+	require.Equal(t, cachedAt, meta.CachedAt)
+	require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+
+	clock.advance(time.Nanosecond)
+	meta, err = c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.True(t, meta.FromCache)
+	require.Equal(t, cachedAt, meta.CachedAt)
+	require.Eventually(t, func() bool {
+		c.c.Wait()
+		ace, ok := c.get(formatActorCacheKey(nil, "ns-1", "test-module", "a"))
+		return ok && ace.cachedAt.Equal(clock.Now())
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, int64(2), reg.numEnsureCalls.Load())
+}
+
+// TestActivationsCacheNamespaceStaleness ensures that stale entries are served from the
+// cache while being refreshed in the background, and that per-namespace staleness
+// overrides the global value.
+func TestActivationsCacheNamespaceStaleness(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	_, err := reg.RegisterModule(
+		context.Background(), "ns-2", "test-module", nil,
+		registry.ModuleOptions{AllowEmptyModuleBytes: true})
+	require.NoError(t, err)
+
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{
+		IdealCacheStaleness: time.Minute,
+		NamespaceCacheStaleness: func(namespace string) time.Duration {
+			if namespace == "ns-1" {
+				return time.Second
+			}
+			return 0
+		},
+	})
+	require.NoError(t, err)
+
+	clock := newFakeClock()
+	c.clock = clock
+
+	for _, ns := range []string{"ns-1", "ns-2"} {
+		_, err = c.ensureActivation(context.Background(), ns, "test-module", "a")
+		require.NoError(t, err)
+	}
+	c.c.Wait()
+	require.Equal(t, int64(2), reg.numEnsureCalls.Load())
+
+	// Stale for ns-1, but not for ns-2.
+	clock.advance(2 * time.Second)
+	for _, ns := range []string{"ns-1", "ns-2"} {
+		meta, err := c.ensureActivationWithMeta(context.Background(), ns, "test-module", "a")
+		require.NoError(t, err)
+		require.True(t, meta.FromCache)
+	}
+	require.Eventually(t, func() bool {
+		c.c.Wait()
+		ace, ok := c.get(formatActorCacheKey(nil, "ns-1", "test-module", "a"))
+		return ok && ace.cachedAt.Equal(c.clock.Now())
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, int64(3), reg.numEnsureCalls.Load())
+
+	// The refreshed entry should be fresh again.
+	meta, err := c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.True(t, meta.FromCache)
+	require.Equal(t, int64(3), reg.numEnsureCalls.Load())
+}
+
+// TestActivationsCacheSkipRefreshUnchangedVersionStamp ensures that stale entries are
+// re-cached without calling the registry when its versionstamp has not changed since they
+// were cached, and refreshed as usual once it has.
+func TestActivationsCacheSkipRefreshUnchangedVersionStamp(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	reg.versionStamp.Store(1)
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{
+		IdealCacheStaleness: time.Second,
+	})
+	require.NoError(t, err)
+
+	clock := newFakeClock()
+	c.clock = clock
+
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	c.c.Wait()
+	require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+
+	isRefreshed := func() bool {
+		c.c.Wait()
+		ace, ok := c.get(formatActorCacheKey(nil, "ns-1", "test-module", "a"))
+		return ok && ace.cachedAt.Equal(c.clock.Now())
+	}
+
+	// Unchanged versionstamp.
+	clock.advance(2 * time.Second)
+	meta, err := c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.True(t, meta.FromCache)
+	require.Eventually(t, isRefreshed, 5*time.Second, time.Millisecond)
+	require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+	require.Equal(t, uint64(1), c.stats().RefreshesSkipped)
+
+	// Changed versionstamp.
+	reg.versionStamp.Store(2)
+	clock.advance(2 * time.Second)
+	meta, err = c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.True(t, meta.FromCache)
+	require.Eventually(t, isRefreshed, 5*time.Second, time.Millisecond)
+	require.Equal(t, int64(2), reg.numEnsureCalls.Load())
+	require.Equal(t, uint64(1), c.stats().RefreshesSkipped)
+
+	meta, err = c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), meta.RegistryVersionStamp)
+}
+
+// TestActivationsCacheRefreshVersionStampTimeout ensures that background refreshes don't
+// wait on the registry's versionstamp for longer than EnsureTimeout.
+func TestActivationsCacheRefreshVersionStampTimeout(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	clock := newFakeClock()
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{
+		IdealCacheStaleness:              time.Second,
+		EnsureTimeout:                    50 * time.Millisecond,
+		MaxConcurrentBackgroundRefreshes: 1,
+		Clock:                            clock,
+	})
+	require.NoError(t, err)
+
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	c.c.Wait()
+
+	reg.blockVersionStamp.Store(true)
+	clock.advance(2 * time.Second)
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	// The refresh gives up on the versionstamp and refreshes the entry, which releases its
+	// slot.
+	require.Eventually(t, func() bool {
+		return reg.numEnsureCalls.Load() == 2 && c.refreshSem.TryAcquire(1)
+	}, 5*time.Second, time.Millisecond)
+}
+
+// TestActivationsCacheVersionStampRegression ensures that results resolved after the
+// registry's versionstamp regressed are not rejected as stale and are cached at the
+// highest versionstamp observed before.
+func TestActivationsCacheVersionStampRegression(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	reg.versionStamp.Store(5)
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{})
+	require.NoError(t, err)
+
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	c.c.Wait()
+
+	reg.versionStamp.Store(3)
+	meta, err := c.refreshActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.Equal(t, int64(5), meta.RegistryVersionStamp)
+	c.c.Wait()
+	require.Equal(t, uint64(0), c.stats().StaleUpdatesRejected)
+	require.Equal(t, int64(2), reg.numEnsureCalls.Load())
+}
+
+// TestActivationsCacheEnsureActivationAtLeast ensures that cached entries that were
+// resolved before the minimum versionstamp are treated as cache misses.
+func TestActivationsCacheEnsureActivationAtLeast(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	reg.versionStamp.Store(1)
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{})
+	require.NoError(t, err)
+
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	c.c.Wait()
+	require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+
+	// The cached entry is recent enough.
+	_, err = c.ensureActivationAtLeast(context.Background(), "ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+
+	// The cached entry predates the minimum versionstamp.
+	reg.versionStamp.Store(2)
+	_, err = c.ensureActivationAtLeast(context.Background(), "ns-1", "test-module", "a", 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), reg.numEnsureCalls.Load())
+	c.c.Wait()
+	meta, err := c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.True(t, meta.FromCache)
+	require.Equal(t, int64(2), meta.RegistryVersionStamp)
+
+	// The registry can't resolve the actor at the minimum versionstamp.
+	_, err = c.ensureActivationAtLeast(context.Background(), "ns-1", "test-module", "a", 3)
+	require.Error(t, err)
+}
+
+// TestActivationsCacheEnsureErrorHoldDuration ensures that failed registry calls are
+// forgotten immediately by default, and that their errors are held for
+// EnsureErrorHoldDuration otherwise.
+func TestActivationsCacheEnsureErrorHoldDuration(t *testing.T) {
+	for _, hold := range []time.Duration{0, time.Minute} {
+		t.Run(hold.String(), func(t *testing.T) {
+			reg := newTestCacheRegistry(t)
+			c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{
+				EnsureErrorHoldDuration: hold,
+			})
+			require.NoError(t, err)
+			clock := newFakeClock()
+			c.clock = clock
+
+			reg.failEnsure.Store(true)
+			_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+			require.Error(t, err)
+			require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+
+			reg.failEnsure.Store(false)
+			_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+			if hold == 0 {
+				require.NoError(t, err)
+				require.Equal(t, int64(2), reg.numEnsureCalls.Load())
+				return
+			}
+			require.Error(t, err)
+			require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+			require.Equal(t, uint64(1), c.stats().EnsureErrorsHeld)
+
+			// Other actors are not affected.
+			_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "b")
+			require.NoError(t, err)
+
+			clock.advance(hold)
+			_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+			require.NoError(t, err)
+			require.Equal(t, int64(3), reg.numEnsureCalls.Load())
+		})
+	}
+}
+
+// TestActivationsCacheMaxConcurrentBackgroundRefreshes ensures that background refreshes
+// beyond MaxConcurrentBackgroundRefreshes are dropped instead of queued.
+func TestActivationsCacheMaxConcurrentBackgroundRefreshes(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{
+		IdealCacheStaleness:              time.Second,
+		MaxConcurrentBackgroundRefreshes: 1,
+	})
+	require.NoError(t, err)
+
+	clock := newFakeClock()
+	c.clock = clock
+
+	actorIDs := []string{"a", "b", "c"}
+	for _, actorID := range actorIDs {
+		_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", actorID)
+		require.NoError(t, err)
+	}
+	c.c.Wait()
+	require.Equal(t, int64(3), reg.numEnsureCalls.Load())
+
+	// Only the first refresh is in flight while the registry is slow, so the others are
+	// dropped.
+	reg.ensureDelay = 200 * time.Millisecond
+	clock.advance(2 * time.Second)
+	for _, actorID := range actorIDs {
+		meta, err := c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", actorID)
+		require.NoError(t, err)
+		require.True(t, meta.FromCache)
+	}
+	require.Equal(t, uint64(2), c.stats().RefreshesDropped)
+	require.Eventually(t, func() bool {
+		return reg.numEnsureCalls.Load() == 4 && reg.inFlight.Load() == 0
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, int64(1), reg.maxInFlight.Load())
+}
+
+// TestActivationsCacheDisableBackgroundRefresh ensures that stale entries are re-resolved
+// in the foreground when background refreshes are disabled, using an injected clock to
+// control when entries become stale.
+func TestActivationsCacheDisableBackgroundRefresh(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+
+	clock := newFakeClock()
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{
+		IdealCacheStaleness:      time.Second,
+		DisableBackgroundRefresh: true,
+		Clock:                    clock,
+	})
+	require.NoError(t, err)
+
+	for _, actorID := range []string{"a", "b"} {
+		_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", actorID)
+		require.NoError(t, err)
+	}
+	c.c.Wait()
+	require.Equal(t, int64(2), reg.numEnsureCalls.Load())
+
+	meta, err := c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.True(t, meta.FromCache)
+	require.Equal(t, int64(2), reg.numEnsureCalls.Load())
+
+	clock.advance(2 * time.Second)
+	meta, err = c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.False(t, meta.FromCache)
+	require.Equal(t, c.clock.Now(), meta.CachedAt)
+	require.Equal(t, int64(3), reg.numEnsureCalls.Load())
+	c.c.Wait()
+
+	results, err := c.ensureActivations(context.Background(), "ns-1", "test-module", []string{"a", "b"})
+	require.NoError(t, err)
+	for _, result := range results {
+		require.NoError(t, result.Err)
+	}
+	require.Equal(t, int64(3), reg.numEnsureCalls.Load())
+	require.Equal(t, int64(1), reg.numBulkEnsureCalls.Load())
+	require.Equal(t, []string{"b"}, reg.lastBulkActorIDs)
+}
+
+// TestActivationsCacheSlowRegistry ensures that the staleness of entries and the timeout
+// of registry calls are widened (within bounds) while the registry is slow, and that they
+// recover once it's fast again.
+func TestActivationsCacheSlowRegistry(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	clock := newFakeClock()
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{
+		EnsureTimeout:                time.Second,
+		IdealCacheStaleness:          time.Second,
+		DisableBackgroundRefresh:     true,
+		SlowRegistryThreshold:        5 * time.Millisecond,
+		MaxSlowRegistryStaleness:     3 * time.Second,
+		MaxSlowRegistryEnsureTimeout: 1500 * time.Millisecond,
+		Clock:                        clock,
+	})
+	require.NoError(t, err)
+
+	stats := c.stats()
+	require.False(t, stats.SlowRegistry)
+	require.Equal(t, time.Second, stats.EffectiveCacheStaleness)
+	require.Equal(t, time.Second, stats.EffectiveEnsureTimeout)
+
+	reg.ensureDelay = 50 * time.Millisecond
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	c.c.Wait()
+	stats = c.stats()
+	require.True(t, stats.SlowRegistry)
+	require.GreaterOrEqual(t, stats.RegistryLatency, 50*time.Millisecond)
+	require.Equal(t, 3*time.Second, stats.EffectiveCacheStaleness)
+	require.Equal(t, 1500*time.Millisecond, stats.EffectiveEnsureTimeout)
+
+	// The entry is not refreshed until the widened staleness has elapsed.
+	clock.advance(2 * time.Second)
+	meta, err := c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.True(t, meta.FromCache)
+	require.Equal(t, int64(1), reg.numEnsureCalls.Load())
+	clock.advance(2 * time.Second)
+	meta, err = c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.False(t, meta.FromCache)
+	require.Equal(t, int64(2), reg.numEnsureCalls.Load())
+
+	// The detector recovers once the registry is fast again.
+	for i := 0; i < 50; i++ {
+		c.registryLatency.record(time.Millisecond, nil)
+	}
+	stats = c.stats()
+	require.False(t, stats.SlowRegistry)
+	require.Equal(t, time.Second, stats.EffectiveCacheStaleness)
+	require.Equal(t, time.Second, stats.EffectiveEnsureTimeout)
+
+	// Calls that were canceled by their caller are ignored.
+	c.registryLatency.record(time.Hour, context.Canceled)
+	require.False(t, c.stats().SlowRegistry)
+}
+
+// TestActivationsCacheBlacklistServer ensures that blacklisted servers are avoided by
+// cache misses and cached references that point to them until the blacklist expires.
+func TestActivationsCacheBlacklistServer(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	_, err := reg.Heartbeat(context.Background(), "serverID2", registry.HeartbeatState{
+		NumActivatedActors: 100,
+		Address:            Localhost,
+	})
+	require.NoError(t, err)
+
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{})
+	require.NoError(t, err)
+
+	clock := newFakeClock()
+	c.clock = clock
+
+	references, err := c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.Equal(t, "serverID1", references[0].ServerID())
+	c.c.Wait()
+
+	c.blacklistServer("serverID1", 30*time.Second)
+	for _, actorID := range []string{"a", "b"} {
+		references, err = c.ensureActivation(context.Background(), "ns-1", "test-module", actorID)
+		require.NoError(t, err)
+		require.Equal(t, "serverID2", references[0].ServerID())
+	}
+	c.c.Wait()
+	require.Equal(t, int64(3), reg.numEnsureCalls.Load())
+
+	results, err := c.ensureActivations(context.Background(), "ns-1", "test-module", []string{"c"})
+	require.NoError(t, err)
+	require.NoError(t, results[0].Err)
+	require.Equal(t, "serverID2", results[0].References[0].ServerID())
+	c.c.Wait()
+
+	// References to other servers are still served from the cache.
+	meta, err := c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.True(t, meta.FromCache)
+
+	// The blacklist is forgotten once it expires.
+	clock.advance(31 * time.Second)
+	require.Empty(t, c.ensureActivationOptions().BlacklistedServerIDs)
+	references, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "d")
+	require.NoError(t, err)
+	require.Equal(t, "serverID1", references[0].ServerID())
+}
+
+// TestActivationsCacheMaxCachedActivations ensures that the cache size is configurable
+// and that stats reflect the contents of the cache.
+func TestActivationsCacheMaxCachedActivations(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		MaxCachedActivations: 10,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(10), c.stats().MaxCost)
+
+	for i := 0; i < 5; i++ {
+		_, err := c.ensureActivation(
+			context.Background(), "ns-1", "test-module", fmt.Sprintf("actor-%d", i))
+		require.NoError(t, err)
+		c.c.Wait()
+	}
+	stats := c.stats()
+	require.Equal(t, int64(5), stats.Len)
+	require.Equal(t, int64(5), stats.Cost)
+	require.Equal(t, uint64(0), stats.KeysEvicted)
+
+	// Overfill the cache so entries have to be evicted.
+	for i := 5; i < 100; i++ {
+		_, err := c.ensureActivation(
+			context.Background(), "ns-1", "test-module", fmt.Sprintf("actor-%d", i))
+		require.NoError(t, err)
+		c.c.Wait()
+	}
+	stats = c.stats()
+	require.LessOrEqual(t, stats.Len, int64(10))
+	require.LessOrEqual(t, stats.Cost, int64(10))
+	require.Greater(t, stats.KeysEvicted, uint64(0))
+}
+
+// TestActivationsCacheModuleCosts ensures that entries are cached with the cost of
+// their module (or of their references) and that stats reflect the effective capacity.
+func TestActivationsCacheModuleCosts(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	_, err := reg.RegisterModule(
+		context.Background(), "ns-1", "cheap-module", nil,
+		registry.ModuleOptions{AllowEmptyModuleBytes: true})
+	require.NoError(t, err)
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		MaxCachedActivations: 100,
+		ModuleCosts: map[types.NamespacedIDNoType]int64{
+			types.NewNamespacedIDNoType("ns-1", "test-module"): 10,
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(100), c.stats().EffectiveCapacity)
+
+	for i := 0; i < 5; i++ {
+		_, err := c.ensureActivation(
+			context.Background(), "ns-1", "test-module", fmt.Sprintf("actor-%d", i))
+		require.NoError(t, err)
+		c.c.Wait()
+	}
+	stats := c.stats()
+	require.Equal(t, int64(5), stats.Len)
+	require.Equal(t, int64(50), stats.Cost)
+	require.Equal(t, int64(10), stats.EffectiveCapacity)
+	status, ok := c.inspect("ns-1", "test-module", "actor-0")
+	require.True(t, ok)
+	require.Equal(t, int64(10), status.Cost)
+
+	for i := 0; i < 5; i++ {
+		_, err := c.ensureActivation(
+			context.Background(), "ns-1", "cheap-module", fmt.Sprintf("actor-%d", i))
+		require.NoError(t, err)
+		c.c.Wait()
+	}
+	stats = c.stats()
+	require.Equal(t, int64(10), stats.Len)
+	require.Equal(t, int64(55), stats.Cost)
+	require.Equal(t, int64(18), stats.EffectiveCapacity)
+
+	// Modules without a configured cost use the cost that their references were tagged
+	// with, and costs never exceed the capacity of the cache.
+	ref, err := types.NewActorReference("serverID1", 1, Localhost, "ns-1", "cheap-module", "a", 1)
+	require.NoError(t, err)
+	ref, err = types.WithCacheCost(ref, 3)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), c.entryCost(activationCacheEntry{
+		namespace: "ns-1", moduleID: "cheap-module", references: []types.ActorReference{ref}}))
+	ref, err = types.WithCacheCost(ref, 1000)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), c.entryCost(activationCacheEntry{
+		namespace: "ns-1", moduleID: "cheap-module", references: []types.ActorReference{ref}}))
+	require.Equal(t, int64(1), c.entryCost(activationCacheEntry{
+		namespace: "ns-1", moduleID: "test-module", err: errors.New("negative entry")}))
+}
+
+// TestActivationsCacheDeleteNamespaceAndModule ensures that cache entries can be deleted
+// in bulk by namespace or module.
+func TestActivationsCacheDeleteNamespaceAndModule(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	for _, id := range []types.NamespacedIDNoType{
+		{Namespace: "ns-1", ID: "other-module"},
+		{Namespace: "ns-2", ID: "test-module"},
+	} {
+		_, err := reg.RegisterModule(
+			context.Background(), id.Namespace, id.ID, nil,
+			registry.ModuleOptions{AllowEmptyModuleBytes: true})
+		require.NoError(t, err)
+	}
+
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{})
+	require.NoError(t, err)
+
+	keys := []ActivationKey{
+		{Namespace: "ns-1", ModuleID: "test-module", ActorID: "a"},
+		{Namespace: "ns-1", ModuleID: "other-module", ActorID: "b"},
+		{Namespace: "ns-2", ModuleID: "test-module", ActorID: "a"},
+		{Namespace: "ns-2", ModuleID: "test-module", ActorID: "b"},
+	}
+	require.Empty(t, c.prefetchActivations(context.Background(), keys))
+	c.c.Wait()
+
+	isCached := func(key ActivationKey) bool {
+		_, ok := c.get(formatActorCacheKey(nil, key.Namespace, key.ModuleID, key.ActorID))
+		return ok
+	}
+	for _, key := range keys {
+		require.True(t, isCached(key))
+	}
+
+	c.deleteModule("ns-1", "other-module")
+	require.True(t, isCached(keys[0]))
+	require.False(t, isCached(keys[1]))
+	require.True(t, isCached(keys[2]))
+	require.True(t, isCached(keys[3]))
+
+	c.deleteNamespace("ns-2")
+	require.True(t, isCached(keys[0]))
+	require.False(t, isCached(keys[2]))
+	require.False(t, isCached(keys[3]))
+
+	c.delete("ns-1", "test-module", "a")
+	require.False(t, isCached(keys[0]))
+	require.Empty(t, c.index.m)
+}
+
+// TestActivationsCacheIndexEviction ensures that the secondary index used to delete
+// entries in bulk does not leak when entries are evicted.
+func TestActivationsCacheIndexEviction(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		MaxCachedActivations: 10,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		_, err := c.ensureActivation(
+			context.Background(), "ns-1", "test-module", fmt.Sprintf("actor-%d", i))
+		require.NoError(t, err)
+		c.c.Wait()
+	}
+
+	c.index.Lock()
+	numIndexed := len(c.index.m["ns-1"])
+	c.index.Unlock()
+	require.Equal(t, c.stats().Len, int64(numIndexed))
+}
+
+// TestActivationsCacheOnEvict ensures that the OnEvict callback is called with every
+// entry that is evicted or rejected from the cache.
+func TestActivationsCacheOnEvict(t *testing.T) {
+	var (
+		reg     = newTestCacheRegistry(t)
+		mu      sync.Mutex
+		evicted = make(map[string]EvictedActivation)
+	)
+	c, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		MaxCachedActivations: 10,
+		OnEvict: func(e EvictedActivation) {
+			mu.Lock()
+			defer mu.Unlock()
+			evicted[e.ActorID] = e
+		},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		_, err := c.ensureActivation(
+			context.Background(), "ns-1", "test-module", fmt.Sprintf("actor-%d", i))
+		require.NoError(t, err)
+		c.c.Wait()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, evicted)
+	require.Equal(t, int64(100), c.stats().Len+int64(len(evicted)))
+	for actorID, e := range evicted {
+		require.Equal(t, "ns-1", e.Namespace)
+		require.Equal(t, "test-module", e.ModuleID)
+		require.Len(t, e.References, 1)
+		require.Equal(t, actorID, e.References[0].ActorID().ID)
+		require.False(t, e.CachedAt.IsZero())
+	}
+}
+
+// TestActivationsCacheOptionsValidate ensures that illegal options are rejected.
+func TestActivationsCacheOptionsValidate(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+
+	_, err := newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		MaxConcurrentEnsureCalls: -1,
+	})
+	require.Error(t, err)
+
+	_, err = newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		EnsureTimeout: -1,
+	})
+	require.Error(t, err)
+
+	_, err = newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		MaxConcurrentBackgroundRefreshes: -1,
+	})
+	require.Error(t, err)
+
+	_, err = newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		MaxEnsureWait: -1,
+	})
+	require.Error(t, err)
+
+	_, err = newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		SlowRegistryThreshold: -1,
+	})
+	require.Error(t, err)
+
+	_, err = newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		RefreshJitter: -1,
+	})
+	require.Error(t, err)
+
+	_, err = newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		NegativeCacheTTL: -1,
+	})
+	require.Error(t, err)
+
+	_, err = newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		MaxCacheAge: -1,
+	})
+	require.Error(t, err)
+
+	_, err = newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		IdealCacheStaleness: -1,
+	})
+	require.Error(t, err)
+
+	_, err = newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		MaxCachedActivations: -1,
+	})
+	require.Error(t, err)
+
+	_, err = newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		ModuleCosts: map[types.NamespacedIDNoType]int64{
+			types.NewNamespacedIDNoType("ns-1", "test-module"): 0,
+		},
+	})
+	require.Error(t, err)
+
+	_, err = newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		CircuitBreakerFailureThreshold: -1,
+	})
+	require.Error(t, err)
+
+	_, err = newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		CircuitBreakerCooldown: -1,
+	})
+	require.Error(t, err)
+
+	_, err = newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		EnsureRetryMaxAttempts: -1,
+	})
+	require.Error(t, err)
+
+	_, err = newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		EnsureRetryBaseBackoff: -1,
+	})
+	require.Error(t, err)
+
+	_, err = newActivationsCache(reg, time.Minute, false, ActivationsCacheOptions{
+		EnsureRetryJitter: -1,
+	})
+	require.Error(t, err)
+}
+
+// TestFormatActorCacheKey ensures that distinct actors never map to the same cache key,
+// regardless of the bytes their namespace, module and actor IDs contain.
+func TestFormatActorCacheKey(t *testing.T) {
+	long := strings.Repeat("a", 1<<16)
+	actors := [][3]string{
+		{"", "", ""},
+		{"", "", "a"},
+		{"", "a", ""},
+		{"a", "", ""},
+		{"ab", "c", "d"},
+		{"a", "bc", "d"},
+		{"a", "b", "cd"},
+		{"ns", "mod\x00x", "y"},
+		{"ns", "mod", "x\x00y"},
+		{"ns\x00", "mod", "x"},
+		{"ns", "\x00mod", "x"},
+		{"\x03abc", "", ""},
+		{"", "\x03abc", ""},
+		{"\x01", "a", ""},
+		{long, "", ""},
+		{"", long, ""},
+		{"", "", long},
+		{long[1:], "a", ""},
+		{long[1:], "", "a"},
+	}
+	seen := make(map[string][3]string, len(actors))
+	buf := make([]byte, 0, 8)
+	for _, actor := range actors {
+		key := formatActorCacheKey(nil, actor[0], actor[1], actor[2])
+		require.Equal(t, len(key), cap(key))
+		other, ok := seen[string(key)]
+		require.False(t, ok, "%q collides with %q", actor, other)
+		seen[string(key)] = actor
+
+		// Appending to an existing buffer produces the same key.
+		buf = formatActorCacheKey(buf[:0], actor[0], actor[1], actor[2])
+		require.Equal(t, key, buf)
+	}
+}
+
+// TestActivationsCacheKeyCollisions ensures that actors whose namespace and module IDs
+// concatenate to the same string are cached separately.
+func TestActivationsCacheKeyCollisions(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	_, err := reg.RegisterModule(
+		context.Background(), "ns-1t", "est-module", nil,
+		registry.ModuleOptions{AllowEmptyModuleBytes: true})
+	require.NoError(t, err)
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{})
+	require.NoError(t, err)
+
+	for _, actor := range [][2]string{{"ns-1", "test-module"}, {"ns-1t", "est-module"}} {
+		refs, err := c.ensureActivation(context.Background(), actor[0], actor[1], "a")
+		require.NoError(t, err)
+		require.Equal(t, actor[0], refs[0].Namespace())
+		require.Equal(t, actor[1], refs[0].ModuleID().ID)
+	}
+	c.c.Wait()
+	for _, actor := range [][2]string{{"ns-1", "test-module"}, {"ns-1t", "est-module"}} {
+		ace, ok := c.get(formatActorCacheKey(nil, actor[0], actor[1], "a"))
+		require.True(t, ok)
+		require.Equal(t, actor[0], ace.namespace)
+		require.Equal(t, actor[1], ace.moduleID)
+
+		refs, err := c.ensureActivation(context.Background(), actor[0], actor[1], "a")
+		require.NoError(t, err)
+		require.Equal(t, actor[0], refs[0].Namespace())
+		require.Equal(t, actor[1], refs[0].ModuleID().ID)
+	}
+	require.Equal(t, int64(2), reg.numEnsureCalls.Load())
+}
+
+// TestActivationsCachePooledCacheKeys ensures that a caller that abandons a cache miss
+// doesn't corrupt the cache when its pooled cache key is reused while the registry call it
+// started is still in flight.
+func TestActivationsCachePooledCacheKeys(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	reg.ensureDelay = 100 * time.Millisecond
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{
+		PooledCacheKeys: true,
+	})
+	require.NoError(t, err)
+
+	// Abandon the call by canceling it since calls are cut short by the caller's deadline.
+	ctx, cc := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cc)
+	_, err = c.ensureActivation(ctx, "ns-1", "test-module", "a")
+	require.ErrorIs(t, err, context.Canceled)
+
+	// Reuse the pooled buffer while the abandoned call is still in flight.
+	_, err = c.ensureActivation(context.Background(), "ns-1", "test-module", "b")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		c.c.Wait()
+		ace, ok := c.get(formatActorCacheKey(nil, "ns-1", "test-module", "a"))
+		return ok && ace.actorID == "a"
+	}, 5*time.Second, time.Millisecond)
+	ace, ok := c.get(formatActorCacheKey(nil, "ns-1", "test-module", "b"))
+	require.True(t, ok)
+	require.Equal(t, "b", ace.actorID)
+}
+
+// BenchmarkActivationsCacheHit benchmarks cache hits with and without PooledCacheKeys.
+func BenchmarkActivationsCacheHit(b *testing.B) {
+	for _, pooled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pooled=%t", pooled), func(b *testing.B) {
+			reg := localregistry.NewLocalRegistry()
+			_, err := reg.Heartbeat(context.Background(), "serverID1", registry.HeartbeatState{
+				Address: Localhost,
+			})
+			require.NoError(b, err)
+			_, err = reg.RegisterModule(
+				context.Background(), "tenant-1234", "test-module", nil,
+				registry.ModuleOptions{AllowEmptyModuleBytes: true})
+			require.NoError(b, err)
+
+			c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{
+				PooledCacheKeys: pooled,
+			})
+			require.NoError(b, err)
+
+			// Realistic namespace and actor ID sizes.
+			const actorID = "6f1c1c1e-5b0a-4b7e-9c36-1f0c2a3e4d5b"
+			_, err = c.ensureActivation(context.Background(), "tenant-1234", "test-module", actorID)
+			require.NoError(b, err)
+			c.c.Wait()
+
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				meta, err := c.ensureActivationWithMeta(ctx, "tenant-1234", "test-module", actorID)
+				if err != nil || !meta.FromCache {
+					b.Fatalf("expected cache hit, err: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// fakeClock is a Clock whose time only moves when advance() is called.
+type fakeClock struct {
+	nanos atomic.Int64
+}
+
+func newFakeClock() *fakeClock {
+	c := &fakeClock{}
+	c.nanos.Store(time.Now().UnixNano())
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	return time.Unix(0, c.nanos.Load())
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.nanos.Add(int64(d))
+}
+
+// testCacheRegistry wraps a local registry and instruments calls to EnsureActivation()
+// so tests can make assertions about how the activations cache interacts with the
+// registry.
+type testCacheRegistry struct {
+	registry.Registry
+
+	ensureDelay    time.Duration
+	failEnsure     atomic.Bool
+	numEnsureCalls atomic.Int64
+	inFlight       atomic.Int64
+	maxInFlight    atomic.Int64
+	// The next numEnsureFailures calls to EnsureActivation() fail.
+	numEnsureFailures atomic.Int64
+	// The time remaining until the deadline of the last call to EnsureActivation(), or 0
+	// if it had no deadline.
+	lastEnsureTimeout atomic.Int64
+
+	numBulkEnsureCalls atomic.Int64
+	lastBulkActorIDs   []string
+
+	// If non-zero, returned by GetVersionStamp() instead of the wrapped registry's
+	// versionstamp.
+	versionStamp atomic.Int64
+	// If true, GetVersionStamp() blocks until its context is done.
+	blockVersionStamp atomic.Bool
+}
+
+// versionStampedTestRegistry is a testCacheRegistry that implements
+// registry.VersionStampedRegistry and counts the calls to GetVersionStamp().
+type versionStampedTestRegistry struct {
+	*testCacheRegistry
+
+	numGetVersionStampCalls atomic.Int64
+}
+
+func (r *versionStampedTestRegistry) EnsureActivationWithVersionStamp(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+	opts registry.EnsureActivationOptions,
+) ([]types.ActorReference, int64, error) {
+	r.numEnsureCalls.Add(1)
+	vsr := r.Registry.(registry.VersionStampedRegistry)
+	return vsr.EnsureActivationWithVersionStamp(ctx, namespace, actorID, moduleID, opts)
+}
+
+func (r *versionStampedTestRegistry) GetVersionStamp(ctx context.Context) (int64, error) {
+	r.numGetVersionStampCalls.Add(1)
+	return r.testCacheRegistry.GetVersionStamp(ctx)
+}
+
+func newTestCacheRegistry(t *testing.T) *testCacheRegistry {
+	return newTestCacheRegistryWithOptions(t, registry.KVRegistryOptions{})
+}
+
+func newTestCacheRegistryWithOptions(t *testing.T, opts registry.KVRegistryOptions) *testCacheRegistry {
+	reg, err := localregistry.NewLocalRegistryWithOptions(opts)
+	require.NoError(t, err)
+	_, err = reg.Heartbeat(context.Background(), "serverID1", registry.HeartbeatState{
+		Address: Localhost,
+	})
+	require.NoError(t, err)
+	_, err = reg.RegisterModule(
+		context.Background(), "ns-1", "test-module", nil,
+		registry.ModuleOptions{AllowEmptyModuleBytes: true})
+	require.NoError(t, err)
+
+	return &testCacheRegistry{Registry: reg}
+}
+
+func (r *testCacheRegistry) EnsureActivation(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+	opts registry.EnsureActivationOptions,
+) ([]types.ActorReference, error) {
+	r.numEnsureCalls.Add(1)
+	if deadline, ok := ctx.Deadline(); ok {
+		r.lastEnsureTimeout.Store(int64(time.Until(deadline)))
+	} else {
+		r.lastEnsureTimeout.Store(0)
+	}
+	inFlight := r.inFlight.Add(1)
+	defer r.inFlight.Add(-1)
+	for {
+		max := r.maxInFlight.Load()
+		if inFlight <= max || r.maxInFlight.CompareAndSwap(max, inFlight) {
+			break
+		}
+	}
+
+	if r.failEnsure.Load() || r.numEnsureFailures.Add(-1) >= 0 {
+		return nil, errors.New("testCacheRegistry: registry is unavailable")
+	}
+
+	select {
+	case <-time.After(r.ensureDelay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return r.Registry.EnsureActivation(ctx, namespace, actorID, moduleID, opts)
+}
+
+func (r *testCacheRegistry) GetVersionStamp(ctx context.Context) (int64, error) {
+	if r.blockVersionStamp.Load() {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	if vs := r.versionStamp.Load(); vs != 0 {
+		return vs, nil
+	}
+	return r.Registry.GetVersionStamp(ctx)
+}
+
+func (r *testCacheRegistry) BulkEnsureActivation(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorIDs []string,
+	opts registry.EnsureActivationOptions,
+) ([]registry.EnsureActivationResult, error) {
+	r.numBulkEnsureCalls.Add(1)
+	r.lastBulkActorIDs = append([]string(nil), actorIDs...)
+	return r.Registry.BulkEnsureActivation(ctx, namespace, moduleID, actorIDs, opts)
+}
+
+// TestActivationsCacheRejectsStaleUpdates ensures that results that were resolved at a
+// lower registry versionstamp than the cached one don't replace it until it's deleted.
+func TestActivationsCacheRejectsStaleUpdates(t *testing.T) {
+	c, err := newActivationsCache(newTestCacheRegistry(t), time.Hour, false, ActivationsCacheOptions{})
+	require.NoError(t, err)
+
+	newEntry := func(serverID string, vs int64) activationCacheEntry {
+		ref, err := types.NewActorReference(serverID, 1, Localhost, "ns-1", "test-module", "a", 1)
+		require.NoError(t, err)
+		return activationCacheEntry{
+			references:           []types.ActorReference{ref},
+			registryVersionStamp: vs,
+			namespace:            "ns-1",
+			moduleID:             "test-module",
+			actorID:              "a",
+		}
+	}
+	cachedServerID := func() string {
+		c.c.Wait()
+		ace, ok := c.get(formatActorCacheKey(nil, "ns-1", "test-module", "a"))
+		require.True(t, ok)
+		return ace.references[0].ServerID()
+	}
+	key := formatActorCacheKey(nil, "ns-1", "test-module", "a")
+
+	c.updateCache(key, newEntry("serverID1", 10))
+	c.updateCache(key, newEntry("serverID2", 5))
+	require.Equal(t, "serverID1", cachedServerID())
+	require.Equal(t, uint64(1), c.stats().StaleUpdatesRejected)
+
+	// Results whose versionstamp is unknown are always cached, but don't lower the
+	// versionstamp that later results are compared against.
+	c.updateCache(key, newEntry("serverID2", 0))
+	require.Equal(t, "serverID2", cachedServerID())
+	c.updateCache(key, newEntry("serverID3", 5))
+	require.Equal(t, "serverID2", cachedServerID())
+
+	c.delete("ns-1", "test-module", "a")
+	c.updateCache(key, newEntry("serverID3", 5))
+	require.Equal(t, "serverID3", cachedServerID())
+}
+
+// TestActivationsCacheInvalidateActivation ensures that the changes that are received from
+// the registry's watch delete the entries that don't point to the actor's activation
+// anymore, and that removed servers are blacklisted.
+func TestActivationsCacheInvalidateActivation(t *testing.T) {
+	reg := newTestCacheRegistry(t)
+	c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{WatchRegistry: true})
+	require.NoError(t, err)
+
+	references, err := c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	c.c.Wait()
+	var (
+		ref     = references[0]
+		actorID = types.NewNamespacedActorID("ns-1", "a", "test-module", types.IDTypeActor)
+	)
+
+	// Changes that don't move the actor are ignored.
+	c.invalidateActivation(registry.ActivationChange{
+		ActorID:       actorID,
+		ServerID:      ref.ServerID(),
+		ServerVersion: ref.ServerVersion(),
+		Generation:    ref.Generation(),
+	})
+	c.c.Wait()
+	meta, err := c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.True(t, meta.FromCache)
+
+	for _, change := range []registry.ActivationChange{
+		{ActorID: actorID, ServerID: "serverID2", ServerVersion: ref.ServerVersion(), Generation: ref.Generation()},
+		{ActorID: actorID, ServerID: ref.ServerID(), ServerVersion: ref.ServerVersion() + 1, Generation: ref.Generation()},
+		{ActorID: actorID, ServerID: ref.ServerID(), ServerVersion: ref.ServerVersion(), Generation: ref.Generation() + 1},
+		{ActorID: actorID},
+	} {
+		c.invalidateActivation(change)
+		c.c.Wait()
+		meta, err = c.ensureActivationWithMeta(context.Background(), "ns-1", "test-module", "a")
+		require.NoError(t, err)
+		require.False(t, meta.FromCache)
+		c.c.Wait()
+	}
+	require.Equal(t, int64(5), reg.numEnsureCalls.Load())
+
+	c.serverRemoved("serverID1")
+	require.Equal(t, []string{"serverID1"}, c.ensureActivationOptions().BlacklistedServerIDs)
+}
@@ -0,0 +1,331 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/richardartoul/nola/durable"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+var errActorFSQuotaExceeded = fmt.Errorf("actor file system quota exceeded: %w", syscall.ENOSPC)
+
+// IsActorFSQuotaExceededErr returns a boolean indicating whether the error is an instance
+// of (or wraps) errActorFSQuotaExceeded.
+func IsActorFSQuotaExceededErr(err error) bool {
+	return errors.Is(err, errActorFSQuotaExceeded)
+}
+
+// ActorFSProvider provides the file systems that are mounted as the root ("/") of the
+// WASI file system of WASM actors. Each actor must get its own file system so that actors
+// can't see each other's files. Implementations can be backed by anything that can
+// implement durable.FS: a directory (see NewDirActorFSProvider), memory (see
+// NewMemActorFSProvider), an object store, etc.
+type ActorFSProvider interface {
+	// Open returns the file system of the provided actor. It is called when the actor is
+	// activated.
+	Open(ctx context.Context, namespace, moduleID, actorID string) (durable.FS, error)
+	// Release is called once every activation of the provided actor that the file system
+	// was opened for has been closed. Providers with ephemeral backing should delete
+	// the actor's files.
+	Release(ctx context.Context, namespace, moduleID, actorID string) error
+}
+
+// actorFileSystems opens (and releases) the file systems of actors with an
+// ActorFSProvider. The file system of an actor is shared by all its concurrent
+// activations (the previous activation of an actor may not have been closed by the time
+// the next one is created) and is only released once all of them have been closed.
+type actorFileSystems struct {
+	sync.Mutex
+
+	// Configuration.
+	provider   ActorFSProvider
+	quotaBytes int64
+
+	// State.
+	open map[types.NamespacedActorID]*actorFSEntry
+}
+
+type actorFSEntry struct {
+	fs   durable.FS
+	refs int
+}
+
+func newActorFileSystems(opts ActorFSOptions) *actorFileSystems {
+	return &actorFileSystems{
+		provider:   opts.Provider,
+		quotaBytes: opts.QuotaBytes,
+		open:       make(map[types.NamespacedActorID]*actorFSEntry),
+	}
+}
+
+// acquire returns the file system of the provided actor and a function that must be
+// called once the activation that it was acquired for is closed. It returns false if no
+// ActorFSProvider is configured.
+func (a *actorFileSystems) acquire(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+) (durable.FS, func(context.Context), bool, error) {
+	if a == nil || a.provider == nil {
+		return nil, nil, false, nil
+	}
+
+	actorID := reference.ActorID()
+	a.Lock()
+	defer a.Unlock()
+	entry, ok := a.open[actorID]
+	if !ok {
+		fsys, err := a.provider.Open(
+			ctx, actorID.Namespace, actorID.Module, actorID.ID)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf(
+				"error opening file system for actor: %v, err: %w", actorID, err)
+		}
+		if a.quotaBytes > 0 {
+			fsys, err = newQuotaFS(fsys, a.quotaBytes)
+			if err != nil {
+				return nil, nil, false, fmt.Errorf(
+					"error computing file system usage for actor: %v, err: %w", actorID, err)
+			}
+		}
+		entry = &actorFSEntry{fs: fsys}
+		a.open[actorID] = entry
+	}
+	entry.refs++
+
+	var once sync.Once
+	release := func(ctx context.Context) {
+		once.Do(func() {
+			a.release(ctx, actorID, entry)
+		})
+	}
+	return entry.fs, release, true, nil
+}
+
+func (a *actorFileSystems) release(
+	ctx context.Context,
+	actorID types.NamespacedActorID,
+	entry *actorFSEntry,
+) {
+	a.Lock()
+	defer a.Unlock()
+	entry.refs--
+	if entry.refs > 0 {
+		return
+	}
+	if a.open[actorID] == entry {
+		delete(a.open, actorID)
+	}
+	// Releasing while holding the lock ensures that the file system is not reopened
+	// before the provider is done releasing it.
+	if err := a.provider.Release(ctx, actorID.Namespace, actorID.Module, actorID.ID); err != nil {
+		// Nothing else we can do since the actor is already closed.
+		log.Printf("error releasing file system for actor: %v, err: %v", actorID, err)
+	}
+}
+
+// quotaFS wraps a durable.FS and limits the total size of the files it contains.
+type quotaFS struct {
+	sync.Mutex
+
+	durable.FS
+	quota int64
+	used  int64
+}
+
+func newQuotaFS(fsys durable.FS, quota int64) (*quotaFS, error) {
+	used, err := fsUsage(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &quotaFS{FS: fsys, quota: quota, used: used}, nil
+}
+
+// fsUsage returns the total size of the regular files in fsys.
+func fsUsage(fsys fs.FS) (int64, error) {
+	var used int64
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		used += info.Size()
+		return nil
+	})
+	return used, err
+}
+
+func (q *quotaFS) Open(name string) (fs.File, error) {
+	return q.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (q *quotaFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	var truncated int64
+	if flag&os.O_TRUNC != 0 {
+		truncated = q.sizeWithLock(name)
+	}
+	f, err := q.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	q.used -= truncated
+	return &quotaFile{File: f, q: q, append: flag&os.O_APPEND != 0}, nil
+}
+
+func (q *quotaFS) Rename(from, to string) error {
+	q.Lock()
+	defer q.Unlock()
+
+	var overwritten int64
+	if from != to {
+		overwritten = q.sizeWithLock(to)
+	}
+	if err := q.FS.Rename(from, to); err != nil {
+		return err
+	}
+	q.used -= overwritten
+	return nil
+}
+
+func (q *quotaFS) Unlink(name string) error {
+	q.Lock()
+	defer q.Unlock()
+
+	size := q.sizeWithLock(name)
+	if err := q.FS.Unlink(name); err != nil {
+		return err
+	}
+	q.used -= size
+	return nil
+}
+
+// sizeWithLock returns the size of the provided regular file, or 0 if it doesn't exist
+// or it's not a regular file.
+func (q *quotaFS) sizeWithLock(name string) int64 {
+	info, err := fs.Stat(q.FS, name)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	return info.Size()
+}
+
+// quotaFile wraps a file opened by quotaFS and accounts for how much each write grows
+// the file.
+type quotaFile struct {
+	fs.File
+	q      *quotaFS
+	append bool
+}
+
+func (f *quotaFile) Write(p []byte) (int, error) {
+	w, ok := f.File.(io.Writer)
+	if !ok {
+		return 0, syscall.EBADF
+	}
+
+	f.q.Lock()
+	defer f.q.Unlock()
+	size, err := f.size()
+	if err != nil {
+		return 0, err
+	}
+	offset := size
+	if !f.append {
+		if offset, err = f.Seek(0, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+	}
+	if err := f.reserveWithLock(size, offset+int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := w.Write(p)
+	f.accountWithLock(size)
+	return n, err
+}
+
+func (f *quotaFile) WriteAt(p []byte, offset int64) (int, error) {
+	w, ok := f.File.(io.WriterAt)
+	if !ok {
+		return 0, syscall.ENOSYS
+	}
+
+	f.q.Lock()
+	defer f.q.Unlock()
+	size, err := f.size()
+	if err != nil {
+		return 0, err
+	}
+	if err := f.reserveWithLock(size, offset+int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := w.WriteAt(p, offset)
+	f.accountWithLock(size)
+	return n, err
+}
+
+func (f *quotaFile) Seek(offset int64, whence int) (int64, error) {
+	s, ok := f.File.(io.Seeker)
+	if !ok {
+		return 0, syscall.ENOSYS
+	}
+	return s.Seek(offset, whence)
+}
+
+func (f *quotaFile) ReadAt(p []byte, offset int64) (int, error) {
+	r, ok := f.File.(io.ReaderAt)
+	if !ok {
+		return 0, syscall.ENOSYS
+	}
+	return r.ReadAt(p, offset)
+}
+
+func (f *quotaFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	d, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, syscall.ENOTDIR
+	}
+	return d.ReadDir(n)
+}
+
+func (f *quotaFile) size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// reserveWithLock returns errActorFSQuotaExceeded if growing the file from size to end
+// would exceed the quota.
+func (f *quotaFile) reserveWithLock(size, end int64) error {
+	if growth := end - size; growth > 0 && f.q.used+growth > f.q.quota {
+		return fmt.Errorf(
+			"%w: quota: %d bytes, used: %d bytes, cannot grow file by: %d bytes",
+			errActorFSQuotaExceeded, f.q.quota, f.q.used, growth)
+	}
+	return nil
+}
+
+// accountWithLock updates the usage of the file system after a write that started when
+// the file had the provided size.
+func (f *quotaFile) accountWithLock(prevSize int64) {
+	if size, err := f.size(); err == nil {
+		f.q.used += size - prevSize
+	}
+}
@@ -0,0 +1,575 @@
+package virtual
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/richardartoul/nola/durable"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+// DirActorFSProviderOptions contains the options for NewDirActorFSProvider.
+type DirActorFSProviderOptions struct {
+	// Ephemeral makes the provider delete the directory of each actor once the actor is
+	// deactivated. Otherwise, files survive deactivations (and restarts).
+	Ephemeral bool
+}
+
+type dirActorFSProvider struct {
+	root string
+	opts DirActorFSProviderOptions
+}
+
+// NewDirActorFSProvider returns an ActorFSProvider that gives each actor its own
+// subdirectory of root. Actors can't access files outside of their directory by path,
+// but symbolic links that are created outside of nola are followed.
+func NewDirActorFSProvider(root string, opts DirActorFSProviderOptions) ActorFSProvider {
+	return &dirActorFSProvider{root: root, opts: opts}
+}
+
+func (p *dirActorFSProvider) Open(
+	ctx context.Context,
+	namespace, moduleID, actorID string,
+) (durable.FS, error) {
+	dir := p.actorDir(namespace, moduleID, actorID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating actor dir: %s, err: %w", dir, err)
+	}
+	return dirFS(dir), nil
+}
+
+func (p *dirActorFSProvider) Release(
+	ctx context.Context,
+	namespace, moduleID, actorID string,
+) error {
+	if !p.opts.Ephemeral {
+		return nil
+	}
+	return os.RemoveAll(p.actorDir(namespace, moduleID, actorID))
+}
+
+// actorDir returns the directory of the provided actor. Each component of the actor's
+// identity is encoded so they can't contain path separators or be "." or "..".
+func (p *dirActorFSProvider) actorDir(namespace, moduleID, actorID string) string {
+	return filepath.Join(
+		p.root,
+		"ns-"+base64.RawURLEncoding.EncodeToString([]byte(namespace)),
+		"mod-"+base64.RawURLEncoding.EncodeToString([]byte(moduleID)),
+		"actor-"+base64.RawURLEncoding.EncodeToString([]byte(actorID)))
+}
+
+// dirFS implements durable.FS on top of a directory.
+type dirFS string
+
+func (d dirFS) Open(name string) (fs.File, error) {
+	return d.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (d dirFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	p, err := d.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, flag, perm)
+}
+
+func (d dirFS) Mkdir(name string, perm fs.FileMode) error {
+	p, err := d.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, perm)
+}
+
+func (d dirFS) Rename(from, to string) error {
+	fromPath, err := d.path("rename", from)
+	if err != nil {
+		return err
+	}
+	toPath, err := d.path("rename", to)
+	if err != nil {
+		return err
+	}
+	return os.Rename(fromPath, toPath)
+}
+
+func (d dirFS) Rmdir(name string) error {
+	p, err := d.path("rmdir", name)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &fs.PathError{Op: "rmdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	return os.Remove(p)
+}
+
+func (d dirFS) Unlink(name string) error {
+	p, err := d.path("unlink", name)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &fs.PathError{Op: "unlink", Path: name, Err: syscall.EISDIR}
+	}
+	return os.Remove(p)
+}
+
+func (d dirFS) Utimes(name string, atimeSec, atimeNsec, mtimeSec, mtimeNsec int64) error {
+	p, err := d.path("utimes", name)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(p, time.Unix(atimeSec, atimeNsec), time.Unix(mtimeSec, mtimeNsec))
+}
+
+// path returns the path of name on the host, or an error if name could escape the
+// directory.
+func (d dirFS) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: syscall.EINVAL}
+	}
+	return filepath.Join(string(d), filepath.FromSlash(name)), nil
+}
+
+type memActorFSProvider struct {
+	sync.Mutex
+	fileSystems map[types.NamespacedActorID]*memFS
+}
+
+// NewMemActorFSProvider returns an ActorFSProvider that keeps the files of each actor in
+// memory. The files of an actor are deleted once the actor is deactivated so they must
+// be small, and actors must not rely on them outliving the activation.
+func NewMemActorFSProvider() ActorFSProvider {
+	return &memActorFSProvider{
+		fileSystems: make(map[types.NamespacedActorID]*memFS),
+	}
+}
+
+func (p *memActorFSProvider) Open(
+	ctx context.Context,
+	namespace, moduleID, actorID string,
+) (durable.FS, error) {
+	p.Lock()
+	defer p.Unlock()
+	id := types.NewNamespacedActorID(namespace, actorID, moduleID, types.IDTypeActor)
+	fsys, ok := p.fileSystems[id]
+	if !ok {
+		fsys = newMemFS()
+		p.fileSystems[id] = fsys
+	}
+	return fsys, nil
+}
+
+func (p *memActorFSProvider) Release(
+	ctx context.Context,
+	namespace, moduleID, actorID string,
+) error {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.fileSystems, types.NewNamespacedActorID(namespace, actorID, moduleID, types.IDTypeActor))
+	return nil
+}
+
+// memFS implements durable.FS in memory.
+type memFS struct {
+	sync.Mutex
+	// nodes maps the (clean) path of every file and directory to its contents. The root
+	// directory is ".".
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	mode    fs.FileMode
+	data    []byte
+	modTime time.Time
+}
+
+func newMemFS() *memFS {
+	return &memFS{
+		nodes: map[string]*memNode{
+			".": {mode: fs.ModeDir | 0o755, modTime: time.Now()},
+		},
+	}
+}
+
+func (m *memFS) Open(name string) (fs.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EINVAL}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	node, ok := m.nodes[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EEXIST}
+	case ok && node.mode.IsDir() && flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	case !ok:
+		if err := m.checkParentWithLock("open", name); err != nil {
+			return nil, err
+		}
+		node = &memNode{mode: perm.Perm(), modTime: time.Now()}
+		m.nodes[name] = node
+	}
+	if flag&os.O_TRUNC != 0 {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+	return &memFile{fs: m, name: name, node: node, flag: flag}, nil
+}
+
+func (m *memFS) Mkdir(name string, perm fs.FileMode) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.EINVAL}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.nodes[name]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.EEXIST}
+	}
+	if err := m.checkParentWithLock("mkdir", name); err != nil {
+		return err
+	}
+	m.nodes[name] = &memNode{mode: fs.ModeDir | perm.Perm(), modTime: time.Now()}
+	return nil
+}
+
+func (m *memFS) Rename(from, to string) error {
+	if !fs.ValidPath(from) || !fs.ValidPath(to) || from == "." || to == "." {
+		return syscall.EINVAL
+	}
+	if from == to {
+		return nil
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	node, ok := m.nodes[from]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: from, Err: syscall.ENOENT}
+	}
+	if err := m.checkParentWithLock("rename", to); err != nil {
+		return err
+	}
+	if existing, ok := m.nodes[to]; ok {
+		switch {
+		case node.mode.IsDir() && !existing.mode.IsDir():
+			return &fs.PathError{Op: "rename", Path: to, Err: syscall.ENOTDIR}
+		case !node.mode.IsDir() && existing.mode.IsDir():
+			return &fs.PathError{Op: "rename", Path: to, Err: syscall.EISDIR}
+		case existing.mode.IsDir() && len(m.childrenWithLock(to)) > 0:
+			return &fs.PathError{Op: "rename", Path: to, Err: syscall.ENOTEMPTY}
+		}
+	}
+	if node.mode.IsDir() && strings.HasPrefix(to, from+"/") {
+		return &fs.PathError{Op: "rename", Path: to, Err: syscall.EINVAL}
+	}
+
+	if node.mode.IsDir() {
+		prefix := from + "/"
+		for p, child := range m.nodes {
+			if strings.HasPrefix(p, prefix) {
+				delete(m.nodes, p)
+				m.nodes[to+"/"+strings.TrimPrefix(p, prefix)] = child
+			}
+		}
+	}
+	delete(m.nodes, from)
+	m.nodes[to] = node
+	return nil
+}
+
+func (m *memFS) Rmdir(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "rmdir", Path: name, Err: syscall.EINVAL}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	node, ok := m.nodes[name]
+	switch {
+	case !ok:
+		return &fs.PathError{Op: "rmdir", Path: name, Err: syscall.ENOENT}
+	case !node.mode.IsDir():
+		return &fs.PathError{Op: "rmdir", Path: name, Err: syscall.ENOTDIR}
+	case len(m.childrenWithLock(name)) > 0:
+		return &fs.PathError{Op: "rmdir", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *memFS) Unlink(name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "unlink", Path: name, Err: syscall.EINVAL}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	node, ok := m.nodes[name]
+	switch {
+	case !ok:
+		return &fs.PathError{Op: "unlink", Path: name, Err: syscall.ENOENT}
+	case node.mode.IsDir():
+		return &fs.PathError{Op: "unlink", Path: name, Err: syscall.EISDIR}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *memFS) Utimes(name string, atimeSec, atimeNsec, mtimeSec, mtimeNsec int64) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "utimes", Path: name, Err: syscall.EINVAL}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	node, ok := m.nodes[name]
+	if !ok {
+		return &fs.PathError{Op: "utimes", Path: name, Err: syscall.ENOENT}
+	}
+	node.modTime = time.Unix(mtimeSec, mtimeNsec)
+	return nil
+}
+
+// checkParentWithLock returns an error if the parent of name is not an existing
+// directory.
+func (m *memFS) checkParentWithLock(op, name string) error {
+	parent, ok := m.nodes[path.Dir(name)]
+	if !ok {
+		return &fs.PathError{Op: op, Path: name, Err: syscall.ENOENT}
+	}
+	if !parent.mode.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// childrenWithLock returns the sorted names of the direct children of the provided
+// directory.
+func (m *memFS) childrenWithLock(dir string) []string {
+	var children []string
+	for p := range m.nodes {
+		if p != "." && path.Dir(p) == dir {
+			children = append(children, path.Base(p))
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+// memFile is a file or directory of a memFS that has been opened.
+type memFile struct {
+	fs     *memFS
+	name   string
+	node   *memNode
+	flag   int
+	offset int64
+	// dirOffset is the number of entries that have already been returned by ReadDir.
+	dirOffset int
+	closed    bool
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+	return f.infoWithLock(path.Base(f.name), f.node), nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+	n, err := f.readAtWithLock(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, offset int64) (int, error) {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+	return f.readAtWithLock(p, offset)
+}
+
+func (f *memFile) readAtWithLock(p []byte, offset int64) (int, error) {
+	if err := f.checkWithLock("read", os.O_WRONLY); err != nil {
+		return 0, err
+	}
+	if f.node.mode.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: syscall.EINVAL}
+	}
+	if offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+	n, err := f.writeAtWithLock(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, offset int64) (int, error) {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+	return f.writeAtWithLock(p, offset)
+}
+
+func (f *memFile) writeAtWithLock(p []byte, offset int64) (int, error) {
+	if err := f.checkWithLock("write", os.O_RDONLY); err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EINVAL}
+	}
+	if end := offset + int64(len(p)); end > int64(len(f.node.data)) {
+		if end > int64(cap(f.node.data)) {
+			data := make([]byte, end, end*2)
+			copy(data, f.node.data)
+			f.node.data = data
+		} else {
+			f.node.data = f.node.data[:end]
+		}
+	}
+	copy(f.node.data[offset:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+	if err := f.checkWithLock("seek", -1); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+	if err := f.checkWithLock("readdir", -1); err != nil {
+		return nil, err
+	}
+	if !f.node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+
+	children := f.fs.childrenWithLock(f.name)
+	if f.dirOffset > len(children) {
+		f.dirOffset = len(children)
+	}
+	children = children[f.dirOffset:]
+	if n > 0 && len(children) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && len(children) > n {
+		children = children[:n]
+	}
+	f.dirOffset += len(children)
+
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, child := range children {
+		node := f.fs.nodes[path.Join(f.name, child)]
+		entries = append(entries, fs.FileInfoToDirEntry(f.infoWithLock(child, node)))
+	}
+	return entries, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// checkWithLock returns an error if the file is closed or was opened with the provided
+// access mode (which doesn't allow op).
+func (f *memFile) checkWithLock(op string, disallowedAccessMode int) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	if disallowedAccessMode >= 0 && f.flag&(os.O_RDONLY|os.O_WRONLY|os.O_RDWR) == disallowedAccessMode {
+		return &fs.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+func (f *memFile) infoWithLock(name string, node *memNode) fs.FileInfo {
+	return memFileInfo{
+		name:    name,
+		size:    int64(len(node.data)),
+		mode:    node.mode,
+		modTime: node.modTime,
+	}
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memFileInfo) Sys() any           { return nil }
@@ -0,0 +1,289 @@
+package virtual
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/richardartoul/nola/durable"
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestActorFS ensures that each WASM actor gets its own file system from the provider
+// and that it's released once the actor is deactivated.
+func TestActorFS(t *testing.T) {
+	var (
+		reg      = localregistry.NewLocalRegistry()
+		ctx      = context.Background()
+		provider = newTestActorFSProvider(NewMemActorFSProvider())
+	)
+	opts := defaultOptsWASM
+	opts.Discovery.Port = 70
+	opts.ActorFS = ActorFSOptions{Provider: provider, QuotaBytes: 1 << 20}
+	opts.ActorIdleTimeout = 100 * time.Millisecond
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	_, err = reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+
+	for i, actorID := range []string{"a", "b", "a"} {
+		result, err := env.InvokeActor(ctx, "ns-1", actorID, "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		require.Equal(t, []int64{1, 1, 2}[i], getCount(t, result))
+	}
+	require.Equal(t, []string{"ns-1/test-module/a", "ns-1/test-module/b"}, provider.getOpened())
+	require.Empty(t, provider.getReleased())
+
+	require.Eventually(t, func() bool {
+		return len(provider.getReleased()) == 2
+	}, time.Second, 10*time.Millisecond)
+	require.ElementsMatch(t, []string{"ns-1/test-module/a", "ns-1/test-module/b"}, provider.getReleased())
+
+	require.Error(t, (&ActorFSOptions{QuotaBytes: -1}).Validate())
+}
+
+// TestActorFileSystemsSharedByActivations ensures that the file system of an actor is
+// shared by its concurrent activations and only released once all of them are closed.
+func TestActorFileSystemsSharedByActivations(t *testing.T) {
+	var (
+		ctx         = context.Background()
+		provider    = newTestActorFSProvider(NewMemActorFSProvider())
+		fileSystems = newActorFileSystems(ActorFSOptions{Provider: provider})
+	)
+	refA, err := types.NewVirtualActorReference("ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+	refB, err := types.NewVirtualActorReference("ns-1", "test-module", "b", 1)
+	require.NoError(t, err)
+
+	fsA1, releaseA1, ok, err := fileSystems.acquire(ctx, refA)
+	require.NoError(t, err)
+	require.True(t, ok)
+	writeFile(t, fsA1, "file", "hello")
+
+	fsA2, releaseA2, _, err := fileSystems.acquire(ctx, refA)
+	require.NoError(t, err)
+	require.Equal(t, "hello", readFile(t, fsA2, "file"))
+
+	// Actors can't see each other's files.
+	fsB, releaseB, _, err := fileSystems.acquire(ctx, refB)
+	require.NoError(t, err)
+	_, err = fsB.Open("file")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	releaseB(ctx)
+
+	// Releasing is idempotent, and the file system is only released with the last
+	// activation.
+	releaseA1(ctx)
+	releaseA1(ctx)
+	require.Equal(t, []string{"ns-1/test-module/b"}, provider.getReleased())
+	releaseA2(ctx)
+	require.Equal(t, []string{"ns-1/test-module/b", "ns-1/test-module/a"}, provider.getReleased())
+
+	// The in-memory provider is ephemeral.
+	fsA3, releaseA3, _, err := fileSystems.acquire(ctx, refA)
+	require.NoError(t, err)
+	defer releaseA3(ctx)
+	_, err = fsA3.Open("file")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// Nothing is mounted without a provider.
+	_, _, ok, err = newActorFileSystems(ActorFSOptions{}).acquire(ctx, refA)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestDirActorFSProvider(t *testing.T) {
+	for _, ephemeral := range []bool{false, true} {
+		var (
+			ctx      = context.Background()
+			root     = t.TempDir()
+			provider = NewDirActorFSProvider(root, DirActorFSProviderOptions{Ephemeral: ephemeral})
+		)
+
+		// Actor IDs can't be used to escape the root.
+		fsys, err := provider.Open(ctx, "ns-1", "test-module", "../../a")
+		require.NoError(t, err)
+		writeFile(t, fsys, "file", "hello")
+		matches, err := filepath.Glob(filepath.Join(root, "*", "*", "*", "file"))
+		require.NoError(t, err)
+		require.Len(t, matches, 1)
+
+		_, err = fsys.OpenFile("../file", os.O_RDONLY, 0)
+		require.ErrorIs(t, err, syscall.EINVAL)
+
+		require.NoError(t, provider.Release(ctx, "ns-1", "test-module", "../../a"))
+		fsys, err = provider.Open(ctx, "ns-1", "test-module", "../../a")
+		require.NoError(t, err)
+		_, err = fsys.Open("file")
+		if ephemeral {
+			require.ErrorIs(t, err, fs.ErrNotExist)
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, "hello", readFile(t, fsys, "file"))
+		}
+	}
+}
+
+func TestActorFSImplementations(t *testing.T) {
+	dirFS, err := NewDirActorFSProvider(t.TempDir(), DirActorFSProviderOptions{}).Open(
+		context.Background(), "ns-1", "test-module", "a")
+	require.NoError(t, err)
+
+	for name, fsys := range map[string]durable.FS{
+		"dir": dirFS,
+		"mem": newMemFS(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, fsys.Mkdir("dir", 0o755))
+			require.ErrorIs(t, fsys.Mkdir("dir", 0o755), syscall.EEXIST)
+			require.ErrorIs(t, fsys.Mkdir("missing/dir", 0o755), syscall.ENOENT)
+			writeFile(t, fsys, "dir/a", "aaa")
+			writeFile(t, fsys, "dir/b", "b")
+			require.NoError(t, fstest.TestFS(fsys, "dir", "dir/a", "dir/b"))
+
+			require.NoError(t, fsys.Utimes("dir/b", 1, 0, 2, 0))
+			info, err := fs.Stat(fsys, "dir/b")
+			require.NoError(t, err)
+			require.Equal(t, int64(2), info.ModTime().Unix())
+
+			// Appends.
+			f, err := fsys.OpenFile("dir/a", os.O_WRONLY|os.O_APPEND, 0)
+			require.NoError(t, err)
+			_, err = f.(io.Writer).Write([]byte("AA"))
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+			require.Equal(t, "aaaAA", readFile(t, fsys, "dir/a"))
+
+			// Read-only files can't be written.
+			f, err = fsys.OpenFile("dir/a", os.O_RDONLY, 0)
+			require.NoError(t, err)
+			_, err = f.(io.Writer).Write([]byte("x"))
+			require.Error(t, err)
+			require.NoError(t, f.Close())
+
+			require.ErrorIs(t, fsys.Rmdir("dir"), syscall.ENOTEMPTY)
+			require.ErrorIs(t, fsys.Unlink("dir"), syscall.EISDIR)
+			require.ErrorIs(t, fsys.Rmdir("dir/a"), syscall.ENOTDIR)
+
+			require.NoError(t, fsys.Rename("dir", "renamed"))
+			require.Equal(t, "aaaAA", readFile(t, fsys, "renamed/a"))
+			require.NoError(t, fsys.Rename("renamed/b", "renamed/a"))
+			require.Equal(t, "b", readFile(t, fsys, "renamed/a"))
+			require.NoError(t, fsys.Unlink("renamed/a"))
+			require.NoError(t, fsys.Rmdir("renamed"))
+			require.NoError(t, fstest.TestFS(fsys))
+		})
+	}
+}
+
+func TestActorFSQuota(t *testing.T) {
+	fsys := newMemFS()
+	writeFile(t, fsys, "existing", "12345")
+
+	q, err := newQuotaFS(fsys, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), q.used)
+
+	f, err := q.OpenFile("file", os.O_CREATE|os.O_RDWR, 0o644)
+	require.NoError(t, err)
+	w := f.(io.WriteSeeker)
+	_, err = w.Write([]byte("abcd"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("ef"))
+	require.True(t, IsActorFSQuotaExceededErr(err), err)
+	require.ErrorIs(t, err, syscall.ENOSPC)
+
+	// Overwriting doesn't use more space.
+	_, err = w.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("ABCD"))
+	require.NoError(t, err)
+	_, err = f.(io.WriterAt).WriteAt([]byte("xy"), 4)
+	require.True(t, IsActorFSQuotaExceededErr(err), err)
+	require.NoError(t, f.Close())
+	require.Equal(t, int64(9), q.used)
+
+	// Deleting, truncating and renaming on top of existing files frees space.
+	require.NoError(t, q.Unlink("existing"))
+	require.Equal(t, int64(4), q.used)
+	writeFile(t, q, "other", "123")
+	require.Equal(t, int64(7), q.used)
+	require.NoError(t, q.Rename("other", "file"))
+	require.Equal(t, int64(3), q.used)
+	f, err = q.OpenFile("file", os.O_WRONLY|os.O_TRUNC, 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, int64(0), q.used)
+}
+
+func writeFile(t *testing.T, fsys durable.FS, name, contents string) {
+	f, err := fsys.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	require.NoError(t, err)
+	_, err = f.(io.Writer).Write([]byte(contents))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func readFile(t *testing.T, fsys durable.FS, name string) string {
+	contents, err := fs.ReadFile(fsys, name)
+	require.NoError(t, err)
+	return string(contents)
+}
+
+// testActorFSProvider wraps an ActorFSProvider and records which file systems are
+// opened and released.
+type testActorFSProvider struct {
+	sync.Mutex
+	ActorFSProvider
+	opened   []string
+	released []string
+}
+
+func newTestActorFSProvider(provider ActorFSProvider) *testActorFSProvider {
+	return &testActorFSProvider{ActorFSProvider: provider}
+}
+
+func (p *testActorFSProvider) Open(
+	ctx context.Context,
+	namespace, moduleID, actorID string,
+) (durable.FS, error) {
+	p.Lock()
+	p.opened = append(p.opened, namespace+"/"+moduleID+"/"+actorID)
+	p.Unlock()
+	return p.ActorFSProvider.Open(ctx, namespace, moduleID, actorID)
+}
+
+func (p *testActorFSProvider) Release(
+	ctx context.Context,
+	namespace, moduleID, actorID string,
+) error {
+	p.Lock()
+	p.released = append(p.released, namespace+"/"+moduleID+"/"+actorID)
+	p.Unlock()
+	return p.ActorFSProvider.Release(ctx, namespace, moduleID, actorID)
+}
+
+func (p *testActorFSProvider) getOpened() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string(nil), p.opened...)
+}
+
+func (p *testActorFSProvider) getReleased() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string(nil), p.released...)
+}
@@ -0,0 +1,170 @@
+package virtual
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const (
+	// defaultMaxMetricNamesPerModule is the default value for
+	// ActorMetricsOptions.MaxNamesPerModule.
+	defaultMaxMetricNamesPerModule = 100
+	// maxMetricNameLength is the maximum length of the name of a metric emitted by an
+	// actor (after it has been sanitized).
+	maxMetricNameLength = 128
+)
+
+var (
+	errInvalidMetricName = errors.New("invalid metric name")
+	errTooManyMetrics    = errors.New("too many distinct metric names")
+)
+
+// IsInvalidMetricNameErr returns a boolean indicating whether the error is an instance
+// of (or wraps) errInvalidMetricName.
+func IsInvalidMetricNameErr(err error) bool {
+	return errors.Is(err, errInvalidMetricName)
+}
+
+// IsTooManyMetricsErr returns a boolean indicating whether the error is an instance of
+// (or wraps) errTooManyMetrics.
+func IsTooManyMetricsErr(err error) bool {
+	return errors.Is(err, errTooManyMetrics)
+}
+
+// MetricsSink is the interface that must be implemented to receive the metrics that
+// actors emit with HostCapabilities.MetricInc and HostCapabilities.MetricObserve. It
+// maps directly to the APIs of most metrics libraries: for example, a Prometheus sink
+// can lazily create a CounterVec (for Inc) or a HistogramVec (for Observe) per name
+// with "namespace" and "module_id" labels. Its methods must be safe for concurrent use
+// and should not block since they're called inline with actor invocations.
+type MetricsSink interface {
+	// Inc increments the counter with the provided name by delta.
+	Inc(name string, delta float64, labels MetricLabels)
+	// Observe records value in the distribution (histogram, summary, etc) with the
+	// provided name.
+	Observe(name string, value float64, labels MetricLabels)
+}
+
+// MetricLabels contains the labels that are attached automatically to every metric
+// emitted by an actor. The actor's ID is intentionally not included since it would
+// result in one time series per actor.
+type MetricLabels struct {
+	Namespace string
+	ModuleID  string
+}
+
+// actorMetrics validates the metrics emitted by actors and forwards them to the
+// configured MetricsSink.
+type actorMetrics struct {
+	sync.RWMutex
+
+	// Configuration.
+	sink              MetricsSink
+	maxNamesPerModule int
+
+	// State.
+	// names contains the (sanitized) names of the metrics emitted by each module.
+	names map[types.NamespacedIDNoType]map[string]struct{}
+}
+
+func newActorMetrics(opts ActorMetricsOptions) *actorMetrics {
+	return &actorMetrics{
+		sink:              opts.Sink,
+		maxNamesPerModule: opts.MaxNamesPerModule,
+		names:             make(map[types.NamespacedIDNoType]map[string]struct{}),
+	}
+}
+
+// inc increments the counter with the provided name for the provided module by delta.
+func (m *actorMetrics) inc(labels MetricLabels, name string, delta float64) error {
+	if m.sink == nil {
+		return nil
+	}
+	name, err := m.register(labels, name)
+	if err != nil {
+		return err
+	}
+	m.sink.Inc(name, delta, labels)
+	return nil
+}
+
+// observe records value in the distribution with the provided name for the provided
+// module.
+func (m *actorMetrics) observe(labels MetricLabels, name string, value float64) error {
+	if m.sink == nil {
+		return nil
+	}
+	name, err := m.register(labels, name)
+	if err != nil {
+		return err
+	}
+	m.sink.Observe(name, value, labels)
+	return nil
+}
+
+// register sanitizes name and records that the provided module emits it. It fails if the
+// module would exceed MaxNamesPerModule distinct names.
+func (m *actorMetrics) register(labels MetricLabels, name string) (string, error) {
+	name, err := sanitizeMetricName(name)
+	if err != nil {
+		return "", err
+	}
+
+	moduleID := types.NewNamespacedIDNoType(labels.Namespace, labels.ModuleID)
+	m.RLock()
+	_, ok := m.names[moduleID][name]
+	m.RUnlock()
+	if ok {
+		return name, nil
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	names, ok := m.names[moduleID]
+	if !ok {
+		names = make(map[string]struct{})
+		m.names[moduleID] = names
+	}
+	if _, ok := names[name]; ok {
+		return name, nil
+	}
+	if len(names) >= m.maxNamesPerModule {
+		return "", fmt.Errorf(
+			"%w: module: %v already emits %d metrics, cannot emit: %s",
+			errTooManyMetrics, moduleID, len(names), name)
+	}
+	names[name] = struct{}{}
+	return name, nil
+}
+
+// sanitizeMetricName replaces the characters of name that are not valid in Prometheus
+// metric names (anything other than ASCII letters, digits, '_' and ':') with '_' and
+// prefixes names that start with a digit with '_'. Empty names and names that are longer
+// than maxMetricNameLength are rejected.
+func sanitizeMetricName(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("%w: name cannot be empty", errInvalidMetricName)
+	}
+
+	sanitized := make([]byte, 0, len(name)+1)
+	if name[0] >= '0' && name[0] <= '9' {
+		sanitized = append(sanitized, '_')
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == ':':
+			sanitized = append(sanitized, c)
+		default:
+			sanitized = append(sanitized, '_')
+		}
+	}
+	if len(sanitized) > maxMetricNameLength {
+		return "", fmt.Errorf(
+			"%w: name: %s is longer than %d characters", errInvalidMetricName, name, maxMetricNameLength)
+	}
+	return string(sanitized), nil
+}
@@ -0,0 +1,159 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestActorMetrics ensures that actors can emit custom metrics, that they're labeled with
+// the actor's namespace and module, and that the number of distinct metric names each
+// module can emit is limited.
+func TestActorMetrics(t *testing.T) {
+	var (
+		reg  = localregistry.NewLocalRegistry()
+		ctx  = context.Background()
+		sink = &testMetricsSink{}
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 21
+	opts.ActorMetrics = ActorMetricsOptions{Sink: sink, MaxNamesPerModule: 2}
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	for _, moduleID := range []string{"test-module", "test-module-2"} {
+		require.NoError(t, env.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: "ns-1", ID: moduleID}, testModule{}))
+	}
+
+	emit := func(actorID, moduleID, operation, name string, value float64) error {
+		marshaled, err := json.Marshal(wapcutils.Metric{Name: name, Value: value})
+		require.NoError(t, err)
+		_, err = env.InvokeActor(
+			ctx, "ns-1", actorID, moduleID, operation, marshaled, types.CreateIfNotExist{})
+		return err
+	}
+	require.NoError(t, emit("a", "test-module", "metricInc", "requests", 1))
+	require.NoError(t, emit("a", "test-module", "metricObserve", "latency.ms", 12.5))
+	// The limit is shared by all the actors of a module.
+	require.NoError(t, emit("b", "test-module", "metricInc", "requests", 2))
+	err = emit("b", "test-module", "metricInc", "errors", 1)
+	require.True(t, IsTooManyMetricsErr(err), err)
+	// But not by other modules.
+	require.NoError(t, emit("c", "test-module-2", "metricInc", "errors", 1))
+
+	err = emit("a", "test-module", "metricInc", "", 1)
+	require.True(t, IsInvalidMetricNameErr(err), err)
+
+	labels := MetricLabels{Namespace: "ns-1", ModuleID: "test-module"}
+	require.Equal(t, []testMetric{
+		{kind: "inc", name: "requests", value: 1, labels: labels},
+		{kind: "observe", name: "latency_ms", value: 12.5, labels: labels},
+		{kind: "inc", name: "requests", value: 2, labels: labels},
+		{
+			kind: "inc", name: "errors", value: 1,
+			labels: MetricLabels{Namespace: "ns-1", ModuleID: "test-module-2"},
+		},
+	}, sink.getMetrics())
+}
+
+// TestActorMetricsHostFunctions ensures that the METRIC-INC and METRIC-OBSERVE host
+// functions that are exposed to WASM modules forward metrics to the sink.
+func TestActorMetricsHostFunctions(t *testing.T) {
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+	sink := &testMetricsSink{}
+	metrics := newActorMetrics(ActorMetricsOptions{Sink: sink, MaxNamesPerModule: 1})
+	host := newHostCapabilities(nil, nil, nil, nil, ref, nil, nil, nil, metrics, newNamespaceConfigs(nil), nil)
+
+	router := newHostFnRouter(nil, nil, nil, nil)
+	invokeCtx := context.WithValue(context.Background(), hostFnActorReferenceCtxKey{}, ref)
+	invokeCtx = context.WithValue(invokeCtx, hostFnHostCapabilitiesKey{}, host)
+	call := func(operation, name string, value float64) error {
+		marshaled, err := json.Marshal(wapcutils.Metric{Name: name, Value: value})
+		require.NoError(t, err)
+		_, err = router(invokeCtx, "", "", operation, marshaled)
+		return err
+	}
+
+	require.NoError(t, call(wapcutils.MetricIncOperationName, "count", 1))
+	require.NoError(t, call(wapcutils.MetricObserveOperationName, "count", 2))
+	err = call(wapcutils.MetricIncOperationName, "other", 1)
+	require.True(t, IsTooManyMetricsErr(err), err)
+
+	labels := MetricLabels{Namespace: "ns-1", ModuleID: "test-module"}
+	require.Equal(t, []testMetric{
+		{kind: "inc", name: "count", value: 1, labels: labels},
+		{kind: "observe", name: "count", value: 2, labels: labels},
+	}, sink.getMetrics())
+
+	// Metrics are discarded without a sink.
+	metrics = newActorMetrics(ActorMetricsOptions{MaxNamesPerModule: 1})
+	host = newHostCapabilities(nil, nil, nil, nil, ref, nil, nil, nil, metrics, newNamespaceConfigs(nil), nil)
+	for _, name := range []string{"a", "b", ""} {
+		require.NoError(t, host.MetricInc(context.Background(), name, 1))
+	}
+}
+
+func TestSanitizeMetricName(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		expected string
+		invalid  bool
+	}{
+		{name: "requests_total", expected: "requests_total"},
+		{name: "nola:requests", expected: "nola:requests"},
+		{name: "latency.ms", expected: "latency_ms"},
+		{name: "a b-c/d", expected: "a_b_c_d"},
+		{name: "5xx", expected: "_5xx"},
+		{name: "", invalid: true},
+		{name: strings.Repeat("a", maxMetricNameLength), expected: strings.Repeat("a", maxMetricNameLength)},
+		{name: strings.Repeat("a", maxMetricNameLength+1), invalid: true},
+	} {
+		sanitized, err := sanitizeMetricName(tc.name)
+		if tc.invalid {
+			require.True(t, IsInvalidMetricNameErr(err), tc.name)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, sanitized)
+	}
+}
+
+type testMetric struct {
+	kind   string
+	name   string
+	value  float64
+	labels MetricLabels
+}
+
+type testMetricsSink struct {
+	sync.Mutex
+	metrics []testMetric
+}
+
+func (s *testMetricsSink) Inc(name string, delta float64, labels MetricLabels) {
+	s.Lock()
+	defer s.Unlock()
+	s.metrics = append(s.metrics, testMetric{kind: "inc", name: name, value: delta, labels: labels})
+}
+
+func (s *testMetricsSink) Observe(name string, value float64, labels MetricLabels) {
+	s.Lock()
+	defer s.Unlock()
+	s.metrics = append(s.metrics, testMetric{kind: "observe", name: name, value: value, labels: labels})
+}
+
+func (s *testMetricsSink) getMetrics() []testMetric {
+	s.Lock()
+	defer s.Unlock()
+	return append([]testMetric(nil), s.metrics...)
+}
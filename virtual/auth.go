@@ -0,0 +1,215 @@
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authorizationScheme is the scheme of the Authorization header that is used by the
+// Authenticator returned by NewHMACAuthenticator.
+const authorizationScheme = "Nola"
+
+// Authenticator authenticates the invocations that servers receive over HTTP, both the
+// ones that are forwarded by other servers and the ones that are sent by clients. The
+// same Authenticator should be configured on the servers (see ServerOptions) and on the
+// RemoteClient that they use to forward invocations (see HTTPClientOptions).
+type Authenticator interface {
+	// Attach adds the credentials of this process to an outbound request.
+	Attach(req *http.Request) error
+	// Authenticate validates the credentials of an inbound request and returns the
+	// identity of the caller. Requests for which it returns an error are rejected with
+	// http.StatusUnauthorized before they're dispatched to actors.
+	Authenticate(req *http.Request) (string, error)
+}
+
+// AuthorizeFn decides whether caller (as returned by Authenticator.Authenticate) is
+// allowed to invoke the actors (and workers) of namespace. Requests for which it returns
+// an error are rejected with http.StatusForbidden before they're dispatched to actors.
+//
+// Note that invocations that are forwarded between servers are authorized against the
+// identity of the forwarding server, so servers must be authorized for every namespace
+// that they may forward invocations of.
+type AuthorizeFn func(ctx context.Context, caller string, namespace string) error
+
+// NewHMACAuthenticator returns an Authenticator that identifies callers with tokens that
+// are signed with a secret that is shared by all the callers and servers. identity is
+// the identity that outbound requests are signed with.
+//
+// Each token signs the time at which it was attached along with the method, path and a
+// hash of the body of its request, so it can't be reused for a different request, and it
+// is rejected if its time is further than hmacTokenMaxSkew from the server's clock. A
+// captured token can still be replayed for the exact same request within that window.
+func NewHMACAuthenticator(identity string, secret []byte) Authenticator {
+	return &hmacAuthenticator{identity: identity, secret: secret, now: time.Now}
+}
+
+const (
+	// hmacTokenMaxSkew is the maximum difference between the time at which an HMAC token
+	// was attached and the time at which it's authenticated, in either direction to
+	// tolerate clock skew between the caller and the server.
+	hmacTokenMaxSkew = time.Minute
+	// maxHMACBodyBytes is the maximum size of the (possibly compressed) body of requests
+	// that are authenticated with HMAC tokens, since their body must be buffered to be
+	// hashed.
+	maxHMACBodyBytes = 1 << 24
+)
+
+type hmacAuthenticator struct {
+	identity string
+	secret   []byte
+	now      func() time.Time
+}
+
+func (h *hmacAuthenticator) Attach(req *http.Request) error {
+	body, err := bufferRequestBody(req)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(h.now().Unix(), 10)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s %s.%s.%s", authorizationScheme,
+		base64.RawURLEncoding.EncodeToString([]byte(h.identity)),
+		timestamp,
+		base64.RawURLEncoding.EncodeToString(
+			h.sign(h.identity, timestamp, req.Method, req.URL.Path, body))))
+	return nil
+}
+
+func (h *hmacAuthenticator) Authenticate(req *http.Request) (string, error) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || scheme != authorizationScheme {
+		return "", errors.New("missing authorization token")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed authorization token")
+	}
+	encodedIdentity, timestamp, encodedSignature := parts[0], parts[1], parts[2]
+	identity, err := base64.RawURLEncoding.DecodeString(encodedIdentity)
+	if err != nil {
+		return "", fmt.Errorf("malformed authorization token: %w", err)
+	}
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("malformed authorization token timestamp: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return "", fmt.Errorf("malformed authorization token: %w", err)
+	}
+	skew := h.now().Sub(time.Unix(signedAt, 0))
+	if skew > hmacTokenMaxSkew || skew < -hmacTokenMaxSkew {
+		return "", fmt.Errorf(
+			"authorization token timestamp is %s away from the server's clock, max: %s",
+			skew, hmacTokenMaxSkew)
+	}
+	body, err := bufferRequestBody(req)
+	if err != nil {
+		return "", err
+	}
+	expected := h.sign(string(identity), timestamp, req.Method, req.URL.Path, body)
+	if !hmac.Equal(signature, expected) {
+		return "", errors.New("invalid authorization token signature")
+	}
+	return string(identity), nil
+}
+
+func (h *hmacAuthenticator) sign(identity, timestamp, method, path string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, h.secret)
+	// Every field is length-prefixed so that the boundaries between them are unambiguous.
+	for _, field := range []string{identity, timestamp, method, path} {
+		mac.Write(binary.AppendUvarint(nil, uint64(len(field))))
+		mac.Write([]byte(field))
+	}
+	mac.Write(bodyHash[:])
+	return mac.Sum(nil)
+}
+
+// bufferRequestBody reads the body of req (up to maxHMACBodyBytes) and replaces it with
+// an in-memory copy so that it can still be read afterwards.
+func bufferRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxHMACBodyBytes+1))
+	req.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error reading request body: %w", err)
+	}
+	if len(body) > maxHMACBodyBytes {
+		return nil, fmt.Errorf("request body exceeds %d bytes", maxHMACBodyBytes)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// NewMTLSAuthenticator returns an Authenticator that identifies callers by the common
+// name of the client certificate that they presented when establishing a mutual TLS
+// connection. The server's tls.Config must verify client certificates (for example with
+// tls.RequireAndVerifyClientCert) since only verified certificates are accepted, and the
+// client's tls.Config must contain its certificate.
+func NewMTLSAuthenticator() Authenticator {
+	return mtlsAuthenticator{}
+}
+
+type mtlsAuthenticator struct{}
+
+func (mtlsAuthenticator) Attach(req *http.Request) error {
+	// The credentials are the client certificate, which is part of the TLS handshake.
+	return nil
+}
+
+func (mtlsAuthenticator) Authenticate(req *http.Request) (string, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "", errors.New("missing verified client certificate")
+	}
+	return req.TLS.VerifiedChains[0][0].Subject.CommonName, nil
+}
+
+type callerCtxKey struct{}
+
+// authenticate wraps handler so that requests are authenticated with the server's
+// Authenticator (if any) before they're handled. The identity of the caller is stored in
+// the request's context so handlers can authorize it with authorize.
+func (s *server) authenticate(handler http.HandlerFunc) http.HandlerFunc {
+	if s.opts.Authenticator == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := s.opts.Authenticator.Authenticate(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(fmt.Sprintf("error authenticating request: %v", err)))
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), callerCtxKey{}, caller)))
+	}
+}
+
+// authorize returns whether the caller of r is allowed to invoke the actors of
+// namespace. If not, it writes the error to w.
+func (s *server) authorize(w http.ResponseWriter, r *http.Request, namespace string) bool {
+	if s.opts.Authorize == nil {
+		return true
+	}
+	caller, _ := r.Context().Value(callerCtxKey{}).(string)
+	if err := s.opts.Authorize(r.Context(), caller, namespace); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf(
+			"caller: %s is not authorized for namespace: %s, err: %v", caller, namespace, err)))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,233 @@
+package virtual
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestAuthentication ensures that invocations are only dispatched if they're sent by
+// authenticated callers that are authorized for the namespace of the invoked actor.
+func TestAuthentication(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 30
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	for _, ns := range []string{"ns-1", "ns-2"} {
+		require.NoError(t, env.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: ns, ID: "test-module"}, testModule{}))
+	}
+
+	authorize := func(ctx context.Context, caller string, namespace string) error {
+		if caller == "node-a" && namespace == "ns-1" {
+			return nil
+		}
+		return fmt.Errorf("caller: %s is not allowed", caller)
+	}
+	vs, err := reg.GetVersionStamp(ctx)
+	require.NoError(t, err)
+	invoke := func(client RemoteClient, httpServer *httptest.Server, namespace string) error {
+		references, err := reg.EnsureActivation(
+			ctx, namespace, "a", "test-module", registry.EnsureActivationOptions{})
+		require.NoError(t, err)
+		ref, err := types.NewActorReference(
+			references[0].ServerID(), references[0].ServerVersion(),
+			strings.TrimPrefix(strings.TrimPrefix(httpServer.URL, "http://"), "https://"),
+			namespace, "test-module", "a", references[0].Generation())
+		require.NoError(t, err)
+
+		stream, err := client.InvokeActorRemote(ctx, vs, ref, "inc", nil, types.CreateIfNotExist{})
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadAll(stream)
+		require.NoError(t, err)
+		return stream.Close()
+	}
+
+	t.Run("hmac", func(t *testing.T) {
+		s := NewServerWithOptions(reg, env, ServerOptions{
+			Authenticator: NewHMACAuthenticator("server", []byte("secret")),
+			Authorize:     authorize,
+		})
+		httpServer := httptest.NewServer(s.authenticate(s.invokeDirect))
+		defer httpServer.Close()
+
+		client := NewHTTPClientWithOptions(HTTPClientOptions{
+			Authenticator: NewHMACAuthenticator("node-a", []byte("secret")),
+		})
+		require.NoError(t, invoke(client, httpServer, "ns-1"))
+		err := invoke(client, httpServer, "ns-2")
+		require.ErrorContains(t, err, "403")
+
+		for _, client := range []RemoteClient{
+			NewHTTPClient(),
+			NewHTTPClientWithOptions(HTTPClientOptions{
+				Authenticator: NewHMACAuthenticator("node-a", []byte("other-secret")),
+			}),
+		} {
+			err := invoke(client, httpServer, "ns-1")
+			require.ErrorContains(t, err, "401")
+		}
+	})
+
+	t.Run("hmac tokens", func(t *testing.T) {
+		var (
+			now       = time.Unix(time.Now().Unix(), 0)
+			caller    = NewHMACAuthenticator("node-a", []byte("secret")).(*hmacAuthenticator)
+			server    = NewHMACAuthenticator("server", []byte("secret")).(*hmacAuthenticator)
+			newSigned = func(path, body string) *http.Request {
+				req := httptest.NewRequest("POST", path, strings.NewReader(body))
+				require.NoError(t, caller.Attach(req))
+				return req
+			}
+		)
+		caller.now = func() time.Time { return now }
+		server.now = func() time.Time { return now }
+
+		req := newSigned("/api/v1/invoke-actor", "payload")
+		identity, err := server.Authenticate(req)
+		require.NoError(t, err)
+		require.Equal(t, "node-a", identity)
+		// The body can still be read by the handler.
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		require.Equal(t, "payload", string(body))
+
+		// The token is only valid for the request that it was attached to.
+		tampered := newSigned("/api/v1/invoke-actor", "payload")
+		tampered.Body = io.NopCloser(strings.NewReader("other-payload"))
+		_, err = server.Authenticate(tampered)
+		require.ErrorContains(t, err, "signature")
+		moved := newSigned("/api/v1/invoke-actor", "payload")
+		moved.URL.Path = "/api/v1/restore-actor-direct"
+		_, err = server.Authenticate(moved)
+		require.ErrorContains(t, err, "signature")
+		moved = newSigned("/api/v1/invoke-actor", "payload")
+		moved.Method = "PUT"
+		_, err = server.Authenticate(moved)
+		require.ErrorContains(t, err, "signature")
+
+		// Tokens are rejected outside of the window around the server's clock.
+		for _, c := range []struct {
+			skew  time.Duration
+			valid bool
+		}{
+			{skew: hmacTokenMaxSkew, valid: true},
+			{skew: -hmacTokenMaxSkew, valid: true},
+			{skew: hmacTokenMaxSkew + time.Second},
+			{skew: -hmacTokenMaxSkew - time.Second},
+		} {
+			req = newSigned("/api/v1/invoke-actor", "payload")
+			server.now = func() time.Time { return now.Add(c.skew) }
+			_, err = server.Authenticate(req)
+			if c.valid {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, "timestamp")
+			}
+		}
+	})
+
+	t.Run("mtls", func(t *testing.T) {
+		var (
+			ca         = newTestCA(t)
+			serverCert = ca.issue(t, "server")
+			pool       = x509.NewCertPool()
+		)
+		pool.AddCert(ca.cert)
+		serverTLS := &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		}
+		s := NewServerWithOptions(reg, env, ServerOptions{
+			TLSConfig:     serverTLS,
+			Authenticator: NewMTLSAuthenticator(),
+			Authorize:     authorize,
+		})
+		httpServer := httptest.NewUnstartedServer(s.authenticate(s.invokeDirect))
+		httpServer.TLS = serverTLS
+		httpServer.StartTLS()
+		defer httpServer.Close()
+
+		newClient := func(certs ...tls.Certificate) RemoteClient {
+			return NewHTTPClientWithOptions(HTTPClientOptions{
+				TLSConfig: &tls.Config{RootCAs: pool, Certificates: certs},
+				// Client certificates are verified during the handshake.
+				Authenticator: NewMTLSAuthenticator(),
+			})
+		}
+		require.NoError(t, invoke(newClient(ca.issue(t, "node-a")), httpServer, "ns-1"))
+		require.ErrorContains(t, invoke(newClient(ca.issue(t, "node-b")), httpServer, "ns-1"), "403")
+		// Clients without a certificate can't establish a connection.
+		require.Error(t, invoke(newClient(), httpServer, "ns-1"))
+	})
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return testCA{cert: cert, key: key}
+}
+
+// issue returns a certificate for commonName that is valid for both servers (on
+// 127.0.0.1) and clients.
+func (ca testCA) issue(t *testing.T, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,233 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/richardartoul/nola/virtual/registry/dnsregistry"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+// maxConcurrentBatchInvocations is the maximum number of invocations of a batch that a
+// server executes concurrently, as well as the maximum number of activations of a batch
+// that are ensured concurrently.
+const maxConcurrentBatchInvocations = 64
+
+// BatchInvocation is a single invocation of a batch (see Environment.InvokeActorBatch).
+type BatchInvocation struct {
+	ActorID          string                 `json:"actor_id"`
+	ModuleID         string                 `json:"module_id"`
+	Operation        string                 `json:"operation"`
+	Payload          []byte                 `json:"payload"`
+	CreateIfNotExist types.CreateIfNotExist `json:"create_if_not_exist"`
+}
+
+// DirectBatchInvocation is a single invocation of a batch that is performed directly
+// (see Environment.InvokeActorDirectBatch).
+type DirectBatchInvocation struct {
+	ServerVersion    int64
+	Reference        types.ActorReferenceVirtual
+	Operation        string
+	Payload          []byte
+	CreateIfNotExist types.CreateIfNotExist
+}
+
+// BatchInvocationResult is the result of a single invocation of a batch. Exactly one of
+// Result or Err will be set (unless the actor returned an empty result).
+type BatchInvocationResult struct {
+	Result []byte
+	Err    error
+}
+
+// batchTarget identifies the server that a sub-batch of invocations is forwarded to.
+type batchTarget struct {
+	serverID string
+	address  string
+}
+
+func (r *environment) InvokeActorBatch(
+	ctx context.Context,
+	namespace string,
+	invocations []BatchInvocation,
+) (_ []BatchInvocationResult, err error) {
+	ctx = withTracer(ctx, r.opts.Tracer)
+	ctx, span := startSpan(ctx, "nola.InvokeActorBatch", namespace, "", "")
+	defer func() {
+		span.end(err)
+	}()
+
+	if namespace == "" {
+		return nil, errors.New("InvokeActorBatch: namespace cannot be empty")
+	}
+
+	vs, err := r.registry.GetVersionStamp(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting version stamp: %w", err)
+	}
+
+	// Ensure all the activations first (which is cheap when they're cached) so that the
+	// invocations can be grouped by the server that they need to be forwarded to.
+	var (
+		results    = make([]BatchInvocationResult, len(invocations))
+		references = make([]types.ActorReference, len(invocations))
+	)
+	forEachConcurrently(len(invocations), maxConcurrentBatchInvocations, func(i int) {
+		inv := invocations[i]
+		if inv.ActorID == "" {
+			results[i].Err = newInvalidInvokeError(
+				errors.New("InvokeActorBatch: actorID cannot be empty"))
+			return
+		}
+		if inv.ModuleID == "" {
+			results[i].Err = newInvalidInvokeError(
+				errors.New("InvokeActorBatch: moduleID cannot be empty"))
+			return
+		}
+
+		actorID := types.NewNamespacedActorID(namespace, inv.ActorID, inv.ModuleID, types.IDTypeActor)
+		if err := r.handoffs.wait(ctx, actorID); err != nil {
+			results[i].Err = err
+			return
+		}
+		refs, err := r.activationsCache.ensureActivation(ctx, namespace, inv.ModuleID, inv.ActorID)
+		if err != nil {
+			results[i].Err = err
+			return
+		}
+		if len(refs) == 0 {
+			results[i].Err = newRoutingError(fmt.Errorf(
+				"ensureActivation() success with 0 references for actor ID: %s", inv.ActorID))
+			return
+		}
+		references[i] = refs[0]
+	})
+
+	var (
+		targets []batchTarget
+		groups  = make(map[batchTarget][]int)
+	)
+	for i, ref := range references {
+		if ref == nil {
+			continue
+		}
+		target := batchTarget{serverID: ref.ServerID(), address: ref.Address()}
+		if _, ok := groups[target]; !ok {
+			targets = append(targets, target)
+		}
+		groups[target] = append(groups[target], i)
+	}
+
+	// Forward one sub-batch per server.
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		var (
+			target  = target
+			indexes = groups[target]
+			batch   = make([]DirectBatchInvocation, 0, len(indexes))
+		)
+		for _, i := range indexes {
+			batch = append(batch, DirectBatchInvocation{
+				ServerVersion:    references[i].ServerVersion(),
+				Reference:        references[i],
+				Operation:        invocations[i].Operation,
+				Payload:          invocations[i].Payload,
+				CreateIfNotExist: invocations[i].CreateIfNotExist,
+			})
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			subResults, err := r.invokeDirectBatch(ctx, vs, target, batch)
+			if err == nil && len(subResults) != len(batch) {
+				err = fmt.Errorf(
+					"server: %s returned %d results for a batch of %d invocations",
+					target.serverID, len(subResults), len(batch))
+			}
+			for j, i := range indexes {
+				if err != nil {
+					results[i].Err = err
+				} else {
+					results[i] = subResults[j]
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range results {
+		results[i].Err = categorizeInvokeErr(results[i].Err)
+	}
+	return results, nil
+}
+
+// invokeDirectBatch forwards a sub-batch of invocations to the server that they were
+// routed to. It uses the same routing logic as invokeReferences.
+func (r *environment) invokeDirectBatch(
+	ctx context.Context,
+	versionStamp int64,
+	target batchTarget,
+	invocations []DirectBatchInvocation,
+) ([]BatchInvocationResult, error) {
+	if !r.opts.ForceRemoteProcedureCalls {
+		localEnvironmentsRouterLock.RLock()
+		localEnv, ok := localEnvironmentsRouter[target.address]
+		localEnvironmentsRouterLock.RUnlock()
+		if ok {
+			return localEnv.InvokeActorDirectBatch(ctx, versionStamp, target.serverID, invocations), nil
+		}
+
+		if target.address == Localhost || target.address == dnsregistry.Localhost {
+			return r.InvokeActorDirectBatch(ctx, versionStamp, target.serverID, invocations), nil
+		}
+	}
+
+	ctx = withCompression(ctx, r.opts.Compression)
+	return r.client.InvokeActorDirectBatchRemote(
+		ctx, versionStamp, target.serverID, target.address, invocations)
+}
+
+func (r *environment) InvokeActorDirectBatch(
+	ctx context.Context,
+	versionStamp int64,
+	serverID string,
+	invocations []DirectBatchInvocation,
+) []BatchInvocationResult {
+	results := make([]BatchInvocationResult, len(invocations))
+	forEachConcurrently(len(invocations), maxConcurrentBatchInvocations, func(i int) {
+		inv := invocations[i]
+		results[i].Result, results[i].Err = r.InvokeActorDirect(
+			ctx, versionStamp, serverID, inv.ServerVersion, inv.Reference,
+			inv.Operation, inv.Payload, inv.CreateIfNotExist)
+	})
+	return results
+}
+
+// forEachConcurrently calls fn for every index in [0, n) using at most concurrency
+// goroutines and returns once all the calls have returned.
+func forEachConcurrently(n, concurrency int, fn func(i int)) {
+	if n < concurrency {
+		concurrency = n
+	}
+
+	var (
+		wg        sync.WaitGroup
+		indexesCh = make(chan int)
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexesCh {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexesCh <- i
+	}
+	close(indexesCh)
+	wg.Wait()
+}
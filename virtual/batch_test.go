@@ -0,0 +1,149 @@
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestInvokeActorBatch ensures that batches are split across the servers that the actors
+// are activated on and that errors are reported per-invocation.
+func TestInvokeActorBatch(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+		id  = types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}
+	)
+	opts1 := defaultOptsGoByte
+	opts1.Discovery.Port = 23
+	env1, err := NewEnvironment(ctx, "serverID1", reg, nil, opts1)
+	require.NoError(t, err)
+	defer env1.Close()
+	require.NoError(t, env1.RegisterGoModule(id, testModule{}))
+
+	opts2 := defaultOptsGoByte
+	opts2.Discovery.Port = 24
+	env2, err := NewEnvironment(ctx, "serverID2", reg, nil, opts2)
+	require.NoError(t, err)
+	defer env2.Close()
+	require.NoError(t, env2.RegisterGoModule(id, testModule{}))
+
+	var invocations []BatchInvocation
+	for i := 0; i < 20; i++ {
+		invocations = append(invocations, BatchInvocation{
+			ActorID:   fmt.Sprintf("actor-%d", i),
+			ModuleID:  "test-module",
+			Operation: "inc",
+		})
+	}
+	for _, expected := range []int64{1, 2} {
+		results, err := env1.InvokeActorBatch(ctx, "ns-1", invocations)
+		require.NoError(t, err)
+		require.Len(t, results, len(invocations))
+		for _, result := range results {
+			require.NoError(t, result.Err)
+			require.Equal(t, expected, getCount(t, result.Result))
+		}
+	}
+	require.Equal(t, len(invocations), env1.numActivatedActors()+env2.numActivatedActors())
+
+	// Failures are reported per-invocation.
+	results, err := env2.InvokeActorBatch(ctx, "ns-1", []BatchInvocation{
+		{ActorID: "actor-0", ModuleID: "test-module", Operation: "inc"},
+		{ActorID: "actor-1", ModuleID: "test-module", Operation: "does-not-exist"},
+		{ActorID: "actor-2", Operation: "inc"},
+		{ActorID: "actor-3", ModuleID: "does-not-exist", Operation: "inc"},
+		{ActorID: "actor-2", ModuleID: "test-module", Operation: "inc"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, results[0].Err)
+	require.Equal(t, int64(3), getCount(t, results[0].Result))
+	require.ErrorContains(t, results[1].Err, "unhandled operation")
+	require.ErrorContains(t, results[2].Err, "moduleID cannot be empty")
+	require.Error(t, results[3].Err)
+	require.NoError(t, results[4].Err)
+	require.Equal(t, int64(3), getCount(t, results[4].Result))
+
+	_, err = env1.InvokeActorBatch(ctx, "", invocations)
+	require.Error(t, err)
+	results, err = env1.InvokeActorBatch(ctx, "ns-1", nil)
+	require.NoError(t, err)
+	require.Empty(t, results)
+}
+
+// TestInvokeActorBatchHTTP ensures that batches can be submitted and forwarded over HTTP.
+func TestInvokeActorBatchHTTP(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 25
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	s := NewServer(reg, env)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/invoke-actor-batch", s.invokeBatch)
+	mux.HandleFunc("/api/v1/invoke-actor-direct-batch", s.invokeDirectBatch)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	// Submit a batch to the public endpoint.
+	marshaled, err := json.Marshal(invokeActorBatchRequest{
+		Namespace: "ns-1",
+		Invocations: []BatchInvocation{
+			{ActorID: "a", ModuleID: "test-module", Operation: "inc"},
+			{ActorID: "b", ModuleID: "test-module", Operation: "does-not-exist"},
+		},
+	})
+	require.NoError(t, err)
+	resp, err := http.Post(
+		httpServer.URL+"/api/v1/invoke-actor-batch", "application/json", bytes.NewReader(marshaled))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var batchResp invokeActorBatchResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&batchResp))
+	results := batchResp.results()
+	require.Len(t, results, 2)
+	require.NoError(t, results[0].Err)
+	require.Equal(t, int64(1), getCount(t, results[0].Result))
+	require.ErrorContains(t, results[1].Err, "unhandled operation")
+
+	// Forward a sub-batch to the direct endpoint.
+	references, err := reg.EnsureActivation(ctx, "ns-1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	vs, err := reg.GetVersionStamp(ctx)
+	require.NoError(t, err)
+	results, err = NewHTTPClient().InvokeActorDirectBatchRemote(
+		ctx, vs, references[0].ServerID(), strings.TrimPrefix(httpServer.URL, "http://"),
+		[]DirectBatchInvocation{
+			{ServerVersion: references[0].ServerVersion(), Reference: references[0], Operation: "inc"},
+			{ServerVersion: references[0].ServerVersion() + 1, Reference: references[0], Operation: "inc"},
+		})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.NoError(t, results[0].Err)
+	require.Equal(t, int64(2), getCount(t, results[0].Result))
+	require.ErrorContains(t, results[1].Err, "server version")
+
+	// Sub-batches that can't be executed at all fail entirely.
+	_, err = NewHTTPClient().InvokeActorDirectBatchRemote(
+		ctx, vs, references[0].ServerID(), "127.0.0.1:1", nil)
+	require.Error(t, err)
+}
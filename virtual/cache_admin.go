@@ -0,0 +1,224 @@
+package virtual
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+// cacheAdminPathPrefix is the prefix of the paths of the activation cache admin API (see
+// ServerOptions.EnableCacheAdminAPI).
+const cacheAdminPathPrefix = "/api/v1/cache/"
+
+// cacheAdmin is implemented by environments whose activation cache can be inspected and
+// flushed through the admin API.
+type cacheAdmin interface {
+	inspectActivationCache(namespace, moduleID, actorID string) (cacheEntryStatus, bool)
+	flushActivationCache(namespace, moduleID, actorID string)
+	activationCacheMetrics() cacheStatsResponse
+}
+
+// cacheEntryStatus is the decoded activation cache entry of an actor.
+type cacheEntryStatus struct {
+	Namespace  string                `json:"namespace"`
+	ModuleID   string                `json:"module_id"`
+	ActorID    string                `json:"actor_id"`
+	References []cacheEntryReference `json:"references"`
+	// Err is the (negatively cached) error that the registry returned, if any.
+	Err                  string    `json:"error,omitempty"`
+	CachedAt             time.Time `json:"cached_at"`
+	Age                  string    `json:"age"`
+	RegistryVersionStamp int64     `json:"registry_version_stamp"`
+	// Cost is the cost of the entry (see ActivationsCacheOptions.ModuleCosts).
+	Cost int64 `json:"cost"`
+	// Stale indicates whether the entry is older than the ideal cache staleness, so the
+	// next lookup refreshes it.
+	Stale bool `json:"stale"`
+	// Expired indicates whether the entry is older than MaxCacheAge (or the lease of one
+	// of its references), so the next lookup treats it as a miss.
+	Expired bool `json:"expired"`
+}
+
+// cacheEntryReference is a reference in a cacheEntryStatus.
+type cacheEntryReference struct {
+	ServerID           string                `json:"server_id"`
+	ServerVersion      int64                 `json:"server_version"`
+	Address            string                `json:"address"`
+	Generation         uint64                `json:"generation"`
+	LeaseDuration      string                `json:"lease_duration,omitempty"`
+	FailoverCandidates []cacheEntryReference `json:"failover_candidates,omitempty"`
+}
+
+func newCacheEntryReference(ref types.ActorReference) cacheEntryReference {
+	r := cacheEntryReference{
+		ServerID:      ref.ServerID(),
+		ServerVersion: ref.ServerVersion(),
+		Address:       ref.Address(),
+		Generation:    ref.Generation(),
+	}
+	if lease := ref.Lease(); !lease.IsZero() {
+		r.LeaseDuration = lease.Duration.String()
+	}
+	for _, candidate := range ref.FailoverCandidates() {
+		r.FailoverCandidates = append(r.FailoverCandidates, newCacheEntryReference(candidate))
+	}
+	return r
+}
+
+// cacheStatsResponse contains the statistics of the activation cache, including the raw
+// metrics of the underlying ristretto cache.
+type cacheStatsResponse struct {
+	Stats     ActivationCacheStats `json:"stats"`
+	Ristretto ristrettoMetrics     `json:"ristretto"`
+}
+
+type ristrettoMetrics struct {
+	Hits         uint64  `json:"hits"`
+	Misses       uint64  `json:"misses"`
+	Ratio        float64 `json:"ratio"`
+	KeysAdded    uint64  `json:"keys_added"`
+	KeysUpdated  uint64  `json:"keys_updated"`
+	KeysEvicted  uint64  `json:"keys_evicted"`
+	CostAdded    uint64  `json:"cost_added"`
+	CostEvicted  uint64  `json:"cost_evicted"`
+	SetsDropped  uint64  `json:"sets_dropped"`
+	SetsRejected uint64  `json:"sets_rejected"`
+	GetsDropped  uint64  `json:"gets_dropped"`
+	GetsKept     uint64  `json:"gets_kept"`
+}
+
+// inspect returns the decoded cache entry of the actor, if any. Unlike get, it returns
+// entries that would be treated as a miss so that they can be debugged.
+func (a *activationsCache) inspect(namespace, moduleID, actorID string) (cacheEntryStatus, bool) {
+	aceI, ok := a.c.Get(formatActorCacheKey(nil, namespace, moduleID, actorID))
+	if !ok {
+		return cacheEntryStatus{}, false
+	}
+	ace := aceI.(activationCacheEntry)
+
+	status := cacheEntryStatus{
+		Namespace:            namespace,
+		ModuleID:             moduleID,
+		ActorID:              actorID,
+		References:           []cacheEntryReference{},
+		CachedAt:             ace.cachedAt,
+		Age:                  a.clock.Now().Sub(ace.cachedAt).String(),
+		RegistryVersionStamp: ace.registryVersionStamp,
+		Cost:                 a.entryCost(ace),
+		Stale:                a.isStale(namespace, ace),
+		Expired:              a.isExpired(ace),
+	}
+	if ace.err != nil {
+		status.Err = ace.err.Error()
+	}
+	for _, ref := range ace.references {
+		status.References = append(status.References, newCacheEntryReference(ref))
+	}
+	return status, true
+}
+
+func (a *activationsCache) metrics() cacheStatsResponse {
+	m := a.c.Metrics
+	return cacheStatsResponse{
+		Stats: a.stats(),
+		Ristretto: ristrettoMetrics{
+			Hits:         m.Hits(),
+			Misses:       m.Misses(),
+			Ratio:        m.Ratio(),
+			KeysAdded:    m.KeysAdded(),
+			KeysUpdated:  m.KeysUpdated(),
+			KeysEvicted:  m.KeysEvicted(),
+			CostAdded:    m.CostAdded(),
+			CostEvicted:  m.CostEvicted(),
+			SetsDropped:  m.SetsDropped(),
+			SetsRejected: m.SetsRejected(),
+			GetsDropped:  m.GetsDropped(),
+			GetsKept:     m.GetsKept(),
+		},
+	}
+}
+
+func (r *environment) inspectActivationCache(
+	namespace, moduleID, actorID string,
+) (cacheEntryStatus, bool) {
+	return r.activationsCache.inspect(namespace, moduleID, actorID)
+}
+
+func (r *environment) flushActivationCache(namespace, moduleID, actorID string) {
+	r.activationsCache.delete(namespace, moduleID, actorID)
+}
+
+func (r *environment) activationCacheMetrics() cacheStatsResponse {
+	return r.activationsCache.metrics()
+}
+
+// cacheStats serves the statistics of the activation cache.
+func (s *server) cacheStats(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.environment.(cacheAdmin)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("environment does not support the cache admin API"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeCacheAdminResponse(w, admin.activationCacheMetrics())
+}
+
+// cacheEntry serves the cache entry of the actor that is identified by the
+// /{namespace}/{module}/{actor} suffix of the path on GET, and removes it from the cache
+// on DELETE.
+func (s *server) cacheEntry(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.environment.(cacheAdmin)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("environment does not support the cache admin API"))
+		return
+	}
+
+	// Actor IDs may contain slashes, namespaces and module IDs may not.
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, cacheAdminPathPrefix), "/", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("path must be: " + cacheAdminPathPrefix + "{namespace}/{module}/{actor}"))
+		return
+	}
+	namespace, moduleID, actorID := parts[0], parts[1], parts[2]
+	if !s.authorize(w, r, namespace) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		status, ok := admin.inspectActivationCache(namespace, moduleID, actorID)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("actor is not cached"))
+			return
+		}
+		writeCacheAdminResponse(w, status)
+	case http.MethodDelete:
+		admin.flushActivationCache(namespace, moduleID, actorID)
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeCacheAdminResponse(w http.ResponseWriter, v any) {
+	marshaled, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(marshaled)
+}
@@ -0,0 +1,75 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestCacheAdminAPI ensures that the activation cache entries of actors can be inspected
+// and flushed through the admin API.
+func TestCacheAdminAPI(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 45
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	_, err = env.InvokeActor(ctx, "ns-1", "a/b", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	env.(*environment).activationsCache.c.Wait()
+
+	s := NewServer(reg, env)
+	entryServer := httptest.NewServer(http.HandlerFunc(s.cacheEntry))
+	defer entryServer.Close()
+	statsServer := httptest.NewServer(http.HandlerFunc(s.cacheStats))
+	defer statsServer.Close()
+
+	do := func(method, path string) *http.Response {
+		req, err := http.NewRequest(method, entryServer.URL+cacheAdminPathPrefix+path, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := do(http.MethodGet, "ns-1/test-module/a/b")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var status cacheEntryStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	require.Equal(t, "a/b", status.ActorID)
+	require.Len(t, status.References, 1)
+	require.Equal(t, "serverID1", status.References[0].ServerID)
+	require.Greater(t, status.RegistryVersionStamp, int64(0))
+	require.False(t, status.Expired)
+
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "ns-1/test-module/other").StatusCode)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodGet, "ns-1/test-module").StatusCode)
+	require.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPost, "ns-1/test-module/a/b").StatusCode)
+
+	require.Equal(t, http.StatusOK, do(http.MethodDelete, "ns-1/test-module/a/b").StatusCode)
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "ns-1/test-module/a/b").StatusCode)
+
+	resp, err = http.Get(statsServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var stats cacheStatsResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	require.Greater(t, stats.Ristretto.KeysAdded, uint64(0))
+	require.Greater(t, stats.Ristretto.Hits, uint64(0))
+}
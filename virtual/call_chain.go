@@ -0,0 +1,111 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const (
+	// defaultMaxInvocationDepth is the default value for
+	// EnvironmentOptions.MaxInvocationDepth.
+	defaultMaxInvocationDepth = 16
+
+	callDepthHeader       = "X-Nola-Call-Depth"
+	callerNamespaceHeader = "X-Nola-Caller-Namespace"
+	callerModuleIDHeader  = "X-Nola-Caller-Module-ID"
+	callerActorIDHeader   = "X-Nola-Caller-Actor-ID"
+)
+
+var errMaxInvocationDepthExceeded = errors.New("maximum actor invocation depth exceeded")
+
+// IsMaxInvocationDepthExceededErr returns a boolean indicating whether the error is
+// caused by a chain of actor-to-actor invocations that is deeper than
+// EnvironmentOptions.MaxInvocationDepth.
+func IsMaxInvocationDepthExceededErr(err error) bool {
+	return errors.Is(err, errMaxInvocationDepthExceeded)
+}
+
+// Caller identifies the actor that invoked the current invocation.
+type Caller struct {
+	Namespace string
+	ModuleID  string
+	ActorID   string
+}
+
+// callChain is stored in the context of invocations that were made by other actors.
+type callChain struct {
+	// depth is the number of actor-to-actor invocations that led to the current
+	// invocation.
+	depth  int
+	caller Caller
+}
+
+type callChainCtxKey struct{}
+
+// CallerFromContext returns the actor that invoked the current invocation if it was
+// invoked by another actor (as opposed to an external client), so that actors can
+// decide which other actors are allowed to invoke them. It works even if the caller
+// is running on a different server.
+func CallerFromContext(ctx context.Context) (Caller, bool) {
+	cc, ok := ctx.Value(callChainCtxKey{}).(callChain)
+	return cc.caller, ok
+}
+
+// withCaller returns the context that should be used by caller to invoke another actor
+// from within an invocation with context ctx. It returns an error if the invocation
+// would make the chain of actor-to-actor invocations deeper than maxDepth.
+func withCaller(
+	ctx context.Context,
+	caller types.ActorReferenceVirtual,
+	maxDepth int,
+) (context.Context, error) {
+	cc, _ := ctx.Value(callChainCtxKey{}).(callChain)
+	depth := cc.depth + 1
+	if depth > maxDepth {
+		return nil, fmt.Errorf(
+			"actor: %s can't invoke another actor at depth: %d, max: %d: %w",
+			caller.ActorID(), depth, maxDepth, errMaxInvocationDepthExceeded)
+	}
+	return context.WithValue(ctx, callChainCtxKey{}, callChain{
+		depth: depth,
+		caller: Caller{
+			Namespace: caller.Namespace(),
+			ModuleID:  caller.ModuleID().ID,
+			ActorID:   caller.ActorID().ID,
+		},
+	}), nil
+}
+
+// injectCallChain injects the call chain in ctx (if any) into the headers of an outgoing
+// request so that it is preserved when the invocation is forwarded to another server.
+func injectCallChain(ctx context.Context, header http.Header) {
+	cc, ok := ctx.Value(callChainCtxKey{}).(callChain)
+	if !ok {
+		return
+	}
+	header.Set(callDepthHeader, strconv.Itoa(cc.depth))
+	header.Set(callerNamespaceHeader, cc.caller.Namespace)
+	header.Set(callerModuleIDHeader, cc.caller.ModuleID)
+	header.Set(callerActorIDHeader, cc.caller.ActorID)
+}
+
+// extractCallChain is the inverse of injectCallChain.
+func extractCallChain(ctx context.Context, header http.Header) context.Context {
+	depth, err := strconv.Atoi(header.Get(callDepthHeader))
+	if err != nil || depth <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, callChainCtxKey{}, callChain{
+		depth: depth,
+		caller: Caller{
+			Namespace: header.Get(callerNamespaceHeader),
+			ModuleID:  header.Get(callerModuleIDHeader),
+			ActorID:   header.Get(callerActorIDHeader),
+		},
+	})
+}
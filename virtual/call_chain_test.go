@@ -0,0 +1,136 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestActorToActorInvocation ensures that WASM actors can invoke actors in other
+// namespaces, that the invoked actor can identify its caller, and that chains of
+// actor-to-actor invocations are bounded by MaxInvocationDepth.
+func TestActorToActorInvocation(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsWASM
+	opts.Discovery.Port = 15
+	opts.MaxInvocationDepth = 2
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	_, err = reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-2", ID: "caller-module"}, testCallerModule{}))
+
+	// invokeActorReq returns the payload for the util module's invokeActor operation,
+	// which passes it straight through to the INVOKE-ACTOR host function.
+	invokeActorReq := func(namespace, moduleID, actorID, operation string, payload []byte) []byte {
+		marshaled, err := json.Marshal(types.InvokeActorRequest{
+			Namespace: namespace,
+			ModuleID:  moduleID,
+			ActorID:   actorID,
+			Operation: operation,
+			Payload:   payload,
+		})
+		require.NoError(t, err)
+		return marshaled
+	}
+	getCaller := invokeActorReq("ns-2", "caller-module", "x", "getCaller", nil)
+
+	// Invocations that don't come from an actor have no caller.
+	result, err := env.InvokeActor(
+		ctx, "ns-2", "x", "caller-module", "getCaller", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, "", string(result))
+
+	// a -> x.
+	result, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "invokeActor", getCaller, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, "ns-1/test-module/a", string(result))
+
+	// a -> b -> x. The namespace defaults to the caller's.
+	result, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "invokeActor",
+		invokeActorReq("", "test-module", "b", "invokeActor", getCaller),
+		types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, "ns-1/test-module/b", string(result))
+
+	// a -> b -> c -> x exceeds the max depth.
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "invokeActor",
+		invokeActorReq("", "test-module", "b", "invokeActor",
+			invokeActorReq("", "test-module", "c", "invokeActor", getCaller)),
+		types.CreateIfNotExist{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), errMaxInvocationDepthExceeded.Error())
+
+	// The call chain is preserved when invocations are forwarded to other servers.
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+	callerCtx, err := withCaller(ctx, ref, 2)
+	require.NoError(t, err)
+	header := http.Header{}
+	injectCallChain(callerCtx, header)
+	caller, ok := CallerFromContext(extractCallChain(ctx, header))
+	require.True(t, ok)
+	require.Equal(t, Caller{Namespace: "ns-1", ModuleID: "test-module", ActorID: "a"}, caller)
+	_, err = withCaller(extractCallChain(ctx, header), ref, 1)
+	require.True(t, IsMaxInvocationDepthExceededErr(err))
+}
+
+type testCallerModule struct{}
+
+func (tm testCallerModule) Instantiate(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	payload []byte,
+	host HostCapabilities,
+) (Actor, error) {
+	return testCallerActor{}, nil
+}
+
+func (tm testCallerModule) Close(ctx context.Context) error {
+	return nil
+}
+
+// testCallerActor returns the identity of the actor that invoked it.
+type testCallerActor struct{}
+
+func (ta testCallerActor) Invoke(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+	transaction registry.ActorKVTransaction,
+) ([]byte, error) {
+	switch operation {
+	case wapcutils.StartupOperationName, wapcutils.ShutdownOperationName:
+		return nil, nil
+	case "getCaller":
+		caller, ok := CallerFromContext(ctx)
+		if !ok {
+			return nil, nil
+		}
+		return []byte(fmt.Sprintf("%s/%s/%s", caller.Namespace, caller.ModuleID, caller.ActorID)), nil
+	default:
+		return nil, fmt.Errorf("testCallerActor: unhandled operation: %s", operation)
+	}
+}
+
+func (ta testCallerActor) Close(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,50 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+var errServerAtCapacity = errors.New("server is at capacity")
+
+// IsServerAtCapacityErr returns a boolean indicating whether the error is an instance of
+// (or wraps) errServerAtCapacity, which indicates that the server that an actor was
+// placed on refused to activate it because it already hosts
+// EnvironmentOptions.MaxActivations actors.
+func IsServerAtCapacityErr(err error) bool {
+	return errors.Is(err, errServerAtCapacity)
+}
+
+// rerouteFromServerAtCapacity invokes the actor on a server other than serverID, which
+// refused to activate it because it was at capacity. The registry may have placed the
+// actor there before it learned that the server was at capacity from its heartbeats.
+func (r *environment) rerouteFromServerAtCapacity(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorID string,
+	serverID string,
+	operation string,
+	payload []byte,
+	create types.CreateIfNotExist,
+) (io.ReadCloser, error) {
+	vs, err := r.registry.GetVersionStamp(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting version stamp: %w", err)
+	}
+	references, err := r.activationsCache.ensureActivationExcluding(
+		ctx, namespace, moduleID, actorID, serverID)
+	if err != nil {
+		return nil, err
+	}
+	if len(references) == 0 {
+		return nil, newRoutingError(fmt.Errorf(
+			"ensureActivation() success with 0 references for actor ID: %s", actorID))
+	}
+
+	return r.invokeReferences(ctx, vs, references, operation, payload, create)
+}
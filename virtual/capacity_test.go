@@ -0,0 +1,66 @@
+package virtual
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMaxActivations ensures that servers don't host more than MaxActivations actors,
+// even when the registry places actors on them before it learns that they're at
+// capacity, and that the invocations of those actors are rerouted to other servers.
+func TestMaxActivations(t *testing.T) {
+	ctx := context.Background()
+	reg, err := localregistry.NewLocalRegistryWithOptions(registry.KVRegistryOptions{
+		PlacementStrategy: registry.PlacementStrategyLeastLoaded,
+	})
+	require.NoError(t, err)
+
+	// The registry prefers serverID1 until it heartbeats that it's at capacity.
+	opts1 := defaultOptsGoByte
+	opts1.Discovery.Port = 40
+	opts1.MaxActivations = 1
+	opts1.ServerLoad = func() float64 { return 0 }
+	env1, err := NewEnvironment(ctx, "serverID1", reg, nil, opts1)
+	require.NoError(t, err)
+	defer env1.Close()
+	opts2 := defaultOptsGoByte
+	opts2.Discovery.Port = 41
+	opts2.ServerLoad = func() float64 { return 1 }
+	env2, err := NewEnvironment(ctx, "serverID2", reg, nil, opts2)
+	require.NoError(t, err)
+	defer env2.Close()
+
+	for _, env := range []Environment{env1, env2} {
+		require.NoError(t, env.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+	}
+
+	for i := 0; i < 5; i++ {
+		result, err := env1.InvokeActor(
+			ctx, "ns-1", fmt.Sprintf("a-%d", i), "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		require.Equal(t, int64(1), getCount(t, result))
+	}
+
+	stats1 := env1.ActivationStats()
+	require.Equal(t, 1, stats1.NumActivatedActors)
+	require.Equal(t, 1, stats1.MaxActivations)
+	require.Equal(t, float64(1), stats1.Utilization)
+	require.Greater(t, stats1.CapacityRejections, uint64(0))
+	require.Equal(t, 4, env2.ActivationStats().NumActivatedActors)
+
+	// Once the registry knows that serverID1 is at capacity new actors are placed
+	// elsewhere without being rejected first.
+	require.NoError(t, env1.heartbeat())
+	_, err = env1.InvokeActor(ctx, "ns-1", "b", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, stats1.CapacityRejections, env1.ActivationStats().CapacityRejections)
+	require.Equal(t, 5, env2.ActivationStats().NumActivatedActors)
+}
@@ -0,0 +1,125 @@
+package virtual
+
+import (
+	"sync"
+	"time"
+)
+
+type circuitBreakerState int
+
+const (
+	// circuitBreakerClosed is the normal state in which all calls are allowed.
+	circuitBreakerClosed circuitBreakerState = iota
+	// circuitBreakerOpen is the state in which all calls are rejected until the
+	// cooldown has elapsed.
+	circuitBreakerOpen
+	// circuitBreakerHalfOpen is the state in which a single probe call is allowed to
+	// determine whether the breaker should close again or go back to being open.
+	circuitBreakerHalfOpen
+)
+
+// circuitBreaker keeps track of consecutive failures of calls to a dependency (the
+// registry) and "opens" once there are too many of them so that callers fail fast
+// instead of piling more load onto an unhealthy dependency. Once the cooldown has
+// elapsed the breaker becomes "half-open" and lets a single probe call through: if it
+// succeeds the breaker closes again, otherwise it reopens for another cooldown.
+//
+// Every call to allow() that returns true must be followed by exactly one call to
+// record() with the outcome of the call, or to skip() if the call was never made.
+type circuitBreaker struct {
+	sync.Mutex
+
+	// Configuration.
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	// State.
+	state               circuitBreakerState
+	consecutiveFailures int
+	openedAt            time.Time
+	probeInFlight       bool
+}
+
+func newCircuitBreaker(
+	threshold int,
+	cooldown time.Duration,
+	now func() time.Time,
+) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       now,
+	}
+}
+
+// allow returns whether a call should be made.
+func (b *circuitBreaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case circuitBreakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = circuitBreakerHalfOpen
+		b.probeInFlight = true
+		return true
+	case circuitBreakerHalfOpen:
+		if b.probeInFlight {
+			return false
+		}
+		b.probeInFlight = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record records the outcome of a call that was allowed by allow().
+func (b *circuitBreaker) record(success bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state == circuitBreakerHalfOpen {
+		b.probeInFlight = false
+		if success {
+			b.state = circuitBreakerClosed
+			b.consecutiveFailures = 0
+		} else {
+			b.open()
+		}
+		return
+	}
+
+	if success {
+		b.consecutiveFailures = 0
+		return
+	}
+	b.consecutiveFailures++
+	if b.state == circuitBreakerClosed && b.consecutiveFailures >= b.threshold {
+		b.open()
+	}
+}
+
+// skip must be called instead of record() when a call that was allowed by allow() ended
+// up not being made, so that it doesn't count as a probe.
+func (b *circuitBreaker) skip() {
+	b.Lock()
+	defer b.Unlock()
+	if b.state == circuitBreakerHalfOpen {
+		b.probeInFlight = false
+	}
+}
+
+func (b *circuitBreaker) open() {
+	b.state = circuitBreakerOpen
+	b.openedAt = b.now()
+}
+
+func (b *circuitBreaker) getState() circuitBreakerState {
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
@@ -0,0 +1,276 @@
+// Package client contains a client for invoking actors from processes that don't run a
+// NOLA environment themselves, like API servers or batch jobs.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+
+	"github.com/richardartoul/nola/virtual"
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const (
+	defaultActivationCacheTTL   = registry.HeartbeatTTL
+	defaultMaxCachedActivations = 1e5
+)
+
+// Options contains the options for creating a Client. Exactly one of Registry or
+// SeedAddress must be set.
+type Options struct {
+	// Registry is the registry that the servers of the cluster use. If set, the client
+	// looks up (and ensures) the activation of every actor in the registry and invokes it
+	// directly on the server that hosts it, the same way the servers route invocations
+	// between themselves. Use a dnsregistry to discover the servers through DNS.
+	Registry registry.Registry
+	// SeedAddress is the address (host:port) of a server of the cluster. If set, the
+	// client sends every invocation to it and it routes them to the servers that host
+	// the actors. This is simpler to deploy since the client doesn't need access to the
+	// registry, but it costs an extra hop for actors that the seed doesn't host.
+	SeedAddress string
+	// HTTP contains the options for the HTTP client that is used to connect to the
+	// servers. Connections are kept alive and reused across invocations of the same
+	// server.
+	HTTP virtual.HTTPClientOptions
+
+	// ActivationCacheTTL is how long the activations looked up in Registry are cached
+	// before they're looked up again. Activations are also evicted from the cache when an
+	// invocation of the actor fails.
+	//
+	// A value of 0 will be ignored and replaced with the default value of
+	// registry.HeartbeatTTL.
+	ActivationCacheTTL time.Duration
+	// MaxCachedActivations is the maximum number of activations that are cached.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 100,000.
+	MaxCachedActivations int
+}
+
+func (o *Options) Validate() error {
+	if o.Registry == nil && o.SeedAddress == "" {
+		return errors.New("one of Registry or SeedAddress must be set")
+	}
+	if o.Registry != nil && o.SeedAddress != "" {
+		return errors.New("only one of Registry or SeedAddress can be set")
+	}
+	if o.ActivationCacheTTL < 0 {
+		return errors.New("ActivationCacheTTL must be >= 0")
+	}
+	if o.MaxCachedActivations < 0 {
+		return errors.New("MaxCachedActivations must be >= 0")
+	}
+	return nil
+}
+
+// Stats contains statistics about the activation cache of a Client.
+type Stats struct {
+	// CacheHits is the number of invocations whose activation was cached.
+	CacheHits uint64
+	// CacheMisses is the number of invocations whose activation was looked up in the
+	// registry.
+	CacheMisses uint64
+	// Retries is the number of invocations that were retried after their cached
+	// activation turned out to be stale.
+	Retries uint64
+}
+
+// Client invokes actors in a NOLA cluster. It's safe for concurrent use.
+type Client struct {
+	opts   Options
+	remote virtual.RemoteClient
+	// cache contains the cachedActivation of actors by actor key. It's nil when
+	// opts.Registry is not set.
+	cache *ristretto.Cache
+
+	cacheHits   atomic.Uint64
+	cacheMisses atomic.Uint64
+	retries     atomic.Uint64
+}
+
+type cachedActivation struct {
+	references   []types.ActorReference
+	versionStamp int64
+}
+
+// New creates a new Client.
+func New(opts Options) (*Client, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("client: error validating options: %w", err)
+	}
+	if opts.ActivationCacheTTL == 0 {
+		opts.ActivationCacheTTL = defaultActivationCacheTTL
+	}
+	if opts.MaxCachedActivations == 0 {
+		opts.MaxCachedActivations = defaultMaxCachedActivations
+	}
+
+	c := &Client{
+		opts:   opts,
+		remote: virtual.NewHTTPClientWithOptions(opts.HTTP),
+	}
+	if opts.Registry != nil {
+		cache, err := ristretto.NewCache(&ristretto.Config{
+			NumCounters: int64(opts.MaxCachedActivations) * 10, // * 10 per the docs.
+			// Every entry has a cost of 1 so this is the maximum number of activations.
+			MaxCost:            int64(opts.MaxCachedActivations),
+			IgnoreInternalCost: true,
+			// Recommended default.
+			BufferItems: 64,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("client: error creating ristretto cache: %w", err)
+		}
+		c.cache = cache
+	}
+	return c, nil
+}
+
+// Invoke invokes operation on the actor with the provided payload and returns the result,
+// creating the actor if it doesn't exist yet.
+//
+// Invocations that fail because the cached activation of the actor is stale (for example
+// because the actor moved to another server) are retried once with a fresh activation.
+func (c *Client) Invoke(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorID string,
+	operation string,
+	payload []byte,
+) ([]byte, error) {
+	if c.cache == nil {
+		reader, err := c.remote.(virtual.RoutingClient).InvokeActorRouted(
+			ctx, c.opts.SeedAddress, namespace, actorID, moduleID, operation, payload,
+			types.CreateIfNotExist{})
+		if err != nil {
+			return nil, err
+		}
+		return readAll(reader)
+	}
+
+	result, cached, err := c.invokeDirect(ctx, namespace, moduleID, actorID, operation, payload)
+	if err == nil || !cached {
+		return result, err
+	}
+	if invokeErr, ok := virtual.AsInvokeError(err); !ok || !invokeErr.Category.Retryable() {
+		return nil, err
+	}
+	c.retries.Add(1)
+	result, _, err = c.invokeDirect(ctx, namespace, moduleID, actorID, operation, payload)
+	return result, err
+}
+
+// invokeDirect invokes the actor on the server that hosts it according to its (possibly
+// cached) activation, and returns whether the activation was cached. The activation is
+// evicted from the cache if the invocation fails.
+func (c *Client) invokeDirect(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorID string,
+	operation string,
+	payload []byte,
+) ([]byte, bool, error) {
+	key := cacheKey(namespace, moduleID, actorID)
+	activation, cached, err := c.ensureActivation(ctx, key, namespace, moduleID, actorID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	reader, err := c.remote.InvokeActorRemote(
+		ctx, activation.versionStamp, primaryReference(activation.references), operation,
+		payload, types.CreateIfNotExist{})
+	if err == nil {
+		var result []byte
+		result, err = readAll(reader)
+		if err == nil {
+			return result, cached, nil
+		}
+	}
+	c.cache.Del(key)
+	return nil, cached, err
+}
+
+func (c *Client) ensureActivation(
+	ctx context.Context,
+	key []byte,
+	namespace string,
+	moduleID string,
+	actorID string,
+) (cachedActivation, bool, error) {
+	if v, ok := c.cache.Get(key); ok {
+		c.cacheHits.Add(1)
+		return v.(cachedActivation), true, nil
+	}
+	c.cacheMisses.Add(1)
+
+	// Get the versionstamp first so that it's never ahead of the activation.
+	versionStamp, err := c.opts.Registry.GetVersionStamp(ctx)
+	if err != nil {
+		return cachedActivation{}, false, fmt.Errorf(
+			"client: error getting versionstamp from registry: %w", err)
+	}
+	references, err := c.opts.Registry.EnsureActivation(
+		ctx, namespace, actorID, moduleID, registry.EnsureActivationOptions{})
+	if err != nil {
+		return cachedActivation{}, false, fmt.Errorf(
+			"client: error ensuring activation of actor: %s in namespace: %s: %w",
+			actorID, namespace, err)
+	}
+	if len(references) == 0 {
+		return cachedActivation{}, false, fmt.Errorf(
+			"client: registry returned no references for actor: %s in namespace: %s",
+			actorID, namespace)
+	}
+
+	activation := cachedActivation{references: references, versionStamp: versionStamp}
+	c.cache.SetWithTTL(key, activation, 1, c.opts.ActivationCacheTTL)
+	return activation, false, nil
+}
+
+// Stats returns statistics about the client's activation cache.
+func (c *Client) Stats() Stats {
+	return Stats{
+		CacheHits:   c.cacheHits.Load(),
+		CacheMisses: c.cacheMisses.Load(),
+		Retries:     c.retries.Load(),
+	}
+}
+
+// Close releases the resources of the client. The registry is not closed.
+func (c *Client) Close() {
+	if c.cache != nil {
+		c.cache.Close()
+	}
+}
+
+// primaryReference returns the reference of the actor that isn't a replica since all the
+// invocations of the client may write.
+func primaryReference(references []types.ActorReference) types.ActorReference {
+	for _, ref := range references {
+		if !ref.IsReplica() {
+			return ref
+		}
+	}
+	return references[0]
+}
+
+func cacheKey(namespace, moduleID, actorID string) []byte {
+	return []byte(fmt.Sprintf("%s::%s::%s", namespace, moduleID, actorID))
+}
+
+func readAll(reader io.ReadCloser) ([]byte, error) {
+	defer reader.Close()
+	result, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("client: error reading result: %w", err)
+	}
+	return result, nil
+}
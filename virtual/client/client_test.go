@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual"
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestClient ensures that the client can invoke actors through the registry (caching their
+// activations and retrying once when a cached activation is stale) and through a seed
+// server.
+func TestClient(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	wasmBytes, err := os.ReadFile("../../testdata/tinygo/util/main.wasm")
+	require.NoError(t, err)
+	_, err = reg.RegisterModule(ctx, "ns-1", "util", wasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+
+	// Find a free port for the server to listen on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	require.NoError(t, ln.Close())
+
+	env, err := virtual.NewEnvironment(ctx, "server-1", reg, virtual.NewHTTPClient(), virtual.EnvironmentOptions{
+		Discovery: virtual.DiscoveryOptions{
+			DiscoveryType: virtual.DiscoveryTypeLocalHost,
+			Port:          port,
+		},
+	})
+	require.NoError(t, err)
+	defer env.Close()
+	go virtual.NewServer(reg, env).Start(port)
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(fmt.Sprintf("http://%s/api/v1/health", address))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	c, err := New(Options{Registry: reg})
+	require.NoError(t, err)
+	defer c.Close()
+
+	result, err := c.Invoke(ctx, "ns-1", "util", "a", "inc", nil)
+	require.NoError(t, err)
+	require.Equal(t, "1", string(result))
+	c.cache.Wait()
+	result, err = c.Invoke(ctx, "ns-1", "util", "a", "inc", nil)
+	require.NoError(t, err)
+	require.Equal(t, "2", string(result))
+	require.Equal(t, Stats{CacheHits: 1, CacheMisses: 1}, c.Stats())
+
+	// Stale activations are evicted and the invocation is retried.
+	stale, err := types.NewActorReference("server-0", 1, address, "ns-1", "util", "a", 1)
+	require.NoError(t, err)
+	c.cache.SetWithTTL(
+		cacheKey("ns-1", "util", "a"),
+		cachedActivation{references: []types.ActorReference{stale}, versionStamp: 1},
+		1, time.Minute)
+	c.cache.Wait()
+	result, err = c.Invoke(ctx, "ns-1", "util", "a", "inc", nil)
+	require.NoError(t, err)
+	require.Equal(t, "3", string(result))
+	require.Equal(t, Stats{CacheHits: 2, CacheMisses: 2, Retries: 1}, c.Stats())
+
+	seedClient, err := New(Options{SeedAddress: address})
+	require.NoError(t, err)
+	defer seedClient.Close()
+	result, err = seedClient.Invoke(ctx, "ns-1", "util", "a", "inc", nil)
+	require.NoError(t, err)
+	require.Equal(t, "4", string(result))
+
+	_, err = New(Options{Registry: reg, SeedAddress: address})
+	require.Error(t, err)
+}
@@ -0,0 +1,24 @@
+package virtual
+
+import "time"
+
+// Clock is the source of the current time. It exists so that tests can control the
+// passage of time deterministically instead of sleeping.
+//
+// The times that a Clock returns are only compared with times returned by the same
+// Clock in the same process, for example to determine the age of cached activations,
+// and never with the times or the versionstamps of other servers. Implementations
+// should return times with a monotonic clock reading (like time.Now() does) so that
+// these comparisons are not affected by adjustments of the wall clock.
+type Clock interface {
+	// Now returns the current time. It must be safe for concurrent use.
+	Now() time.Time
+}
+
+// realClock is a Clock that uses the system's clock. The times that it returns include a
+// monotonic clock reading.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,196 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes values to (and decodes them from) the raw []byte payloads that actors
+// are invoked with and respond with, and the values they store in their KV storage.
+// Payloads are opaque to the environment, so codecs are only a convenience for callers
+// and actors that agree on a format: see InvokeActorCodec, KVPutCodec and KVGetCodec.
+//
+// Values that implement Validator are validated when they're encoded and decoded so
+// that malformed payloads and state are rejected at the boundary.
+type Codec interface {
+	// Marshal encodes v.
+	Marshal(v any) ([]byte, error)
+	// Unmarshal decodes data into v, which is usually a pointer.
+	Unmarshal(data []byte, v any) error
+}
+
+// Validator is implemented by values that can validate themselves.
+type Validator interface {
+	Validate() error
+}
+
+var (
+	// RawCodec is the identity codec, which preserves the raw []byte payloads that actors
+	// are invoked with. It encodes []byte and string values, and decodes into *[]byte and
+	// *string values. It's used when no codec is provided.
+	RawCodec Codec = rawCodec{}
+	// JSONCodec encodes values as JSON.
+	JSONCodec Codec = jsonCodec{}
+	// ProtoCodec encodes values in the protobuf wire format. Values must implement
+	// proto.Message.
+	ProtoCodec Codec = protoCodec{}
+)
+
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return nil, fmt.Errorf("RawCodec: can't marshal value of type: %T", v)
+	}
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = data
+	case *string:
+		*v = string(data)
+	default:
+		return fmt.Errorf("RawCodec: can't unmarshal into value of type: %T", v)
+	}
+	return nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("ProtoCodec: %T does not implement proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protoCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("ProtoCodec: %T does not implement proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// Encode validates v (if it implements Validator) and encodes it with codec. If codec is
+// nil, RawCodec is used.
+func Encode(codec Codec, v any) ([]byte, error) {
+	if codec == nil {
+		codec = RawCodec
+	}
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return nil, fmt.Errorf("error validating value of type: %T, err: %w", v, err)
+		}
+	}
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding value of type: %T, err: %w", v, err)
+	}
+	return data, nil
+}
+
+// Decode decodes data into v with codec and validates v (if it implements Validator).
+// If codec is nil, RawCodec is used.
+func Decode(codec Codec, data []byte, v any) error {
+	if codec == nil {
+		codec = RawCodec
+	}
+	if err := codec.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error decoding value of type: %T, err: %w", v, err)
+	}
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return fmt.Errorf("error validating value of type: %T, err: %w", v, err)
+		}
+	}
+	return nil
+}
+
+// InvokeActorCodec is the same as Environment.InvokeActor, except the payload is encoded
+// from req and the result is decoded into resp with codec (see Encode and Decode).
+func InvokeActorCodec(
+	ctx context.Context,
+	env Environment,
+	codec Codec,
+	namespace string,
+	actorID string,
+	moduleID string,
+	operation string,
+	req any,
+	resp any,
+	create types.CreateIfNotExist,
+) error {
+	payload, err := Encode(codec, req)
+	if err != nil {
+		return fmt.Errorf("InvokeActorCodec: error encoding request: %w", err)
+	}
+	result, err := env.InvokeActor(ctx, namespace, actorID, moduleID, operation, payload, create)
+	if err != nil {
+		return err
+	}
+	if err := Decode(codec, result, resp); err != nil {
+		return fmt.Errorf("InvokeActorCodec: error decoding response: %w", err)
+	}
+	return nil
+}
+
+// KVPutCodec is the same as registry.ActorKVTransaction.Put, except the value is encoded
+// from v with codec (see Encode).
+func KVPutCodec(
+	ctx context.Context,
+	tr registry.ActorKVTransaction,
+	codec Codec,
+	key []byte,
+	v any,
+) error {
+	value, err := Encode(codec, v)
+	if err != nil {
+		return fmt.Errorf("KVPutCodec: %w", err)
+	}
+	return tr.Put(ctx, key, value)
+}
+
+// KVGetCodec is the same as registry.ActorKVTransaction.Get, except the value is decoded
+// into v with codec (see Decode). v is left untouched if the key doesn't exist.
+func KVGetCodec(
+	ctx context.Context,
+	tr registry.ActorKVTransaction,
+	codec Codec,
+	key []byte,
+	v any,
+) (bool, error) {
+	value, ok, err := tr.Get(ctx, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := Decode(codec, value, v); err != nil {
+		return false, fmt.Errorf("KVGetCodec: %w", err)
+	}
+	return true, nil
+}
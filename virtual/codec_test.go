@@ -0,0 +1,113 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type testCodecValue struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func (v *testCodecValue) Validate() error {
+	if v.Name == "" {
+		return errors.New("name is required")
+	}
+	return nil
+}
+
+// TestInvokeActorCodec ensures that payloads are encoded and decoded with the provided
+// codec, and that values are validated at the boundary.
+func TestInvokeActorCodec(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 37
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	var resp testCodecValue
+	err = InvokeActorCodec(
+		ctx, env, JSONCodec, "ns-1", "a", "test-module", "echo",
+		&testCodecValue{Name: "a", Count: 1}, &resp, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, testCodecValue{Name: "a", Count: 1}, resp)
+
+	err = InvokeActorCodec(
+		ctx, env, JSONCodec, "ns-1", "a", "test-module", "echo",
+		&testCodecValue{Count: 1}, &resp, types.CreateIfNotExist{})
+	require.Error(t, err)
+
+	// The raw codec is used by default.
+	var rawResp []byte
+	err = InvokeActorCodec(
+		ctx, env, nil, "ns-1", "a", "test-module", "echo",
+		[]byte("hello"), &rawResp, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), rawResp)
+}
+
+func TestCodecs(t *testing.T) {
+	var s string
+	require.NoError(t, Decode(RawCodec, []byte("hello"), &s))
+	require.Equal(t, "hello", s)
+	_, err := Encode(RawCodec, 1)
+	require.Error(t, err)
+
+	data, err := Encode(ProtoCodec, wrapperspb.String("hello"))
+	require.NoError(t, err)
+	var msg wrapperspb.StringValue
+	require.NoError(t, Decode(ProtoCodec, data, &msg))
+	require.Equal(t, "hello", msg.GetValue())
+	_, err = Encode(ProtoCodec, "hello")
+	require.Error(t, err)
+
+	require.Error(t, Decode(JSONCodec, []byte(`{"count":1}`), &testCodecValue{}))
+}
+
+func TestKVCodec(t *testing.T) {
+	var (
+		ctx = context.Background()
+		tr  = &testMapKVTransaction{kvs: make(map[string][]byte)}
+		v   testCodecValue
+	)
+	ok, err := KVGetCodec(ctx, tr, JSONCodec, []byte("k"), &v)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, KVPutCodec(ctx, tr, JSONCodec, []byte("k"), &testCodecValue{Name: "a", Count: 2}))
+	require.Error(t, KVPutCodec(ctx, tr, JSONCodec, []byte("k"), &testCodecValue{Count: 2}))
+	ok, err = KVGetCodec(ctx, tr, JSONCodec, []byte("k"), &v)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, testCodecValue{Name: "a", Count: 2}, v)
+}
+
+type testMapKVTransaction struct {
+	registry.ActorKVTransaction
+	kvs map[string][]byte
+}
+
+func (tr *testMapKVTransaction) Put(ctx context.Context, key []byte, value []byte) error {
+	tr.kvs[string(key)] = value
+	return nil
+}
+
+func (tr *testMapKVTransaction) Get(ctx context.Context, key []byte) ([]byte, bool, error) {
+	v, ok := tr.kvs[string(key)]
+	return v, ok, nil
+}
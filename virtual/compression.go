@@ -0,0 +1,233 @@
+package virtual
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	// CompressionCodecNone disables compression.
+	CompressionCodecNone = ""
+	// CompressionCodecGzip compresses payloads with gzip.
+	CompressionCodecGzip = "gzip"
+	// CompressionCodecZstd compresses payloads with zstd. It's only supported for the
+	// state of actors (see StateCompressionOptions).
+	CompressionCodecZstd = "zstd"
+
+	defaultCompressionMinSizeBytes = 1024
+)
+
+// CompressionOptions contains the options for compressing the payloads of invocations
+// that are sent over the network, both the requests that this server sends to other
+// servers and the responses that it sends back to its callers. Compression is
+// negotiated with HTTP headers (Content-Encoding and Accept-Encoding) so servers with
+// different options (or clients that don't support compression) can talk to each
+// other, and requests are always decompressed regardless of these options.
+type CompressionOptions struct {
+	// Codec is the codec that is used to compress payloads. Only CompressionCodecGzip is
+	// supported.
+	//
+	// If empty (CompressionCodecNone), payloads are not compressed.
+	Codec string
+	// MinSizeBytes is the minimum size of the payloads that are compressed. Smaller
+	// payloads are sent uncompressed since compressing them isn't worth the CPU.
+	// Streaming responses are always compressed (as long as the caller accepts it)
+	// since their size is not known upfront.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 1KiB.
+	MinSizeBytes int
+}
+
+func (c *CompressionOptions) Validate() error {
+	if c.Codec != CompressionCodecNone && c.Codec != CompressionCodecGzip {
+		return fmt.Errorf("unsupported compression codec: %s", c.Codec)
+	}
+	if c.MinSizeBytes < 0 {
+		return fmt.Errorf("MinSizeBytes must be >= 0")
+	}
+	return nil
+}
+
+// compressionProvider is implemented by environments that compress responses.
+type compressionProvider interface {
+	compression() CompressionOptions
+}
+
+type compressionCtxKey struct{}
+
+// withCompression returns a context that makes the RemoteClient compress the requests it
+// sends (and accept compressed responses) according to opts.
+func withCompression(ctx context.Context, opts CompressionOptions) context.Context {
+	if opts.Codec == CompressionCodecNone {
+		return ctx
+	}
+	return context.WithValue(ctx, compressionCtxKey{}, opts)
+}
+
+func compressionFromContext(ctx context.Context) (CompressionOptions, bool) {
+	opts, ok := ctx.Value(compressionCtxKey{}).(CompressionOptions)
+	return opts, ok
+}
+
+// newCompressedRequestBody returns the body of a request with the provided payload,
+// compressing it if ctx requests compression and it's large enough. It also sets the
+// headers that negotiate compression on header.
+func newCompressedRequestBody(
+	ctx context.Context,
+	payload []byte,
+	header http.Header,
+) (io.Reader, error) {
+	opts, ok := compressionFromContext(ctx)
+	if !ok {
+		return bytes.NewReader(payload), nil
+	}
+
+	header.Set("Accept-Encoding", opts.Codec)
+	if len(payload) < opts.MinSizeBytes {
+		return bytes.NewReader(payload), nil
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(payload); err != nil {
+		return nil, fmt.Errorf("error compressing request: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("error compressing request: %w", err)
+	}
+	header.Set("Content-Encoding", opts.Codec)
+	return &buf, nil
+}
+
+// readRequestBody reads the body of r (up to 16MiB once decompressed), decompressing it
+// if necessary.
+func readRequestBody(r *http.Request) ([]byte, error) {
+	body := io.Reader(r.Body)
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+	case CompressionCodecGzip:
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing request: %w", err)
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+	return io.ReadAll(io.LimitReader(body, 1<<24))
+}
+
+// decompressResponseBody wraps the body of resp so that it's decompressed as it's read.
+// Each chunk of streaming responses can be decompressed as soon as it's received.
+func decompressResponseBody(resp *http.Response) (io.ReadCloser, error) {
+	switch encoding := resp.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case CompressionCodecGzip:
+		return &gzipResponseBody{body: resp.Body}, nil
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+}
+
+// gzipResponseBody decompresses a response body. The gzip reader is created lazily
+// because creating it reads the gzip header, which would block until the first chunk of
+// streaming responses is produced.
+type gzipResponseBody struct {
+	body io.ReadCloser
+	gz   *gzip.Reader
+}
+
+func (g *gzipResponseBody) Read(p []byte) (int, error) {
+	if g.gz == nil {
+		gz, err := gzip.NewReader(g.body)
+		if err != nil {
+			return 0, fmt.Errorf("error decompressing response: %w", err)
+		}
+		g.gz = gz
+	}
+	return g.gz.Read(p)
+}
+
+func (g *gzipResponseBody) Close() error {
+	return g.body.Close()
+}
+
+// writeResponse writes the successful response of an invocation, result, to w. It's
+// compressed if the server is configured to compress responses, the caller accepts the
+// codec, and the response is large enough (or streamed). Compressed streaming responses
+// are flushed after every chunk so the caller can decompress them incrementally.
+func (s *server) writeResponse(
+	ctx context.Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	result io.Reader,
+) error {
+	var opts CompressionOptions
+	if cp, ok := s.environment.(compressionProvider); ok {
+		opts = cp.compression()
+	}
+	if opts.Codec == CompressionCodecNone || !acceptsEncoding(r, opts.Codec) {
+		w.WriteHeader(200)
+		_, err := io.Copy(responseWriter(ctx, w), result)
+		return err
+	}
+
+	streaming := isStreamingRequested(ctx)
+	if !streaming {
+		// Peek errors are ignored since they're returned again when copying.
+		br := bufio.NewReaderSize(result, opts.MinSizeBytes)
+		result = br
+		if peeked, _ := br.Peek(opts.MinSizeBytes); len(peeked) < opts.MinSizeBytes {
+			w.WriteHeader(200)
+			_, err := io.Copy(w, result)
+			return err
+		}
+	}
+
+	w.Header().Set("Content-Encoding", opts.Codec)
+	w.WriteHeader(200)
+	gz := gzip.NewWriter(responseWriter(ctx, w))
+	var dst io.Writer = gz
+	if streaming {
+		dst = gzipFlushWriter{gz: gz}
+	}
+	if _, err := io.Copy(dst, result); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// gzipFlushWriter flushes the gzip writer after every write so that every chunk of a
+// streaming response can be decompressed as soon as it's received.
+type gzipFlushWriter struct {
+	gz *gzip.Writer
+}
+
+func (g gzipFlushWriter) Write(p []byte) (int, error) {
+	n, err := g.gz.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, g.gz.Flush()
+}
+
+// acceptsEncoding returns whether the caller of r accepts responses that are encoded
+// with the provided encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		accepted, _, _ = strings.Cut(accepted, ";")
+		if strings.TrimSpace(accepted) == encoding {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestCompression ensures that requests and responses are only compressed when they're
+// larger than the threshold, and that compressed streaming responses can be decompressed
+// incrementally.
+func TestCompression(t *testing.T) {
+	var (
+		reg    = localregistry.NewLocalRegistry()
+		ctx    = context.Background()
+		module = &testChunkedModule{}
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 29
+	opts.Compression = CompressionOptions{Codec: CompressionCodecGzip, MinSizeBytes: 64}
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "chunked-module"}, module))
+
+	var (
+		encodingsMu sync.Mutex
+		encodings   []string
+	)
+	s := NewServer(reg, env)
+	recordEncodings := func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			handler(w, r)
+			encodingsMu.Lock()
+			encodings = append(encodings,
+				r.Header.Get("Content-Encoding")+"/"+w.Header().Get("Content-Encoding"))
+			encodingsMu.Unlock()
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/invoke-actor-direct", recordEncodings(s.invokeDirect))
+	mux.HandleFunc("/api/v1/invoke-actor-stream", recordEncodings(s.invokeStream))
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	references, err := reg.EnsureActivation(ctx, "ns-1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	ref, err := types.NewActorReference(
+		references[0].ServerID(), references[0].ServerVersion(),
+		strings.TrimPrefix(httpServer.URL, "http://"), "ns-1", "test-module", "a",
+		references[0].Generation())
+	require.NoError(t, err)
+	vs, err := reg.GetVersionStamp(ctx)
+	require.NoError(t, err)
+
+	echo := func(ctx context.Context, payload []byte) {
+		stream, err := NewHTTPClient().InvokeActorRemote(
+			ctx, vs, ref, "echo", payload, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		result, err := io.ReadAll(stream)
+		require.NoError(t, err)
+		require.NoError(t, stream.Close())
+		require.Equal(t, payload, result)
+	}
+	var (
+		compressCtx = withCompression(ctx, env.(*environment).opts.Compression)
+		large       = bytes.Repeat([]byte("a"), 1024)
+	)
+	echo(compressCtx, large)
+	// The request is still larger than the threshold once it's encoded.
+	echo(compressCtx, []byte("small"))
+	// Callers that don't accept compressed responses don't get them.
+	echo(ctx, large)
+	encodingsMu.Lock()
+	require.Equal(t, []string{"gzip/gzip", "gzip/", "/"}, encodings)
+	encodingsMu.Unlock()
+
+	// Compressed streaming responses can be decompressed as soon as each chunk arrives.
+	module.reset()
+	req, err := http.NewRequest("POST", httpServer.URL+"/api/v1/invoke-actor-stream", strings.NewReader(
+		`{"namespace":"ns-1","actor_id":"a","module_id":"chunked-module","operation":"stream"}`))
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "deflate, gzip;q=1.0")
+	resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	body, err := decompressResponseBody(resp)
+	require.NoError(t, err)
+	defer body.Close()
+	requireRead(t, body, "a")
+	close(module.proceed)
+	rest, err := io.ReadAll(body)
+	require.NoError(t, err)
+	require.Equal(t, "bc", string(rest))
+
+	require.Error(t, (&CompressionOptions{Codec: "zstd"}).Validate())
+}
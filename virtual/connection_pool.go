@@ -0,0 +1,254 @@
+package virtual
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultUnhealthyThreshold = 3
+
+// ServerHealthChecker is implemented by the RemoteClients that actively check the health
+// of the servers they connect to, like the one returned by NewHTTPClientWithOptions when
+// HTTPClientOptions.HealthCheckInterval is set. Environments subscribe to it so that the
+// activations cached for a server that becomes unhealthy are resolved again (see
+// ActivationsCacheOptions.UnreachableServerBlacklistTTL).
+type ServerHealthChecker interface {
+	// OnServerUnhealthy registers fn to be called with the ID of every server that
+	// becomes unhealthy, and returns a function that unregisters it. fn is called
+	// synchronously from the health checks, so it must not block.
+	OnServerUnhealthy(fn func(serverID string)) (unregister func())
+}
+
+// connectionPools contains a pool of connections for every server that the HTTP client
+// sends requests to, and optionally checks the health of those servers in the
+// background. Servers that fail UnhealthyThreshold consecutive health checks are removed,
+// which closes their idle connections, and the subscribers are notified so they stop
+// routing to them. The pool of a removed server is created again the next time a
+// request is sent to it.
+type connectionPools struct {
+	sync.Mutex
+
+	// Configuration.
+	opts   HTTPClientOptions
+	scheme string
+
+	// State.
+	pools       map[string]*connectionPool
+	subscribers map[int]func(serverID string)
+	nextSubID   int
+	closeCh     chan struct{}
+	closeOnce   sync.Once
+}
+
+// connectionPool is the pool of connections of a single server.
+type connectionPool struct {
+	serverID  string
+	transport *http.Transport
+	client    *http.Client
+	// failures is the number of consecutive failed health checks.
+	failures int
+}
+
+func newConnectionPools(opts HTTPClientOptions, scheme string) *connectionPools {
+	if opts.UnhealthyThreshold == 0 {
+		opts.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+	p := &connectionPools{
+		opts:        opts,
+		scheme:      scheme,
+		pools:       make(map[string]*connectionPool),
+		subscribers: make(map[int]func(serverID string)),
+		closeCh:     make(chan struct{}),
+	}
+	if opts.HealthCheckInterval > 0 {
+		go p.healthCheckLoop()
+	}
+	return p
+}
+
+// client returns the client for the server at address, creating its pool if necessary.
+// serverID may be empty if the caller doesn't know which server is at address, in which
+// case it's learned from subsequent calls.
+func (p *connectionPools) client(address, serverID string) *http.Client {
+	p.Lock()
+	defer p.Unlock()
+	pool, ok := p.pools[address]
+	if !ok {
+		transport := newHTTPTransport(p.opts)
+		pool = &connectionPool{
+			transport: transport,
+			client:    &http.Client{Transport: transport},
+		}
+		p.pools[address] = pool
+	}
+	if serverID != "" {
+		pool.serverID = serverID
+	}
+	return pool.client
+}
+
+// numPools returns the number of servers that currently have a pool.
+func (p *connectionPools) numPools() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.pools)
+}
+
+func (p *connectionPools) OnServerUnhealthy(fn func(serverID string)) func() {
+	p.Lock()
+	defer p.Unlock()
+	id := p.nextSubID
+	p.nextSubID++
+	p.subscribers[id] = fn
+	return func() {
+		p.Lock()
+		defer p.Unlock()
+		delete(p.subscribers, id)
+	}
+}
+
+func (p *connectionPools) healthCheckLoop() {
+	ticker := time.NewTicker(p.opts.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.checkHealth()
+		case <-p.closeCh:
+			return
+		}
+	}
+}
+
+// checkHealth checks the health of every server that has a pool concurrently, and
+// removes the ones that failed too many consecutive checks.
+func (p *connectionPools) checkHealth() {
+	p.Lock()
+	pools := make(map[string]*connectionPool, len(p.pools))
+	for address, pool := range p.pools {
+		pools[address] = pool
+	}
+	p.Unlock()
+
+	var wg sync.WaitGroup
+	for address, pool := range pools {
+		wg.Add(1)
+		go func(address string, pool *connectionPool) {
+			defer wg.Done()
+			err := p.checkServer(address, pool)
+			p.recordHealthCheck(address, pool, err)
+		}(address, pool)
+	}
+	wg.Wait()
+}
+
+// checkServer calls the health endpoint of the server at address.
+func (p *connectionPools) checkServer(address string, pool *connectionPool) error {
+	ctx, cc := context.WithTimeout(context.Background(), p.opts.HealthCheckInterval)
+	defer cc()
+	req, err := http.NewRequestWithContext(
+		ctx, "GET", fmt.Sprintf("%s://%s/api/v1/health", p.scheme, address), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := pool.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *connectionPools) recordHealthCheck(address string, pool *connectionPool, err error) {
+	p.Lock()
+	if p.pools[address] != pool {
+		// The pool was removed (and possibly created again) in the meantime.
+		p.Unlock()
+		return
+	}
+	if err == nil {
+		pool.failures = 0
+		p.Unlock()
+		return
+	}
+	pool.failures++
+	if pool.failures < p.opts.UnhealthyThreshold {
+		p.Unlock()
+		return
+	}
+
+	delete(p.pools, address)
+	subscribers := make([]func(string), 0, len(p.subscribers))
+	for _, fn := range p.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	p.Unlock()
+
+	log.Printf(
+		"server: %s at address: %s failed %d consecutive health checks, removing it from the connection pool, last err: %v",
+		pool.serverID, address, pool.failures, err)
+	pool.transport.CloseIdleConnections()
+	if pool.serverID == "" {
+		return
+	}
+	for _, fn := range subscribers {
+		fn(pool.serverID)
+	}
+}
+
+// Close stops the health checks and closes the idle connections of every pool.
+func (p *connectionPools) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closeCh)
+	})
+	p.Lock()
+	defer p.Unlock()
+	for address, pool := range p.pools {
+		pool.transport.CloseIdleConnections()
+		delete(p.pools, address)
+	}
+	return nil
+}
+
+// newHTTPTransport returns the transport of the connection pool of a single server.
+func newHTTPTransport(opts HTTPClientOptions) *http.Transport {
+	maxIdleConns := 6500
+	if opts.MaxConnsPerServer > 0 {
+		maxIdleConns = opts.MaxConnsPerServer
+	}
+	return &http.Transport{
+		// Some of this is copy-pasta from http.DefaultTransport.
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:        0, // No limit.
+		MaxIdleConnsPerHost: maxIdleConns,
+		MaxConnsPerHost:     opts.MaxConnsPerServer,
+		IdleConnTimeout:     90 * time.Second,
+		DisableCompression:  true,
+		// Some cloud providers (like GCP) rate-limit connections to 200MiB/s
+		// which means if we allow the SDK to use HTTP2 connections and perform
+		// multi-plexing our entire application will get throttled to ~200MiB/s
+		// regardless of how many parallel streams we open so make sure we disable
+		// HTTP2.
+		ForceAttemptHTTP2:     false,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       opts.TLSConfig,
+		WriteBufferSize:       1 << 18,
+		ReadBufferSize:        1 << 18,
+	}
+}
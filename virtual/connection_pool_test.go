@@ -0,0 +1,92 @@
+package virtual
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestHTTPClientHealthChecks ensures that the HTTP client removes the servers that fail
+// its health checks from its connection pools, and that the environments that use it
+// blacklist them.
+func TestHTTPClientHealthChecks(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/health" && !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer httpServer.Close()
+
+	client := NewHTTPClientWithOptions(HTTPClientOptions{
+		MaxConnsPerServer:   4,
+		HealthCheckInterval: 10 * time.Millisecond,
+		UnhealthyThreshold:  2,
+	})
+	defer client.(io.Closer).Close()
+	pools := client.(*httpClient).connectionPools
+
+	var (
+		ctx              = context.Background()
+		unhealthyMu      sync.Mutex
+		unhealthy        []string
+		unregisteredSubs atomic.Int64
+	)
+	pools.OnServerUnhealthy(func(serverID string) {
+		unhealthyMu.Lock()
+		defer unhealthyMu.Unlock()
+		unhealthy = append(unhealthy, serverID)
+	})
+	pools.OnServerUnhealthy(func(serverID string) {
+		unregisteredSubs.Add(1)
+	})()
+
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 60
+	env, err := NewEnvironment(ctx, "serverID2", localregistry.NewLocalRegistry(), client, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ref, err := types.NewActorReference(
+		"serverID1", 1, strings.TrimPrefix(httpServer.URL, "http://"), "ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+	result, err := client.InvokeActorRemote(ctx, 1, ref, "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	defer result.Close()
+	require.Equal(t, 1, pools.numPools())
+	pools.Lock()
+	require.Equal(t, 4, pools.pools[ref.Address()].transport.MaxConnsPerHost)
+	pools.Unlock()
+
+	// Healthy servers stay in the pool.
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 1, pools.numPools())
+
+	healthy.Store(false)
+	// The subscribers are notified after the server is removed from the pool.
+	require.Eventually(t, func() bool {
+		unhealthyMu.Lock()
+		defer unhealthyMu.Unlock()
+		return pools.numPools() == 0 && len(unhealthy) > 0 &&
+			env.ActivationCacheStats().UnreachableServers > 0
+	}, 5*time.Second, time.Millisecond)
+	unhealthyMu.Lock()
+	require.Equal(t, []string{"serverID1"}, unhealthy)
+	unhealthyMu.Unlock()
+	require.Zero(t, unregisteredSubs.Load())
+	require.Equal(t, uint64(1), env.ActivationCacheStats().UnreachableServers)
+}
@@ -0,0 +1,236 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/richardartoul/nola/durable/durablewazero"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+)
+
+var (
+	errModuleNotDescribable = errors.New("module does not describe its operations")
+	errUnknownOperation     = errors.New("operation is not supported by module")
+)
+
+// IsModuleNotDescribableErr returns a boolean indicating whether the error is an instance
+// of (or wraps) errModuleNotDescribable, which indicates that the module doesn't export
+// the wapcutils.DescribeOperationName operation (or, for Go modules, doesn't implement
+// ModuleDescriber).
+func IsModuleNotDescribableErr(err error) bool {
+	return errors.Is(err, errModuleNotDescribable)
+}
+
+// IsUnknownOperationErr returns a boolean indicating whether the error is an instance of
+// (or wraps) errUnknownOperation, which indicates that an invocation was rejected because
+// the operation is not listed in the description of the actor's module.
+func IsUnknownOperationErr(err error) bool {
+	return errors.Is(err, errUnknownOperation)
+}
+
+// ModuleDescriber is an optional interface that can be implemented by Go modules to
+// describe the operations that their actors support. It's the equivalent of the
+// wapcutils.DescribeOperationName operation of WASM modules.
+type ModuleDescriber interface {
+	Describe(ctx context.Context) (wapcutils.ModuleDescription, error)
+}
+
+// hostOperations contains the well-known operations that are invoked by the host, which
+// modules don't have to list in their description.
+var hostOperations = map[string]struct{}{
+	wapcutils.StartupOperationName:          {},
+	wapcutils.ShutdownOperationName:         {},
+	wapcutils.ReceiveReminderOperationName:  {},
+	wapcutils.ReceiveTimerOperationName:     {},
+	wapcutils.SnapshotOperationName:         {},
+	wapcutils.RestoreOperationName:          {},
+	wapcutils.DescribeOperationName:         {},
+	wapcutils.MembershipChangeOperationName: {},
+}
+
+// moduleDescription is the cached description of a module.
+type moduleDescription struct {
+	description wapcutils.ModuleDescription
+	operations  map[string]struct{}
+	// err is set if the module couldn't be described, in which case the operations of
+	// its invocations are not validated.
+	err error
+}
+
+func newModuleDescription(description wapcutils.ModuleDescription) *moduleDescription {
+	operations := make(map[string]struct{}, len(description.Operations))
+	for _, op := range description.Operations {
+		operations[op.Name] = struct{}{}
+	}
+	return &moduleDescription{description: description, operations: operations}
+}
+
+// validate returns an error if the module's description doesn't list the operation.
+func (d *moduleDescription) validate(moduleID types.NamespacedID, operation string) error {
+	if d == nil || d.err != nil {
+		return nil
+	}
+	if _, ok := hostOperations[operation]; ok {
+		return nil
+	}
+	if _, ok := d.operations[operation]; ok {
+		return nil
+	}
+	return newInvalidInvokeError(fmt.Errorf(
+		"error invoking operation: %s of module: %s/%s, err: %w",
+		operation, moduleID.Namespace, moduleID.ID, errUnknownOperation))
+}
+
+// describe returns the description of the module, describing it first if it's not cached.
+// Modules can't be modified once they're registered, so a module ID always identifies
+// the same version of the module and its description is cached for the lifetime of the
+// environment.
+func (a *activations) describe(
+	ctx context.Context,
+	moduleID types.NamespacedID,
+	module Module,
+) *moduleDescription {
+	key := types.NewNamespacedIDNoType(moduleID.Namespace, moduleID.ID)
+	a.Lock()
+	d, ok := a._descriptions[key]
+	a.Unlock()
+	if ok {
+		return d
+	}
+
+	var (
+		description wapcutils.ModuleDescription
+		err         error
+	)
+	switch m := module.(type) {
+	case wasmModule:
+		description, err = m.describe(ctx, moduleID)
+	case ModuleDescriber:
+		description, err = m.Describe(ctx)
+	default:
+		err = errModuleNotDescribable
+	}
+	if err != nil {
+		d = &moduleDescription{err: fmt.Errorf(
+			"error describing module: %s/%s, err: %w", moduleID.Namespace, moduleID.ID, err)}
+		if ctx.Err() != nil || errors.Is(err, errCompiledModuleEvicted) {
+			// The module may be described successfully next time.
+			return d
+		}
+	} else {
+		d = newModuleDescription(description)
+	}
+
+	a.Lock()
+	a._descriptions[key] = d
+	a.Unlock()
+	return d
+}
+
+// cachedDescription returns the description of the module if it has already been
+// described.
+func (a *activations) cachedDescription(moduleID types.NamespacedID) *moduleDescription {
+	a.Lock()
+	defer a.Unlock()
+	return a._descriptions[types.NewNamespacedIDNoType(moduleID.Namespace, moduleID.ID)]
+}
+
+// describeModule returns the description of the module with the provided ID.
+func (a *activations) describeModule(
+	ctx context.Context,
+	moduleID types.NamespacedID,
+) (wapcutils.ModuleDescription, error) {
+	d := a.cachedDescription(moduleID)
+	if d == nil {
+		module, err := a.ensureModule(ctx, moduleID)
+		if err != nil {
+			return wapcutils.ModuleDescription{}, fmt.Errorf(
+				"error ensuring module: %s/%s, err: %w", moduleID.Namespace, moduleID.ID, err)
+		}
+		d = a.describe(ctx, moduleID, module)
+	}
+	if d.err != nil {
+		return wapcutils.ModuleDescription{}, d.err
+	}
+	return d.description, nil
+}
+
+// describe invokes the wapcutils.DescribeOperationName operation on a fresh instance of
+// the module that is closed immediately afterwards. The instance is not started up and
+// isn't associated with an actor, so the operation can't use the host's capabilities.
+func (w wasmModule) describe(
+	ctx context.Context,
+	moduleID types.NamespacedID,
+) (wapcutils.ModuleDescription, error) {
+	reference, err := types.NewVirtualWorkerReference(
+		moduleID.Namespace, moduleID.ID, wapcutils.DescribeOperationName)
+	if err != nil {
+		return wapcutils.ModuleDescription{}, err
+	}
+	obj, err := w.cache.instantiate(ctx, w.cm, reference)
+	if err != nil {
+		return wapcutils.ModuleDescription{}, err
+	}
+	defer func() {
+		obj.Close(ctx)
+		w.cache.release(ctx, w.cm)
+	}()
+
+	if w.fuelLimit > 0 {
+		ctx = durablewazero.WithFuel(ctx, w.fuelLimit)
+	}
+	result, err := obj.Invoke(ctx, wapcutils.DescribeOperationName, nil)
+	if err != nil {
+		// Modules that don't export the operation can't be told apart from modules whose
+		// describe operation failed.
+		return wapcutils.ModuleDescription{}, fmt.Errorf("%w: %v", errModuleNotDescribable, err)
+	}
+
+	var description wapcutils.ModuleDescription
+	if err := json.Unmarshal(result, &description); err != nil {
+		return wapcutils.ModuleDescription{}, fmt.Errorf(
+			"error unmarshaling ModuleDescription: %w", err)
+	}
+	return description, nil
+}
+
+// describeModule serves the description of the module that is identified by the
+// namespace and module_id query parameters.
+func (s *server) describeModule(w http.ResponseWriter, r *http.Request) {
+	var (
+		namespace = r.URL.Query().Get("namespace")
+		moduleID  = r.URL.Query().Get("module_id")
+	)
+	if !s.authorize(w, r, namespace) {
+		return
+	}
+
+	ctx, cc := context.WithTimeout(s.extractRequestContext(r), 5*time.Second)
+	defer cc()
+	description, err := s.environment.DescribeModule(ctx, namespace, moduleID)
+	if err != nil {
+		code := 500
+		if IsModuleNotDescribableErr(err) {
+			code = http.StatusNotFound
+		}
+		w.WriteHeader(code)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	marshaled, err := json.Marshal(description)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(marshaled)
+}
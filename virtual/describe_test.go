@@ -0,0 +1,136 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testModuleDescription = wapcutils.ModuleDescription{
+	Operations: []wapcutils.OperationDescription{
+		{
+			Name:   "inc",
+			Doc:    "Increments the counter.",
+			Output: wapcutils.PayloadDescriptor{ContentType: "text/plain"},
+		},
+		{Name: "getCount"},
+	},
+}
+
+// describedTestModule is a testModule that describes its operations.
+type describedTestModule struct {
+	testModule
+
+	numDescribes *int
+}
+
+func (m describedTestModule) Describe(ctx context.Context) (wapcutils.ModuleDescription, error) {
+	*m.numDescribes++
+	return testModuleDescription, nil
+}
+
+// TestDescribeModule ensures that modules can describe their operations and that
+// invocations of operations they don't support are rejected before the actor is
+// instantiated.
+func TestDescribeModule(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 42
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	numDescribes := 0
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "described"},
+		describedTestModule{numDescribes: &numDescribes}))
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	// Operations that the description lists (and the ones that are invoked by the host)
+	// can be invoked.
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "described", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "described", wapcutils.SnapshotOperationName, nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+
+	// Other operations are rejected, including by actors that are not activated yet.
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "described", "dec", nil, types.CreateIfNotExist{})
+	require.True(t, IsUnknownOperationErr(err))
+	_, err = env.InvokeActor(ctx, "ns-1", "b", "described", "dec", nil, types.CreateIfNotExist{})
+	require.True(t, IsUnknownOperationErr(err))
+	invokeErr, ok := AsInvokeError(err)
+	require.True(t, ok)
+	require.Equal(t, InvokeErrorCategoryAppError, invokeErr.Category)
+	require.Equal(t, 1, env.ActivationStats().NumActivatedActors)
+
+	description, err := env.DescribeModule(ctx, "ns-1", "described")
+	require.NoError(t, err)
+	require.Equal(t, testModuleDescription, description)
+	require.Equal(t, 1, numDescribes)
+
+	// The operations of modules that don't describe themselves are not validated, so
+	// their actors are invoked with any operation.
+	_, err = env.DescribeModule(ctx, "ns-1", "test-module")
+	require.True(t, IsModuleNotDescribableErr(err))
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "dec", nil, types.CreateIfNotExist{})
+	require.ErrorContains(t, err, "testActor: unhandled operation: dec")
+	require.False(t, IsUnknownOperationErr(err))
+
+	_, err = env.DescribeModule(ctx, "ns-1", "missing")
+	require.Error(t, err)
+	require.False(t, IsModuleNotDescribableErr(err))
+
+	httpServer := httptest.NewServer(http.HandlerFunc(NewServer(reg, env).describeModule))
+	defer httpServer.Close()
+	resp, err := http.Get(httpServer.URL + "?namespace=ns-1&module_id=described")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var decoded wapcutils.ModuleDescription
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+	require.Equal(t, testModuleDescription, decoded)
+
+	resp, err = http.Get(httpServer.URL + "?namespace=ns-1&module_id=test-module")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// TestDescribeModuleWASM ensures that WASM modules that don't export the describe
+// operation are not describable but can still be invoked.
+func TestDescribeModuleWASM(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsWASM
+	opts.Discovery.Port = 43
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	_, err = reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+
+	_, err = env.DescribeModule(ctx, "ns-1", "test-module")
+	require.True(t, IsModuleNotDescribableErr(err))
+
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, "1", string(result))
+}
@@ -0,0 +1,130 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+// drainPollInterval is the interval at which Drain() checks whether the in-flight
+// invocations have completed.
+const drainPollInterval = 10 * time.Millisecond
+
+var errServerDrained = errors.New("server has been drained")
+
+// IsServerDrainedErr returns a boolean indicating whether the error is an instance of (or
+// wraps) errServerDrained.
+func IsServerDrainedErr(err error) bool {
+	return errors.Is(err, errServerDrained)
+}
+
+func (r *environment) Drain(ctx context.Context) error {
+	// Stop the registry from placing new actors here, and from routing invocations of
+	// the actors that are activated here once their activations are ensured again.
+	r.draining.Store(true)
+	if err := r.heartbeat(); err != nil {
+		return fmt.Errorf("Drain: error heartbeating draining state: %w", err)
+	}
+
+	waitErr := r.waitForInFlightInvocations(ctx)
+
+	// The handoffs are marked as pending before invocations start being rerouted so that
+	// rerouted invocations wait for them.
+	var handoffActors []*activatedActor
+	if r.opts.Handoff.Enabled {
+		handoffActors = r.activations.activatedActors()
+		r.handoffs.add(handoffActors...)
+	}
+
+	// From now on invocations that are routed here by stale activation caches are
+	// rerouted to the actor's new location instead of reactivating it here.
+	r.drained.Store(true)
+
+	if r.opts.Handoff.Enabled {
+		r.handoffActors(ctx, handoffActors)
+	}
+
+	// Deactivation hooks are bounded by ActorDeactivationTimeout so wait for them even
+	// if ctx is done since stopping the process before they complete would lose any
+	// state they're flushing.
+	<-r.activations.deactivateAll("drained")
+
+	if waitErr != nil {
+		return fmt.Errorf("Drain: error waiting for in-flight invocations: %w", waitErr)
+	}
+	return nil
+}
+
+// waitForInFlightInvocations waits until there are no invocations in-flight, or until ctx
+// is done.
+func (r *environment) waitForInFlightInvocations(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		inFlight := r.inFlight.Load()
+		if inFlight == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d invocations still in-flight: %w", inFlight, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// isMovingAway returns whether invocations of the actor that are routed to this server
+// must be rerouted to the actor's new location, because this server has been drained or
+// because the actor is being handed off.
+func (r *environment) isMovingAway(actorID types.NamespacedActorID) bool {
+	return r.drained.Load() || r.handoffs.isPending(actorID)
+}
+
+// rerouteMovedActor invokes the actor on the server that the registry activates it on
+// now that this server has been drained, or has handed the actor off.
+func (r *environment) rerouteMovedActor(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	operation string,
+	payload []byte,
+	create types.CreateIfNotExist,
+) (io.ReadCloser, error) {
+	var (
+		namespace = reference.Namespace()
+		moduleID  = reference.ModuleID().ID
+		actorID   = reference.ActorID().ID
+	)
+	// Don't route the invocation to the actor's new location before its in-memory state
+	// has been handed off there.
+	if err := r.handoffs.wait(ctx, reference.ActorID()); err != nil {
+		return nil, err
+	}
+
+	// The cached activation (if any) most likely points to this server.
+	r.activationsCache.delete(namespace, moduleID, actorID)
+
+	vs, err := r.registry.GetVersionStamp(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting version stamp: %w", err)
+	}
+	references, err := r.activationsCache.ensureActivation(ctx, namespace, moduleID, actorID)
+	if err != nil {
+		return nil, err
+	}
+	if len(references) == 0 {
+		return nil, fmt.Errorf(
+			"ensureActivation() success with 0 references for actor ID: %s", actorID)
+	}
+	if references[0].ServerID() == r.serverID && r.drained.Load() {
+		return nil, fmt.Errorf(
+			"%w: cannot invoke actor: %v, registry activated it on this server",
+			errServerDrained, reference)
+	}
+
+	return r.invokeReferences(ctx, vs, references, operation, payload, create)
+}
@@ -0,0 +1,204 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestDrain ensures that draining an environment waits for in-flight invocations, runs the
+// deactivation hooks of its actors, stops new actors from being placed on it, and reroutes
+// invocations that are still routed to it to the actor's new location.
+func TestDrain(t *testing.T) {
+	var (
+		reg    = localregistry.NewLocalRegistry()
+		ctx    = context.Background()
+		module = &testDeactivatorModule{}
+		id     = types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}
+	)
+	opts1 := defaultOptsGoByte
+	opts1.Discovery.Port = 18
+	env1, err := NewEnvironment(ctx, "serverID1", reg, nil, opts1)
+	require.NoError(t, err)
+	defer env1.Close()
+	require.NoError(t, env1.RegisterGoModule(id, module))
+
+	// Activate the actor on env1 before env2 exists so it's the only candidate.
+	result, err := env1.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	opts2 := defaultOptsGoByte
+	opts2.Discovery.Port = 19
+	env2, err := NewEnvironment(ctx, "serverID2", reg, nil, opts2)
+	require.NoError(t, err)
+	defer env2.Close()
+	require.NoError(t, env2.RegisterGoModule(id, module))
+
+	// Start an invocation that doesn't complete until blockCtx is canceled.
+	blockCtx, cancelBlock := context.WithCancel(ctx)
+	defer cancelBlock()
+	blockDoneCh := make(chan struct{})
+	go func() {
+		defer close(blockDoneCh)
+		env1.InvokeActor(blockCtx, "ns-1", "a", "test-module", "block", nil, types.CreateIfNotExist{})
+	}()
+	require.Eventually(t, func() bool {
+		return env1.(*environment).inFlight.Load() == 1
+	}, 5*time.Second, time.Millisecond)
+
+	// Drain should wait for the in-flight invocation.
+	drainErrCh := make(chan error, 1)
+	go func() {
+		drainErrCh <- env1.Drain(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-drainErrCh:
+		t.Fatalf("Drain returned before in-flight invocations completed: %v", err)
+	default:
+	}
+	cancelBlock()
+	<-blockDoneCh
+	require.NoError(t, <-drainErrCh)
+	require.Equal(t, int64(1), module.numDeactivations.Load())
+	require.Equal(t, 0, env1.numActivatedActors())
+
+	// env1's activation cache still points to itself, but the invocation is rerouted to
+	// env2 where the actor is reactivated.
+	result, err = env1.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+	require.Equal(t, 0, env1.numActivatedActors())
+	require.Equal(t, 1, env2.numActivatedActors())
+
+	// New actors are not placed on env1 even though it has fewer activated actors.
+	_, err = env1.InvokeActor(ctx, "ns-1", "b", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, 0, env1.numActivatedActors())
+	require.Equal(t, 2, env2.numActivatedActors())
+
+	// Draining an environment that is waiting on invocations gives up once ctx is done.
+	blockCtx, cancelBlock = context.WithCancel(ctx)
+	defer cancelBlock()
+	go env2.InvokeActor(blockCtx, "ns-1", "a", "test-module", "block", nil, types.CreateIfNotExist{})
+	require.Eventually(t, func() bool {
+		return env2.(*environment).inFlight.Load() == 1
+	}, 5*time.Second, time.Millisecond)
+	drainCtx, cc := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cc()
+	drainErrCh = make(chan error, 1)
+	go func() {
+		drainErrCh <- env2.Drain(drainCtx)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	// The deactivation hooks can't run until the blocked invocation completes.
+	cancelBlock()
+	require.ErrorIs(t, <-drainErrCh, context.DeadlineExceeded)
+}
+
+// TestDrainHandoff ensures that draining an environment with handoffs enabled transfers
+// the in-memory state of its actors to the servers they're moved to, and that actors that
+// don't support snapshots fall back to starting from their persisted state.
+func TestDrainHandoff(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts1 := defaultOptsGoByte
+	opts1.Discovery.Port = 35
+	opts1.Handoff.Enabled = true
+	env1, err := NewEnvironment(ctx, "serverID1", reg, nil, opts1)
+	require.NoError(t, err)
+	defer env1.Close()
+
+	opts2 := opts1
+	opts2.Discovery.Port = 36
+	registerModules := func(env Environment) {
+		require.NoError(t, env.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+		require.NoError(t, env.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: "ns-1", ID: "no-snapshot-module"}, testNoSnapshotModule{}))
+	}
+	registerModules(env1)
+
+	// Activate the actors on env1 before env2 exists so it's the only candidate.
+	for _, moduleID := range []string{"test-module", "no-snapshot-module"} {
+		for i := 0; i < 3; i++ {
+			_, err := env1.InvokeActor(ctx, "ns-1", "a", moduleID, "inc", nil, types.CreateIfNotExist{})
+			require.NoError(t, err)
+		}
+	}
+
+	env2, err := NewEnvironment(ctx, "serverID2", reg, nil, opts2)
+	require.NoError(t, err)
+	defer env2.Close()
+	registerModules(env2)
+
+	require.NoError(t, env1.Drain(ctx))
+	require.Equal(t, 0, env1.numActivatedActors())
+	require.Equal(t, 1, env2.numActivatedActors())
+
+	// The invocation is rerouted from env1 to env2 where the actor's state was restored.
+	result, err := env1.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(4), getCount(t, result))
+	result, err = env2.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(5), getCount(t, result))
+
+	// The actor that doesn't support snapshots starts cold.
+	result, err = env2.InvokeActor(ctx, "ns-1", "a", "no-snapshot-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	// Actors that are already activated can't be restored.
+	env2Impl := env2.(*environment)
+	env2Impl.heartbeatState.RLock()
+	heartbeatResult := env2Impl.heartbeatState.HeartbeatResult
+	env2Impl.heartbeatState.RUnlock()
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+	err = env2.RestoreActorDirect(
+		ctx, heartbeatResult.VersionStamp, "serverID2", heartbeatResult.ServerVersion, ref, []byte("10"))
+	require.ErrorIs(t, err, errActorAlreadyActivated)
+}
+
+// testNoSnapshotModule is the same as testModule, except its actors don't support
+// snapshots.
+type testNoSnapshotModule struct {
+	testModule
+}
+
+func (tm testNoSnapshotModule) Instantiate(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	payload []byte,
+	host HostCapabilities,
+) (Actor, error) {
+	return &testNoSnapshotActor{testActor: &testActor{host: host}}, nil
+}
+
+type testNoSnapshotActor struct {
+	*testActor
+}
+
+func (ta *testNoSnapshotActor) Invoke(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+	transaction registry.ActorKVTransaction,
+) ([]byte, error) {
+	if operation == wapcutils.SnapshotOperationName {
+		return nil, errors.New("snapshots are not supported")
+	}
+	return ta.testActor.Invoke(ctx, operation, payload, transaction)
+}
@@ -7,15 +7,21 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
+	"os"
+	"path/filepath"
+	"runtime/metrics"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/richardartoul/nola/durable"
+	"github.com/richardartoul/nola/durable/durablewazero"
 	"github.com/richardartoul/nola/virtual/registry"
 	"github.com/richardartoul/nola/virtual/registry/dnsregistry"
 	"github.com/richardartoul/nola/virtual/types"
-
-	"github.com/dgraph-io/ristretto"
+	"github.com/richardartoul/nola/wapcutils"
 )
 
 const (
@@ -23,25 +29,58 @@ const (
 
 	heartbeatTimeout           = registry.HeartbeatTTL
 	defaultActivationsCacheTTL = heartbeatTimeout
-	maxNumActivationsToCache   = 1e6 // 1 Million.
 )
 
 type environment struct {
 	// State.
-	activations     *activations // Internally synchronized.
-	activationCache *ristretto.Cache
+	activations      *activations      // Internally synchronized.
+	activationsCache *activationsCache // Internally synchronized.
 
 	heartbeatState struct {
 		sync.RWMutex
 		registry.HeartbeatResult
+		health heartbeatHealth
 		frozen bool
 		paused bool
+		// lastVersionStamp is the versionstamp of the last successful heartbeat, and
+		// versionStampRegressions is the number of heartbeats whose versionstamp was
+		// lower than the one of the heartbeat before them.
+		lastVersionStamp        int64
+		versionStampRegressions uint64
 	}
 
+	// Number of invocations that are currently being executed by this environment.
+	inFlight atomic.Int64
+	// Configuration of every namespace.
+	configs *namespaceConfigs
+	// Mirrors invocations to their shadow modules.
+	shadower *shadower
+
+	// Set once Drain() has been called.
+	draining atomic.Bool
+	// Set once Drain() has waited for in-flight invocations to complete. Invocations
+	// of actors that are received afterwards are rerouted to other servers.
+	drained atomic.Bool
+	// Actors that are being handed off to other servers by Drain().
+	handoffs pendingHandoffs
+	// Leases of the actors that are activated on this server, if the registry grants them.
+	leases activationLeases
+	// Notifies actors of membership changes, or nil if MembershipOptions.Enabled is not set.
+	membership *membershipNotifier
+	// Mailboxes of the actors that tells were accepted for.
+	mailboxes *tellMailboxes
+	// Unregisters the environment from the health checks of its RemoteClient, or nil if
+	// the client doesn't check the health of servers (see ServerHealthChecker).
+	unregisterHealthChecks func()
+
 	// Closed when the background heartbeating goroutine should be shut down.
 	closeCh chan struct{}
 	// Closed when the background heartbeating goroutine completes shutting down.
 	closedCh chan struct{}
+	// Closed when the background reminders goroutine completes shutting down.
+	remindersClosedCh chan struct{}
+	// Closed when the background registry watching goroutine completes shutting down.
+	registryWatchClosedCh chan struct{}
 
 	// Dependencies.
 	serverID string
@@ -66,6 +105,8 @@ type EnvironmentOptions struct {
 	ActivationCacheTTL time.Duration
 	// DisableActivationCache disables the activation cache.
 	DisableActivationCache bool
+	// ActivationsCache contains the options for the activation cache.
+	ActivationsCache ActivationsCacheOptions
 	// Discovery contains the discovery options.
 	Discovery DiscoveryOptions
 	// ForceRemoteProcedureCalls forces the environment to *always* invoke
@@ -90,7 +131,219 @@ type EnvironmentOptions struct {
 	// A value of 0 will be ignored and replaced with the default value of
 	// DefaultGCActorsAfterDurationWithNoInvocations. To disable this
 	// functionality entirely, just use a really large value.
+	//
+	// Deprecated: Use ActorIdleTimeout instead, which takes precedence if set.
 	GCActorsAfterDurationWithNoInvocations time.Duration
+
+	// ActorIdleTimeout is the duration after which an activated actor that receives no
+	// invocations is deactivated to free its memory (for WASM actors, its instance).
+	// Deactivated actors run their deactivation hooks (OnDeactivate, if they implement
+	// ActorDeactivator, and their shutdown operation) and are re-instantiated by their
+	// next invocation. Note that timers don't count as invocations.
+	//
+	// A value of 0 will be ignored and replaced with the value of
+	// GCActorsAfterDurationWithNoInvocations (or its default of 1 minute).
+	ActorIdleTimeout time.Duration
+
+	// ActorDeactivationTimeout is the grace period that an actor is given to run its
+	// deactivation hooks (OnDeactivate, if it implements ActorDeactivator, and its
+	// shutdown operation) before the server stops waiting for it. This prevents a
+	// misbehaving actor from blocking the deactivation of other actors forever.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 5 seconds.
+	ActorDeactivationTimeout time.Duration
+
+	// InvokeTimeout is the maximum amount of wall-clock time that a single actor
+	// invocation can run for. Invocations that exceed it are canceled (WASM actors are
+	// interrupted, Go actors must honor context cancellation), fail with an error for
+	// which IsInvocationTimeoutErr returns true, and the actor is torn down so that
+	// subsequent invocations reactivate it in a clean state.
+	//
+	// A value of 0 disables the timeout.
+	InvokeTimeout time.Duration
+
+	// MaxCachedModules is the maximum number of compiled WASM modules that will be
+	// cached. All the activations of a module (and of modules with identical bytes) share
+	// a single compiled module, and the least recently used compiled modules with no
+	// activations are evicted once this limit is exceeded.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 1000.
+	MaxCachedModules int
+
+	// MaxActivations is the maximum number of actors that the server will host at once.
+	// It's advertised to the registry in the server's heartbeats so that new actors are
+	// placed on other servers once it's reached. Activations that race with the
+	// heartbeats and exceed it anyways are rejected with an error for which
+	// IsServerAtCapacityErr returns true, and the invocations that caused them are
+	// rerouted to a different server. Workers don't count towards the limit.
+	//
+	// A value of 0 disables the limit.
+	MaxActivations int
+
+	// MaxMailboxDepth is the maximum number of invocations of each actor that wait for
+	// the actor to process the invocations that arrived before them. Every actor
+	// processes its invocations one at a time in the order in which they arrive at the
+	// server (through its mailbox), so actors never have to synchronize their own state,
+	// while invocations of different actors run in parallel. Invocations that arrive
+	// once an actor's mailbox is full are rejected with an error for which
+	// IsActorMailboxFullErr returns true instead of piling up behind a slow actor.
+	//
+	// The tells that the server buffers (see TellOptions) only enter the mailbox once
+	// they're delivered, so they don't count towards the limit while they're buffered.
+	//
+	// A value of 0 disables the limit.
+	MaxMailboxDepth int
+
+	// Fuel contains the options for limiting the amount of fuel that invocations of
+	// WASM actors can consume.
+	Fuel FuelOptions
+
+	// MemoryLimits contains the options for limiting the amount of linear memory that
+	// each WASM actor can use.
+	MemoryLimits MemoryLimitOptions
+
+	// WASMRuntime is the runtime that is used to compile and run WASM modules. Note
+	// that Fuel, MemoryLimits, InvokeTimeout and CompilationCache depend on features that not every
+	// runtime supports (see the documentation of each runtime). Modules will fail to load
+	// if they require features that the runtime doesn't support.
+	//
+	// If nil, durablewazero.NewRuntime() will be used.
+	WASMRuntime durable.WASMRuntime
+
+	// CompilationCache contains the options for persisting compiled WASM modules on disk
+	// so that they don't have to be recompiled when the server restarts.
+	CompilationCache CompilationCacheOptions
+
+	// ReminderPollInterval is the interval at which the environment claims the reminders
+	// that are due from the registry and fires them. Reminders can fire up to
+	// ReminderPollInterval after their due time.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 1 second.
+	ReminderPollInterval time.Duration
+
+	// MaxInvocationDepth is the maximum length of a chain of actor-to-actor invocations
+	// (actor A invokes actor B, which invokes actor C, etc). Invocations that would
+	// exceed it fail immediately so that actors that (directly or indirectly) keep
+	// invoking each other can't recurse forever.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 16.
+	MaxInvocationDepth int
+
+	// Tracer is used to trace invocations, including the resolution of actor activations
+	// and invocations that are forwarded to other servers (as long as they use the same
+	// Tracer). See the Tracer interface for how to use OpenTelemetry.
+	//
+	// If nil, invocations are not traced and tracing has no overhead.
+	Tracer Tracer
+
+	// ServerLoad returns the current load of the server which is reported to the
+	// registry with every heartbeat so that registries configured with the
+	// registry.PlacementStrategyLeastLoaded placement strategy can place new activations
+	// on the least loaded servers. Higher values indicate more load. It must be safe
+	// for concurrent use.
+	//
+	// If nil, the number of bytes in use by the Go heap will be reported.
+	ServerLoad func() float64
+
+	// Logger is the logger that actors log to with HostCapabilities.Log (or the
+	// wapcutils.LogOperationName host function for WASM actors). Every entry is annotated
+	// with the namespace, module ID and actor ID of the actor that logged it, and entries
+	// below the logger's level are dropped.
+	//
+	// If nil, slog.Default() will be used.
+	Logger *slog.Logger
+
+	// ActorMetrics contains the options for the custom metrics that actors emit.
+	ActorMetrics ActorMetricsOptions
+
+	// ActorFS contains the options for the file systems that are mounted into the WASI
+	// context of WASM actors.
+	ActorFS ActorFSOptions
+
+	// NamespaceConfigs contains the configuration (API endpoints, feature flags, etc)
+	// of each namespace which actors can read with HostCapabilities.GetConfig (or the
+	// wapcutils.GetConfigOperationName host function for WASM actors) instead of
+	// receiving it in every invocation payload. It can be replaced at runtime with
+	// Environment.ReloadNamespaceConfigs.
+	NamespaceConfigs map[string]NamespaceConfig
+
+	// Idempotency contains the options for deduplicating invocations that carry an
+	// idempotency key (see WithIdempotencyKey).
+	Idempotency IdempotencyOptions
+
+	// RegistryStalenessTolerance is how long the server can go without heartbeating the
+	// registry successfully before Environment.Health reports the registry as
+	// unreachable (and the server as not ready).
+	//
+	// A value of 0 will be ignored and replaced with the value of ActivationCacheTTL,
+	// which is how long the activation cache tolerates not hearing from the registry.
+	RegistryStalenessTolerance time.Duration
+
+	// Compression contains the options for compressing the payloads of invocations that
+	// are sent over the network.
+	Compression CompressionOptions
+
+	// PersistInstantiatePayloads controls whether the instantiate payloads of actors
+	// (see types.CreateIfNotExist.InstantiatePayload) are persisted in the registry.
+	// When enabled, activations that are triggered by an invocation that provides an
+	// instantiate payload persist it, and activations that are triggered by invocations
+	// that don't provide one (for example after the actor migrated to a different server
+	// or was deactivated for being idle) are instantiated with the persisted payload
+	// instead of an empty one. Workers are not affected.
+	//
+	// This requires a registry that supports persisting instantiate payloads (the DNS
+	// registry doesn't), and it costs an extra registry round-trip per activation.
+	PersistInstantiatePayloads bool
+
+	// RateLimits contains the options for limiting the rate at which each actor is
+	// invoked.
+	RateLimits RateLimitOptions
+
+	// Shadow contains the options for mirroring a sample of the invocations of actors
+	// to shadow actors of a different module version.
+	Shadow ShadowOptions
+
+	// Handoff contains the options for handing off the in-memory state of actors to the
+	// servers they're moved to, for example when the environment is drained.
+	Handoff HandoffOptions
+
+	// Membership contains the options for notifying actors of changes to the set of
+	// servers in the cluster.
+	Membership MembershipOptions
+
+	// Scheduler contains the options for limiting the number of invocations that are
+	// executed concurrently and prioritizing the ones that are queued.
+	Scheduler SchedulerOptions
+
+	// Tell contains the options for fire-and-forget invocations of actors.
+	Tell TellOptions
+
+	// NamespaceQuotas contains the options for limiting the resources that the actors of
+	// each namespace can use.
+	NamespaceQuotas NamespaceQuotaOptions
+
+	// Recording contains the options for recording the invocations of WASM actors so that
+	// they can be replayed with Replay.
+	Recording RecordingOptions
+
+	// HTTPEgress contains the options for the HTTP requests that actors make through the
+	// server.
+	HTTPEgress HTTPEgressOptions
+
+	// Quarantine contains the options for quarantining actors that trap repeatedly.
+	Quarantine QuarantineOptions
+
+	// ResponseCache contains the options for caching the responses of operations that
+	// are pure reads.
+	ResponseCache ResponseCacheOptions
+
+	// Lifecycle contains the options for publishing the lifecycle events of actors (see
+	// Environment.SubscribeLifecycle).
+	Lifecycle LifecycleOptions
+
+	// StateCompression contains the options for compressing the values that actors store
+	// in their KV storage.
+	StateCompression StateCompressionOptions
 }
 
 // NewDNSRegistryEnvironment is a convenience function that creates a virtual environment backed
@@ -159,6 +412,176 @@ func (d *DiscoveryOptions) Validate() error {
 	return nil
 }
 
+// FuelOptions contains the options for limiting the amount of fuel that invocations of
+// WASM actors can consume. One unit of fuel is consumed on every WASM function call and on
+// every iteration of every loop (so tight loops are metered too), and invocations that
+// exhaust their fuel fail with an error that wraps durablewazero.ErrFuelExhausted
+// instead of running forever. Actors can query their remaining fuel with the
+// wapcutils.RemainingFuelOperationName host function to checkpoint before they run out.
+//
+// Modules with no fuel limit are not metered at all. Note that the limit for a module
+// is resolved when the module is first loaded by the environment, so changes to the
+// limits of modules that have already been loaded have no effect.
+type FuelOptions struct {
+	// DefaultLimit is the fuel limit for invocations of all modules that don't have a
+	// more specific limit configured. A value of 0 means no limit.
+	DefaultLimit int64
+	// NamespaceLimits contains per-namespace fuel limits that override DefaultLimit.
+	NamespaceLimits map[string]int64
+	// ModuleLimits contains per-module fuel limits that override NamespaceLimits and
+	// DefaultLimit.
+	ModuleLimits map[types.NamespacedIDNoType]int64
+}
+
+func (f *FuelOptions) Validate() error {
+	if f.DefaultLimit < 0 {
+		return fmt.Errorf("DefaultLimit must be >= 0")
+	}
+	for namespace, limit := range f.NamespaceLimits {
+		if limit < 0 {
+			return fmt.Errorf("NamespaceLimits for namespace: %s must be >= 0", namespace)
+		}
+	}
+	for moduleID, limit := range f.ModuleLimits {
+		if limit < 0 {
+			return fmt.Errorf("ModuleLimits for module: %v must be >= 0", moduleID)
+		}
+	}
+	return nil
+}
+
+// limit returns the fuel limit for invocations of the provided module, or 0 if there
+// is no limit.
+func (f *FuelOptions) limit(namespace, moduleID string) int64 {
+	if limit, ok := f.ModuleLimits[types.NewNamespacedIDNoType(namespace, moduleID)]; ok {
+		return limit
+	}
+	if limit, ok := f.NamespaceLimits[namespace]; ok {
+		return limit
+	}
+	return f.DefaultLimit
+}
+
+// maxMemoryLimitPages is the maximum number of 64KiB pages that a WASM memory can have.
+const maxMemoryLimitPages = 65536
+
+// MemoryLimitOptions contains the options for limiting the amount of linear memory (in
+// 64KiB pages) that each WASM actor can use. The limit is enforced when the actor is
+// instantiated, and by refusing to grow its memory beyond the limit afterwards.
+// Modules that declare a larger memory than the limit fail to load, and invocations
+// that run into the limit fail with an error that wraps
+// durablewazero.ErrMemoryLimitExceeded. Actors that run into the limit are torn down
+// (like actors that exceed the invoke timeout) and reactivated by the next invocation.
+//
+// Modules with no memory limit can grow their memory up to the maximum size of WASM
+// memories (4GiB). Like fuel limits, the limit for a module is resolved when the module
+// is first loaded by the environment.
+type MemoryLimitOptions struct {
+	// DefaultLimit is the memory limit for all modules that don't have a more specific
+	// limit configured. A value of 0 means no limit.
+	DefaultLimit uint32
+	// NamespaceLimits contains per-namespace memory limits that override DefaultLimit.
+	NamespaceLimits map[string]uint32
+	// ModuleLimits contains per-module memory limits that override NamespaceLimits and
+	// DefaultLimit.
+	ModuleLimits map[types.NamespacedIDNoType]uint32
+}
+
+func (m *MemoryLimitOptions) Validate() error {
+	if m.DefaultLimit > maxMemoryLimitPages {
+		return fmt.Errorf("DefaultLimit must be <= %d", maxMemoryLimitPages)
+	}
+	for namespace, limit := range m.NamespaceLimits {
+		if limit > maxMemoryLimitPages {
+			return fmt.Errorf(
+				"NamespaceLimits for namespace: %s must be <= %d", namespace, maxMemoryLimitPages)
+		}
+	}
+	for moduleID, limit := range m.ModuleLimits {
+		if limit > maxMemoryLimitPages {
+			return fmt.Errorf(
+				"ModuleLimits for module: %v must be <= %d", moduleID, maxMemoryLimitPages)
+		}
+	}
+	return nil
+}
+
+// limit returns the memory limit (in pages) for actors of the provided module, or 0 if
+// there is no limit.
+func (m *MemoryLimitOptions) limit(namespace, moduleID string) uint32 {
+	if limit, ok := m.ModuleLimits[types.NewNamespacedIDNoType(namespace, moduleID)]; ok {
+		return limit
+	}
+	if limit, ok := m.NamespaceLimits[namespace]; ok {
+		return limit
+	}
+	return m.DefaultLimit
+}
+
+// ActorMetricsOptions contains the options for the custom metrics that actors emit with
+// HostCapabilities.MetricInc and HostCapabilities.MetricObserve (or the
+// wapcutils.MetricIncOperationName and wapcutils.MetricObserveOperationName host
+// functions for WASM actors). Metric names are sanitized to only contain characters that
+// are valid in Prometheus metric names and every metric is labeled with the namespace
+// and module ID of the actor that emitted it.
+type ActorMetricsOptions struct {
+	// Sink receives the metrics emitted by actors. If nil, metrics emitted by actors are
+	// discarded.
+	Sink MetricsSink
+	// MaxNamesPerModule is the maximum number of distinct metric names that the actors
+	// of each module can emit, which protects the monitoring backend from actors that
+	// generate metric names dynamically. Since metrics are labeled by module (and not by
+	// actor) the limit is shared by all the actors of a module. Emitting a metric with a
+	// new name once the limit is reached fails with an error for which
+	// IsTooManyMetricsErr returns true.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 100.
+	MaxNamesPerModule int
+}
+
+func (a *ActorMetricsOptions) Validate() error {
+	if a.MaxNamesPerModule < 0 {
+		return fmt.Errorf("MaxNamesPerModule must be >= 0")
+	}
+	return nil
+}
+
+// ActorFSOptions contains the options for the file systems that are mounted as the root
+// ("/") of the WASI file system of WASM actors. Go modules don't have a WASI context so
+// they're not affected by these options.
+type ActorFSOptions struct {
+	// Provider provides the file system of each actor. If nil, actors don't have access
+	// to a file system. The file system of an actor is released (and deleted, for
+	// providers with ephemeral backing) once the actor is deactivated.
+	Provider ActorFSProvider
+	// QuotaBytes is the maximum total size of the files in the file system of each actor.
+	// Writes that would grow the files beyond it fail with ENOSPC. If 0, the size of the
+	// files is not limited.
+	QuotaBytes int64
+}
+
+func (a *ActorFSOptions) Validate() error {
+	if a.QuotaBytes < 0 {
+		return fmt.Errorf("QuotaBytes must be >= 0")
+	}
+	return nil
+}
+
+// CompilationCacheOptions contains the options for the on-disk cache of compiled WASM
+// modules. Cached modules are keyed by the hash of their bytes so modules whose bytes
+// change are recompiled automatically, and the cache directory can safely be shared by
+// multiple processes on the same machine (see durablewazero.WithCompilationCache).
+type CompilationCacheOptions struct {
+	// Enabled enables the on-disk compilation cache.
+	Enabled bool
+	// Dir is the directory in which compiled modules are persisted. It will be created
+	// if it doesn't exist.
+	//
+	// An empty value will be ignored and replaced with the default value of
+	// "nola-compilation-cache" in the OS temp directory.
+	Dir string
+}
+
 func (e *EnvironmentOptions) Validate() error {
 	if err := e.Discovery.Validate(); err != nil {
 		return fmt.Errorf("error validating discovery options: %w", err)
@@ -168,6 +591,105 @@ func (e *EnvironmentOptions) Validate() error {
 		return fmt.Errorf("GCActorsAfterDurationWithNoInvocations must be >= 0")
 	}
 
+	if e.ActorIdleTimeout < 0 {
+		return fmt.Errorf("ActorIdleTimeout must be >= 0")
+	}
+
+	if e.ActorDeactivationTimeout < 0 {
+		return fmt.Errorf("ActorDeactivationTimeout must be >= 0")
+	}
+
+	if e.InvokeTimeout < 0 {
+		return fmt.Errorf("InvokeTimeout must be >= 0")
+	}
+
+	if e.MaxCachedModules < 0 {
+		return fmt.Errorf("MaxCachedModules must be >= 0")
+	}
+
+	if e.MaxActivations < 0 {
+		return fmt.Errorf("MaxActivations must be >= 0")
+	}
+	if e.MaxMailboxDepth < 0 {
+		return fmt.Errorf("MaxMailboxDepth must be >= 0")
+	}
+
+	if e.ReminderPollInterval < 0 {
+		return fmt.Errorf("ReminderPollInterval must be >= 0")
+	}
+
+	if e.MaxInvocationDepth < 0 {
+		return fmt.Errorf("MaxInvocationDepth must be >= 0")
+	}
+
+	if e.RegistryStalenessTolerance < 0 {
+		return fmt.Errorf("RegistryStalenessTolerance must be >= 0")
+	}
+
+	if err := e.ActivationsCache.Validate(); err != nil {
+		return fmt.Errorf("error validating activations cache options: %w", err)
+	}
+
+	if err := e.Fuel.Validate(); err != nil {
+		return fmt.Errorf("error validating fuel options: %w", err)
+	}
+
+	if err := e.MemoryLimits.Validate(); err != nil {
+		return fmt.Errorf("error validating memory limit options: %w", err)
+	}
+
+	if err := e.ActorMetrics.Validate(); err != nil {
+		return fmt.Errorf("error validating actor metrics options: %w", err)
+	}
+	if err := e.ActorFS.Validate(); err != nil {
+		return fmt.Errorf("error validating actor file system options: %w", err)
+	}
+	if err := e.Idempotency.Validate(); err != nil {
+		return fmt.Errorf("error validating idempotency options: %w", err)
+	}
+	if err := e.RateLimits.Validate(); err != nil {
+		return fmt.Errorf("error validating rate limit options: %w", err)
+	}
+	if err := e.Shadow.Validate(); err != nil {
+		return fmt.Errorf("error validating shadow options: %w", err)
+	}
+	if err := e.Compression.Validate(); err != nil {
+		return fmt.Errorf("error validating compression options: %w", err)
+	}
+	if err := e.Handoff.Validate(); err != nil {
+		return fmt.Errorf("error validating handoff options: %w", err)
+	}
+	if err := e.Membership.Validate(); err != nil {
+		return fmt.Errorf("error validating membership options: %w", err)
+	}
+	if err := e.Scheduler.Validate(); err != nil {
+		return fmt.Errorf("error validating scheduler options: %w", err)
+	}
+	if err := e.Tell.Validate(); err != nil {
+		return fmt.Errorf("error validating tell options: %w", err)
+	}
+	if err := e.NamespaceQuotas.Validate(); err != nil {
+		return fmt.Errorf("error validating namespace quota options: %w", err)
+	}
+	if err := e.Recording.Validate(); err != nil {
+		return fmt.Errorf("error validating recording options: %w", err)
+	}
+	if err := e.HTTPEgress.Validate(); err != nil {
+		return fmt.Errorf("error validating HTTP egress options: %w", err)
+	}
+	if err := e.Quarantine.Validate(); err != nil {
+		return fmt.Errorf("error validating quarantine options: %w", err)
+	}
+	if err := e.ResponseCache.Validate(); err != nil {
+		return fmt.Errorf("error validating response cache options: %w", err)
+	}
+	if err := e.Lifecycle.Validate(); err != nil {
+		return fmt.Errorf("error validating lifecycle options: %w", err)
+	}
+	if err := e.StateCompression.Validate(); err != nil {
+		return fmt.Errorf("error validating state compression options: %w", err)
+	}
+
 	return nil
 }
 
@@ -182,25 +704,102 @@ func NewEnvironment(
 	if opts.ActivationCacheTTL == 0 {
 		opts.ActivationCacheTTL = defaultActivationsCacheTTL
 	}
+	if opts.RegistryStalenessTolerance == 0 {
+		opts.RegistryStalenessTolerance = opts.ActivationCacheTTL
+	}
 	if opts.GCActorsAfterDurationWithNoInvocations == 0 {
 		opts.GCActorsAfterDurationWithNoInvocations = time.Minute
 	}
+	if opts.ActorIdleTimeout == 0 {
+		opts.ActorIdleTimeout = opts.GCActorsAfterDurationWithNoInvocations
+	}
+	if opts.ActorDeactivationTimeout == 0 {
+		opts.ActorDeactivationTimeout = 5 * time.Second
+	}
+	if opts.MaxCachedModules == 0 {
+		opts.MaxCachedModules = defaultMaxCachedModules
+	}
+	if opts.WASMRuntime == nil {
+		opts.WASMRuntime = durablewazero.NewRuntime()
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	configs := newNamespaceConfigs(opts.NamespaceConfigs)
+	if opts.Tracer != nil {
+		// Make sure the values of secrets never end up in traces.
+		opts.Tracer = newRedactingTracer(opts.Tracer, configs)
+	}
+	if opts.ActorMetrics.MaxNamesPerModule == 0 {
+		opts.ActorMetrics.MaxNamesPerModule = defaultMaxMetricNamesPerModule
+	}
+	if opts.CompilationCache.Dir == "" {
+		opts.CompilationCache.Dir = filepath.Join(os.TempDir(), "nola-compilation-cache")
+	}
+	if opts.ReminderPollInterval == 0 {
+		opts.ReminderPollInterval = defaultReminderPollInterval
+	}
+	if opts.MaxInvocationDepth == 0 {
+		opts.MaxInvocationDepth = defaultMaxInvocationDepth
+	}
+	if opts.Idempotency.MaxKeysPerActor == 0 {
+		opts.Idempotency.MaxKeysPerActor = defaultMaxIdempotencyKeysPerActor
+	}
+	if opts.Idempotency.TTL == 0 {
+		opts.Idempotency.TTL = defaultIdempotencyKeyTTL
+	}
+	if opts.Compression.MinSizeBytes == 0 {
+		opts.Compression.MinSizeBytes = defaultCompressionMinSizeBytes
+	}
+	if opts.Shadow.Timeout == 0 {
+		opts.Shadow.Timeout = defaultShadowTimeout
+	}
+	if opts.Shadow.MaxInFlight == 0 {
+		opts.Shadow.MaxInFlight = defaultMaxInFlightShadow
+	}
+	if opts.Shadow.Comparator == nil {
+		opts.Shadow.Comparator = newLoggingShadowComparator(opts.Logger)
+	}
+	if opts.Handoff.Timeout == 0 {
+		opts.Handoff.Timeout = defaultHandoffTimeout
+	}
+	if opts.Handoff.MaxConcurrency == 0 {
+		opts.Handoff.MaxConcurrency = defaultMaxConcurrentHandoffs
+	}
+	if opts.Membership.Debounce == 0 {
+		opts.Membership.Debounce = defaultMembershipDebounce
+	}
+	if opts.Tell.Delivery == "" {
+		opts.Tell.Delivery = TellDeliveryAtMostOnce
+	}
+	if opts.Tell.MailboxSize == 0 {
+		opts.Tell.MailboxSize = defaultTellMailboxSize
+	}
+	if opts.Tell.MaxAttempts == 0 {
+		opts.Tell.MaxAttempts = defaultTellMaxAttempts
+	}
+	if opts.Tell.RetryBackoff == 0 {
+		opts.Tell.RetryBackoff = defaultTellRetryBackoff
+	}
 
 	if err := opts.Validate(); err != nil {
 		return nil, fmt.Errorf("error validating EnvironmentOptions: %w", err)
 	}
 
-	activationCache, err := ristretto.NewCache(&ristretto.Config{
-		NumCounters: maxNumActivationsToCache * 10, // * 10 per the docs.
-		// Maximum number of entries in cache (~1million). Note that
-		// technically this is a measure in bytes, but we pass a cost of 1
-		// always to make it behave as a limit on number of activations.
-		MaxCost: 1e6,
-		// Recommended default.
-		BufferItems: 64,
-	})
+	activationsCache, err := newActivationsCache(
+		reg, opts.ActivationCacheTTL, opts.DisableActivationCache, opts.ActivationsCache)
+	if err != nil {
+		return nil, fmt.Errorf("error creating activationsCache: %w", err)
+	}
+	quotas := newNamespaceQuotas(opts.NamespaceQuotas)
+	activationsCache.quotas = quotas
+	events := newLifecycleBus(serverID, opts.Lifecycle, time.Now)
+	activationsCache.events = events
+	quarantine := newActorQuarantine(opts.Quarantine, time.Now)
+	quarantine.events = events
+	stateCompressor, err := newStateCompressor(opts.StateCompression)
 	if err != nil {
-		return nil, fmt.Errorf("error creating activationCache: %w", err)
+		return nil, fmt.Errorf("error creating state compressor: %w", err)
 	}
 
 	host := Localhost
@@ -214,17 +813,37 @@ func NewEnvironment(
 	address := fmt.Sprintf("%s:%d", host, opts.Discovery.Port)
 
 	env := &environment{
-		activationCache: activationCache,
-		closeCh:         make(chan struct{}),
-		closedCh:        make(chan struct{}),
-		registry:        reg,
-		client:          client,
-		address:         address,
-		serverID:        serverID,
-		opts:            opts,
+		activationsCache:      activationsCache,
+		closeCh:               make(chan struct{}),
+		closedCh:              make(chan struct{}),
+		remindersClosedCh:     make(chan struct{}),
+		registryWatchClosedCh: make(chan struct{}),
+		registry:              reg,
+		client:                client,
+		address:               address,
+		serverID:              serverID,
+		opts:                  opts,
+		configs:               configs,
+	}
+	env.shadower = &shadower{opts: opts.Shadow, invoke: env.InvokeActor}
+	env.mailboxes = newTellMailboxes(opts.Tell, env.deliverTell, env.redeliverTell)
+	if opts.Membership.Enabled {
+		env.membership = newMembershipNotifier(opts.Membership.Debounce, env.notifyMembershipChange)
+	}
+	var compilationCacheDir string
+	if opts.CompilationCache.Enabled {
+		compilationCacheDir = opts.CompilationCache.Dir
 	}
 	activations := newActivations(
-		reg, env, env.opts.CustomHostFns, opts.GCActorsAfterDurationWithNoInvocations)
+		reg, env, env.opts.CustomHostFns,
+		opts.ActorIdleTimeout, opts.ActorDeactivationTimeout,
+		opts.InvokeTimeout, opts.MaxInvocationDepth, opts.Fuel, opts.MemoryLimits,
+		opts.MaxCachedModules, opts.MaxActivations,
+		opts.WASMRuntime, compilationCacheDir, opts.Logger, newActorMetrics(opts.ActorMetrics),
+		newActorFileSystems(opts.ActorFS), configs, opts.Idempotency, opts.RateLimits,
+		opts.PersistInstantiatePayloads, env.membership, newInvocationScheduler(opts.Scheduler),
+		opts.MaxMailboxDepth, quotas, opts.Recording, newHTTPEgress(opts.HTTPEgress),
+		quarantine, newResponseCaches(opts.ResponseCache), events, stateCompressor)
 	env.activations = activations
 
 	// Skip confusing log if dnsregistry is being used since it doesn't use the registry-based
@@ -246,6 +865,10 @@ func NewEnvironment(
 	}
 	localEnvironmentsRouter[address] = env
 
+	if checker, ok := client.(ServerHealthChecker); ok {
+		env.unregisterHealthChecks = checker.OnServerUnhealthy(activationsCache.markServerUnreachable)
+	}
+
 	go func() {
 		defer close(env.closedCh)
 		ticker := time.NewTicker(1 * time.Second)
@@ -258,6 +881,7 @@ func NewEnvironment(
 				if err := env.heartbeat(); err != nil {
 					log.Printf("error performing background heartbeat: %v\n", err)
 				}
+				go env.renewActivationLeases()
 			case <-env.closeCh:
 				log.Printf(
 					"environment with serverID: %s and address: %s is shutting down\n",
@@ -266,16 +890,12 @@ func NewEnvironment(
 			}
 		}
 	}()
+	go env.remindersLoop()
+	go env.watchRegistry()
 
 	return env, nil
 }
 
-var bufPool = sync.Pool{
-	New: func() any {
-		return make([]byte, 0, 128)
-	},
-}
-
 func (r *environment) RegisterGoModule(id types.NamespacedIDNoType, module Module) error {
 	// Register all the GoModules in the registry so they're useable with calls to
 	// CreateActor() and EnsureActivation().
@@ -326,14 +946,48 @@ func (r *environment) InvokeActorStream(
 	payload []byte,
 	create types.CreateIfNotExist,
 ) (io.ReadCloser, error) {
+	shadowed, ok := r.shadower.maybeShadow(
+		ctx, namespace, actorID, moduleID, operation, payload, create)
+	result, err := r.invokeActorStream(
+		ctx, namespace, actorID, moduleID, operation, payload, create)
+	err = categorizeInvokeErr(err)
+	if ok {
+		return shadowed(result, err)
+	}
+	return result, err
+}
+
+func (r *environment) invokeActorStream(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	operation string,
+	payload []byte,
+	create types.CreateIfNotExist,
+) (_ io.ReadCloser, err error) {
+	ctx = withTracer(ctx, r.opts.Tracer)
+	ctx, span := startSpan(ctx, "nola.InvokeActor", namespace, moduleID, actorID)
+	span.setString(AttributeOperation, operation)
+	defer func() {
+		span.end(err)
+	}()
+
 	if namespace == "" {
-		return nil, errors.New("InvokeActor: namespace cannot be empty")
+		return nil, newInvalidInvokeError(errors.New("InvokeActor: namespace cannot be empty"))
 	}
 	if actorID == "" {
-		return nil, errors.New("InvokeActor: actorID cannot be empty")
+		return nil, newInvalidInvokeError(errors.New("InvokeActor: actorID cannot be empty"))
 	}
 	if moduleID == "" {
-		return nil, errors.New("InvokeActor: moduleID cannot be empty")
+		return nil, newInvalidInvokeError(errors.New("InvokeActor: moduleID cannot be empty"))
+	}
+
+	// Don't route the invocation to the actor's new location before its in-memory state
+	// has been handed off there.
+	err = r.handoffs.wait(ctx, types.NewNamespacedActorID(namespace, actorID, moduleID, types.IDTypeActor))
+	if err != nil {
+		return nil, err
 	}
 
 	vs, err := r.registry.GetVersionStamp(ctx)
@@ -341,48 +995,114 @@ func (r *environment) InvokeActorStream(
 		return nil, fmt.Errorf("error getting version stamp: %w", err)
 	}
 
-	bufIface := bufPool.Get()
-	defer bufPool.Put(bufIface)
-	cacheKey := bufPool.Get().([]byte)[:0]
-	cacheKey = append(cacheKey, []byte(namespace)...)
-	cacheKey = append(cacheKey, []byte(actorID)...)
+	references, err := r.activationsCache.ensureActivation(ctx, namespace, moduleID, actorID)
+	if err != nil {
+		return nil, err
+	}
+	if len(references) == 0 {
+		return nil, newRoutingError(fmt.Errorf(
+			"ensureActivation() success with 0 references for actor ID: %s", actorID))
+	}
+	ref := r.activationsCache.selectReference(ctx, namespace, moduleID, actorID, references)
+	span.setString(AttributeServerID, ref.ServerID())
+
+	result, err := r.invokeReferences(ctx, vs, []types.ActorReference{ref}, operation, payload, create)
+	if IsServerAtCapacityErr(err) && ref.IsReplica() {
+		// Replica reads can always be served by the primary.
+		primary := primaryReference(references)
+		return r.invokeReferences(ctx, vs, []types.ActorReference{primary}, operation, payload, create)
+	}
+	if IsServerAtCapacityErr(err) {
+		return r.rerouteFromServerAtCapacity(
+			ctx, namespace, moduleID, actorID, ref.ServerID(), operation, payload, create)
+	}
+	return result, err
+}
+
+func (r *environment) ActivationCacheStats() ActivationCacheStats {
+	return r.activationsCache.stats()
+}
 
-	var (
-		references  []types.ActorReference
-		referencesI any = nil
-		ok              = false
-	)
-	if !r.opts.DisableActivationCache {
-		referencesI, ok = r.activationCache.Get(cacheKey)
+func (r *environment) ActivationStats() ActivationStats {
+	return r.activations.stats()
+}
+
+func (r *environment) ModuleCacheStats() ModuleCacheStats {
+	return r.activations.moduleCache.stats()
+}
+
+func (r *environment) SchedulerStats() SchedulerStats {
+	return r.activations.scheduler.stats()
+}
+
+func (r *environment) NamespaceStats() map[string]NamespaceStats {
+	return r.activations.quotas.stats(
+		r.activations.namespaceActivations(), r.activationsCache.namespaceEntries())
+}
+
+func (r *environment) HTTPEgressStats() map[string]HTTPEgressStats {
+	return r.activations.egress.stats()
+}
+
+func (r *environment) QuarantinedActors() []QuarantinedActor {
+	return r.activations.quarantine.list()
+}
+
+func (r *environment) SubscribeLifecycle() <-chan LifecycleEvent {
+	return r.activations.events.subscribe()
+}
+
+func (r *environment) UnquarantineActor(namespace, moduleID, actorID string) bool {
+	return r.activations.quarantine.release(
+		types.NewNamespacedActorID(namespace, actorID, moduleID, types.IDTypeActor))
+}
+
+func (r *environment) PrefetchActivations(
+	ctx context.Context,
+	keys []ActivationKey,
+) map[ActivationKey]error {
+	return r.activationsCache.prefetchActivations(ctx, keys)
+}
+
+func (r *environment) WhereIs(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorID string,
+) (_ []types.ActorReference, err error) {
+	ctx = withTracer(ctx, r.opts.Tracer)
+	ctx, span := startSpan(ctx, "nola.WhereIs", namespace, moduleID, actorID)
+	defer func() {
+		span.end(err)
+	}()
+
+	if namespace == "" {
+		return nil, errors.New("WhereIs: namespace cannot be empty")
+	}
+	if actorID == "" {
+		return nil, errors.New("WhereIs: actorID cannot be empty")
+	}
+	if moduleID == "" {
+		return nil, errors.New("WhereIs: moduleID cannot be empty")
 	}
-	if ok {
-		references = referencesI.([]types.ActorReference)
-	} else {
-		var err error
-		// TODO: Need a concurrency limiter on this thing.
-		references, err = r.registry.EnsureActivation(ctx, namespace, actorID, moduleID)
-		if err != nil {
-			return nil, fmt.Errorf(
-				"error ensuring activation of actor: %s in registry: %w",
-				actorID, err)
-		}
 
-		// Note that we need to copy the cache key before we call Set() since it will be
-		// returned to the pool when this function returns.
-		cacheKeyClone := append([]byte(nil), cacheKey...)
+	return r.activationsCache.lookupActivation(ctx, namespace, moduleID, actorID)
+}
 
-		// Set a TTL on the cache entry so that if the generation count increases
-		// it will eventually get reflected in the system even if its not immediate.
-		// Note that the purpose the generation count is is for code/setting upgrades
-		// so it does not need to take effect immediately.
-		r.activationCache.SetWithTTL(cacheKeyClone, references, 1, r.opts.ActivationCacheTTL)
+func (r *environment) DescribeModule(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+) (wapcutils.ModuleDescription, error) {
+	if namespace == "" {
+		return wapcutils.ModuleDescription{}, errors.New("DescribeModule: namespace cannot be empty")
 	}
-	if len(references) == 0 {
-		return nil, fmt.Errorf(
-			"ensureActivation() success with 0 references for actor ID: %s", actorID)
+	if moduleID == "" {
+		return wapcutils.ModuleDescription{}, errors.New("DescribeModule: moduleID cannot be empty")
 	}
 
-	return r.invokeReferences(ctx, vs, references, operation, payload, create)
+	return r.activations.describeModule(
+		ctx, types.NewNamespacedID(namespace, moduleID, types.IDTypeActor))
 }
 
 func (r *environment) InvokeActorDirect(
@@ -419,9 +1139,54 @@ func (r *environment) InvokeActorDirectStream(
 	operation string,
 	payload []byte,
 	create types.CreateIfNotExist,
-) (io.ReadCloser, error) {
+) (_ io.ReadCloser, err error) {
+	ctx = withTracer(ctx, r.opts.Tracer)
+	ctx, span := startSpan(
+		ctx, "nola.InvokeActorDirect",
+		reference.Namespace(), reference.ModuleID().ID, reference.ActorID().ID)
+	span.setString(AttributeOperation, operation)
+	span.setString(AttributeServerID, r.serverID)
+	defer func() {
+		err = categorizeInvokeErr(err)
+		span.end(err)
+	}()
+
+	if err := r.checkDirectRequest(versionStamp, serverID, serverVersion); err != nil {
+		return nil, newRoutingError(err)
+	}
+
+	// TODO: Delete me, but useful for now.
+	// log.Printf("%d::%s:%s::%s::%s\n", versionStamp, serverID, reference.ModuleID().ID, reference.ActorID().ID, operation)
+
+	if r.isMovingAway(reference.ActorID()) {
+		return r.rerouteMovedActor(ctx, reference, operation, payload, create)
+	}
+
+	if delivery, ok := tellFromContext(ctx); ok {
+		return r.mailboxes.accept(ctx, &tell{
+			reference: reference,
+			operation: operation,
+			payload:   payload,
+			create:    create,
+			delivery:  delivery,
+		})
+	}
+
+	r.inFlight.Add(1)
+	defer r.inFlight.Add(-1)
+	return r.activations.invoke(ctx, reference, operation, create.InstantiatePayload, payload, false)
+}
+
+// checkDirectRequest ensures that a request that was routed directly to this server
+// (like InvokeActorDirect) was meant for this server, and that this server still owns
+// the actors that were activated on it when the request's versionstamp was observed.
+func (r *environment) checkDirectRequest(
+	versionStamp int64,
+	serverID string,
+	serverVersion int64,
+) error {
 	if serverID == "" {
-		return nil, errors.New("serverID cannot be empty")
+		return errors.New("serverID cannot be empty")
 	}
 	if serverID != r.serverID && serverID != dnsregistry.DNSServerID {
 		// Make sure the client has reached the server it intended. This is an important
@@ -440,23 +1205,20 @@ func (r *environment) InvokeActorDirectStream(
 		//       client should assert on that as well to avoid issues where the request
 		//       reaches the wrong application entirely and that application just returns
 		//       OK to everything.
-		return nil, fmt.Errorf(
+		return fmt.Errorf(
 			"request for serverID: %s received by server: %s, cannot fullfil",
 			serverID, r.serverID)
 	}
 	if versionStamp <= 0 {
-		return nil, fmt.Errorf("versionStamp must be >= 0, but was: %d", versionStamp)
+		return fmt.Errorf("versionStamp must be >= 0, but was: %d", versionStamp)
 	}
 
-	// TODO: Delete me, but useful for now.
-	// log.Printf("%d::%s:%s::%s::%s\n", versionStamp, serverID, reference.ModuleID().ID, reference.ActorID().ID, operation)
-
 	r.heartbeatState.RLock()
 	heartbeatResult := r.heartbeatState.HeartbeatResult
 	r.heartbeatState.RUnlock()
 
 	if heartbeatResult.VersionStamp+heartbeatResult.HeartbeatTTL < versionStamp {
-		return nil, fmt.Errorf(
+		return fmt.Errorf(
 			"InvokeLocal: server heartbeat(%d) + TTL(%d) < versionStamp(%d)",
 			heartbeatResult.VersionStamp, heartbeatResult.HeartbeatTTL, versionStamp)
 	}
@@ -465,12 +1227,12 @@ func (r *environment) InvokeActorDirectStream(
 	// the env hasn't missed a heartbeat recently, which could cause it to lose ownership of the actor.
 	// This bug was identified using this mode.l https://github.com/richardartoul/nola/blob/master/proofs/stateright/activation-cache/README.md
 	if heartbeatResult.ServerVersion != serverVersion {
-		return nil, fmt.Errorf(
+		return fmt.Errorf(
 			"InvokeLocal: server version(%d) != server version from reference(%d)",
 			heartbeatResult.ServerVersion, serverVersion)
 	}
 
-	return r.activations.invoke(ctx, reference, operation, create.InstantiatePayload, payload, false)
+	return nil
 }
 
 func (r *environment) InvokeWorker(
@@ -502,7 +1264,11 @@ func (r *environment) InvokeWorkerStream(
 	operation string,
 	payload []byte,
 	create types.CreateIfNotExist,
-) (io.ReadCloser, error) {
+) (_ io.ReadCloser, err error) {
+	defer func() {
+		err = categorizeInvokeErr(err)
+	}()
+
 	// TODO: The implementation of this function is nice because it just reusees a bunch of the
 	//       actor logic. However, it's also less performant than it could be because it still
 	//       effectively makes worker execution single-threaded per-server. We should add the
@@ -511,14 +1277,25 @@ func (r *environment) InvokeWorkerStream(
 	//       to activations.go.
 	ref, err := types.NewVirtualWorkerReference(namespace, moduleID, moduleID)
 	if err != nil {
-		return nil, fmt.Errorf("InvokeWorker: error creating actor reference: %w", err)
+		return nil, newInvalidInvokeError(
+			fmt.Errorf("InvokeWorker: error creating actor reference: %w", err))
 	}
 
 	// Workers provide none of the consistency / linearizability guarantees that actor's do, so we
 	// can bypass the registry entirely and just immediately invoke the function.
+	r.inFlight.Add(1)
+	defer r.inFlight.Add(-1)
 	return r.activations.invoke(ctx, ref, operation, create.InstantiatePayload, payload, false)
 }
 
+func (r *environment) BlacklistServer(serverID string, ttl time.Duration) {
+	r.activationsCache.blacklistServer(serverID, ttl)
+}
+
+func (r *environment) ReloadNamespaceConfigs(configs map[string]NamespaceConfig) {
+	r.configs.reload(configs)
+}
+
 func (r *environment) Close() error {
 	// TODO: This should call Close on the activations field (which needs to be implemented).
 
@@ -528,6 +1305,16 @@ func (r *environment) Close() error {
 
 	close(r.closeCh)
 	<-r.closedCh
+	<-r.remindersClosedCh
+	<-r.registryWatchClosedCh
+	if r.membership != nil {
+		r.membership.close()
+	}
+	r.mailboxes.close()
+	if r.unregisterHealthChecks != nil {
+		r.unregisterHealthChecks()
+	}
+	r.activations.events.close()
 
 	return nil
 }
@@ -542,8 +1329,15 @@ func (r *environment) heartbeat() error {
 	result, err := r.registry.Heartbeat(ctx, r.serverID, registry.HeartbeatState{
 		NumActivatedActors: r.numActivatedActors(),
 		Address:            r.address,
+		Load:               r.serverLoad(),
+		Draining:           r.draining.Load(),
+		MaxActivations:     r.opts.MaxActivations,
+		IncludeLiveServers: r.membership != nil,
 	})
 	if err != nil {
+		r.heartbeatState.Lock()
+		r.heartbeatState.health.lastErr = err
+		r.heartbeatState.Unlock()
 		return fmt.Errorf("error heartbeating: %w", err)
 	}
 
@@ -551,7 +1345,38 @@ func (r *environment) heartbeat() error {
 	if !r.heartbeatState.frozen {
 		r.heartbeatState.HeartbeatResult = result
 	}
+	r.heartbeatState.health = heartbeatHealth{lastSuccess: time.Now()}
+	// Heartbeats are sequential so their versionstamps must increase. The (lower)
+	// versionstamp of a regressed heartbeat is still used since it only makes
+	// checkDirectRequest() more conservative.
+	lastVersionStamp := r.heartbeatState.lastVersionStamp
+	regressed := result.VersionStamp < lastVersionStamp
+	if regressed {
+		r.heartbeatState.versionStampRegressions++
+	}
+	r.heartbeatState.lastVersionStamp = result.VersionStamp
 	r.heartbeatState.Unlock()
+	if regressed {
+		log.Printf(
+			"heartbeat versionstamp regressed from %d to %d, registry may be misbehaving or servers' clocks may be skewed\n",
+			lastVersionStamp, result.VersionStamp)
+	}
+
+	if r.membership != nil {
+		r.membership.observe(result.LiveServers)
+	}
+
+	_, prevServerVersion := r.activations.getServerState()
+	if prevServerVersion != 0 && prevServerVersion != result.ServerVersion {
+		// The server's heartbeat lapsed at some point so the registry may have placed
+		// the actors that were activated on this server elsewhere in the meantime. Stop
+		// hosting all of them (giving them a chance to flush their state) so that
+		// subsequent invocations that are routed here will reactivate them.
+		log.Printf(
+			"server version changed from %d to %d, deactivating all actors",
+			prevServerVersion, result.ServerVersion)
+		r.activations.deactivateAll("server_version_changed")
+	}
 
 	// Ensure the latest ServerVersion is set on the activation struct as well so
 	// that new calls to BeginTransaction() in the registry from actors will have
@@ -561,6 +1386,21 @@ func (r *environment) heartbeat() error {
 	return nil
 }
 
+// serverLoad returns the load that should be reported to the registry in heartbeats.
+func (r *environment) serverLoad() float64 {
+	if r.opts.ServerLoad != nil {
+		return r.opts.ServerLoad()
+	}
+
+	// Unlike runtime.ReadMemStats(), reading runtime/metrics does not stop the world.
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return float64(sample[0].Value.Uint64())
+}
+
 // TODO: This is kind of a giant hack, but it's really only used for testing. The idea is that
 // even when we're using local references, we still want to be able to create multiple
 // environments in memory that can all "route" to each other. To accomplish this, everytime an
@@ -580,6 +1420,24 @@ func (r *environment) invokeReferences(
 ) (io.ReadCloser, error) {
 	// TODO: Load balancing or some other strategy if the number of references is > 1?
 	ref := references[0]
+	result, err := r.invokeReference(ctx, versionStamp, ref, operation, payload, create)
+	if err != nil && isConnectionErr(err) {
+		r.activationsCache.reportDialFailure(ref.ServerID())
+		return r.invokeFailoverCandidates(ctx, versionStamp, ref, operation, payload, create, err)
+	}
+	r.activationsCache.reportDialSuccess(ref.ServerID())
+	return result, err
+}
+
+// invokeReference invokes the actor on the server that ref points to.
+func (r *environment) invokeReference(
+	ctx context.Context,
+	versionStamp int64,
+	ref types.ActorReference,
+	operation string,
+	payload []byte,
+	create types.CreateIfNotExist,
+) (io.ReadCloser, error) {
 	if !r.opts.ForceRemoteProcedureCalls {
 		// First check the global localEnvironmentsRouter map for scenarios where we're
 		// potentially trying to communicate between multiple different in-memory
@@ -616,6 +1474,7 @@ func (r *environment) invokeReferences(
 		}
 	}
 
+	ctx = withCompression(ctx, r.opts.Compression)
 	return r.client.InvokeActorRemote(ctx, versionStamp, ref, operation, payload, create)
 }
 
@@ -665,3 +1524,11 @@ func getSelfIP() (net.IP, error) {
 
 	return nil, errors.New("could not discovery self IPV4")
 }
+
+func (r *environment) compression() CompressionOptions {
+	return r.opts.Compression
+}
+
+func (r *environment) tracer() Tracer {
+	return r.opts.Tracer
+}
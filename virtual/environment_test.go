@@ -8,12 +8,15 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/richardartoul/nola/durable/durablewazero"
 	"github.com/richardartoul/nola/virtual/registry"
 	"github.com/richardartoul/nola/virtual/registry/localregistry"
 	"github.com/richardartoul/nola/virtual/types"
@@ -156,6 +159,51 @@ func TestCreateIfNotExistWithInstantiatePayload(t *testing.T) {
 	runWithDifferentConfigs(t, testFn, false, testGCActorsAfterDurationWithNoInvocations)
 }
 
+// TestPersistInstantiatePayloads ensures that actors that are reactivated by invocations
+// that don't provide an instantiate payload are instantiated with the persisted one.
+func TestPersistInstantiatePayloads(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 31
+	opts.ActorIdleTimeout = 100 * time.Millisecond
+	opts.PersistInstantiatePayloads = true
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	getInstantiatePayload := func(actorID string, create types.CreateIfNotExist) string {
+		result, err := env.InvokeActor(
+			ctx, "ns-1", actorID, "test-module", "getInstantiatePayload", nil, create)
+		require.NoError(t, err)
+		return string(result)
+	}
+	waitForDeactivation := func() {
+		require.Eventually(t, func() bool {
+			return env.ActivationStats().NumActivatedActors == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	for _, payload := range []string{"abc", "def"} {
+		require.Equal(t, payload, getInstantiatePayload(
+			"a", types.CreateIfNotExist{InstantiatePayload: []byte(payload)}))
+		waitForDeactivation()
+
+		require.Equal(t, payload, getInstantiatePayload("a", types.CreateIfNotExist{}))
+		waitForDeactivation()
+	}
+
+	// Actors that were never provided an instantiate payload don't have one.
+	require.Equal(t, "", getInstantiatePayload("b", types.CreateIfNotExist{}))
+	_, ok, err := reg.GetInstantiatePayload(ctx, "ns-1", "b", "test-module")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
 // TestSimpleWorker is a basic sanity test that verifies the most basic flow for workers.
 func TestSimpleWorker(t *testing.T) {
 	testFn := func(t *testing.T, reg registry.Registry, env Environment) {
@@ -786,6 +834,14 @@ func TestServerVersionIsHonored(t *testing.T) {
 	_, err = env1.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
 	require.NoError(t, err)
 
+	serverVersion := func() int64 {
+		env := env1.(*environment)
+		env.heartbeatState.RLock()
+		defer env.heartbeatState.RUnlock()
+		return env.heartbeatState.ServerVersion
+	}
+	prevServerVersion := serverVersion()
+
 	env1.pauseHeartbeat()
 
 	time.Sleep(registry.HeartbeatTTL + time.Second)
@@ -793,14 +849,371 @@ func TestServerVersionIsHonored(t *testing.T) {
 	env1.resumeHeartbeat()
 
 	require.NoError(t, env1.heartbeat())
+	require.Greater(t, serverVersion(), prevServerVersion)
 
 	_, err = env1.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
 	require.Equal(
 		t,
-		errors.New("error invoking actor: InvokeLocal: server version(2) != server version from reference(1)").Error(),
+		fmt.Errorf(
+			"error invoking actor: InvokeLocal: server version(%d) != server version from reference(%d)",
+			serverVersion(), prevServerVersion).Error(),
 		err.Error())
 }
 
+// TestActorDeactivation ensures that actors implementing ActorDeactivator have OnDeactivate
+// invoked when the server stops hosting them, and that a misbehaving actor can't block its
+// deactivation for longer than the configured grace timeout.
+func TestActorDeactivation(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 4
+	opts.ActorDeactivationTimeout = 100 * time.Millisecond
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	module := &testDeactivatorModule{}
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, module))
+
+	for i := 0; i < 3; i++ {
+		result, err := env.InvokeActor(
+			ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		require.Equal(t, int64(i+1), getCount(t, result))
+	}
+
+	env.(*environment).activations.deactivateAll("server_version_changed")
+	require.Equal(t, 0, env.numActivatedActors())
+	require.Eventually(t, func() bool {
+		return module.numDeactivations.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The actor should be reactivated with fresh in-memory state.
+	result, err := env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	// Closing an actor whose OnDeactivate never returns should give up after the
+	// deactivation timeout.
+	ref, err := types.NewVirtualWorkerReference("ns-1", "test-module", "b")
+	require.NoError(t, err)
+	blocking := &testDeactivatorActor{
+		testActor: &testActor{}, module: module, block: make(chan struct{})}
+	actor, err := newActivatedActor(
+		ctx, blocking, ref, nil, newActorTimers(), nil, time.Hour, 100*time.Millisecond, 0, nil, nil, nil, newActorMailbox(0, &mailboxStats{}), nil, nil, nil, func() {}, func() {}, func() {}, func() {}, func() {})
+	require.NoError(t, err)
+
+	start := time.Now()
+	err = actor.close(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 5*time.Second)
+	_, err = actor.invoke(ctx, "inc", nil, false, false)
+	require.Error(t, err)
+	close(blocking.block)
+}
+
+// TestActorIdleTimeout ensures that idle actors are deactivated (running their
+// deactivation hooks) after the idle timeout, and that invocations racing with idle
+// deactivations are served by a new activation instead of failing.
+func TestActorIdleTimeout(t *testing.T) {
+	var (
+		reg    = localregistry.NewLocalRegistry()
+		ctx    = context.Background()
+		module = &testDeactivatorModule{}
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 13
+	opts.ActorIdleTimeout = 100 * time.Millisecond
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, module))
+
+	for i := 0; i < 2; i++ {
+		result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		require.Equal(t, int64(i+1), getCount(t, result))
+	}
+	require.Equal(t, ActivationStats{NumActivatedActors: 1}, env.ActivationStats())
+
+	// ActorIdleTimeout takes precedence over GCActorsAfterDurationWithNoInvocations.
+	require.Eventually(t, func() bool {
+		return env.ActivationStats() == ActivationStats{IdleDeactivations: 1}
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, int64(1), module.numDeactivations.Load())
+
+	// The next invocation should reactivate the actor with fresh in-memory state.
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	// Simulate an invocation that looked up the activation right before it was
+	// deactivated for being idle.
+	activations := env.(*environment).activations
+	activations.Lock()
+	actorF := activations._actors[types.NewNamespacedActorID("ns-1", "a", "test-module", types.IDTypeActor)]
+	activations.Unlock()
+	actor, err := actorF.Wait()
+	require.NoError(t, err)
+	actor.Lock()
+	resultCh := make(chan error, 1)
+	go func() {
+		_, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+		resultCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, actor.closeWithLock(ctx))
+	actor._onAbort()
+	actor.Unlock()
+	require.NoError(t, <-resultCh)
+
+	// Invocations that arrive around the idle timeout should never fail.
+	for i := 0; i < 10; i++ {
+		time.Sleep(opts.ActorIdleTimeout + time.Duration(i*5)*time.Millisecond)
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := env.InvokeActor(
+					ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+				require.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+	}
+	require.Greater(t, env.ActivationStats().IdleDeactivations, uint64(1))
+}
+
+// TestActorDeactivateSelf ensures that actors that request to be deactivated with
+// DeactivateSelf() are deactivated (running their deactivation hooks) once the
+// invocation returns, and that the next invocation reactivates them from scratch.
+func TestActorDeactivateSelf(t *testing.T) {
+	var (
+		reg    = localregistry.NewLocalRegistry()
+		ctx    = context.Background()
+		module = &testDeactivatorModule{}
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 48
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, module))
+
+	for i := 0; i < 2; i++ {
+		result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		require.Equal(t, int64(i+1), getCount(t, result))
+	}
+
+	// The invocation that requests the deactivation is still served by the activation.
+	result, err := env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "incAndDeactivateSelf", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(3), getCount(t, result))
+	require.Eventually(t, func() bool {
+		return env.ActivationStats() == ActivationStats{SelfDeactivations: 1}
+	}, time.Second, time.Millisecond)
+	require.Equal(t, int64(1), module.numDeactivations.Load())
+
+	result, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	// DeactivateSelf() can only be called during an invocation.
+	require.Error(t, requestSelfDeactivation(ctx))
+}
+
+// TestActorLastInvokedAt ensures that actors can retrieve the time at which the previous
+// invocation of their activation started.
+func TestActorLastInvokedAt(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 61
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	lastInvokedAt := func(operation string) int64 {
+		result, err := env.InvokeActor(
+			ctx, "ns-1", "a", "test-module", operation, nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		if operation != "lastInvokedAt" {
+			return 0
+		}
+		unixMs, err := strconv.ParseInt(string(result), 10, 64)
+		require.NoError(t, err)
+		return unixMs
+	}
+
+	// The first invocation of the activation doesn't have a previous invocation.
+	require.Zero(t, lastInvokedAt("lastInvokedAt"))
+
+	before := time.Now().UnixMilli()
+	lastInvokedAt("inc")
+	after := time.Now().UnixMilli()
+	time.Sleep(10 * time.Millisecond)
+	unixMs := lastInvokedAt("lastInvokedAt")
+	require.GreaterOrEqual(t, unixMs, before)
+	require.LessOrEqual(t, unixMs, after)
+
+	// LastInvokedAt() can only be called during an invocation.
+	_, err = lastInvokedAtFromContext(ctx)
+	require.Error(t, err)
+}
+
+// TestFuel ensures that invocations of WASM actors are limited by the configured fuel
+// limits and fail with durablewazero.ErrFuelExhausted instead of running forever.
+func TestFuel(t *testing.T) {
+	fuel := FuelOptions{
+		DefaultLimit:    1_000_000,
+		NamespaceLimits: map[string]int64{"ns-2": 1},
+		ModuleLimits: map[types.NamespacedIDNoType]int64{
+			types.NewNamespacedIDNoType("ns-2", "unlimited-module"): 0,
+		},
+	}
+	require.NoError(t, fuel.Validate())
+	require.Equal(t, int64(1_000_000), fuel.limit("ns-1", "test-module"))
+	require.Equal(t, int64(1), fuel.limit("ns-2", "test-module"))
+	require.Equal(t, int64(0), fuel.limit("ns-2", "unlimited-module"))
+	require.Error(t, (&FuelOptions{DefaultLimit: -1}).Validate())
+
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsWASM
+	opts.Discovery.Port = 5
+	opts.Fuel = fuel
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	for _, ns := range []string{"ns-1", "ns-2"} {
+		for _, moduleID := range []string{"test-module", "unlimited-module"} {
+			_, err = reg.RegisterModule(ctx, ns, moduleID, utilWasmBytes, registry.ModuleOptions{})
+			require.NoError(t, err)
+		}
+	}
+
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	result, err = env.InvokeActor(ctx, "ns-2", "a", "unlimited-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	_, err = env.InvokeActor(ctx, "ns-2", "b", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.ErrorIs(t, err, durablewazero.ErrFuelExhausted)
+}
+
+// TestMemoryLimits ensures that the memory of WASM actors is limited by the configured
+// memory limits, and that actors that run into their limit fail with
+// durablewazero.ErrMemoryLimitExceeded and are torn down.
+func TestMemoryLimits(t *testing.T) {
+	memoryLimits := MemoryLimitOptions{
+		NamespaceLimits: map[string]uint32{"ns-1": 64},
+		ModuleLimits: map[types.NamespacedIDNoType]uint32{
+			types.NewNamespacedIDNoType("ns-1", "unlimited-module"): 0,
+		},
+	}
+	require.NoError(t, memoryLimits.Validate())
+	require.Equal(t, uint32(64), memoryLimits.limit("ns-1", "test-module"))
+	require.Equal(t, uint32(0), memoryLimits.limit("ns-1", "unlimited-module"))
+	require.Equal(t, uint32(0), memoryLimits.limit("ns-2", "test-module"))
+	require.Error(t, (&MemoryLimitOptions{DefaultLimit: maxMemoryLimitPages + 1}).Validate())
+
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsWASM
+	opts.Discovery.Port = 17
+	opts.MemoryLimits = memoryLimits
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	for _, moduleID := range []string{"test-module", "unlimited-module"} {
+		_, err = reg.RegisterModule(ctx, "ns-1", moduleID, utilWasmBytes, registry.ModuleOptions{})
+		require.NoError(t, err)
+	}
+
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "echo", make([]byte, 4<<20), types.CreateIfNotExist{})
+	require.ErrorIs(t, err, durablewazero.ErrMemoryLimitExceeded)
+	require.Equal(t, uint64(1), env.ActivationStats().MemoryLimitTraps)
+
+	// The actor was torn down so the next invocation reactivates it in a clean state.
+	result, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	result, err = env.InvokeActor(
+		ctx, "ns-1", "b", "unlimited-module", "echo", make([]byte, 4<<20), types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Len(t, result, 4<<20)
+}
+
+// TestInvokeTimeout ensures that invocations that exceed the configured invoke timeout are
+// canceled, fail with an error that can be distinguished from application errors, and that
+// the actor is torn down so it's reactivated in a clean state.
+func TestInvokeTimeout(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 6
+	opts.InvokeTimeout = 100 * time.Millisecond
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	for i := 0; i < 2; i++ {
+		result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		require.Equal(t, int64(i+1), getCount(t, result))
+	}
+	require.Equal(t, 1, env.numActivatedActors())
+
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "block", nil, types.CreateIfNotExist{})
+	require.True(t, IsInvocationTimeoutErr(err))
+	require.Equal(t, 0, env.numActivatedActors())
+
+	// Application errors are not timeouts.
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "unknown", nil, types.CreateIfNotExist{})
+	require.Error(t, err)
+	require.False(t, IsInvocationTimeoutErr(err))
+
+	// The actor was torn down so it should have been reactivated with fresh state.
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+}
+
 func getCount(t *testing.T, v []byte) int64 {
 	x, err := strconv.Atoi(string(v))
 	require.NoError(t, err)
@@ -889,6 +1302,77 @@ func runWithDifferentConfigs(
 	}
 }
 
+// TestReminders ensures that reminders fire (activating their actor wherever the
+// registry placed it) and can be listed and unregistered.
+func TestReminders(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	// Create 2 environments backed by the same registry so that reminders are claimed by
+	// both, but each firing is only delivered once.
+	var envs []Environment
+	for i, port := range []int{10, 11} {
+		opts := defaultOptsGoByte
+		opts.Discovery.Port = port
+		opts.ReminderPollInterval = 10 * time.Millisecond
+		env, err := NewEnvironment(ctx, fmt.Sprintf("serverID%d", i), reg, nil, opts)
+		require.NoError(t, err)
+		defer env.Close()
+		require.NoError(t, env.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+		envs = append(envs, env)
+	}
+	for _, env := range envs {
+		require.NoError(t, env.heartbeat())
+	}
+
+	getReminders := func(actorID string) string {
+		result, err := envs[0].InvokeActor(
+			ctx, "ns-1", actorID, "test-module", "getReminders", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		return string(result)
+	}
+
+	now := time.Now()
+	require.NoError(t, envs[0].RegisterReminder(
+		ctx, "ns-1", "a", "test-module", "once", now, 0))
+	require.NoError(t, envs[1].RegisterReminder(
+		ctx, "ns-1", "b", "test-module", "periodic", now, 50*time.Millisecond))
+	require.NoError(t, envs[0].RegisterReminder(
+		ctx, "ns-1", "c", "test-module", "later", now.Add(time.Hour), 0))
+
+	// The reminders fire without the actors ever having been invoked.
+	require.Eventually(t, func() bool {
+		return getReminders("a") == "once"
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return strings.HasPrefix(getReminders("b"), "periodic,periodic,periodic")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	reminders, err := envs[1].ListReminders(ctx, "ns-1", "a", "test-module")
+	require.NoError(t, err)
+	require.Empty(t, reminders)
+	reminders, err = envs[1].ListReminders(ctx, "ns-1", "b", "test-module")
+	require.NoError(t, err)
+	require.Len(t, reminders, 1)
+	require.Equal(t, 50*time.Millisecond, reminders[0].Period)
+	reminders, err = envs[1].ListReminders(ctx, "ns-1", "c", "test-module")
+	require.NoError(t, err)
+	require.Len(t, reminders, 1)
+	require.Equal(t, "later", reminders[0].Name)
+
+	// Unregistered reminders stop firing.
+	require.NoError(t, envs[1].UnregisterReminder(ctx, "ns-1", "b", "test-module", "periodic"))
+	// Wait for any firing that was claimed before the reminder was unregistered.
+	time.Sleep(100 * time.Millisecond)
+	fired := getReminders("b")
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, fired, getReminders("b"))
+	require.Equal(t, "once", getReminders("a"))
+	require.Equal(t, "", getReminders("c"))
+}
+
 type testModule struct {
 }
 
@@ -914,6 +1398,7 @@ type testActor struct {
 	count              int
 	startupWasCalled   bool
 	instantiatePayload []byte
+	reminders          []string
 }
 
 func (ta *testActor) Invoke(
@@ -924,10 +1409,15 @@ func (ta *testActor) Invoke(
 ) ([]byte, error) {
 	switch operation {
 	case wapcutils.StartupOperationName:
+		if string(ta.instantiatePayload) == "panic" {
+			panic("startup panic")
+		}
 		ta.startupWasCalled = true
 		return nil, nil
 	case wapcutils.ShutdownOperationName:
 		return nil, nil
+	case "panic":
+		panic(string(payload))
 	case "getInstantiatePayload":
 		return ta.instantiatePayload, nil
 	case "inc":
@@ -935,6 +1425,18 @@ func (ta *testActor) Invoke(
 		return []byte(strconv.Itoa(ta.count)), nil
 	case "getCount":
 		return []byte(strconv.Itoa(ta.count)), nil
+	case wapcutils.SnapshotOperationName:
+		return []byte(strconv.Itoa(ta.count)), nil
+	case wapcutils.RestoreOperationName:
+		count, err := strconv.Atoi(string(payload))
+		if err != nil {
+			return nil, err
+		}
+		ta.count = count
+		return nil, nil
+	case "block":
+		<-ctx.Done()
+		return nil, ctx.Err()
 	case "getStartupWasCalled":
 		if ta.startupWasCalled {
 			return []byte("true"), nil
@@ -971,6 +1473,81 @@ func (ta *testActor) Invoke(
 		return nil, err
 	case "invokeCustomHostFn":
 		return ta.host.CustomFn(ctx, string(payload), payload)
+	case "log":
+		var req wapcutils.Log
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+		ta.host.Log(ctx, slog.Level(req.Level), req.Message, "count", ta.count)
+		return nil, nil
+	case "echo":
+		return payload, nil
+	case "getConfig":
+		value, ok := ta.host.GetConfig(ctx, string(payload))
+		if !ok {
+			return nil, fmt.Errorf("config key: %s not found", payload)
+		}
+		return value, nil
+	case "metricInc", "metricObserve":
+		var req wapcutils.Metric
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+		if operation == "metricInc" {
+			return nil, ta.host.MetricInc(ctx, req.Name, req.Value)
+		}
+		return nil, ta.host.MetricObserve(ctx, req.Name, req.Value)
+	case wapcutils.ReceiveReminderOperationName:
+		var req wapcutils.ReceiveReminderRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+		ta.reminders = append(ta.reminders, req.Name)
+		return nil, nil
+	case "getReminders":
+		return []byte(strings.Join(ta.reminders, ",")), nil
+	case "incAndFailUntil":
+		// Increments the count and fails until it reaches the value of the payload.
+		until, err := strconv.Atoi(string(payload))
+		if err != nil {
+			return nil, err
+		}
+		ta.count++
+		if ta.count < until {
+			return nil, fmt.Errorf("count: %d < %d", ta.count, until)
+		}
+		return []byte(strconv.Itoa(ta.count)), nil
+	case "incAndDeactivateSelf":
+		if err := ta.host.DeactivateSelf(ctx); err != nil {
+			return nil, err
+		}
+		ta.count++
+		return []byte(strconv.Itoa(ta.count)), nil
+	case "httpFetch":
+		var req wapcutils.HTTPFetchRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+		resp, err := ta.host.HTTPFetch(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(&resp)
+	case "lastInvokedAt":
+		lastInvokedAt, err := ta.host.LastInvokedAt(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if lastInvokedAt.IsZero() {
+			return []byte("0"), nil
+		}
+		return []byte(strconv.FormatInt(lastInvokedAt.UnixMilli(), 10)), nil
+	case "fencingToken":
+		token, err := ta.host.FencingToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatUint(token, 10)), nil
 	default:
 		return nil, fmt.Errorf("testActor: unhandled operation: %s", operation)
 	}
@@ -1026,3 +1603,43 @@ func (ta *testStreamActor) InvokeStream(
 func (ta *testStreamActor) Close(ctx context.Context) error {
 	return nil
 }
+
+// Same as testModule, but its actors implement ActorDeactivator.
+type testDeactivatorModule struct {
+	numDeactivations atomic.Int64
+}
+
+func (tm *testDeactivatorModule) Instantiate(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	payload []byte,
+	host HostCapabilities,
+) (Actor, error) {
+	return &testDeactivatorActor{
+		testActor: &testActor{
+			host:               host,
+			instantiatePayload: payload,
+		},
+		module: tm,
+	}, nil
+}
+
+func (tm *testDeactivatorModule) Close(ctx context.Context) error {
+	return nil
+}
+
+type testDeactivatorActor struct {
+	*testActor
+
+	module *testDeactivatorModule
+	// If non-nil, OnDeactivate blocks until it is closed.
+	block chan struct{}
+}
+
+func (ta *testDeactivatorActor) OnDeactivate(ctx context.Context) error {
+	if ta.block != nil {
+		<-ta.block
+	}
+	ta.module.numDeactivations.Add(1)
+	return nil
+}
@@ -0,0 +1,53 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+// isConnectionErr returns whether err indicates that a connection to the server could not
+// be established, in which case the request never reached it and it's safe to send it
+// somewhere else.
+func isConnectionErr(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// invokeFailoverCandidates invokes the actor on the failover candidates of ref (see
+// ActivationsCacheOptions.NumFailoverCandidates), in order, because the server that ref
+// points to couldn't be reached. It stops at the first candidate that can be reached,
+// even if the invocation fails, and returns err if there are no candidates to try.
+func (r *environment) invokeFailoverCandidates(
+	ctx context.Context,
+	versionStamp int64,
+	ref types.ActorReference,
+	operation string,
+	payload []byte,
+	create types.CreateIfNotExist,
+	err error,
+) (io.ReadCloser, error) {
+	candidates := r.activationsCache.failoverCandidates(ref)
+	if len(candidates) == 0 {
+		return nil, err
+	}
+
+	r.activationsCache.failovers.Add(1)
+	for _, candidate := range candidates {
+		result, candidateErr := r.invokeReference(
+			ctx, versionStamp, candidate, operation, payload, create)
+		if candidateErr == nil || !isConnectionErr(candidateErr) {
+			r.activationsCache.reportDialSuccess(candidate.ServerID())
+			return result, candidateErr
+		}
+		r.activationsCache.reportDialFailure(candidate.ServerID())
+		err = fmt.Errorf(
+			"error invoking failover candidate on server: %s: %w, after: %v",
+			candidate.ServerID(), candidateErr, err)
+	}
+	return nil, err
+}
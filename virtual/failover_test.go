@@ -0,0 +1,92 @@
+package virtual
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestFailoverCandidates ensures that invocations that can't connect to the server that
+// hosts the actor are retried on the failover candidates that are not blacklisted,
+// without consulting the registry.
+func TestFailoverCandidates(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 44
+	opts.ActivationsCache.NumFailoverCandidates = 1
+	env, err := NewEnvironment(ctx, "serverID1", reg, NewHTTPClient(), opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	// Place the actor on a server that is heartbeating but that nothing listens on.
+	_, err = reg.Heartbeat(ctx, "unreachable", registry.HeartbeatState{Address: "127.0.0.1:1"})
+	require.NoError(t, err)
+	refs, err := reg.EnsureActivation(ctx, "ns-1", "a", "test-module", registry.EnsureActivationOptions{
+		BlacklistedServerIDs: []string{"serverID1"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "unreachable", refs[0].ServerID())
+
+	for i := 1; i <= 2; i++ {
+		result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		require.Equal(t, int64(i), getCount(t, result))
+	}
+	require.Equal(t, uint64(2), env.ActivationCacheStats().Failovers)
+	require.Equal(t, 1, env.ActivationStats().NumActivatedActors)
+
+	// Blacklisted candidates are not tried.
+	env.BlacklistServer("serverID1", time.Hour)
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.Error(t, err)
+	require.True(t, isConnectionErr(err))
+	require.Equal(t, uint64(2), env.ActivationCacheStats().Failovers)
+}
+
+// TestUnreachableServers ensures that servers that invocations repeatedly fail to connect
+// to are blacklisted, so that the actors that are cached on them are resolved again.
+func TestUnreachableServers(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 59
+	opts.ActivationsCache.UnreachableServerThreshold = 2
+	env, err := NewEnvironment(ctx, "serverID1", reg, NewHTTPClient(), opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	// Place the actor on a server that is heartbeating but that nothing listens on.
+	_, err = reg.Heartbeat(ctx, "unreachable", registry.HeartbeatState{Address: "127.0.0.1:1"})
+	require.NoError(t, err)
+	refs, err := reg.EnsureActivation(ctx, "ns-1", "a", "test-module", registry.EnsureActivationOptions{
+		BlacklistedServerIDs: []string{"serverID1"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "unreachable", refs[0].ServerID())
+
+	for i := 0; i < 2; i++ {
+		_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.True(t, isConnectionErr(err), err)
+	}
+	require.Equal(t, uint64(1), env.ActivationCacheStats().UnreachableServers)
+
+	// The actor is moved off the unreachable server once it's blacklisted.
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+}
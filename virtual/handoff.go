@@ -0,0 +1,288 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/dnsregistry"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const (
+	defaultHandoffTimeout        = 5 * time.Second
+	defaultMaxConcurrentHandoffs = 16
+)
+
+// HandoffOptions contains the options for handing off the in-memory state of actors to
+// the servers they're moved to. Actors are handed off whenever this server learns that
+// they're moved away from it:
+//
+//   - When the environment is drained (see Environment.Drain), every activated actor is
+//     handed off.
+//   - When an actor that is activated on this server is rebalanced with
+//     Environment.RebalanceActor on this server.
+//   - When the registry activates an actor that is activated on this server on a
+//     different server, which this server learns when it fails to renew the actor's
+//     activation lease (so only with registries that grant them).
+//
+// Handing off an actor snapshots its in-memory state with its
+// wapcutils.SnapshotOperationName operation and deactivates it (running its deactivation
+// hooks so its persisted state is up to date), resolves the actor's new placement in the
+// registry, and sends the snapshot directly to the new server. The new server activates
+// the actor and invokes its wapcutils.RestoreOperationName operation with the snapshot
+// before it serves any other invocation, so the actor doesn't start cold.
+//
+// If any step fails (for example because the actor's module doesn't support snapshots,
+// or because the new server already activated the actor) the actor's new activation
+// starts from its persisted KV state like it does without handoffs. Invocations that this
+// server routes to the actor, or that are routed to this server, while its handoff is
+// pending wait for the handoff to complete before they're routed to the actor's new
+// location, but invocations from servers whose activation caches already point to the
+// new server may activate it there first, in which case its handoff fails.
+type HandoffOptions struct {
+	// Enabled enables handoffs.
+	Enabled bool
+	// Timeout is the maximum amount of time that handing off each actor can take.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 5 seconds.
+	Timeout time.Duration
+	// MaxConcurrency is the maximum number of actors that are handed off at once.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 16.
+	MaxConcurrency int
+}
+
+func (h *HandoffOptions) Validate() error {
+	if h.Timeout < 0 {
+		return fmt.Errorf("Timeout must be >= 0")
+	}
+	if h.MaxConcurrency < 0 {
+		return fmt.Errorf("MaxConcurrency must be >= 0")
+	}
+	return nil
+}
+
+// pendingHandoffs tracks the actors whose handoff has not completed yet.
+type pendingHandoffs struct {
+	sync.Mutex
+	m map[types.NamespacedActorID]chan struct{}
+}
+
+// add marks the handoffs of the provided actors as pending.
+func (p *pendingHandoffs) add(actors ...*activatedActor) {
+	p.Lock()
+	defer p.Unlock()
+	if p.m == nil {
+		p.m = make(map[types.NamespacedActorID]chan struct{}, len(actors))
+	}
+	for _, actor := range actors {
+		p.m[actor.reference().ActorID()] = make(chan struct{})
+	}
+}
+
+// isPending returns whether the handoff of the actor has not completed yet.
+func (p *pendingHandoffs) isPending(actorID types.NamespacedActorID) bool {
+	p.Lock()
+	defer p.Unlock()
+	_, ok := p.m[actorID]
+	return ok
+}
+
+// done marks the handoff of the actor as complete.
+func (p *pendingHandoffs) done(actorID types.NamespacedActorID) {
+	p.Lock()
+	defer p.Unlock()
+	if ch, ok := p.m[actorID]; ok {
+		close(ch)
+		delete(p.m, actorID)
+	}
+}
+
+// wait waits until the handoff of the actor (if any) is complete, or until ctx is done.
+func (p *pendingHandoffs) wait(ctx context.Context, actorID types.NamespacedActorID) error {
+	p.Lock()
+	ch, ok := p.m[actorID]
+	p.Unlock()
+	if !ok {
+		return nil
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error waiting for handoff of actor: %v: %w", actorID, ctx.Err())
+	}
+}
+
+// handoffActors hands off the provided actors because the environment is being drained.
+// Their handoffs must have been added to r.handoffs already.
+func (r *environment) handoffActors(ctx context.Context, actors []*activatedActor) {
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, r.opts.Handoff.MaxConcurrency)
+	)
+	for _, actor := range actors {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(actor *activatedActor) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			reference := actor.reference()
+			err := r.handoffActor(ctx, actor, "handoff", func(ctx context.Context) (types.ActorReference, error) {
+				meta, err := r.activationsCache.refreshActivation(
+					ctx, reference.Namespace(), reference.ModuleID().ID, reference.ActorID().ID)
+				if err != nil {
+					return nil, fmt.Errorf("error ensuring new activation: %w", err)
+				}
+				if meta.References[0].ServerID() == r.serverID {
+					return nil, errors.New("registry placed actor on the draining server")
+				}
+				return meta.References[0], nil
+			})
+			if err != nil {
+				log.Printf("error handing off actor: %v, err: %v", reference, err)
+			}
+		}(actor)
+	}
+	wg.Wait()
+}
+
+// startHandoff returns the actor with the provided ID if handoffs are enabled and it's
+// activated on this server, in which case its handoff is marked as pending.
+func (r *environment) startHandoff(actorID types.NamespacedActorID) (*activatedActor, bool) {
+	if !r.opts.Handoff.Enabled {
+		return nil, false
+	}
+	actor, ok := r.activations.activatedActor(actorID)
+	if !ok {
+		return nil, false
+	}
+	r.handoffs.add(actor)
+	return actor, true
+}
+
+// handoffRevokedActor hands off actor, whose activation lease was revoked, to the server
+// that the registry activated it on instead (if any).
+func (r *environment) handoffRevokedActor(actor *activatedActor) {
+	reference := actor.reference()
+	r.handoffs.add(actor)
+	err := r.handoffActor(context.Background(), actor, "lease_revoked", func(ctx context.Context) (types.ActorReference, error) {
+		references, err := r.registry.LookupActivation(
+			ctx, reference.Namespace(), reference.ActorID().ID, reference.ModuleID().ID)
+		if err != nil {
+			return nil, fmt.Errorf("error looking up new activation: %w", err)
+		}
+		if len(references) == 0 || references[0].ServerID() == r.serverID {
+			return nil, errors.New("actor is not activated on a different server")
+		}
+		return references[0], nil
+	})
+	if !errors.Is(err, errActivationClosed) {
+		r.activations.leaseRevocations.Add(1)
+	}
+	if err != nil {
+		log.Printf("error handing off actor: %v with revoked lease, err: %v", reference, err)
+	}
+}
+
+// handoffActor hands off actor (see HandoffOptions) to the server of the reference that
+// place returns, which is called once the actor has been snapshotted and closed (even if
+// the snapshot failed). The handoff of the actor must have been added to r.handoffs
+// already, and it's marked as done once it completes or fails. reason is the reason of
+// the LifecycleEventMigrated event that's published once the actor is restored.
+func (r *environment) handoffActor(
+	ctx context.Context,
+	actor *activatedActor,
+	reason string,
+	place func(ctx context.Context) (types.ActorReference, error),
+) error {
+	reference := actor.reference()
+	defer r.handoffs.done(reference.ActorID())
+
+	// Like deactivation hooks, handoffs are bounded by their own timeout so they're not
+	// abandoned if ctx is done since that would lose the actor's state.
+	ctx, cc := context.WithTimeout(context.WithoutCancel(ctx), r.opts.Handoff.Timeout)
+	defer cc()
+
+	state, snapshotErr := actor.snapshotAndClose(ctx)
+	newRef, err := place(ctx)
+	if err != nil {
+		return err
+	}
+	if snapshotErr != nil {
+		return snapshotErr
+	}
+
+	vs, err := r.registry.GetVersionStamp(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting version stamp: %w", err)
+	}
+	if err := r.restoreReference(ctx, vs, newRef, state); err != nil {
+		return fmt.Errorf("error restoring actor on server: %s, err: %w", newRef.ServerID(), err)
+	}
+	if newRef.ServerID() != r.serverID {
+		r.activations.events.publishEvent(LifecycleEvent{
+			Type:             LifecycleEventMigrated,
+			Namespace:        reference.Namespace(),
+			ModuleID:         reference.ModuleID().ID,
+			ActorID:          reference.ActorID().ID,
+			ServerID:         newRef.ServerID(),
+			PreviousServerID: r.serverID,
+			Reason:           reason,
+		})
+	}
+	return nil
+}
+
+// restoreReference calls RestoreActorDirect on the server of the provided reference.
+func (r *environment) restoreReference(
+	ctx context.Context,
+	versionStamp int64,
+	ref types.ActorReference,
+	state []byte,
+) error {
+	if !r.opts.ForceRemoteProcedureCalls {
+		localEnvironmentsRouterLock.RLock()
+		localEnv, ok := localEnvironmentsRouter[ref.Address()]
+		localEnvironmentsRouterLock.RUnlock()
+		if ok {
+			return localEnv.RestoreActorDirect(
+				ctx, versionStamp, ref.ServerID(), ref.ServerVersion(), ref, state)
+		}
+	}
+
+	ctx = withCompression(ctx, r.opts.Compression)
+	return r.client.RestoreActorRemote(ctx, versionStamp, ref, state)
+}
+
+func (r *environment) RestoreActorDirect(
+	ctx context.Context,
+	versionStamp int64,
+	serverID string,
+	serverVersion int64,
+	reference types.ActorReferenceVirtual,
+	state []byte,
+) error {
+	if err := r.checkDirectRequest(versionStamp, serverID, serverVersion); err != nil {
+		return err
+	}
+	if reference.ActorID().IDType != types.IDTypeActor {
+		return fmt.Errorf("only actors can be restored, but got: %v", reference.ActorID())
+	}
+	if serverID == dnsregistry.DNSServerID {
+		return errors.New("actors can't be restored on servers that use the DNS registry")
+	}
+	if r.draining.Load() {
+		return fmt.Errorf("error restoring actor: %v: %w", reference, errServerDrained)
+	}
+
+	r.inFlight.Add(1)
+	defer r.inFlight.Add(-1)
+	return r.activations.restore(ctx, reference, state)
+}
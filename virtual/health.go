@@ -0,0 +1,92 @@
+package virtual
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// HealthStatus is a point-in-time report of the health of an Environment. See
+// Environment.Health.
+type HealthStatus struct {
+	// Ready indicates whether the server should receive traffic. It's true if the
+	// registry is reachable and the server is not draining.
+	Ready bool `json:"ready"`
+	// RegistryReachable indicates whether the server heartbeated the registry
+	// successfully within EnvironmentOptions.RegistryStalenessTolerance.
+	RegistryReachable bool `json:"registry_reachable"`
+	// LastHeartbeat is the time of the last successful heartbeat.
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	// LastHeartbeatError is the error of the last heartbeat if it failed, or empty if it
+	// succeeded.
+	LastHeartbeatError string `json:"last_heartbeat_error,omitempty"`
+	// NumActivatedActors is the number of actors that are activated on the server.
+	NumActivatedActors int `json:"num_activated_actors"`
+	// Draining indicates whether the server is draining (see Environment.Drain).
+	Draining bool `json:"draining"`
+	// VersionStampRegressions is the number of heartbeats whose registry versionstamp
+	// was lower than the one of the previous heartbeat. Versionstamps must increase
+	// monotonically, so this indicates that a registry node is misbehaving, or that the
+	// registry derives versionstamps from the clocks of the servers and they're skewed.
+	VersionStampRegressions uint64 `json:"versionstamp_regressions,omitempty"`
+}
+
+// heartbeatHealth tracks the outcome of the heartbeats of an environment.
+type heartbeatHealth struct {
+	lastSuccess time.Time
+	lastErr     error
+}
+
+func (r *environment) Health() HealthStatus {
+	r.heartbeatState.RLock()
+	health := r.heartbeatState.health
+	regressions := r.heartbeatState.versionStampRegressions
+	r.heartbeatState.RUnlock()
+
+	status := HealthStatus{
+		// Transient heartbeat errors don't make the server unready as long as a heartbeat
+		// succeeded recently, the same way the activation cache keeps serving cached
+		// activations while the registry is unavailable.
+		RegistryReachable:  time.Since(health.lastSuccess) <= r.opts.RegistryStalenessTolerance,
+		LastHeartbeat:      health.lastSuccess,
+		NumActivatedActors: r.numActivatedActors(),
+		Draining:           r.draining.Load(),
+
+		VersionStampRegressions: regressions,
+	}
+	if health.lastErr != nil {
+		status.LastHeartbeatError = health.lastErr.Error()
+	}
+	status.Ready = status.RegistryReachable && !status.Draining
+	return status
+}
+
+// health is the liveness endpoint. It always succeeds as long as the server is serving
+// requests, and reports the health of the environment in the response body.
+func (s *server) health(w http.ResponseWriter, r *http.Request) {
+	writeHealthStatus(w, s.environment.Health(), http.StatusOK)
+}
+
+// ready is the readiness endpoint. It fails with http.StatusServiceUnavailable if the
+// server should not receive traffic.
+func (s *server) ready(w http.ResponseWriter, r *http.Request) {
+	status := s.environment.Health()
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeHealthStatus(w, status, code)
+}
+
+func writeHealthStatus(w http.ResponseWriter, status HealthStatus, code int) {
+	marshaled, err := json.Marshal(status)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(marshaled)
+}
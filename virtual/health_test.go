@@ -0,0 +1,128 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestHealth ensures that readiness tolerates transient registry errors, degrades once the
+// registry has been unreachable for longer than the staleness tolerance, and reflects
+// whether the server is draining.
+func TestHealth(t *testing.T) {
+	var (
+		reg = &unreachableRegistry{Registry: localregistry.NewLocalRegistry()}
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 28
+	opts.RegistryStalenessTolerance = 500 * time.Millisecond
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(NewServer(reg, env).ready))
+	defer httpServer.Close()
+	getReady := func() (int, HealthStatus) {
+		resp, err := http.Get(httpServer.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var status HealthStatus
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+		return resp.StatusCode, status
+	}
+
+	code, status := getReady()
+	require.Equal(t, http.StatusOK, code)
+	require.True(t, status.Ready)
+	require.True(t, status.RegistryReachable)
+	require.Equal(t, 1, status.NumActivatedActors)
+	require.Empty(t, status.LastHeartbeatError)
+
+	// A transient error doesn't make the server unready.
+	require.NoError(t, env.heartbeat())
+	reg.unreachable.Store(true)
+	require.Error(t, env.heartbeat())
+	status = env.Health()
+	require.True(t, status.Ready)
+	require.Contains(t, status.LastHeartbeatError, "registry unreachable")
+
+	require.Eventually(t, func() bool {
+		return !env.Health().RegistryReachable
+	}, 5*time.Second, 10*time.Millisecond)
+	code, status = getReady()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.False(t, status.Ready)
+
+	reg.unreachable.Store(false)
+	require.NoError(t, env.heartbeat())
+	require.True(t, env.Health().Ready)
+
+	require.NoError(t, env.Drain(ctx))
+	code, status = getReady()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.True(t, status.RegistryReachable)
+	require.True(t, status.Draining)
+	require.Equal(t, 0, status.NumActivatedActors)
+}
+
+// TestHealthVersionStampRegressions ensures that heartbeats whose versionstamp is lower
+// than the one of the previous heartbeat are reported.
+func TestHealthVersionStampRegressions(t *testing.T) {
+	reg := &unreachableRegistry{Registry: localregistry.NewLocalRegistry()}
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 53
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	require.NoError(t, env.heartbeat())
+	require.Equal(t, uint64(0), env.Health().VersionStampRegressions)
+
+	reg.regressBy.Store(int64(time.Hour / time.Microsecond))
+	require.NoError(t, env.heartbeat())
+	require.Equal(t, uint64(1), env.Health().VersionStampRegressions)
+	// Only the heartbeat that regressed is counted.
+	require.NoError(t, env.heartbeat())
+	require.Equal(t, uint64(1), env.Health().VersionStampRegressions)
+
+	reg.regressBy.Store(0)
+	require.NoError(t, env.heartbeat())
+	require.Equal(t, uint64(1), env.Health().VersionStampRegressions)
+}
+
+// unreachableRegistry wraps a registry and fails heartbeats while unreachable is set.
+type unreachableRegistry struct {
+	registry.Registry
+	unreachable atomic.Bool
+	// regressBy is subtracted from the versionstamps of heartbeats.
+	regressBy atomic.Int64
+}
+
+func (r *unreachableRegistry) Heartbeat(
+	ctx context.Context,
+	serverID string,
+	state registry.HeartbeatState,
+) (registry.HeartbeatResult, error) {
+	if r.unreachable.Load() {
+		return registry.HeartbeatResult{}, errors.New("registry unreachable")
+	}
+	result, err := r.Registry.Heartbeat(ctx, serverID, state)
+	result.VersionStamp -= r.regressBy.Load()
+	return result, err
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"sync"
 	"time"
 
@@ -19,6 +20,20 @@ type hostCapabilities struct {
 	customHostFns    map[string]func([]byte) ([]byte, error)
 	reference        types.ActorReferenceVirtual
 	getServerStateFn func() (string, int64)
+	timers           *actorTimers
+	logger           *slog.Logger
+	metrics          *actorMetrics
+	metricLabels     MetricLabels
+	configs          *namespaceConfigs
+	ids              idGenerator
+	egress           *httpEgress
+
+	// fencingToken caches the fencing token of the activation's lease, which doesn't
+	// change for as long as the activation lives.
+	fencingToken struct {
+		sync.Mutex
+		token uint64
+	}
 }
 
 func newHostCapabilities(
@@ -28,6 +43,11 @@ func newHostCapabilities(
 	customHostFns map[string]func([]byte) ([]byte, error),
 	reference types.ActorReferenceVirtual,
 	getServerStateFn func() (string, int64),
+	timers *actorTimers,
+	logger *slog.Logger,
+	metrics *actorMetrics,
+	configs *namespaceConfigs,
+	egress *httpEgress,
 ) HostCapabilities {
 	return &hostCapabilities{
 		reg:              reg,
@@ -36,6 +56,15 @@ func newHostCapabilities(
 		customHostFns:    customHostFns,
 		reference:        reference,
 		getServerStateFn: getServerStateFn,
+		timers:           timers,
+		logger:           logger,
+		metrics:          metrics,
+		metricLabels: MetricLabels{
+			Namespace: reference.Namespace(),
+			ModuleID:  reference.ModuleID().ID,
+		},
+		configs: configs,
+		egress:  egress,
 	}
 }
 
@@ -45,7 +74,7 @@ func (h *hostCapabilities) BeginTransaction(
 	// Use lazy implementation because we create an implicit transaction for every
 	// invocation which would be extremely expensive if it were not for the fact that
 	// the transaction is never actually begun unless a KV operation is initiated.
-	tr := newLazyActorTransaction(h.reg, h.getServerStateFn, h.reference)
+	tr := newLazyActorTransaction(h.actorStorage(), h.getServerStateFn, h.reference)
 	return tr, nil
 }
 
@@ -54,7 +83,7 @@ func (h *hostCapabilities) Transact(
 	fn func(tr registry.ActorKVTransaction) (any, error),
 ) (any, error) {
 	// Use lazy implementation for same reason described in BeginTransaction() above.
-	tr := newLazyActorTransaction(h.reg, h.getServerStateFn, h.reference)
+	tr := newLazyActorTransaction(h.actorStorage(), h.getServerStateFn, h.reference)
 	result, err := fn(tr)
 	if err != nil {
 		tr.Cancel(ctx)
@@ -66,12 +95,44 @@ func (h *hostCapabilities) Transact(
 	return result, nil
 }
 
+// actorStorage returns the storage of the actor's KV pairs, which compresses them if the
+// state of actors is compressed (see EnvironmentOptions.StateCompression).
+func (h *hostCapabilities) actorStorage() registry.ActorStorage {
+	if h.activations == nil {
+		return h.reg
+	}
+	return h.activations.stateCompressor.wrap(h.reg)
+}
+
 func (h *hostCapabilities) InvokeActor(
 	ctx context.Context,
 	req types.InvokeActorRequest,
 ) ([]byte, error) {
-	return h.env.InvokeActor(
-		ctx, h.reference.Namespace(), req.ActorID, req.ModuleID,
+	return invokeActorFromActor(ctx, h.env, h.reference, h.activations.maxInvocationDepth, req)
+}
+
+// invokeActorFromActor invokes the actor described by req on behalf of the actor caller.
+// The caller's identity is made available to the target actor via CallerFromContext().
+func invokeActorFromActor(
+	ctx context.Context,
+	env Environment,
+	caller types.ActorReferenceVirtual,
+	maxInvocationDepth int,
+	req types.InvokeActorRequest,
+) ([]byte, error) {
+	ctx, err := withCaller(ctx, caller, maxInvocationDepth)
+	if err != nil {
+		return nil, err
+	}
+	// The result is returned as a []byte so there is no point in streaming it.
+	ctx = withoutStreamingResponse(ctx)
+
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = caller.Namespace()
+	}
+	return env.InvokeActor(
+		ctx, namespace, req.ActorID, req.ModuleID,
 		req.Operation, req.Payload, req.CreateIfNotExist)
 }
 
@@ -109,6 +170,116 @@ func (h *hostCapabilities) ScheduleSelfTimer(
 	return nil
 }
 
+func (h *hostCapabilities) RegisterTimer(
+	ctx context.Context,
+	req wapcutils.RegisterTimer,
+) error {
+	return h.timers.register(
+		req.Name,
+		time.Duration(req.DueMillis)*time.Millisecond,
+		time.Duration(req.PeriodMillis)*time.Millisecond)
+}
+
+func (h *hostCapabilities) UnregisterTimer(
+	ctx context.Context,
+	name string,
+) error {
+	h.timers.unregister(name)
+	return nil
+}
+
+func (h *hostCapabilities) Log(
+	ctx context.Context,
+	level slog.Level,
+	msg string,
+	args ...any,
+) {
+	if !h.logger.Enabled(ctx, level) {
+		return
+	}
+	h.logger.Log(ctx, level, h.configs.redact(msg), h.configs.redactArgs(args)...)
+}
+
+func (h *hostCapabilities) GetConfig(
+	ctx context.Context,
+	key string,
+) ([]byte, bool) {
+	return h.configs.get(h.reference.Namespace(), key)
+}
+
+func (h *hostCapabilities) NewID(ctx context.Context) string {
+	return h.ids.newID(time.Now())
+}
+
+func (h *hostCapabilities) DeactivateSelf(ctx context.Context) error {
+	return requestSelfDeactivation(ctx)
+}
+
+func (h *hostCapabilities) LastInvokedAt(ctx context.Context) (time.Time, error) {
+	return lastInvokedAtFromContext(ctx)
+}
+
+func (h *hostCapabilities) FencingToken(ctx context.Context) (uint64, error) {
+	h.fencingToken.Lock()
+	defer h.fencingToken.Unlock()
+	if h.fencingToken.token != 0 {
+		return h.fencingToken.token, nil
+	}
+
+	refs, err := h.reg.LookupActivation(
+		ctx, h.reference.Namespace(), h.reference.ActorID().ID, h.reference.ModuleID().ID)
+	if err != nil {
+		return 0, fmt.Errorf("FencingToken: error looking up activation: %w", err)
+	}
+	serverID, serverVersion := h.getServerStateFn()
+	if len(refs) == 0 ||
+		refs[0].ServerID() != serverID ||
+		refs[0].ServerVersion() != serverVersion {
+		return 0, fmt.Errorf(
+			"FencingToken: actor: %s is not activated on server: %s (version: %d)",
+			h.reference.ActorID().ID, serverID, serverVersion)
+	}
+	lease := refs[0].Lease()
+	if lease.IsZero() || lease.FencingToken == 0 {
+		return 0, fmt.Errorf(
+			"FencingToken: actor: %s has no activation lease, registry must be configured with an activation lease duration",
+			h.reference.ActorID().ID)
+	}
+
+	h.fencingToken.token = lease.FencingToken
+	return lease.FencingToken, nil
+}
+
+func (h *hostCapabilities) HTTPFetch(
+	ctx context.Context,
+	req wapcutils.HTTPFetchRequest,
+) (wapcutils.HTTPFetchResponse, error) {
+	return h.egress.fetch(ctx, h.reference.Namespace(), req)
+}
+
+func (h *hostCapabilities) MetricInc(
+	ctx context.Context,
+	name string,
+	delta float64,
+) error {
+	return h.metrics.inc(h.metricLabels, name, delta)
+}
+
+func (h *hostCapabilities) MetricObserve(
+	ctx context.Context,
+	name string,
+	value float64,
+) error {
+	return h.metrics.observe(h.metricLabels, name, value)
+}
+
+func (h *hostCapabilities) StreamSend(
+	ctx context.Context,
+	chunk []byte,
+) error {
+	return streamSend(ctx, chunk)
+}
+
 func (h *hostCapabilities) CustomFn(
 	ctx context.Context,
 	operation string,
@@ -188,6 +359,92 @@ func (l *lazyActorTransaction) Get(
 	return v, ok, nil
 }
 
+func (l *lazyActorTransaction) Delete(
+	ctx context.Context,
+	key []byte,
+) error {
+	if err := l.maybeInitTr(ctx, true); err != nil {
+		return fmt.Errorf("lazyActorTransaction: Delete: error initializing transaction: %w", err)
+	}
+
+	if err := l.tr.Delete(ctx, key); err != nil {
+		return fmt.Errorf("lazyActorTransaction: Delete: error calling Delete: %w", err)
+	}
+
+	return nil
+}
+
+func (l *lazyActorTransaction) GetWithVersion(
+	ctx context.Context,
+	key []byte,
+) ([]byte, int64, bool, error) {
+	if err := l.maybeInitTr(ctx, true); err != nil {
+		return nil, 0, false, fmt.Errorf(
+			"lazyActorTransaction: GetWithVersion: error initializing transaction: %w", err)
+	}
+
+	v, version, ok, err := l.tr.GetWithVersion(ctx, key)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf(
+			"lazyActorTransaction: GetWithVersion: error calling GetWithVersion: %w", err)
+	}
+
+	return v, version, ok, nil
+}
+
+func (l *lazyActorTransaction) PutIfVersion(
+	ctx context.Context,
+	key, value []byte,
+	expectedVersion int64,
+) (bool, error) {
+	if err := l.maybeInitTr(ctx, true); err != nil {
+		return false, fmt.Errorf(
+			"lazyActorTransaction: PutIfVersion: error initializing transaction: %w", err)
+	}
+
+	ok, err := l.tr.PutIfVersion(ctx, key, value, expectedVersion)
+	if err != nil {
+		return false, fmt.Errorf(
+			"lazyActorTransaction: PutIfVersion: error calling PutIfVersion: %w", err)
+	}
+
+	return ok, nil
+}
+
+func (l *lazyActorTransaction) Incr(
+	ctx context.Context,
+	key []byte,
+	delta int64,
+) (int64, error) {
+	if err := l.maybeInitTr(ctx, true); err != nil {
+		return 0, fmt.Errorf("lazyActorTransaction: Incr: error initializing transaction: %w", err)
+	}
+
+	value, err := l.tr.Incr(ctx, key, delta)
+	if err != nil {
+		return 0, fmt.Errorf("lazyActorTransaction: Incr: error calling Incr: %w", err)
+	}
+
+	return value, nil
+}
+
+func (l *lazyActorTransaction) IterPrefix(
+	ctx context.Context,
+	prefix []byte,
+	fn func(k, v []byte) error,
+) error {
+	if err := l.maybeInitTr(ctx, true); err != nil {
+		return fmt.Errorf(
+			"lazyActorTransaction: IterPrefix: error initializing transaction: %w", err)
+	}
+
+	if err := l.tr.IterPrefix(ctx, prefix, fn); err != nil {
+		return fmt.Errorf("lazyActorTransaction: IterPrefix: error calling IterPrefix: %w", err)
+	}
+
+	return nil
+}
+
 func (l *lazyActorTransaction) Commit(ctx context.Context) error {
 	if err := l.maybeInitTr(ctx, false); err != nil {
 		return fmt.Errorf(
@@ -1,13 +1,12 @@
 package virtual
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"time"
 
@@ -15,7 +14,40 @@ import (
 )
 
 type httpClient struct {
-	c *http.Client
+	*connectionPools
+	scheme        string
+	authenticator Authenticator
+}
+
+// HTTPClientOptions contains the options for the HTTP RemoteClient.
+type HTTPClientOptions struct {
+	// TLSConfig is the TLS configuration that is used to connect to other servers. If
+	// set, requests are sent over TLS (which the other servers must be configured to
+	// accept, see ServerOptions.TLSConfig). Add the certificate of this process to it
+	// for mutual TLS.
+	TLSConfig *tls.Config
+	// Authenticator attaches credentials to the requests that are sent to other
+	// servers. If nil, requests don't carry any credentials.
+	Authenticator Authenticator
+	// MaxConnsPerServer is the size of the pool of connections of each server that the
+	// client sends requests to: requests that would need more connections wait for one
+	// to become available.
+	//
+	// A value of 0 means no limit.
+	MaxConnsPerServer int
+	// HealthCheckInterval is the interval at which the client checks the health of the
+	// servers it has sent requests to. Servers that fail UnhealthyThreshold consecutive
+	// health checks are removed from the pool and reported to the environments that use
+	// the client (see ServerHealthChecker), which resolve the actors that were activated
+	// on them again. The client must be closed (see io.Closer) to stop the checks.
+	//
+	// A value of 0 disables health checks.
+	HealthCheckInterval time.Duration
+	// UnhealthyThreshold is the number of consecutive failed health checks after which a
+	// server is considered unhealthy.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 3.
+	UnhealthyThreshold int
 }
 
 func (h *httpClient) InvokeActorRemote(
@@ -42,18 +74,82 @@ func (h *httpClient) InvokeActorRemote(
 	if err != nil {
 		return nil, fmt.Errorf("HTTPClient: InvokeDirect: error marshaling invokeActorDirectRequest: %w", err)
 	}
+	return h.invoke(
+		ctx, "InvokeDirect", reference.Address(), reference.ServerID(),
+		"/api/v1/invoke-actor-direct", marshaled)
+}
+
+// InvokeActorRouted implements RoutingClient.
+func (h *httpClient) InvokeActorRouted(
+	ctx context.Context,
+	address string,
+	namespace string,
+	actorID string,
+	moduleID string,
+	operation string,
+	payload []byte,
+	create types.CreateIfNotExist,
+) (io.ReadCloser, error) {
+	ir := invokeActorRequest{
+		Namespace: namespace,
+		InvokeActorRequest: types.InvokeActorRequest{
+			ActorID:          actorID,
+			ModuleID:         moduleID,
+			Operation:        operation,
+			Payload:          payload,
+			CreateIfNotExist: create,
+		},
+	}
+	marshaled, err := json.Marshal(&ir)
+	if err != nil {
+		return nil, fmt.Errorf("HTTPClient: InvokeRouted: error marshaling invokeActorRequest: %w", err)
+	}
+	return h.invoke(ctx, "InvokeRouted", address, "", "/api/v1/invoke-actor", marshaled)
+}
 
+// invoke sends an invocation request with the marshaled body to the provided path of the
+// server at address and returns the (decompressed) response. name is the name of the
+// calling method, which prefixes the errors. serverID is the ID of the server at address,
+// or empty if it's not known.
+func (h *httpClient) invoke(
+	ctx context.Context,
+	name string,
+	address string,
+	serverID string,
+	path string,
+	marshaled []byte,
+) (io.ReadCloser, error) {
+	header := make(http.Header)
+	body, err := newCompressedRequestBody(ctx, marshaled, header)
+	if err != nil {
+		return nil, fmt.Errorf("HTTPClient: %s: %w", name, err)
+	}
 	req, err := http.NewRequestWithContext(
-		ctx, "POST",
-		fmt.Sprintf("http://%s/api/v1/invoke-actor-direct", reference.Address()),
-		bytes.NewReader(marshaled))
+		ctx, "POST", fmt.Sprintf("%s://%s%s", h.scheme, address, path), body)
 	if err != nil {
-		return nil, fmt.Errorf("HTTPClient: InvokeDirect: error constructing request: %w", err)
+		return nil, fmt.Errorf("HTTPClient: %s: error constructing request: %w", name, err)
+	}
+	req.Header = header
+	if h.authenticator != nil {
+		if err := h.authenticator.Attach(req); err != nil {
+			return nil, fmt.Errorf("HTTPClient: %s: error attaching credentials: %w", name, err)
+		}
+	}
+
+	if tracer, ok := tracerFromContext(ctx); ok {
+		tracer.Inject(ctx, req.Header)
+	}
+	injectCallChain(ctx, req.Header)
+	injectIdempotencyKey(ctx, req.Header)
+	injectInvocationPriority(ctx, req.Header)
+	injectTell(ctx, req.Header)
+	if isStreamingRequested(ctx) {
+		req.Header.Set(streamResponseHeader, "true")
 	}
 
-	resp, err := h.c.Do(req)
+	resp, err := h.client(address, serverID).Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("HTTPClient: InvokeDirect: error running request: %w", err)
+		return nil, fmt.Errorf("HTTPClient: %s: error running request: %w", name, err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
@@ -63,38 +159,191 @@ func (h *httpClient) InvokeActorRemote(
 		if err == nil {
 			errMsg = string(body)
 		}
-		return nil, fmt.Errorf("HTTPClient: InvokeDirect: error status code: %d, msg: %s", resp.StatusCode, errMsg)
+		quotaExceededErr := namespaceQuotaExceededFromHeader(resp.Header)
+		if resp.StatusCode == http.StatusTooManyRequests && quotaExceededErr != nil {
+			return nil, invokeErrorFromHeaders(resp.Header, fmt.Errorf(
+				"HTTPClient: %s: error status code: %d: %w", name, resp.StatusCode, quotaExceededErr))
+		}
+		if resp.StatusCode == http.StatusTooManyRequests && resp.Header.Get(mailboxFullHeader) != "" {
+			return nil, invokeErrorFromHeaders(resp.Header, fmt.Errorf(
+				"HTTPClient: %s: error status code: %d, msg: %s: %w",
+				name, resp.StatusCode, errMsg, ErrActorMailboxFull))
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return nil, invokeErrorFromHeaders(resp.Header, fmt.Errorf(
+				"HTTPClient: %s: error status code: %d: %w",
+				name, resp.StatusCode, &ActorRateLimitedError{RetryAfter: retryAfterFromHeader(resp.Header)}))
+		}
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			return nil, invokeErrorFromHeaders(resp.Header, fmt.Errorf(
+				"HTTPClient: %s: error status code: %d, msg: %s: %w",
+				name, resp.StatusCode, errMsg, errServerAtCapacity))
+		}
+		return nil, invokeErrorFromHeaders(resp.Header, fmt.Errorf(
+			"HTTPClient: %s: error status code: %d, msg: %s", name, resp.StatusCode, errMsg))
+	}
+
+	result, err := decompressResponseBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("HTTPClient: %s: %w", name, err)
+	}
+	return result, nil
+}
+
+func (h *httpClient) InvokeActorDirectBatchRemote(
+	ctx context.Context,
+	versionStamp int64,
+	serverID string,
+	address string,
+	invocations []DirectBatchInvocation,
+) ([]BatchInvocationResult, error) {
+	ir := invokeActorDirectBatchRequest{
+		VersionStamp: versionStamp,
+		ServerID:     serverID,
+		Invocations:  make([]invokeActorDirectBatchInvocation, 0, len(invocations)),
+	}
+	for _, inv := range invocations {
+		ir.Invocations = append(ir.Invocations, invokeActorDirectBatchInvocation{
+			ServerVersion:    inv.ServerVersion,
+			Namespace:        inv.Reference.Namespace(),
+			ModuleID:         inv.Reference.ModuleID().ID,
+			ActorID:          inv.Reference.ActorID().ID,
+			Generation:       inv.Reference.Generation(),
+			Operation:        inv.Operation,
+			Payload:          inv.Payload,
+			CreateIfNotExist: inv.CreateIfNotExist,
+		})
+	}
+	marshaled, err := json.Marshal(&ir)
+	if err != nil {
+		return nil, fmt.Errorf("HTTPClient: InvokeDirectBatch: error marshaling invokeActorDirectBatchRequest: %w", err)
+	}
+
+	header := make(http.Header)
+	reqBody, err := newCompressedRequestBody(ctx, marshaled, header)
+	if err != nil {
+		return nil, fmt.Errorf("HTTPClient: InvokeDirectBatch: %w", err)
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, "POST",
+		fmt.Sprintf("%s://%s/api/v1/invoke-actor-direct-batch", h.scheme, address),
+		reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("HTTPClient: InvokeDirectBatch: error constructing request: %w", err)
+	}
+	req.Header = header
+	if h.authenticator != nil {
+		if err := h.authenticator.Attach(req); err != nil {
+			return nil, fmt.Errorf("HTTPClient: InvokeDirectBatch: error attaching credentials: %w", err)
+		}
+	}
+
+	if tracer, ok := tracerFromContext(ctx); ok {
+		tracer.Inject(ctx, req.Header)
+	}
+	injectCallChain(ctx, req.Header)
+	injectIdempotencyKey(ctx, req.Header)
+	injectInvocationPriority(ctx, req.Header)
+	injectTell(ctx, req.Header)
+
+	resp, err := h.client(address, serverID).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTPClient: InvokeDirectBatch: error running request: %w", err)
+	}
+	respBody, err := decompressResponseBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("HTTPClient: InvokeDirectBatch: %w", err)
+	}
+	defer respBody.Close()
+
+	body, err := ioutil.ReadAll(respBody)
+	if err != nil {
+		return nil, fmt.Errorf("HTTPClient: InvokeDirectBatch: error reading response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTPClient: InvokeDirectBatch: error status code: %d, msg: %s", resp.StatusCode, body)
 	}
 
-	return resp.Body, nil
+	var batchResp invokeActorBatchResponse
+	if err := json.Unmarshal(body, &batchResp); err != nil {
+		return nil, fmt.Errorf("HTTPClient: InvokeDirectBatch: error unmarshaling response: %w", err)
+	}
+	return batchResp.results(), nil
+}
+
+func (h *httpClient) RestoreActorRemote(
+	ctx context.Context,
+	versionStamp int64,
+	reference types.ActorReference,
+	state []byte,
+) error {
+	rr := restoreActorDirectRequest{
+		VersionStamp:  versionStamp,
+		ServerID:      reference.ServerID(),
+		ServerVersion: reference.ServerVersion(),
+		Namespace:     reference.Namespace(),
+		ModuleID:      reference.ModuleID().ID,
+		ActorID:       reference.ActorID().ID,
+		Generation:    reference.Generation(),
+		State:         state,
+	}
+	marshaled, err := json.Marshal(&rr)
+	if err != nil {
+		return fmt.Errorf("HTTPClient: RestoreDirect: error marshaling restoreActorDirectRequest: %w", err)
+	}
+
+	header := make(http.Header)
+	body, err := newCompressedRequestBody(ctx, marshaled, header)
+	if err != nil {
+		return fmt.Errorf("HTTPClient: RestoreDirect: %w", err)
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, "POST",
+		fmt.Sprintf("%s://%s/api/v1/restore-actor-direct", h.scheme, reference.Address()),
+		body)
+	if err != nil {
+		return fmt.Errorf("HTTPClient: RestoreDirect: error constructing request: %w", err)
+	}
+	req.Header = header
+	if h.authenticator != nil {
+		if err := h.authenticator.Attach(req); err != nil {
+			return fmt.Errorf("HTTPClient: RestoreDirect: error attaching credentials: %w", err)
+		}
+	}
+	if tracer, ok := tracerFromContext(ctx); ok {
+		tracer.Inject(ctx, req.Header)
+	}
+
+	resp, err := h.client(reference.Address(), reference.ServerID()).Do(req)
+	if err != nil {
+		return fmt.Errorf("HTTPClient: RestoreDirect: error running request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var errMsg string
+		body, err := ioutil.ReadAll(resp.Body)
+		if err == nil {
+			errMsg = string(body)
+		}
+		return fmt.Errorf("HTTPClient: RestoreDirect: error status code: %d, msg: %s", resp.StatusCode, errMsg)
+	}
+	return nil
 }
 
 // NewHTTPClient returns a new HTTPClient that implements the RemoteClient interface.
 func NewHTTPClient() RemoteClient {
-	transport := &http.Transport{
-		// Some of this is copy-pasta from http.DefaultTransport.
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:        0, // No limit.
-		MaxIdleConnsPerHost: 6500,
-		MaxConnsPerHost:     0, // No limit.
-		IdleConnTimeout:     90 * time.Second,
-		DisableCompression:  true,
-		// Some cloud providers (like GCP) rate-limit connections to 200MiB/s
-		// which means if we allow the SDK to use HTTP2 connections and perform
-		// multi-plexing our entire application will get throttled to ~200MiB/s
-		// regardless of how many parallel streams we open so make sure we disable
-		// HTTP2.
-		ForceAttemptHTTP2:     false,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		WriteBufferSize:       1 << 18,
-		ReadBufferSize:        1 << 18,
-	}
-	c := &http.Client{Transport: transport}
-	return &httpClient{c: c}
+	return NewHTTPClientWithOptions(HTTPClientOptions{})
+}
+
+// NewHTTPClientWithOptions is the same as NewHTTPClient, except it accepts options.
+func NewHTTPClientWithOptions(opts HTTPClientOptions) RemoteClient {
+	scheme := "http"
+	if opts.TLSConfig != nil {
+		scheme = "https"
+	}
+	return &httpClient{
+		connectionPools: newConnectionPools(opts, scheme),
+		scheme:          scheme,
+		authenticator:   opts.Authenticator,
+	}
 }
@@ -0,0 +1,343 @@
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardartoul/nola/wapcutils"
+)
+
+const (
+	defaultHTTPEgressTimeout          = 10 * time.Second
+	defaultHTTPEgressMaxResponseBytes = 1 << 20
+	maxHTTPEgressRedirects            = 10
+)
+
+// ErrHTTPEgressDenied is wrapped by the errors of HTTP requests that actors are not
+// allowed to make (see HTTPEgressOptions). Use errors.As with *HTTPEgressDeniedError to
+// find out why the request was denied.
+var ErrHTTPEgressDenied = errors.New("http egress denied")
+
+// IsHTTPEgressDeniedErr returns a boolean indicating whether the error is an instance of
+// (or wraps) ErrHTTPEgressDenied.
+func IsHTTPEgressDeniedErr(err error) bool {
+	return errors.Is(err, ErrHTTPEgressDenied)
+}
+
+// HTTPEgressDeniedError is the error of HTTP requests that actors are not allowed to
+// make, either because the host is not allowed for the actor's namespace or because the
+// namespace exceeded its rate limit. It wraps ErrHTTPEgressDenied.
+type HTTPEgressDeniedError struct {
+	// Namespace is the namespace of the actor that made the request.
+	Namespace string
+	// Host is the host that the request (or one of its redirects) was made to.
+	Host string
+	// RetryAfter is how long until the namespace is allowed to make another request if
+	// the request was denied because the namespace exceeded HTTPEgressPolicy.RateLimit,
+	// and 0 otherwise.
+	RetryAfter time.Duration
+}
+
+func (e *HTTPEgressDeniedError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf(
+			"%s: namespace: %s exceeded its rate limit, retry after: %s",
+			ErrHTTPEgressDenied, e.Namespace, e.RetryAfter)
+	}
+	return fmt.Sprintf(
+		"%s: namespace: %s is not allowed to make requests to host: %s",
+		ErrHTTPEgressDenied, e.Namespace, e.Host)
+}
+
+func (e *HTTPEgressDeniedError) Unwrap() error {
+	return ErrHTTPEgressDenied
+}
+
+// HTTPEgressPolicy controls the HTTP requests that the actors of a single namespace can
+// make.
+type HTTPEgressPolicy struct {
+	// AllowedHosts contains the hostnames that the actors of the namespace can make
+	// requests to. Entries that start with "*." match every subdomain of the domain that
+	// follows (but not the domain itself). Hostnames are matched case insensitively and
+	// regardless of the port of the request.
+	AllowedHosts []string
+	// RateLimit is the rate limit of the requests of all the actors of the namespace on
+	// each server. The zero value means no limit.
+	RateLimit RateLimit
+}
+
+func (p *HTTPEgressPolicy) validate() error {
+	for _, host := range p.AllowedHosts {
+		if host == "" || host == "*." {
+			return fmt.Errorf("AllowedHosts cannot contain empty hosts")
+		}
+		if strings.ContainsAny(host, "/:") {
+			return fmt.Errorf(
+				"AllowedHosts must contain hostnames without a scheme, port or path, got: %s", host)
+		}
+	}
+	if err := p.RateLimit.validate(); err != nil {
+		return fmt.Errorf("invalid RateLimit: %w", err)
+	}
+	return nil
+}
+
+// allows returns whether hostname is allowed by the policy.
+func (p *HTTPEgressPolicy) allows(hostname string) bool {
+	hostname = strings.ToLower(hostname)
+	for _, allowed := range p.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(hostname, allowed[1:]) && len(hostname) > len(allowed)-1 {
+				return true
+			}
+			continue
+		}
+		if hostname == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPEgressOptions contains the options for the HTTP requests that actors make with
+// HostCapabilities.HTTPFetch (or the wapcutils.HTTPFetchOperationName host function for
+// WASM actors). Requests are made by the server so modules don't have to embed an HTTP
+// stack, and operators control (and can audit with Environment.HTTPEgressStats) which
+// hosts the actors of each namespace can reach.
+type HTTPEgressOptions struct {
+	// NamespacePolicies contains the policy of each namespace. The actors of namespaces
+	// without a policy can't make any requests.
+	NamespacePolicies map[string]HTTPEgressPolicy
+	// Timeout is the maximum duration of each request, including reading its response.
+	// Requests are also bounded by the deadline of the invocation that made them.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 10 seconds.
+	Timeout time.Duration
+	// MaxResponseBytes is the maximum size of the body of responses. Requests whose
+	// response is larger fail.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 1MiB.
+	MaxResponseBytes int64
+	// Transport is used to make the requests.
+	//
+	// If nil, http.DefaultTransport will be used.
+	Transport http.RoundTripper
+}
+
+func (h *HTTPEgressOptions) Validate() error {
+	for namespace, policy := range h.NamespacePolicies {
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("invalid NamespacePolicies for namespace: %s: %w", namespace, err)
+		}
+	}
+	if h.Timeout < 0 {
+		return fmt.Errorf("Timeout must be >= 0")
+	}
+	if h.MaxResponseBytes < 0 {
+		return fmt.Errorf("MaxResponseBytes must be >= 0")
+	}
+	return nil
+}
+
+// HTTPEgressStats contains statistics about the HTTP requests that the actors of a single
+// namespace made on a server.
+type HTTPEgressStats struct {
+	// Requests is the total number of requests that were allowed and made.
+	Requests uint64
+	// Denied is the total number of requests that were denied because their host (or the
+	// host of one of their redirects) was not allowed.
+	Denied uint64
+	// RateLimited is the total number of requests that were denied because the namespace
+	// exceeded HTTPEgressPolicy.RateLimit.
+	RateLimited uint64
+	// Failed is the total number of requests that were made but failed, for example
+	// because they timed out or their response exceeded HTTPEgressOptions.MaxResponseBytes.
+	Failed uint64
+	// ResponseBytes is the total size of the bodies of the responses that were returned to
+	// actors.
+	ResponseBytes uint64
+}
+
+// httpEgress makes the HTTP requests of actors and enforces the policy of their
+// namespace. All its methods are safe to call on a nil *httpEgress, in which case every
+// request is denied.
+type httpEgress struct {
+	sync.Mutex
+
+	opts       HTTPEgressOptions
+	namespaces map[string]*namespaceEgress
+}
+
+// namespaceEgress is the state of the HTTP requests of a single namespace.
+type namespaceEgress struct {
+	policy HTTPEgressPolicy
+	// rateLimiter is nil if the requests of the namespace are not rate limited.
+	rateLimiter *tokenBucket
+
+	requests      atomic.Uint64
+	denied        atomic.Uint64
+	rateLimited   atomic.Uint64
+	failed        atomic.Uint64
+	responseBytes atomic.Uint64
+}
+
+func newHTTPEgress(opts HTTPEgressOptions) *httpEgress {
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultHTTPEgressTimeout
+	}
+	if opts.MaxResponseBytes == 0 {
+		opts.MaxResponseBytes = defaultHTTPEgressMaxResponseBytes
+	}
+	if opts.Transport == nil {
+		opts.Transport = http.DefaultTransport
+	}
+	return &httpEgress{
+		opts:       opts,
+		namespaces: make(map[string]*namespaceEgress),
+	}
+}
+
+// get returns the state of the provided namespace, creating it if necessary.
+func (e *httpEgress) get(namespace string) *namespaceEgress {
+	e.Lock()
+	defer e.Unlock()
+	ns, ok := e.namespaces[namespace]
+	if !ok {
+		policy := e.opts.NamespacePolicies[namespace]
+		ns = &namespaceEgress{
+			policy:      policy,
+			rateLimiter: newTokenBucket(policy.RateLimit, time.Now()),
+		}
+		e.namespaces[namespace] = ns
+	}
+	return ns
+}
+
+// fetch makes the HTTP request of an actor of the provided namespace.
+func (e *httpEgress) fetch(
+	ctx context.Context,
+	namespace string,
+	req wapcutils.HTTPFetchRequest,
+) (wapcutils.HTTPFetchResponse, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return wapcutils.HTTPFetchResponse{}, fmt.Errorf("HTTPFetch: invalid URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return wapcutils.HTTPFetchResponse{}, fmt.Errorf(
+			"HTTPFetch: URL must be an absolute http or https URL, got: %s", req.URL)
+	}
+	if e == nil {
+		return wapcutils.HTTPFetchResponse{}, &HTTPEgressDeniedError{
+			Namespace: namespace,
+			Host:      u.Hostname(),
+		}
+	}
+
+	ns := e.get(namespace)
+	if !ns.policy.allows(u.Hostname()) {
+		ns.denied.Add(1)
+		return wapcutils.HTTPFetchResponse{}, &HTTPEgressDeniedError{
+			Namespace: namespace,
+			Host:      u.Hostname(),
+		}
+	}
+	if ns.rateLimiter != nil {
+		if retryAfter, ok := ns.rateLimiter.take(time.Now()); !ok {
+			ns.rateLimited.Add(1)
+			return wapcutils.HTTPFetchResponse{}, &HTTPEgressDeniedError{
+				Namespace:  namespace,
+				Host:       u.Hostname(),
+				RetryAfter: retryAfter,
+			}
+		}
+	}
+
+	ctx, cc := context.WithTimeout(ctx, e.opts.Timeout)
+	defer cc()
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, req.URL, bytes.NewReader(req.Body))
+	if err != nil {
+		return wapcutils.HTTPFetchResponse{}, fmt.Errorf("HTTPFetch: error creating request: %w", err)
+	}
+	for k, v := range req.Header {
+		httpReq.Header[k] = v
+	}
+	client := &http.Client{
+		Transport: e.opts.Transport,
+		// Redirects are followed only if their host is allowed as well, otherwise an
+		// allowed host could be used to reach any other host.
+		CheckRedirect: func(redirect *http.Request, via []*http.Request) error {
+			if len(via) >= maxHTTPEgressRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxHTTPEgressRedirects)
+			}
+			if !ns.policy.allows(redirect.URL.Hostname()) {
+				return &HTTPEgressDeniedError{
+					Namespace: namespace,
+					Host:      redirect.URL.Hostname(),
+				}
+			}
+			return nil
+		},
+	}
+
+	ns.requests.Add(1)
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		if IsHTTPEgressDeniedErr(err) {
+			ns.denied.Add(1)
+		} else {
+			ns.failed.Add(1)
+		}
+		return wapcutils.HTTPFetchResponse{}, fmt.Errorf("HTTPFetch: error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, e.opts.MaxResponseBytes+1))
+	if err != nil {
+		ns.failed.Add(1)
+		return wapcutils.HTTPFetchResponse{}, fmt.Errorf("HTTPFetch: error reading response: %w", err)
+	}
+	if int64(len(body)) > e.opts.MaxResponseBytes {
+		ns.failed.Add(1)
+		return wapcutils.HTTPFetchResponse{}, fmt.Errorf(
+			"HTTPFetch: response body exceeds MaxResponseBytes: %d", e.opts.MaxResponseBytes)
+	}
+	ns.responseBytes.Add(uint64(len(body)))
+
+	return wapcutils.HTTPFetchResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+	}, nil
+}
+
+// stats returns the statistics of every namespace that made a request.
+func (e *httpEgress) stats() map[string]HTTPEgressStats {
+	if e == nil {
+		return map[string]HTTPEgressStats{}
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	stats := make(map[string]HTTPEgressStats, len(e.namespaces))
+	for namespace, ns := range e.namespaces {
+		stats[namespace] = HTTPEgressStats{
+			Requests:      ns.requests.Load(),
+			Denied:        ns.denied.Load(),
+			RateLimited:   ns.rateLimited.Load(),
+			Failed:        ns.failed.Load(),
+			ResponseBytes: ns.responseBytes.Load(),
+		}
+	}
+	return stats
+}
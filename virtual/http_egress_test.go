@@ -0,0 +1,153 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestHTTPEgress ensures that actors can only make HTTP requests to the hosts that are
+// allowed for their namespace, that requests are bounded by the configured timeout, response
+// size and rate limit, and that the requests of every namespace are reported.
+func TestHTTPEgress(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.Header().Set("X-Test", r.Header.Get("X-Test"))
+			w.Write([]byte(r.Method + " ok"))
+		case "/big":
+			w.Write([]byte(strings.Repeat("a", 11)))
+		case "/redirect":
+			http.Redirect(w, r, strings.Replace(
+				"http://"+r.Host+"/ok", "127.0.0.1", "localhost", 1), http.StatusFound)
+		case "/slow":
+			time.Sleep(500 * time.Millisecond)
+		}
+	}))
+	defer httpServer.Close()
+
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 58
+	opts.HTTPEgress = HTTPEgressOptions{
+		NamespacePolicies: map[string]HTTPEgressPolicy{
+			"ns-1": {AllowedHosts: []string{"127.0.0.1"}},
+			"ns-2": {
+				AllowedHosts: []string{"127.0.0.1"},
+				RateLimit:    RateLimit{Rate: 0.001, Burst: 1},
+			},
+		},
+		Timeout:          100 * time.Millisecond,
+		MaxResponseBytes: 10,
+	}
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	for _, namespace := range []string{"ns-1", "ns-2", "ns-3"} {
+		require.NoError(t, env.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: namespace, ID: "test-module"}, testModule{}))
+	}
+
+	fetch := func(namespace string, req wapcutils.HTTPFetchRequest) (wapcutils.HTTPFetchResponse, error) {
+		marshaled, err := json.Marshal(&req)
+		require.NoError(t, err)
+		result, err := env.InvokeActor(
+			ctx, namespace, "a", "test-module", "httpFetch", marshaled, types.CreateIfNotExist{})
+		if err != nil {
+			return wapcutils.HTTPFetchResponse{}, err
+		}
+		var resp wapcutils.HTTPFetchResponse
+		require.NoError(t, json.Unmarshal(result, &resp))
+		return resp, nil
+	}
+	requireDenied := func(err error, host string, rateLimited bool) {
+		require.True(t, IsHTTPEgressDeniedErr(err), err)
+		var deniedErr *HTTPEgressDeniedError
+		require.True(t, errors.As(err, &deniedErr))
+		require.Equal(t, host, deniedErr.Host)
+		require.Equal(t, rateLimited, deniedErr.RetryAfter > 0)
+	}
+
+	resp, err := fetch("ns-1", wapcutils.HTTPFetchRequest{
+		Method: http.MethodPost,
+		URL:    httpServer.URL + "/ok",
+		Header: map[string][]string{"X-Test": {"value"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "POST ok", string(resp.Body))
+	require.Equal(t, []string{"value"}, resp.Header["X-Test"])
+
+	// Hosts that are not allowed are denied, including when they're redirected to.
+	_, err = fetch("ns-1", wapcutils.HTTPFetchRequest{
+		URL: strings.Replace(httpServer.URL, "127.0.0.1", "localhost", 1) + "/ok"})
+	requireDenied(err, "localhost", false)
+	_, err = fetch("ns-1", wapcutils.HTTPFetchRequest{URL: httpServer.URL + "/redirect"})
+	requireDenied(err, "localhost", false)
+
+	// Requests are bounded by the timeout and the maximum response size.
+	_, err = fetch("ns-1", wapcutils.HTTPFetchRequest{URL: httpServer.URL + "/slow"})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = fetch("ns-1", wapcutils.HTTPFetchRequest{URL: httpServer.URL + "/big"})
+	require.ErrorContains(t, err, "exceeds MaxResponseBytes")
+
+	_, err = fetch("ns-1", wapcutils.HTTPFetchRequest{URL: "file:///etc/passwd"})
+	require.Error(t, err)
+	require.False(t, IsHTTPEgressDeniedErr(err))
+
+	// Requests of namespaces are rate limited, and namespaces without a policy can't make
+	// any requests.
+	_, err = fetch("ns-2", wapcutils.HTTPFetchRequest{URL: httpServer.URL + "/ok"})
+	require.NoError(t, err)
+	_, err = fetch("ns-2", wapcutils.HTTPFetchRequest{URL: httpServer.URL + "/ok"})
+	requireDenied(err, "127.0.0.1", true)
+	_, err = fetch("ns-3", wapcutils.HTTPFetchRequest{URL: httpServer.URL + "/ok"})
+	requireDenied(err, "127.0.0.1", false)
+
+	require.Equal(t, map[string]HTTPEgressStats{
+		"ns-1": {Requests: 4, Denied: 2, Failed: 2, ResponseBytes: 7},
+		"ns-2": {Requests: 1, RateLimited: 1, ResponseBytes: 6},
+		"ns-3": {Denied: 1},
+	}, env.HTTPEgressStats())
+}
+
+// TestHTTPEgressPolicy ensures that policies match hostnames exactly or by subdomain, and
+// that invalid policies are rejected.
+func TestHTTPEgressPolicy(t *testing.T) {
+	policy := HTTPEgressPolicy{AllowedHosts: []string{"api.example.com", "*.Example.org"}}
+	require.NoError(t, policy.validate())
+	for host, allowed := range map[string]bool{
+		"api.example.com":     true,
+		"API.example.com":     true,
+		"example.com":         false,
+		"evilapi.example.com": false,
+		"a.example.org":       true,
+		"a.b.example.org":     true,
+		"example.org":         false,
+		"evilexample.org":     false,
+	} {
+		require.Equal(t, allowed, policy.allows(host), host)
+	}
+
+	for _, host := range []string{"", "*.", "https://example.com", "example.com:443", "example.com/a"} {
+		require.Error(t, (&HTTPEgressOptions{NamespacePolicies: map[string]HTTPEgressPolicy{
+			"ns-1": {AllowedHosts: []string{host}},
+		}}).Validate(), host)
+	}
+	require.Error(t, (&HTTPEgressOptions{Timeout: -1}).Validate())
+	require.Error(t, (&HTTPEgressOptions{MaxResponseBytes: -1}).Validate())
+}
@@ -0,0 +1,159 @@
+package virtual
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// idempotencyKeyHeader is the header that carries the idempotency key of invocations
+	// that are forwarded to other servers.
+	idempotencyKeyHeader = "X-Nola-Idempotency-Key"
+
+	defaultMaxIdempotencyKeysPerActor = 128
+	defaultIdempotencyKeyTTL          = 5 * time.Minute
+)
+
+// IdempotencyOptions contains the options for deduplicating invocations that carry an
+// idempotency key (see WithIdempotencyKey).
+type IdempotencyOptions struct {
+	// MaxKeysPerActor is the maximum number of idempotency keys (and their results)
+	// that are remembered for each activated actor. The least recently used keys are
+	// forgotten once it's exceeded.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 128.
+	MaxKeysPerActor int
+	// TTL is how long the result of an invocation is remembered after it completes.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 5 minutes.
+	TTL time.Duration
+}
+
+func (i *IdempotencyOptions) Validate() error {
+	if i.MaxKeysPerActor < 0 {
+		return fmt.Errorf("MaxKeysPerActor must be >= 0")
+	}
+	if i.TTL < 0 {
+		return fmt.Errorf("TTL must be >= 0")
+	}
+	return nil
+}
+
+type idempotencyKeyCtxKey struct{}
+
+// WithIdempotencyKey returns a context that attaches the provided idempotency key to
+// invocations of actors, which makes it safe for callers to retry invocations that timed
+// out: if the actor already executed an invocation with the same key, the result of that
+// invocation is returned instead of executing it again. Keys are scoped to the actor
+// that is invoked.
+//
+// Deduplication is best-effort: keys are only remembered by the activation of the actor
+// (for up to IdempotencyOptions.TTL, and as long as they are not evicted by newer keys),
+// so an invocation may execute again if the actor is deactivated or moved to another
+// server in the meantime. Actors that need exactly-once semantics across deactivations
+// must persist the keys they've seen in their own state. Failed invocations are not
+// remembered so they're executed again when retried.
+//
+// Results of invocations with an idempotency key are buffered so they're never
+// streamed, even if WithStreamingResponse is used. Note that the key only applies to
+// the invocation that the context is passed to, not to the invocations that the actor
+// makes while handling it.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyCtxKey{}, key)
+}
+
+// withoutIdempotencyKey returns a context that undoes WithIdempotencyKey.
+func withoutIdempotencyKey(ctx context.Context) context.Context {
+	if _, ok := idempotencyKeyFromContext(ctx); !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, idempotencyKeyCtxKey{}, "")
+}
+
+func idempotencyKeyFromContext(ctx context.Context) (string, bool) {
+	key, _ := ctx.Value(idempotencyKeyCtxKey{}).(string)
+	return key, key != ""
+}
+
+// injectIdempotencyKey adds the idempotency key of ctx (if any) to header so that it is
+// honored by the server that the invocation is forwarded to.
+func injectIdempotencyKey(ctx context.Context, header http.Header) {
+	if key, ok := idempotencyKeyFromContext(ctx); ok {
+		header.Set(idempotencyKeyHeader, key)
+	}
+}
+
+// extractIdempotencyKey is the inverse of injectIdempotencyKey.
+func extractIdempotencyKey(ctx context.Context, header http.Header) context.Context {
+	if key := header.Get(idempotencyKeyHeader); key != "" {
+		return WithIdempotencyKey(ctx, key)
+	}
+	return ctx
+}
+
+// idempotencyCache remembers the results of the invocations of a single activated actor
+// by their idempotency key. It's an LRU with a TTL. It's not safe for concurrent use, the
+// actor's lock must be held.
+type idempotencyCache struct {
+	maxKeys int
+	ttl     time.Duration
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type idempotencyEntry struct {
+	key       string
+	result    []byte
+	expiresAt time.Time
+}
+
+func newIdempotencyCache(opts IdempotencyOptions) *idempotencyCache {
+	return &idempotencyCache{
+		maxKeys: opts.MaxKeysPerActor,
+		ttl:     opts.TTL,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *idempotencyCache) get(key string, now time.Time) ([]byte, bool) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*idempotencyEntry)
+	if now.After(entry.expiresAt) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.result, true
+}
+
+func (c *idempotencyCache) put(key string, result []byte, now time.Time) {
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&idempotencyEntry{
+		key:       key,
+		result:    result,
+		expiresAt: now.Add(c.ttl),
+	})
+
+	for c.lru.Len() > c.maxKeys {
+		c.remove(c.lru.Back())
+	}
+	// Also forget the least recently used entries that have expired so that results
+	// don't outlive their TTL in memory just because the limit is never reached.
+	for back := c.lru.Back(); back != nil && now.After(back.Value.(*idempotencyEntry).expiresAt); back = c.lru.Back() {
+		c.remove(back)
+	}
+}
+
+func (c *idempotencyCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*idempotencyEntry).key)
+}
@@ -0,0 +1,149 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestIdempotencyKey ensures that invocations that are retried with the same idempotency
+// key are only executed once per actor.
+func TestIdempotencyKey(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 26
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	invoke := func(ctx context.Context, actorID, operation string, payload []byte) ([]byte, error) {
+		return env.InvokeActor(
+			ctx, "ns-1", actorID, "test-module", operation, payload, types.CreateIfNotExist{})
+	}
+	inc := func(ctx context.Context, actorID string) int64 {
+		result, err := invoke(ctx, actorID, "inc", nil)
+		require.NoError(t, err)
+		return getCount(t, result)
+	}
+
+	// The first invocation with a key activates the actor.
+	require.Equal(t, int64(1), inc(WithIdempotencyKey(ctx, "k1"), "a"))
+	require.Equal(t, int64(1), inc(WithIdempotencyKey(ctx, "k1"), "a"))
+	require.Equal(t, int64(2), inc(ctx, "a"))
+	require.Equal(t, int64(3), inc(WithIdempotencyKey(ctx, "k2"), "a"))
+	require.Equal(t, int64(1), inc(WithIdempotencyKey(ctx, "k1"), "a"))
+	// Keys are scoped to the actor.
+	require.Equal(t, int64(1), inc(WithIdempotencyKey(ctx, "k2"), "b"))
+	require.Equal(t, int64(2), inc(WithIdempotencyKey(ctx, "k1"), "b"))
+
+	// Failed invocations are not remembered.
+	for i := 0; i < 2; i++ {
+		_, err := invoke(WithIdempotencyKey(ctx, "k3"), "a", "does-not-exist", nil)
+		require.ErrorContains(t, err, "unhandled operation")
+	}
+
+	// Keys don't apply to the invocations that the actor makes.
+	req, err := json.Marshal(types.InvokeActorRequest{ActorID: "c", ModuleID: "test-module", Operation: "inc"})
+	require.NoError(t, err)
+	result, err := invoke(WithIdempotencyKey(ctx, "k4"), "a", "invokeActor", req)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+	require.Equal(t, int64(2), inc(WithIdempotencyKey(ctx, "k4"), "c"))
+	require.Equal(t, int64(4), inc(ctx, "a"))
+
+	// Streaming responses are buffered so they can be remembered.
+	for i := 0; i < 2; i++ {
+		stream, err := env.InvokeActorStream(
+			WithStreamingResponse(WithIdempotencyKey(ctx, "k5")),
+			"ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		result, err := io.ReadAll(stream)
+		require.NoError(t, err)
+		require.NoError(t, stream.Close())
+		require.Equal(t, int64(5), getCount(t, result))
+	}
+
+	require.Error(t, (&IdempotencyOptions{TTL: -1}).Validate())
+}
+
+// TestIdempotencyKeyForwarded ensures that idempotency keys are honored by the server that
+// invocations are forwarded to.
+func TestIdempotencyKeyForwarded(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 27
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	httpServer := httptest.NewServer(http.HandlerFunc(NewServer(reg, env).invokeDirect))
+	defer httpServer.Close()
+	references, err := reg.EnsureActivation(ctx, "ns-1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	ref, err := types.NewActorReference(
+		references[0].ServerID(), references[0].ServerVersion(),
+		strings.TrimPrefix(httpServer.URL, "http://"), "ns-1", "test-module", "a",
+		references[0].Generation())
+	require.NoError(t, err)
+	vs, err := reg.GetVersionStamp(ctx)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		stream, err := NewHTTPClient().InvokeActorRemote(
+			WithIdempotencyKey(ctx, "k1"), vs, ref, "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		result, err := io.ReadAll(stream)
+		require.NoError(t, err)
+		require.NoError(t, stream.Close())
+		require.Equal(t, int64(1), getCount(t, result))
+	}
+}
+
+func TestIdempotencyCache(t *testing.T) {
+	var (
+		c   = newIdempotencyCache(IdempotencyOptions{MaxKeysPerActor: 2, TTL: time.Minute})
+		now = time.Now()
+	)
+	c.put("a", []byte("1"), now)
+	c.put("b", []byte("2"), now)
+	result, ok := c.get("a", now)
+	require.True(t, ok)
+	require.Equal(t, []byte("1"), result)
+
+	// The least recently used key is evicted.
+	c.put("c", []byte("3"), now)
+	_, ok = c.get("b", now)
+	require.False(t, ok)
+	_, ok = c.get("a", now)
+	require.True(t, ok)
+
+	// Keys expire after the TTL.
+	_, ok = c.get("c", now.Add(2*time.Minute))
+	require.False(t, ok)
+	c.put("d", []byte("4"), now.Add(2*time.Minute))
+	require.Equal(t, 1, c.lru.Len())
+	result, ok = c.get("d", now.Add(2*time.Minute))
+	require.True(t, ok)
+	require.Equal(t, []byte("4"), result)
+}
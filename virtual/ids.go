@@ -0,0 +1,72 @@
+package virtual
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// crockfordBase32 is the alphabet that ULIDs are encoded with. Its characters are sorted
+// so that encoded ULIDs sort the same way as their bytes.
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// idGenerator generates ULIDs (https://github.com/ulid/spec): 26 character strings that
+// begin with the millisecond at which they were generated, followed by 80 random bits.
+// IDs generated by the same idGenerator are strictly increasing (even if they're
+// generated within the same millisecond or the clock goes backwards) so they can be
+// used as ordered keys.
+type idGenerator struct {
+	sync.Mutex
+	lastMillis  uint64
+	lastEntropy [10]byte
+}
+
+func (g *idGenerator) newID(now time.Time) string {
+	g.Lock()
+	defer g.Unlock()
+
+	millis := uint64(now.UnixMilli())
+	if millis > g.lastMillis {
+		g.lastMillis = millis
+		if _, err := rand.Read(g.lastEntropy[:]); err != nil {
+			panic(err)
+		}
+	} else if !incrementEntropy(&g.lastEntropy) {
+		// The entropy overflowed so borrow the next millisecond to preserve the ordering.
+		g.lastMillis++
+	}
+
+	var id [16]byte
+	binary.BigEndian.PutUint16(id[:2], uint16(g.lastMillis>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(g.lastMillis))
+	copy(id[6:], g.lastEntropy[:])
+	return encodeULID(id)
+}
+
+// incrementEntropy increments entropy by one and returns false if it overflowed.
+func incrementEntropy(entropy *[10]byte) bool {
+	for i := len(entropy) - 1; i >= 0; i-- {
+		entropy[i]++
+		if entropy[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID encodes the 128 bits of id as 26 base32 characters, the first of which
+// only encodes 3 bits.
+func encodeULID(id [16]byte) string {
+	var (
+		dst [26]byte
+		hi  = binary.BigEndian.Uint64(id[:8])
+		lo  = binary.BigEndian.Uint64(id[8:])
+	)
+	for i := len(dst) - 1; i >= 0; i-- {
+		dst[i] = crockfordBase32[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(dst[:])
+}
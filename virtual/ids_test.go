@@ -0,0 +1,64 @@
+package virtual
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIDGenerator(t *testing.T) {
+	var (
+		g   idGenerator
+		now = time.UnixMilli(1469918176385)
+		ids []string
+	)
+	// IDs are strictly increasing within the same millisecond, and when the clock goes
+	// backwards.
+	for i := 0; i < 100; i++ {
+		ids = append(ids, g.newID(now))
+	}
+	ids = append(ids, g.newID(now.Add(-time.Second)))
+	ids = append(ids, g.newID(now.Add(time.Millisecond)))
+	for i := 1; i < len(ids); i++ {
+		require.Less(t, ids[i-1], ids[i])
+	}
+	require.True(t, sort.StringsAreSorted(ids))
+
+	// The timestamp is encoded in the first 10 characters (example from the ULID spec).
+	for _, id := range ids[:len(ids)-1] {
+		require.Len(t, id, 26)
+		require.Equal(t, "01ARYZ6S41", id[:10])
+	}
+
+	// The entropy borrows the next millisecond when it overflows.
+	for i := range g.lastEntropy {
+		g.lastEntropy[i] = 0xff
+	}
+	id := g.newID(now)
+	require.Equal(t, "01ARYZ6S43", id[:10])
+	require.Equal(t, "0000000000000000", id[10:])
+}
+
+// TestNewIDHostFunction ensures that the NEW-ID host function that is exposed to WASM
+// modules returns unique IDs.
+func TestNewIDHostFunction(t *testing.T) {
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+	host := newHostCapabilities(nil, nil, nil, nil, ref, nil, nil, nil, nil, nil, nil)
+
+	router := newHostFnRouter(nil, nil, nil, nil)
+	invokeCtx := context.WithValue(context.Background(), hostFnActorReferenceCtxKey{}, ref)
+	invokeCtx = context.WithValue(invokeCtx, hostFnHostCapabilitiesKey{}, host)
+	first, err := router(invokeCtx, "", "", wapcutils.NewIDOperationName, nil)
+	require.NoError(t, err)
+	second, err := router(invokeCtx, "", "", wapcutils.NewIDOperationName, nil)
+	require.NoError(t, err)
+	require.Len(t, first, 26)
+	require.Less(t, string(first), string(second))
+}
@@ -0,0 +1,168 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/richardartoul/nola/durable"
+	"github.com/richardartoul/nola/virtual/registry"
+)
+
+const (
+	// invokeErrorCategoryHeader and trapReasonHeader carry the category (and trap reason)
+	// of the errors of invocations that fail on other servers so that they're preserved
+	// across RPCs.
+	invokeErrorCategoryHeader = "X-Nola-Invoke-Error-Category"
+	trapReasonHeader          = "X-Nola-Trap-Reason"
+)
+
+// InvokeErrorCategory describes why an invocation failed so that callers can decide
+// whether to retry it.
+type InvokeErrorCategory string
+
+const (
+	// InvokeErrorCategoryAppError indicates that the actor returned an error, or that the
+	// invocation itself is invalid (for example because its module doesn't exist).
+	// Retrying the invocation will most likely fail the same way.
+	InvokeErrorCategoryAppError InvokeErrorCategory = "app_error"
+	// InvokeErrorCategoryTrap indicates that the actor's module trapped (for example
+	// because it panicked, accessed memory out of bounds or ran out of fuel) while
+	// handling the invocation. TrapReason describes the trap.
+	InvokeErrorCategoryTrap InvokeErrorCategory = "trap"
+	// InvokeErrorCategoryTimeout indicates that the invocation did not complete before
+	// its deadline (or the actor's invoke timeout), or that it was canceled. The
+	// invocation may or may not have been applied.
+	InvokeErrorCategoryTimeout InvokeErrorCategory = "timeout"
+	// InvokeErrorCategoryRoutingError indicates that the invocation was routed to a
+	// server that no longer hosts the actor, usually because the caller's view of the
+	// actor's activation is stale. The invocation was not applied and can be retried.
+	InvokeErrorCategoryRoutingError InvokeErrorCategory = "routing_error"
+	// InvokeErrorCategoryServerUnavailable indicates that a server (or the registry)
+	// that the invocation depends on can't serve it right now, for example because it
+	// is draining, unreachable or rate limiting the actor. Errors that can't be
+	// attributed to the actor are reported in this category as well since they're
+	// failures of the system rather than of the application.
+	InvokeErrorCategoryServerUnavailable InvokeErrorCategory = "server_unavailable"
+)
+
+// Retryable returns whether invocations that failed with errors in the category can be
+// retried safely because they were not applied.
+func (c InvokeErrorCategory) Retryable() bool {
+	return c == InvokeErrorCategoryRoutingError || c == InvokeErrorCategoryServerUnavailable
+}
+
+// InvokeError is the error of a failed invocation. Errors returned by the invocation
+// methods of Environment (and the results of batch invocations) wrap an *InvokeError,
+// including the errors of invocations that failed on other servers. Use AsInvokeError
+// to get it.
+type InvokeError struct {
+	// Category describes why the invocation failed.
+	Category InvokeErrorCategory
+	// TrapReason is the runtime's description of the trap (for example "wasm error:
+	// unreachable") if Category is InvokeErrorCategoryTrap, and empty otherwise.
+	TrapReason string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *InvokeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InvokeError) Unwrap() error {
+	return e.Err
+}
+
+// AsInvokeError returns the InvokeError that err is (or wraps), if any.
+func AsInvokeError(err error) (*InvokeError, bool) {
+	var invokeErr *InvokeError
+	if errors.As(err, &invokeErr) {
+		return invokeErr, true
+	}
+	return nil, false
+}
+
+// newRoutingError returns an InvokeError in the InvokeErrorCategoryRoutingError
+// category.
+func newRoutingError(err error) error {
+	return &InvokeError{Category: InvokeErrorCategoryRoutingError, Err: err}
+}
+
+// newInvalidInvokeError returns an InvokeError in the InvokeErrorCategoryAppError
+// category for an invocation that is invalid.
+func newInvalidInvokeError(err error) error {
+	return &InvokeError{Category: InvokeErrorCategoryAppError, Err: err}
+}
+
+// actorInvokeError categorizes an error that was returned by an actor's Invoke method.
+// Errors are attributed to the actor unless its module trapped or the invocation timed
+// out. Note that errors the actor returns are attributed to it even if they're the
+// errors of invocations of other actors that it made.
+func actorInvokeError(err error) error {
+	if err == nil || isTimeoutErr(err) {
+		return err
+	}
+	if trapErr, ok := durable.AsTrapError(err); ok {
+		return &InvokeError{Category: InvokeErrorCategoryTrap, TrapReason: trapErr.Reason, Err: err}
+	}
+	return &InvokeError{Category: InvokeErrorCategoryAppError, Err: err}
+}
+
+// categorizeInvokeErr ensures that the error of a failed invocation wraps an InvokeError
+// so it can be returned to the caller. Errors that were categorized where they happened
+// are returned unmodified.
+func categorizeInvokeErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := AsInvokeError(err); ok {
+		return err
+	}
+
+	category := InvokeErrorCategoryServerUnavailable
+	switch {
+	case isTimeoutErr(err):
+		category = InvokeErrorCategoryTimeout
+	case errors.Is(err, registry.ErrModuleNotFound) || IsMaxInvocationDepthExceededErr(err):
+		// Retrying won't help since the invocation itself is invalid.
+		category = InvokeErrorCategoryAppError
+	case IsActorQuarantinedErr(err):
+		// Retrying won't help until the quarantine ends, and the actor is to blame.
+		category = InvokeErrorCategoryAppError
+	}
+	return &InvokeError{Category: category, Err: err}
+}
+
+func isTimeoutErr(err error) bool {
+	return IsInvocationTimeoutErr(err) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, context.Canceled)
+}
+
+// setInvokeErrorHeaders sets the headers that preserve the category of the error of an
+// invocation that failed on this server.
+func setInvokeErrorHeaders(h http.Header, err error) {
+	invokeErr, ok := AsInvokeError(err)
+	if !ok {
+		return
+	}
+	h.Set(invokeErrorCategoryHeader, string(invokeErr.Category))
+	if invokeErr.TrapReason != "" {
+		h.Set(trapReasonHeader, invokeErr.TrapReason)
+	}
+}
+
+// invokeErrorFromHeaders wraps the error of an invocation that failed on another server
+// with the InvokeError described by the headers of its response, if any.
+func invokeErrorFromHeaders(h http.Header, err error) error {
+	category := h.Get(invokeErrorCategoryHeader)
+	if category == "" {
+		return err
+	}
+	return &InvokeError{
+		Category:   InvokeErrorCategory(category),
+		TrapReason: h.Get(trapReasonHeader),
+		Err:        err,
+	}
+}
@@ -0,0 +1,106 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/durable"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestInvokeErrorCategories ensures that the errors of failed invocations are
+// categorized by why they failed.
+func TestInvokeErrorCategories(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 39
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	requireCategory := func(err error, category InvokeErrorCategory) {
+		t.Helper()
+		invokeErr, ok := AsInvokeError(err)
+		require.True(t, ok, "error is not an InvokeError: %v", err)
+		require.Equal(t, category, invokeErr.Category)
+	}
+
+	// Errors returned by the actor.
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "getConfig", []byte("missing"), types.CreateIfNotExist{})
+	requireCategory(err, InvokeErrorCategoryAppError)
+	require.False(t, InvokeErrorCategoryAppError.Retryable())
+
+	// Invalid invocations.
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "", "inc", nil, types.CreateIfNotExist{})
+	requireCategory(err, InvokeErrorCategoryAppError)
+
+	// Invocations that don't complete before their deadline.
+	timeoutCtx, cc := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cc()
+	_, err = env.InvokeActor(
+		timeoutCtx, "ns-1", "a", "test-module", "block", nil, types.CreateIfNotExist{})
+	requireCategory(err, InvokeErrorCategoryTimeout)
+
+	// Invocations that are routed to the wrong server.
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+	_, err = env.InvokeActorDirect(
+		ctx, 1, "serverID2", 1, ref, "inc", nil, types.CreateIfNotExist{})
+	requireCategory(err, InvokeErrorCategoryRoutingError)
+	require.True(t, InvokeErrorCategoryRoutingError.Retryable())
+
+	// Batches categorize the errors of each invocation.
+	results, err := env.InvokeActorBatch(ctx, "ns-1", []BatchInvocation{
+		{ActorID: "a", ModuleID: "test-module", Operation: "inc"},
+		{ActorID: "a", ModuleID: "test-module", Operation: "getConfig", Payload: []byte("missing")},
+	})
+	require.NoError(t, err)
+	require.NoError(t, results[0].Err)
+	requireCategory(results[1].Err, InvokeErrorCategoryAppError)
+
+	// Errors that can't be attributed to the actor.
+	requireCategory(categorizeInvokeErr(errors.New("some error")), InvokeErrorCategoryServerUnavailable)
+	require.True(t, InvokeErrorCategoryServerUnavailable.Retryable())
+
+	// Traps.
+	err = actorInvokeError(&durable.TrapError{Reason: "wasm error: unreachable", Err: errors.New("trap")})
+	requireCategory(err, InvokeErrorCategoryTrap)
+	invokeErr, _ := AsInvokeError(err)
+	require.Equal(t, "wasm error: unreachable", invokeErr.TrapReason)
+}
+
+// TestInvokeErrorRPC ensures that the categories of errors are preserved across RPCs.
+func TestInvokeErrorRPC(t *testing.T) {
+	err := &InvokeError{
+		Category:   InvokeErrorCategoryTrap,
+		TrapReason: "wasm error: unreachable",
+		Err:        errors.New("trap"),
+	}
+
+	w := httptest.NewRecorder()
+	writeInvokeError(w, err)
+	decoded, ok := AsInvokeError(invokeErrorFromHeaders(w.Header(), errors.New("trap")))
+	require.True(t, ok)
+	require.Equal(t, InvokeErrorCategoryTrap, decoded.Category)
+	require.Equal(t, "wasm error: unreachable", decoded.TrapReason)
+
+	results := newInvokeActorBatchResponse([]BatchInvocationResult{{Err: err}, {Result: []byte("ok")}}).results()
+	decoded, ok = AsInvokeError(results[0].Err)
+	require.True(t, ok)
+	require.Equal(t, InvokeErrorCategoryTrap, decoded.Category)
+	require.Equal(t, "wasm error: unreachable", decoded.TrapReason)
+	require.NoError(t, results[1].Err)
+}
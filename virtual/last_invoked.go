@@ -0,0 +1,25 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+type lastInvokedAtCtxKey struct{}
+
+// withLastInvokedAt returns a context for an invocation of an actor whose previous
+// invocation started at lastInvokedAt, which is the zero time if it's the first
+// invocation of the activation.
+func withLastInvokedAt(ctx context.Context, lastInvokedAt time.Time) context.Context {
+	return context.WithValue(ctx, lastInvokedAtCtxKey{}, lastInvokedAt)
+}
+
+// lastInvokedAtFromContext implements HostCapabilities.LastInvokedAt.
+func lastInvokedAtFromContext(ctx context.Context) (time.Time, error) {
+	lastInvokedAt, ok := ctx.Value(lastInvokedAtCtxKey{}).(time.Time)
+	if !ok {
+		return time.Time{}, errors.New("LastInvokedAt can only be called while the actor is being invoked")
+	}
+	return lastInvokedAt, nil
+}
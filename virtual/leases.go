@@ -0,0 +1,172 @@
+package virtual
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const maxConcurrentLeaseRenewals = 16
+
+// activationLeases tracks the activation leases of the actors that the environment hosts
+// when the registry grants them (see registry.HeartbeatResult.ActivationLeaseDuration).
+//
+// The server learns the lease of each actor it hosts by looking up its activation in the
+// registry the first time it sees the actor, and renews it in the background from then
+// on. Actors whose lease can't be renewed before it expires (for example because the
+// server can't reach the registry) are deactivated, since the registry is free to
+// activate them on a different server at that point.
+type activationLeases struct {
+	sync.Mutex
+	m map[*activatedActor]activationLease
+	// Set while leases are being renewed so that slow renewals don't pile up.
+	renewing atomic.Bool
+}
+
+type activationLease struct {
+	lease types.ActivationLease
+	// validUntil is the time until which the lease is known to be valid, measured from
+	// before the registry call that returned it.
+	validUntil time.Time
+	// firstSeenAt is the time at which the actor was first seen, and is used to bound
+	// how long the actor can be hosted before its lease is known.
+	firstSeenAt time.Time
+}
+
+// get returns the lease of the actor, if it's been seen before.
+func (l *activationLeases) get(actor *activatedActor) (activationLease, bool) {
+	l.Lock()
+	defer l.Unlock()
+	lease, ok := l.m[actor]
+	return lease, ok
+}
+
+// put sets the lease of the actor.
+func (l *activationLeases) put(actor *activatedActor, lease activationLease) {
+	l.Lock()
+	defer l.Unlock()
+	if l.m == nil {
+		l.m = make(map[*activatedActor]activationLease)
+	}
+	l.m[actor] = lease
+}
+
+// retain forgets the leases of the actors that are not in actors.
+func (l *activationLeases) retain(actors []*activatedActor) {
+	live := make(map[*activatedActor]struct{}, len(actors))
+	for _, actor := range actors {
+		live[actor] = struct{}{}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	for actor := range l.m {
+		if _, ok := live[actor]; !ok {
+			delete(l.m, actor)
+		}
+	}
+}
+
+// renewActivationLeases renews the leases of all the actors that the environment hosts
+// that are at least halfway through their lease, and deactivates the ones whose lease
+// was lost. It does nothing if the registry doesn't grant leases, or if a previous call
+// is still in progress.
+func (r *environment) renewActivationLeases() {
+	r.heartbeatState.RLock()
+	leaseDuration := r.heartbeatState.ActivationLeaseDuration
+	r.heartbeatState.RUnlock()
+	if leaseDuration <= 0 || !r.leases.renewing.CompareAndSwap(false, true) {
+		return
+	}
+	defer r.leases.renewing.Store(false)
+
+	var (
+		actors = r.activations.activatedActors()
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, maxConcurrentLeaseRenewals)
+	)
+	r.leases.retain(actors)
+	for _, actor := range actors {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(actor *activatedActor) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			ctx, cc := context.WithTimeout(context.Background(), heartbeatTimeout)
+			defer cc()
+			if !r.renewActivationLease(ctx, actor, leaseDuration) {
+				log.Printf("lost activation lease of actor: %v, deactivating it", actor.reference())
+				if r.opts.Handoff.Enabled {
+					r.handoffRevokedActor(actor)
+				} else {
+					r.activations.revokeLease(ctx, actor)
+				}
+			}
+		}(actor)
+	}
+	wg.Wait()
+}
+
+// renewActivationLease renews the lease of the actor if necessary and returns whether
+// the server still holds it.
+func (r *environment) renewActivationLease(
+	ctx context.Context,
+	actor *activatedActor,
+	leaseDuration time.Duration,
+) bool {
+	var (
+		now       = time.Now()
+		ref       = actor.reference()
+		state, ok = r.leases.get(actor)
+	)
+	if !ok {
+		state = activationLease{firstSeenAt: now}
+		r.leases.put(actor, state)
+	}
+
+	if state.lease.IsZero() {
+		// The lease is not known yet, so look it up.
+		refs, err := r.registry.LookupActivation(
+			ctx, ref.Namespace(), ref.ActorID().ID, ref.ModuleID().ID)
+		if err != nil {
+			log.Printf("error looking up activation lease of actor: %v, err: %v", ref, err)
+			return now.Sub(state.firstSeenAt) < leaseDuration
+		}
+		_, serverVersion := r.activations.getServerState()
+		if len(refs) == 0 || refs[0].ServerID() != r.serverID || refs[0].ServerVersion() != serverVersion {
+			// The actor is not activated on this server (anymore).
+			return false
+		}
+		lease := refs[0].Lease()
+		if lease.IsZero() {
+			// The activation was created before the registry granted leases. The next
+			// call to EnsureActivation() will grant it one.
+			return true
+		}
+		state.lease = lease
+		state.validUntil = now.Add(lease.Duration)
+		r.leases.put(actor, state)
+	}
+
+	if state.validUntil.Sub(now) > leaseDuration/2 {
+		return true
+	}
+	lease, err := r.registry.RenewActivationLease(ctx, state.lease.Token)
+	if registry.IsActivationLeaseExpiredErr(err) {
+		return false
+	}
+	if err != nil {
+		log.Printf("error renewing activation lease of actor: %v, err: %v", ref, err)
+		return now.Before(state.validUntil)
+	}
+	state.lease = lease
+	state.validUntil = now.Add(lease.Duration)
+	r.leases.put(actor, state)
+	return true
+}
@@ -0,0 +1,194 @@
+package virtual
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestActivationLeases ensures that the environment renews the activation leases of the
+// actors it hosts, and deactivates the ones whose lease it fails to renew.
+func TestActivationLeases(t *testing.T) {
+	baseReg, err := localregistry.NewLocalRegistryWithOptions(registry.KVRegistryOptions{
+		ActivationLeaseDuration: 3 * time.Second,
+	})
+	require.NoError(t, err)
+	var (
+		reg = &testLeaseRegistry{Registry: baseReg}
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 38
+	opts.GCActorsAfterDurationWithNoInvocations = time.Minute
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+
+	// The lease is renewed so the actor stays activated past its initial lease.
+	require.Eventually(t, func() bool {
+		return reg.numRenewals.Load() >= 2
+	}, 10*time.Second, 10*time.Millisecond)
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), getCount(t, result))
+	require.Zero(t, env.ActivationStats().LeaseRevocations)
+
+	// Once renewals fail the actor is deactivated.
+	reg.expire.Store(true)
+	require.Eventually(t, func() bool {
+		stats := env.ActivationStats()
+		return stats.LeaseRevocations == 1 && stats.NumActivatedActors == 0
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+// TestActivationLeaseHandoff ensures that an actor whose lease is lost because the registry
+// activated it on a different server is handed off to that server when handoffs are
+// enabled.
+func TestActivationLeaseHandoff(t *testing.T) {
+	reg, err := localregistry.NewLocalRegistryWithOptions(registry.KVRegistryOptions{
+		ActivationLeaseDuration: 2 * time.Second,
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+	opts1 := defaultOptsGoByte
+	opts1.Discovery.Port = 72
+	opts1.GCActorsAfterDurationWithNoInvocations = time.Minute
+	opts1.Handoff.Enabled = true
+	env1, err := NewEnvironment(ctx, "serverID1", reg, nil, opts1)
+	require.NoError(t, err)
+	defer env1.Close()
+	require.NoError(t, env1.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	for i := 0; i < 3; i++ {
+		_, err = env1.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+	}
+
+	opts2 := opts1
+	opts2.Discovery.Port = 73
+	env2, err := NewEnvironment(ctx, "serverID2", reg, nil, opts2)
+	require.NoError(t, err)
+	defer env2.Close()
+	require.NoError(t, env2.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	// Move the actor to env2 behind env1's back.
+	m := reg.(registry.MigratableRegistry)
+	servers, err := m.ListServers(ctx)
+	require.NoError(t, err)
+	placement, ok, err := m.GetActorPlacement(ctx, "ns-1", "a", "test-module")
+	require.NoError(t, err)
+	require.True(t, ok)
+	for _, server := range servers {
+		if server.ServerID == "serverID2" {
+			placement.ServerID, placement.ServerVersion = server.ServerID, server.ServerVersion
+		}
+	}
+	require.Equal(t, "serverID2", placement.ServerID)
+	require.NoError(t, m.PutActorPlacement(ctx, placement))
+
+	require.Eventually(t, func() bool {
+		return env1.ActivationStats().LeaseRevocations == 1 &&
+			env1.(*environment).numActivatedActors() == 0 &&
+			env2.(*environment).numActivatedActors() == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	result, err := env2.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(4), getCount(t, result))
+}
+
+// TestFencingTokens ensures that actors can retrieve the fencing token of their activation
+// lease, which stays the same while the lease is renewed and increases once the actor is
+// activated with a new lease.
+func TestFencingTokens(t *testing.T) {
+	baseReg, err := localregistry.NewLocalRegistryWithOptions(registry.KVRegistryOptions{
+		ActivationLeaseDuration: 3 * time.Second,
+	})
+	require.NoError(t, err)
+	var (
+		reg = &testLeaseRegistry{Registry: baseReg}
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 56
+	opts.GCActorsAfterDurationWithNoInvocations = time.Minute
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	fencingToken := func() uint64 {
+		result, err := env.InvokeActor(
+			ctx, "ns-1", "a", "test-module", "fencingToken", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		token, err := strconv.ParseUint(string(result), 10, 64)
+		require.NoError(t, err)
+		return token
+	}
+	token := fencingToken()
+	require.NotZero(t, token)
+
+	// Renewing the lease doesn't change the token.
+	require.Eventually(t, func() bool {
+		return reg.numRenewals.Load() >= 2
+	}, 10*time.Second, 10*time.Millisecond)
+	require.Equal(t, token, fencingToken())
+
+	// Once the lease is lost the actor is activated again with a new lease and token. The
+	// server gives up on the lease before the registry expires it, so wait for the
+	// registry to expire it as well, otherwise the actor is activated under the same lease.
+	reg.expire.Store(true)
+	require.Eventually(t, func() bool {
+		return env.ActivationStats().LeaseRevocations == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	time.Sleep(3 * time.Second)
+	reg.expire.Store(false)
+	require.Greater(t, fencingToken(), token)
+
+	// Actors don't have fencing tokens if the registry doesn't grant leases.
+	opts.Discovery.Port = 57
+	envNoLeases, err := NewEnvironment(ctx, "serverID2", localregistry.NewLocalRegistry(), nil, opts)
+	require.NoError(t, err)
+	defer envNoLeases.Close()
+	require.NoError(t, envNoLeases.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+	_, err = envNoLeases.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "fencingToken", nil, types.CreateIfNotExist{})
+	require.ErrorContains(t, err, "has no activation lease")
+}
+
+// testLeaseRegistry wraps a registry and counts calls to RenewActivationLease(), failing
+// them if expire is set.
+type testLeaseRegistry struct {
+	registry.Registry
+
+	expire      atomic.Bool
+	numRenewals atomic.Int64
+}
+
+func (r *testLeaseRegistry) RenewActivationLease(
+	ctx context.Context,
+	token string,
+) (types.ActivationLease, error) {
+	r.numRenewals.Add(1)
+	if r.expire.Load() {
+		return types.ActivationLease{}, fmt.Errorf("test: %w", registry.ErrActivationLeaseExpired)
+	}
+	return r.Registry.RenewActivationLease(ctx, token)
+}
@@ -0,0 +1,194 @@
+package virtual
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const defaultLifecycleSubscriberBufferSize = 1024
+
+// LifecycleEventType is the type of a LifecycleEvent.
+type LifecycleEventType string
+
+const (
+	// LifecycleEventActivated is published when an actor is activated on the server.
+	LifecycleEventActivated LifecycleEventType = "activated"
+	// LifecycleEventDeactivated is published when the server stops hosting an actor.
+	LifecycleEventDeactivated LifecycleEventType = "deactivated"
+	// LifecycleEventMigrated is published when an actor moves to another server, either
+	// because the server handed it off, or because the server's activation cache
+	// observed that the registry placed it on a different server than the one it was
+	// cached on.
+	LifecycleEventMigrated LifecycleEventType = "migrated"
+	// LifecycleEventQuarantined is published when an actor is quarantined because it
+	// trapped too many times (see EnvironmentOptions.Quarantine).
+	LifecycleEventQuarantined LifecycleEventType = "quarantined"
+	// LifecycleEventCacheInvalidated is published when the cached activation of an
+	// actor is removed from the server's activation cache, so that the next invocation
+	// of the actor asks the registry where it's activated.
+	LifecycleEventCacheInvalidated LifecycleEventType = "cache_invalidated"
+)
+
+// LifecycleEvent describes a change to the lifecycle of an actor (see
+// Environment.SubscribeLifecycle).
+type LifecycleEvent struct {
+	Type      LifecycleEventType
+	Namespace string
+	ModuleID  string
+	ActorID   string
+	// ServerID is the ID of the server that the actor is activated on as a result of
+	// the event, which is the server that published it except for
+	// LifecycleEventMigrated (which has the ID of the server the actor moved to) and
+	// LifecycleEventCacheInvalidated (which has the ID of the server the invalidated
+	// entry referenced, which is empty if it cached an error or was just cached).
+	ServerID string
+	// PreviousServerID is the ID of the server the actor moved from. It's only set for
+	// LifecycleEventMigrated.
+	PreviousServerID string
+	// PublishedBy is the ID of the server that published the event.
+	PublishedBy string
+	// Reason describes why the event happened, for example "idle" or "memory_limit"
+	// for deactivations, or the last trap for quarantines.
+	Reason string
+	Time   time.Time
+}
+
+// LifecycleOptions contains the options for publishing the lifecycle events of actors
+// (see Environment.SubscribeLifecycle).
+type LifecycleOptions struct {
+	// SubscriberBufferSize is the number of events that are buffered for every
+	// subscriber. Events are dropped for subscribers whose buffer is full, so they must
+	// be sized to absorb bursts like a server deactivating all its actors.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 1024.
+	SubscriberBufferSize int
+}
+
+// Validate validates the LifecycleOptions.
+func (o *LifecycleOptions) Validate() error {
+	if o.SubscriberBufferSize < 0 {
+		return fmt.Errorf("SubscriberBufferSize must be >= 0, but was: %d", o.SubscriberBufferSize)
+	}
+	return nil
+}
+
+// lifecycleBus publishes the lifecycle events of actors to subscribers. Publishing never
+// blocks: events are dropped for subscribers that don't keep up. All of its methods are
+// no-ops on a nil lifecycleBus.
+type lifecycleBus struct {
+	sync.RWMutex
+	serverID   string
+	bufferSize int
+	now        func() time.Time
+
+	_subscribers []chan LifecycleEvent
+	_closed      bool
+
+	// hasSubscribers is set once the first subscriber subscribes so that publishers can
+	// skip the work of building events that nobody would receive.
+	hasSubscribers atomic.Bool
+	dropped        atomic.Uint64
+}
+
+func newLifecycleBus(serverID string, opts LifecycleOptions, now func() time.Time) *lifecycleBus {
+	if opts.SubscriberBufferSize == 0 {
+		opts.SubscriberBufferSize = defaultLifecycleSubscriberBufferSize
+	}
+	return &lifecycleBus{
+		serverID:   serverID,
+		bufferSize: opts.SubscriberBufferSize,
+		now:        now,
+	}
+}
+
+// subscribe returns a channel on which all the events published from now on are
+// delivered. The channel is closed when the bus is closed.
+func (b *lifecycleBus) subscribe() <-chan LifecycleEvent {
+	b.Lock()
+	defer b.Unlock()
+	ch := make(chan LifecycleEvent, b.bufferSize)
+	if b._closed {
+		close(ch)
+		return ch
+	}
+	b._subscribers = append(b._subscribers, ch)
+	b.hasSubscribers.Store(true)
+	return ch
+}
+
+// enabled returns whether there's anyone to publish events to.
+func (b *lifecycleBus) enabled() bool {
+	return b != nil && b.hasSubscribers.Load()
+}
+
+// publish publishes an event of the provided actor on this server.
+func (b *lifecycleBus) publish(
+	eventType LifecycleEventType,
+	actorID types.NamespacedActorID,
+	reason string,
+) {
+	if !b.enabled() || actorID.IDType != types.IDTypeActor {
+		return
+	}
+	b.publishEvent(LifecycleEvent{
+		Type:      eventType,
+		Namespace: actorID.Namespace,
+		ModuleID:  actorID.Module,
+		ActorID:   actorID.ID,
+		ServerID:  b.serverID,
+		Reason:    reason,
+	})
+}
+
+// publishEvent publishes the provided event, after setting its PublishedBy and Time.
+func (b *lifecycleBus) publishEvent(event LifecycleEvent) {
+	if !b.enabled() {
+		return
+	}
+	event.PublishedBy = b.serverID
+	event.Time = b.now()
+
+	b.RLock()
+	defer b.RUnlock()
+	if b._closed {
+		return
+	}
+	for _, ch := range b._subscribers {
+		select {
+		case ch <- event:
+		default:
+			b.dropped.Add(1)
+		}
+	}
+}
+
+// numDropped returns the total number of events that were dropped because a subscriber's
+// buffer was full.
+func (b *lifecycleBus) numDropped() uint64 {
+	if b == nil {
+		return 0
+	}
+	return b.dropped.Load()
+}
+
+// close closes the channels of all the subscribers. Events that are published afterwards
+// are discarded.
+func (b *lifecycleBus) close() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b._closed {
+		return
+	}
+	b._closed = true
+	for _, ch := range b._subscribers {
+		close(ch)
+	}
+	b._subscribers = nil
+}
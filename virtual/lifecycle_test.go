@@ -0,0 +1,108 @@
+package virtual
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestLifecycleEvents ensures that the environment publishes the lifecycle events of the
+// actors it hosts to its subscribers.
+func TestLifecycleEvents(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 68
+	opts.Quarantine = QuarantineOptions{MaxTraps: 1}
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+	events := env.SubscribeLifecycle()
+
+	next := func(eventType LifecycleEventType, actorID, reason string) LifecycleEvent {
+		t.Helper()
+		select {
+		case event := <-events:
+			require.Equal(t, eventType, event.Type)
+			require.Equal(t, "ns-1", event.Namespace)
+			require.Equal(t, "test-module", event.ModuleID)
+			require.Equal(t, actorID, event.ActorID)
+			require.Equal(t, reason, event.Reason)
+			require.Equal(t, "serverID1", event.PublishedBy)
+			require.False(t, event.Time.IsZero())
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s event", eventType)
+			return LifecycleEvent{}
+		}
+	}
+
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	event := next(LifecycleEventActivated, "a", "activated")
+	require.Equal(t, "serverID1", event.ServerID)
+
+	// Workers don't publish events.
+	_, err = env.InvokeWorker(ctx, "ns-1", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "panic", []byte("boom"), types.CreateIfNotExist{})
+	require.Error(t, err)
+	next(LifecycleEventQuarantined, "a", "panic: boom")
+	next(LifecycleEventDeactivated, "a", "aborted")
+
+	env.(*environment).activationsCache.delete("ns-1", "test-module", "a")
+	next(LifecycleEventCacheInvalidated, "a", "deleted")
+
+	_, err = env.InvokeActor(ctx, "ns-1", "b", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	next(LifecycleEventActivated, "b", "activated")
+	<-env.(*environment).activations.deactivateAll("drained")
+	next(LifecycleEventDeactivated, "b", "drained")
+
+	require.NoError(t, env.Close())
+	_, ok := <-events
+	require.False(t, ok)
+}
+
+// TestLifecycleBusDropsEvents ensures that events are dropped instead of blocking the
+// publisher when a subscriber doesn't keep up.
+func TestLifecycleBusDropsEvents(t *testing.T) {
+	bus := newLifecycleBus("serverID1", LifecycleOptions{SubscriberBufferSize: 2}, time.Now)
+	actorID := types.NewNamespacedActorID("ns-1", "a", "test-module", types.IDTypeActor)
+
+	// Nothing is published until there's a subscriber.
+	bus.publish(LifecycleEventActivated, actorID, "activated")
+	require.Zero(t, bus.numDropped())
+
+	slow, fast := bus.subscribe(), bus.subscribe()
+	for i := 0; i < 3; i++ {
+		bus.publish(LifecycleEventActivated, actorID, "activated")
+		<-fast
+	}
+	require.Len(t, slow, 2)
+	require.Equal(t, uint64(1), bus.numDropped())
+
+	bus.close()
+	bus.publish(LifecycleEventDeactivated, actorID, "idle")
+	require.Len(t, slow, 2)
+	_, ok := <-fast
+	require.False(t, ok)
+	_, ok = <-bus.subscribe()
+	require.False(t, ok)
+
+	var nilBus *lifecycleBus
+	nilBus.publish(LifecycleEventActivated, actorID, "activated")
+	nilBus.close()
+	require.Zero(t, nilBus.numDropped())
+	require.Error(t, (&LifecycleOptions{SubscriberBufferSize: -1}).Validate())
+}
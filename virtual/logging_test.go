@@ -0,0 +1,119 @@
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestHostLog ensures that actors can log to the environment's logger, that entries are
+// annotated with the identity of the actor, and that entries below the logger's level are
+// dropped.
+func TestHostLog(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+		buf = &bytes.Buffer{}
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 20
+	opts.Logger = slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	logReq := func(level slog.Level, msg string) []byte {
+		marshaled, err := json.Marshal(wapcutils.Log{Level: int(level), Message: msg})
+		require.NoError(t, err)
+		return marshaled
+	}
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "log", logReq(slog.LevelDebug, "dropped"), types.CreateIfNotExist{})
+	require.NoError(t, err)
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "log", logReq(slog.LevelWarn, "hello"), types.CreateIfNotExist{})
+	require.NoError(t, err)
+
+	entries := decodeLogEntries(t, buf)
+	require.Len(t, entries, 1)
+	require.Equal(t, "WARN", entries[0]["level"])
+	require.Equal(t, "hello", entries[0]["msg"])
+	require.Equal(t, "ns-1", entries[0]["namespace"])
+	require.Equal(t, "test-module", entries[0]["moduleID"])
+	require.Equal(t, "a", entries[0]["actorID"])
+	require.Equal(t, float64(1), entries[0]["count"])
+}
+
+// TestHostLogHostFunction ensures that the LOG host function that is exposed to WASM
+// modules forwards entries, including their KV pairs, to the actor's logger.
+func TestHostLogHostFunction(t *testing.T) {
+	var (
+		ctx = context.Background()
+		buf = &bytes.Buffer{}
+	)
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+	logger := slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	host := newHostCapabilities(nil, nil, nil, nil, ref, nil, nil, logger.With("actorID", "a"), nil, newNamespaceConfigs(nil), nil)
+
+	router := newHostFnRouter(nil, nil, nil, nil)
+	invokeCtx := context.WithValue(ctx, hostFnActorReferenceCtxKey{}, ref)
+	invokeCtx = context.WithValue(invokeCtx, hostFnHostCapabilitiesKey{}, host)
+	call := func(level slog.Level, msg string, kvs ...string) {
+		req := wapcutils.Log{Level: int(level), Message: msg}
+		for i := 0; i < len(kvs); i += 2 {
+			req.KVPairs = wapcutils.AppendKVListEntry(req.KVPairs, []byte(kvs[i]), []byte(kvs[i+1]))
+		}
+		marshaled, err := json.Marshal(req)
+		require.NoError(t, err)
+		_, err = router(invokeCtx, "", "", wapcutils.LogOperationName, marshaled)
+		require.NoError(t, err)
+	}
+
+	call(slog.LevelDebug, "dropped", "k", "v")
+	call(slog.LevelInfo, "hello", "k1", "v1", "k2", "v2")
+	call(slog.LevelError, "no kvs")
+
+	entries := decodeLogEntries(t, buf)
+	require.Len(t, entries, 2)
+	require.Equal(t, "INFO", entries[0]["level"])
+	require.Equal(t, "hello", entries[0]["msg"])
+	require.Equal(t, "a", entries[0]["actorID"])
+	require.Equal(t, "v1", entries[0]["k1"])
+	require.Equal(t, "v2", entries[0]["k2"])
+	require.Equal(t, "ERROR", entries[1]["level"])
+	require.Equal(t, "no kvs", entries[1]["msg"])
+
+	// Malformed KV pairs are rejected.
+	marshaled, err := json.Marshal(wapcutils.Log{Message: "malformed", KVPairs: []byte{0xff}})
+	require.NoError(t, err)
+	_, err = router(invokeCtx, "", "", wapcutils.LogOperationName, marshaled)
+	require.Error(t, err)
+}
+
+func decodeLogEntries(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
@@ -0,0 +1,115 @@
+package virtual
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// mailboxStats are the statistics of the mailboxes of all the actors that are activated
+// in an environment.
+type mailboxStats struct {
+	// depth is the number of invocations that are currently waiting in mailboxes.
+	depth atomic.Int64
+	// rejections is the total number of invocations that were rejected because the
+	// mailbox of their actor was full.
+	rejections atomic.Uint64
+}
+
+// actorMailbox serializes the invocations of an activated actor: invocations enter the
+// mailbox in the order in which they arrive, and each one waits until the ones that
+// arrived before it have left it. The actor's lock is only acquired by the invocation at
+// the front of the mailbox, so invocations are processed one at a time in arrival order
+// (unlike waiting on the lock directly, which is not fair).
+type actorMailbox struct {
+	sync.Mutex
+
+	// maxDepth is the maximum number of invocations that can wait in the mailbox, or 0
+	// if it's unlimited.
+	maxDepth int
+	stats    *mailboxStats
+
+	// busy is set while an invocation has entered the mailbox and not left it yet.
+	busy    bool
+	waiting *list.List // Contains *mailboxWaiter.
+}
+
+type mailboxWaiter struct {
+	readyCh chan struct{}
+	// ready is set (with the mailbox's lock held) once it's the waiter's turn.
+	ready bool
+}
+
+func newActorMailbox(maxDepth int, stats *mailboxStats) *actorMailbox {
+	return &actorMailbox{
+		maxDepth: maxDepth,
+		stats:    stats,
+		waiting:  list.New(),
+	}
+}
+
+// enter waits until all the invocations that entered the mailbox before have left it.
+// It fails if the mailbox is full, or if ctx is done first. leave must be called once the
+// invocation completes if (and only if) enter succeeds.
+func (m *actorMailbox) enter(ctx context.Context) error {
+	m.Lock()
+	if !m.busy {
+		m.busy = true
+		m.Unlock()
+		return nil
+	}
+	if m.maxDepth > 0 && m.waiting.Len() >= m.maxDepth {
+		m.Unlock()
+		m.stats.rejections.Add(1)
+		return fmt.Errorf(
+			"%d invocations are waiting already: %w", m.maxDepth, ErrActorMailboxFull)
+	}
+
+	w := &mailboxWaiter{readyCh: make(chan struct{})}
+	elem := m.waiting.PushBack(w)
+	m.stats.depth.Add(1)
+	m.Unlock()
+
+	select {
+	case <-w.readyCh:
+		return nil
+	case <-ctx.Done():
+		m.Lock()
+		if w.ready {
+			// Raced with being given the turn, hand it over to the next invocation.
+			m.Unlock()
+			m.leave()
+		} else {
+			m.waiting.Remove(elem)
+			m.stats.depth.Add(-1)
+			m.Unlock()
+		}
+		return fmt.Errorf("invocation was not processed before its context was done: %w", ctx.Err())
+	}
+}
+
+// leave gives the turn to the next invocation in the mailbox (if any).
+func (m *actorMailbox) leave() {
+	m.Lock()
+	defer m.Unlock()
+
+	front := m.waiting.Front()
+	if front == nil {
+		m.busy = false
+		return
+	}
+	m.waiting.Remove(front)
+	m.stats.depth.Add(-1)
+	w := front.Value.(*mailboxWaiter)
+	w.ready = true
+	close(w.readyCh)
+}
+
+// depth returns the number of invocations that are waiting in the mailbox.
+func (m *actorMailbox) depth() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.waiting.Len()
+}
@@ -0,0 +1,120 @@
+package virtual
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestActorMailbox ensures that invocations leave the mailbox in the order in which they
+// entered it, that invocations are rejected once the mailbox is full, and that
+// invocations whose context is done give up their place.
+func TestActorMailbox(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		stats = &mailboxStats{}
+		m     = newActorMailbox(3, stats)
+	)
+	require.NoError(t, m.enter(ctx))
+
+	var (
+		orderLock sync.Mutex
+		order     []int
+		wg        sync.WaitGroup
+	)
+	for i := 0; i < 3; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, m.enter(ctx))
+			orderLock.Lock()
+			order = append(order, i)
+			orderLock.Unlock()
+			m.leave()
+		}()
+		require.Eventually(t, func() bool {
+			return m.depth() == i+1
+		}, 5*time.Second, time.Millisecond)
+	}
+	require.True(t, IsActorMailboxFullErr(m.enter(ctx)))
+	require.Equal(t, uint64(1), stats.rejections.Load())
+	require.Equal(t, int64(3), stats.depth.Load())
+
+	m.leave()
+	wg.Wait()
+	require.Equal(t, []int{0, 1, 2}, order)
+	require.Equal(t, int64(0), stats.depth.Load())
+
+	require.NoError(t, m.enter(ctx))
+	timeoutCtx, cc := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cc()
+	require.ErrorIs(t, m.enter(timeoutCtx), context.DeadlineExceeded)
+	require.Equal(t, 0, m.depth())
+	m.leave()
+	require.NoError(t, m.enter(ctx))
+	m.leave()
+}
+
+// TestEnvironmentMailbox ensures that invocations of an actor wait for the previous ones
+// to complete, that they're rejected once EnvironmentOptions.MaxMailboxDepth of them are
+// waiting, and that invocations of other actors are not affected.
+func TestEnvironmentMailbox(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 52
+	opts.MaxMailboxDepth = 1
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	blockCtx, cancelBlock := context.WithCancel(ctx)
+	blockDoneCh := make(chan struct{})
+	go func() {
+		defer close(blockDoneCh)
+		env.InvokeActor(blockCtx, "ns-1", "a", "test-module", "block", nil, types.CreateIfNotExist{})
+	}()
+	require.Eventually(t, func() bool {
+		return env.(*environment).inFlight.Load() == 1
+	}, 5*time.Second, time.Millisecond)
+
+	resultCh := make(chan []byte, 1)
+	go func() {
+		result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		resultCh <- result
+	}()
+	require.Eventually(t, func() bool {
+		return env.ActivationStats().MailboxDepth == 1
+	}, 5*time.Second, time.Millisecond)
+
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.True(t, IsActorMailboxFullErr(err))
+	invokeErr, ok := AsInvokeError(err)
+	require.True(t, ok)
+	require.True(t, invokeErr.Category.Retryable())
+
+	// Other actors are invoked in parallel.
+	result, err := env.InvokeActor(ctx, "ns-1", "b", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	cancelBlock()
+	<-blockDoneCh
+	require.Equal(t, int64(1), getCount(t, <-resultCh))
+	stats := env.ActivationStats()
+	require.Equal(t, 0, stats.MailboxDepth)
+	require.Equal(t, 1, stats.MaxMailboxDepth)
+	require.Equal(t, uint64(1), stats.MailboxRejections)
+}
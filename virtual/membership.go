@@ -0,0 +1,258 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+)
+
+const (
+	defaultMembershipDebounce = 5 * time.Second
+
+	maxConcurrentMembershipNotifications = 16
+)
+
+// MembershipOptions contains the options for notifying actors of changes to the set of
+// servers in the cluster, for example so that actors that implement sharded
+// coordination can rebalance when servers join or leave.
+//
+// The actors of modules whose description sets
+// wapcutils.ModuleDescription.SubscribeMembershipChanges are invoked with the
+// wapcutils.MembershipChangeOperationName operation once when they're activated (with
+// the current membership), and again every time the membership that the environment
+// observes in its heartbeats changes. Notifications are delivered on a best-effort
+// basis: actors that fail to process one are not notified of it again.
+type MembershipOptions struct {
+	// Enabled enables membership change notifications. Every heartbeat of the
+	// environment lists the live servers in the registry when they're enabled, so
+	// they're disabled by default. Registries that don't track the servers in the
+	// cluster never report changes.
+	Enabled bool
+	// Debounce is how long the membership must remain unchanged before actors are
+	// notified of a change, so that servers that flap don't spam actors with
+	// notifications. Changes that are reverted within Debounce are never notified.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 5 seconds.
+	Debounce time.Duration
+}
+
+func (m *MembershipOptions) Validate() error {
+	if m.Debounce < 0 {
+		return fmt.Errorf("Debounce must be >= 0")
+	}
+	return nil
+}
+
+// membershipNotifier tracks the membership of the cluster that is observed in the
+// environment's heartbeats and calls notify once it changes and remains unchanged for
+// the debounce duration.
+type membershipNotifier struct {
+	sync.Mutex
+	debounce time.Duration
+	notify   func(change wapcutils.MembershipChange)
+
+	// current is the membership that was last notified (or the first one that was
+	// observed), or nil if none has been observed yet.
+	current []wapcutils.MembershipServer
+	// pending is the membership that will be notified once the timer fires, if any.
+	pending []wapcutils.MembershipServer
+	timer   *time.Timer
+	closed  bool
+}
+
+func newMembershipNotifier(
+	debounce time.Duration,
+	notify func(change wapcutils.MembershipChange),
+) *membershipNotifier {
+	return &membershipNotifier{debounce: debounce, notify: notify}
+}
+
+// observe records the live servers that were returned by a heartbeat.
+func (m *membershipNotifier) observe(liveServers []registry.LiveServer) {
+	if liveServers == nil {
+		// The registry doesn't track the servers in the cluster.
+		return
+	}
+	servers := make([]wapcutils.MembershipServer, 0, len(liveServers))
+	for _, server := range liveServers {
+		servers = append(servers, wapcutils.MembershipServer{
+			ServerID: server.ServerID,
+			Address:  server.Address,
+		})
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].ServerID < servers[j].ServerID
+	})
+
+	m.Lock()
+	defer m.Unlock()
+	switch {
+	case m.closed:
+	case m.current == nil:
+		// Nothing to compare against yet, actors will receive it when they're activated.
+		m.current = servers
+	case m.pending != nil && equalMembership(m.pending, servers):
+		// Already waiting for it to settle.
+	case equalMembership(m.current, servers):
+		// The change was reverted before it settled.
+		m.stopWithLock()
+	default:
+		m.stopWithLock()
+		m.pending = servers
+		m.timer = time.AfterFunc(m.debounce, m.fire)
+	}
+}
+
+// fire notifies the pending membership change, if it's still pending.
+func (m *membershipNotifier) fire() {
+	m.Lock()
+	if m.closed || m.pending == nil {
+		m.Unlock()
+		return
+	}
+	change := diffMembership(m.current, m.pending)
+	m.current = m.pending
+	m.pending = nil
+	m.timer = nil
+	m.Unlock()
+
+	m.notify(change)
+}
+
+// snapshot returns the current membership, if any has been observed.
+func (m *membershipNotifier) snapshot() ([]wapcutils.MembershipServer, bool) {
+	m.Lock()
+	defer m.Unlock()
+	return m.current, m.current != nil
+}
+
+func (m *membershipNotifier) close() {
+	m.Lock()
+	defer m.Unlock()
+	m.closed = true
+	m.stopWithLock()
+}
+
+func (m *membershipNotifier) stopWithLock() {
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	m.pending = nil
+}
+
+func equalMembership(a, b []wapcutils.MembershipServer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// diffMembership returns the change from prev to next, which must both be sorted by
+// ServerID.
+func diffMembership(prev, next []wapcutils.MembershipServer) wapcutils.MembershipChange {
+	change := wapcutils.MembershipChange{Servers: next}
+	prevIDs := make(map[string]struct{}, len(prev))
+	for _, server := range prev {
+		prevIDs[server.ServerID] = struct{}{}
+	}
+	nextIDs := make(map[string]struct{}, len(next))
+	for _, server := range next {
+		nextIDs[server.ServerID] = struct{}{}
+		if _, ok := prevIDs[server.ServerID]; !ok {
+			change.Joined = append(change.Joined, server.ServerID)
+		}
+	}
+	for _, server := range prev {
+		if _, ok := nextIDs[server.ServerID]; !ok {
+			change.Left = append(change.Left, server.ServerID)
+		}
+	}
+	return change
+}
+
+// notifyMembershipChange notifies the actors that are activated on this server and that
+// subscribe to membership changes of change.
+func (r *environment) notifyMembershipChange(change wapcutils.MembershipChange) {
+	payload, err := json.Marshal(change)
+	if err != nil {
+		log.Printf("error marshaling membership change, err: %v", err)
+		return
+	}
+
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, maxConcurrentMembershipNotifications)
+	)
+	for _, actor := range r.activations.activatedActors() {
+		if !r.activations.subscribesToMembership(actor.reference().ModuleID()) {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(actor *activatedActor) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			actor.notifyMembershipChange(payload)
+		}(actor)
+	}
+	wg.Wait()
+}
+
+// subscribesToMembership returns whether the description of the module sets
+// wapcutils.ModuleDescription.SubscribeMembershipChanges. Modules are always described
+// before their actors are activated, so the description of the modules of activated
+// actors is cached.
+func (a *activations) subscribesToMembership(moduleID types.NamespacedID) bool {
+	d := a.cachedDescription(moduleID)
+	return d != nil && d.err == nil && d.description.SubscribeMembershipChanges
+}
+
+// notifyMembershipSnapshot notifies a new activation of actor of the current
+// membership, if its module subscribes to membership changes.
+func (a *activations) notifyMembershipSnapshot(actor *activatedActor) {
+	if a.membership == nil || !a.subscribesToMembership(actor.reference().ModuleID()) {
+		return
+	}
+	servers, ok := a.membership.snapshot()
+	if !ok {
+		return
+	}
+	payload, err := json.Marshal(wapcutils.MembershipChange{Servers: servers})
+	if err != nil {
+		log.Printf("error marshaling membership for actor: %v, err: %v", actor.reference(), err)
+		return
+	}
+	actor.notifyMembershipChange(payload)
+}
+
+// notifyMembershipChange invokes the actor's wapcutils.MembershipChangeOperationName
+// operation with payload.
+func (a *activatedActor) notifyMembershipChange(payload []byte) {
+	a.Lock()
+	defer a.Unlock()
+	if a._closed {
+		return
+	}
+
+	result, err := a.invokeWithLimitsWithLock(
+		context.Background(), wapcutils.MembershipChangeOperationName, payload, nil)
+	if err != nil {
+		log.Printf("error notifying actor: %v of membership change, err: %v", a._reference, err)
+		return
+	}
+	result.Close()
+}
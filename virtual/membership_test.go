@@ -0,0 +1,176 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMembershipNotifierDebounce ensures that membership changes are only notified once
+// they settle, and that changes that are reverted before they settle are not notified.
+func TestMembershipNotifierDebounce(t *testing.T) {
+	changesCh := make(chan wapcutils.MembershipChange, 10)
+	m := newMembershipNotifier(50*time.Millisecond, func(change wapcutils.MembershipChange) {
+		changesCh <- change
+	})
+	defer m.close()
+
+	var (
+		a  = registry.LiveServer{ServerID: "a", Address: "a_address"}
+		b  = registry.LiveServer{ServerID: "b", Address: "b_address"}
+		c  = registry.LiveServer{ServerID: "c", Address: "c_address"}
+		ms = func(servers ...registry.LiveServer) []wapcutils.MembershipServer {
+			var converted []wapcutils.MembershipServer
+			for _, server := range servers {
+				converted = append(converted, wapcutils.MembershipServer{
+					ServerID: server.ServerID, Address: server.Address})
+			}
+			return converted
+		}
+	)
+
+	// Registries that don't track servers are ignored, and the first membership is not a
+	// change.
+	m.observe(nil)
+	_, ok := m.snapshot()
+	require.False(t, ok)
+	m.observe([]registry.LiveServer{a})
+	snapshot, ok := m.snapshot()
+	require.True(t, ok)
+	require.Equal(t, ms(a), snapshot)
+
+	// Flaps are not notified.
+	m.observe([]registry.LiveServer{a, b})
+	m.observe([]registry.LiveServer{a})
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, changesCh)
+
+	// Only the membership that settles is notified.
+	m.observe([]registry.LiveServer{b, a})
+	m.observe([]registry.LiveServer{c, b})
+	m.observe([]registry.LiveServer{b, c})
+	select {
+	case change := <-changesCh:
+		require.Equal(t, wapcutils.MembershipChange{
+			Servers: ms(b, c),
+			Joined:  []string{"b", "c"},
+			Left:    []string{"a"},
+		}, change)
+	case <-time.After(5 * time.Second):
+		t.Fatal("membership change was not notified")
+	}
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, changesCh)
+	snapshot, _ = m.snapshot()
+	require.Equal(t, ms(b, c), snapshot)
+}
+
+// TestMembershipNotifications ensures that the actors of modules that subscribe to
+// membership changes receive the current membership when they're activated and are
+// notified when servers join the cluster.
+func TestMembershipNotifications(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 47
+	opts.Membership.Enabled = true
+	opts.Membership.Debounce = 10 * time.Millisecond
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	module := &membershipTestModule{}
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "membership-module"}, module))
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "membership-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, []wapcutils.MembershipChange{{
+		Servers: []wapcutils.MembershipServer{{ServerID: "serverID1", Address: "127.0.0.1:47"}},
+	}}, module.received())
+
+	_, err = reg.Heartbeat(ctx, "serverID2", registry.HeartbeatState{Address: "serverID2_address"})
+	require.NoError(t, err)
+	require.NoError(t, env.(*environment).heartbeat())
+	require.Eventually(t, func() bool {
+		return len(module.received()) == 2
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, wapcutils.MembershipChange{
+		Servers: []wapcutils.MembershipServer{
+			{ServerID: "serverID1", Address: "127.0.0.1:47"},
+			{ServerID: "serverID2", Address: "serverID2_address"},
+		},
+		Joined: []string{"serverID2"},
+	}, module.received()[1])
+}
+
+// membershipTestModule is a testModule whose actors subscribe to membership changes and
+// record the ones they receive.
+type membershipTestModule struct {
+	testModule
+
+	sync.Mutex
+	changes []wapcutils.MembershipChange
+}
+
+func (m *membershipTestModule) Describe(ctx context.Context) (wapcutils.ModuleDescription, error) {
+	return wapcutils.ModuleDescription{
+		Operations:                 []wapcutils.OperationDescription{{Name: "inc"}},
+		SubscribeMembershipChanges: true,
+	}, nil
+}
+
+func (m *membershipTestModule) Instantiate(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	payload []byte,
+	host HostCapabilities,
+) (Actor, error) {
+	return &membershipTestActor{testActor: &testActor{host: host}, module: m}, nil
+}
+
+func (m *membershipTestModule) received() []wapcutils.MembershipChange {
+	m.Lock()
+	defer m.Unlock()
+	return append([]wapcutils.MembershipChange(nil), m.changes...)
+}
+
+type membershipTestActor struct {
+	*testActor
+	module *membershipTestModule
+}
+
+func (ta *membershipTestActor) Invoke(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+	transaction registry.ActorKVTransaction,
+) ([]byte, error) {
+	if operation != wapcutils.MembershipChangeOperationName {
+		return ta.testActor.Invoke(ctx, operation, payload, transaction)
+	}
+
+	var change wapcutils.MembershipChange
+	if err := json.Unmarshal(payload, &change); err != nil {
+		return nil, err
+	}
+	ta.module.Lock()
+	defer ta.module.Unlock()
+	ta.module.changes = append(ta.module.changes, change)
+	return nil, nil
+}
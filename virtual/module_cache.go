@@ -0,0 +1,265 @@
+package virtual
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/richardartoul/nola/durable"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const (
+	defaultMaxCachedModules = 1000
+)
+
+var errCompiledModuleEvicted = errors.New("compiled module was evicted from the module cache")
+
+// ModuleCacheStats contains point-in-time statistics about the compiled module cache.
+type ModuleCacheStats struct {
+	// Len is the number of compiled modules currently cached.
+	Len int64
+	// Hits is the number of times a module was loaded without compiling it, either
+	// because the module itself was already cached or because another module with the
+	// exact same bytes was.
+	Hits uint64
+	// Misses is the number of times a module had to be compiled.
+	Misses uint64
+	// Evictions is the number of compiled modules that were evicted from the cache.
+	Evictions uint64
+}
+
+// compiledModuleKey identifies a compiled module. Modules with identical bytes that are
+// compiled with the same options share a single compiled module.
+type compiledModuleKey struct {
+	hash             [sha256.Size]byte
+	interrupts       bool
+	memoryLimitPages uint32
+}
+
+type compiledModule struct {
+	key    compiledModuleKey
+	module durable.Module
+	ids    map[types.NamespacedID]struct{}
+	elem   *list.Element
+
+	// Protected by the moduleCache lock.
+	numInstances int
+	closed       bool
+}
+
+// moduleCache is an LRU cache of compiled WASM modules that allows all the activations
+// of a module (and of modules with identical bytes) to share a single compiled module
+// so that only a fresh instance has to be created per actor.
+//
+// Compiled modules are only evicted once they have no live instances, so the number of
+// cached modules can temporarily exceed the maximum if they're all in use.
+type moduleCache struct {
+	sync.Mutex
+
+	maxSize int
+	byID    map[types.NamespacedID]*compiledModule
+	byKey   map[compiledModuleKey]*compiledModule
+	// Front is the most recently used.
+	lru *list.List
+
+	hits, misses, evictions uint64
+
+	// Used to generate unique instance IDs.
+	instanceSeq atomic.Uint64
+}
+
+func newModuleCache(maxSize int) *moduleCache {
+	if maxSize <= 0 {
+		panic(fmt.Sprintf("[invariant violated] illegal value for maxSize: %d", maxSize))
+	}
+	return &moduleCache{
+		maxSize: maxSize,
+		byID:    make(map[types.NamespacedID]*compiledModule),
+		byKey:   make(map[compiledModuleKey]*compiledModule),
+		lru:     list.New(),
+	}
+}
+
+// get returns the compiled module for the provided module ID, if it is cached.
+func (c *moduleCache) get(id types.NamespacedID) (*compiledModule, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	cm, ok := c.byID[id]
+	if !ok {
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(cm.elem)
+	return cm, true
+}
+
+// getOrCompile returns the compiled module for the provided module ID, reusing an existing
+// compiled module with the same key if there is one and calling compile otherwise.
+func (c *moduleCache) getOrCompile(
+	ctx context.Context,
+	id types.NamespacedID,
+	moduleBytes []byte,
+	interrupts bool,
+	memoryLimitPages uint32,
+	compile func() (durable.Module, error),
+) (*compiledModule, error) {
+	key := compiledModuleKey{
+		hash:             sha256.Sum256(moduleBytes),
+		interrupts:       interrupts,
+		memoryLimitPages: memoryLimitPages,
+	}
+	if cm, ok := c.addID(key, id); ok {
+		return cm, nil
+	}
+
+	module, err := compile()
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	cm, ok := c.byKey[key]
+	if ok {
+		// Another module with identical bytes was compiled concurrently, use that one
+		// instead.
+		c.hits++
+		cm.ids[id] = struct{}{}
+		c.byID[id] = cm
+		c.lru.MoveToFront(cm.elem)
+		c.Unlock()
+		if err := module.Close(ctx); err != nil {
+			log.Printf("error closing duplicate compiled module: %s, err: %v", id, err)
+		}
+		return cm, nil
+	}
+
+	c.misses++
+	cm = &compiledModule{
+		key:    key,
+		module: module,
+		ids:    map[types.NamespacedID]struct{}{id: {}},
+	}
+	cm.elem = c.lru.PushFront(cm)
+	c.byKey[key] = cm
+	c.byID[id] = cm
+	toClose := c.evictWithLock()
+	c.Unlock()
+
+	c.closeAll(ctx, toClose)
+	return cm, nil
+}
+
+// addID associates the provided module ID with an existing compiled module with the
+// provided key, if there is one.
+func (c *moduleCache) addID(key compiledModuleKey, id types.NamespacedID) (*compiledModule, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	cm, ok := c.byKey[key]
+	if !ok {
+		return nil, false
+	}
+	c.hits++
+	cm.ids[id] = struct{}{}
+	c.byID[id] = cm
+	c.lru.MoveToFront(cm.elem)
+	return cm, true
+}
+
+// instantiate creates a new instance of the compiled module. The compiled module can't
+// be closed until the instance is released with release().
+func (c *moduleCache) instantiate(
+	ctx context.Context,
+	cm *compiledModule,
+	reference types.ActorReferenceVirtual,
+) (durable.Object, error) {
+	c.Lock()
+	if cm.closed {
+		c.Unlock()
+		return nil, fmt.Errorf(
+			"error instantiating actor: %v, err: %w", reference, errCompiledModuleEvicted)
+	}
+	cm.numInstances++
+	c.Unlock()
+
+	// Instance IDs only need to be unique within the compiled module, but the compiled
+	// module may be shared by multiple module IDs and the previous activation of an actor
+	// may not have been closed yet.
+	instanceID := fmt.Sprintf(
+		"%s::%s::%s::%d",
+		reference.Namespace(), reference.ModuleID().ID, reference.ActorID().ID,
+		c.instanceSeq.Add(1))
+	obj, err := cm.module.Instantiate(ctx, instanceID)
+	if err != nil {
+		c.release(ctx, cm)
+		return nil, err
+	}
+	return obj, nil
+}
+
+// release releases an instance created with instantiate() once it has been closed.
+func (c *moduleCache) release(ctx context.Context, cm *compiledModule) {
+	c.Lock()
+	cm.numInstances--
+	if cm.numInstances < 0 {
+		c.Unlock()
+		panic(fmt.Sprintf("[invariant violated] numInstances < 0 for compiled module: %v", cm.ids))
+	}
+	// The compiled module may have become evictable now that it has one less instance.
+	toClose := c.evictWithLock()
+	c.Unlock()
+
+	c.closeAll(ctx, toClose)
+}
+
+// evictWithLock evicts the least recently used compiled modules that have no live
+// instances until the cache is no larger than its maximum size. It returns the compiled
+// modules that must be closed (after the lock is released).
+//
+// The most recently used compiled module is never evicted since it's likely about to be
+// instantiated.
+func (c *moduleCache) evictWithLock() []*compiledModule {
+	var toClose []*compiledModule
+	for e := c.lru.Back(); e != nil && e != c.lru.Front() && c.lru.Len() > c.maxSize; {
+		cm := e.Value.(*compiledModule)
+		prev := e.Prev()
+		if cm.numInstances == 0 {
+			c.lru.Remove(e)
+			delete(c.byKey, cm.key)
+			for id := range cm.ids {
+				delete(c.byID, id)
+			}
+			cm.closed = true
+			c.evictions++
+			toClose = append(toClose, cm)
+		}
+		e = prev
+	}
+	return toClose
+}
+
+func (c *moduleCache) closeAll(ctx context.Context, toClose []*compiledModule) {
+	for _, cm := range toClose {
+		if err := cm.module.Close(ctx); err != nil {
+			log.Printf("error closing evicted compiled module: %v, err: %v", cm.ids, err)
+		}
+	}
+}
+
+func (c *moduleCache) stats() ModuleCacheStats {
+	c.Lock()
+	defer c.Unlock()
+	return ModuleCacheStats{
+		Len:       int64(c.lru.Len()),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
@@ -0,0 +1,216 @@
+package virtual
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/richardartoul/nola/durable"
+	"github.com/richardartoul/nola/durable/durablewazero"
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wapc/wapc-go/engines/wazero"
+)
+
+func TestModuleCacheSharesCompiledModules(t *testing.T) {
+	ctx := context.Background()
+	c := newModuleCache(10)
+
+	var numCompiles int
+	compile := func() (durable.Module, error) {
+		numCompiles++
+		return durablewazero.NewModule(ctx, wazero.Engine(), testModuleCacheHost, utilWasmBytes)
+	}
+
+	var (
+		idA = types.NewNamespacedID("ns-1", "module-a", types.IDTypeActor)
+		idB = types.NewNamespacedID("ns-2", "module-b", types.IDTypeActor)
+		idC = types.NewNamespacedID("ns-1", "module-c", types.IDTypeActor)
+	)
+	cmA, err := c.getOrCompile(ctx, idA, utilWasmBytes, false, 0, compile)
+	require.NoError(t, err)
+	require.Equal(t, 1, numCompiles)
+
+	// Different module ID with identical bytes should reuse the compiled module.
+	cmB, err := c.getOrCompile(ctx, idB, utilWasmBytes, false, 0, compile)
+	require.NoError(t, err)
+	require.Equal(t, 1, numCompiles)
+	require.True(t, cmA == cmB)
+
+	cm, ok := c.get(idB)
+	require.True(t, ok)
+	require.True(t, cm == cmA)
+
+	// Same bytes, but different compilation options.
+	cmC, err := c.getOrCompile(ctx, idC, utilWasmBytes, true, 0, compile)
+	require.NoError(t, err)
+	require.Equal(t, 2, numCompiles)
+	require.False(t, cmA == cmC)
+
+	require.Equal(t, ModuleCacheStats{Len: 2, Hits: 2, Misses: 2}, c.stats())
+
+	// Actors with the same ID in different modules that share the compiled module
+	// should not conflict.
+	refA, err := types.NewVirtualActorReference("ns-1", "module-a", "a", 1)
+	require.NoError(t, err)
+	refB, err := types.NewVirtualActorReference("ns-2", "module-b", "a", 1)
+	require.NoError(t, err)
+	objA, err := c.instantiate(ctx, cmA, refA)
+	require.NoError(t, err)
+	objB, err := c.instantiate(ctx, cmB, refB)
+	require.NoError(t, err)
+
+	result, err := objA.Invoke(ctx, "inc", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+	result, err = objB.Invoke(ctx, "inc", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	require.NoError(t, objA.Close(ctx))
+	c.release(ctx, cmA)
+	require.NoError(t, objB.Close(ctx))
+	c.release(ctx, cmB)
+}
+
+func TestModuleCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	c := newModuleCache(1)
+
+	compile := func(moduleBytes []byte) func() (durable.Module, error) {
+		return func() (durable.Module, error) {
+			return durablewazero.NewModule(ctx, wazero.Engine(), testModuleCacheHost, moduleBytes)
+		}
+	}
+
+	var (
+		idA    = types.NewNamespacedID("ns-1", "module-a", types.IDTypeActor)
+		idB    = types.NewNamespacedID("ns-1", "module-b", types.IDTypeActor)
+		idC    = types.NewNamespacedID("ns-1", "module-c", types.IDTypeActor)
+		bytesA = withCustomSection(utilWasmBytes, "a")
+		bytesB = withCustomSection(utilWasmBytes, "b")
+		bytesC = withCustomSection(utilWasmBytes, "c")
+	)
+	cmA, err := c.getOrCompile(ctx, idA, bytesA, false, 0, compile(bytesA))
+	require.NoError(t, err)
+	ref, err := types.NewVirtualActorReference("ns-1", "module-a", "a", 1)
+	require.NoError(t, err)
+	objA, err := c.instantiate(ctx, cmA, ref)
+	require.NoError(t, err)
+
+	// A has a live instance so it can't be evicted yet.
+	_, err = c.getOrCompile(ctx, idB, bytesB, false, 0, compile(bytesB))
+	require.NoError(t, err)
+	require.Equal(t, ModuleCacheStats{Len: 2, Misses: 2}, c.stats())
+	_, ok := c.get(idA)
+	require.True(t, ok)
+
+	// Once A's last instance is released it should be evicted since B is more recent.
+	_, ok = c.get(idB)
+	require.True(t, ok)
+	require.NoError(t, objA.Close(ctx))
+	c.release(ctx, cmA)
+	require.Equal(t, ModuleCacheStats{Len: 1, Hits: 2, Misses: 2, Evictions: 1}, c.stats())
+	_, ok = c.get(idA)
+	require.False(t, ok)
+
+	// Evicted compiled modules can't be instantiated anymore.
+	_, err = c.instantiate(ctx, cmA, ref)
+	require.ErrorIs(t, err, errCompiledModuleEvicted)
+
+	// B is idle so it should be evicted immediately when C is added.
+	_, err = c.getOrCompile(ctx, idC, bytesC, false, 0, compile(bytesC))
+	require.NoError(t, err)
+	require.Equal(t, ModuleCacheStats{Len: 1, Hits: 2, Misses: 3, Evictions: 2}, c.stats())
+	_, ok = c.get(idB)
+	require.False(t, ok)
+	_, ok = c.get(idC)
+	require.True(t, ok)
+}
+
+func TestModuleCacheStats(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsWASM
+	opts.Discovery.Port = 7
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	_, err = reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+
+	for _, actorID := range []string{"a", "b", "c"} {
+		_, err = env.InvokeActor(ctx, "ns-1", actorID, "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+	}
+
+	// All the actors should share a single compiled module.
+	stats := env.ModuleCacheStats()
+	require.Equal(t, int64(1), stats.Len)
+	require.Equal(t, uint64(1), stats.Misses)
+	require.Equal(t, uint64(2), stats.Hits)
+}
+
+// TestCompilationCache ensures that compiled modules are persisted in (and reused from)
+// the on-disk compilation cache when it is enabled.
+func TestCompilationCache(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+		dir = t.TempDir()
+	)
+	opts := defaultOptsWASM
+	opts.Discovery.Port = 8
+	opts.CompilationCache = CompilationCacheOptions{Enabled: true, Dir: dir}
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	// Identical bytes registered under different module IDs share a single entry.
+	for _, moduleID := range []string{"module-a", "module-b"} {
+		_, err = reg.RegisterModule(ctx, "ns-1", moduleID, utilWasmBytes, registry.ModuleOptions{})
+		require.NoError(t, err)
+		_, err = env.InvokeActor(ctx, "ns-1", moduleID, moduleID, "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+	}
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	_, err = reg.RegisterModule(
+		ctx, "ns-1", "module-c", withCustomSection(utilWasmBytes, "c"), registry.ModuleOptions{})
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-1", "module-c", "module-c", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
+
+func testModuleCacheHost(
+	ctx context.Context,
+	binding, namespace, operation string,
+	payload []byte,
+) ([]byte, error) {
+	return nil, nil
+}
+
+// withCustomSection returns a copy of the provided WASM module bytes with a custom section
+// appended so that the module is functionally identical, but its bytes differ.
+func withCustomSection(moduleBytes []byte, name string) []byte {
+	if len(name) > 64 {
+		panic("name too long")
+	}
+	withSection := append([]byte(nil), moduleBytes...)
+	// Section ID (0 for custom sections), section size, name size, name and a one byte
+	// payload.
+	withSection = append(withSection, 0, byte(len(name)+2), byte(len(name)))
+	withSection = append(withSection, name...)
+	return append(withSection, 0)
+}
@@ -0,0 +1,178 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// redactedPlaceholder replaces the values of secrets in logs and traces.
+const redactedPlaceholder = "[REDACTED]"
+
+// ConfigValue is a single entry of the configuration of a namespace.
+type ConfigValue struct {
+	// Value is the value that actors retrieve with HostCapabilities.GetConfig.
+	Value []byte
+	// Secret marks the value as sensitive (API keys, passwords, etc). Every occurrence of
+	// the values of secrets is redacted from the entries that actors log with
+	// HostCapabilities.Log and from the attributes and errors that are recorded on spans.
+	Secret bool
+}
+
+// NamespaceConfig is the configuration of a namespace. It maps keys to their values.
+type NamespaceConfig map[string]ConfigValue
+
+// namespaceConfigs contains the configuration of every namespace. It can be replaced
+// atomically at any time with reload().
+type namespaceConfigs struct {
+	snapshot atomic.Pointer[namespaceConfigsSnapshot]
+}
+
+type namespaceConfigsSnapshot struct {
+	configs map[string]NamespaceConfig
+	// redactor replaces the values of the secrets of every namespace with
+	// redactedPlaceholder, or is nil if there are no secrets.
+	redactor *strings.Replacer
+}
+
+func newNamespaceConfigs(configs map[string]NamespaceConfig) *namespaceConfigs {
+	c := &namespaceConfigs{}
+	c.reload(configs)
+	return c
+}
+
+// reload replaces the configuration of every namespace. configs is copied so the caller
+// can keep modifying it.
+func (c *namespaceConfigs) reload(configs map[string]NamespaceConfig) {
+	var (
+		snapshot = &namespaceConfigsSnapshot{configs: make(map[string]NamespaceConfig, len(configs))}
+		secrets  []string
+	)
+	for namespace, config := range configs {
+		copied := make(NamespaceConfig, len(config))
+		for key, value := range config {
+			value.Value = append([]byte(nil), value.Value...)
+			copied[key] = value
+			if value.Secret && len(value.Value) > 0 {
+				secrets = append(secrets, string(value.Value))
+			}
+		}
+		snapshot.configs[namespace] = copied
+	}
+	if len(secrets) > 0 {
+		// Replace longer secrets first so that secrets that contain other secrets are
+		// redacted entirely.
+		sort.Slice(secrets, func(i, j int) bool {
+			return len(secrets[i]) > len(secrets[j])
+		})
+		oldnew := make([]string, 0, 2*len(secrets))
+		for _, secret := range secrets {
+			oldnew = append(oldnew, secret, redactedPlaceholder)
+		}
+		snapshot.redactor = strings.NewReplacer(oldnew...)
+	}
+	c.snapshot.Store(snapshot)
+}
+
+// get returns the value of the provided key in the configuration of the provided
+// namespace. The returned slice must not be modified.
+func (c *namespaceConfigs) get(namespace, key string) ([]byte, bool) {
+	value, ok := c.snapshot.Load().configs[namespace][key]
+	return value.Value, ok
+}
+
+// redact returns s with the values of all secrets replaced with redactedPlaceholder.
+func (c *namespaceConfigs) redact(s string) string {
+	redactor := c.snapshot.Load().redactor
+	if redactor == nil {
+		return s
+	}
+	return redactor.Replace(s)
+}
+
+// redactArgs is the same as redact, except it redacts every string (or []byte) in args,
+// which are slog key-value pairs or attributes.
+func (c *namespaceConfigs) redactArgs(args []any) []any {
+	if c.snapshot.Load().redactor == nil {
+		return args
+	}
+	redacted := make([]any, len(args))
+	for i, arg := range args {
+		redacted[i] = c.redactAny(arg)
+	}
+	return redacted
+}
+
+func (c *namespaceConfigs) redactAny(v any) any {
+	switch v := v.(type) {
+	case string:
+		return c.redact(v)
+	case []byte:
+		return c.redact(string(v))
+	case error:
+		if redacted := c.redact(v.Error()); redacted != v.Error() {
+			return errors.New(redacted)
+		}
+		return v
+	case Attribute:
+		v.Value = c.redactAny(v.Value)
+		return v
+	case slog.Attr:
+		if v.Value.Kind() == slog.KindString {
+			return slog.String(v.Key, c.redact(v.Value.String()))
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// redactingTracer wraps a Tracer and redacts the values of secrets from the attributes
+// and errors that are recorded on its spans.
+type redactingTracer struct {
+	Tracer
+	configs *namespaceConfigs
+}
+
+func newRedactingTracer(tracer Tracer, configs *namespaceConfigs) Tracer {
+	return redactingTracer{Tracer: tracer, configs: configs}
+}
+
+func (t redactingTracer) Start(
+	ctx context.Context,
+	spanName string,
+	attrs ...Attribute,
+) (context.Context, Span) {
+	ctx, s := t.Tracer.Start(ctx, spanName, t.redactAttributes(attrs)...)
+	return ctx, redactingSpan{Span: s, tracer: t}
+}
+
+func (t redactingTracer) redactAttributes(attrs []Attribute) []Attribute {
+	if t.configs.snapshot.Load().redactor == nil {
+		return attrs
+	}
+	redacted := make([]Attribute, 0, len(attrs))
+	for _, attr := range attrs {
+		redacted = append(redacted, t.configs.redactAny(attr).(Attribute))
+	}
+	return redacted
+}
+
+type redactingSpan struct {
+	Span
+	tracer redactingTracer
+}
+
+func (s redactingSpan) SetAttributes(attrs ...Attribute) {
+	s.Span.SetAttributes(s.tracer.redactAttributes(attrs)...)
+}
+
+func (s redactingSpan) RecordError(err error) {
+	if err != nil {
+		err = s.tracer.configs.redactAny(err).(error)
+	}
+	s.Span.RecordError(err)
+}
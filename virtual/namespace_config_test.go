@@ -0,0 +1,167 @@
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestNamespaceConfig ensures that actors can only read the configuration of their own
+// namespace, that the configuration can be reloaded, and that secrets are redacted from
+// the entries that actors log.
+func TestNamespaceConfig(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+		buf = &bytes.Buffer{}
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 22
+	opts.Logger = slog.New(slog.NewJSONHandler(buf, nil))
+	opts.NamespaceConfigs = map[string]NamespaceConfig{
+		"ns-1": {
+			"endpoint": {Value: []byte("https://example.com")},
+			"apiKey":   {Value: []byte("s3cr3t"), Secret: true},
+		},
+	}
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	for _, ns := range []string{"ns-1", "ns-2"} {
+		require.NoError(t, env.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: ns, ID: "test-module"}, testModule{}))
+	}
+
+	getConfig := func(ns, key string) (string, error) {
+		result, err := env.InvokeActor(
+			ctx, ns, "a", "test-module", "getConfig", []byte(key), types.CreateIfNotExist{})
+		if err != nil {
+			return "", err
+		}
+		return string(result), nil
+	}
+
+	value, err := getConfig("ns-1", "endpoint")
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com", value)
+	value, err = getConfig("ns-1", "apiKey")
+	require.NoError(t, err)
+	require.Equal(t, "s3cr3t", value)
+	_, err = getConfig("ns-1", "missing")
+	require.Error(t, err)
+	_, err = getConfig("ns-2", "endpoint")
+	require.Error(t, err)
+
+	// Secrets are redacted from logs.
+	marshaled, err := json.Marshal(wapcutils.Log{Level: int(slog.LevelInfo), Message: "key is s3cr3t"})
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "log", marshaled, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	entries := decodeLogEntries(t, buf)
+	require.Len(t, entries, 1)
+	require.Equal(t, "key is [REDACTED]", entries[0]["msg"])
+
+	env.ReloadNamespaceConfigs(map[string]NamespaceConfig{
+		"ns-2": {"endpoint": {Value: []byte("https://example.org")}},
+	})
+	_, err = getConfig("ns-1", "endpoint")
+	require.Error(t, err)
+	value, err = getConfig("ns-2", "endpoint")
+	require.NoError(t, err)
+	require.Equal(t, "https://example.org", value)
+}
+
+func TestNamespaceConfigsRedact(t *testing.T) {
+	configs := newNamespaceConfigs(nil)
+	require.Equal(t, "abc", configs.redact("abc"))
+
+	configs.reload(map[string]NamespaceConfig{
+		"ns-1": {
+			"short": {Value: []byte("abc"), Secret: true},
+			"long":  {Value: []byte("abcdef"), Secret: true},
+			"plain": {Value: []byte("xyz")},
+		},
+		"ns-2": {"other": {Value: []byte("123"), Secret: true}},
+	})
+	require.Equal(t, "[REDACTED] [REDACTED] [REDACTED] xyz", configs.redact("abcdef abc 123 xyz"))
+	require.Equal(t, []any{
+		"key", "[REDACTED]",
+		"bytes", "[REDACTED]",
+		"count", 123,
+		slog.String("attr", "[REDACTED]"),
+	}, configs.redactArgs([]any{
+		"key", "abc",
+		"bytes", []byte("123"),
+		"count", 123,
+		slog.String("attr", "abcdef"),
+	}))
+
+	// Reloaded configs are copied.
+	reloaded := map[string]NamespaceConfig{"ns-1": {"key": {Value: []byte("value")}}}
+	configs.reload(reloaded)
+	reloaded["ns-1"]["key"].Value[0] = 'V'
+	value, ok := configs.get("ns-1", "key")
+	require.True(t, ok)
+	require.Equal(t, "value", string(value))
+	require.Equal(t, "abc", configs.redact("abc"))
+}
+
+func TestRedactingTracer(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		tracer  = newTestTracer()
+		configs = newNamespaceConfigs(map[string]NamespaceConfig{
+			"ns-1": {"apiKey": {Value: []byte("s3cr3t"), Secret: true}},
+		})
+	)
+	_, span := newRedactingTracer(tracer, configs).Start(
+		ctx, "span", Attribute{Key: "start", Value: "s3cr3t"})
+	span.SetAttributes(Attribute{Key: "set", Value: "key: s3cr3t"}, Attribute{Key: "int", Value: 1})
+	span.RecordError(errors.New("invalid key: s3cr3t"))
+	span.End()
+
+	require.Len(t, tracer.spans, 1)
+	require.Equal(t, map[string]any{
+		"start": "[REDACTED]",
+		"set":   "key: [REDACTED]",
+		"int":   1,
+	}, tracer.spans[0].attrs)
+	require.EqualError(t, tracer.spans[0].err, "invalid key: [REDACTED]")
+	require.True(t, tracer.spans[0].ended)
+}
+
+// TestGetConfigHostFunction ensures that the GET-CONFIG host function that is exposed to
+// WASM modules distinguishes missing keys from empty values.
+func TestGetConfigHostFunction(t *testing.T) {
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+	configs := newNamespaceConfigs(map[string]NamespaceConfig{
+		"ns-1": {
+			"key":   {Value: []byte("value")},
+			"empty": {},
+		},
+	})
+	host := newHostCapabilities(nil, nil, nil, nil, ref, nil, nil, nil, nil, configs, nil)
+
+	router := newHostFnRouter(nil, nil, nil, nil)
+	invokeCtx := context.WithValue(context.Background(), hostFnActorReferenceCtxKey{}, ref)
+	invokeCtx = context.WithValue(invokeCtx, hostFnHostCapabilitiesKey{}, host)
+	for key, expected := range map[string][]byte{
+		"key":     append([]byte{1}, "value"...),
+		"empty":   {1},
+		"missing": {0},
+	} {
+		result, err := router(invokeCtx, "", "", wapcutils.GetConfigOperationName, []byte(key))
+		require.NoError(t, err)
+		require.Equal(t, expected, result, key)
+	}
+}
@@ -0,0 +1,347 @@
+package virtual
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// namespaceQuotaExceededHeader marks the responses of invocations that were rejected
+	// because a namespace quota was exceeded, and carries the exceeded resource.
+	namespaceQuotaExceededHeader = "X-Nola-Namespace-Quota-Exceeded"
+	// namespaceQuotaNamespaceHeader carries the namespace whose quota was exceeded.
+	namespaceQuotaNamespaceHeader = "X-Nola-Namespace-Quota-Namespace"
+)
+
+// ErrNamespaceQuotaExceeded is wrapped by the errors of activations and invocations that
+// are rejected because the namespace of the actor exceeded one of its quotas (see
+// NamespaceQuotaOptions), including the ones that are rejected by other servers. Use
+// errors.As with *NamespaceQuotaExceededError to find out which quota was exceeded.
+var ErrNamespaceQuotaExceeded = errors.New("namespace quota exceeded")
+
+// IsNamespaceQuotaExceededErr returns a boolean indicating whether the error is an
+// instance of (or wraps) ErrNamespaceQuotaExceeded.
+func IsNamespaceQuotaExceededErr(err error) bool {
+	return errors.Is(err, ErrNamespaceQuotaExceeded)
+}
+
+// NamespaceQuotaResource is a resource whose usage is limited per namespace.
+type NamespaceQuotaResource string
+
+const (
+	// NamespaceQuotaActivatedActors is the number of actors of the namespace that are
+	// activated (see NamespaceQuota.MaxActivatedActors).
+	NamespaceQuotaActivatedActors NamespaceQuotaResource = "activated-actors"
+	// NamespaceQuotaInvocationRate is the rate at which the actors of the namespace are
+	// invoked (see NamespaceQuota.InvocationRate).
+	NamespaceQuotaInvocationRate NamespaceQuotaResource = "invocation-rate"
+	// NamespaceQuotaMemory is the linear memory used by the actors of the namespace (see
+	// NamespaceQuota.MaxMemoryBytes).
+	NamespaceQuotaMemory NamespaceQuotaResource = "memory"
+)
+
+// NamespaceQuotaExceededError is the error of activations and invocations that are
+// rejected because the namespace of the actor exceeded one of its quotas. It wraps
+// ErrNamespaceQuotaExceeded.
+type NamespaceQuotaExceededError struct {
+	// Namespace is the namespace whose quota was exceeded.
+	Namespace string
+	// Resource is the resource whose quota was exceeded.
+	Resource NamespaceQuotaResource
+	// RetryAfter is how long until the namespace accepts another invocation if its
+	// invocation rate was exceeded, or 0 otherwise.
+	RetryAfter time.Duration
+}
+
+func (e *NamespaceQuotaExceededError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf(
+			"%s, namespace: %s, resource: %s, retry after: %s",
+			ErrNamespaceQuotaExceeded, e.Namespace, e.Resource, e.RetryAfter)
+	}
+	return fmt.Sprintf(
+		"%s, namespace: %s, resource: %s", ErrNamespaceQuotaExceeded, e.Namespace, e.Resource)
+}
+
+func (e *NamespaceQuotaExceededError) Unwrap() error {
+	return ErrNamespaceQuotaExceeded
+}
+
+// NamespaceQuota contains the quotas of a single namespace. The zero value of each field
+// means no limit.
+type NamespaceQuota struct {
+	// MaxActivatedActors is the maximum number of actors of the namespace that the server
+	// hosts at once. Activations beyond it are rejected before the actor is instantiated.
+	MaxActivatedActors int
+	// InvocationRate is the rate limit of the invocations of all the actors of the
+	// namespace combined.
+	InvocationRate RateLimit
+	// MaxCacheEntries is the maximum number of activations of actors of the namespace
+	// that are kept in the activations cache. The activations that are resolved once the
+	// namespace has MaxCacheEntries entries are not cached, so a single namespace can't
+	// evict the cached activations of the others.
+	MaxCacheEntries int
+	// MaxMemoryBytes is the maximum amount of linear memory that the WASM actors of the
+	// namespace can use in total. Once they use that much, new activations and
+	// invocations of the namespace's actors are rejected until enough of them are
+	// deactivated. Go actors don't count against it.
+	MaxMemoryBytes int64
+}
+
+func (q *NamespaceQuota) validate() error {
+	if q.MaxActivatedActors < 0 {
+		return errors.New("MaxActivatedActors must be >= 0")
+	}
+	if err := q.InvocationRate.validate(); err != nil {
+		return fmt.Errorf("invalid InvocationRate: %w", err)
+	}
+	if q.MaxCacheEntries < 0 {
+		return errors.New("MaxCacheEntries must be >= 0")
+	}
+	if q.MaxMemoryBytes < 0 {
+		return errors.New("MaxMemoryBytes must be >= 0")
+	}
+	return nil
+}
+
+// NamespaceQuotaOptions contains the options for limiting the resources that the actors
+// of each namespace can use so that the tenants of a cluster can't exhaust the resources
+// of each other. Activations and invocations that exceed a quota are rejected with a
+// *NamespaceQuotaExceededError, which servers report to remote callers with
+// http.StatusTooManyRequests.
+//
+// Every server enforces the quotas independently for the actors that it hosts, the same
+// way as EnvironmentOptions.MaxActivations, so the quotas of a namespace apply per server
+// rather than to the whole cluster. Invocations of workers and timers are not limited,
+// and neither are the startup and shutdown operations of actors.
+type NamespaceQuotaOptions struct {
+	// DefaultQuota is the quota of all the namespaces that don't have a more specific
+	// quota configured. The zero value means no limits.
+	DefaultQuota NamespaceQuota
+	// NamespaceQuotas contains per-namespace quotas that override DefaultQuota.
+	NamespaceQuotas map[string]NamespaceQuota
+}
+
+func (n *NamespaceQuotaOptions) Validate() error {
+	if err := n.DefaultQuota.validate(); err != nil {
+		return fmt.Errorf("invalid DefaultQuota: %w", err)
+	}
+	for namespace, quota := range n.NamespaceQuotas {
+		if err := quota.validate(); err != nil {
+			return fmt.Errorf("invalid NamespaceQuotas for namespace: %s: %w", namespace, err)
+		}
+	}
+	return nil
+}
+
+// quota returns the quota of the provided namespace.
+func (n *NamespaceQuotaOptions) quota(namespace string) NamespaceQuota {
+	if quota, ok := n.NamespaceQuotas[namespace]; ok {
+		return quota
+	}
+	return n.DefaultQuota
+}
+
+// NamespaceStats contains the utilization of the resources of a single namespace on a
+// server, and how many times its quotas were exceeded.
+type NamespaceStats struct {
+	// Quota is the quota of the namespace (see NamespaceQuotaOptions).
+	Quota NamespaceQuota
+	// ActivatedActors is the number of actors of the namespace that are currently
+	// activated (or being activated).
+	ActivatedActors int
+	// CacheEntries is the number of activations of actors of the namespace that are
+	// currently cached.
+	CacheEntries int
+	// MemoryBytes is the amount of linear memory that the activated WASM actors of the
+	// namespace are currently using.
+	MemoryBytes int64
+	// ActivationRejections is the total number of activations that were rejected because
+	// the namespace had Quota.MaxActivatedActors actors activated already.
+	ActivationRejections uint64
+	// RateLimitRejections is the total number of invocations that were rejected because
+	// the namespace exceeded Quota.InvocationRate.
+	RateLimitRejections uint64
+	// MemoryRejections is the total number of activations and invocations that were
+	// rejected because the namespace used Quota.MaxMemoryBytes already.
+	MemoryRejections uint64
+	// CacheEntriesRejected is the total number of activations that were not cached
+	// because the namespace had Quota.MaxCacheEntries cached already.
+	CacheEntriesRejected uint64
+}
+
+// memorySizer is implemented by the actors whose linear memory counts against
+// NamespaceQuota.MaxMemoryBytes.
+type memorySizer interface {
+	// memorySize returns the current size of the actor's linear memory in bytes.
+	memorySize() int64
+}
+
+// namespaceQuotas tracks the usage of the resources of every namespace and enforces
+// their quotas. All its methods are safe to call on a nil *namespaceQuotas, in which
+// case nothing is tracked or limited.
+type namespaceQuotas struct {
+	sync.Mutex
+
+	opts  NamespaceQuotaOptions
+	usage map[string]*namespaceUsage
+}
+
+// namespaceUsage is the usage of the resources of a single namespace.
+type namespaceUsage struct {
+	namespace string
+	quota     NamespaceQuota
+	// rateLimiter is nil if the invocations of the namespace are not rate limited.
+	rateLimiter *tokenBucket
+	memoryBytes atomic.Int64
+
+	activationRejections atomic.Uint64
+	rateLimitRejections  atomic.Uint64
+	memoryRejections     atomic.Uint64
+	cacheEntriesRejected atomic.Uint64
+}
+
+func newNamespaceQuotas(opts NamespaceQuotaOptions) *namespaceQuotas {
+	return &namespaceQuotas{
+		opts:  opts,
+		usage: make(map[string]*namespaceUsage),
+	}
+}
+
+// get returns the usage of the provided namespace, or nil if q is nil.
+func (q *namespaceQuotas) get(namespace string) *namespaceUsage {
+	if q == nil {
+		return nil
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	usage, ok := q.usage[namespace]
+	if !ok {
+		quota := q.opts.quota(namespace)
+		usage = &namespaceUsage{
+			namespace:   namespace,
+			quota:       quota,
+			rateLimiter: newTokenBucket(quota.InvocationRate, time.Now()),
+		}
+		q.usage[namespace] = usage
+	}
+	return usage
+}
+
+// admitActivation returns an error if a new actor of the namespace can't be activated
+// because the namespace has activated actors (its maximum) activated already, or because
+// it's out of memory.
+func (q *namespaceQuotas) admitActivation(namespace string, activated int) error {
+	usage := q.get(namespace)
+	if usage == nil {
+		return nil
+	}
+	if usage.quota.MaxActivatedActors > 0 && activated >= usage.quota.MaxActivatedActors {
+		usage.activationRejections.Add(1)
+		return &NamespaceQuotaExceededError{
+			Namespace: namespace, Resource: NamespaceQuotaActivatedActors}
+	}
+	return usage.admitMemory()
+}
+
+// admitInvocation returns an error if an actor of the namespace can't be invoked because
+// the namespace exceeded its invocation rate, or because it's out of memory.
+func (q *namespaceQuotas) admitInvocation(namespace string) error {
+	usage := q.get(namespace)
+	if usage == nil {
+		return nil
+	}
+	if err := usage.admitMemory(); err != nil {
+		return err
+	}
+	if usage.rateLimiter != nil {
+		if retryAfter, ok := usage.rateLimiter.take(time.Now()); !ok {
+			usage.rateLimitRejections.Add(1)
+			return &NamespaceQuotaExceededError{
+				Namespace: namespace, Resource: NamespaceQuotaInvocationRate, RetryAfter: retryAfter}
+		}
+	}
+	return nil
+}
+
+// admitCacheEntry returns whether a new activation of an actor of the namespace can be
+// cached when entries activations of the namespace are cached already.
+func (q *namespaceQuotas) admitCacheEntry(namespace string, entries int) bool {
+	usage := q.get(namespace)
+	if usage == nil || usage.quota.MaxCacheEntries == 0 || entries < usage.quota.MaxCacheEntries {
+		return true
+	}
+	usage.cacheEntriesRejected.Add(1)
+	return false
+}
+
+func (u *namespaceUsage) admitMemory() error {
+	if u.quota.MaxMemoryBytes > 0 && u.memoryBytes.Load() >= u.quota.MaxMemoryBytes {
+		u.memoryRejections.Add(1)
+		return &NamespaceQuotaExceededError{Namespace: u.namespace, Resource: NamespaceQuotaMemory}
+	}
+	return nil
+}
+
+// stats returns the stats of every namespace that has been tracked, or that has actors
+// activated or cached.
+func (q *namespaceQuotas) stats(activated, cacheEntries map[string]int) map[string]NamespaceStats {
+	stats := make(map[string]NamespaceStats)
+	if q == nil {
+		return stats
+	}
+	for namespace := range activated {
+		q.get(namespace)
+	}
+	for namespace := range cacheEntries {
+		q.get(namespace)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	for namespace, usage := range q.usage {
+		stats[namespace] = NamespaceStats{
+			Quota:                usage.quota,
+			ActivatedActors:      activated[namespace],
+			CacheEntries:         cacheEntries[namespace],
+			MemoryBytes:          usage.memoryBytes.Load(),
+			ActivationRejections: usage.activationRejections.Load(),
+			RateLimitRejections:  usage.rateLimitRejections.Load(),
+			MemoryRejections:     usage.memoryRejections.Load(),
+			CacheEntriesRejected: usage.cacheEntriesRejected.Load(),
+		}
+	}
+	return stats
+}
+
+// setNamespaceQuotaExceeded sets the headers that identify the quota that an invocation
+// exceeded so that the error survives being forwarded.
+func setNamespaceQuotaExceeded(header http.Header, err *NamespaceQuotaExceededError) {
+	header.Set(namespaceQuotaExceededHeader, string(err.Resource))
+	header.Set(namespaceQuotaNamespaceHeader, err.Namespace)
+	if err.RetryAfter > 0 {
+		setRetryAfter(header, err.RetryAfter)
+	}
+}
+
+// namespaceQuotaExceededFromHeader is the inverse of setNamespaceQuotaExceeded. It returns
+// nil if the headers don't identify an exceeded quota.
+func namespaceQuotaExceededFromHeader(header http.Header) *NamespaceQuotaExceededError {
+	resource := header.Get(namespaceQuotaExceededHeader)
+	if resource == "" {
+		return nil
+	}
+	err := &NamespaceQuotaExceededError{
+		Namespace: header.Get(namespaceQuotaNamespaceHeader),
+		Resource:  NamespaceQuotaResource(resource),
+	}
+	if err.Resource == NamespaceQuotaInvocationRate {
+		err.RetryAfter = retryAfterFromHeader(header)
+	}
+	return err
+}
@@ -0,0 +1,141 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestNamespaceQuotas ensures that activations and invocations of actors whose namespace
+// exceeded one of its quotas are rejected without affecting other namespaces, and that
+// the utilization of every namespace is reported.
+func TestNamespaceQuotas(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsWASM
+	opts.Discovery.Port = 54
+	opts.NamespaceQuotas = NamespaceQuotaOptions{
+		NamespaceQuotas: map[string]NamespaceQuota{
+			"ns-1":   {MaxActivatedActors: 1},
+			"ns-2":   {InvocationRate: RateLimit{Rate: 0.001, Burst: 2}},
+			"ns-3":   {MaxCacheEntries: 1},
+			"ns-mem": {MaxMemoryBytes: 1},
+		},
+	}
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	for _, namespace := range []string{"ns-1", "ns-2", "ns-3", "ns-4"} {
+		require.NoError(t, env.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: namespace, ID: "test-module"}, testModule{}))
+	}
+	_, err = reg.RegisterModule(ctx, "ns-mem", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+
+	invoke := func(namespace, actorID string) error {
+		_, err := env.InvokeActor(
+			ctx, namespace, actorID, "test-module", "inc", nil, types.CreateIfNotExist{})
+		return err
+	}
+	requireQuotaExceeded := func(err error, namespace string, resource NamespaceQuotaResource) {
+		require.True(t, IsNamespaceQuotaExceededErr(err), err)
+		var quotaErr *NamespaceQuotaExceededError
+		require.True(t, errors.As(err, &quotaErr))
+		require.Equal(t, namespace, quotaErr.Namespace)
+		require.Equal(t, resource, quotaErr.Resource)
+	}
+
+	// Activated actors can still be invoked once the namespace is at its quota.
+	require.NoError(t, invoke("ns-1", "a"))
+	requireQuotaExceeded(invoke("ns-1", "b"), "ns-1", NamespaceQuotaActivatedActors)
+	require.NoError(t, invoke("ns-1", "a"))
+
+	// The invocation rate is shared by all the actors of the namespace.
+	require.NoError(t, invoke("ns-2", "a"))
+	require.NoError(t, invoke("ns-2", "b"))
+	err = invoke("ns-2", "c")
+	requireQuotaExceeded(err, "ns-2", NamespaceQuotaInvocationRate)
+	var quotaErr *NamespaceQuotaExceededError
+	require.True(t, errors.As(err, &quotaErr))
+	require.Greater(t, quotaErr.RetryAfter, 900*time.Second)
+
+	// Activations that exceed the namespace's cache entries are served, just not cached.
+	require.NoError(t, invoke("ns-3", "a"))
+	require.NoError(t, invoke("ns-3", "b"))
+
+	// The first activation fits in the namespace's memory, but its memory counts against
+	// the namespace once the actor has been instantiated.
+	require.NoError(t, invoke("ns-mem", "a"))
+	requireQuotaExceeded(invoke("ns-mem", "a"), "ns-mem", NamespaceQuotaMemory)
+	requireQuotaExceeded(invoke("ns-mem", "b"), "ns-mem", NamespaceQuotaMemory)
+
+	// Namespaces without quotas are not limited.
+	for i := 0; i < 5; i++ {
+		require.NoError(t, invoke("ns-4", fmt.Sprintf("a-%d", i)))
+	}
+
+	stats := env.NamespaceStats()
+	require.Equal(t, 1, stats["ns-1"].ActivatedActors)
+	require.Equal(t, 1, stats["ns-1"].Quota.MaxActivatedActors)
+	require.Equal(t, uint64(1), stats["ns-1"].ActivationRejections)
+	require.Equal(t, 2, stats["ns-2"].ActivatedActors)
+	require.Equal(t, uint64(1), stats["ns-2"].RateLimitRejections)
+	require.Equal(t, 1, stats["ns-3"].CacheEntries)
+	require.Equal(t, uint64(1), stats["ns-3"].CacheEntriesRejected)
+	require.Equal(t, 1, stats["ns-mem"].ActivatedActors)
+	require.Greater(t, stats["ns-mem"].MemoryBytes, int64(0))
+	require.Equal(t, uint64(2), stats["ns-mem"].MemoryRejections)
+	require.Equal(t, 5, stats["ns-4"].ActivatedActors)
+	require.Equal(t, NamespaceQuota{}, stats["ns-4"].Quota)
+	require.Equal(t, int64(0), stats["ns-4"].MemoryBytes)
+
+	require.Error(t, (&NamespaceQuotaOptions{DefaultQuota: NamespaceQuota{MaxActivatedActors: -1}}).Validate())
+	require.Error(t, (&NamespaceQuotaOptions{
+		NamespaceQuotas: map[string]NamespaceQuota{"ns-1": {InvocationRate: RateLimit{Rate: -1}}},
+	}).Validate())
+	require.Error(t, (&NamespaceQuotaOptions{
+		NamespaceQuotas: map[string]NamespaceQuota{"ns-1": {MaxMemoryBytes: -1}},
+	}).Validate())
+}
+
+// TestNamespaceQuotasForwarded ensures that invocations that are rejected by the server
+// they are forwarded to because of a namespace quota can be told apart from other errors
+// by the caller.
+func TestNamespaceQuotasForwarded(t *testing.T) {
+	ctx := context.Background()
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeInvokeError(w, fmt.Errorf("error invoking actor: %w", &NamespaceQuotaExceededError{
+			Namespace:  "ns-1",
+			Resource:   NamespaceQuotaInvocationRate,
+			RetryAfter: 50 * time.Millisecond,
+		}))
+	}))
+	defer httpServer.Close()
+	ref, err := types.NewActorReference(
+		"serverID1", 1, strings.TrimPrefix(httpServer.URL, "http://"), "ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+
+	_, err = NewHTTPClient().InvokeActorRemote(ctx, 1, ref, "inc", nil, types.CreateIfNotExist{})
+	require.True(t, IsNamespaceQuotaExceededErr(err))
+	require.False(t, IsActorRateLimitedErr(err))
+	var quotaErr *NamespaceQuotaExceededError
+	require.True(t, errors.As(err, &quotaErr))
+	require.Equal(t, NamespaceQuotaExceededError{
+		Namespace:  "ns-1",
+		Resource:   NamespaceQuotaInvocationRate,
+		RetryAfter: 50 * time.Millisecond,
+	}, *quotaErr)
+}
@@ -0,0 +1,312 @@
+package virtual
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	runtimedebug "runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+// quarantineAdminPathPrefix is the prefix of the paths of the quarantine admin API (see
+// ServerOptions.EnableQuarantineAdminAPI).
+const quarantineAdminPathPrefix = "/api/v1/quarantine/"
+
+const (
+	defaultQuarantineWindow   = time.Minute
+	defaultQuarantineCooldown = 5 * time.Minute
+)
+
+var (
+	// ErrActorQuarantined is returned (wrapped) by invocations of actors that are
+	// quarantined because they trapped too many times recently (see QuarantineOptions).
+	ErrActorQuarantined = errors.New("actor is quarantined")
+	errActorPanicked    = errors.New("actor panicked")
+)
+
+// IsActorQuarantinedErr returns a boolean indicating whether the error is (or wraps)
+// ErrActorQuarantined.
+func IsActorQuarantinedErr(err error) bool {
+	return errors.Is(err, ErrActorQuarantined)
+}
+
+// QuarantineOptions contains the options for quarantining actors that trap repeatedly,
+// for example because their module panics on startup. Without a quarantine such actors
+// get stuck in a crash loop in which every invocation activates them again, which
+// hammers the registry. Quarantined actors are deactivated and refuse to be activated
+// again (with an error for which IsActorQuarantinedErr returns true) until the cooldown
+// has elapsed or they're released with Environment.UnquarantineActor.
+//
+// Traps include panics of Go actors (and of the host functions that actors call), which
+// fail the invocation with an InvokeError in the InvokeErrorCategoryTrap category instead
+// of crashing the server regardless of these options. Quarantines are local to every
+// server.
+type QuarantineOptions struct {
+	// MaxTraps is the number of traps within Window after which an actor is quarantined.
+	// A value of 0 disables quarantines.
+	MaxTraps int
+	// Window is the duration over which traps are counted.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 1 minute.
+	Window time.Duration
+	// Cooldown is how long actors stay quarantined.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 5 minutes.
+	Cooldown time.Duration
+}
+
+// Validate validates the QuarantineOptions.
+func (o *QuarantineOptions) Validate() error {
+	if o.MaxTraps < 0 {
+		return fmt.Errorf("MaxTraps must be >= 0, but was: %d", o.MaxTraps)
+	}
+	if o.Window < 0 {
+		return fmt.Errorf("Window must be >= 0, but was: %s", o.Window)
+	}
+	if o.Cooldown < 0 {
+		return fmt.Errorf("Cooldown must be >= 0, but was: %s", o.Cooldown)
+	}
+	return nil
+}
+
+// QuarantinedActor describes an actor that is quarantined (see QuarantineOptions).
+type QuarantinedActor struct {
+	Namespace string `json:"namespace"`
+	ModuleID  string `json:"module_id"`
+	ActorID   string `json:"actor_id"`
+	// LastTrapReason is the reason of the trap that got the actor quarantined.
+	LastTrapReason string    `json:"last_trap_reason"`
+	QuarantinedAt  time.Time `json:"quarantined_at"`
+	Until          time.Time `json:"until"`
+}
+
+// actorQuarantine counts the traps of every actor and keeps track of the actors that are
+// quarantined. recordTrap and check are no-ops on a nil actorQuarantine.
+type actorQuarantine struct {
+	sync.Mutex
+
+	// Configuration.
+	opts QuarantineOptions
+	now  func() time.Time
+	// events is nil if lifecycle events are not published.
+	events *lifecycleBus
+
+	// State.
+	_traps       map[types.NamespacedActorID]*trapCount
+	_quarantined map[types.NamespacedActorID]QuarantinedActor
+	_lastSweep   time.Time
+	traps        atomic.Uint64
+	quarantines  atomic.Uint64
+}
+
+// trapCount is the number of traps of an actor in the window that started at start.
+type trapCount struct {
+	start time.Time
+	count int
+}
+
+func newActorQuarantine(opts QuarantineOptions, now func() time.Time) *actorQuarantine {
+	if opts.Window == 0 {
+		opts.Window = defaultQuarantineWindow
+	}
+	if opts.Cooldown == 0 {
+		opts.Cooldown = defaultQuarantineCooldown
+	}
+	return &actorQuarantine{
+		opts:         opts,
+		now:          now,
+		_traps:       make(map[types.NamespacedActorID]*trapCount),
+		_quarantined: make(map[types.NamespacedActorID]QuarantinedActor),
+		_lastSweep:   now(),
+	}
+}
+
+// recordTrap records a trap of the actor, and returns whether the actor was quarantined
+// because of it.
+func (q *actorQuarantine) recordTrap(actorID types.NamespacedActorID, reason string) bool {
+	if q == nil {
+		return false
+	}
+	q.traps.Add(1)
+	if q.opts.MaxTraps == 0 || actorID.IDType != types.IDTypeActor {
+		return false
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	now := q.now()
+	q.sweepWithLock(now)
+	if _, ok := q._quarantined[actorID]; ok {
+		return false
+	}
+
+	tc, ok := q._traps[actorID]
+	if !ok || now.Sub(tc.start) >= q.opts.Window {
+		tc = &trapCount{start: now}
+		q._traps[actorID] = tc
+	}
+	tc.count++
+	if tc.count < q.opts.MaxTraps {
+		return false
+	}
+
+	delete(q._traps, actorID)
+	q._quarantined[actorID] = QuarantinedActor{
+		Namespace:      actorID.Namespace,
+		ModuleID:       actorID.Module,
+		ActorID:        actorID.ID,
+		LastTrapReason: reason,
+		QuarantinedAt:  now,
+		Until:          now.Add(q.opts.Cooldown),
+	}
+	q.quarantines.Add(1)
+	log.Printf(
+		"actor: %v trapped %d times within: %s, quarantining it for: %s, last trap: %s",
+		actorID, q.opts.MaxTraps, q.opts.Window, q.opts.Cooldown, reason)
+	q.events.publish(LifecycleEventQuarantined, actorID, reason)
+	return true
+}
+
+// check returns an error that wraps ErrActorQuarantined if the actor is quarantined.
+func (q *actorQuarantine) check(actorID types.NamespacedActorID) error {
+	if q == nil || q.opts.MaxTraps == 0 {
+		return nil
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	qa, ok := q._quarantined[actorID]
+	if !ok {
+		return nil
+	}
+	now := q.now()
+	if !now.Before(qa.Until) {
+		delete(q._quarantined, actorID)
+		return nil
+	}
+	return fmt.Errorf(
+		"%w: actor: %v, retry after: %s, last trap: %s",
+		ErrActorQuarantined, actorID, qa.Until.Sub(now), qa.LastTrapReason)
+}
+
+// release removes the actor from quarantine and forgets its traps, and returns whether it
+// was quarantined.
+func (q *actorQuarantine) release(actorID types.NamespacedActorID) bool {
+	q.Lock()
+	defer q.Unlock()
+	qa, ok := q._quarantined[actorID]
+	delete(q._quarantined, actorID)
+	delete(q._traps, actorID)
+	return ok && q.now().Before(qa.Until)
+}
+
+// list returns the actors that are currently quarantined, sorted by the time at which
+// they were quarantined.
+func (q *actorQuarantine) list() []QuarantinedActor {
+	q.Lock()
+	defer q.Unlock()
+	now := q.now()
+	q.sweepWithLock(now)
+	quarantined := make([]QuarantinedActor, 0, len(q._quarantined))
+	for _, qa := range q._quarantined {
+		if now.Before(qa.Until) {
+			quarantined = append(quarantined, qa)
+		}
+	}
+	sort.Slice(quarantined, func(i, j int) bool {
+		return quarantined[i].QuarantinedAt.Before(quarantined[j].QuarantinedAt)
+	})
+	return quarantined
+}
+
+// sweepWithLock forgets the trap counts whose window has elapsed and the quarantines whose
+// cooldown has elapsed, at most once per window so that recording traps stays cheap. The
+// lock must be held.
+func (q *actorQuarantine) sweepWithLock(now time.Time) {
+	if now.Sub(q._lastSweep) < q.opts.Window {
+		return
+	}
+	q._lastSweep = now
+	for actorID, tc := range q._traps {
+		if now.Sub(tc.start) >= q.opts.Window {
+			delete(q._traps, actorID)
+		}
+	}
+	for actorID, qa := range q._quarantined {
+		if !now.Before(qa.Until) {
+			delete(q._quarantined, actorID)
+		}
+	}
+}
+
+// recoverActorPanic converts a panic of an actor (or of the host functions that it
+// called) into an InvokeError in the InvokeErrorCategoryTrap category that is stored in
+// err, so that it fails the invocation instead of crashing the server. It must be
+// deferred directly.
+func recoverActorPanic(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	reason := fmt.Sprintf("panic: %v", r)
+	log.Printf("recovered actor %s\n%s", reason, runtimedebug.Stack())
+	*err = &InvokeError{
+		Category:   InvokeErrorCategoryTrap,
+		TrapReason: reason,
+		Err:        fmt.Errorf("%w: %v", errActorPanicked, r),
+	}
+}
+
+// quarantine serves the quarantined actors of the namespace that is identified by the
+// /{namespace} suffix of the path on GET, and releases the actor that is identified by
+// the /{namespace}/{module}/{actor} suffix of the path from quarantine on DELETE.
+func (s *server) quarantine(w http.ResponseWriter, r *http.Request) {
+	// Actor IDs may contain slashes, namespaces and module IDs may not.
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, quarantineAdminPathPrefix), "/", 3)
+	if parts[0] == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("path must start with: " + quarantineAdminPathPrefix + "{namespace}"))
+		return
+	}
+	namespace := parts[0]
+	if !s.authorize(w, r, namespace) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if len(parts) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("path must be: " + quarantineAdminPathPrefix + "{namespace}"))
+			return
+		}
+		quarantined := []QuarantinedActor{}
+		for _, qa := range s.environment.QuarantinedActors() {
+			if qa.Namespace == namespace {
+				quarantined = append(quarantined, qa)
+			}
+		}
+		writeCacheAdminResponse(w, quarantined)
+	case http.MethodDelete:
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("path must be: " + quarantineAdminPathPrefix + "{namespace}/{module}/{actor}"))
+			return
+		}
+		if !s.environment.UnquarantineActor(namespace, parts[1], parts[2]) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("actor is not quarantined"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
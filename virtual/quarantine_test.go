@@ -0,0 +1,215 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestActorPanicIsTrap ensures that actors that panic fail the invocation with a trap
+// instead of crashing the server.
+func TestActorPanicIsTrap(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 62
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "panic", []byte("boom"), types.CreateIfNotExist{})
+	invokeErr, ok := AsInvokeError(err)
+	require.True(t, ok, "error is not an InvokeError: %v", err)
+	require.Equal(t, InvokeErrorCategoryTrap, invokeErr.Category)
+	require.Equal(t, "panic: boom", invokeErr.TrapReason)
+
+	// Quarantines are disabled by default, so the actor keeps its state.
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, "2", string(result))
+
+	// Panics of workers are recovered too.
+	_, err = env.InvokeWorker(
+		ctx, "ns-1", "test-module", "panic", []byte("boom"), types.CreateIfNotExist{})
+	invokeErr, ok = AsInvokeError(err)
+	require.True(t, ok, "error is not an InvokeError: %v", err)
+	require.Equal(t, InvokeErrorCategoryTrap, invokeErr.Category)
+
+	stats := env.ActivationStats()
+	require.Equal(t, uint64(2), stats.Traps)
+	require.Equal(t, uint64(0), stats.Quarantines)
+	require.Empty(t, env.QuarantinedActors())
+}
+
+// TestActorQuarantine ensures that actors that trap repeatedly are quarantined until the
+// cooldown elapses or they're released manually.
+func TestActorQuarantine(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 63
+	opts.Quarantine = QuarantineOptions{
+		MaxTraps: 2,
+		Window:   time.Minute,
+		Cooldown: 500 * time.Millisecond,
+	}
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	// Actors that panic on startup are stuck in a crash loop.
+	create := types.CreateIfNotExist{InstantiatePayload: []byte("panic")}
+	for i := 0; i < 2; i++ {
+		_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, create)
+		invokeErr, ok := AsInvokeError(err)
+		require.True(t, ok, "error is not an InvokeError: %v", err)
+		require.Equal(t, InvokeErrorCategoryTrap, invokeErr.Category)
+	}
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, create)
+	require.True(t, IsActorQuarantinedErr(err), "unexpected error: %v", err)
+	invokeErr, ok := AsInvokeError(err)
+	require.True(t, ok, "error is not an InvokeError: %v", err)
+	require.Equal(t, InvokeErrorCategoryAppError, invokeErr.Category)
+
+	quarantined := env.QuarantinedActors()
+	require.Len(t, quarantined, 1)
+	require.Equal(t, "ns-1", quarantined[0].Namespace)
+	require.Equal(t, "test-module", quarantined[0].ModuleID)
+	require.Equal(t, "a", quarantined[0].ActorID)
+	require.Equal(t, "panic: startup panic", quarantined[0].LastTrapReason)
+
+	// Other actors are not affected.
+	_, err = env.InvokeActor(ctx, "ns-1", "b", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+
+	// Releasing the actor allows it to be activated again.
+	require.True(t, env.UnquarantineActor("ns-1", "test-module", "a"))
+	require.False(t, env.UnquarantineActor("ns-1", "test-module", "a"))
+	require.Empty(t, env.QuarantinedActors())
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, create)
+	require.False(t, IsActorQuarantinedErr(err), "unexpected error: %v", err)
+
+	// Active actors that trap repeatedly are deactivated too.
+	for i := 0; i < 2; i++ {
+		_, err = env.InvokeActor(ctx, "ns-1", "b", "test-module", "panic", []byte("boom"), types.CreateIfNotExist{})
+		require.Error(t, err)
+		require.False(t, IsActorQuarantinedErr(err), "unexpected error: %v", err)
+	}
+	_, err = env.InvokeActor(ctx, "ns-1", "b", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.True(t, IsActorQuarantinedErr(err), "unexpected error: %v", err)
+
+	// The quarantine ends once the cooldown elapses, and the actor starts over.
+	require.Eventually(t, func() bool {
+		result, err := env.InvokeActor(ctx, "ns-1", "b", "test-module", "inc", nil, types.CreateIfNotExist{})
+		if err != nil {
+			require.True(t, IsActorQuarantinedErr(err), "unexpected error: %v", err)
+			return false
+		}
+		require.Equal(t, "1", string(result))
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+
+	stats := env.ActivationStats()
+	require.Equal(t, uint64(5), stats.Traps)
+	require.Equal(t, uint64(2), stats.Quarantines)
+}
+
+// TestQuarantineAdminAPI ensures that quarantined actors can be listed and released
+// through the admin API.
+func TestQuarantineAdminAPI(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 64
+	opts.Quarantine = QuarantineOptions{MaxTraps: 1}
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	_, err = env.InvokeActor(ctx, "ns-1", "a/b", "test-module", "panic", nil, types.CreateIfNotExist{})
+	require.Error(t, err)
+
+	s := NewServer(reg, env)
+	server := httptest.NewServer(http.HandlerFunc(s.quarantine))
+	defer server.Close()
+
+	do := func(method, path string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+quarantineAdminPathPrefix+path, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	list := func(namespace string) []QuarantinedActor {
+		resp := do(http.MethodGet, namespace)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var quarantined []QuarantinedActor
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&quarantined))
+		return quarantined
+	}
+
+	quarantined := list("ns-1")
+	require.Len(t, quarantined, 1)
+	require.Equal(t, "a/b", quarantined[0].ActorID)
+	require.Empty(t, list("ns-2"))
+
+	require.Equal(t, http.StatusBadRequest, do(http.MethodGet, "").StatusCode)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodDelete, "ns-1/test-module").StatusCode)
+	require.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPost, "ns-1").StatusCode)
+
+	require.Equal(t, http.StatusNotFound, do(http.MethodDelete, "ns-1/test-module/other").StatusCode)
+	require.Equal(t, http.StatusOK, do(http.MethodDelete, "ns-1/test-module/a/b").StatusCode)
+	require.Empty(t, list("ns-1"))
+}
+
+// TestActorQuarantineWindow ensures that only the traps within the window count towards
+// the quarantine.
+func TestActorQuarantineWindow(t *testing.T) {
+	now := time.Unix(0, 0)
+	q := newActorQuarantine(QuarantineOptions{MaxTraps: 2}, func() time.Time { return now })
+	actorID := types.NewNamespacedActorID("ns-1", "a", "test-module", types.IDTypeActor)
+
+	require.False(t, q.recordTrap(actorID, "trap"))
+	now = now.Add(defaultQuarantineWindow)
+	require.False(t, q.recordTrap(actorID, "trap"))
+	require.NoError(t, q.check(actorID))
+	now = now.Add(time.Second)
+	require.True(t, q.recordTrap(actorID, "trap"))
+	require.True(t, IsActorQuarantinedErr(q.check(actorID)))
+
+	now = now.Add(defaultQuarantineCooldown)
+	require.NoError(t, q.check(actorID))
+	require.Empty(t, q.list())
+
+	// Workers are never quarantined.
+	workerID := types.NewNamespacedActorID("ns-1", "w", "test-module", types.IDTypeWorker)
+	require.False(t, q.recordTrap(workerID, "trap"))
+	require.False(t, q.recordTrap(workerID, "trap"))
+	require.Equal(t, uint64(5), q.traps.Load())
+	require.Equal(t, uint64(1), q.quarantines.Load())
+}
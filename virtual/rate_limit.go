@@ -0,0 +1,186 @@
+package virtual
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+// retryAfterMillisHeader carries the same hint as the standard Retry-After header, but
+// with millisecond precision since actors are usually limited to more than one
+// invocation per second.
+const retryAfterMillisHeader = "X-Nola-Retry-After-Ms"
+
+// ErrActorRateLimited is wrapped by the errors of invocations that are rejected because
+// the actor exceeded its rate limit (see RateLimitOptions), including invocations that
+// are rejected by other servers. Use errors.As with *ActorRateLimitedError to find out
+// how long the caller should back off for.
+var ErrActorRateLimited = errors.New("actor invocation rate limit exceeded")
+
+// IsActorRateLimitedErr returns a boolean indicating whether the error is an instance of
+// (or wraps) ErrActorRateLimited.
+func IsActorRateLimitedErr(err error) bool {
+	return errors.Is(err, ErrActorRateLimited)
+}
+
+// ActorRateLimitedError is the error of invocations that are rejected because the actor
+// exceeded its rate limit. It wraps ErrActorRateLimited.
+type ActorRateLimitedError struct {
+	// RetryAfter is how long until the actor accepts another invocation, assuming it
+	// receives no other invocations in the meantime.
+	RetryAfter time.Duration
+}
+
+func (e *ActorRateLimitedError) Error() string {
+	return fmt.Sprintf("%s, retry after: %s", ErrActorRateLimited, e.RetryAfter)
+}
+
+func (e *ActorRateLimitedError) Unwrap() error {
+	return ErrActorRateLimited
+}
+
+// RateLimit is the rate limit of the invocations of a single actor. Invocations are
+// admitted by a token bucket that holds up to Burst tokens and is refilled at Rate
+// tokens per second.
+type RateLimit struct {
+	// Rate is the number of invocations per second that each actor accepts on average.
+	// A value of 0 means no limit.
+	Rate float64
+	// Burst is the number of invocations that each actor accepts at once after it
+	// hasn't been invoked for a while.
+	//
+	// A value of 0 will be ignored and replaced with Rate rounded up.
+	Burst int
+}
+
+func (r *RateLimit) validate() error {
+	if r.Rate < 0 || math.IsNaN(r.Rate) || math.IsInf(r.Rate, 0) {
+		return fmt.Errorf("Rate must be a finite number >= 0")
+	}
+	if r.Burst < 0 {
+		return fmt.Errorf("Burst must be >= 0")
+	}
+	return nil
+}
+
+// RateLimitOptions contains the options for limiting the rate at which each actor is
+// invoked so that a single hot actor can't starve the other actors of its server.
+// Invocations that exceed the limit are rejected immediately (instead of queuing behind
+// the actor's lock) with an *ActorRateLimitedError, which servers report to remote
+// callers with http.StatusTooManyRequests and a Retry-After header.
+//
+// The limiter of each actor lives with its activation, so it's reset when the actor is
+// reactivated. Invocations of workers, timers and the actor's startup and shutdown
+// operations are not limited. Like fuel limits, the limit for a module is resolved when
+// an actor is activated, so changes only apply to new activations.
+type RateLimitOptions struct {
+	// DefaultLimit is the rate limit for the actors of all modules that don't have a
+	// more specific limit configured. The zero value means no limit.
+	DefaultLimit RateLimit
+	// NamespaceLimits contains per-namespace rate limits that override DefaultLimit.
+	NamespaceLimits map[string]RateLimit
+	// ModuleLimits contains per-module rate limits that override NamespaceLimits and
+	// DefaultLimit.
+	ModuleLimits map[types.NamespacedIDNoType]RateLimit
+}
+
+func (r *RateLimitOptions) Validate() error {
+	if err := r.DefaultLimit.validate(); err != nil {
+		return fmt.Errorf("invalid DefaultLimit: %w", err)
+	}
+	for namespace, limit := range r.NamespaceLimits {
+		if err := limit.validate(); err != nil {
+			return fmt.Errorf("invalid NamespaceLimits for namespace: %s: %w", namespace, err)
+		}
+	}
+	for moduleID, limit := range r.ModuleLimits {
+		if err := limit.validate(); err != nil {
+			return fmt.Errorf("invalid ModuleLimits for module: %v: %w", moduleID, err)
+		}
+	}
+	return nil
+}
+
+// limit returns the rate limit for the actors of the provided module.
+func (r *RateLimitOptions) limit(namespace, moduleID string) RateLimit {
+	if limit, ok := r.ModuleLimits[types.NewNamespacedIDNoType(namespace, moduleID)]; ok {
+		return limit
+	}
+	if limit, ok := r.NamespaceLimits[namespace]; ok {
+		return limit
+	}
+	return r.DefaultLimit
+}
+
+// tokenBucket is the rate limiter of a single activated actor. Unlike the rest of the
+// actor's state it has its own lock so that invocations can be rejected without waiting
+// for the actor's in-flight invocation to complete.
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full token bucket for the provided limit, or nil if there is
+// no limit.
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	if limit.Rate == 0 {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst == 0 {
+		burst = math.Ceil(limit.Rate)
+	}
+	return &tokenBucket{
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+// take consumes a token if one is available. Otherwise it returns false and how long
+// until the next token is available.
+func (b *tokenBucket) take(now time.Time) (time.Duration, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	wait := time.Duration(math.Ceil((1 - b.tokens) / b.rate * float64(time.Second)))
+	return wait, false
+}
+
+// setRetryAfter sets the headers that tell the caller of a rate limited invocation how
+// long to back off for.
+func setRetryAfter(header http.Header, retryAfter time.Duration) {
+	header.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+	header.Set(retryAfterMillisHeader, strconv.FormatInt(int64(math.Ceil(
+		float64(retryAfter)/float64(time.Millisecond))), 10))
+}
+
+// retryAfterFromHeader is the inverse of setRetryAfter. It falls back to the standard
+// Retry-After header (in seconds) for responses from other HTTP servers.
+func retryAfterFromHeader(header http.Header) time.Duration {
+	if millis, err := strconv.ParseInt(header.Get(retryAfterMillisHeader), 10, 64); err == nil {
+		return time.Duration(millis) * time.Millisecond
+	}
+	if seconds, err := strconv.ParseInt(header.Get("Retry-After"), 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
@@ -0,0 +1,143 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRateLimits ensures that invocations of actors that exceed their rate limit are
+// rejected, and that the limits are resolved per module.
+func TestRateLimits(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 32
+	opts.RateLimits = RateLimitOptions{
+		NamespaceLimits: map[string]RateLimit{"ns-1": {Rate: 0.001, Burst: 2}},
+		ModuleLimits: map[types.NamespacedIDNoType]RateLimit{
+			types.NewNamespacedIDNoType("ns-1", "unlimited-module"): {},
+		},
+	}
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	for _, moduleID := range []string{"test-module", "unlimited-module"} {
+		require.NoError(t, env.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: "ns-1", ID: moduleID}, testModule{}))
+	}
+
+	invoke := func(actorID, moduleID string) error {
+		_, err := env.InvokeActor(
+			ctx, "ns-1", actorID, moduleID, "inc", nil, types.CreateIfNotExist{})
+		return err
+	}
+
+	// The activation's startup operation doesn't count against the limit.
+	require.NoError(t, invoke("a", "test-module"))
+	require.NoError(t, invoke("a", "test-module"))
+	err = invoke("a", "test-module")
+	require.True(t, IsActorRateLimitedErr(err))
+	var rateLimitedErr *ActorRateLimitedError
+	require.True(t, errors.As(err, &rateLimitedErr))
+	require.Greater(t, rateLimitedErr.RetryAfter, 900*time.Second)
+
+	// Limits are per actor.
+	require.NoError(t, invoke("b", "test-module"))
+	for i := 0; i < 10; i++ {
+		require.NoError(t, invoke("a", "unlimited-module"))
+	}
+
+	require.Error(t, (&RateLimitOptions{DefaultLimit: RateLimit{Rate: -1}}).Validate())
+	require.Error(t, (&RateLimitOptions{
+		NamespaceLimits: map[string]RateLimit{"ns-1": {Rate: 1, Burst: -1}},
+	}).Validate())
+}
+
+// TestRateLimitsForwarded ensures that invocations that are rejected by the server they
+// are forwarded to can be told apart from other errors by the caller.
+func TestRateLimitsForwarded(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 33
+	opts.RateLimits.DefaultLimit = RateLimit{Rate: 10, Burst: 1}
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	httpServer := httptest.NewServer(http.HandlerFunc(NewServer(reg, env).invokeDirect))
+	defer httpServer.Close()
+	references, err := reg.EnsureActivation(ctx, "ns-1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	ref, err := types.NewActorReference(
+		references[0].ServerID(), references[0].ServerVersion(),
+		strings.TrimPrefix(httpServer.URL, "http://"), "ns-1", "test-module", "a",
+		references[0].Generation())
+	require.NoError(t, err)
+	vs, err := reg.GetVersionStamp(ctx)
+	require.NoError(t, err)
+
+	stream, err := NewHTTPClient().InvokeActorRemote(ctx, vs, ref, "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+	_, err = NewHTTPClient().InvokeActorRemote(ctx, vs, ref, "inc", nil, types.CreateIfNotExist{})
+	var rateLimitedErr *ActorRateLimitedError
+	require.True(t, errors.As(err, &rateLimitedErr))
+	require.Greater(t, rateLimitedErr.RetryAfter, time.Duration(0))
+	require.LessOrEqual(t, rateLimitedErr.RetryAfter, 100*time.Millisecond)
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	require.Nil(t, newTokenBucket(RateLimit{}, now))
+
+	b := newTokenBucket(RateLimit{Rate: 2}, now)
+	for i := 0; i < 2; i++ {
+		_, ok := b.take(now)
+		require.True(t, ok)
+	}
+	retryAfter, ok := b.take(now)
+	require.False(t, ok)
+	require.Equal(t, 500*time.Millisecond, retryAfter)
+
+	// Tokens are refilled at the rate, up to the burst.
+	_, ok = b.take(now.Add(500 * time.Millisecond))
+	require.True(t, ok)
+	_, ok = b.take(now.Add(500 * time.Millisecond))
+	require.False(t, ok)
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		_, ok := b.take(now)
+		require.True(t, ok)
+	}
+	_, ok = b.take(now)
+	require.False(t, ok)
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	header := make(http.Header)
+	setRetryAfter(header, 1500*time.Millisecond)
+	require.Equal(t, "2", header.Get("Retry-After"))
+	require.Equal(t, 1500*time.Millisecond, retryAfterFromHeader(header))
+
+	header.Del(retryAfterMillisHeader)
+	require.Equal(t, 2*time.Second, retryAfterFromHeader(header))
+	require.Equal(t, time.Duration(0), retryAfterFromHeader(make(http.Header)))
+}
@@ -0,0 +1,406 @@
+package virtual
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/richardartoul/nola/durable"
+	"github.com/richardartoul/nola/durable/durablewazero"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+)
+
+// errReplayDiverged is returned to modules that make a host function call during a replay
+// that doesn't match the next call that was recorded.
+var errReplayDiverged = errors.New("replay diverged from recording")
+
+// RecordedHostCall is a call to a host function that a WASM actor made while it was
+// recorded, including KV reads, invocations of other actors and custom host functions.
+type RecordedHostCall struct {
+	Binding   string `json:"binding"`
+	Namespace string `json:"namespace"`
+	Operation string `json:"operation"`
+	Payload   []byte `json:"payload,omitempty"`
+	Result    []byte `json:"result,omitempty"`
+	// Err is the message of the error that the host function returned, if any.
+	Err string `json:"err,omitempty"`
+}
+
+// RecordedInvocation is an invocation of a WASM actor that was recorded (see
+// RecordingOptions), along with the host function calls that the actor made while
+// handling it so that it can be replayed hermetically with Replay.
+type RecordedInvocation struct {
+	Namespace string             `json:"namespace"`
+	ModuleID  string             `json:"module_id"`
+	ActorID   string             `json:"actor_id"`
+	Operation string             `json:"operation"`
+	Payload   []byte             `json:"payload,omitempty"`
+	HostCalls []RecordedHostCall `json:"host_calls,omitempty"`
+	Result    []byte             `json:"result,omitempty"`
+	// Err is the message of the error that the invocation returned, if any.
+	Err string `json:"err,omitempty"`
+}
+
+// Recorder stores the invocations that are recorded (see RecordingOptions). It must be
+// safe for concurrent use since the invocations of different actors are recorded
+// concurrently.
+type Recorder interface {
+	Record(invocation RecordedInvocation) error
+}
+
+// RecordingOptions contains the options for recording the invocations of WASM actors so
+// that they can be replayed against a different build of their module with Replay, for
+// example to debug a production issue locally.
+//
+// Every invocation of a recorded actor is recorded, including its startup and shutdown
+// operations, along with the host function calls that it makes. Invocations of Go
+// modules are never recorded. Recording is meant for debugging since it costs a call to
+// the Recorder per invocation.
+type RecordingOptions struct {
+	// Recorder stores the recorded invocations. Recording is disabled if it's nil.
+	Recorder Recorder
+	// Modules contains the modules whose actors are recorded. All the WASM modules are
+	// recorded if it's empty.
+	Modules []types.NamespacedIDNoType
+}
+
+func (r *RecordingOptions) Validate() error {
+	if r.Recorder == nil && len(r.Modules) > 0 {
+		return errors.New("Modules can't be set without Recorder")
+	}
+	return nil
+}
+
+// recorder returns the Recorder for the actors of the provided module, or nil if they're
+// not recorded.
+func (r *RecordingOptions) recorder(namespace, moduleID string) Recorder {
+	if r.Recorder == nil {
+		return nil
+	}
+	if len(r.Modules) == 0 {
+		return r.Recorder
+	}
+	for _, id := range r.Modules {
+		if id.Namespace == namespace && id.ID == moduleID {
+			return r.Recorder
+		}
+	}
+	return nil
+}
+
+// FileRecorder is a Recorder that appends every recorded invocation to a file as a line
+// of JSON. Use ReadRecording to read them back.
+type FileRecorder struct {
+	sync.Mutex
+	f *os.File
+}
+
+// NewFileRecorder creates a new FileRecorder that appends to the file at path, creating
+// it if it doesn't exist.
+func NewFileRecorder(path string) (*FileRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening recording file: %s, err: %w", path, err)
+	}
+	return &FileRecorder{f: f}, nil
+}
+
+func (r *FileRecorder) Record(invocation RecordedInvocation) error {
+	marshaled, err := json.Marshal(invocation)
+	if err != nil {
+		return fmt.Errorf("error marshaling recorded invocation: %w", err)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if _, err := r.f.Write(append(marshaled, '\n')); err != nil {
+		return fmt.Errorf("error writing recorded invocation: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (r *FileRecorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.f.Close()
+}
+
+// ReadRecording reads the invocations that were recorded by a FileRecorder, in the order
+// in which they were recorded.
+func ReadRecording(r io.Reader) ([]RecordedInvocation, error) {
+	var (
+		invocations []RecordedInvocation
+		scanner     = bufio.NewScanner(r)
+	)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var invocation RecordedInvocation
+		if err := json.Unmarshal(scanner.Bytes(), &invocation); err != nil {
+			return nil, fmt.Errorf(
+				"error unmarshaling recorded invocation: %d, err: %w", len(invocations), err)
+		}
+		invocations = append(invocations, invocation)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading recording: %w", err)
+	}
+	return invocations, nil
+}
+
+// invocationRecording accumulates the host function calls of an invocation of a recorded
+// actor.
+type invocationRecording struct {
+	// reference is the reference of the recorded actor, so that the host function calls
+	// of the actors it invokes (which inherit its context) are not recorded with its own.
+	reference types.ActorReferenceVirtual
+	hostCalls []RecordedHostCall
+}
+
+type invocationRecordingCtxKey struct{}
+
+// recordHostCalls wraps the host function router of WASM modules so that the host
+// function calls of recorded actors are added to their invocation's recording.
+func recordHostCalls(hostFn durable.HostFn) durable.HostFn {
+	return func(
+		ctx context.Context,
+		wapcBinding string,
+		wapcNamespace string,
+		wapcOperation string,
+		wapcPayload []byte,
+	) ([]byte, error) {
+		// Copy the payload since the module may reuse its memory.
+		payload := append([]byte(nil), wapcPayload...)
+		result, err := hostFn(ctx, wapcBinding, wapcNamespace, wapcOperation, wapcPayload)
+
+		recording, ok := ctx.Value(invocationRecordingCtxKey{}).(*invocationRecording)
+		if !ok || recording.reference != ctx.Value(hostFnActorReferenceCtxKey{}) {
+			return result, err
+		}
+		call := RecordedHostCall{
+			Binding:   wapcBinding,
+			Namespace: wapcNamespace,
+			Operation: wapcOperation,
+			Payload:   payload,
+			Result:    append([]byte(nil), result...),
+		}
+		if err != nil {
+			call.Err = err.Error()
+		}
+		recording.hostCalls = append(recording.hostCalls, call)
+		return result, err
+	}
+}
+
+// invokeRecorded invokes the operation on the WASM actor with invoke and records the
+// invocation with recorder.
+func invokeRecorded(
+	ctx context.Context,
+	recorder Recorder,
+	reference types.ActorReferenceVirtual,
+	operation string,
+	payload []byte,
+	invoke func(ctx context.Context) ([]byte, error),
+) ([]byte, error) {
+	recording := &invocationRecording{reference: reference}
+	invocation := RecordedInvocation{
+		Namespace: reference.Namespace(),
+		ModuleID:  reference.ModuleID().ID,
+		ActorID:   reference.ActorID().ID,
+		Operation: operation,
+		Payload:   append([]byte(nil), payload...),
+	}
+
+	result, err := invoke(context.WithValue(ctx, invocationRecordingCtxKey{}, recording))
+	invocation.HostCalls = recording.hostCalls
+	invocation.Result = append([]byte(nil), result...)
+	if err != nil {
+		invocation.Err = err.Error()
+	}
+	if recordErr := recorder.Record(invocation); recordErr != nil {
+		log.Printf(
+			"error recording invocation of operation: %s of actor: %v, err: %v",
+			operation, reference, recordErr)
+	}
+	return result, err
+}
+
+// ReplayOptions contains the options for Replay.
+type ReplayOptions struct {
+	// WASMRuntime is the runtime that the module is compiled and run with.
+	//
+	// A nil value will be ignored and replaced with the default value of
+	// durablewazero.NewRuntime().
+	WASMRuntime durable.WASMRuntime
+}
+
+// ReplayMismatch is a recorded invocation whose replay didn't match the recording.
+type ReplayMismatch struct {
+	// Index is the index of the invocation in the recording.
+	Index int
+	// Invocation is the recorded invocation.
+	Invocation RecordedInvocation
+	// Result is the result of the replayed invocation.
+	Result []byte
+	// Err is the message of the error that the replayed invocation returned, if any.
+	Err string
+	// Reason describes how the replay diverged from the recording.
+	Reason string
+}
+
+// Replay re-runs the recorded invocations (see RecordingOptions) against moduleBytes, which
+// is usually a different build of the module that they were recorded from, and returns
+// the invocations whose result, error or host function calls don't match the recording.
+//
+// Replays are hermetic: the module's host function calls are not executed, instead they
+// must match the calls that were recorded (in order) and they return the recorded
+// results. Every actor in the recording is replayed on its own instance of the module,
+// which starts over whenever the actor's startup operation was recorded, so actors should
+// be recorded from the moment they're activated for their replay to be faithful. The
+// invocations are replayed in the order in which they were recorded.
+//
+// The returned error is only set if the invocations couldn't be replayed at all, for
+// example because moduleBytes is not a valid module.
+func Replay(
+	ctx context.Context,
+	moduleBytes []byte,
+	recording []RecordedInvocation,
+	opts ReplayOptions,
+) ([]ReplayMismatch, error) {
+	if opts.WASMRuntime == nil {
+		opts.WASMRuntime = durablewazero.NewRuntime()
+	}
+
+	module, err := opts.WASMRuntime.Compile(ctx, replayHostCalls, moduleBytes, durable.CompileOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error compiling module for replay: %w", err)
+	}
+	defer module.Close(ctx)
+
+	var (
+		mismatches  []ReplayMismatch
+		objects     = make(map[types.NamespacedActorID]durable.Object)
+		instanceSeq int
+	)
+	defer func() {
+		for _, obj := range objects {
+			obj.Close(ctx)
+		}
+	}()
+	for i, invocation := range recording {
+		actorID := types.NewNamespacedActorID(
+			invocation.Namespace, invocation.ActorID, invocation.ModuleID, types.IDTypeActor)
+		obj, ok := objects[actorID]
+		if ok && invocation.Operation == wapcutils.StartupOperationName {
+			// The actor was reactivated.
+			obj.Close(ctx)
+			ok = false
+		}
+		if !ok {
+			instanceSeq++
+			obj, err = module.Instantiate(ctx, fmt.Sprintf(
+				"%s::%s::%s::%d", invocation.Namespace, invocation.ModuleID, invocation.ActorID, instanceSeq))
+			if err != nil {
+				return nil, fmt.Errorf("error instantiating actor: %v for replay: %w", actorID, err)
+			}
+			objects[actorID] = obj
+		}
+
+		cursor := &replayCursor{hostCalls: invocation.HostCalls}
+		result, err := obj.Invoke(
+			context.WithValue(ctx, replayCursorCtxKey{}, cursor), invocation.Operation, invocation.Payload)
+		var errMsg string
+		if err != nil {
+			errMsg = err.Error()
+		}
+		if reason := cursor.mismatch(invocation, result, errMsg); reason != "" {
+			mismatches = append(mismatches, ReplayMismatch{
+				Index:      i,
+				Invocation: invocation,
+				Result:     result,
+				Err:        errMsg,
+				Reason:     reason,
+			})
+		}
+	}
+	return mismatches, nil
+}
+
+// replayCursor tracks the host function calls that a replayed invocation has made.
+type replayCursor struct {
+	hostCalls []RecordedHostCall
+	next      int
+	// diverged describes the first host function call that didn't match the recording,
+	// if any.
+	diverged string
+}
+
+type replayCursorCtxKey struct{}
+
+// replayHostCalls is the host function router of replays. It returns the recorded result
+// of each host function call instead of executing it.
+func replayHostCalls(
+	ctx context.Context,
+	wapcBinding string,
+	wapcNamespace string,
+	wapcOperation string,
+	wapcPayload []byte,
+) ([]byte, error) {
+	cursor, ok := ctx.Value(replayCursorCtxKey{}).(*replayCursor)
+	if !ok {
+		return nil, fmt.Errorf("%w: host function called outside of an invocation", errReplayDiverged)
+	}
+	if cursor.diverged != "" {
+		return nil, fmt.Errorf("%w: %s", errReplayDiverged, cursor.diverged)
+	}
+	if cursor.next >= len(cursor.hostCalls) {
+		cursor.diverged = fmt.Sprintf(
+			"unexpected host function call: %s::%s::%s, only %d were recorded",
+			wapcBinding, wapcNamespace, wapcOperation, len(cursor.hostCalls))
+		return nil, fmt.Errorf("%w: %s", errReplayDiverged, cursor.diverged)
+	}
+
+	call := cursor.hostCalls[cursor.next]
+	if call.Binding != wapcBinding || call.Namespace != wapcNamespace ||
+		call.Operation != wapcOperation || !bytes.Equal(call.Payload, wapcPayload) {
+		cursor.diverged = fmt.Sprintf(
+			"host function call: %d was: %s::%s::%s with payload: %q, but recorded: %s::%s::%s with payload: %q",
+			cursor.next, wapcBinding, wapcNamespace, wapcOperation, wapcPayload,
+			call.Binding, call.Namespace, call.Operation, call.Payload)
+		return nil, fmt.Errorf("%w: %s", errReplayDiverged, cursor.diverged)
+	}
+	cursor.next++
+	if call.Err != "" {
+		return nil, errors.New(call.Err)
+	}
+	return call.Result, nil
+}
+
+// mismatch returns how the replayed invocation diverged from the recorded one, or an
+// empty string if it didn't.
+func (c *replayCursor) mismatch(invocation RecordedInvocation, result []byte, errMsg string) string {
+	switch {
+	case c.diverged != "":
+		return c.diverged
+	case c.next < len(c.hostCalls):
+		return fmt.Sprintf(
+			"made %d host function calls, but %d were recorded", c.next, len(c.hostCalls))
+	case errMsg != invocation.Err:
+		return fmt.Sprintf("returned error: %q, but recorded: %q", errMsg, invocation.Err)
+	case !bytes.Equal(result, invocation.Result):
+		return fmt.Sprintf("returned result: %q, but recorded: %q", result, invocation.Result)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,104 @@
+package virtual
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRecordingReplay ensures that the invocations of recorded modules are recorded along
+// with their host function calls, and that replaying them reports the invocations that
+// diverge from the recording.
+func TestRecordingReplay(t *testing.T) {
+	var (
+		reg  = localregistry.NewLocalRegistry()
+		ctx  = context.Background()
+		path = filepath.Join(t.TempDir(), "recording.jsonl")
+	)
+	recorder, err := NewFileRecorder(path)
+	require.NoError(t, err)
+	opts := defaultOptsWASM
+	opts.Discovery.Port = 55
+	opts.Recording = RecordingOptions{
+		Recorder: recorder,
+		Modules:  []types.NamespacedIDNoType{types.NewNamespacedIDNoType("ns-1", "test-module")},
+	}
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	for _, moduleID := range []string{"test-module", "other-module"} {
+		_, err = reg.RegisterModule(ctx, "ns-1", moduleID, utilWasmBytes, registry.ModuleOptions{})
+		require.NoError(t, err)
+	}
+
+	invoke := func(moduleID, operation string, payload []byte) []byte {
+		result, err := env.InvokeActor(
+			ctx, "ns-1", "a", moduleID, operation, payload, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		return result
+	}
+	invoke("test-module", "inc", nil)
+	invoke("test-module", "inc", nil)
+	invoke("test-module", "kvPutCount", []byte("k"))
+	require.Equal(t, "2", string(invoke("test-module", "kvGet", []byte("k"))))
+	invoke("other-module", "inc", nil)
+	require.NoError(t, recorder.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	recording, err := ReadRecording(f)
+	require.NoError(t, err)
+	require.Len(t, recording, 5)
+	var operations []string
+	for _, invocation := range recording {
+		require.Equal(t, "test-module", invocation.ModuleID)
+		require.Equal(t, "a", invocation.ActorID)
+		operations = append(operations, invocation.Operation)
+	}
+	require.Equal(t, []string{
+		wapcutils.StartupOperationName, "inc", "inc", "kvPutCount", "kvGet"}, operations)
+	require.Equal(t, "2", string(recording[2].Result))
+	require.Equal(t, []RecordedHostCall{{
+		Binding:   "wapc",
+		Namespace: "nola",
+		Operation: wapcutils.KVGetOperationName,
+		Payload:   []byte("k"),
+		Result:    []byte("\x012"),
+	}}, recording[4].HostCalls)
+
+	mismatches, err := Replay(ctx, utilWasmBytes, recording, ReplayOptions{})
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+
+	// Replays return the recorded results of host function calls instead of executing
+	// them, and report invocations whose results or host function calls diverge.
+	recording[4].HostCalls[0].Result = []byte("\x013")
+	recording[3].HostCalls[0].Payload = []byte("other")
+	mismatches, err = Replay(ctx, utilWasmBytes, recording, ReplayOptions{})
+	require.NoError(t, err)
+	require.Len(t, mismatches, 2)
+	require.Equal(t, 3, mismatches[0].Index)
+	require.Contains(t, mismatches[0].Reason, "host function call: 0 was")
+	require.Contains(t, mismatches[0].Err, errReplayDiverged.Error())
+	require.Equal(t, 4, mismatches[1].Index)
+	require.Equal(t, "3", string(mismatches[1].Result))
+
+	// Invocations of actors whose startup wasn't recorded are replayed on a new instance.
+	mismatches, err = Replay(ctx, utilWasmBytes, recording[2:3], ReplayOptions{})
+	require.NoError(t, err)
+	require.Len(t, mismatches, 1)
+	require.Equal(t, "1", string(mismatches[0].Result))
+
+	_, err = Replay(ctx, []byte("not wasm"), recording, ReplayOptions{})
+	require.Error(t, err)
+	require.Error(t, (&RecordingOptions{Modules: opts.Recording.Modules}).Validate())
+}
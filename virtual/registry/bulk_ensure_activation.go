@@ -0,0 +1,31 @@
+package registry
+
+import (
+	"context"
+)
+
+// BulkEnsureActivationSequential implements BulkEnsureActivation() by calling
+// EnsureActivation() on r once for each actor. It is a fallback for Registry
+// implementations that can't batch EnsureActivation() calls natively.
+func BulkEnsureActivationSequential(
+	ctx context.Context,
+	r Registry,
+	namespace string,
+	moduleID string,
+	actorIDs []string,
+	opts EnsureActivationOptions,
+) ([]EnsureActivationResult, error) {
+	results := make([]EnsureActivationResult, 0, len(actorIDs))
+	for _, actorID := range actorIDs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		references, err := r.EnsureActivation(ctx, namespace, actorID, moduleID, opts)
+		results = append(results, EnsureActivationResult{
+			References: references,
+			Err:        err,
+		})
+	}
+	return results, nil
+}
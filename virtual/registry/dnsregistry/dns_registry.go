@@ -5,8 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"hash/fnv"
 	"log"
+	"math"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
@@ -24,8 +27,16 @@ const (
 	DNSServerID          = "DNS_SERVER_ID"
 	DNSServerVersion     = int64(-1)
 	DNS_ACTOR_GENERATION = 1
-	// Must be at least 1 because <= 0 is not a legal versionstamp
+	// DNSVersionStamp is the versionstamp that the registry starts with. It is
+	// incremented every time the set of resolved addresses changes. Must be at least 1
+	// because <= 0 is not a legal versionstamp.
 	DNSVersionStamp = 1
+
+	// dnsHeartbeatTTL is the TTL returned by Heartbeat(). Versionstamps returned by the
+	// DNS registry count changes to the set of resolved addresses instead of measuring
+	// time, so heartbeats must never be considered expired no matter how many changes
+	// happened since the last one.
+	dnsHeartbeatTTL = math.MaxInt32
 )
 
 // DNSResolver is the interface that must be implemented by a resolver
@@ -34,6 +45,17 @@ type DNSResolver interface {
 	LookupIP(host string) ([]net.IP, error)
 }
 
+// DNSResolverWithTTL is an optional interface that can be implemented by a DNSResolver
+// that knows the TTL of the records it resolves. The registry honors the TTL by
+// resolving the host again once the records expire, instead of every ResolveEvery.
+type DNSResolverWithTTL interface {
+	DNSResolver
+
+	// LookupIPWithTTL is the same as LookupIP, except it also returns the TTL of the
+	// resolved records.
+	LookupIPWithTTL(host string) ([]net.IP, time.Duration, error)
+}
+
 type dnsRegistry struct {
 	sync.RWMutex
 
@@ -46,6 +68,12 @@ type dnsRegistry struct {
 	// State.
 	ips      []net.IP
 	hashRing *HashRing
+	// addrsHash is the hash of the sorted addresses that hashRing was built from.
+	addrsHash    uint64
+	versionStamp int64
+	// ttl is the TTL of the most recently resolved records, or 0 if the resolver does
+	// not report TTLs.
+	ttl time.Duration
 
 	// Shutdown logic.
 	discoveryRunning bool
@@ -57,8 +85,15 @@ type dnsRegistry struct {
 // implementation.
 type DNSRegistryOptions struct {
 	// ResolveEvery controls how often the LookupIP method will be
-	// called on the DNSResolver to detect which IPs are active.
+	// called on the DNSResolver to detect which IPs are active. It is
+	// ignored if the DNSResolver implements DNSResolverWithTTL.
 	ResolveEvery time.Duration
+	// MinResolveEvery is the minimum amount of time between resolutions when the
+	// DNSResolver implements DNSResolverWithTTL, which protects the DNS server from
+	// records with very short (or zero) TTLs.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 1 second.
+	MinResolveEvery time.Duration
 }
 
 // NewDNSRegistry creates a new registry.Registry backed by DNS.
@@ -87,6 +122,9 @@ func NewDNSRegistryFromResolver(
 	if opts.ResolveEvery == 0 {
 		opts.ResolveEvery = 5 * time.Second
 	}
+	if opts.MinResolveEvery == 0 {
+		opts.MinResolveEvery = time.Second
+	}
 
 	d := &dnsRegistry{
 		resolver: resolver,
@@ -94,6 +132,8 @@ func NewDNSRegistryFromResolver(
 		port:     port,
 		opts:     opts,
 
+		versionStamp: DNSVersionStamp,
+
 		closeCh:  make(chan struct{}),
 		closedCh: make(chan struct{}),
 	}
@@ -147,21 +187,31 @@ func (d *dnsRegistry) IncGeneration(
 	return errors.New("DNSRegistry: IncGeneration: not implemented")
 }
 
+// EnsureActivation picks a server for the actor by consistent hashing. opts.BlacklistedServerIDs
+// is ignored because every reference returned by the DNS registry has the same server ID
+// (DNSServerID). If opts.AffinityKey is set it is hashed instead of the actor's identity so
+// that actors that share it are placed on the same server. opts.AntiAffinityGroup is
+// ignored because the DNS registry doesn't keep track of placements.
 func (d *dnsRegistry) EnsureActivation(
 	ctx context.Context,
 	namespace,
 	actorID string,
 	moduleID string,
+	opts registry.EnsureActivationOptions,
 ) ([]types.ActorReference, error) {
 	d.RLock()
 	ring := d.hashRing
 	d.RUnlock()
 
 	if ring.IsEmpty() {
-		return nil, fmt.Errorf("EnsureActivation: hashring is empty")
+		return nil, fmt.Errorf("EnsureActivation: hashring is empty: %w", registry.ErrNoEligibleServers)
 	}
 
-	serverIP := ring.Get(fmt.Sprintf("%s::%s", actorID, moduleID))
+	hashKey := fmt.Sprintf("%s::%s", actorID, moduleID)
+	if opts.AffinityKey != "" {
+		hashKey = fmt.Sprintf("%s::affinity::%s", namespace, opts.AffinityKey)
+	}
+	serverIP := ring.Get(hashKey)
 	ref, err := types.NewActorReference(
 		DNSServerID, DNSServerVersion, serverIP, namespace,
 		moduleID, actorID, DNS_ACTOR_GENERATION)
@@ -173,11 +223,38 @@ func (d *dnsRegistry) EnsureActivation(
 
 }
 
+// BulkEnsureActivation calls EnsureActivation for each actor since it only consults the
+// hash ring, so there are no round-trips to batch.
+func (d *dnsRegistry) BulkEnsureActivation(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorIDs []string,
+	opts registry.EnsureActivationOptions,
+) ([]registry.EnsureActivationResult, error) {
+	return registry.BulkEnsureActivationSequential(ctx, d, namespace, moduleID, actorIDs, opts)
+}
+
+// LookupActivation is the same as EnsureActivation since the DNS registry doesn't keep
+// track of activations: actors are always placed on the server that they hash to.
+func (d *dnsRegistry) LookupActivation(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+) ([]types.ActorReference, error) {
+	return d.EnsureActivation(ctx, namespace, actorID, moduleID, registry.EnsureActivationOptions{})
+}
+
+// GetVersionStamp returns a versionstamp that only changes when the set of resolved
+// addresses (and therefore the placement of actors) changes, so that callers can tell
+// whether references they resolved previously could still be stale.
 func (d *dnsRegistry) GetVersionStamp(
 	ctx context.Context,
 ) (int64, error) {
-	// Must always return 1 because <= 0 is not a legal versionstamp in the system.
-	return DNSVersionStamp, nil
+	d.RLock()
+	defer d.RUnlock()
+	return d.versionStamp, nil
 }
 
 func (d *dnsRegistry) BeginTransaction(
@@ -191,19 +268,90 @@ func (d *dnsRegistry) BeginTransaction(
 	return nil, errors.New("DNSRegistry: BeginTransaction: not implemented")
 }
 
+func (d *dnsRegistry) PutInstantiatePayload(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	payload []byte,
+) error {
+	return errors.New("DNSRegistry: PutInstantiatePayload: not implemented")
+}
+
+func (d *dnsRegistry) GetInstantiatePayload(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+) ([]byte, bool, error) {
+	// Payloads can't be persisted so there are never any.
+	return nil, false, nil
+}
+
 func (d *dnsRegistry) Heartbeat(
 	ctx context.Context,
 	serverID string,
 	heartbeatState registry.HeartbeatState,
 ) (registry.HeartbeatResult, error) {
+	versionStamp, err := d.GetVersionStamp(ctx)
+	if err != nil {
+		return registry.HeartbeatResult{}, err
+	}
 	return registry.HeartbeatResult{
-		VersionStamp: DNSVersionStamp,
-		// Must be at least 1 so heartbeat.Versionstamp + TTL > DNSVersionStamp
-		HeartbeatTTL:  1,
+		VersionStamp:  versionStamp,
+		HeartbeatTTL:  dnsHeartbeatTTL,
 		ServerVersion: DNSServerVersion,
 	}, nil
 }
 
+func (d *dnsRegistry) RegisterReminder(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	name string,
+	dueTime time.Time,
+	period time.Duration,
+) error {
+	return errors.New("DNSRegistry: RegisterReminder: not implemented")
+}
+
+func (d *dnsRegistry) UnregisterReminder(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	name string,
+) error {
+	return errors.New("DNSRegistry: UnregisterReminder: not implemented")
+}
+
+func (d *dnsRegistry) ListReminders(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+) ([]registry.Reminder, error) {
+	return nil, errors.New("DNSRegistry: ListReminders: not implemented")
+}
+
+func (d *dnsRegistry) ClaimDueReminders(
+	ctx context.Context,
+	now time.Time,
+	limit int,
+) ([]registry.Reminder, error) {
+	// Reminders can't be registered so there are never any due.
+	return nil, nil
+}
+
+func (d *dnsRegistry) RenewActivationLease(
+	ctx context.Context,
+	token string,
+) (types.ActivationLease, error) {
+	// Leases are never granted since actor placement is determined by consistent hashing.
+	return types.ActivationLease{}, errors.New("DNSRegistry: RenewActivationLease: not implemented")
+}
+
 func (d *dnsRegistry) Close(ctx context.Context) error {
 	log.Printf("DNSRegistry: Shutting down")
 	close(d.closeCh)
@@ -217,7 +365,16 @@ func (d *dnsRegistry) UnsafeWipeAll() error {
 }
 
 func (d *dnsRegistry) discover() error {
-	ips, err := d.resolver.LookupIP(d.host)
+	var (
+		ips []net.IP
+		ttl time.Duration
+		err error
+	)
+	if resolver, ok := d.resolver.(DNSResolverWithTTL); ok {
+		ips, ttl, err = resolver.LookupIPWithTTL(d.host)
+	} else {
+		ips, err = d.resolver.LookupIP(d.host)
+	}
 	if err != nil {
 		return fmt.Errorf("discover: error looking up IPs: %w", err)
 	}
@@ -239,13 +396,33 @@ func (d *dnsRegistry) discover() error {
 	}
 	hashRing.Add(ipStrs...)
 
+	// The order of DNS answers is not stable so hash the sorted addresses to detect
+	// whether the set of addresses actually changed.
+	sort.Strings(ipStrs)
+	h := fnv.New64a()
+	for _, ipStr := range ipStrs {
+		h.Write([]byte(ipStr))
+		h.Write([]byte{0})
+	}
+	addrsHash := h.Sum64()
+
 	d.Lock()
-	oldIPs := d.ips
-	d.ips = ips
-	d.hashRing = hashRing
+	var (
+		oldIPs  = d.ips
+		changed = d.hashRing != nil && addrsHash != d.addrsHash
+	)
+	if d.hashRing == nil || changed {
+		d.ips = ips
+		d.hashRing = hashRing
+		d.addrsHash = addrsHash
+	}
+	if changed {
+		d.versionStamp++
+	}
+	d.ttl = ttl
 	d.Unlock()
 
-	if len(d.ips) != len(oldIPs) {
+	if changed {
 		log.Printf(
 			"DNSRegistry: discovered new IP addresses: prev: %v, curr: %v\n",
 			oldIPs, ips)
@@ -254,6 +431,21 @@ func (d *dnsRegistry) discover() error {
 	return nil
 }
 
+// resolveInterval returns how long to wait before resolving the host again.
+func (d *dnsRegistry) resolveInterval() time.Duration {
+	if _, ok := d.resolver.(DNSResolverWithTTL); !ok {
+		return d.opts.ResolveEvery
+	}
+
+	d.RLock()
+	ttl := d.ttl
+	d.RUnlock()
+	if ttl < d.opts.MinResolveEvery {
+		return d.opts.MinResolveEvery
+	}
+	return ttl
+}
+
 func (d *dnsRegistry) discoveryLoop() {
 	d.Lock()
 	if d.discoveryRunning {
@@ -263,13 +455,15 @@ func (d *dnsRegistry) discoveryLoop() {
 	d.Unlock()
 
 	defer close(d.closedCh)
-	ticker := time.NewTicker(d.opts.ResolveEvery)
+	timer := time.NewTimer(d.resolveInterval())
+	defer timer.Stop()
 	for {
 		select {
-		case <-ticker.C:
+		case <-timer.C:
 			if err := d.discover(); err != nil {
 				log.Printf("discoveryLoop: error performing background discovery: %v\n", err)
 			}
+			timer.Reset(d.resolveInterval())
 		case <-d.closeCh:
 			return
 		}
@@ -2,8 +2,10 @@ package dnsregistry
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -26,14 +28,14 @@ func TestDNSRegistrySimple(t *testing.T) {
 		}
 	}()
 
-	_, err = reg.EnsureActivation(context.Background(), "ns1", "a", "test-module")
+	_, err = reg.EnsureActivation(context.Background(), "ns1", "a", "test-module", registry.EnsureActivationOptions{})
 	require.True(t, strings.Contains(err.Error(), "hashring is empty"))
 
 	// Should be a no-op.
 	_, err = reg.Heartbeat(context.Background(), "serverID", registry.HeartbeatState{})
 	require.NoError(t, err)
 
-	// Should always return a constant.
+	// Should be constant until the set of resolved addresses changes.
 	for i := 0; i < 100; i++ {
 		versionStamp, err := reg.GetVersionStamp(context.Background())
 		require.NoError(t, err)
@@ -47,7 +49,7 @@ func TestDNSRegistrySimple(t *testing.T) {
 	})
 
 	for {
-		activations, err := reg.EnsureActivation(context.Background(), "ns1", "a", "test-module")
+		activations, err := reg.EnsureActivation(context.Background(), "ns1", "a", "test-module", registry.EnsureActivationOptions{})
 		if err != nil {
 			time.Sleep(time.Millisecond)
 			continue
@@ -78,7 +80,7 @@ func TestDNSRegistrySingleNode(t *testing.T) {
 		}
 	}()
 
-	activations, err := reg.EnsureActivation(context.Background(), "ns1", "a", "test-module")
+	activations, err := reg.EnsureActivation(context.Background(), "ns1", "a", "test-module", registry.EnsureActivationOptions{})
 	require.NoError(t, err)
 
 	require.Equal(t, 1, len(activations))
@@ -88,3 +90,124 @@ func TestDNSRegistrySingleNode(t *testing.T) {
 	require.Equal(t, DNSServerID, activations[0].ServerID())
 	require.Equal(t, DNSServerVersion, activations[0].ServerVersion())
 }
+
+// TestDNSRegistryAffinityKey tests that actors that share an affinity key are placed on
+// the same server.
+func TestDNSRegistryAffinityKey(t *testing.T) {
+	resolver := newConstResolver([]net.IP{
+		net.ParseIP("127.0.0.1"),
+		net.ParseIP("127.0.0.2"),
+		net.ParseIP("127.0.0.3"),
+	})
+	reg, err := NewDNSRegistryFromResolver(resolver, "test", 9090, DNSRegistryOptions{
+		ResolveEvery: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer func() {
+		if err := reg.Close(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	addresses := func(opts registry.EnsureActivationOptions) map[string]struct{} {
+		addresses := make(map[string]struct{})
+		for i := 0; i < 20; i++ {
+			activations, err := reg.EnsureActivation(
+				context.Background(), "ns1", fmt.Sprintf("actor-%d", i), "test-module", opts)
+			require.NoError(t, err)
+			addresses[activations[0].Address()] = struct{}{}
+		}
+		return addresses
+	}
+	require.Greater(t, len(addresses(registry.EnsureActivationOptions{})), 1)
+	require.Len(t, addresses(registry.EnsureActivationOptions{AffinityKey: "key1"}), 1)
+}
+
+// TestDNSRegistryVersionStamp tests that the versionstamp only changes when the set of
+// resolved addresses changes, regardless of the order in which they're resolved.
+func TestDNSRegistryVersionStamp(t *testing.T) {
+	resolver := newConstResolver([]net.IP{
+		net.ParseIP("127.0.0.1"),
+		net.ParseIP("127.0.0.2"),
+	})
+	reg, err := NewDNSRegistryFromResolver(resolver, "test", 9090, DNSRegistryOptions{
+		ResolveEvery: time.Hour,
+	})
+	require.NoError(t, err)
+	defer reg.Close(context.Background())
+
+	requireVersionStamp := func(expected int64) {
+		versionStamp, err := reg.GetVersionStamp(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, expected, versionStamp)
+
+		hb, err := reg.Heartbeat(context.Background(), "serverID", registry.HeartbeatState{})
+		require.NoError(t, err)
+		require.Equal(t, expected, hb.VersionStamp)
+	}
+	requireVersionStamp(DNSVersionStamp)
+
+	// Same set of addresses in a different order.
+	resolver.setIPs([]net.IP{
+		net.ParseIP("127.0.0.2"),
+		net.ParseIP("127.0.0.1"),
+	})
+	require.NoError(t, reg.(*dnsRegistry).discover())
+	requireVersionStamp(DNSVersionStamp)
+
+	resolver.setIPs([]net.IP{
+		net.ParseIP("127.0.0.1"),
+		net.ParseIP("127.0.0.2"),
+		net.ParseIP("127.0.0.3"),
+	})
+	require.NoError(t, reg.(*dnsRegistry).discover())
+	requireVersionStamp(DNSVersionStamp + 1)
+	require.NoError(t, reg.(*dnsRegistry).discover())
+	requireVersionStamp(DNSVersionStamp + 1)
+}
+
+// TestDNSRegistryTTL tests that the registry resolves the host again once the TTL
+// reported by a DNSResolverWithTTL expires, but no more often than MinResolveEvery.
+func TestDNSRegistryTTL(t *testing.T) {
+	resolver := &ttlResolver{
+		constResolver: newConstResolver([]net.IP{net.ParseIP("127.0.0.1")}),
+		ttl:           time.Hour,
+	}
+	reg, err := NewDNSRegistryFromResolver(resolver, "test", 9090, DNSRegistryOptions{
+		ResolveEvery:    time.Millisecond,
+		MinResolveEvery: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer reg.Close(context.Background())
+
+	d := reg.(*dnsRegistry)
+	require.Equal(t, time.Hour, d.resolveInterval())
+
+	resolver.setTTL(0)
+	require.NoError(t, d.discover())
+	require.Equal(t, 10*time.Millisecond, d.resolveInterval())
+}
+
+type ttlResolver struct {
+	*constResolver
+
+	ttlMu sync.Mutex
+	ttl   time.Duration
+}
+
+func (r *ttlResolver) setTTL(ttl time.Duration) {
+	r.ttlMu.Lock()
+	defer r.ttlMu.Unlock()
+	r.ttl = ttl
+}
+
+func (r *ttlResolver) LookupIPWithTTL(host string) ([]net.IP, time.Duration, error) {
+	ips, err := r.LookupIP(host)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r.ttlMu.Lock()
+	defer r.ttlMu.Unlock()
+	return ips, r.ttl, nil
+}
@@ -6,7 +6,9 @@ type dnsResolver struct {
 }
 
 // NewDNSResolver returns a new DNSResolver that is backed by the
-// standard library implementation of net.LookupIP.
+// standard library implementation of net.LookupIP. The standard library does
+// not expose the TTL of resolved records so the returned DNSResolver does not
+// implement DNSResolverWithTTL.
 func NewDNSResolver() DNSResolver {
 	return &dnsResolver{}
 }
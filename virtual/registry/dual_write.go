@@ -0,0 +1,298 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+// dualWriteRegistry is the registry returned by NewDualWriteRegistry.
+type dualWriteRegistry struct {
+	// Don't embed so we know we've overrided every method in the interface
+	// explicitly.
+	src MigratableRegistry
+	dst MigratableRegistry
+}
+
+// NewDualWriteRegistry returns a registry that keeps dst consistent with src while
+// servers are migrated from src to dst (see Migrate). Reads are served by src, and the
+// module registrations and placement state (servers and actor activations) that are
+// written to src, or read from it, are written through to dst as well. Errors writing to
+// dst are returned to the caller after the write was applied to src, so retrying an
+// operation that failed reconciles both registries.
+//
+// Everything else (the actors' KV storage, instantiate payloads, reminders and activation
+// leases) is only served by src, so it must be migrated separately.
+//
+// Typical usage is:
+//
+//  1. Restart the servers with the registry returned by NewDualWriteRegistry(src, dst).
+//  2. Call Migrate(ctx, src, dst, MigrateOptions{CopyPlacements: true}).
+//  3. Restart the servers with dst.
+//
+// Closing the registry closes both src and dst.
+func NewDualWriteRegistry(src, dst Registry) (Registry, error) {
+	srcM, dstM, err := migratableRegistries(src, dst)
+	if err != nil {
+		return nil, fmt.Errorf("NewDualWriteRegistry: %w", err)
+	}
+	return &dualWriteRegistry{
+		src: srcM,
+		dst: dstM,
+	}, nil
+}
+
+func (d *dualWriteRegistry) RegisterModule(
+	ctx context.Context,
+	namespace,
+	moduleID string,
+	moduleBytes []byte,
+	opts ModuleOptions,
+) (RegisterModuleResult, error) {
+	result, err := d.src.RegisterModule(ctx, namespace, moduleID, moduleBytes, opts)
+	if err != nil {
+		return RegisterModuleResult{}, err
+	}
+	if _, err := copyModule(ctx, d.dst, namespace, moduleID, moduleBytes, opts); err != nil {
+		return RegisterModuleResult{}, fmt.Errorf("dualWriteRegistry: %w", err)
+	}
+	return result, nil
+}
+
+func (d *dualWriteRegistry) GetModule(
+	ctx context.Context,
+	namespace,
+	moduleID string,
+) ([]byte, ModuleOptions, error) {
+	moduleBytes, opts, err := d.src.GetModule(ctx, namespace, moduleID)
+	if err != nil {
+		return nil, ModuleOptions{}, err
+	}
+	// Read-through so that modules that were registered before the migration started
+	// are available in dst as soon as they're used.
+	if _, err := copyModule(ctx, d.dst, namespace, moduleID, moduleBytes, opts); err != nil {
+		return nil, ModuleOptions{}, fmt.Errorf("dualWriteRegistry: %w", err)
+	}
+	return moduleBytes, opts, nil
+}
+
+func (d *dualWriteRegistry) IncGeneration(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+) error {
+	if err := d.src.IncGeneration(ctx, namespace, actorID, moduleID); err != nil {
+		return err
+	}
+	return d.copyActorPlacement(ctx, namespace, actorID, moduleID)
+}
+
+func (d *dualWriteRegistry) EnsureActivation(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+	opts EnsureActivationOptions,
+) ([]types.ActorReference, error) {
+	references, _, err := d.EnsureActivationWithVersionStamp(
+		ctx, namespace, actorID, moduleID, opts)
+	return references, err
+}
+
+func (d *dualWriteRegistry) EnsureActivationWithVersionStamp(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+	opts EnsureActivationOptions,
+) ([]types.ActorReference, int64, error) {
+	references, vs, err := ensureActivationWithVersionStamp(
+		ctx, d.src, namespace, actorID, moduleID, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := d.copyActorPlacement(ctx, namespace, actorID, moduleID); err != nil {
+		return nil, 0, err
+	}
+	return references, vs, nil
+}
+
+func (d *dualWriteRegistry) BulkEnsureActivation(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorIDs []string,
+	opts EnsureActivationOptions,
+) ([]EnsureActivationResult, error) {
+	results, err := d.src.BulkEnsureActivation(ctx, namespace, moduleID, actorIDs, opts)
+	if err != nil {
+		return nil, err
+	}
+	for i, result := range results {
+		if result.Err != nil {
+			continue
+		}
+		if err := d.copyActorPlacement(ctx, namespace, actorIDs[i], moduleID); err != nil {
+			results[i] = EnsureActivationResult{Err: err}
+		}
+	}
+	return results, nil
+}
+
+func (d *dualWriteRegistry) LookupActivation(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+) ([]types.ActorReference, error) {
+	return d.src.LookupActivation(ctx, namespace, actorID, moduleID)
+}
+
+func (d *dualWriteRegistry) RenewActivationLease(
+	ctx context.Context,
+	token string,
+) (types.ActivationLease, error) {
+	return d.src.RenewActivationLease(ctx, token)
+}
+
+func (d *dualWriteRegistry) GetVersionStamp(ctx context.Context) (int64, error) {
+	return d.src.GetVersionStamp(ctx)
+}
+
+func (d *dualWriteRegistry) BeginTransaction(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	serverID string,
+	serverVersion int64,
+) (ActorKVTransaction, error) {
+	return d.src.BeginTransaction(ctx, namespace, actorID, moduleID, serverID, serverVersion)
+}
+
+func (d *dualWriteRegistry) PutInstantiatePayload(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	payload []byte,
+) error {
+	return d.src.PutInstantiatePayload(ctx, namespace, actorID, moduleID, payload)
+}
+
+func (d *dualWriteRegistry) GetInstantiatePayload(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+) ([]byte, bool, error) {
+	return d.src.GetInstantiatePayload(ctx, namespace, actorID, moduleID)
+}
+
+func (d *dualWriteRegistry) Heartbeat(
+	ctx context.Context,
+	serverID string,
+	state HeartbeatState,
+) (HeartbeatResult, error) {
+	result, err := d.src.Heartbeat(ctx, serverID, state)
+	if err != nil {
+		return HeartbeatResult{}, err
+	}
+	// Copy the server version that was assigned by src instead of heartbeating dst so
+	// the activations that are copied to dst remain valid.
+	err = d.dst.PutServer(ctx, ServerPlacement{
+		ServerID:       serverID,
+		ServerVersion:  result.ServerVersion,
+		HeartbeatState: state,
+	})
+	if err != nil {
+		return HeartbeatResult{}, fmt.Errorf("dualWriteRegistry: error copying server: %s: %w", serverID, err)
+	}
+	return result, nil
+}
+
+func (d *dualWriteRegistry) RegisterReminder(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	name string,
+	dueTime time.Time,
+	period time.Duration,
+) error {
+	return d.src.RegisterReminder(ctx, namespace, actorID, moduleID, name, dueTime, period)
+}
+
+func (d *dualWriteRegistry) UnregisterReminder(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	name string,
+) error {
+	return d.src.UnregisterReminder(ctx, namespace, actorID, moduleID, name)
+}
+
+func (d *dualWriteRegistry) ListReminders(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+) ([]Reminder, error) {
+	return d.src.ListReminders(ctx, namespace, actorID, moduleID)
+}
+
+func (d *dualWriteRegistry) ClaimDueReminders(
+	ctx context.Context,
+	now time.Time,
+	limit int,
+) ([]Reminder, error) {
+	return d.src.ClaimDueReminders(ctx, now, limit)
+}
+
+func (d *dualWriteRegistry) Close(ctx context.Context) error {
+	srcErr := d.src.Close(ctx)
+	if err := d.dst.Close(ctx); err != nil {
+		return err
+	}
+	return srcErr
+}
+
+// WatchActivations watches src since it serves the reads.
+func (d *dualWriteRegistry) WatchActivations(
+	ctx context.Context,
+	onActivationChanged func(ActivationChange),
+	onServerRemoved func(serverID string),
+) error {
+	return watchActivations(ctx, d.src, onActivationChanged, onServerRemoved)
+}
+
+func (d *dualWriteRegistry) UnsafeWipeAll() error {
+	if err := d.src.UnsafeWipeAll(); err != nil {
+		return err
+	}
+	return d.dst.UnsafeWipeAll()
+}
+
+// copyActorPlacement copies the placement state of the provided actor from src to dst.
+func (d *dualWriteRegistry) copyActorPlacement(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+) error {
+	placement, ok, err := d.src.GetActorPlacement(ctx, namespace, actorID, moduleID)
+	if err != nil {
+		return fmt.Errorf("dualWriteRegistry: error getting actor: %s(%s): %w", actorID, moduleID, err)
+	}
+	if !ok {
+		return nil
+	}
+	if err := d.dst.PutActorPlacement(ctx, placement); err != nil {
+		return fmt.Errorf("dualWriteRegistry: error copying actor: %s(%s): %w", actorID, moduleID, err)
+	}
+	return nil
+}
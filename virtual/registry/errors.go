@@ -0,0 +1,71 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrModuleNotFound is returned (wrapped) by operations that refer to a module that
+	// has not been registered.
+	ErrModuleNotFound = errors.New("module does not exist")
+	// ErrNoEligibleServers is returned (wrapped) by EnsureActivation() when a new
+	// activation is required but there are no live servers to place it on, or all of
+	// them are at capacity (see HeartbeatState.MaxActivations).
+	ErrNoEligibleServers = errors.New("0 live servers available for new activation")
+	// ErrAllServersBlacklisted is returned (wrapped) by EnsureActivation() when a new
+	// activation is required and there are live servers, but all of them are excluded
+	// from new activations because they're draining or were blacklisted by the caller.
+	ErrAllServersBlacklisted = errors.New("all live servers are excluded from new activations")
+	// ErrRegistryTimeout is returned (wrapped) by operations that did not complete before
+	// their context's deadline. Errors that match it also match context.DeadlineExceeded.
+	ErrRegistryTimeout = errors.New("registry operation timed out")
+	// ErrActivationLeaseExpired is returned (wrapped) by RenewActivationLease() when the
+	// lease can't be renewed because it expired or the actor was activated elsewhere.
+	// The server that held the lease must stop hosting the actor.
+	ErrActivationLeaseExpired = errors.New("activation lease expired")
+	// ErrWatchNotSupported is returned (wrapped) by WatchActivations() when the registry
+	// (or the KV store that backs it) can't watch for changes.
+	ErrWatchNotSupported = errors.New("registry does not support watching activations")
+)
+
+// IsActivationLeaseExpiredErr returns a boolean indicating whether the error is (or
+// wraps) ErrActivationLeaseExpired.
+func IsActivationLeaseExpiredErr(err error) bool {
+	return errors.Is(err, ErrActivationLeaseExpired)
+}
+
+// IsWatchNotSupportedErr returns a boolean indicating whether the error is (or wraps)
+// ErrWatchNotSupported.
+func IsWatchNotSupportedErr(err error) bool {
+	return errors.Is(err, ErrWatchNotSupported)
+}
+
+// WrapTimeoutErr returns err such that it matches ErrRegistryTimeout (in addition to
+// everything it already matches) if it is (or wraps) context.DeadlineExceeded, and err
+// unmodified otherwise. Registry implementations should call it on the errors that are
+// returned by their methods.
+func WrapTimeoutErr(err error) error {
+	if err == nil || !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrRegistryTimeout) {
+		return err
+	}
+	return timeoutErr{err: err}
+}
+
+// timeoutErr matches both ErrRegistryTimeout and the error it wraps.
+type timeoutErr struct {
+	err error
+}
+
+func (e timeoutErr) Error() string {
+	return fmt.Sprintf("%s: %s", ErrRegistryTimeout, e.err)
+}
+
+func (e timeoutErr) Unwrap() error {
+	return e.err
+}
+
+func (e timeoutErr) Is(target error) bool {
+	return target == ErrRegistryTimeout
+}
@@ -0,0 +1,28 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestWrapTimeoutErr ensures that timeouts match ErrRegistryTimeout without losing the
+// errors they wrap, and that other errors are not modified.
+func TestWrapTimeoutErr(t *testing.T) {
+	require.NoError(t, WrapTimeoutErr(nil))
+
+	err := errors.New("some error")
+	require.Equal(t, err, WrapTimeoutErr(err))
+
+	err = WrapTimeoutErr(fmt.Errorf("error getting actor: %w", context.DeadlineExceeded))
+	require.ErrorIs(t, err, ErrRegistryTimeout)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, err, WrapTimeoutErr(err))
+
+	wrapped := fmt.Errorf("EnsureActivation: error: %w", err)
+	require.ErrorIs(t, wrapped, ErrRegistryTimeout)
+	require.ErrorIs(t, wrapped, context.DeadlineExceeded)
+}
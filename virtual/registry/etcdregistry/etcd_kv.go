@@ -0,0 +1,363 @@
+package etcdregistry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/kv"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// maxTransactRetries is the maximum number of times Transact() will retry a
+	// transaction that failed to commit due to a conflict with another transaction.
+	maxTransactRetries = 100
+
+	// serverLeaseTTL is the TTL (in seconds) of the leases that the keys of the servers'
+	// state are attached to, so that servers that stop heartbeating are removed from etcd
+	// once they're considered dead by the registry.
+	serverLeaseTTL = int64(registry.HeartbeatTTL / time.Second)
+)
+
+var (
+	errConflict    = errors.New("etcdKV: transaction conflict")
+	errWatchClosed = errors.New("etcdKV: watch closed")
+)
+
+// serverKeysPrefix is the prefix of the keys that store the state of servers, which are
+// attached to leases.
+var serverKeysPrefix = registry.ServerKeysPrefix()
+
+// etcdKV is an implementation of kv backed by etcd.
+//
+// Every transaction reads from a consistent snapshot of etcd (the revision at which
+// the transaction began) and buffers its writes in memory. On commit, the writes are
+// applied with a single etcd transaction that only succeeds if no other transaction
+// has committed since the snapshot was taken, which is detected by comparing the mod
+// revision of a dedicated "commit" key that every commit also writes. Otherwise the
+// commit fails and Transact() will retry.
+//
+// The commit key also stores the highest versionstamp that was handed out by the
+// transactions that committed, so versionstamps are ordered like the etcd revisions of
+// the commits (see GetVersionStamp).
+//
+// The state of every server (which is written every time the server heartbeats) is
+// attached to an etcd lease that every heartbeat keeps alive, so etcd removes the servers
+// that stop heartbeating, and the watches (see Watch) notify of their removal so the
+// references to their actors can be invalidated.
+type etcdKV struct {
+	client    *clientv3.Client
+	keyPrefix string
+	commitKey string
+
+	// versionStamp ensures that GetVersionStamp() is monotonic within this process.
+	versionStamp struct {
+		sync.Mutex
+		last int64
+	}
+
+	// leases contains the lease of every server key that this process wrote.
+	leases struct {
+		sync.Mutex
+		byKey map[string]clientv3.LeaseID
+	}
+}
+
+func newEtcdKV(client *clientv3.Client, keyPrefix string) kv.Store {
+	e := &etcdKV{
+		client:    client,
+		keyPrefix: keyPrefix + "/data/",
+		commitKey: keyPrefix + "/commit",
+	}
+	e.leases.byKey = make(map[string]clientv3.LeaseID)
+	return e
+}
+
+func (e *etcdKV) BeginTransaction(ctx context.Context) (kv.Transaction, error) {
+	resp, err := e.client.Get(ctx, e.commitKey)
+	if err != nil {
+		return nil, fmt.Errorf("etcdKV: beginTransaction: error getting commit key: %w", err)
+	}
+
+	var (
+		commitModRevision int64
+		committedVS       int64
+	)
+	if len(resp.Kvs) > 0 {
+		commitModRevision = resp.Kvs[0].ModRevision
+		if len(resp.Kvs[0].Value) > 0 {
+			committedVS, err = strconv.ParseInt(string(resp.Kvs[0].Value), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("etcdKV: beginTransaction: error parsing committed versionstamp: %w", err)
+			}
+		}
+	}
+	return &etcdTransaction{
+		kv:                e,
+		revision:          resp.Header.Revision,
+		commitModRevision: commitModRevision,
+		committedVS:       committedVS,
+		versionStamp:      committedVS,
+		writes:            make(map[string][]byte),
+		deletes:           make(map[string]struct{}),
+	}, nil
+}
+
+func (e *etcdKV) Transact(ctx context.Context, fn func(tr kv.Transaction) (any, error)) (any, error) {
+	for i := 0; ; i++ {
+		tr, err := e.BeginTransaction(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := fn(tr)
+		if err != nil {
+			tr.Cancel(ctx)
+			return nil, err
+		}
+
+		err = tr.Commit(ctx)
+		if err == nil {
+			return result, nil
+		}
+		if !errors.Is(err, errConflict) || i >= maxTransactRetries {
+			return nil, err
+		}
+	}
+}
+
+func (e *etcdKV) Close(ctx context.Context) error {
+	return e.client.Close()
+}
+
+// Watch watches the keys with the provided prefix, starting from the current revision.
+func (e *etcdKV) Watch(
+	ctx context.Context,
+	prefix []byte,
+	fn func(key, value []byte, deleted bool),
+) error {
+	ctx, cc := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cc()
+
+	watch := e.client.Watch(ctx, e.keyPrefix+string(prefix), clientv3.WithPrefix())
+	for resp := range watch {
+		if err := resp.Err(); err != nil {
+			return fmt.Errorf("etcdKV: watch error: %w", err)
+		}
+		for _, event := range resp.Events {
+			fn(event.Kv.Key[len(e.keyPrefix):], event.Kv.Value, event.Type == clientv3.EventTypeDelete)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errWatchClosed
+}
+
+// serverLease returns the lease that the server key k must be attached to when it's
+// written. The lease that the previous write of k (by this process) attached it to is
+// kept alive if it didn't expire yet, otherwise a new lease is granted.
+func (e *etcdKV) serverLease(ctx context.Context, k string) (clientv3.LeaseID, error) {
+	e.leases.Lock()
+	id, ok := e.leases.byKey[k]
+	e.leases.Unlock()
+	if ok {
+		if _, err := e.client.KeepAliveOnce(ctx, id); err == nil {
+			return id, nil
+		}
+	}
+
+	resp, err := e.client.Grant(ctx, serverLeaseTTL)
+	if err != nil {
+		return 0, fmt.Errorf("etcdKV: error granting server lease: %w", err)
+	}
+	e.leases.Lock()
+	e.leases.byKey[k] = resp.ID
+	e.leases.Unlock()
+	return resp.ID, nil
+}
+
+func (e *etcdKV) UnsafeWipeAll(ctx context.Context) error {
+	if _, err := e.client.Delete(ctx, e.keyPrefix, clientv3.WithPrefix()); err != nil {
+		return err
+	}
+	_, err := e.client.Delete(ctx, e.commitKey)
+	return err
+}
+
+type etcdTransaction struct {
+	kv                *etcdKV
+	revision          int64
+	commitModRevision int64
+	// committedVS is the highest versionstamp handed out by the transactions that
+	// committed before this one began, and versionStamp is the highest versionstamp
+	// handed out by this transaction (or committedVS if it didn't hand out any).
+	committedVS  int64
+	versionStamp int64
+	writes       map[string][]byte
+	// deletes contains the keys deleted by the transaction. A key is never in both
+	// writes and deletes.
+	deletes map[string]struct{}
+}
+
+func (tr *etcdTransaction) Put(
+	ctx context.Context,
+	k, v []byte,
+) error {
+	// Copy v in case the caller reuses it or mutates it.
+	tr.writes[string(k)] = append([]byte(nil), v...)
+	delete(tr.deletes, string(k))
+	return nil
+}
+
+func (tr *etcdTransaction) Get(
+	ctx context.Context,
+	k []byte,
+) ([]byte, bool, error) {
+	if v, ok := tr.writes[string(k)]; ok {
+		return v, true, nil
+	}
+	if _, ok := tr.deletes[string(k)]; ok {
+		return nil, false, nil
+	}
+
+	resp, err := tr.kv.client.Get(
+		ctx, tr.kv.keyPrefix+string(k), clientv3.WithRev(tr.revision))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, false, nil
+	}
+	return resp.Kvs[0].Value, true, nil
+}
+
+func (tr *etcdTransaction) Delete(
+	ctx context.Context,
+	k []byte,
+) error {
+	delete(tr.writes, string(k))
+	tr.deletes[string(k)] = struct{}{}
+	return nil
+}
+
+func (tr *etcdTransaction) IterPrefix(
+	ctx context.Context,
+	prefix []byte,
+	fn func(k, v []byte) error,
+) error {
+	resp, err := tr.kv.client.Get(
+		ctx, tr.kv.keyPrefix+string(prefix),
+		clientv3.WithPrefix(), clientv3.WithRev(tr.revision))
+	if err != nil {
+		return err
+	}
+
+	// Merge the snapshot with the transaction's own (uncommitted) writes so the
+	// transaction can read its own writes.
+	merged := make(map[string][]byte, len(resp.Kvs))
+	for _, pair := range resp.Kvs {
+		merged[string(pair.Key[len(tr.kv.keyPrefix):])] = pair.Value
+	}
+	for key, v := range tr.writes {
+		if bytes.HasPrefix([]byte(key), prefix) {
+			merged[key] = v
+		}
+	}
+	for key := range tr.deletes {
+		delete(merged, key)
+	}
+
+	sorted := make([]string, 0, len(merged))
+	for key := range merged {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	for _, key := range sorted {
+		if err := fn([]byte(key), merged[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetVersionStamp returns the local time in microseconds, but never less than or equal
+// to the last value it returned, or to the highest versionstamp handed out by the
+// transactions that committed before this one began (which every commit stores in the
+// commit key). etcd revisions are monotonic, but they don't increase at a predictable
+// rate so they can't be compared against the heartbeat TTL the way the registry
+// requires. Instead, versionstamps are a hybrid logical clock that is anchored to the
+// revisions: a transaction's versionstamps are greater than the versionstamps of every
+// transaction that committed at a revision that is lower than the one it reads from, even
+// if they were handed out by a server whose clock is ahead. Note that the clocks of all
+// the servers sharing the registry should still be reasonably synchronized since the
+// heartbeat TTL is measured with them.
+func (tr *etcdTransaction) GetVersionStamp() (int64, error) {
+	vs := &tr.kv.versionStamp
+	vs.Lock()
+	defer vs.Unlock()
+
+	now := time.Now().UnixMicro()
+	if now <= vs.last {
+		now = vs.last + 1
+	}
+	if now <= tr.committedVS {
+		now = tr.committedVS + 1
+	}
+	vs.last = now
+	if now > tr.versionStamp {
+		tr.versionStamp = now
+	}
+	return now, nil
+}
+
+func (tr *etcdTransaction) Commit(ctx context.Context) error {
+	if len(tr.writes) == 0 && len(tr.deletes) == 0 {
+		return nil
+	}
+
+	ops := make([]clientv3.Op, 0, len(tr.deletes)+len(tr.writes)+1)
+	for k := range tr.deletes {
+		ops = append(ops, clientv3.OpDelete(tr.kv.keyPrefix+k))
+	}
+	for k, v := range tr.writes {
+		var opts []clientv3.OpOption
+		if bytes.HasPrefix([]byte(k), serverKeysPrefix) {
+			lease, err := tr.kv.serverLease(ctx, k)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, clientv3.WithLease(lease))
+		}
+		ops = append(ops, clientv3.OpPut(tr.kv.keyPrefix+k, string(v), opts...))
+	}
+	ops = append(ops, clientv3.OpPut(
+		tr.kv.commitKey, strconv.FormatInt(tr.versionStamp, 10)))
+
+	resp, err := tr.kv.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(tr.kv.commitKey), "=", tr.commitModRevision)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("etcdKV: error committing transaction: %w", err)
+	}
+	if !resp.Succeeded {
+		return errConflict
+	}
+	return nil
+}
+
+func (tr *etcdTransaction) Cancel(ctx context.Context) error {
+	tr.writes = nil
+	tr.deletes = nil
+	return nil
+}
@@ -0,0 +1,18 @@
+package etcdregistry
+
+import (
+	"github.com/richardartoul/nola/virtual/registry"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// NewEtcdRegistry creates a new etcd backed registry. All the registry's data is
+// stored under keys that begin with keyPrefix so multiple registries can share the
+// same etcd cluster.
+func NewEtcdRegistry(
+	client *clientv3.Client,
+	keyPrefix string,
+	opts registry.KVRegistryOptions,
+) (registry.Registry, error) {
+	return registry.NewKVRegistry(newEtcdKV(client, keyPrefix), opts)
+}
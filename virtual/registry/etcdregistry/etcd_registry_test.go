@@ -0,0 +1,116 @@
+package etcdregistry
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/kv"
+
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestEtcdRegistry(t *testing.T) {
+	if os.Getenv("ETCD_ENDPOINTS") == "" {
+		t.Skip("ETCD_ENDPOINTS not set, skipping etcd registry tests")
+	}
+
+	registry.TestAllCommon(t, func() registry.Registry {
+		client := newTestClient(t)
+		registry, err := NewEtcdRegistry(client, "nola-test", registry.KVRegistryOptions{})
+		require.NoError(t, err)
+		require.NoError(t, registry.UnsafeWipeAll())
+		return registry
+	})
+}
+
+// TestEtcdKVWatchAndLeases ensures that the keys of the servers' state are attached to
+// leases, that watches notify of the writes and deletes of keys, and that versionstamps
+// increase across commits.
+func TestEtcdKVWatchAndLeases(t *testing.T) {
+	var (
+		client = newTestClient(t)
+		store  = newEtcdKV(client, "nola-test-watch").(*etcdKV)
+		ctx    = context.Background()
+	)
+	require.NoError(t, store.UnsafeWipeAll(ctx))
+
+	type event struct {
+		key     string
+		deleted bool
+	}
+	var (
+		events       = make(chan event, 16)
+		watchCtx, cc = context.WithCancel(ctx)
+		watchErr     = make(chan error, 1)
+	)
+	defer cc()
+	go func() {
+		watchErr <- store.Watch(watchCtx, nil, func(key, value []byte, deleted bool) {
+			events <- event{key: string(key), deleted: deleted}
+		})
+	}()
+	// Give the watch time to be established, since it starts at the current revision.
+	time.Sleep(100 * time.Millisecond)
+
+	var (
+		serverKey = append(append([]byte(nil), serverKeysPrefix...), "server1"...)
+		lastVS    int64
+	)
+	for i := 0; i < 2; i++ {
+		_, err := store.Transact(ctx, func(tr kv.Transaction) (any, error) {
+			vs, err := tr.GetVersionStamp()
+			require.NoError(t, err)
+			require.Greater(t, vs, lastVS)
+			lastVS = vs
+			return nil, tr.Put(ctx, serverKey, []byte("state"))
+		})
+		require.NoError(t, err)
+	}
+
+	resp, err := client.Get(ctx, store.keyPrefix+string(serverKey))
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	require.NotZero(t, resp.Kvs[0].Lease)
+	// Heartbeats keep the same lease alive instead of granting new ones.
+	require.Equal(t, store.leases.byKey[string(serverKey)], clientv3.LeaseID(resp.Kvs[0].Lease))
+
+	_, err = store.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		return nil, tr.Delete(ctx, serverKey)
+	})
+	require.NoError(t, err)
+
+	for _, expected := range []event{
+		{key: string(serverKey)},
+		{key: string(serverKey)},
+		{key: string(serverKey), deleted: true},
+	} {
+		select {
+		case e := <-events:
+			require.Equal(t, expected, e)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for watch event")
+		}
+	}
+
+	cc()
+	require.ErrorIs(t, <-watchErr, context.Canceled)
+}
+
+func newTestClient(t *testing.T) *clientv3.Client {
+	endpoints := os.Getenv("ETCD_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("ETCD_ENDPOINTS not set, skipping etcd registry tests")
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(endpoints, ","),
+		DialTimeout: 5 * time.Second,
+	})
+	require.NoError(t, err)
+	return client
+}
@@ -2,9 +2,11 @@ package fdbregistry
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 
 	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/wapcutils"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
 )
@@ -31,7 +33,7 @@ func (f *fdbKV) BeginTransaction(ctx context.Context) (kv.Transaction, error) {
 	return &fdbTransaction{tr: tr}, nil
 }
 
-func (f *fdbKV) Transact(fn func(tr kv.Transaction) (any, error)) (any, error) {
+func (f *fdbKV) Transact(ctx context.Context, fn func(tr kv.Transaction) (any, error)) (any, error) {
 	return f.db.Transact(func(tr fdb.Transaction) (any, error) {
 		return fn(&fdbTransaction{tr})
 	})
@@ -43,7 +45,7 @@ func (f *fdbKV) Close(ctx context.Context) error {
 	return nil
 }
 
-func (f *fdbKV) UnsafeWipeAll() error {
+func (f *fdbKV) UnsafeWipeAll(ctx context.Context) error {
 	_, err := f.db.Transact(func(tr fdb.Transaction) (any, error) {
 		tr.ClearRange(fdb.KeyRange{Begin: fdb.Key{0x00}, End: fdb.Key{0xFF}})
 		return nil, nil
@@ -79,6 +81,34 @@ func (tr *fdbTransaction) Get(
 	return v, true, nil
 }
 
+func (tr *fdbTransaction) Delete(
+	ctx context.Context,
+	k []byte,
+) error {
+	tr.tr.Clear(fdb.Key(k))
+	return nil
+}
+
+// Incr increments the counter with FoundationDB's atomic add mutation, which stores
+// counters in the format that kv.IncrTransaction requires. Reading the new value back
+// makes the transaction conflict with concurrent increments like a regular read would,
+// but the increment itself is applied by the storage servers.
+func (tr *fdbTransaction) Incr(
+	ctx context.Context,
+	k []byte,
+	delta int64,
+) (int64, error) {
+	var param [8]byte
+	binary.LittleEndian.PutUint64(param[:], uint64(delta))
+	tr.tr.Add(fdb.Key(k), param[:])
+
+	v, err := tr.tr.Get(fdb.Key(k)).Get()
+	if err != nil {
+		return 0, err
+	}
+	return wapcutils.DecodeCounter(v)
+}
+
 func (tr *fdbTransaction) IterPrefix(
 	ctx context.Context,
 	prefix []byte,
@@ -4,9 +4,18 @@ import "github.com/richardartoul/nola/virtual/registry"
 
 // NewFoundationDBRegistry creates a new FoundationDB backed registry.
 func NewFoundationDBRegistry(clusterFile string) (registry.Registry, error) {
+	return NewFoundationDBRegistryWithOptions(clusterFile, registry.KVRegistryOptions{})
+}
+
+// NewFoundationDBRegistryWithOptions is the same as NewFoundationDBRegistry, except it
+// allows the registry's options to be configured.
+func NewFoundationDBRegistryWithOptions(
+	clusterFile string,
+	opts registry.KVRegistryOptions,
+) (registry.Registry, error) {
 	fdbKV, err := newFDBKV(clusterFile)
 	if err != nil {
 		return nil, err
 	}
-	return registry.NewKVRegistry(fdbKV), nil
+	return registry.NewKVRegistry(fdbKV, opts)
 }
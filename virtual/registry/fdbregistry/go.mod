@@ -1,6 +1,6 @@
 module github.com/richardartoul/nola/virtual/registry/fdbregistry
 
-go 1.19
+go 1.21
 
 replace github.com/richardartoul/nola => ../../../
 
@@ -0,0 +1,282 @@
+package k8sregistry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	inClusterTokenFile     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile        = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	inClusterNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	// ServiceNameLabel is the label that Kubernetes sets on the EndpointSlices of a
+	// Service to the name of the Service.
+	ServiceNameLabel = "kubernetes.io/service-name"
+)
+
+// APIServerWatcherOptions contains the options for the EndpointsWatcher that is backed by
+// the Kubernetes API server.
+type APIServerWatcherOptions struct {
+	// Host is the base URL of the Kubernetes API server.
+	//
+	// An empty value will be replaced with the in-cluster address of the API server, as
+	// advertised by the KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT environment
+	// variables.
+	Host string
+	// Namespace is the namespace of the Service whose endpoints are watched.
+	//
+	// An empty value will be replaced with the namespace of the pod's service account.
+	Namespace string
+	// LabelSelector selects the EndpointSlices that are watched, for example
+	// "kubernetes.io/service-name=nola" (see ServiceNameLabel) to watch the endpoints of
+	// the headless Service named nola.
+	LabelSelector string
+	// TokenFile is the file that contains the bearer token that requests are
+	// authenticated with. It's read again before every request so that rotated tokens are
+	// picked up. Requests are not authenticated if the file does not exist.
+	//
+	// An empty value will be replaced with the token file of the pod's service account.
+	TokenFile string
+	// Client is the HTTP client that is used to make requests to the API server. The
+	// client must not have a timeout since watches are long-lived.
+	//
+	// A nil value will be replaced with a client that trusts the CA of the pod's service
+	// account.
+	Client *http.Client
+}
+
+func (o *APIServerWatcherOptions) Validate() error {
+	if o.LabelSelector == "" {
+		return errors.New("LabelSelector must be set")
+	}
+	if o.Host == "" {
+		return errors.New("Host must be set when not running in a Kubernetes cluster")
+	}
+	if o.Namespace == "" {
+		return errors.New("Namespace must be set when not running in a Kubernetes cluster")
+	}
+	return nil
+}
+
+type apiServerWatcher struct {
+	opts APIServerWatcherOptions
+}
+
+// NewAPIServerWatcher creates a new EndpointsWatcher that lists and watches the
+// discovery.k8s.io/v1 EndpointSlices that match opts.LabelSelector through the
+// Kubernetes API server. The service account of the pod must be allowed to list and watch
+// EndpointSlices in opts.Namespace.
+func NewAPIServerWatcher(opts APIServerWatcherOptions) (EndpointsWatcher, error) {
+	if opts.Host == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host != "" && port != "" {
+			opts.Host = "https://" + net.JoinHostPort(host, port)
+		}
+	}
+	if opts.Namespace == "" {
+		namespace, err := os.ReadFile(inClusterNamespaceFile)
+		if err == nil {
+			opts.Namespace = strings.TrimSpace(string(namespace))
+		}
+	}
+	if opts.TokenFile == "" {
+		opts.TokenFile = inClusterTokenFile
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("NewAPIServerWatcher: error validating options: %w", err)
+	}
+	if opts.Client == nil {
+		client, err := newInClusterClient()
+		if err != nil {
+			return nil, fmt.Errorf("NewAPIServerWatcher: %w", err)
+		}
+		opts.Client = client
+	}
+
+	return &apiServerWatcher{opts: opts}, nil
+}
+
+func newInClusterClient() (*http.Client, error) {
+	ca, err := os.ReadFile(inClusterCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA of the service account: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("error parsing CA of the service account")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
+
+type objectMeta struct {
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type listMeta struct {
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type endpointSliceList struct {
+	Metadata listMeta        `json:"metadata"`
+	Items    []endpointSlice `json:"items"`
+}
+
+type endpointSlice struct {
+	Metadata    objectMeta `json:"metadata"`
+	AddressType string     `json:"addressType"`
+	Endpoints   []endpoint `json:"endpoints"`
+}
+
+type endpoint struct {
+	Addresses  []string           `json:"addresses"`
+	Conditions endpointConditions `json:"conditions"`
+}
+
+type endpointConditions struct {
+	// Ready is nil if the readiness of the endpoint is unknown, which should be
+	// interpreted as ready.
+	Ready *bool `json:"ready"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type status struct {
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Code    int    `json:"code"`
+}
+
+// Watch lists the EndpointSlices and then watches them from the resource version of the
+// list, so every time it's restarted it begins with a consistent snapshot.
+func (w *apiServerWatcher) Watch(ctx context.Context, onChange func(Endpoints)) error {
+	resp, err := w.get(ctx, url.Values{"labelSelector": {w.opts.LabelSelector}})
+	if err != nil {
+		return fmt.Errorf("error listing EndpointSlices: %w", err)
+	}
+	var list endpointSliceList
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error decoding EndpointSlices: %w", err)
+	}
+
+	slices := make(map[string]endpointSlice, len(list.Items))
+	for _, slice := range list.Items {
+		slices[slice.Metadata.Name] = slice
+	}
+	onChange(newEndpoints(slices, list.Metadata.ResourceVersion))
+
+	resp, err = w.get(ctx, url.Values{
+		"labelSelector":   {w.opts.LabelSelector},
+		"watch":           {"true"},
+		"resourceVersion": {list.Metadata.ResourceVersion},
+	})
+	if err != nil {
+		return fmt.Errorf("error watching EndpointSlices: %w", err)
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event watchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				// The API server closes watches periodically.
+				return nil
+			}
+			return fmt.Errorf("error decoding EndpointSlice watch event: %w", err)
+		}
+
+		if event.Type == "ERROR" {
+			// The resource version is too old (410 Gone) or the watch failed otherwise,
+			// either way it has to be listed again.
+			var s status
+			json.Unmarshal(event.Object, &s)
+			return fmt.Errorf(
+				"EndpointSlice watch failed, code: %d, reason: %s, message: %s",
+				s.Code, s.Reason, s.Message)
+		}
+
+		var slice endpointSlice
+		if err := json.Unmarshal(event.Object, &slice); err != nil {
+			return fmt.Errorf("error decoding EndpointSlice: %w", err)
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			slices[slice.Metadata.Name] = slice
+		case "DELETED":
+			delete(slices, slice.Metadata.Name)
+		default:
+			// BOOKMARK events and any events that are added in the future don't change
+			// the endpoints.
+			continue
+		}
+		onChange(newEndpoints(slices, slice.Metadata.ResourceVersion))
+	}
+}
+
+func (w *apiServerWatcher) get(ctx context.Context, query url.Values) (*http.Response, error) {
+	u := fmt.Sprintf(
+		"%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s",
+		strings.TrimSuffix(w.opts.Host, "/"), url.PathEscape(w.opts.Namespace), query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	token, err := os.ReadFile(w.opts.TokenFile)
+	if err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading token: %w", err)
+	}
+
+	resp, err := w.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("API server returned status: %d, body: %s", resp.StatusCode, body)
+	}
+	return resp, nil
+}
+
+// newEndpoints returns the IPs of the ready endpoints in slices.
+func newEndpoints(slices map[string]endpointSlice, resourceVersion string) Endpoints {
+	endpoints := Endpoints{IPs: []string{}, ResourceVersion: resourceVersion}
+	for _, slice := range slices {
+		if slice.AddressType != "IPv4" && slice.AddressType != "IPv6" {
+			// FQDN endpoints are not pods.
+			continue
+		}
+		for _, e := range slice.Endpoints {
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+			endpoints.IPs = append(endpoints.IPs, e.Addresses...)
+		}
+	}
+	sort.Strings(endpoints.IPs)
+	return endpoints
+}
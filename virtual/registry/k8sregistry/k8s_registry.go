@@ -0,0 +1,461 @@
+package k8sregistry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/dnsregistry"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const (
+	K8sServerID          = "K8S_SERVER_ID"
+	K8sServerVersion     = int64(-1)
+	K8S_ACTOR_GENERATION = 1
+	// K8sVersionStamp is the versionstamp that the registry starts with if the resource
+	// version of the endpoints is not numeric. Must be at least 1 because <= 0 is not a
+	// legal versionstamp.
+	K8sVersionStamp = 1
+
+	// k8sHeartbeatTTL is the TTL returned by Heartbeat(). Versionstamps returned by the
+	// K8s registry are derived from the resource version of the endpoints instead of
+	// measuring time, so heartbeats must never be considered expired no matter how much
+	// the versionstamp advanced since the last one.
+	k8sHeartbeatTTL = math.MaxInt32
+)
+
+// Endpoints is a snapshot of the pods that back the NOLA servers.
+type Endpoints struct {
+	// IPs contains the IPs of the pods that are ready to serve traffic.
+	IPs []string
+	// ResourceVersion is the Kubernetes resource version of the snapshot. It's opaque to
+	// Kubernetes clients, but in practice it's the (numeric) revision of the API server's
+	// storage so the registry uses it as its versionstamp when it can be parsed.
+	ResourceVersion string
+}
+
+// EndpointsWatcher is the interface that must be implemented by a watcher in order to
+// discover the pods that back the NOLA servers.
+type EndpointsWatcher interface {
+	// Watch calls onChange with the current endpoints and then again every time they
+	// change, until ctx is canceled or the watch ends. It returns nil if the watch ended
+	// normally (for example because the API server closed it), in which case it's
+	// restarted immediately, and the error that ended it otherwise.
+	Watch(ctx context.Context, onChange func(Endpoints)) error
+}
+
+type k8sRegistry struct {
+	sync.RWMutex
+
+	// Dependencies.
+	watcher EndpointsWatcher
+	port    int
+	opts    K8sRegistryOptions
+
+	// State.
+	addrs        []string
+	hashRing     *dnsregistry.HashRing
+	versionStamp int64
+	syncedCh     chan struct{}
+	synced       bool
+
+	// Shutdown logic.
+	closeCh  chan struct{}
+	closedCh chan struct{}
+}
+
+// K8sRegistryOptions contains the options for the K8s registry implementation.
+type K8sRegistryOptions struct {
+	// RetryEvery controls how long the registry waits before watching the endpoints again
+	// after the watch fails. The registry keeps placing actors according to the endpoints
+	// that it last observed in the meantime.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 1 second.
+	RetryEvery time.Duration
+}
+
+// NewK8sRegistry creates a new registry.Registry that discovers the NOLA servers by
+// watching the endpoints of a (headless) Kubernetes Service with watcher, and that
+// places actors on them by consistent hashing, the same way as the DNS registry. Every
+// server must listen on port.
+//
+// It blocks until the endpoints have been observed once, and fails if the first attempt
+// to watch them fails.
+func NewK8sRegistry(
+	watcher EndpointsWatcher,
+	port int,
+	opts K8sRegistryOptions,
+) (registry.Registry, error) {
+	if opts.RetryEvery == 0 {
+		opts.RetryEvery = time.Second
+	}
+
+	k := &k8sRegistry{
+		watcher: watcher,
+		port:    port,
+		opts:    opts,
+
+		hashRing:     dnsregistry.NewHashRing(64, crc32.ChecksumIEEE),
+		versionStamp: K8sVersionStamp,
+		syncedCh:     make(chan struct{}),
+
+		closeCh:  make(chan struct{}),
+		closedCh: make(chan struct{}),
+	}
+
+	firstErrCh := make(chan error, 1)
+	go k.watchLoop(firstErrCh)
+	select {
+	case <-k.syncedCh:
+		return k, nil
+	case err := <-firstErrCh:
+		close(k.closeCh)
+		<-k.closedCh
+		return nil, fmt.Errorf("NewK8sRegistry: error watching endpoints: %w", err)
+	}
+}
+
+func (k *k8sRegistry) RegisterModule(
+	ctx context.Context,
+	namespace,
+	moduleID string,
+	moduleBytes []byte,
+	opts registry.ModuleOptions,
+) (registry.RegisterModuleResult, error) {
+	return registry.RegisterModuleResult{}, nil
+}
+
+// GetModule gets the bytes and options associated with the provided module.
+func (k *k8sRegistry) GetModule(
+	ctx context.Context,
+	namespace,
+	moduleID string,
+) ([]byte, registry.ModuleOptions, error) {
+	return nil, registry.ModuleOptions{}, nil
+}
+
+func (k *k8sRegistry) CreateActor(
+	ctx context.Context,
+	namespace,
+	actorID,
+	moduleID string,
+	opts types.ActorOptions,
+) (registry.CreateActorResult, error) {
+	return registry.CreateActorResult{}, nil
+}
+
+func (k *k8sRegistry) IncGeneration(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+) error {
+	return errors.New("K8sRegistry: IncGeneration: not implemented")
+}
+
+// EnsureActivation picks a pod for the actor by consistent hashing over the pods that
+// are ready. opts.BlacklistedServerIDs is ignored because every reference returned by
+// the K8s registry has the same server ID (K8sServerID). If opts.AffinityKey is set it is
+// hashed instead of the actor's identity so that actors that share it are placed on the
+// same pod. opts.AntiAffinityGroup is ignored because the K8s registry doesn't keep track
+// of placements.
+func (k *k8sRegistry) EnsureActivation(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+	opts registry.EnsureActivationOptions,
+) ([]types.ActorReference, error) {
+	k.RLock()
+	ring := k.hashRing
+	k.RUnlock()
+
+	if ring.IsEmpty() {
+		return nil, fmt.Errorf("EnsureActivation: hashring is empty: %w", registry.ErrNoEligibleServers)
+	}
+
+	hashKey := fmt.Sprintf("%s::%s", actorID, moduleID)
+	if opts.AffinityKey != "" {
+		hashKey = fmt.Sprintf("%s::affinity::%s", namespace, opts.AffinityKey)
+	}
+	addr := ring.Get(hashKey)
+	ref, err := types.NewActorReference(
+		K8sServerID, K8sServerVersion, addr, namespace,
+		moduleID, actorID, K8S_ACTOR_GENERATION)
+	if err != nil {
+		return nil, fmt.Errorf("error creating actor reference: %w", err)
+	}
+
+	return []types.ActorReference{ref}, nil
+}
+
+// BulkEnsureActivation calls EnsureActivation for each actor since it only consults the
+// hash ring, so there are no round-trips to batch.
+func (k *k8sRegistry) BulkEnsureActivation(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorIDs []string,
+	opts registry.EnsureActivationOptions,
+) ([]registry.EnsureActivationResult, error) {
+	return registry.BulkEnsureActivationSequential(ctx, k, namespace, moduleID, actorIDs, opts)
+}
+
+// LookupActivation is the same as EnsureActivation since the K8s registry doesn't keep
+// track of activations: actors are always placed on the pod that they hash to.
+func (k *k8sRegistry) LookupActivation(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+) ([]types.ActorReference, error) {
+	return k.EnsureActivation(ctx, namespace, actorID, moduleID, registry.EnsureActivationOptions{})
+}
+
+// GetVersionStamp returns a versionstamp that only changes when the set of ready pods
+// (and therefore the placement of actors) changes, so that callers can tell whether
+// references they resolved previously could still be stale.
+func (k *k8sRegistry) GetVersionStamp(
+	ctx context.Context,
+) (int64, error) {
+	k.RLock()
+	defer k.RUnlock()
+	return k.versionStamp, nil
+}
+
+func (k *k8sRegistry) BeginTransaction(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	serverID string,
+	serverVersion int64,
+) (_ registry.ActorKVTransaction, err error) {
+	return nil, errors.New("K8sRegistry: BeginTransaction: not implemented")
+}
+
+func (k *k8sRegistry) PutInstantiatePayload(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	payload []byte,
+) error {
+	return errors.New("K8sRegistry: PutInstantiatePayload: not implemented")
+}
+
+func (k *k8sRegistry) GetInstantiatePayload(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+) ([]byte, bool, error) {
+	// Payloads can't be persisted so there are never any.
+	return nil, false, nil
+}
+
+// Heartbeat is a no-op since the servers are discovered through Kubernetes. If
+// heartbeatState.IncludeLiveServers is set, the pods that are ready are listed as the live
+// servers, identified by their address.
+func (k *k8sRegistry) Heartbeat(
+	ctx context.Context,
+	serverID string,
+	heartbeatState registry.HeartbeatState,
+) (registry.HeartbeatResult, error) {
+	k.RLock()
+	defer k.RUnlock()
+
+	result := registry.HeartbeatResult{
+		VersionStamp:  k.versionStamp,
+		HeartbeatTTL:  k8sHeartbeatTTL,
+		ServerVersion: K8sServerVersion,
+	}
+	if heartbeatState.IncludeLiveServers {
+		result.LiveServers = make([]registry.LiveServer, 0, len(k.addrs))
+		for _, addr := range k.addrs {
+			result.LiveServers = append(result.LiveServers, registry.LiveServer{
+				ServerID: addr,
+				Address:  addr,
+			})
+		}
+	}
+	return result, nil
+}
+
+func (k *k8sRegistry) RegisterReminder(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	name string,
+	dueTime time.Time,
+	period time.Duration,
+) error {
+	return errors.New("K8sRegistry: RegisterReminder: not implemented")
+}
+
+func (k *k8sRegistry) UnregisterReminder(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	name string,
+) error {
+	return errors.New("K8sRegistry: UnregisterReminder: not implemented")
+}
+
+func (k *k8sRegistry) ListReminders(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+) ([]registry.Reminder, error) {
+	return nil, errors.New("K8sRegistry: ListReminders: not implemented")
+}
+
+func (k *k8sRegistry) ClaimDueReminders(
+	ctx context.Context,
+	now time.Time,
+	limit int,
+) ([]registry.Reminder, error) {
+	// Reminders can't be registered so there are never any due.
+	return nil, nil
+}
+
+func (k *k8sRegistry) RenewActivationLease(
+	ctx context.Context,
+	token string,
+) (types.ActivationLease, error) {
+	// Leases are never granted since actor placement is determined by consistent hashing.
+	return types.ActivationLease{}, errors.New("K8sRegistry: RenewActivationLease: not implemented")
+}
+
+func (k *k8sRegistry) Close(ctx context.Context) error {
+	log.Printf("K8sRegistry: Shutting down")
+	close(k.closeCh)
+	<-k.closedCh
+	log.Printf("K8sRegistry: Done shutting down")
+	return nil
+}
+
+func (k *k8sRegistry) UnsafeWipeAll() error {
+	return nil
+}
+
+// update rebuilds the hash ring from endpoints if the set of ready pods changed.
+func (k *k8sRegistry) update(endpoints Endpoints) {
+	addrs := make([]string, 0, len(endpoints.IPs))
+	seen := make(map[string]struct{}, len(endpoints.IPs))
+	for _, ip := range endpoints.IPs {
+		addr := net.JoinHostPort(ip, strconv.Itoa(k.port))
+		if _, ok := seen[addr]; ok {
+			continue
+		}
+		seen[addr] = struct{}{}
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	k.Lock()
+	defer k.Unlock()
+	if k.synced && equalAddrs(k.addrs, addrs) {
+		return
+	}
+
+	// crc32.ChecksumIEEE to place actors the same way as the DNS registry.
+	hashRing := dnsregistry.NewHashRing(64, crc32.ChecksumIEEE)
+	hashRing.Add(addrs...)
+	prevAddrs := k.addrs
+	k.addrs = addrs
+	k.hashRing = hashRing
+	k.versionStamp = nextVersionStamp(k.versionStamp, endpoints.ResourceVersion, !k.synced)
+	if !k.synced {
+		k.synced = true
+		close(k.syncedCh)
+		return
+	}
+	log.Printf(
+		"K8sRegistry: discovered new pod addresses: prev: %v, curr: %v, versionStamp: %d\n",
+		prevAddrs, addrs, k.versionStamp)
+}
+
+// nextVersionStamp returns the versionstamp after a change of the endpoints to
+// resourceVersion. Versionstamps must never go backwards, so the resource version is only
+// used if it's numeric and larger than prev, otherwise prev is incremented (unless it's
+// the first change, which doesn't need to invalidate anything).
+func nextVersionStamp(prev int64, resourceVersion string, first bool) int64 {
+	parsed, err := strconv.ParseInt(resourceVersion, 10, 64)
+	if err == nil && parsed > prev {
+		return parsed
+	}
+	if first {
+		return prev
+	}
+	return prev + 1
+}
+
+func equalAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// watchLoop watches the endpoints until the registry is closed, restarting the watch
+// whenever it ends. Errors that happen before the endpoints have been observed once are
+// sent to firstErrCh (if it's not full) so that the constructor can fail.
+func (k *k8sRegistry) watchLoop(firstErrCh chan<- error) {
+	defer close(k.closedCh)
+
+	ctx, cc := context.WithCancel(context.Background())
+	defer cc()
+	go func() {
+		select {
+		case <-k.closeCh:
+			cc()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		err := k.watcher.Watch(ctx, k.update)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			continue
+		}
+
+		k.RLock()
+		synced := k.synced
+		k.RUnlock()
+		if !synced {
+			select {
+			case firstErrCh <- err:
+			default:
+			}
+		}
+		log.Printf("watchLoop: error watching endpoints: %v\n", err)
+
+		select {
+		case <-time.After(k.opts.RetryEvery):
+		case <-k.closeCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package k8sregistry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/stretchr/testify/require"
+)
+
+// TestK8sRegistry tests that the K8s registry places actors by consistent hashing over
+// the watched endpoints and that its versionstamp follows the resource version of the
+// endpoints, but only when the set of ready pods changes.
+func TestK8sRegistry(t *testing.T) {
+	ctx := context.Background()
+	watcher := newFakeWatcher()
+	watcher.send(Endpoints{ResourceVersion: "10"})
+	reg, err := NewK8sRegistry(watcher, 9090, K8sRegistryOptions{})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, reg.Close(ctx))
+	}()
+
+	_, err = reg.EnsureActivation(ctx, "ns1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.True(t, errors.Is(err, registry.ErrNoEligibleServers))
+	versionStamp, err := reg.GetVersionStamp(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), versionStamp)
+
+	watcher.send(Endpoints{IPs: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, ResourceVersion: "15"})
+	require.Eventually(t, func() bool {
+		versionStamp, err := reg.GetVersionStamp(ctx)
+		require.NoError(t, err)
+		return versionStamp == 15
+	}, 5*time.Second, time.Millisecond)
+	refs, err := reg.EnsureActivation(ctx, "ns1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Len(t, refs, 1)
+	require.Equal(t, "a", refs[0].ActorID().ID)
+	require.Equal(t, K8sServerID, refs[0].ServerID())
+	require.Equal(t, K8sServerVersion, refs[0].ServerVersion())
+	require.Contains(t, []string{"10.0.0.1:9090", "10.0.0.2:9090", "10.0.0.3:9090"}, refs[0].Address())
+
+	// Placement is deterministic.
+	for i := 0; i < 10; i++ {
+		again, err := reg.EnsureActivation(ctx, "ns1", "a", "test-module", registry.EnsureActivationOptions{})
+		require.NoError(t, err)
+		require.Equal(t, refs[0].Address(), again[0].Address())
+	}
+
+	heartbeat, err := reg.Heartbeat(ctx, "server1", registry.HeartbeatState{IncludeLiveServers: true})
+	require.NoError(t, err)
+	require.Equal(t, int64(15), heartbeat.VersionStamp)
+	require.Equal(t, []registry.LiveServer{
+		{ServerID: "10.0.0.1:9090", Address: "10.0.0.1:9090"},
+		{ServerID: "10.0.0.2:9090", Address: "10.0.0.2:9090"},
+		{ServerID: "10.0.0.3:9090", Address: "10.0.0.3:9090"},
+	}, heartbeat.LiveServers)
+
+	// Changes that don't change the set of ready pods don't change the versionstamp,
+	// and non-numeric resource versions still advance it.
+	watcher.send(Endpoints{IPs: []string{"10.0.0.3", "10.0.0.2", "10.0.0.1"}, ResourceVersion: "20"})
+	watcher.send(Endpoints{IPs: []string{"10.0.0.1"}, ResourceVersion: "opaque"})
+	require.Eventually(t, func() bool {
+		versionStamp, err := reg.GetVersionStamp(ctx)
+		require.NoError(t, err)
+		return versionStamp == 16
+	}, 5*time.Second, time.Millisecond)
+	refs, err = reg.EnsureActivation(ctx, "ns1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1:9090", refs[0].Address())
+
+	// Watches are restarted when they fail.
+	watcher.fail(errors.New("some fake error"))
+	watcher.send(Endpoints{IPs: []string{"10.0.0.4"}, ResourceVersion: "30"})
+	require.Eventually(t, func() bool {
+		versionStamp, err := reg.GetVersionStamp(ctx)
+		require.NoError(t, err)
+		return versionStamp == 30
+	}, 5*time.Second, time.Millisecond)
+}
+
+// TestK8sRegistryInitialWatchError tests that the registry can't be created if the first
+// attempt to watch the endpoints fails.
+func TestK8sRegistryInitialWatchError(t *testing.T) {
+	watcher := newFakeWatcher()
+	watcher.fail(errors.New("forbidden"))
+	_, err := NewK8sRegistry(watcher, 9090, K8sRegistryOptions{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "forbidden")
+}
+
+// TestAPIServerWatcher tests that the API server watcher lists the EndpointSlices, applies
+// the events of the watch that follows, and ignores endpoints that are not ready.
+func TestAPIServerWatcher(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret\n"), 0o600))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices", r.URL.Path)
+		require.Equal(t, "kubernetes.io/service-name=nola", r.URL.Query().Get("labelSelector"))
+		require.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+
+		if r.URL.Query().Get("watch") != "true" {
+			fmt.Fprint(w, `{"metadata":{"resourceVersion":"100"},"items":[
+				{"metadata":{"name":"nola-a","resourceVersion":"90"},"addressType":"IPv4",
+				 "endpoints":[{"addresses":["10.0.0.1"],"conditions":{"ready":true}},
+				              {"addresses":["10.0.0.2"],"conditions":{}}]},
+				{"metadata":{"name":"nola-b","resourceVersion":"95"},"addressType":"IPv4",
+				 "endpoints":[{"addresses":["10.0.0.3"],"conditions":{"ready":false}}]}]}`)
+			return
+		}
+
+		require.Equal(t, "100", r.URL.Query().Get("resourceVersion"))
+		fmt.Fprint(w, `{"type":"MODIFIED","object":{"metadata":{"name":"nola-b","resourceVersion":"101"},
+			"addressType":"IPv4","endpoints":[{"addresses":["10.0.0.3"],"conditions":{"ready":true}}]}}`)
+		fmt.Fprint(w, `{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"102"}}}`)
+		fmt.Fprint(w, `{"type":"DELETED","object":{"metadata":{"name":"nola-a","resourceVersion":"103"},
+			"addressType":"IPv4"}}`)
+	}))
+	defer server.Close()
+
+	watcher, err := NewAPIServerWatcher(APIServerWatcherOptions{
+		Host:          server.URL,
+		Namespace:     "default",
+		LabelSelector: ServiceNameLabel + "=nola",
+		TokenFile:     tokenFile,
+		Client:        server.Client(),
+	})
+	require.NoError(t, err)
+
+	var observed []Endpoints
+	require.NoError(t, watcher.Watch(context.Background(), func(endpoints Endpoints) {
+		observed = append(observed, endpoints)
+	}))
+	require.Equal(t, []Endpoints{
+		{IPs: []string{"10.0.0.1", "10.0.0.2"}, ResourceVersion: "100"},
+		{IPs: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, ResourceVersion: "101"},
+		{IPs: []string{"10.0.0.3"}, ResourceVersion: "103"},
+	}, observed)
+
+	_, err = NewAPIServerWatcher(APIServerWatcherOptions{
+		Host: server.URL, Namespace: "default", Client: server.Client()})
+	require.Error(t, err)
+}
+
+// fakeWatcher is an EndpointsWatcher whose endpoints and failures are controlled by the
+// test.
+type fakeWatcher struct {
+	eventsCh chan any
+}
+
+func newFakeWatcher() *fakeWatcher {
+	return &fakeWatcher{eventsCh: make(chan any, 10)}
+}
+
+func (f *fakeWatcher) send(endpoints Endpoints) {
+	f.eventsCh <- endpoints
+}
+
+func (f *fakeWatcher) fail(err error) {
+	f.eventsCh <- err
+}
+
+func (f *fakeWatcher) Watch(ctx context.Context, onChange func(Endpoints)) error {
+	for {
+		select {
+		case event := <-f.eventsCh:
+			switch event := event.(type) {
+			case Endpoints:
+				onChange(event)
+			case error:
+				return event
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -8,14 +8,15 @@ import "context"
 // KV backends.
 type Store interface {
 	BeginTransaction(ctx context.Context) (Transaction, error)
-	Transact(func(Transaction) (any, error)) (any, error)
+	Transact(ctx context.Context, fn func(Transaction) (any, error)) (any, error)
 	Close(ctx context.Context) error
-	UnsafeWipeAll() error
+	UnsafeWipeAll(ctx context.Context) error
 }
 
 type Transaction interface {
 	Put(ctx context.Context, key []byte, value []byte) error
 	Get(ctx context.Context, key []byte) ([]byte, bool, error)
+	Delete(ctx context.Context, key []byte) error
 	IterPrefix(ctx context.Context, prefix []byte, fn func(k, v []byte) error) error
 	// Monotonically increase number that should increase at a rate of ~ 1 million
 	// per second.
@@ -23,3 +24,28 @@ type Transaction interface {
 	Commit(ctx context.Context) error
 	Cancel(ctx context.Context) error
 }
+
+// IncrTransaction is implemented by the Transactions of stores that can increment
+// counters natively. The registry uses the native increments to implement
+// ActorKVTransaction.Incr (in the registry package) if they're available, otherwise it
+// emulates them with a read and a write in the transaction.
+type IncrTransaction interface {
+	Transaction
+
+	// Incr adds delta to the counter at the provided key as part of the transaction and
+	// returns its new value. A missing key is a counter with a value of 0. Counters must
+	// be stored as 8 byte little endian two's complement integers (see
+	// wapcutils.EncodeCounter) that wrap around on overflow.
+	Incr(ctx context.Context, key []byte, delta int64) (int64, error)
+}
+
+// WatchableStore is implemented by stores that can notify of changes to their keys. The
+// registry uses it to implement ActivationWatcher (in the registry package).
+type WatchableStore interface {
+	Store
+
+	// Watch calls fn with every key with the provided prefix that is written, along with
+	// its new value, or deleted (in which case deleted is true), in the order in which
+	// the changes were committed, until ctx is done or the watch fails.
+	Watch(ctx context.Context, prefix []byte, fn func(key, value []byte, deleted bool)) error
+}
@@ -2,15 +2,19 @@ package registry
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"sort"
 	"time"
 
 	"github.com/richardartoul/nola/virtual/registry/kv"
 	"github.com/richardartoul/nola/virtual/registry/tuple"
 	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
 
 	"golang.org/x/sync/singleflight"
 )
@@ -23,9 +27,7 @@ const (
 	HeartbeatTTL = 5 * time.Second
 )
 
-var (
-	errActorDoesNotExist = errors.New("actor does not exist")
-)
+var errActorDoesNotExist = errors.New("actor does not exist")
 
 // IsActorDoesNotExistErr returns a boolean indicating whether the error is an
 // instance of (or wraps) errActorDoesNotExist.
@@ -33,18 +35,109 @@ func IsActorDoesNotExistErr(err error) bool {
 	return errors.Is(err, errActorDoesNotExist)
 }
 
+// IsModuleDoesNotExistErr returns a boolean indicating whether the error is an
+// instance of (or wraps) ErrModuleNotFound.
+func IsModuleDoesNotExistErr(err error) bool {
+	return errors.Is(err, ErrModuleNotFound)
+}
+
+// PlacementStrategy controls how the registry picks a server for new actor activations.
+type PlacementStrategy string
+
+const (
+	// PlacementStrategyFewestActors places new activations on the live server that
+	// currently has the fewest activated actors. This is the default strategy.
+	PlacementStrategyFewestActors PlacementStrategy = "fewest_actors"
+	// PlacementStrategyRendezvousHash places new activations using rendezvous (highest
+	// random weight) hashing of the actor's ID across the live servers. When a server
+	// joins or leaves the cluster, only ~1/N of the actors that need to be (re)placed
+	// will pick a different server than they would have otherwise which minimizes
+	// reactivations and cache churn. See KVRegistryOptions.ShardFunc for hashing a
+	// shard key that is embedded in the actors' IDs instead.
+	PlacementStrategyRendezvousHash PlacementStrategy = "rendezvous_hash"
+	// PlacementStrategyLeastLoaded places new activations on the live server that
+	// reported the lowest HeartbeatState.Load, breaking ties by the number of activated
+	// actors. Existing activations are not moved, but as activations are replaced (for
+	// example, because their server died) they will gravitate towards less loaded
+	// servers over time.
+	PlacementStrategyLeastLoaded PlacementStrategy = "least_loaded"
+)
+
+// KVRegistryOptions contains the options for the KV-backed registry.
+type KVRegistryOptions struct {
+	// PlacementStrategy is the strategy that will be used to pick a server for new
+	// actor activations. Defaults to PlacementStrategyFewestActors if empty.
+	PlacementStrategy PlacementStrategy
+	// ActivationLeaseDuration is the duration of the leases that the registry grants
+	// activations (see types.ActivationLease). When it is > 0, an actor's activation is
+	// only reused while its lease is alive, so a server that can't reach the registry to
+	// renew the leases of the actors it hosts (for example because of a network partition)
+	// loses them, and they're activated elsewhere, once their leases expire. Servers stop
+	// hosting the actors whose leases they fail to renew in time so that two servers never
+	// believe they host the same actor.
+	//
+	// Servers renew leases in the background every time they heartbeat (once per second),
+	// so it should be several seconds long.
+	//
+	// A value of 0 disables leases.
+	ActivationLeaseDuration time.Duration
+	// ShardFunc maps actors to shards, for example with ShardByPrefix for actor IDs that
+	// embed a shard key. If set, new activations of the actors that belong to a shard are
+	// placed by rendezvous hashing their shard (within their namespace) instead of
+	// according to PlacementStrategy, so that all the actors of a shard are colocated on
+	// the same server (for example, for transactional locality). Their failover
+	// candidates are ranked by their shard as well so that they fail over together. The
+	// actors that don't belong to a shard are placed according to PlacementStrategy, and
+	// EnsureActivationOptions.AffinityKey takes precedence over the shard.
+	//
+	// Hashing shards has the same properties as PlacementStrategyRendezvousHash: only the
+	// shards that were placed on a server that leaves (or that map to a server that
+	// joins) move. Unlike with that strategy whole shards move at once though, so shards
+	// should be small relative to the capacity of a server to keep load balanced.
+	//
+	// Every server must use the same ShardFunc. Changing it requires a coordinated
+	// rebalance: existing activations are not moved, so until the actors of a shard are
+	// reactivated (for example by draining the servers that host them) they may be
+	// spread across servers that disagree about where the shard belongs.
+	ShardFunc ShardFunc
+}
+
+// Validate validates the KVRegistryOptions.
+func (o *KVRegistryOptions) Validate() error {
+	if o.ActivationLeaseDuration < 0 {
+		return fmt.Errorf("ActivationLeaseDuration must be >= 0, but was: %s", o.ActivationLeaseDuration)
+	}
+	switch o.PlacementStrategy {
+	case "", PlacementStrategyFewestActors, PlacementStrategyRendezvousHash, PlacementStrategyLeastLoaded:
+		return nil
+	default:
+		return fmt.Errorf("unknown PlacementStrategy: %s", o.PlacementStrategy)
+	}
+}
+
 type kvRegistry struct {
 	versionStampBatcher singleflight.Group
 
+	// Dependencies / configuration.
+	opts KVRegistryOptions
+
 	// State.
 	kv kv.Store
 }
 
 // NewKVRegistry creates a new KV-backed registry.
-func NewKVRegistry(kv kv.Store) Registry {
+func NewKVRegistry(kv kv.Store, opts KVRegistryOptions) (Registry, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("error validating KVRegistryOptions: %w", err)
+	}
+	if opts.PlacementStrategy == "" {
+		opts.PlacementStrategy = PlacementStrategyFewestActors
+	}
+
 	return newValidatedRegistry(&kvRegistry{
-		kv: kv,
-	})
+		opts: opts,
+		kv:   kv,
+	}), nil
 }
 
 // TODO: Add compression?
@@ -55,7 +148,7 @@ func (k *kvRegistry) RegisterModule(
 	moduleBytes []byte,
 	opts ModuleOptions,
 ) (RegisterModuleResult, error) {
-	r, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+	r, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
 		_, ok, err := tr.Get(ctx, getModulePartKey(namespace, moduleID, 0))
 		if err != nil {
 			return nil, err
@@ -111,7 +204,7 @@ func (k *kvRegistry) GetModule(
 	moduleID string,
 ) ([]byte, ModuleOptions, error) {
 	key := getModulePrefix(namespace, moduleID)
-	r, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+	r, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
 		var (
 			moduleBytes []byte
 			i           = 0
@@ -126,8 +219,8 @@ func (k *kvRegistry) GetModule(
 		}
 		if i == 0 {
 			return ModuleOptions{}, fmt.Errorf(
-				"error getting module: %s, does not exist in namespace: %s",
-				moduleID, namespace)
+				"error getting module: %s, does not exist in namespace: %s, err: %w",
+				moduleID, namespace, ErrModuleNotFound)
 		}
 
 		rm := registeredModule{}
@@ -151,7 +244,7 @@ func (k *kvRegistry) CreateActor(
 	moduleID string,
 	opts types.ActorOptions,
 ) (CreateActorResult, error) {
-	r, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+	r, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
 		return k.createActor(ctx, tr, namespace, actorID, moduleID, opts)
 	})
 	if err != nil {
@@ -190,8 +283,8 @@ func (k *kvRegistry) createActor(
 	}
 	if !ok {
 		return CreateActorResult{}, fmt.Errorf(
-			"error creating actor, module: %s does not exist in namespace: %s",
-			moduleID, namespace)
+			"error creating actor, module: %s does not exist in namespace: %s, err: %w",
+			moduleID, namespace, ErrModuleNotFound)
 	}
 
 	ra := registeredActor{
@@ -215,7 +308,7 @@ func (k *kvRegistry) IncGeneration(
 	moduleID string,
 ) error {
 	actorKey := getActorKey(namespace, actorID, moduleID)
-	_, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+	_, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
 		ra, ok, err := k.getActor(ctx, tr, actorKey)
 		if err != nil {
 			return nil, err
@@ -249,132 +342,618 @@ func (k *kvRegistry) EnsureActivation(
 	namespace,
 	actorID string,
 	moduleID string,
+	opts EnsureActivationOptions,
+) ([]types.ActorReference, error) {
+	references, _, err := k.EnsureActivationWithVersionStamp(
+		ctx, namespace, actorID, moduleID, opts)
+	return references, err
+}
+
+// EnsureActivationWithVersionStamp returns the versionstamp of the transaction that
+// resolved the references.
+func (k *kvRegistry) EnsureActivationWithVersionStamp(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+	opts EnsureActivationOptions,
+) ([]types.ActorReference, int64, error) {
+	var vs int64
+	references, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		// Shed the work if the caller gave up (or its deadline expired), including while
+		// the transaction is retried because it conflicted with another one.
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("EnsureActivation: %w", err)
+		}
+
+		var err error
+		vs, err = tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+		return k.ensureActivation(ctx, tr, vs, namespace, actorID, moduleID, opts)
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("EnsureActivation: error: %w", WrapTimeoutErr(err))
+	}
+
+	return references.([]types.ActorReference), vs, nil
+}
+
+// ensureActivation implements EnsureActivation() within tr, where vs is the
+// transaction's versionstamp.
+func (k *kvRegistry) ensureActivation(
+	ctx context.Context,
+	tr kv.Transaction,
+	vs int64,
+	namespace,
+	actorID string,
+	moduleID string,
+	opts EnsureActivationOptions,
 ) ([]types.ActorReference, error) {
 	actorKey := getActorKey(namespace, actorID, moduleID)
-	references, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
-		ra, ok, err := k.getActor(ctx, tr, actorKey)
-		if err == nil && !ok {
-			_, err := k.createActor(ctx, tr, namespace, actorID, moduleID, types.ActorOptions{})
-			if err != nil {
-				return nil, fmt.Errorf("EnsureActivation: error creating actor: %w", err)
-			}
-			ra, ok, err = k.getActor(ctx, tr, actorKey)
-			if err != nil {
-				return nil, fmt.Errorf("EnsureActivation: error getting actor: %w", err)
-			}
-			if !ok {
-				return nil, fmt.Errorf(
-					"[invariant violated] error ensuring activation of actor with ID: %s, does not exist in namespace: %s, err: %w",
-					actorID, namespace, errActorDoesNotExist)
-			}
+	ra, ok, err := k.getActor(ctx, tr, actorKey)
+	if err == nil && !ok {
+		_, err := k.createActor(ctx, tr, namespace, actorID, moduleID, types.ActorOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("EnsureActivation: error creating actor: %w", err)
 		}
+		ra, ok, err = k.getActor(ctx, tr, actorKey)
 		if err != nil {
 			return nil, fmt.Errorf("EnsureActivation: error getting actor: %w", err)
 		}
 		if !ok {
-			// Make sure we use %w to wrap the errActorDoesNotExist so the caller can use
-			// errors.Is() on it.
 			return nil, fmt.Errorf(
 				"[invariant violated] error ensuring activation of actor with ID: %s, does not exist in namespace: %s, err: %w",
 				actorID, namespace, errActorDoesNotExist)
 		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("EnsureActivation: error getting actor: %w", err)
+	}
+	if !ok {
+		// Make sure we use %w to wrap the errActorDoesNotExist so the caller can use
+		// errors.Is() on it.
+		return nil, fmt.Errorf(
+			"[invariant violated] error ensuring activation of actor with ID: %s, does not exist in namespace: %s, err: %w",
+			actorID, namespace, errActorDoesNotExist)
+	}
 
-		serverKey := getServerKey(ra.Activation.ServerID)
-		v, ok, err := tr.Get(ctx, serverKey)
+	serverKey := getServerKey(ra.Activation.ServerID)
+	v, ok, err := tr.Get(ctx, serverKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		server       serverState
+		serverExists bool
+	)
+	if ok {
+		if err := json.Unmarshal(v, &server); err != nil {
+			return nil, fmt.Errorf("error unmarsaling server state with ID: %s", actorID)
+		}
+		serverExists = true
+	}
+
+	var (
+		currActivation, activationExists = ra.Activation, ra.Activation.ServerID != ""
+		timeSinceLastHeartbeat           = versionSince(vs, server.LastHeartbeatedAt)
+		serverID                         string
+		serverAddress                    string
+		serverVersion                    int64
+		// eligibleServers is only listed if a new activation has to be created or
+		// failover candidates were requested.
+		eligibleServers []serverState
+	)
+	if activationExists && serverExists && timeSinceLastHeartbeat < HeartbeatTTL &&
+		!server.HeartbeatState.Draining && !opts.isBlacklisted(currActivation.ServerID) &&
+		!k.isLeaseExpired(currActivation, vs) {
+		// We have an existing activation and the server is still alive, so just use that.
+
+		// It is acceptable to look up the ServerVersion from the server discovery key directly,
+		// as long as the activation is still active, it guarantees that the server's version
+		// has not changed since the activation was first created.
+		serverVersion = server.ServerVersion
+		serverID = currActivation.ServerID
+		serverAddress = server.HeartbeatState.Address
+
+		if k.opts.ActivationLeaseDuration > 0 && currActivation.LeaseID == 0 {
+			// The activation was created before leases were enabled so grant it one.
+			currActivation = k.newActivation(serverID, currActivation.ServerVersion, vs)
+			ra.Activation = currActivation
+			marshaled, err := json.Marshal(&ra)
+			if err != nil {
+				return nil, fmt.Errorf("error marshaling activation: %w", err)
+			}
+			tr.Put(ctx, actorKey, marshaled)
+		}
+	} else {
+		// We need to create a new activation.
+		var numExcluded, numAtCapacity int
+		eligibleServers, numExcluded, numAtCapacity, err = k.eligibleServers(ctx, tr, vs, opts)
 		if err != nil {
 			return nil, err
 		}
+		liveServers := eligibleServers
+		if len(liveServers) == 0 && numExcluded > 0 {
+			return nil, fmt.Errorf(
+				"%d live servers are draining or blacklisted: %w", numExcluded, ErrAllServersBlacklisted)
+		}
+		if len(liveServers) == 0 && numAtCapacity > 0 {
+			return nil, fmt.Errorf(
+				"%d live servers are at capacity: %w", numAtCapacity, ErrNoEligibleServers)
+		}
+		if len(liveServers) == 0 {
+			return nil, ErrNoEligibleServers
+		}
 
-		var (
-			server       serverState
-			serverExists bool
-		)
-		if ok {
-			if err := json.Unmarshal(v, &server); err != nil {
-				return nil, fmt.Errorf("error unmarsaling server state with ID: %s", actorID)
+		if opts.AntiAffinityGroup != "" {
+			liveServers, err = k.excludeAntiAffinityServers(
+				ctx, tr, namespace, opts.AntiAffinityGroup, moduleID, actorID, liveServers)
+			if err != nil {
+				return nil, fmt.Errorf("EnsureActivation: error applying anti-affinity: %w", err)
 			}
-			serverExists = true
 		}
 
-		vs, err := tr.GetVersionStamp()
+		var selected serverState
+		if opts.AffinityKey != "" {
+			selected = pickServerAffinity(namespace, opts.AffinityKey, liveServers)
+		} else {
+			selected = k.pickServer(namespace, actorID, moduleID, liveServers)
+		}
+		serverID = selected.ServerID
+		serverAddress = selected.HeartbeatState.Address
+		serverVersion = selected.ServerVersion
+		currActivation = k.newActivation(serverID, serverVersion, vs)
+
+		if opts.AntiAffinityGroup != "" {
+			tr.Put(ctx, getAntiAffinityKey(namespace, opts.AntiAffinityGroup, moduleID, actorID), []byte(serverID))
+		}
+
+		ra.Activation = currActivation
+		marshaled, err := json.Marshal(&ra)
 		if err != nil {
-			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+			return nil, fmt.Errorf("error marshaling activation: %w", err)
 		}
 
-		var (
-			currActivation, activationExists = ra.Activation, ra.Activation.ServerID != ""
-			timeSinceLastHeartbeat           = versionSince(vs, server.LastHeartbeatedAt)
-			serverID                         string
-			serverAddress                    string
-			serverVersion                    int64
-		)
-		if activationExists && serverExists && timeSinceLastHeartbeat < HeartbeatTTL {
-			// We have an existing activation and the server is still alive, so just use that.
-
-			// It is acceptable to look up the ServerVersion from the server discovery key directly,
-			// as long as the activation is still active, it guarantees that the server's version
-			// has not changed since the activation was first created.
-			serverVersion = server.ServerVersion
-			serverID = currActivation.ServerID
-			serverAddress = server.HeartbeatState.Address
-		} else {
-			// We need to create a new activation.
-			liveServers := []serverState{}
-			err = tr.IterPrefix(ctx, getServersPrefix(), func(k, v []byte) error {
-				var currServer serverState
-				if err := json.Unmarshal(v, &currServer); err != nil {
-					return fmt.Errorf("error unmarshaling server state: %w", err)
-				}
-
-				if versionSince(vs, currServer.LastHeartbeatedAt) < HeartbeatTTL {
-					liveServers = append(liveServers, currServer)
-				}
-				return nil
-			})
+		tr.Put(ctx, actorKey, marshaled)
+	}
+
+	ref, err := types.NewLeasedActorReference(
+		serverID, serverVersion, serverAddress, namespace, ra.ModuleID, actorID, ra.Generation,
+		currActivation.lease(namespace, ra.ModuleID, actorID, vs))
+	if err != nil {
+		return nil, fmt.Errorf("error creating new actor reference: %w", err)
+	}
+
+	if opts.NumFailoverCandidates > 0 {
+		if eligibleServers == nil {
+			eligibleServers, _, _, err = k.eligibleServers(ctx, tr, vs, opts)
 			if err != nil {
 				return nil, err
 			}
-			if len(liveServers) == 0 {
-				return nil, fmt.Errorf("0 live servers available for new activation")
-			}
+		}
+		candidates, err := failoverCandidates(
+			namespace, ra.ModuleID, actorID, ra.Generation, serverID,
+			opts.NumFailoverCandidates, eligibleServers,
+			k.shardKey(namespace, ra.ModuleID, actorID))
+		if err != nil {
+			return nil, fmt.Errorf("error creating failover candidates: %w", err)
+		}
+		ref, err = types.WithFailoverCandidates(ref, candidates)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-			// Pick the server with the lowest current number of activated actors to try and load-balance.
-			// TODO: This is obviously insufficient and we should take other factors into account like
-			//       memory / CPU usage.
-			// TODO: We should also have some hard limits and just reject new activations at some point.
-			sort.Slice(liveServers, func(i, j int) bool {
-				return liveServers[i].HeartbeatState.NumActivatedActors < liveServers[j].HeartbeatState.NumActivatedActors
-			})
+	return []types.ActorReference{ref}, nil
+}
 
-			serverID = liveServers[0].ServerID
-			serverAddress = liveServers[0].HeartbeatState.Address
-			serverVersion = liveServers[0].ServerVersion
-			currActivation = newActivation(serverID, serverVersion)
+// eligibleServers returns the servers that are eligible for new activations, which are
+// the ones that are alive and are not draining, blacklisted or at capacity. It also
+// returns the number of live servers that were excluded because they're draining or
+// blacklisted, and because they're at capacity.
+func (k *kvRegistry) eligibleServers(
+	ctx context.Context,
+	tr kv.Transaction,
+	vs int64,
+	opts EnsureActivationOptions,
+) (eligible []serverState, numExcluded int, numAtCapacity int, err error) {
+	eligible = []serverState{}
+	err = tr.IterPrefix(ctx, getServersPrefix(), func(k, v []byte) error {
+		var currServer serverState
+		if err := json.Unmarshal(v, &currServer); err != nil {
+			return fmt.Errorf("error unmarshaling server state: %w", err)
+		}
 
-			ra.Activation = currActivation
-			marshaled, err := json.Marshal(&ra)
+		if versionSince(vs, currServer.LastHeartbeatedAt) >= HeartbeatTTL {
+			return nil
+		}
+		if currServer.HeartbeatState.Draining || opts.isBlacklisted(currServer.ServerID) {
+			numExcluded++
+			return nil
+		}
+		if currServer.HeartbeatState.isAtCapacity() {
+			numAtCapacity++
+			return nil
+		}
+		eligible = append(eligible, currServer)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return eligible, numExcluded, numAtCapacity, nil
+}
+
+// failoverCandidates returns references to the actor on up to numCandidates of the
+// eligible servers other than serverID, ranked by rendezvous hashing rankKey (the actor's
+// identity, or its shard) so that every caller tries them in the same order.
+func failoverCandidates(
+	namespace,
+	moduleID,
+	actorID string,
+	generation uint64,
+	serverID string,
+	numCandidates int,
+	eligible []serverState,
+	rankKey []string,
+) ([]types.ActorReference, error) {
+	others := make([]serverState, 0, len(eligible))
+	for _, server := range eligible {
+		if server.ServerID != serverID {
+			others = append(others, server)
+		}
+	}
+
+	var candidates []types.ActorReference
+	for _, server := range rankServersRendezvous(others, rankKey...) {
+		if len(candidates) >= numCandidates {
+			break
+		}
+		candidate, err := types.NewActorReference(
+			server.ServerID, server.ServerVersion, server.HeartbeatState.Address,
+			namespace, moduleID, actorID, generation)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates, nil
+}
+
+// pickServer picks the server that a new activation of the provided actor should be
+// placed on according to its shard (see KVRegistryOptions.ShardFunc) or the configured
+// PlacementStrategy. liveServers must not be empty.
+func (k *kvRegistry) pickServer(
+	namespace,
+	actorID,
+	moduleID string,
+	liveServers []serverState,
+) serverState {
+	if shard := k.shard(namespace, moduleID, actorID); shard != "" {
+		return pickServerShard(namespace, shard, liveServers)
+	}
+
+	switch k.opts.PlacementStrategy {
+	case PlacementStrategyRendezvousHash:
+		return pickServerRendezvousHash(namespace, actorID, moduleID, liveServers)
+	case PlacementStrategyLeastLoaded:
+		return pickServerLeastLoaded(liveServers)
+	default:
+		// Pick the server with the lowest current number of activated actors to try and load-balance.
+		// TODO: This is obviously insufficient and we should take other factors into account like
+		//       memory / CPU usage.
+		sort.Slice(liveServers, func(i, j int) bool {
+			return liveServers[i].HeartbeatState.NumActivatedActors < liveServers[j].HeartbeatState.NumActivatedActors
+		})
+		return liveServers[0]
+	}
+}
+
+// excludeAntiAffinityServers returns the subset of liveServers that don't host any
+// actor (other than the provided one) from the anti-affinity group. If every server
+// hosts one, liveServers is returned unmodified since the hint is best-effort.
+func (k *kvRegistry) excludeAntiAffinityServers(
+	ctx context.Context,
+	tr kv.Transaction,
+	namespace,
+	group,
+	moduleID,
+	actorID string,
+	liveServers []serverState,
+) ([]serverState, error) {
+	var (
+		actorKey = string(getAntiAffinityKey(namespace, group, moduleID, actorID))
+		occupied = make(map[string]struct{})
+	)
+	err := tr.IterPrefix(ctx, getAntiAffinityPrefix(namespace, group), func(k, v []byte) error {
+		if string(k) == actorKey {
+			return nil
+		}
+		occupied[string(v)] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	eligible := make([]serverState, 0, len(liveServers))
+	for _, server := range liveServers {
+		if _, ok := occupied[server.ServerID]; !ok {
+			eligible = append(eligible, server)
+		}
+	}
+	if len(eligible) == 0 {
+		return liveServers, nil
+	}
+	return eligible, nil
+}
+
+// pickServerLeastLoaded picks the server with the lowest reported load. liveServers must
+// not be empty.
+func pickServerLeastLoaded(liveServers []serverState) serverState {
+	sort.Slice(liveServers, func(i, j int) bool {
+		a, b := liveServers[i].HeartbeatState, liveServers[j].HeartbeatState
+		if a.Load != b.Load {
+			return a.Load < b.Load
+		}
+		return a.NumActivatedActors < b.NumActivatedActors
+	})
+	return liveServers[0]
+}
+
+// pickServerRendezvousHash picks the server with the highest hash of the actor's
+// identity combined with the server's ID. liveServers must not be empty.
+func pickServerRendezvousHash(
+	namespace,
+	actorID,
+	moduleID string,
+	liveServers []serverState,
+) serverState {
+	return pickServerRendezvous(liveServers, namespace, moduleID, actorID)
+}
+
+// pickServerAffinity picks the server for actors with the provided affinity key such that
+// all of them are placed on the same server. liveServers must not be empty.
+func pickServerAffinity(
+	namespace,
+	affinityKey string,
+	liveServers []serverState,
+) serverState {
+	return pickServerRendezvous(liveServers, namespace, "affinity", affinityKey)
+}
+
+// pickServerShard picks the server for the actors of the provided shard such that all of
+// them are placed on the same server. liveServers must not be empty.
+func pickServerShard(
+	namespace,
+	shard string,
+	liveServers []serverState,
+) serverState {
+	return pickServerRendezvous(liveServers, namespace, "shard", shard)
+}
+
+// pickServerRendezvous picks the server with the highest hash of the provided key parts
+// combined with the server's ID. liveServers must not be empty.
+func pickServerRendezvous(liveServers []serverState, key ...string) serverState {
+	var (
+		best       serverState
+		bestWeight uint64
+	)
+	for i, server := range liveServers {
+		weight := rendezvousWeight(server.ServerID, key...)
+		// Break ties by server ID so the result doesn't depend on the iteration order.
+		if i == 0 || weight > bestWeight || (weight == bestWeight && server.ServerID < best.ServerID) {
+			best, bestWeight = server, weight
+		}
+	}
+	return best
+}
+
+// rankServersRendezvous returns a copy of servers sorted by descending hash of the
+// provided key parts combined with the server's ID, so the first server is the one that
+// pickServerRendezvous would pick.
+func rankServersRendezvous(servers []serverState, key ...string) []serverState {
+	var (
+		ranked  = append([]serverState(nil), servers...)
+		weights = make(map[string]uint64, len(servers))
+	)
+	for _, server := range ranked {
+		weights[server.ServerID] = rendezvousWeight(server.ServerID, key...)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := weights[ranked[i].ServerID], weights[ranked[j].ServerID]
+		if a != b {
+			return a > b
+		}
+		return ranked[i].ServerID < ranked[j].ServerID
+	})
+	return ranked
+}
+
+// rendezvousWeight returns the weight of serverID for the provided key parts.
+func rendezvousWeight(serverID string, key ...string) uint64 {
+	h := fnv.New64a()
+	for _, part := range key {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte(serverID))
+	return mix64(h.Sum64())
+}
+
+// mix64 is the splitmix64 finalizer. FNV has poor avalanche behavior for inputs that
+// only differ in their last few bytes (like server IDs that only differ by a numeric
+// suffix) so we need to mix the bits before comparing weights.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// BulkEnsureActivation ensures the activation of all the actors within a single
+// transaction, so the batch is committed (and retried on conflicts) once instead of once
+// per actor. Errors that only affect a single actor are reported in its result and don't
+// prevent the activations of the other actors from being committed.
+func (k *kvRegistry) BulkEnsureActivation(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorIDs []string,
+	opts EnsureActivationOptions,
+) ([]EnsureActivationResult, error) {
+	results, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("BulkEnsureActivation: %w", err)
+		}
+
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+
+		results := make([]EnsureActivationResult, 0, len(actorIDs))
+		for _, actorID := range actorIDs {
+			if err := ctx.Err(); err != nil {
+				return nil, fmt.Errorf("BulkEnsureActivation: %w", err)
+			}
+
+			references, err := k.ensureActivation(ctx, tr, vs, namespace, actorID, moduleID, opts)
 			if err != nil {
-				return nil, fmt.Errorf("error marshaling activation: %w", err)
+				err = fmt.Errorf("EnsureActivation: error: %w", WrapTimeoutErr(err))
 			}
+			result := EnsureActivationResult{References: references, Err: err}
+			if err == nil {
+				result.VersionStamp = vs
+			}
+			results = append(results, result)
+		}
+		return results, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("BulkEnsureActivation: error: %w", WrapTimeoutErr(err))
+	}
 
-			tr.Put(ctx, actorKey, marshaled)
+	return results.([]EnsureActivationResult), nil
+}
+
+func (k *kvRegistry) LookupActivation(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+) ([]types.ActorReference, error) {
+	actorKey := getActorKey(namespace, actorID, moduleID)
+	references, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		ra, ok, err := k.getActor(ctx, tr, actorKey)
+		if err != nil {
+			return nil, fmt.Errorf("LookupActivation: error getting actor: %w", err)
+		}
+		if !ok || ra.Activation.ServerID == "" {
+			return []types.ActorReference{}, nil
 		}
 
-		ref, err := types.NewActorReference(serverID, serverVersion, serverAddress, namespace, ra.ModuleID, actorID, ra.Generation)
+		v, ok, err := tr.Get(ctx, getServerKey(ra.Activation.ServerID))
 		if err != nil {
-			return nil, fmt.Errorf("error creating new actor reference: %w", err)
+			return nil, err
+		}
+		if !ok {
+			return []types.ActorReference{}, nil
+		}
+		var server serverState
+		if err := json.Unmarshal(v, &server); err != nil {
+			return nil, fmt.Errorf("error unmarsaling server state with ID: %s", ra.Activation.ServerID)
 		}
 
-		return []types.ActorReference{ref}, nil
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+		// Same conditions as EnsureActivation() for reusing an existing activation.
+		if versionSince(vs, server.LastHeartbeatedAt) >= HeartbeatTTL || server.HeartbeatState.Draining ||
+			k.isLeaseExpired(ra.Activation, vs) {
+			return []types.ActorReference{}, nil
+		}
 
+		ref, err := types.NewLeasedActorReference(
+			server.ServerID, server.ServerVersion, server.HeartbeatState.Address,
+			namespace, ra.ModuleID, actorID, ra.Generation,
+			ra.Activation.lease(namespace, ra.ModuleID, actorID, vs))
+		if err != nil {
+			return nil, fmt.Errorf("error creating new actor reference: %w", err)
+		}
+		return []types.ActorReference{ref}, nil
 	})
 	if err != nil {
-		return nil, fmt.Errorf("EnsureActivation: error: %w", err)
+		return nil, fmt.Errorf("LookupActivation: error: %w", WrapTimeoutErr(err))
 	}
 
 	return references.([]types.ActorReference), nil
 }
 
+func (k *kvRegistry) RenewActivationLease(
+	ctx context.Context,
+	token string,
+) (types.ActivationLease, error) {
+	if k.opts.ActivationLeaseDuration <= 0 {
+		return types.ActivationLease{}, errors.New("RenewActivationLease: activation leases are disabled")
+	}
+	lt, err := decodeLeaseToken(token)
+	if err != nil {
+		return types.ActivationLease{}, fmt.Errorf("RenewActivationLease: error: %w", err)
+	}
+
+	actorKey := getActorKey(lt.Namespace, lt.ActorID, lt.ModuleID)
+	lease, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		ra, ok, err := k.getActor(ctx, tr, actorKey)
+		if err != nil {
+			return nil, fmt.Errorf("error getting actor: %w", err)
+		}
+		if !ok {
+			return nil, fmt.Errorf(
+				"actor: %s(%s) does not exist: %w", lt.ActorID, lt.ModuleID, ErrActivationLeaseExpired)
+		}
+
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+		// Like BeginTransaction(), the tuple of <ServerID, ServerVersion> fences the lease
+		// so it can only be renewed by the server that it was granted to, and only until
+		// the actor is activated again (on any server).
+		if ra.Activation.ServerID != lt.ServerID ||
+			ra.Activation.ServerVersion != lt.ServerVersion ||
+			ra.Activation.LeaseID != lt.LeaseID {
+			return nil, fmt.Errorf(
+				"actor: %s(%s) was activated again: %w", lt.ActorID, lt.ModuleID, ErrActivationLeaseExpired)
+		}
+		if k.isLeaseExpired(ra.Activation, vs) {
+			return nil, fmt.Errorf(
+				"lease of actor: %s(%s) expired: %w", lt.ActorID, lt.ModuleID, ErrActivationLeaseExpired)
+		}
+
+		ra.Activation.LeaseExpiresAt = vs + k.opts.ActivationLeaseDuration.Microseconds()
+		marshaled, err := json.Marshal(&ra)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling activation: %w", err)
+		}
+		if err := tr.Put(ctx, actorKey, marshaled); err != nil {
+			return nil, err
+		}
+		return ra.Activation.lease(lt.Namespace, lt.ModuleID, lt.ActorID, vs), nil
+	})
+	if err != nil {
+		return types.ActivationLease{}, fmt.Errorf("RenewActivationLease: error: %w", WrapTimeoutErr(err))
+	}
+
+	return lease.(types.ActivationLease), nil
+}
+
 func (k *kvRegistry) GetVersionStamp(
 	ctx context.Context,
 ) (int64, error) {
@@ -389,7 +968,7 @@ func (k *kvRegistry) GetVersionStamp(
 	//
 	// We pass "" as the key because every call is the same.
 	v, err, _ := k.versionStampBatcher.Do("", func() (any, error) {
-		return k.kv.Transact(func(tr kv.Transaction) (any, error) {
+		return k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
 			return tr.GetVersionStamp()
 		})
 	})
@@ -449,14 +1028,55 @@ func (k *kvRegistry) BeginTransaction(
 	return tr, nil
 }
 
+func (k *kvRegistry) PutInstantiatePayload(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	payload []byte,
+) error {
+	_, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		return nil, tr.Put(ctx, getInstantiatePayloadKey(namespace, actorID, moduleID), payload)
+	})
+	if err != nil {
+		return fmt.Errorf("PutInstantiatePayload: error: %w", WrapTimeoutErr(err))
+	}
+	return nil
+}
+
+func (k *kvRegistry) GetInstantiatePayload(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+) ([]byte, bool, error) {
+	var payload []byte
+	ok, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		v, ok, err := tr.Get(ctx, getInstantiatePayloadKey(namespace, actorID, moduleID))
+		if err != nil {
+			return false, err
+		}
+		// Copy the value since it's only valid for the lifetime of the transaction.
+		payload = append([]byte(nil), v...)
+		return ok, nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("GetInstantiatePayload: error: %w", WrapTimeoutErr(err))
+	}
+	return payload, ok.(bool), nil
+}
+
 func (k *kvRegistry) Heartbeat(
 	ctx context.Context,
 	serverID string,
 	heartbeatState HeartbeatState,
 ) (HeartbeatResult, error) {
 	key := getServerKey(serverID)
-	var serverVersion int64
-	versionStamp, err := k.kv.Transact(func(tr kv.Transaction) (any, error) {
+	var (
+		serverVersion int64
+		liveServers   []LiveServer
+	)
+	versionStamp, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
 		v, ok, err := tr.Get(ctx, key)
 		if err != nil {
 			return nil, fmt.Errorf("error getting server state: %w", err)
@@ -464,16 +1084,20 @@ func (k *kvRegistry) Heartbeat(
 
 		var state serverState
 		if !ok {
-			serverVersion = 1
-			state = serverState{
-				ServerID:      serverID,
-				ServerVersion: serverVersion,
-			}
 			vs, err := tr.GetVersionStamp()
 			if err != nil {
 				return nil, fmt.Errorf("error getting versionstamp: %w", err)
 			}
-			state.LastHeartbeatedAt = vs
+			// The versions of new servers start at the versionstamp instead of 1 so that
+			// the version of a server whose state was removed from the store (for example
+			// because its etcd lease expired) never repeats, and the references to its
+			// actors that were issued before remain invalid.
+			serverVersion = vs
+			state = serverState{
+				ServerID:          serverID,
+				ServerVersion:     serverVersion,
+				LastHeartbeatedAt: vs,
+			}
 		} else {
 			if err := json.Unmarshal(v, &state); err != nil {
 				return nil, fmt.Errorf("error unmarshaling server state: %w", err)
@@ -500,6 +1124,13 @@ func (k *kvRegistry) Heartbeat(
 
 		tr.Put(ctx, key, marshaled)
 
+		if heartbeatState.IncludeLiveServers {
+			liveServers, err = k.liveServers(ctx, tr, vs, state)
+			if err != nil {
+				return nil, fmt.Errorf("error listing live servers: %w", err)
+			}
+		}
+
 		return tr.GetVersionStamp()
 	})
 	if err != nil {
@@ -508,17 +1139,143 @@ func (k *kvRegistry) Heartbeat(
 	return HeartbeatResult{
 		VersionStamp: versionStamp.(int64),
 		// VersionStamp corresponds to ~ 1 million increments per second.
-		HeartbeatTTL:  int64(HeartbeatTTL.Microseconds()),
-		ServerVersion: serverVersion,
+		HeartbeatTTL:            int64(HeartbeatTTL.Microseconds()),
+		ServerVersion:           serverVersion,
+		ActivationLeaseDuration: k.opts.ActivationLeaseDuration,
+		LiveServers:             liveServers,
 	}, nil
 }
 
+// liveServers returns the servers whose heartbeat has not expired at versionstamp vs,
+// including self (which is the state that is being written by the current transaction),
+// sorted by ServerID.
+func (k *kvRegistry) liveServers(
+	ctx context.Context,
+	tr kv.Transaction,
+	vs int64,
+	self serverState,
+) ([]LiveServer, error) {
+	live := []LiveServer{{ServerID: self.ServerID, Address: self.HeartbeatState.Address}}
+	err := tr.IterPrefix(ctx, getServersPrefix(), func(k, v []byte) error {
+		var server serverState
+		if err := json.Unmarshal(v, &server); err != nil {
+			return fmt.Errorf("error unmarshaling server state: %w", err)
+		}
+		if server.ServerID == self.ServerID || versionSince(vs, server.LastHeartbeatedAt) >= HeartbeatTTL {
+			return nil
+		}
+		live = append(live, LiveServer{ServerID: server.ServerID, Address: server.HeartbeatState.Address})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].ServerID < live[j].ServerID
+	})
+	return live, nil
+}
+
+// ExtendServerHeartbeats is meant to be called on the kv.Store of a KV-backed registry
+// right after its state is restored from a snapshot that was taken at versionstamp asOf.
+// It treats the restore as a heartbeat of every server that was alive at asOf, so that
+// they have HeartbeatTTL to heartbeat again while keeping their server version (and
+// therefore their activations) instead of being considered dead because the registry was
+// down. Servers that don't heartbeat again in time are considered dead like usual and
+// their actors are placed elsewhere when they're activated again.
+func ExtendServerHeartbeats(ctx context.Context, store kv.Store, asOf int64) error {
+	_, err := store.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+
+		var alive []serverState
+		err = tr.IterPrefix(ctx, getServersPrefix(), func(k, v []byte) error {
+			var state serverState
+			if err := json.Unmarshal(v, &state); err != nil {
+				return fmt.Errorf("error unmarshaling server state: %w", err)
+			}
+			if state.LastHeartbeatedAt <= asOf && versionSince(asOf, state.LastHeartbeatedAt) < HeartbeatTTL {
+				alive = append(alive, state)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error iterating servers: %w", err)
+		}
+
+		for _, state := range alive {
+			state.LastHeartbeatedAt = vs
+			marshaled, err := json.Marshal(&state)
+			if err != nil {
+				return nil, fmt.Errorf("error marshaling server state: %w", err)
+			}
+			if err := tr.Put(ctx, getServerKey(state.ServerID), marshaled); err != nil {
+				return nil, fmt.Errorf("error putting server state: %w", err)
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("ExtendServerHeartbeats: error: %w", err)
+	}
+	return nil
+}
+
 func (k *kvRegistry) Close(ctx context.Context) error {
 	return k.kv.Close(ctx)
 }
 
+// WatchActivations watches the actor and server keys of the KV store, if it can watch for
+// changes (see kv.WatchableStore).
+func (k *kvRegistry) WatchActivations(
+	ctx context.Context,
+	onActivationChanged func(ActivationChange),
+	onServerRemoved func(serverID string),
+) error {
+	store, ok := k.kv.(kv.WatchableStore)
+	if !ok {
+		return fmt.Errorf("WatchActivations: %w", ErrWatchNotSupported)
+	}
+
+	err := store.Watch(ctx, nil, func(key, value []byte, deleted bool) {
+		t, err := tuple.Unpack(key)
+		if err != nil {
+			return
+		}
+		if serverID, ok := parseServerKey(t); ok {
+			if deleted {
+				onServerRemoved(serverID)
+			}
+			return
+		}
+		namespace, moduleID, actorID, ok := parseActorKey(t)
+		if !ok {
+			return
+		}
+
+		change := ActivationChange{
+			ActorID: types.NewNamespacedActorID(namespace, actorID, moduleID, types.IDTypeActor),
+		}
+		// The activation is reported as unknown if the actor can't be unmarshaled so that
+		// it is resolved again.
+		var ra registeredActor
+		if !deleted && json.Unmarshal(value, &ra) == nil {
+			change.ServerID = ra.Activation.ServerID
+			change.ServerVersion = ra.Activation.ServerVersion
+			change.Generation = ra.Generation
+		}
+		onActivationChanged(change)
+	})
+	if err != nil {
+		return fmt.Errorf("WatchActivations: error: %w", err)
+	}
+	return nil
+}
+
 func (k *kvRegistry) UnsafeWipeAll() error {
-	return k.kv.UnsafeWipeAll()
+	return k.kv.UnsafeWipeAll(context.Background())
 }
 
 func (k *kvRegistry) getActorBytes(
@@ -570,10 +1327,40 @@ func getActorKey(namespace, actorID, moduleID string) []byte {
 	return tuple.Tuple{namespace, "actors", moduleID, actorID, "state"}.Pack()
 }
 
+func getInstantiatePayloadKey(namespace, actorID, moduleID string) []byte {
+	return tuple.Tuple{namespace, "actors", moduleID, actorID, "instantiate_payload"}.Pack()
+}
+
 func getActoKVKey(namespace, actorID string, moduleID string, key []byte) []byte {
 	return tuple.Tuple{namespace, "actors", moduleID, actorID, "kv", key}.Pack()
 }
 
+// getActorKVVersionKey returns the key of the version column of an actor KV pair (see
+// kvTransaction.getVersion).
+func getActorKVVersionKey(namespace, actorID string, moduleID string, key []byte) []byte {
+	return tuple.Tuple{namespace, "actors", moduleID, actorID, "kv_version", key}.Pack()
+}
+
+// parseActorKey returns the namespace, module ID and actor ID of an unpacked actor key
+// (see getActorKey), and false if t is not an actor key.
+func parseActorKey(t tuple.Tuple) (namespace, moduleID, actorID string, ok bool) {
+	if len(t) != 5 || t[1] != "actors" || t[4] != "state" {
+		return "", "", "", false
+	}
+	namespace, ok1 := t[0].(string)
+	moduleID, ok2 := t[2].(string)
+	actorID, ok3 := t[3].(string)
+	return namespace, moduleID, actorID, ok1 && ok2 && ok3
+}
+
+func getAntiAffinityPrefix(namespace, group string) []byte {
+	return tuple.Tuple{namespace, "anti_affinity", group}.Pack()
+}
+
+func getAntiAffinityKey(namespace, group, moduleID, actorID string) []byte {
+	return tuple.Tuple{namespace, "anti_affinity", group, moduleID, actorID}.Pack()
+}
+
 func getServerKey(serverID string) []byte {
 	return tuple.Tuple{"servers", serverID}.Pack()
 }
@@ -582,6 +1369,23 @@ func getServersPrefix() []byte {
 	return tuple.Tuple{"servers"}.Pack()
 }
 
+// parseServerKey returns the server ID of an unpacked server key (see getServerKey), and
+// false if t is not a server key.
+func parseServerKey(t tuple.Tuple) (string, bool) {
+	if len(t) != 2 || t[0] != "servers" {
+		return "", false
+	}
+	serverID, ok := t[1].(string)
+	return serverID, ok
+}
+
+// ServerKeysPrefix returns the prefix of the keys under which KV-backed registries store
+// the state of every server, which is written every time the server heartbeats. Stores
+// can use it to lay out heartbeats differently from the rest of the keys.
+func ServerKeysPrefix() []byte {
+	return getServersPrefix()
+}
+
 type registeredActor struct {
 	Opts       types.ActorOptions
 	ModuleID   string
@@ -604,21 +1408,92 @@ type serverState struct {
 type activation struct {
 	ServerID      string
 	ServerVersion int64
+	// LeaseID is the versionstamp at which the activation's lease was granted, or 0 if
+	// it was granted without a lease. LeaseExpiresAt is the versionstamp at which the
+	// lease expires unless it's renewed.
+	LeaseID        int64
+	LeaseExpiresAt int64
 }
 
-func newActivation(serverID string, serverVersion int64) activation {
-	return activation{
+// newActivation creates a new activation at versionstamp vs, with a lease if leases are
+// enabled.
+func (k *kvRegistry) newActivation(serverID string, serverVersion int64, vs int64) activation {
+	a := activation{
 		ServerID:      serverID,
 		ServerVersion: serverVersion,
 	}
+	if k.opts.ActivationLeaseDuration > 0 {
+		a.LeaseID = vs
+		a.LeaseExpiresAt = vs + k.opts.ActivationLeaseDuration.Microseconds()
+	}
+	return a
 }
 
+// isLeaseExpired returns whether the activation's lease has expired as of versionstamp
+// vs. Leases are ignored if they're disabled, since nothing renews them.
+func (k *kvRegistry) isLeaseExpired(a activation, vs int64) bool {
+	return k.opts.ActivationLeaseDuration > 0 && a.LeaseID != 0 && vs >= a.LeaseExpiresAt
+}
+
+// lease returns the activation's lease as of versionstamp vs, or the zero value if it
+// doesn't have one.
+func (a activation) lease(namespace, moduleID, actorID string, vs int64) types.ActivationLease {
+	if a.LeaseID == 0 {
+		return types.ActivationLease{}
+	}
+	token, err := json.Marshal(&leaseToken{
+		Namespace:     namespace,
+		ModuleID:      moduleID,
+		ActorID:       actorID,
+		ServerID:      a.ServerID,
+		ServerVersion: a.ServerVersion,
+		LeaseID:       a.LeaseID,
+	})
+	if err != nil {
+		panic(fmt.Sprintf("[invariant violated] error marshaling lease token: %v", err))
+	}
+	return types.ActivationLease{
+		Token:    base64.RawURLEncoding.EncodeToString(token),
+		Duration: time.Duration(a.LeaseExpiresAt-vs) * time.Microsecond,
+		// The lease ID is the versionstamp at which the lease was granted, so it
+		// increases with every new lease.
+		FencingToken: uint64(a.LeaseID),
+	}
+}
+
+// leaseToken is the decoded form of the token of an activation's lease. It identifies
+// the activation that the lease was granted to.
+type leaseToken struct {
+	Namespace     string
+	ModuleID      string
+	ActorID       string
+	ServerID      string
+	ServerVersion int64
+	LeaseID       int64
+}
+
+func decodeLeaseToken(token string) (leaseToken, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return leaseToken{}, fmt.Errorf("error decoding lease token: %w", err)
+	}
+	var lt leaseToken
+	if err := json.Unmarshal(b, &lt); err != nil {
+		return leaseToken{}, fmt.Errorf("error unmarshaling lease token: %w", err)
+	}
+	return lt, nil
+}
+
+// versionSince returns the time that elapsed between two versionstamps. Stores that derive
+// versionstamps from the local clock of each server (like etcdregistry) only guarantee
+// that they're monotonic within a process, so prev may be ahead of curr if it was written
+// by a server whose clock is ahead. In that case no time is considered to have elapsed
+// instead of failing, which errs on the side of considering servers alive (delaying
+// failover by up to the clock skew).
 func versionSince(curr, prev int64) time.Duration {
 	since := curr - prev
 	if since < 0 {
-		panic(fmt.Sprintf(
-			"prev: %d, curr: %d, versionstamp did not increase monotonically",
-			prev, curr))
+		return 0
 	}
 	return time.Duration(since) * time.Microsecond
 }
@@ -658,10 +1533,169 @@ func (tr *kvTransaction) Put(
 	key []byte,
 	value []byte,
 ) error {
+	if err := tr.bumpVersion(ctx, key); err != nil {
+		return err
+	}
 	actorKVKey := getActoKVKey(tr.namespace, tr.actorID, tr.moduleID, key)
 	return tr.tr.Put(ctx, actorKVKey, value)
 }
 
+func (tr *kvTransaction) Delete(
+	ctx context.Context,
+	key []byte,
+) error {
+	versionKey := getActorKVVersionKey(tr.namespace, tr.actorID, tr.moduleID, key)
+	if err := tr.tr.Delete(ctx, versionKey); err != nil {
+		return fmt.Errorf("error deleting actor KV version: %w", err)
+	}
+	actorKVKey := getActoKVKey(tr.namespace, tr.actorID, tr.moduleID, key)
+	return tr.tr.Delete(ctx, actorKVKey)
+}
+
+func (tr *kvTransaction) GetWithVersion(
+	ctx context.Context,
+	key []byte,
+) ([]byte, int64, bool, error) {
+	value, ok, err := tr.Get(ctx, key)
+	if err != nil || !ok {
+		return nil, 0, false, err
+	}
+	version, err := tr.getVersion(ctx, key)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return value, version, true, nil
+}
+
+func (tr *kvTransaction) PutIfVersion(
+	ctx context.Context,
+	key []byte,
+	value []byte,
+	expectedVersion int64,
+) (bool, error) {
+	version, err := tr.getVersion(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if version != expectedVersion {
+		return false, nil
+	}
+	if err := tr.Put(ctx, key, value); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (tr *kvTransaction) Incr(
+	ctx context.Context,
+	key []byte,
+	delta int64,
+) (int64, error) {
+	if itr, ok := tr.tr.(kv.IncrTransaction); ok {
+		if err := tr.bumpVersion(ctx, key); err != nil {
+			return 0, err
+		}
+		actorKVKey := getActoKVKey(tr.namespace, tr.actorID, tr.moduleID, key)
+		return itr.Incr(ctx, actorKVKey, delta)
+	}
+
+	// The store can't increment natively, so emulate it. The read makes the transaction
+	// conflict with concurrent increments, so no increment is lost.
+	v, ok, err := tr.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	var value int64
+	if ok {
+		value, err = wapcutils.DecodeCounter(v)
+		if err != nil {
+			return 0, fmt.Errorf("error decoding counter: %w", err)
+		}
+	}
+	value += delta
+	if err := tr.Put(ctx, key, wapcutils.EncodeCounter(value)); err != nil {
+		return 0, err
+	}
+	return value, nil
+}
+
+// getVersion returns the version of the value at key, or 0 if the key does not exist.
+//
+// The version is stored in a separate "version column" that Put() increases every time
+// it writes the key, which costs an extra read and write per Put(). The version is
+// written by the same transaction as the value, so the version that a transaction reads
+// after writing a key is the version that the key has once the transaction commits.
+// Values that were written before the version column existed have a version of 1.
+func (tr *kvTransaction) getVersion(ctx context.Context, key []byte) (int64, error) {
+	versionKey := getActorKVVersionKey(tr.namespace, tr.actorID, tr.moduleID, key)
+	v, ok, err := tr.tr.Get(ctx, versionKey)
+	if err != nil {
+		return 0, fmt.Errorf("error getting actor KV version: %w", err)
+	}
+	if ok {
+		if len(v) != 8 {
+			return 0, fmt.Errorf("actor KV version has wrong length: %d", len(v))
+		}
+		return int64(binary.BigEndian.Uint64(v)), nil
+	}
+
+	_, ok, err = tr.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// bumpVersion sets the version column of key to a version that is greater than both
+// its current version and every version assigned by transactions that committed before
+// this one, so versions never repeat even if the key is deleted and written again.
+func (tr *kvTransaction) bumpVersion(ctx context.Context, key []byte) error {
+	prev, err := tr.getVersion(ctx, key)
+	if err != nil {
+		return err
+	}
+	version, err := tr.tr.GetVersionStamp()
+	if err != nil {
+		return fmt.Errorf("error getting versionstamp for actor KV version: %w", err)
+	}
+	if version <= prev {
+		version = prev + 1
+	}
+
+	var marshaled [8]byte
+	binary.BigEndian.PutUint64(marshaled[:], uint64(version))
+	versionKey := getActorKVVersionKey(tr.namespace, tr.actorID, tr.moduleID, key)
+	if err := tr.tr.Put(ctx, versionKey, marshaled[:]); err != nil {
+		return fmt.Errorf("error putting actor KV version: %w", err)
+	}
+	return nil
+}
+
+func (tr *kvTransaction) IterPrefix(
+	ctx context.Context,
+	prefix []byte,
+	fn func(k, v []byte) error,
+) error {
+	// The tuple encoding of a byte string is a prefix of the encoding of every byte
+	// string that begins with it, except for the terminating 0x00 byte.
+	actorKVPrefix := getActoKVKey(tr.namespace, tr.actorID, tr.moduleID, prefix)
+	actorKVPrefix = actorKVPrefix[:len(actorKVPrefix)-1]
+	return tr.tr.IterPrefix(ctx, actorKVPrefix, func(k, v []byte) error {
+		t, err := tuple.Unpack(k)
+		if err != nil {
+			return fmt.Errorf("error unpacking actor KV key: %w", err)
+		}
+		key, ok := t[len(t)-1].([]byte)
+		if !ok {
+			return fmt.Errorf("actor KV key has wrong type: %T", t[len(t)-1])
+		}
+		return fn(key, v)
+	})
+}
+
 func (tr *kvTransaction) Commit(ctx context.Context) error {
 	return tr.tr.Commit(ctx)
 }
@@ -0,0 +1,111 @@
+package registry
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestPickServerRendezvousHash ensures that rendezvous hashing is deterministic, spreads
+// actors across servers, and only moves ~1/N of the actors when servers join or leave.
+func TestPickServerRendezvousHash(t *testing.T) {
+	const numActors = 10_000
+
+	servers := func(n int) []serverState {
+		servers := make([]serverState, 0, n)
+		for i := 0; i < n; i++ {
+			servers = append(servers, serverState{ServerID: fmt.Sprintf("server-%d", i)})
+		}
+		return servers
+	}
+	placements := func(servers []serverState) map[string]string {
+		placements := make(map[string]string, numActors)
+		for i := 0; i < numActors; i++ {
+			actorID := fmt.Sprintf("actor-%d", i)
+			placements[actorID] = pickServerRendezvousHash(
+				"ns", actorID, "module", servers).ServerID
+		}
+		return placements
+	}
+
+	before := placements(servers(10))
+	require.Equal(t, before, placements(servers(10)))
+
+	counts := make(map[string]int)
+	for _, serverID := range before {
+		counts[serverID]++
+	}
+	require.Len(t, counts, 10)
+	for serverID, count := range counts {
+		require.InDelta(t, numActors/10, count, numActors/10/2, serverID)
+	}
+
+	// Adding a server should only move ~1/11 of the actors, and only to the new server.
+	after := placements(servers(11))
+	moved := 0
+	for actorID, serverID := range before {
+		if after[actorID] != serverID {
+			moved++
+			require.Equal(t, "server-10", after[actorID])
+		}
+	}
+	require.InDelta(t, numActors/11, moved, numActors/11/2)
+
+	// Removing a server should only move the actors that were placed on it.
+	for actorID, serverID := range placements(servers(9)) {
+		if before[actorID] != "server-9" {
+			require.Equal(t, before[actorID], serverID)
+		}
+	}
+}
+
+// TestPickServerLeastLoaded ensures that the least loaded server is picked, with ties
+// broken by the number of activated actors.
+func TestPickServerLeastLoaded(t *testing.T) {
+	server := func(id string, load float64, numActivatedActors int) serverState {
+		return serverState{
+			ServerID: id,
+			HeartbeatState: HeartbeatState{
+				Load:               load,
+				NumActivatedActors: numActivatedActors,
+			},
+		}
+	}
+
+	require.Equal(t, "b", pickServerLeastLoaded([]serverState{
+		server("a", 0.9, 1),
+		server("b", 0.1, 100),
+		server("c", 0.5, 10),
+	}).ServerID)
+	require.Equal(t, "c", pickServerLeastLoaded([]serverState{
+		server("a", 0.9, 1),
+		server("b", 0.1, 100),
+		server("c", 0.1, 10),
+	}).ServerID)
+}
+
+// TestShardByPrefix ensures that ShardByPrefix extracts the shard key that is embedded in
+// actor IDs.
+func TestShardByPrefix(t *testing.T) {
+	shard := ShardByPrefix("/")
+	require.Equal(t, "tenant1", shard("ns", "module", "tenant1/a"))
+	require.Equal(t, "tenant1", shard("ns", "module", "tenant1/a/b"))
+	require.Equal(t, "", shard("ns", "module", "a"))
+	require.Equal(t, "", shard("ns", "module", "/a"))
+
+	// Shards are hashed within their namespace.
+	servers := []serverState{{ServerID: "a"}, {ServerID: "b"}, {ServerID: "c"}}
+	require.Equal(t,
+		pickServerShard("ns", "tenant1", servers),
+		pickServerShard("ns", "tenant1", []serverState{servers[2], servers[0], servers[1]}))
+}
+
+// TestVersionSinceClockSkew ensures that versionstamps that appear to go backwards, for
+// example because they were derived from the clocks of servers with skewed clocks, are
+// treated as no time having elapsed instead of failing.
+func TestVersionSinceClockSkew(t *testing.T) {
+	require.Equal(t, 5*time.Second, versionSince(10_000_000, 5_000_000))
+	require.Equal(t, time.Duration(0), versionSince(5, 10))
+}
@@ -3,6 +3,9 @@ package localregistry
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"log"
 	"sync"
 	"time"
 
@@ -19,9 +22,16 @@ type localKV struct {
 	// clone of b for current transaction, if any.
 	trClone *btree.BTreeG[btreeKV]
 	closed  bool
+
+	// snapshots is the zero value unless snapshots are enabled with startSnapshots().
+	snapshots SnapshotOptions
+	// stopSnapshots is closed to stop the goroutine that saves snapshots, which closes
+	// snapshotsDone once it's stopped.
+	stopSnapshots chan struct{}
+	snapshotsDone chan struct{}
 }
 
-func newLocalKV() kv.Store {
+func newLocalKV() *localKV {
 	return &localKV{
 		t: time.Now(),
 		b: btree.NewG(16, func(a, b btreeKV) bool {
@@ -57,7 +67,7 @@ func (l *localKV) Cancel(ctx context.Context) error {
 	return nil
 }
 
-func (l *localKV) Transact(fn func(kv.Transaction) (any, error)) (any, error) {
+func (l *localKV) Transact(ctx context.Context, fn func(kv.Transaction) (any, error)) (any, error) {
 	l.Lock()
 	defer l.Unlock()
 
@@ -69,7 +79,7 @@ func (l *localKV) Transact(fn func(kv.Transaction) (any, error)) (any, error) {
 	return result, err
 }
 
-func (l *localKV) UnsafeWipeAll() error {
+func (l *localKV) UnsafeWipeAll(ctx context.Context) error {
 	l.Lock()
 	defer l.Unlock()
 
@@ -79,12 +89,99 @@ func (l *localKV) UnsafeWipeAll() error {
 
 func (l *localKV) Close(ctx context.Context) error {
 	l.Lock()
-	defer l.Unlock()
-
+	alreadyClosed := l.closed
 	l.closed = true
+	l.Unlock()
+
+	if alreadyClosed || l.snapshots.Store == nil {
+		return nil
+	}
+	close(l.stopSnapshots)
+	<-l.snapshotsDone
+	if err := l.saveSnapshot(ctx); err != nil {
+		return fmt.Errorf("error saving final snapshot: %w", err)
+	}
 	return nil
 }
 
+// startSnapshots starts saving snapshots of the KV to opts.Store every opts.Interval
+// until the KV is closed.
+func (l *localKV) startSnapshots(opts SnapshotOptions) {
+	l.snapshots = opts
+	l.stopSnapshots = make(chan struct{})
+	l.snapshotsDone = make(chan struct{})
+	go func() {
+		defer close(l.snapshotsDone)
+
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stopSnapshots:
+				return
+			case <-ticker.C:
+				if err := l.saveSnapshot(context.Background()); err != nil {
+					log.Printf("error saving local registry snapshot: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (l *localKV) saveSnapshot(ctx context.Context) error {
+	snapshot, err := l.snapshot()
+	if err != nil {
+		return err
+	}
+	return l.snapshots.Store.Save(ctx, snapshot)
+}
+
+// snapshot returns the serialized state of the KV. It waits for the in-progress
+// transaction (if any) to complete so the snapshot is consistent.
+func (l *localKV) snapshot() ([]byte, error) {
+	l.Lock()
+	// Cloning is cheap since the clone is copy-on-write, so it's serialized without
+	// holding the lock.
+	var (
+		b            = l.b.Clone()
+		versionStamp = time.Since(l.t).Microseconds()
+	)
+	l.Unlock()
+
+	snapshot := localKVSnapshot{
+		Origin:       l.t,
+		VersionStamp: versionStamp,
+		KVs:          make([]localKVSnapshotKV, 0, b.Len()),
+	}
+	b.Ascend(func(item btreeKV) bool {
+		snapshot.KVs = append(snapshot.KVs, localKVSnapshotKV{K: item.k, V: item.v})
+		return true
+	})
+	marshaled, err := json.Marshal(&snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling snapshot: %w", err)
+	}
+	return marshaled, nil
+}
+
+// restore replaces the state of the KV with the provided snapshot and returns the
+// versionstamp at which the snapshot was taken.
+func (l *localKV) restore(marshaled []byte) (int64, error) {
+	var snapshot localKVSnapshot
+	if err := json.Unmarshal(marshaled, &snapshot); err != nil {
+		return 0, fmt.Errorf("error unmarshaling snapshot: %w", err)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.t = snapshot.Origin
+	l.b.Clear(false)
+	for _, item := range snapshot.KVs {
+		l.b.ReplaceOrInsert(btreeKV{item.K, item.V})
+	}
+	return snapshot.VersionStamp, nil
+}
+
 // "transaction" method so no lock because we're already locked.
 func (l *localKV) Put(
 	ctx context.Context,
@@ -115,6 +212,19 @@ func (l *localKV) Get(
 	return v.v, true, nil
 }
 
+// "transaction" method so no lock because we're already locked.
+func (l *localKV) Delete(
+	ctx context.Context,
+	k []byte,
+) error {
+	if l.closed {
+		panic("KV already closed")
+	}
+
+	l.b.Delete(btreeKV{k, nil})
+	return nil
+}
+
 // "transaction" method so no lock because we're already locked.
 func (l *localKV) IterPrefix(
 	ctx context.Context,
@@ -5,5 +5,16 @@ import "github.com/richardartoul/nola/virtual/registry"
 // NewLocalRegistry creates a new local (in-memory) registry. It is primarily used for
 // tests and simple benchmarking.
 func NewLocalRegistry() registry.Registry {
-	return registry.NewKVRegistry(newLocalKV())
+	reg, err := NewLocalRegistryWithOptions(registry.KVRegistryOptions{})
+	if err != nil {
+		// The default options are always valid.
+		panic(err)
+	}
+	return reg
+}
+
+// NewLocalRegistryWithOptions is the same as NewLocalRegistry, except it allows the
+// registry's options to be configured.
+func NewLocalRegistryWithOptions(opts registry.KVRegistryOptions) (registry.Registry, error) {
+	return registry.NewKVRegistry(newLocalKV(), opts)
 }
@@ -1,9 +1,17 @@
 package localregistry
 
 import (
+	"context"
+	"fmt"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestLocalRegistry(t *testing.T) {
@@ -11,3 +19,388 @@ func TestLocalRegistry(t *testing.T) {
 		return NewLocalRegistry()
 	})
 }
+
+func TestLocalRegistryWithSnapshots(t *testing.T) {
+	registry.TestAllCommon(t, func() registry.Registry {
+		reg, err := NewLocalRegistryWithSnapshots(
+			context.Background(), registry.KVRegistryOptions{}, SnapshotOptions{
+				Store: NewFileSnapshotStore(filepath.Join(t.TempDir(), "snapshot")),
+			})
+		require.NoError(t, err)
+		return reg
+	})
+}
+
+// TestLocalRegistrySnapshotRestore ensures that actors stay placed on the servers that
+// heartbeat again after the registry is restored from a snapshot.
+func TestLocalRegistrySnapshotRestore(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		opts = SnapshotOptions{Store: NewFileSnapshotStore(filepath.Join(t.TempDir(), "snapshot"))}
+	)
+	reg, err := NewLocalRegistryWithSnapshots(ctx, registry.KVRegistryOptions{}, opts)
+	require.NoError(t, err)
+
+	_, err = reg.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), registry.ModuleOptions{})
+	require.NoError(t, err)
+	_, err = reg.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	before, err := reg.EnsureActivation(ctx, "ns1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	vsBefore, err := reg.GetVersionStamp(ctx)
+	require.NoError(t, err)
+	// Closing the registry saves a final snapshot.
+	require.NoError(t, reg.Close(ctx))
+
+	reg, err = NewLocalRegistryWithSnapshots(ctx, registry.KVRegistryOptions{}, opts)
+	require.NoError(t, err)
+	defer reg.Close(ctx)
+
+	vsAfter, err := reg.GetVersionStamp(ctx)
+	require.NoError(t, err)
+	require.Greater(t, vsAfter, vsBefore)
+	module, _, err := reg.GetModule(ctx, "ns1", "test-module")
+	require.NoError(t, err)
+	require.Equal(t, []byte("wasm"), module)
+
+	// The server keeps its version, and therefore its actors, by heartbeating again.
+	result, err := reg.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	require.Equal(t, before[0].ServerVersion(), result.ServerVersion)
+	after, err := reg.EnsureActivation(ctx, "ns1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
+
+func TestLocalRegistryInvalidOptions(t *testing.T) {
+	_, err := NewLocalRegistryWithOptions(registry.KVRegistryOptions{
+		PlacementStrategy: "does-not-exist",
+	})
+	require.Error(t, err)
+
+	_, err = NewLocalRegistryWithSnapshots(
+		context.Background(), registry.KVRegistryOptions{}, SnapshotOptions{})
+	require.Error(t, err)
+}
+
+// TestLocalRegistryActivationLeases ensures that activations are only reused while their
+// lease is renewed, and that expired leases can't be renewed.
+func TestLocalRegistryActivationLeases(t *testing.T) {
+	const leaseDuration = 200 * time.Millisecond
+
+	ctx := context.Background()
+	reg, err := NewLocalRegistryWithOptions(registry.KVRegistryOptions{
+		ActivationLeaseDuration: leaseDuration,
+	})
+	require.NoError(t, err)
+	defer reg.Close(ctx)
+
+	_, err = reg.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), registry.ModuleOptions{})
+	require.NoError(t, err)
+	result, err := reg.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	require.Equal(t, leaseDuration, result.ActivationLeaseDuration)
+
+	refs, err := reg.EnsureActivation(ctx, "ns1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	lease := refs[0].Lease()
+	require.False(t, lease.IsZero())
+	require.True(t, lease.Duration > 0 && lease.Duration <= leaseDuration)
+
+	// The activation is reused while its lease is alive.
+	refs, err = reg.EnsureActivation(ctx, "ns1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, lease.Token, refs[0].Lease().Token)
+	refs, err = reg.LookupActivation(ctx, "ns1", "a", "test-module")
+	require.NoError(t, err)
+	require.Len(t, refs, 1)
+	require.Equal(t, lease.Token, refs[0].Lease().Token)
+
+	time.Sleep(leaseDuration / 2)
+	renewed, err := reg.RenewActivationLease(ctx, lease.Token)
+	require.NoError(t, err)
+	require.Equal(t, lease.Token, renewed.Token)
+	time.Sleep(leaseDuration / 2)
+	refs, err = reg.EnsureActivation(ctx, "ns1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, lease.Token, refs[0].Lease().Token)
+
+	// Once the lease expires the actor is considered free and it's activated again.
+	time.Sleep(leaseDuration)
+	_, err = reg.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	refs, err = reg.LookupActivation(ctx, "ns1", "a", "test-module")
+	require.NoError(t, err)
+	require.Empty(t, refs)
+	refs, err = reg.EnsureActivation(ctx, "ns1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.NotEqual(t, lease.Token, refs[0].Lease().Token)
+
+	_, err = reg.RenewActivationLease(ctx, lease.Token)
+	require.True(t, registry.IsActivationLeaseExpiredErr(err))
+	_, err = reg.RenewActivationLease(ctx, refs[0].Lease().Token)
+	require.NoError(t, err)
+}
+
+// TestLocalRegistryActivationLeasesDisabled ensures that no leases are granted by
+// default.
+func TestLocalRegistryActivationLeasesDisabled(t *testing.T) {
+	ctx := context.Background()
+	reg := NewLocalRegistry()
+	defer reg.Close(ctx)
+
+	_, err := reg.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), registry.ModuleOptions{})
+	require.NoError(t, err)
+	result, err := reg.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	require.Zero(t, result.ActivationLeaseDuration)
+
+	refs, err := reg.EnsureActivation(ctx, "ns1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.True(t, refs[0].Lease().IsZero())
+	_, err = reg.RenewActivationLease(ctx, "token")
+	require.Error(t, err)
+}
+
+// TestLocalRegistryBulkEnsureActivation ensures that BulkEnsureActivation ensures the
+// activation of every actor in the batch within a single transaction.
+func TestLocalRegistryBulkEnsureActivation(t *testing.T) {
+	ctx := context.Background()
+	store := &countingKV{Store: newLocalKV()}
+	reg, err := registry.NewKVRegistry(store, registry.KVRegistryOptions{})
+	require.NoError(t, err)
+	defer reg.Close(ctx)
+
+	_, err = reg.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), registry.ModuleOptions{})
+	require.NoError(t, err)
+	_, err = reg.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+
+	actorIDs := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		actorIDs = append(actorIDs, fmt.Sprintf("actor-%d", i))
+	}
+	store.numTransactions = 0
+	results, err := reg.BulkEnsureActivation(
+		ctx, "ns1", "test-module", actorIDs, registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 1, store.numTransactions)
+	require.Len(t, results, len(actorIDs))
+	for i, result := range results {
+		require.NoError(t, result.Err)
+		require.Equal(t, actorIDs[i], result.References[0].ActorID().ID)
+	}
+
+	// The activations were committed.
+	refs, err := reg.LookupActivation(ctx, "ns1", "actor-99", "test-module")
+	require.NoError(t, err)
+	require.Equal(t, results[99].References[0].ServerID(), refs[0].ServerID())
+}
+
+// countingKV is a kv.Store that counts the transactions that are run with Transact.
+type countingKV struct {
+	kv.Store
+	numTransactions int
+}
+
+func (c *countingKV) Transact(
+	ctx context.Context,
+	fn func(kv.Transaction) (any, error),
+) (any, error) {
+	c.numTransactions++
+	return c.Store.Transact(ctx, fn)
+}
+
+// TestLocalRegistrySharding ensures that the actors of a shard are colocated, and fail
+// over together, regardless of the placement strategy.
+func TestLocalRegistrySharding(t *testing.T) {
+	ctx := context.Background()
+	reg, err := NewLocalRegistryWithOptions(registry.KVRegistryOptions{
+		PlacementStrategy: registry.PlacementStrategyFewestActors,
+		ShardFunc:         registry.ShardByPrefix("/"),
+	})
+	require.NoError(t, err)
+	defer reg.Close(ctx)
+
+	_, err = reg.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), registry.ModuleOptions{})
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		serverID := fmt.Sprintf("server%d", i)
+		_, err = reg.Heartbeat(ctx, serverID, registry.HeartbeatState{
+			Address:            serverID + "_address",
+			NumActivatedActors: 10 * i,
+		})
+		require.NoError(t, err)
+	}
+
+	ensure := func(actorID string) types.ActorReference {
+		refs, err := reg.EnsureActivation(ctx, "ns1", actorID, "test-module", registry.EnsureActivationOptions{
+			NumFailoverCandidates: 2,
+		})
+		require.NoError(t, err)
+		require.Len(t, refs, 1)
+		return refs[0]
+	}
+	failoverServerIDs := func(ref types.ActorReference) []string {
+		var serverIDs []string
+		for _, candidate := range ref.FailoverCandidates() {
+			serverIDs = append(serverIDs, candidate.ServerID())
+		}
+		return serverIDs
+	}
+
+	// The fewest actors strategy would place every actor on server0.
+	shardServerIDs := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		shard := fmt.Sprintf("shard%d", i%2)
+		ref := ensure(fmt.Sprintf("%s/%d", shard, i))
+		serverID, ok := shardServerIDs[shard]
+		if !ok {
+			shardServerIDs[shard] = ref.ServerID()
+			continue
+		}
+		require.Equal(t, serverID, ref.ServerID())
+	}
+	require.NotEqual(t, shardServerIDs["shard0"], shardServerIDs["shard1"])
+	require.Equal(t, failoverServerIDs(ensure("shard0/a")), failoverServerIDs(ensure("shard0/b")))
+
+	// Actors without a shard are placed according to the placement strategy.
+	require.Equal(t, "server0", ensure("unsharded").ServerID())
+}
+
+// TestMigrate ensures that Migrate copies modules and placement state between registries,
+// that it can be called repeatedly, and that it detects registries whose counts differ.
+func TestMigrate(t *testing.T) {
+	var (
+		ctx = context.Background()
+		src = NewLocalRegistry()
+		dst = NewLocalRegistry()
+	)
+	defer src.Close(ctx)
+	defer dst.Close(ctx)
+
+	_, err := src.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), registry.ModuleOptions{})
+	require.NoError(t, err)
+	_, err = src.RegisterModule(ctx, "ns2", "go-module", nil, registry.ModuleOptions{AllowEmptyModuleBytes: true})
+	require.NoError(t, err)
+	_, err = src.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	_, err = src.EnsureActivation(ctx, "ns1", "b", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.NoError(t, src.IncGeneration(ctx, "ns1", "b", "test-module"))
+	before := make(map[string][]types.ActorReference)
+	for _, actorID := range []string{"a", "b"} {
+		refs, err := src.EnsureActivation(ctx, "ns1", actorID, "test-module", registry.EnsureActivationOptions{})
+		require.NoError(t, err)
+		before[actorID] = refs
+	}
+
+	result, err := registry.Migrate(ctx, src, dst, registry.MigrateOptions{})
+	require.NoError(t, err)
+	require.Equal(t, registry.MigrateResult{
+		ModulesCopied: 2,
+		Source:        registry.MigrationCounts{Modules: 2},
+		Destination:   registry.MigrationCounts{Modules: 2},
+	}, result)
+	module, _, err := dst.GetModule(ctx, "ns1", "test-module")
+	require.NoError(t, err)
+	require.Equal(t, []byte("wasm"), module)
+	_, opts, err := dst.GetModule(ctx, "ns2", "go-module")
+	require.NoError(t, err)
+	require.True(t, opts.AllowEmptyModuleBytes)
+
+	// Placements are only copied when requested, and modules are not copied again.
+	_, _, err = registry.VerifyMigration(ctx, src, dst, registry.MigrateOptions{CopyPlacements: true})
+	require.True(t, registry.IsMigrationVerificationErr(err), err)
+	result, err = registry.Migrate(ctx, src, dst, registry.MigrateOptions{CopyPlacements: true})
+	require.NoError(t, err)
+	require.Equal(t, registry.MigrateResult{
+		ServersCopied: 1,
+		ActorsCopied:  2,
+		Source:        registry.MigrationCounts{Modules: 2, Actors: 2},
+		Destination:   registry.MigrationCounts{Modules: 2, Actors: 2},
+	}, result)
+
+	// The actors stay activated on the same server, with the same generation, and the
+	// server keeps its version by heartbeating dst.
+	srcPlacement, ok, err := src.(registry.MigratableRegistry).GetActorPlacement(ctx, "ns1", "b", "test-module")
+	require.NoError(t, err)
+	require.True(t, ok)
+	dstPlacement, ok, err := dst.(registry.MigratableRegistry).GetActorPlacement(ctx, "ns1", "b", "test-module")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, srcPlacement, dstPlacement)
+	require.Equal(t, uint64(2), dstPlacement.Generation)
+	hbResult, err := dst.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	require.Equal(t, before["a"][0].ServerVersion(), hbResult.ServerVersion)
+	for actorID, refs := range before {
+		after, err := dst.EnsureActivation(ctx, "ns1", actorID, "test-module", registry.EnsureActivationOptions{})
+		require.NoError(t, err)
+		require.Equal(t, refs, after)
+	}
+
+	// Registries that don't implement MigratableRegistry are rejected.
+	_, err = registry.Migrate(ctx, src, notMigratableRegistry{dst}, registry.MigrateOptions{})
+	require.Error(t, err)
+}
+
+// TestDualWriteRegistry ensures that the dual-write registry keeps the destination
+// registry consistent with the source registry.
+func TestDualWriteRegistry(t *testing.T) {
+	var (
+		ctx = context.Background()
+		src = NewLocalRegistry()
+		dst = NewLocalRegistry()
+	)
+	_, err := src.RegisterModule(ctx, "ns1", "old-module", []byte("old"), registry.ModuleOptions{})
+	require.NoError(t, err)
+
+	reg, err := registry.NewDualWriteRegistry(src, dst)
+	require.NoError(t, err)
+	defer reg.Close(ctx)
+
+	// Modules that were registered before are copied when they're read.
+	_, err = reg.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), registry.ModuleOptions{})
+	require.NoError(t, err)
+	_, _, err = dst.GetModule(ctx, "ns1", "old-module")
+	require.True(t, registry.IsModuleDoesNotExistErr(err), err)
+	_, _, err = reg.GetModule(ctx, "ns1", "old-module")
+	require.NoError(t, err)
+	module, _, err := dst.GetModule(ctx, "ns1", "old-module")
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), module)
+
+	hbResult, err := reg.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	refs, err := reg.EnsureActivation(ctx, "ns1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	results, err := reg.BulkEnsureActivation(
+		ctx, "ns1", "test-module", []string{"b", "c"}, registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	for _, result := range results {
+		require.NoError(t, result.Err)
+	}
+	require.NoError(t, reg.IncGeneration(ctx, "ns1", "a", "test-module"))
+
+	counts, _, err := registry.VerifyMigration(ctx, src, dst, registry.MigrateOptions{CopyPlacements: true})
+	require.NoError(t, err)
+	require.Equal(t, registry.MigrationCounts{Modules: 2, Actors: 3}, counts)
+	placement, ok, err := dst.(registry.MigratableRegistry).GetActorPlacement(ctx, "ns1", "a", "test-module")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, uint64(2), placement.Generation)
+
+	// Flipping traffic to dst keeps the actors where they are.
+	dstResult, err := dst.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	require.Equal(t, hbResult.ServerVersion, dstResult.ServerVersion)
+	after, err := dst.EnsureActivation(ctx, "ns1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, refs[0].ServerID(), after[0].ServerID())
+	require.Equal(t, refs[0].ServerVersion(), after[0].ServerVersion())
+}
+
+type notMigratableRegistry struct {
+	registry.Registry
+}
@@ -0,0 +1,156 @@
+package localregistry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+)
+
+const defaultSnapshotInterval = 10 * time.Second
+
+// SnapshotStore persists the snapshots of a local registry.
+type SnapshotStore interface {
+	// Load returns the most recently saved snapshot, or false if no snapshot has been
+	// saved yet.
+	Load(ctx context.Context) ([]byte, bool, error)
+	// Save replaces the most recently saved snapshot. It must be atomic so that a
+	// partially saved snapshot is never loaded.
+	Save(ctx context.Context, snapshot []byte) error
+}
+
+// NewFileSnapshotStore returns a SnapshotStore that stores the snapshot in the file at
+// path.
+func NewFileSnapshotStore(path string) SnapshotStore {
+	return fileSnapshotStore{path: path}
+}
+
+type fileSnapshotStore struct {
+	path string
+}
+
+func (f fileSnapshotStore) Load(ctx context.Context) ([]byte, bool, error) {
+	snapshot, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error reading snapshot file: %w", err)
+	}
+	return snapshot, true, nil
+}
+
+func (f fileSnapshotStore) Save(ctx context.Context, snapshot []byte) error {
+	// Write to a temporary file and rename it so that a crash while writing never leaves
+	// a truncated snapshot behind.
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary snapshot file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(snapshot); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing temporary snapshot file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing temporary snapshot file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary snapshot file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("error renaming temporary snapshot file: %w", err)
+	}
+	return nil
+}
+
+// SnapshotOptions contains the options for persisting the state of a local registry so
+// that it survives restarts of the process that runs it.
+type SnapshotOptions struct {
+	// Store is where snapshots are saved to and loaded from. Required.
+	Store SnapshotStore
+	// Interval is the interval at which snapshots are saved. A final snapshot is also
+	// saved when the registry is closed.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 10 seconds.
+	Interval time.Duration
+}
+
+// Validate validates the SnapshotOptions.
+func (o *SnapshotOptions) Validate() error {
+	if o.Store == nil {
+		return errors.New("Store is required")
+	}
+	if o.Interval < 0 {
+		return errors.New("Interval must be >= 0")
+	}
+	return nil
+}
+
+// NewLocalRegistryWithSnapshots is the same as NewLocalRegistryWithOptions, except the
+// registry's entire state (modules, actor placement, server liveness, actor KV storage,
+// reminders, etc) is periodically saved to snapshotOpts.Store, and restored from the
+// latest snapshot when the registry is created.
+//
+// This prevents every actor from being reactivated elsewhere when the registry
+// restarts: servers that were alive when the snapshot was saved are given
+// registry.HeartbeatTTL to heartbeat again and keep their actors, while the actors of
+// the servers that don't are placed elsewhere like usual. Note that changes that were
+// made after the latest snapshot was saved are lost if the registry doesn't exit
+// cleanly.
+func NewLocalRegistryWithSnapshots(
+	ctx context.Context,
+	opts registry.KVRegistryOptions,
+	snapshotOpts SnapshotOptions,
+) (registry.Registry, error) {
+	if err := snapshotOpts.Validate(); err != nil {
+		return nil, fmt.Errorf("error validating SnapshotOptions: %w", err)
+	}
+	if snapshotOpts.Interval == 0 {
+		snapshotOpts.Interval = defaultSnapshotInterval
+	}
+
+	kv := newLocalKV()
+	snapshot, ok, err := snapshotOpts.Store.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error loading snapshot: %w", err)
+	}
+	if ok {
+		versionStamp, err := kv.restore(snapshot)
+		if err != nil {
+			return nil, fmt.Errorf("error restoring snapshot: %w", err)
+		}
+		if err := registry.ExtendServerHeartbeats(ctx, kv, versionStamp); err != nil {
+			return nil, fmt.Errorf("error extending server heartbeats: %w", err)
+		}
+	}
+
+	reg, err := registry.NewKVRegistry(kv, opts)
+	if err != nil {
+		return nil, err
+	}
+	kv.startSnapshots(snapshotOpts)
+	return reg, nil
+}
+
+// localKVSnapshot is the serialized state of a localKV.
+type localKVSnapshot struct {
+	// Origin is the time from which versionstamps are measured. It's restored so that
+	// versionstamps keep increasing monotonically across restarts.
+	Origin time.Time `json:"origin"`
+	// VersionStamp is the versionstamp at which the snapshot was taken.
+	VersionStamp int64               `json:"version_stamp"`
+	KVs          []localKVSnapshotKV `json:"kvs"`
+}
+
+type localKVSnapshotKV struct {
+	K []byte `json:"k"`
+	V []byte `json:"v"`
+}
@@ -0,0 +1,456 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/virtual/registry/tuple"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+// ErrMigrationVerificationFailed is returned (wrapped) by Migrate() and VerifyMigration()
+// when the destination registry doesn't contain the same number of modules (or actors, if
+// placements were copied) as the source registry.
+var ErrMigrationVerificationFailed = errors.New("migration verification failed")
+
+// IsMigrationVerificationErr returns a boolean indicating whether the error is (or wraps)
+// ErrMigrationVerificationFailed.
+func IsMigrationVerificationErr(err error) bool {
+	return errors.Is(err, ErrMigrationVerificationFailed)
+}
+
+// MigratableRegistry is implemented by the registries that can be the source or the
+// destination of Migrate(). The registries returned by NewKVRegistry (and therefore all
+// the KV-backed registries) implement it.
+type MigratableRegistry interface {
+	Registry
+
+	// ListModules lists the namespace and ID of every registered module.
+	ListModules(ctx context.Context) ([]types.NamespacedIDNoType, error)
+
+	// ListServers lists the placement state of every live server.
+	ListServers(ctx context.Context) ([]ServerPlacement, error)
+
+	// PutServer creates or replaces the placement state of a server, and treats it as a
+	// heartbeat of the server.
+	PutServer(ctx context.Context, server ServerPlacement) error
+
+	// ListActorPlacements lists the placement state of every actor.
+	ListActorPlacements(ctx context.Context) ([]ActorPlacement, error)
+
+	// GetActorPlacement returns the placement state of the provided actor, and false if
+	// the actor does not exist.
+	GetActorPlacement(
+		ctx context.Context,
+		namespace,
+		actorID string,
+		moduleID string,
+	) (ActorPlacement, bool, error)
+
+	// PutActorPlacement creates or replaces the placement state of an actor. Activation
+	// leases are specific to the registry that granted them, so the activation is granted
+	// a new lease the next time the actor is activated, unless it's already activated on
+	// the same server (and server version) in which case its current lease is kept.
+	PutActorPlacement(ctx context.Context, placement ActorPlacement) error
+}
+
+// ServerPlacement is the state of a server that the registry needs to place actors on
+// it.
+type ServerPlacement struct {
+	ServerID       string
+	ServerVersion  int64
+	HeartbeatState HeartbeatState
+}
+
+// ActorPlacement is the state of an actor that the registry needs to locate it.
+type ActorPlacement struct {
+	Namespace  string
+	ModuleID   string
+	ActorID    string
+	Options    types.ActorOptions
+	Generation uint64
+	// ServerID and ServerVersion identify the server that the actor is activated on.
+	// They're empty if the actor was never activated.
+	ServerID      string
+	ServerVersion int64
+}
+
+// MigrateOptions contains the options for Migrate().
+type MigrateOptions struct {
+	// CopyPlacements controls whether the placement state (the live servers and the
+	// activations of every actor) is copied in addition to the module registrations.
+	// Copying it prevents every actor from being activated again once traffic is flipped
+	// to the destination registry.
+	CopyPlacements bool
+}
+
+// MigrationCounts contains the number of entries in a registry that Migrate() compares
+// to verify a migration.
+type MigrationCounts struct {
+	Modules int
+	// Actors is only counted if placements were copied.
+	Actors int
+}
+
+// MigrateResult is the result of a call to Migrate().
+type MigrateResult struct {
+	// ModulesCopied is the number of modules that were copied. Modules that were already
+	// registered in the destination registry are not copied again.
+	ModulesCopied int
+	ServersCopied int
+	ActorsCopied  int
+	// Source and Destination are the counts that were compared to verify the migration.
+	Source      MigrationCounts
+	Destination MigrationCounts
+}
+
+// Migrate copies the module registrations, and optionally the placement state, of src to
+// dst and then verifies that dst contains the same number of modules (and actors) as src.
+// Both registries must implement MigratableRegistry. Migrate can be called repeatedly,
+// for example to retry a migration that failed halfway through.
+//
+// Migrate doesn't copy the actors' KV storage, instantiate payloads and reminders, which
+// must be migrated separately.
+//
+// Changes that are made to src while it's running may not be copied, so the servers
+// should use the registry returned by NewDualWriteRegistry(src, dst) before Migrate is
+// called, and until traffic is flipped to dst.
+func Migrate(ctx context.Context, src, dst Registry, opts MigrateOptions) (MigrateResult, error) {
+	srcM, dstM, err := migratableRegistries(src, dst)
+	if err != nil {
+		return MigrateResult{}, err
+	}
+
+	var result MigrateResult
+	modules, err := srcM.ListModules(ctx)
+	if err != nil {
+		return MigrateResult{}, fmt.Errorf("Migrate: error listing source modules: %w", err)
+	}
+	for _, module := range modules {
+		moduleBytes, moduleOpts, err := srcM.GetModule(ctx, module.Namespace, module.ID)
+		if err != nil {
+			return result, fmt.Errorf("Migrate: error getting source module: %s: %w", module.ID, err)
+		}
+		copied, err := copyModule(ctx, dstM, module.Namespace, module.ID, moduleBytes, moduleOpts)
+		if err != nil {
+			return result, fmt.Errorf("Migrate: %w", err)
+		}
+		if copied {
+			result.ModulesCopied++
+		}
+	}
+
+	if opts.CopyPlacements {
+		// Copy the servers first so the actors' activations are valid as soon as they're
+		// copied.
+		servers, err := srcM.ListServers(ctx)
+		if err != nil {
+			return result, fmt.Errorf("Migrate: error listing source servers: %w", err)
+		}
+		for _, server := range servers {
+			if err := dstM.PutServer(ctx, server); err != nil {
+				return result, fmt.Errorf("Migrate: error copying server: %s: %w", server.ServerID, err)
+			}
+			result.ServersCopied++
+		}
+
+		placements, err := srcM.ListActorPlacements(ctx)
+		if err != nil {
+			return result, fmt.Errorf("Migrate: error listing source actors: %w", err)
+		}
+		for _, placement := range placements {
+			if err := dstM.PutActorPlacement(ctx, placement); err != nil {
+				return result, fmt.Errorf(
+					"Migrate: error copying actor: %s(%s): %w", placement.ActorID, placement.ModuleID, err)
+			}
+			result.ActorsCopied++
+		}
+	}
+
+	result.Source, result.Destination, err = VerifyMigration(ctx, src, dst, opts)
+	if err != nil {
+		return result, fmt.Errorf("Migrate: %w", err)
+	}
+	return result, nil
+}
+
+// VerifyMigration verifies that dst contains the same number of modules (and actors, if
+// opts.CopyPlacements is set) as src, and returns the counts that were compared. It
+// returns an error that wraps ErrMigrationVerificationFailed if they don't match.
+//
+// Migrate() already verifies the migration once it's done, but VerifyMigration can be
+// used to verify that the registries are still consistent right before flipping traffic.
+func VerifyMigration(
+	ctx context.Context,
+	src, dst Registry,
+	opts MigrateOptions,
+) (MigrationCounts, MigrationCounts, error) {
+	srcM, dstM, err := migratableRegistries(src, dst)
+	if err != nil {
+		return MigrationCounts{}, MigrationCounts{}, err
+	}
+	srcCounts, err := countMigrated(ctx, srcM, opts)
+	if err != nil {
+		return MigrationCounts{}, MigrationCounts{}, fmt.Errorf("error counting source registry: %w", err)
+	}
+	dstCounts, err := countMigrated(ctx, dstM, opts)
+	if err != nil {
+		return MigrationCounts{}, MigrationCounts{}, fmt.Errorf("error counting destination registry: %w", err)
+	}
+	if srcCounts != dstCounts {
+		return srcCounts, dstCounts, fmt.Errorf(
+			"%w: source registry has %d modules and %d actors, but destination registry has %d modules and %d actors",
+			ErrMigrationVerificationFailed,
+			srcCounts.Modules, srcCounts.Actors, dstCounts.Modules, dstCounts.Actors)
+	}
+	return srcCounts, dstCounts, nil
+}
+
+func migratableRegistries(src, dst Registry) (MigratableRegistry, MigratableRegistry, error) {
+	srcM, ok := src.(MigratableRegistry)
+	if !ok {
+		return nil, nil, fmt.Errorf("source registry: %T does not implement MigratableRegistry", src)
+	}
+	dstM, ok := dst.(MigratableRegistry)
+	if !ok {
+		return nil, nil, fmt.Errorf("destination registry: %T does not implement MigratableRegistry", dst)
+	}
+	return srcM, dstM, nil
+}
+
+func countMigrated(ctx context.Context, r MigratableRegistry, opts MigrateOptions) (MigrationCounts, error) {
+	modules, err := r.ListModules(ctx)
+	if err != nil {
+		return MigrationCounts{}, fmt.Errorf("error listing modules: %w", err)
+	}
+	counts := MigrationCounts{Modules: len(modules)}
+	if opts.CopyPlacements {
+		placements, err := r.ListActorPlacements(ctx)
+		if err != nil {
+			return MigrationCounts{}, fmt.Errorf("error listing actors: %w", err)
+		}
+		counts.Actors = len(placements)
+	}
+	return counts, nil
+}
+
+// copyModule registers the provided module in dst unless it's already registered, and
+// returns whether it was.
+func copyModule(
+	ctx context.Context,
+	dst Registry,
+	namespace,
+	moduleID string,
+	moduleBytes []byte,
+	opts ModuleOptions,
+) (bool, error) {
+	_, _, err := dst.GetModule(ctx, namespace, moduleID)
+	if err == nil {
+		return false, nil
+	}
+	if !IsModuleDoesNotExistErr(err) {
+		return false, fmt.Errorf("error getting destination module: %s: %w", moduleID, err)
+	}
+	if _, err := dst.RegisterModule(ctx, namespace, moduleID, moduleBytes, opts); err != nil {
+		return false, fmt.Errorf("error copying module: %s: %w", moduleID, err)
+	}
+	return true, nil
+}
+
+// TODO: The listing methods below scan the entire KV store in a single transaction, which
+//       may exceed the transaction limits of some stores (like FoundationDB's 5 second
+//       limit) for very large registries.
+
+func (k *kvRegistry) ListModules(ctx context.Context) ([]types.NamespacedIDNoType, error) {
+	modules, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		var modules []types.NamespacedIDNoType
+		err := tr.IterPrefix(ctx, nil, func(key, _ []byte) error {
+			t, err := tuple.Unpack(key)
+			if err != nil {
+				return fmt.Errorf("error unpacking key: %w", err)
+			}
+			// Only the first part of every module identifies it.
+			if len(t) != 4 || t[1] != "modules" || t[3] != int64(0) {
+				return nil
+			}
+			namespace, ok1 := t[0].(string)
+			moduleID, ok2 := t[2].(string)
+			if !ok1 || !ok2 {
+				return nil
+			}
+			modules = append(modules, types.NewNamespacedIDNoType(namespace, moduleID))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return modules, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ListModules: error: %w", WrapTimeoutErr(err))
+	}
+	return modules.([]types.NamespacedIDNoType), nil
+}
+
+func (k *kvRegistry) ListServers(ctx context.Context) ([]ServerPlacement, error) {
+	servers, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+
+		var servers []ServerPlacement
+		err = tr.IterPrefix(ctx, getServersPrefix(), func(k, v []byte) error {
+			var state serverState
+			if err := json.Unmarshal(v, &state); err != nil {
+				return fmt.Errorf("error unmarshaling server state: %w", err)
+			}
+			if versionSince(vs, state.LastHeartbeatedAt) >= HeartbeatTTL {
+				return nil
+			}
+			servers = append(servers, ServerPlacement{
+				ServerID:       state.ServerID,
+				ServerVersion:  state.ServerVersion,
+				HeartbeatState: state.HeartbeatState,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error iterating servers: %w", err)
+		}
+		return servers, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ListServers: error: %w", WrapTimeoutErr(err))
+	}
+	return servers.([]ServerPlacement), nil
+}
+
+func (k *kvRegistry) PutServer(ctx context.Context, server ServerPlacement) error {
+	_, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		vs, err := tr.GetVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+		marshaled, err := json.Marshal(&serverState{
+			ServerID:          server.ServerID,
+			LastHeartbeatedAt: vs,
+			HeartbeatState:    server.HeartbeatState,
+			ServerVersion:     server.ServerVersion,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling server state: %w", err)
+		}
+		return nil, tr.Put(ctx, getServerKey(server.ServerID), marshaled)
+	})
+	if err != nil {
+		return fmt.Errorf("PutServer: error: %w", WrapTimeoutErr(err))
+	}
+	return nil
+}
+
+func (k *kvRegistry) ListActorPlacements(ctx context.Context) ([]ActorPlacement, error) {
+	placements, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		var placements []ActorPlacement
+		err := tr.IterPrefix(ctx, nil, func(key, v []byte) error {
+			t, err := tuple.Unpack(key)
+			if err != nil {
+				return fmt.Errorf("error unpacking key: %w", err)
+			}
+			if len(t) != 5 || t[1] != "actors" || t[4] != "state" {
+				return nil
+			}
+			namespace, ok1 := t[0].(string)
+			_, ok2 := t[2].(string)
+			actorID, ok3 := t[3].(string)
+			if !ok1 || !ok2 || !ok3 {
+				return nil
+			}
+
+			var ra registeredActor
+			if err := json.Unmarshal(v, &ra); err != nil {
+				return fmt.Errorf("error unmarshaling registered actor: %w", err)
+			}
+			placements = append(placements, ra.placement(namespace, actorID))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return placements, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ListActorPlacements: error: %w", WrapTimeoutErr(err))
+	}
+	return placements.([]ActorPlacement), nil
+}
+
+func (k *kvRegistry) GetActorPlacement(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+) (ActorPlacement, bool, error) {
+	var placement ActorPlacement
+	ok, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		ra, ok, err := k.getActor(ctx, tr, getActorKey(namespace, actorID, moduleID))
+		if err != nil || !ok {
+			return false, err
+		}
+		placement = ra.placement(namespace, actorID)
+		return true, nil
+	})
+	if err != nil {
+		return ActorPlacement{}, false, fmt.Errorf("GetActorPlacement: error: %w", WrapTimeoutErr(err))
+	}
+	return placement, ok.(bool), nil
+}
+
+func (k *kvRegistry) PutActorPlacement(ctx context.Context, placement ActorPlacement) error {
+	actorKey := getActorKey(placement.Namespace, placement.ActorID, placement.ModuleID)
+	_, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		prev, ok, err := k.getActor(ctx, tr, actorKey)
+		if err != nil {
+			return nil, err
+		}
+
+		ra := registeredActor{
+			Opts:       placement.Options,
+			ModuleID:   placement.ModuleID,
+			Generation: placement.Generation,
+			Activation: activation{
+				ServerID:      placement.ServerID,
+				ServerVersion: placement.ServerVersion,
+			},
+		}
+		if ok &&
+			prev.Activation.ServerID == placement.ServerID &&
+			prev.Activation.ServerVersion == placement.ServerVersion {
+			ra.Activation = prev.Activation
+		}
+		marshaled, err := json.Marshal(&ra)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling registered actor: %w", err)
+		}
+		return nil, tr.Put(ctx, actorKey, marshaled)
+	})
+	if err != nil {
+		return fmt.Errorf("PutActorPlacement: error: %w", WrapTimeoutErr(err))
+	}
+	return nil
+}
+
+func (ra registeredActor) placement(namespace, actorID string) ActorPlacement {
+	return ActorPlacement{
+		Namespace:     namespace,
+		ModuleID:      ra.ModuleID,
+		ActorID:       actorID,
+		Options:       ra.Opts,
+		Generation:    ra.Generation,
+		ServerID:      ra.Activation.ServerID,
+		ServerVersion: ra.Activation.ServerVersion,
+	}
+}
@@ -0,0 +1,20 @@
+module github.com/richardartoul/nola/virtual/registry/redisregistry
+
+go 1.21
+
+replace github.com/richardartoul/nola => ../../../
+
+require (
+	github.com/redis/go-redis/v9 v9.0.2
+	github.com/richardartoul/nola v0.0.0-00010101000000-000000000000
+	github.com/stretchr/testify v1.8.1
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
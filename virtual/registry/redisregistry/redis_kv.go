@@ -0,0 +1,520 @@
+package redisregistry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// maxTransactRetries is the maximum number of times Transact() will retry a
+	// transaction that failed to commit due to a conflict with another transaction.
+	maxTransactRetries = 100
+
+	// valueField and versionField are the fields of the Redis hash of a key that store
+	// its value and its version.
+	valueField   = "value"
+	versionField = "version"
+)
+
+var errConflict = errors.New("redisKV: transaction conflict")
+
+// commitScript atomically validates a transaction's reads and applies its writes.
+//
+// The transaction is validated by checking that none of the keys it read changed version
+// (or was created or deleted), and that the set of keys in every prefix it iterated over
+// is the same as when it iterated over it. If validation fails nothing is written and 0
+// is returned so the transaction can be retried. Every commit that writes gets a new
+// version from the version counter and writes it next to the value of every key it
+// writes.
+//
+// KEYS[1]: keys sorted set, KEYS[2]: heartbeats sorted set, KEYS[3]: version counter,
+// followed by the hashes of the keys that were read, then the hashes of the deleted keys
+// and then the hashes of the written keys.
+//
+// ARGV[1]: number of read keys, ARGV[2]: number of iterated prefixes, ARGV[3]: number
+// of deleted keys, ARGV[4]: number of written keys, followed by the version of every
+// read key (0 if it didn't exist), then the iterated prefixes (see redisRange.args),
+// then the deleted keys and then key/value/isServer triplets for the writes.
+var commitScript = redis.NewScript(`
+local numReads = tonumber(ARGV[1])
+local numRanges = tonumber(ARGV[2])
+local numDeletes = tonumber(ARGV[3])
+local numWrites = tonumber(ARGV[4])
+local arg = 5
+for i = 1, numReads do
+	local version = redis.call('HGET', KEYS[3 + i], 'version')
+	if (version or '0') ~= ARGV[arg] then
+		return 0
+	end
+	arg = arg + 1
+end
+for i = 1, numRanges do
+	local prefix, min, max = ARGV[arg], ARGV[arg + 1], ARGV[arg + 2]
+	local includeServers, count = ARGV[arg + 3], tonumber(ARGV[arg + 4])
+	arg = arg + 5
+	local expected = {}
+	for j = arg, arg + count - 1 do
+		expected[ARGV[j]] = true
+	end
+	arg = arg + count
+	local found = 0
+	for _, key in ipairs(redis.call('ZRANGEBYLEX', KEYS[1], min, max)) do
+		if not expected[key] then
+			return 0
+		end
+		found = found + 1
+	end
+	if includeServers == '1' then
+		for _, key in ipairs(redis.call('ZRANGE', KEYS[2], 0, -1)) do
+			if string.sub(key, 1, #prefix) == prefix then
+				if not expected[key] then
+					return 0
+				end
+				found = found + 1
+			end
+		end
+	end
+	if found ~= count then
+		return 0
+	end
+end
+if numDeletes + numWrites == 0 then
+	return 1
+end
+-- Format explicitly since Lua numbers are converted to strings with limited precision.
+local version = string.format('%d', redis.call('INCR', KEYS[3]))
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local key = 3 + numReads
+for i = 1, numDeletes do
+	redis.call('DEL', KEYS[key + i])
+	redis.call('ZREM', KEYS[1], ARGV[arg])
+	redis.call('ZREM', KEYS[2], ARGV[arg])
+	arg = arg + 1
+end
+key = key + numDeletes
+for i = 1, numWrites do
+	redis.call('HSET', KEYS[key + i], 'value', ARGV[arg + 1], 'version', version)
+	if ARGV[arg + 2] == '1' then
+		redis.call('ZADD', KEYS[2], now, ARGV[arg])
+	else
+		redis.call('ZADD', KEYS[1], 0, ARGV[arg])
+	end
+	arg = arg + 3
+end
+return 1
+`)
+
+// versionStampScript returns the Redis server's time in microseconds, but never less
+// than or equal to the last value it returned so that the versionstamp is strictly
+// monotonic even if the Redis server's clock goes backwards.
+//
+// KEYS[1]: last versionstamp.
+var versionStampScript = redis.NewScript(`
+local t = redis.call('TIME')
+local vs = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local last = tonumber(redis.call('GET', KEYS[1]) or '0')
+if vs <= last then
+	vs = last + 1
+end
+-- Format explicitly since Lua numbers are converted to strings with limited precision.
+redis.call('SET', KEYS[1], string.format('%d', vs))
+return vs
+`)
+
+// serverKeysPrefix is the prefix of the keys that store the state of servers, which
+// are stored in the heartbeats sorted set instead of the keys sorted set.
+var serverKeysPrefix = registry.ServerKeysPrefix()
+
+// redisKV is an implementation of kv backed by Redis.
+//
+// Every key is stored in its own Redis hash, which holds its value and its version, so
+// actor placements are stored in hashes. Two sorted sets index the keys so that they can
+// be iterated over by prefix: the keys of the servers' state (which is written every
+// time a server heartbeats) are stored in the heartbeats sorted set, scored by the Redis
+// server's time in microseconds when they last heartbeated, and all the other keys are
+// stored in the keys sorted set, with all the scores set to 0 so that it is sorted
+// lexicographically. All the Redis keys share a hash tag so they're co-located in the
+// same slot when Redis Cluster is used.
+//
+// Transactions are optimistic: reads are performed directly against Redis and recorded
+// along with the version of every key that was read, writes are buffered in memory, and
+// on commit the reads are validated and the writes applied atomically by a script. If a
+// key that the transaction read (or the set of keys in a prefix that it iterated over)
+// changed in the meantime the commit fails and Transact() will retry. Conflicts are
+// detected per key so, for example, heartbeats only conflict with the transactions that
+// read the state of the server that heartbeats. Read-only transactions are validated
+// like any other transaction so that they observe a consistent snapshot.
+//
+// Counters are incremented with a read and a write (see kv.IncrTransaction): HINCRBY
+// can't be used since it stores counters as decimal strings rather than in the binary
+// format that the registry requires. The read is validated like any other read, so
+// concurrent increments of the same counter conflict and are retried.
+type redisKV struct {
+	client redis.UniversalClient
+
+	keyPrefix       string
+	keysKey         string
+	heartbeatsKey   string
+	versionKey      string
+	versionStampKey string
+}
+
+func newRedisKV(client redis.UniversalClient, keyPrefix string) kv.Store {
+	keyPrefix = fmt.Sprintf("{%s}", keyPrefix)
+	return &redisKV{
+		client:          client,
+		keyPrefix:       keyPrefix + ":kv:",
+		keysKey:         keyPrefix + ":keys",
+		heartbeatsKey:   keyPrefix + ":heartbeats",
+		versionKey:      keyPrefix + ":version",
+		versionStampKey: keyPrefix + ":versionstamp",
+	}
+}
+
+// hashKey returns the Redis key of the hash that stores the value and version of k.
+func (r *redisKV) hashKey(k string) string {
+	return r.keyPrefix + k
+}
+
+func (r *redisKV) BeginTransaction(ctx context.Context) (kv.Transaction, error) {
+	return &redisTransaction{
+		ctx:     ctx,
+		kv:      r,
+		reads:   make(map[string]int64),
+		writes:  make(map[string][]byte),
+		deletes: make(map[string]struct{}),
+	}, nil
+}
+
+func (r *redisKV) Transact(ctx context.Context, fn func(tr kv.Transaction) (any, error)) (any, error) {
+	for i := 0; ; i++ {
+		tr, err := r.BeginTransaction(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := fn(tr)
+		if err != nil {
+			tr.Cancel(ctx)
+			return nil, err
+		}
+
+		err = tr.Commit(ctx)
+		if err == nil {
+			return result, nil
+		}
+		if !errors.Is(err, errConflict) || i >= maxTransactRetries {
+			return nil, err
+		}
+	}
+}
+
+func (r *redisKV) Close(ctx context.Context) error {
+	return r.client.Close()
+}
+
+func (r *redisKV) UnsafeWipeAll(ctx context.Context) error {
+	redisKeys := []string{r.keysKey, r.heartbeatsKey, r.versionKey, r.versionStampKey}
+	for _, index := range []string{r.keysKey, r.heartbeatsKey} {
+		keys, err := r.client.ZRange(ctx, index, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			redisKeys = append(redisKeys, r.hashKey(k))
+		}
+	}
+	return r.client.Del(ctx, redisKeys...).Err()
+}
+
+type redisTransaction struct {
+	// ctx is the context that the transaction began with, which is used by the methods
+	// that don't accept one.
+	ctx context.Context
+	kv  *redisKV
+	// reads contains the version that every key that the transaction read from Redis
+	// had when it was first read, or 0 if it didn't exist.
+	reads map[string]int64
+	// ranges contains the prefixes that the transaction iterated over in Redis.
+	ranges []redisRange
+	writes map[string][]byte
+	// deletes contains the keys deleted by the transaction. A key is never in both writes
+	// and deletes.
+	deletes map[string]struct{}
+}
+
+// redisRange is a prefix that a transaction iterated over, along with the keys that
+// were stored in Redis under the prefix.
+type redisRange struct {
+	prefix []byte
+	keys   []string
+}
+
+// args returns the arguments that commitScript validates the range with: the prefix,
+// the min and max of the range of the keys sorted set, whether the range includes keys
+// of the heartbeats sorted set, the number of keys and the keys themselves.
+func (r redisRange) args() []any {
+	min, max := lexRange(r.prefix)
+	args := make([]any, 0, 5+len(r.keys))
+	args = append(args, r.prefix, min, max, boolArg(includesServerKeys(r.prefix)), len(r.keys))
+	for _, k := range r.keys {
+		args = append(args, k)
+	}
+	return args
+}
+
+func (tr *redisTransaction) Put(
+	ctx context.Context,
+	k, v []byte,
+) error {
+	// Copy v in case the caller reuses it or mutates it.
+	tr.writes[string(k)] = append([]byte(nil), v...)
+	delete(tr.deletes, string(k))
+	return nil
+}
+
+func (tr *redisTransaction) Get(
+	ctx context.Context,
+	k []byte,
+) ([]byte, bool, error) {
+	if v, ok := tr.writes[string(k)]; ok {
+		return v, true, nil
+	}
+	if _, ok := tr.deletes[string(k)]; ok {
+		return nil, false, nil
+	}
+
+	values, err := tr.read(ctx, []string{string(k)})
+	if err != nil {
+		return nil, false, err
+	}
+	v, ok := values[string(k)]
+	return v, ok, nil
+}
+
+// read reads the values of keys from Redis and records their versions so that the reads
+// are validated on commit. The returned map only contains the keys that exist.
+func (tr *redisTransaction) read(ctx context.Context, keys []string) (map[string][]byte, error) {
+	cmds := make([]*redis.SliceCmd, 0, len(keys))
+	_, err := tr.kv.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, k := range keys {
+			cmds = append(cmds, pipe.HMGet(ctx, tr.kv.hashKey(k), valueField, versionField))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("redisKV: error reading keys: %w", err)
+	}
+
+	values := make(map[string][]byte, len(keys))
+	for i, k := range keys {
+		var (
+			fields      = cmds[i].Val()
+			value, ok1  = fields[0].(string)
+			rawVer, ok2 = fields[1].(string)
+			version     int64
+		)
+		if ok1 && ok2 {
+			version, err = strconv.ParseInt(rawVer, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("redisKV: error parsing version of key: %s: %w", k, err)
+			}
+			values[k] = []byte(value)
+		}
+		if _, ok := tr.reads[k]; !ok {
+			tr.reads[k] = version
+		}
+	}
+	return values, nil
+}
+
+func (tr *redisTransaction) Delete(
+	ctx context.Context,
+	k []byte,
+) error {
+	delete(tr.writes, string(k))
+	tr.deletes[string(k)] = struct{}{}
+	return nil
+}
+
+// Incr reads the counter through the transaction, so that the transaction's own writes
+// and deletes are taken into account and concurrent increments conflict, and writes its
+// new value.
+func (tr *redisTransaction) Incr(
+	ctx context.Context,
+	k []byte,
+	delta int64,
+) (int64, error) {
+	v, ok, err := tr.Get(ctx, k)
+	if err != nil {
+		return 0, err
+	}
+	var value int64
+	if ok {
+		value, err = wapcutils.DecodeCounter(v)
+		if err != nil {
+			return 0, err
+		}
+	}
+	value += delta
+	return value, tr.Put(ctx, k, wapcutils.EncodeCounter(value))
+}
+
+func (tr *redisTransaction) IterPrefix(
+	ctx context.Context,
+	prefix []byte,
+	fn func(k, v []byte) error,
+) error {
+	min, max := lexRange(prefix)
+	keys, err := tr.kv.client.ZRangeByLex(ctx, tr.kv.keysKey, &redis.ZRangeBy{
+		Min: min,
+		Max: max,
+	}).Result()
+	if err != nil {
+		return err
+	}
+	if includesServerKeys(prefix) {
+		serverKeys, err := tr.kv.client.ZRange(ctx, tr.kv.heartbeatsKey, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		for _, k := range serverKeys {
+			if bytes.HasPrefix([]byte(k), prefix) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	tr.ranges = append(tr.ranges, redisRange{prefix: prefix, keys: keys})
+
+	merged, err := tr.read(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	// Merge the committed keys with the transaction's own (uncommitted) writes so the
+	// transaction can read its own writes.
+	for key, v := range tr.writes {
+		if bytes.HasPrefix([]byte(key), prefix) {
+			merged[key] = v
+		}
+	}
+	for key := range tr.deletes {
+		delete(merged, key)
+	}
+
+	sorted := make([]string, 0, len(merged))
+	for key := range merged {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	for _, key := range sorted {
+		if err := fn([]byte(key), merged[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tr *redisTransaction) GetVersionStamp() (int64, error) {
+	vs, err := versionStampScript.Run(
+		tr.ctx, tr.kv.client, []string{tr.kv.versionStampKey}).Int64()
+	if err != nil {
+		return -1, fmt.Errorf("redisKV: error getting versionstamp: %w", err)
+	}
+	return vs, nil
+}
+
+func (tr *redisTransaction) Commit(ctx context.Context) error {
+	if len(tr.reads) == 0 && len(tr.ranges) == 0 &&
+		len(tr.writes) == 0 && len(tr.deletes) == 0 {
+		return nil
+	}
+
+	var (
+		numKeys = 3 + len(tr.reads) + len(tr.deletes) + len(tr.writes)
+		keys    = make([]string, 0, numKeys)
+		args    = make([]any, 0, 4+len(tr.reads)+len(tr.deletes)+3*len(tr.writes))
+	)
+	keys = append(keys, tr.kv.keysKey, tr.kv.heartbeatsKey, tr.kv.versionKey)
+	args = append(args, len(tr.reads), len(tr.ranges), len(tr.deletes), len(tr.writes))
+	for k, version := range tr.reads {
+		keys = append(keys, tr.kv.hashKey(k))
+		args = append(args, version)
+	}
+	for _, r := range tr.ranges {
+		args = append(args, r.args()...)
+	}
+	for k := range tr.deletes {
+		keys = append(keys, tr.kv.hashKey(k))
+		args = append(args, k)
+	}
+	for k, v := range tr.writes {
+		keys = append(keys, tr.kv.hashKey(k))
+		args = append(args, k, v, boolArg(bytes.HasPrefix([]byte(k), serverKeysPrefix)))
+	}
+
+	committed, err := commitScript.Run(ctx, tr.kv.client, keys, args...).Int()
+	if err != nil {
+		return fmt.Errorf("redisKV: error committing transaction: %w", err)
+	}
+	if committed == 0 {
+		return errConflict
+	}
+	return nil
+}
+
+func (tr *redisTransaction) Cancel(ctx context.Context) error {
+	tr.reads = nil
+	tr.ranges = nil
+	tr.writes = nil
+	tr.deletes = nil
+	return nil
+}
+
+// includesServerKeys returns whether the keys with the provided prefix can include keys
+// of the servers' state, which are indexed by the heartbeats sorted set.
+func includesServerKeys(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, serverKeysPrefix) || bytes.HasPrefix(serverKeysPrefix, prefix)
+}
+
+// lexRange returns the min and max of the ZRANGEBYLEX range of the keys with the
+// provided prefix.
+func lexRange(prefix []byte) (string, string) {
+	max := "+"
+	if end := prefixEnd(prefix); end != nil {
+		max = "(" + string(end)
+	}
+	return "[" + string(prefix), max
+}
+
+func boolArg(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// prefixEnd returns the smallest key that is greater than all the keys with the
+// provided prefix, or nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package redisregistry
+
+import (
+	"github.com/richardartoul/nola/virtual/registry"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// NewRedisRegistry creates a new Redis backed registry. All the registry's data is
+// stored under keys that begin with keyPrefix so multiple registries can share the
+// same Redis deployment.
+func NewRedisRegistry(
+	client redis.UniversalClient,
+	keyPrefix string,
+	opts registry.KVRegistryOptions,
+) (registry.Registry, error) {
+	return registry.NewKVRegistry(newRedisKV(client, keyPrefix), opts)
+}
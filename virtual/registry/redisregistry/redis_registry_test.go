@@ -0,0 +1,212 @@
+package redisregistry
+
+import (
+	"context"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisRegistry(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set, skipping Redis registry tests")
+	}
+
+	registry.TestAllCommon(t, func() registry.Registry {
+		client := redis.NewClient(&redis.Options{Addr: addr})
+		registry, err := NewRedisRegistry(client, "nola-test", registry.KVRegistryOptions{})
+		require.NoError(t, err)
+		require.NoError(t, registry.UnsafeWipeAll())
+		return registry
+	})
+}
+
+// TestRedisKVIncr ensures that the increments that the commit script applies wrap around
+// like the increments of int64s, and that they're consistent with the transaction's own
+// writes and deletes.
+func TestRedisKVIncr(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set, skipping Redis KV tests")
+	}
+
+	var (
+		ctx   = context.Background()
+		store = newRedisKV(redis.NewClient(&redis.Options{Addr: addr}), "nola-test-incr")
+	)
+	require.NoError(t, store.UnsafeWipeAll(ctx))
+	defer store.Close(ctx)
+
+	transact := func(fn func(tr kv.IncrTransaction)) {
+		_, err := store.Transact(ctx, func(tr kv.Transaction) (any, error) {
+			fn(tr.(kv.IncrTransaction))
+			return nil, nil
+		})
+		require.NoError(t, err)
+	}
+	incr := func(tr kv.IncrTransaction, key string, delta int64) int64 {
+		value, err := tr.Incr(ctx, []byte(key), delta)
+		require.NoError(t, err)
+		return value
+	}
+	get := func(key string) int64 {
+		var value int64
+		transact(func(tr kv.IncrTransaction) {
+			v, ok, err := tr.Get(ctx, []byte(key))
+			require.NoError(t, err)
+			require.True(t, ok)
+			value, err = wapcutils.DecodeCounter(v)
+			require.NoError(t, err)
+		})
+		return value
+	}
+
+	transact(func(tr kv.IncrTransaction) {
+		require.Equal(t, int64(255), incr(tr, "a", 255))
+		require.Equal(t, int64(256), incr(tr, "a", 1))
+		require.Equal(t, int64(math.MaxInt64), incr(tr, "max", math.MaxInt64))
+		require.NoError(t, tr.IterPrefix(ctx, []byte("a"), func(k, v []byte) error {
+			require.Equal(t, wapcutils.EncodeCounter(256), v)
+			return nil
+		}))
+	})
+	require.Equal(t, int64(256), get("a"))
+	require.Equal(t, int64(math.MaxInt64), get("max"))
+
+	// Carries, borrows and overflows.
+	transact(func(tr kv.IncrTransaction) {
+		require.Equal(t, int64(-1), incr(tr, "a", -257))
+		require.Equal(t, int64(math.MinInt64), incr(tr, "max", 1))
+	})
+	require.Equal(t, int64(-1), get("a"))
+	require.Equal(t, int64(math.MinInt64), get("max"))
+
+	// Counters that the transaction writes or deletes are incremented in place.
+	transact(func(tr kv.IncrTransaction) {
+		require.NoError(t, tr.Put(ctx, []byte("a"), wapcutils.EncodeCounter(10)))
+		require.Equal(t, int64(11), incr(tr, "a", 1))
+		require.NoError(t, tr.Delete(ctx, []byte("max")))
+		require.Equal(t, int64(2), incr(tr, "max", 2))
+	})
+	require.Equal(t, int64(11), get("a"))
+	require.Equal(t, int64(2), get("max"))
+
+	// Values that aren't counters can't be incremented.
+	transact(func(tr kv.IncrTransaction) {
+		require.NoError(t, tr.Put(ctx, []byte("b"), []byte("not a counter")))
+	})
+	transact(func(tr kv.IncrTransaction) {
+		_, err := tr.Incr(ctx, []byte("b"), 1)
+		require.Error(t, err)
+	})
+}
+
+// TestRedisKVConflicts ensures that transactions only conflict with the transactions that
+// wrote the keys they read, or keys in the prefixes they iterated over, including
+// read-only transactions.
+func TestRedisKVConflicts(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set, skipping Redis KV tests")
+	}
+
+	var (
+		ctx    = context.Background()
+		client = redis.NewClient(&redis.Options{Addr: addr})
+		store  = newRedisKV(client, "nola-test-conflicts")
+	)
+	require.NoError(t, store.UnsafeWipeAll(ctx))
+	defer store.Close(ctx)
+
+	begin := func() kv.Transaction {
+		tr, err := store.BeginTransaction(ctx)
+		require.NoError(t, err)
+		return tr
+	}
+	get := func(tr kv.Transaction, key string) {
+		_, _, err := tr.Get(ctx, []byte(key))
+		require.NoError(t, err)
+	}
+	put := func(tr kv.Transaction, key string) {
+		require.NoError(t, tr.Put(ctx, []byte(key), []byte("v")))
+	}
+	iter := func(tr kv.Transaction, prefix []byte) {
+		require.NoError(t, tr.IterPrefix(ctx, prefix, func(k, v []byte) error { return nil }))
+	}
+
+	// Writes to keys that the transaction didn't read don't conflict.
+	tr1, tr2 := begin(), begin()
+	get(tr1, "a")
+	put(tr1, "b")
+	put(tr2, "c")
+	require.NoError(t, tr2.Commit(ctx))
+	require.NoError(t, tr1.Commit(ctx))
+
+	// Writes to keys that the transaction read conflict, even if it's read-only.
+	tr1, tr2 = begin(), begin()
+	get(tr1, "b")
+	put(tr2, "b")
+	require.NoError(t, tr2.Commit(ctx))
+	require.ErrorIs(t, tr1.Commit(ctx), errConflict)
+
+	// Keys added to prefixes that the transaction iterated over conflict.
+	tr1, tr2 = begin(), begin()
+	iter(tr1, []byte("p"))
+	put(tr2, "p1")
+	require.NoError(t, tr2.Commit(ctx))
+	require.ErrorIs(t, tr1.Commit(ctx), errConflict)
+
+	// Heartbeats only conflict with the transactions that read the servers' state.
+	var (
+		server1 = string(append(append([]byte(nil), serverKeysPrefix...), "server1"...))
+		server2 = string(append(append([]byte(nil), serverKeysPrefix...), "server2"...))
+	)
+	tr1, tr2 = begin(), begin()
+	get(tr1, server1)
+	put(tr1, "a")
+	put(tr2, server2)
+	require.NoError(t, tr2.Commit(ctx))
+	require.NoError(t, tr1.Commit(ctx))
+
+	tr1, tr2 = begin(), begin()
+	iter(tr1, nil)
+	put(tr2, server1)
+	require.NoError(t, tr2.Commit(ctx))
+	require.ErrorIs(t, tr1.Commit(ctx), errConflict)
+
+	// The servers' state is indexed by the heartbeats sorted set and every key is stored
+	// in a hash.
+	heartbeats, err := client.ZRange(ctx, "{nola-test-conflicts}:heartbeats", 0, -1).Result()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{server1, server2}, heartbeats)
+	keys, err := client.ZRange(ctx, "{nola-test-conflicts}:keys", 0, -1).Result()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c", "p1"}, keys)
+	value, err := client.HGet(ctx, "{nola-test-conflicts}:kv:"+server1, valueField).Result()
+	require.NoError(t, err)
+	require.Equal(t, "v", value)
+
+	tr1 = begin()
+	var iterated []string
+	require.NoError(t, tr1.IterPrefix(ctx, nil, func(k, v []byte) error {
+		iterated = append(iterated, string(k))
+		return nil
+	}))
+	require.NoError(t, tr1.Commit(ctx))
+	require.Equal(t, []string{server1, server2, "a", "b", "c", "p1"}, iterated)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	require.Equal(t, []byte("b"), prefixEnd([]byte("a")))
+	require.Equal(t, []byte("ab"), prefixEnd([]byte("aa\xff")))
+	require.Nil(t, prefixEnd([]byte("\xff\xff")))
+	require.Nil(t, prefixEnd(nil))
+}
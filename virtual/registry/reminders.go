@@ -0,0 +1,361 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/kv"
+	"github.com/richardartoul/nola/virtual/registry/tuple"
+)
+
+var errStopIteration = errors.New("stop iteration")
+
+// Reminder is a durable, scheduled invocation of an actor. Unlike timers, reminders are
+// persisted in the registry so they fire even if the actor is not activated anywhere,
+// and they survive server restarts and actor migrations.
+type Reminder struct {
+	Namespace string
+	ActorID   string
+	ModuleID  string
+	Name      string
+	// DueTime is the next time at which the reminder will fire. For reminders returned
+	// by ClaimDueReminders, it is the time at which the reminder was due instead.
+	DueTime time.Time
+	// Period is the interval between subsequent firings of the reminder. A value of 0
+	// indicates the reminder only fires once.
+	Period time.Duration
+}
+
+// ReminderStorage contains the methods for interacting with the registry's durable
+// reminders.
+type ReminderStorage interface {
+	// RegisterReminder registers a reminder with the provided name for the provided actor
+	// that will fire at dueTime, and then every period after that if period is not 0. If
+	// the actor already has a reminder with the same name it is replaced.
+	RegisterReminder(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		moduleID string,
+		name string,
+		dueTime time.Time,
+		period time.Duration,
+	) error
+
+	// UnregisterReminder unregisters the reminder with the provided name for the provided
+	// actor. It is a no-op if the reminder does not exist.
+	UnregisterReminder(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		moduleID string,
+		name string,
+	) error
+
+	// ListReminders lists all of the reminders registered for the provided actor, sorted
+	// by name.
+	ListReminders(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		moduleID string,
+	) ([]Reminder, error)
+
+	// ClaimDueReminders atomically claims up to limit reminders whose due time is <= now,
+	// in order of due time. Claimed one-off reminders are removed, and claimed periodic
+	// reminders are rescheduled to their next due time after now, so each firing of a
+	// reminder is only ever claimed once even if multiple servers are claiming reminders
+	// concurrently.
+	ClaimDueReminders(
+		ctx context.Context,
+		now time.Time,
+		limit int,
+	) ([]Reminder, error)
+}
+
+func (k *kvRegistry) RegisterReminder(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	name string,
+	dueTime time.Time,
+	period time.Duration,
+) error {
+	_, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		reminderKey := getReminderKey(namespace, actorID, moduleID, name)
+		prev, ok, err := k.getReminder(ctx, tr, reminderKey)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			// Replacing an existing reminder so the old due time needs to be removed from
+			// the index.
+			err := tr.Delete(ctx, getReminderDueKey(prev.DueTime, namespace, actorID, moduleID, name))
+			if err != nil {
+				return nil, fmt.Errorf("error deleting previous reminder due time: %w", err)
+			}
+		}
+
+		return nil, k.putReminder(ctx, tr, namespace, actorID, moduleID, name, registeredReminder{
+			DueTime: dueTime.UnixMicro(),
+			Period:  period,
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("RegisterReminder: error: %w", err)
+	}
+	return nil
+}
+
+func (k *kvRegistry) UnregisterReminder(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	name string,
+) error {
+	_, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		reminderKey := getReminderKey(namespace, actorID, moduleID, name)
+		reminder, ok, err := k.getReminder(ctx, tr, reminderKey)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, nil
+		}
+
+		if err := tr.Delete(ctx, reminderKey); err != nil {
+			return nil, fmt.Errorf("error deleting reminder: %w", err)
+		}
+		err = tr.Delete(ctx, getReminderDueKey(reminder.DueTime, namespace, actorID, moduleID, name))
+		if err != nil {
+			return nil, fmt.Errorf("error deleting reminder due time: %w", err)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("UnregisterReminder: error: %w", err)
+	}
+	return nil
+}
+
+func (k *kvRegistry) ListReminders(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+) ([]Reminder, error) {
+	reminders, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		var reminders []Reminder
+		prefix := getRemindersPrefix(namespace, actorID, moduleID)
+		err := tr.IterPrefix(ctx, prefix, func(key, v []byte) error {
+			t, err := tuple.Unpack(key)
+			if err != nil {
+				return fmt.Errorf("error unpacking reminder key: %w", err)
+			}
+			name, ok := t[len(t)-1].(string)
+			if !ok {
+				return fmt.Errorf("reminder key has wrong type: %T", t[len(t)-1])
+			}
+
+			var reminder registeredReminder
+			if err := json.Unmarshal(v, &reminder); err != nil {
+				return fmt.Errorf("error unmarshaling reminder: %w", err)
+			}
+			reminders = append(reminders, reminder.toReminder(namespace, actorID, moduleID, name))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return reminders, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ListReminders: error: %w", err)
+	}
+	return reminders.([]Reminder), nil
+}
+
+func (k *kvRegistry) ClaimDueReminders(
+	ctx context.Context,
+	now time.Time,
+	limit int,
+) ([]Reminder, error) {
+	reminders, err := k.kv.Transact(ctx, func(tr kv.Transaction) (any, error) {
+		var (
+			nowMicros = now.UnixMicro()
+			due       []Reminder
+		)
+		err := tr.IterPrefix(ctx, getRemindersDuePrefix(), func(key, _ []byte) error {
+			if len(due) >= limit {
+				return errStopIteration
+			}
+
+			t, err := tuple.Unpack(key)
+			if err != nil {
+				return fmt.Errorf("error unpacking reminder due key: %w", err)
+			}
+			if len(t) != 7 {
+				return fmt.Errorf("reminder due key has wrong number of elements: %d", len(t))
+			}
+			dueTime, ok := t[2].(int64)
+			if !ok {
+				return fmt.Errorf("reminder due key has wrong type for due time: %T", t[2])
+			}
+			if dueTime > nowMicros {
+				// The index is sorted by due time so none of the remaining reminders are
+				// due either.
+				return errStopIteration
+			}
+
+			var fields [4]string
+			for i := range fields {
+				field, ok := t[i+3].(string)
+				if !ok {
+					return fmt.Errorf("reminder due key has wrong type: %T", t[i+3])
+				}
+				fields[i] = field
+			}
+			due = append(due, Reminder{
+				Namespace: fields[0],
+				ActorID:   fields[2],
+				ModuleID:  fields[1],
+				Name:      fields[3],
+				DueTime:   time.UnixMicro(dueTime),
+			})
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopIteration) {
+			return nil, err
+		}
+
+		// Don't modify the KV while iterating over it.
+		for i, r := range due {
+			if err := tr.Delete(ctx, getReminderDueKey(
+				r.DueTime.UnixMicro(), r.Namespace, r.ActorID, r.ModuleID, r.Name)); err != nil {
+				return nil, fmt.Errorf("error deleting reminder due time: %w", err)
+			}
+
+			reminderKey := getReminderKey(r.Namespace, r.ActorID, r.ModuleID, r.Name)
+			reminder, ok, err := k.getReminder(ctx, tr, reminderKey)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, fmt.Errorf(
+					"[invariant violated] reminder: %s for actor: %s has a due time, but does not exist",
+					r.Name, r.ActorID)
+			}
+			due[i].Period = reminder.Period
+
+			if reminder.Period <= 0 {
+				if err := tr.Delete(ctx, reminderKey); err != nil {
+					return nil, fmt.Errorf("error deleting reminder: %w", err)
+				}
+				continue
+			}
+
+			// Skip any firings that were missed (because no server claimed the reminder
+			// in time) instead of firing them all back to back.
+			periodMicros := reminder.Period.Microseconds()
+			if periodMicros <= 0 {
+				periodMicros = 1
+			}
+			reminder.DueTime += ((nowMicros-reminder.DueTime)/periodMicros + 1) * periodMicros
+			err = k.putReminder(ctx, tr, r.Namespace, r.ActorID, r.ModuleID, r.Name, reminder)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return due, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ClaimDueReminders: error: %w", err)
+	}
+	return reminders.([]Reminder), nil
+}
+
+func (k *kvRegistry) getReminder(
+	ctx context.Context,
+	tr kv.Transaction,
+	reminderKey []byte,
+) (registeredReminder, bool, error) {
+	v, ok, err := tr.Get(ctx, reminderKey)
+	if err != nil {
+		return registeredReminder{}, false, fmt.Errorf("error getting reminder: %w", err)
+	}
+	if !ok {
+		return registeredReminder{}, false, nil
+	}
+
+	var reminder registeredReminder
+	if err := json.Unmarshal(v, &reminder); err != nil {
+		return registeredReminder{}, false, fmt.Errorf("error unmarshaling reminder: %w", err)
+	}
+	return reminder, true, nil
+}
+
+func (k *kvRegistry) putReminder(
+	ctx context.Context,
+	tr kv.Transaction,
+	namespace string,
+	actorID string,
+	moduleID string,
+	name string,
+	reminder registeredReminder,
+) error {
+	marshaled, err := json.Marshal(&reminder)
+	if err != nil {
+		return fmt.Errorf("error marshaling reminder: %w", err)
+	}
+	if err := tr.Put(ctx, getReminderKey(namespace, actorID, moduleID, name), marshaled); err != nil {
+		return fmt.Errorf("error putting reminder: %w", err)
+	}
+	err = tr.Put(ctx, getReminderDueKey(reminder.DueTime, namespace, actorID, moduleID, name), nil)
+	if err != nil {
+		return fmt.Errorf("error putting reminder due time: %w", err)
+	}
+	return nil
+}
+
+func getRemindersPrefix(namespace, actorID, moduleID string) []byte {
+	return tuple.Tuple{namespace, "actors", moduleID, actorID, "reminders"}.Pack()
+}
+
+func getReminderKey(namespace, actorID, moduleID, name string) []byte {
+	return tuple.Tuple{namespace, "actors", moduleID, actorID, "reminders", name}.Pack()
+}
+
+// getReminderDueKey returns the key of the reminder in the index of reminders sorted by
+// due time that is used to claim due reminders efficiently.
+func getReminderDueKey(dueTime int64, namespace, actorID, moduleID, name string) []byte {
+	return tuple.Tuple{"reminders", "due", dueTime, namespace, moduleID, actorID, name}.Pack()
+}
+
+func getRemindersDuePrefix() []byte {
+	// The second element ensures the index never overlaps with the keys of a namespace
+	// that happens to be called "reminders".
+	return tuple.Tuple{"reminders", "due"}.Pack()
+}
+
+type registeredReminder struct {
+	// DueTime is the next due time in microseconds since the unix epoch.
+	DueTime int64
+	Period  time.Duration
+}
+
+func (r registeredReminder) toReminder(namespace, actorID, moduleID, name string) Reminder {
+	return Reminder{
+		Namespace: namespace,
+		ActorID:   actorID,
+		ModuleID:  moduleID,
+		Name:      name,
+		DueTime:   time.UnixMicro(r.DueTime),
+		Period:    r.Period,
+	}
+}
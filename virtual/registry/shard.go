@@ -0,0 +1,39 @@
+package registry
+
+import "strings"
+
+// ShardFunc maps an actor to the shard that it belongs to (see KVRegistryOptions.ShardFunc).
+// Actors for which it returns an empty shard are not sharded. It must be deterministic and
+// cheap since it's called every time an actor is placed.
+type ShardFunc func(namespace, moduleID, actorID string) string
+
+// ShardByPrefix returns a ShardFunc that uses the part of the actor's ID before the first
+// occurrence of sep as its shard, so that for example actors "tenant1/a" and "tenant1/b"
+// belong to shard "tenant1" with a sep of "/". Actors whose ID doesn't contain sep (or
+// starts with it) are not sharded.
+func ShardByPrefix(sep string) ShardFunc {
+	return func(namespace, moduleID, actorID string) string {
+		shard, _, ok := strings.Cut(actorID, sep)
+		if !ok {
+			return ""
+		}
+		return shard
+	}
+}
+
+// shard returns the shard of the provided actor, or an empty string if it's not sharded.
+func (k *kvRegistry) shard(namespace, moduleID, actorID string) string {
+	if k.opts.ShardFunc == nil {
+		return ""
+	}
+	return k.opts.ShardFunc(namespace, moduleID, actorID)
+}
+
+// shardKey returns the key parts that rendezvous hashing should use to place the provided
+// actor, which are its shard if it has one, or its identity otherwise.
+func (k *kvRegistry) shardKey(namespace, moduleID, actorID string) []string {
+	if shard := k.shard(namespace, moduleID, actorID); shard != "" {
+		return []string{namespace, "shard", shard}
+	}
+	return []string{namespace, moduleID, actorID}
+}
@@ -6,6 +6,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/richardartoul/nola/wapcutils"
+
 	"github.com/stretchr/testify/require"
 )
 
@@ -22,9 +24,61 @@ func TestAllCommon(t *testing.T, registryCtor func() Registry) {
 		testRegistryServiceDiscoveryAndEnsureActivation(t, registryCtor())
 	})
 
+	t.Run("draining servers", func(t *testing.T) {
+		testRegistryDrainingServers(t, registryCtor())
+	})
+
+	t.Run("blacklisted servers", func(t *testing.T) {
+		testRegistryBlacklistedServers(t, registryCtor())
+	})
+
+	t.Run("server capacity", func(t *testing.T) {
+		testRegistryServerCapacity(t, registryCtor())
+	})
+
+	t.Run("placement hints", func(t *testing.T) {
+		testRegistryPlacementHints(t, registryCtor())
+	})
+
+	t.Run("failover candidates", func(t *testing.T) {
+		testRegistryFailoverCandidates(t, registryCtor())
+	})
+
+	t.Run("live servers", func(t *testing.T) {
+		testRegistryLiveServers(t, registryCtor())
+	})
+
+	t.Run("bulk ensure activation", func(t *testing.T) {
+		testRegistryBulkEnsureActivation(t, registryCtor())
+	})
+
+	t.Run("lookup activation", func(t *testing.T) {
+		testRegistryLookupActivation(t, registryCtor())
+	})
+
 	t.Run("kv simple", func(t *testing.T) {
 		testKVSimple(t, registryCtor())
 	})
+
+	t.Run("kv delete and iter prefix", func(t *testing.T) {
+		testKVDeleteAndIterPrefix(t, registryCtor())
+	})
+
+	t.Run("kv versions", func(t *testing.T) {
+		testKVVersions(t, registryCtor())
+	})
+
+	t.Run("kv incr", func(t *testing.T) {
+		testKVIncr(t, registryCtor())
+	})
+
+	t.Run("reminders", func(t *testing.T) {
+		testReminders(t, registryCtor())
+	})
+
+	t.Run("instantiate payloads", func(t *testing.T) {
+		testInstantiatePayloads(t, registryCtor())
+	})
 }
 
 // testRegistrySimple is a basic smoke test that ensures we can register modules and create actors.
@@ -42,6 +96,11 @@ func testRegistrySimple(t *testing.T, registry Registry) {
 	// Succeeds with same module if different namespace.
 	_, err = registry.RegisterModule(ctx, "ns2", "test-module", []byte("wasm"), ModuleOptions{})
 	require.NoError(t, err)
+
+	// Getting a module that does not exist should fail with a recognizable error.
+	_, _, err = registry.GetModule(ctx, "ns3", "test-module")
+	require.True(t, IsModuleDoesNotExistErr(err))
+	require.ErrorIs(t, err, ErrModuleNotFound)
 }
 
 // testRegistryServiceDiscoveryAndEnsureActivation tests the combination of the
@@ -61,8 +120,8 @@ func testRegistryServiceDiscoveryAndEnsureActivation(t *testing.T, registry Regi
 	require.NoError(t, err)
 
 	// Should fail because there are no servers available to activate on.
-	_, err = registry.EnsureActivation(ctx, "ns1", "a", "test-module1")
-	require.Error(t, err)
+	_, err = registry.EnsureActivation(ctx, "ns1", "a", "test-module1", EnsureActivationOptions{})
+	require.ErrorIs(t, err, ErrNoEligibleServers)
 	require.False(t, IsActorDoesNotExistErr(err))
 
 	heartbeatResult, err := registry.Heartbeat(ctx, "server1", HeartbeatState{
@@ -74,7 +133,7 @@ func testRegistryServiceDiscoveryAndEnsureActivation(t *testing.T, registry Regi
 	require.Equal(t, HeartbeatTTL.Microseconds(), heartbeatResult.HeartbeatTTL)
 
 	// Should succeed now that we have a server to activate on.
-	activations, err := registry.EnsureActivation(ctx, "ns1", "a", "test-module1")
+	activations, err := registry.EnsureActivation(ctx, "ns1", "a", "test-module1", EnsureActivationOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 1, len(activations))
 	require.Equal(t, "server1", activations[0].ServerID())
@@ -89,7 +148,7 @@ func testRegistryServiceDiscoveryAndEnsureActivation(t *testing.T, registry Regi
 	// Ensure we get back all the same information but with the generation
 	// bumped now.
 	require.NoError(t, registry.IncGeneration(ctx, "ns1", "a", "test-module1"))
-	activations, err = registry.EnsureActivation(ctx, "ns1", "a", "test-module1")
+	activations, err = registry.EnsureActivation(ctx, "ns1", "a", "test-module1", EnsureActivationOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 1, len(activations))
 	require.Equal(t, "server1", activations[0].ServerID())
@@ -113,7 +172,7 @@ func testRegistryServiceDiscoveryAndEnsureActivation(t *testing.T, registry Regi
 	// Keep checking the activation of the existing actor, it should remain sticky to
 	// server 1.
 	for i := 0; i < 10; i++ {
-		activations, err := registry.EnsureActivation(ctx, "ns1", "a", "test-module1")
+		activations, err := registry.EnsureActivation(ctx, "ns1", "a", "test-module1", EnsureActivationOptions{})
 		require.NoError(t, err)
 		require.Equal(t, 1, len(activations))
 		require.Equal(t, "server1", activations[0].ServerID())
@@ -127,7 +186,7 @@ func testRegistryServiceDiscoveryAndEnsureActivation(t *testing.T, registry Regi
 
 	// Reuse the same actor ID, but with a different module. The registry should consider
 	// it a completely separate entity therefore it will go on a different server.
-	activations, err = registry.EnsureActivation(ctx, "ns1", "a", "test-module2")
+	activations, err = registry.EnsureActivation(ctx, "ns1", "a", "test-module2", EnsureActivationOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 1, len(activations))
 	require.Equal(t, "server2", activations[0].ServerID())
@@ -141,7 +200,7 @@ func testRegistryServiceDiscoveryAndEnsureActivation(t *testing.T, registry Regi
 	// Next 10 activations should all go to server2 for balancing purposes.
 	for i := 0; i < 10; i++ {
 		actorID := fmt.Sprintf("0-%d", i)
-		activations, err = registry.EnsureActivation(ctx, "ns1", actorID, "test-module1")
+		activations, err = registry.EnsureActivation(ctx, "ns1", actorID, "test-module1", EnsureActivationOptions{})
 		require.NoError(t, err)
 		require.Equal(t, 1, len(activations))
 		require.Equal(t, "server2", activations[0].ServerID())
@@ -157,7 +216,7 @@ func testRegistryServiceDiscoveryAndEnsureActivation(t *testing.T, registry Regi
 	var lastServerID string
 	for i := 0; i < 10; i++ {
 		actorID := fmt.Sprintf("1-%d", i)
-		activations, err = registry.EnsureActivation(ctx, "ns1", actorID, "test-module1")
+		activations, err = registry.EnsureActivation(ctx, "ns1", actorID, "test-module1", EnsureActivationOptions{})
 		require.NoError(t, err)
 		require.Equal(t, 1, len(activations))
 
@@ -192,16 +251,394 @@ func testRegistryServiceDiscoveryAndEnsureActivation(t *testing.T, registry Regi
 	// server2 because its the only one available.
 	for i := 0; i < 10; i++ {
 		actorID := fmt.Sprintf("2-%d", i)
-		activations, err = registry.EnsureActivation(ctx, "ns1", actorID, "test-module1")
+		activations, err = registry.EnsureActivation(ctx, "ns1", actorID, "test-module1", EnsureActivationOptions{})
 		require.NoError(t, err)
 		require.Equal(t, 1, len(activations))
 		require.Equal(t, "server2", activations[0].ServerID())
 	}
 }
 
+// testRegistryDrainingServers ensures that draining servers are not picked for new
+// activations, and that actors that are activated on them are moved to other servers.
+func testRegistryDrainingServers(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	_, err := registry.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), ModuleOptions{})
+	require.NoError(t, err)
+
+	_, err = registry.Heartbeat(ctx, "server1", HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	activations, err := registry.EnsureActivation(ctx, "ns1", "a", "test-module", EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "server1", activations[0].ServerID())
+
+	// Even though server1 has fewer activated actors, new activations go to server2 and
+	// the existing activation is moved once server1 starts draining.
+	_, err = registry.Heartbeat(ctx, "server2", HeartbeatState{
+		NumActivatedActors: 100,
+		Address:            "server2_address",
+	})
+	require.NoError(t, err)
+	_, err = registry.Heartbeat(ctx, "server1", HeartbeatState{
+		Address:  "server1_address",
+		Draining: true,
+	})
+	require.NoError(t, err)
+	for _, actorID := range []string{"a", "b"} {
+		activations, err = registry.EnsureActivation(ctx, "ns1", actorID, "test-module", EnsureActivationOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "server2", activations[0].ServerID())
+	}
+
+	// There is nowhere to activate actors once every server is draining.
+	_, err = registry.Heartbeat(ctx, "server2", HeartbeatState{
+		Address:  "server2_address",
+		Draining: true,
+	})
+	require.NoError(t, err)
+	_, err = registry.EnsureActivation(ctx, "ns1", "c", "test-module", EnsureActivationOptions{})
+	require.ErrorIs(t, err, ErrAllServersBlacklisted)
+}
+
+// testRegistryBlacklistedServers ensures that servers that are blacklisted by the caller
+// are not picked for new activations, that actors that are activated on them are moved to
+// other servers, and that the blacklist only applies to the calls that provide it.
+func testRegistryBlacklistedServers(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	_, err := registry.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), ModuleOptions{})
+	require.NoError(t, err)
+
+	_, err = registry.Heartbeat(ctx, "server1", HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	_, err = registry.Heartbeat(ctx, "server2", HeartbeatState{
+		NumActivatedActors: 100,
+		Address:            "server2_address",
+	})
+	require.NoError(t, err)
+	activations, err := registry.EnsureActivation(ctx, "ns1", "a", "test-module", EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "server1", activations[0].ServerID())
+
+	// Even though server1 has fewer activated actors, new activations go to server2 and
+	// the existing activation is moved while server1 is blacklisted.
+	blacklistServer1 := EnsureActivationOptions{BlacklistedServerIDs: []string{"server1"}}
+	for _, actorID := range []string{"a", "b"} {
+		activations, err = registry.EnsureActivation(ctx, "ns1", actorID, "test-module", blacklistServer1)
+		require.NoError(t, err)
+		require.Equal(t, "server2", activations[0].ServerID())
+	}
+
+	// The blacklist is not sticky.
+	activations, err = registry.EnsureActivation(ctx, "ns1", "a", "test-module", EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "server2", activations[0].ServerID())
+	activations, err = registry.EnsureActivation(ctx, "ns1", "c", "test-module", EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "server1", activations[0].ServerID())
+
+	// There is nowhere to activate actors once every server is blacklisted.
+	_, err = registry.EnsureActivation(ctx, "ns1", "d", "test-module", EnsureActivationOptions{
+		BlacklistedServerIDs: []string{"server1", "server2"},
+	})
+	require.ErrorIs(t, err, ErrAllServersBlacklisted)
+}
+
+// testRegistryFailoverCandidates ensures that references carry the requested number of
+// failover candidates, and that candidates are only picked from the eligible servers
+// other than the one that hosts the actor.
+func testRegistryFailoverCandidates(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	_, err := registry.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), ModuleOptions{})
+	require.NoError(t, err)
+	for _, serverID := range []string{"server1", "server2", "server3", "server4"} {
+		_, err = registry.Heartbeat(ctx, serverID, HeartbeatState{Address: serverID + "_address"})
+		require.NoError(t, err)
+	}
+
+	// Candidates are only returned if they're requested.
+	activations, err := registry.EnsureActivation(ctx, "ns1", "a", "test-module", EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Len(t, activations, 1)
+	require.Empty(t, activations[0].FailoverCandidates())
+	primary := activations[0].ServerID()
+
+	activations, err = registry.EnsureActivation(ctx, "ns1", "a", "test-module", EnsureActivationOptions{
+		NumFailoverCandidates: 2,
+	})
+	require.NoError(t, err)
+	require.Equal(t, primary, activations[0].ServerID())
+	candidates := activations[0].FailoverCandidates()
+	require.Len(t, candidates, 2)
+	require.NotEqual(t, candidates[0].ServerID(), candidates[1].ServerID())
+	for _, candidate := range candidates {
+		require.NotEqual(t, primary, candidate.ServerID())
+		require.Equal(t, candidate.ServerID()+"_address", candidate.Address())
+		require.Equal(t, activations[0].ActorID(), candidate.ActorID())
+		require.Equal(t, activations[0].Generation(), candidate.Generation())
+	}
+
+	// The ranking is stable.
+	again, err := registry.EnsureActivation(ctx, "ns1", "a", "test-module", EnsureActivationOptions{
+		NumFailoverCandidates: 2,
+	})
+	require.NoError(t, err)
+	require.Equal(t, candidates[0].ServerID(), again[0].FailoverCandidates()[0].ServerID())
+	require.Equal(t, candidates[1].ServerID(), again[0].FailoverCandidates()[1].ServerID())
+
+	// Blacklisted servers are never candidates, and there are only as many candidates as
+	// there are eligible servers.
+	activations, err = registry.EnsureActivation(ctx, "ns1", "a", "test-module", EnsureActivationOptions{
+		BlacklistedServerIDs:  []string{candidates[0].ServerID()},
+		NumFailoverCandidates: 10,
+	})
+	require.NoError(t, err)
+	require.Equal(t, primary, activations[0].ServerID())
+	require.Len(t, activations[0].FailoverCandidates(), 2)
+	require.Equal(t, candidates[1].ServerID(), activations[0].FailoverCandidates()[0].ServerID())
+	for _, candidate := range activations[0].FailoverCandidates() {
+		require.NotEqual(t, primary, candidate.ServerID())
+		require.NotEqual(t, candidates[0].ServerID(), candidate.ServerID())
+	}
+}
+
+// testRegistryServerCapacity ensures that servers that are at capacity are not picked for
+// new activations, but keep the actors that are already activated on them.
+func testRegistryLiveServers(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	// Live servers are only listed if they're requested.
+	result, err := registry.Heartbeat(ctx, "server2", HeartbeatState{Address: "server2_address"})
+	require.NoError(t, err)
+	require.Nil(t, result.LiveServers)
+
+	result, err = registry.Heartbeat(ctx, "server1", HeartbeatState{
+		Address:            "server1_address",
+		IncludeLiveServers: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []LiveServer{
+		{ServerID: "server1", Address: "server1_address"},
+		{ServerID: "server2", Address: "server2_address"},
+	}, result.LiveServers)
+}
+
+func testRegistryServerCapacity(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	_, err := registry.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), ModuleOptions{})
+	require.NoError(t, err)
+
+	_, err = registry.Heartbeat(ctx, "server1", HeartbeatState{
+		Address:        "server1_address",
+		MaxActivations: 1,
+	})
+	require.NoError(t, err)
+	activations, err := registry.EnsureActivation(ctx, "ns1", "a", "test-module", EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "server1", activations[0].ServerID())
+
+	// server1 is at capacity now.
+	_, err = registry.Heartbeat(ctx, "server1", HeartbeatState{
+		NumActivatedActors: 1,
+		Address:            "server1_address",
+		MaxActivations:     1,
+	})
+	require.NoError(t, err)
+	_, err = registry.EnsureActivation(ctx, "ns1", "b", "test-module", EnsureActivationOptions{})
+	require.ErrorIs(t, err, ErrNoEligibleServers)
+
+	// Even though server2 has more activated actors, new activations go to it since
+	// server1 is at capacity, but the existing activation stays on server1.
+	_, err = registry.Heartbeat(ctx, "server2", HeartbeatState{
+		NumActivatedActors: 100,
+		Address:            "server2_address",
+	})
+	require.NoError(t, err)
+	activations, err = registry.EnsureActivation(ctx, "ns1", "b", "test-module", EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "server2", activations[0].ServerID())
+	activations, err = registry.EnsureActivation(ctx, "ns1", "a", "test-module", EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "server1", activations[0].ServerID())
+}
+
+// testRegistryPlacementHints ensures that actors that share an affinity key are colocated,
+// that actors that share an anti-affinity group are spread across servers, and that
+// placement hints never override blacklisted servers.
+func testRegistryPlacementHints(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	_, err := registry.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), ModuleOptions{})
+	require.NoError(t, err)
+
+	serverIDs := []string{"server1", "server2", "server3", "server4"}
+	for _, serverID := range serverIDs {
+		_, err = registry.Heartbeat(ctx, serverID, HeartbeatState{Address: serverID + "_address"})
+		require.NoError(t, err)
+	}
+
+	ensure := func(actorID string, opts EnsureActivationOptions) string {
+		activations, err := registry.EnsureActivation(ctx, "ns1", actorID, "test-module", opts)
+		require.NoError(t, err)
+		require.Len(t, activations, 1)
+		return activations[0].ServerID()
+	}
+
+	// Actors that share an affinity key are colocated.
+	affinity := EnsureActivationOptions{AffinityKey: "key1"}
+	colocatedServerID := ensure("affinity-0", affinity)
+	for i := 1; i < 10; i++ {
+		require.Equal(t, colocatedServerID, ensure(fmt.Sprintf("affinity-%d", i), affinity))
+	}
+
+	// Blacklisting wins over affinity, but the actors still colocate with each other.
+	affinity.BlacklistedServerIDs = []string{colocatedServerID}
+	fallbackServerID := ensure("affinity-0", affinity)
+	require.NotEqual(t, colocatedServerID, fallbackServerID)
+	require.Equal(t, fallbackServerID, ensure("affinity-10", affinity))
+
+	// Actors that share an anti-affinity group are spread across servers.
+	antiAffinity := EnsureActivationOptions{AntiAffinityGroup: "group1"}
+	placed := make(map[string]string)
+	for i := range serverIDs {
+		actorID := fmt.Sprintf("anti-affinity-%d", i)
+		serverID := ensure(actorID, antiAffinity)
+		require.NotContains(t, placed, serverID)
+		placed[serverID] = actorID
+	}
+	// Existing activations are not moved.
+	for serverID, actorID := range placed {
+		require.Equal(t, serverID, ensure(actorID, antiAffinity))
+	}
+	// The hint is ignored once every server hosts an actor from the group.
+	ensure("anti-affinity-extra", antiAffinity)
+
+	// Anti-affinity is applied before affinity when both hints are provided.
+	both := EnsureActivationOptions{AffinityKey: "key2", AntiAffinityGroup: "group2"}
+	require.NotEqual(t, ensure("both-0", both), ensure("both-1", both))
+}
+
+// testRegistryBulkEnsureActivation ensures that BulkEnsureActivation() returns the same
+// results as EnsureActivation() for each actor, in order, and that per-actor errors are
+// reported without failing the whole call.
+func testRegistryBulkEnsureActivation(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	_, err := registry.RegisterModule(ctx, "ns1", "test-module1", []byte("wasm"), ModuleOptions{})
+	require.NoError(t, err)
+
+	_, err = registry.Heartbeat(ctx, "server1", HeartbeatState{
+		Address: "server1_address",
+	})
+	require.NoError(t, err)
+
+	actorIDs := []string{"a", "b", "c"}
+	results, err := registry.BulkEnsureActivation(ctx, "ns1", "test-module1", actorIDs, EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, len(actorIDs), len(results))
+	for i, result := range results {
+		require.NoError(t, result.Err)
+		require.Equal(t, 1, len(result.References))
+		require.Equal(t, "server1", result.References[0].ServerID())
+		require.Equal(t, actorIDs[i], result.References[0].ActorID().ID)
+
+		activations, err := registry.EnsureActivation(ctx, "ns1", actorIDs[i], "test-module1", EnsureActivationOptions{})
+		require.NoError(t, err)
+		require.Equal(t, result.References, activations)
+	}
+
+	// Actors whose module does not exist should fail individually.
+	results, err = registry.BulkEnsureActivation(ctx, "ns1", "test-module2", []string{"a", "b"}, EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(results))
+	for _, result := range results {
+		require.Error(t, result.Err)
+	}
+}
+
+// testRegistryLookupActivation ensures that LookupActivation returns the current
+// activation of an actor (if any) without creating the actor or placing it.
+func testRegistryLookupActivation(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	_, err := registry.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), ModuleOptions{})
+	require.NoError(t, err)
+	_, err = registry.Heartbeat(ctx, "server1", HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+
+	// Looking up an actor that was never activated doesn't activate it, so it still gets
+	// placed on the least loaded server once it's actually activated.
+	activations, err := registry.LookupActivation(ctx, "ns1", "a", "test-module")
+	require.NoError(t, err)
+	require.Empty(t, activations)
+	_, err = registry.Heartbeat(ctx, "server1", HeartbeatState{
+		NumActivatedActors: 100,
+		Address:            "server1_address",
+	})
+	require.NoError(t, err)
+	_, err = registry.Heartbeat(ctx, "server2", HeartbeatState{Address: "server2_address"})
+	require.NoError(t, err)
+	activations, err = registry.LookupActivation(ctx, "ns1", "a", "test-module")
+	require.NoError(t, err)
+	require.Empty(t, activations)
+
+	ensured, err := registry.EnsureActivation(ctx, "ns1", "a", "test-module", EnsureActivationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "server2", ensured[0].ServerID())
+	activations, err = registry.LookupActivation(ctx, "ns1", "a", "test-module")
+	require.NoError(t, err)
+	require.Equal(t, ensured, activations)
+
+	// Activations on draining servers are not reported since they would be moved.
+	_, err = registry.Heartbeat(ctx, "server2", HeartbeatState{
+		Address:  "server2_address",
+		Draining: true,
+	})
+	require.NoError(t, err)
+	activations, err = registry.LookupActivation(ctx, "ns1", "a", "test-module")
+	require.NoError(t, err)
+	require.Empty(t, activations)
+}
+
+func testInstantiatePayloads(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	_, ok, err := registry.GetInstantiatePayload(ctx, "ns1", "a", "test-module")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, registry.PutInstantiatePayload(ctx, "ns1", "a", "test-module", []byte("abc")))
+	payload, ok, err := registry.GetInstantiatePayload(ctx, "ns1", "a", "test-module")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("abc"), payload)
+
+	// Payloads are replaced.
+	require.NoError(t, registry.PutInstantiatePayload(ctx, "ns1", "a", "test-module", []byte("def")))
+	payload, ok, err = registry.GetInstantiatePayload(ctx, "ns1", "a", "test-module")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("def"), payload)
+
+	// Payloads are scoped to the namespace, actor and module.
+	_, ok, err = registry.GetInstantiatePayload(ctx, "ns2", "a", "test-module")
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, ok, err = registry.GetInstantiatePayload(ctx, "ns1", "b", "test-module")
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, ok, err = registry.GetInstantiatePayload(ctx, "ns1", "a", "test-module-2")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+}
+
 func testKVSimple(t *testing.T, registry Registry) {
 	ctx := context.Background()
 
+	var server1Version int64
 	for nsIdx, ns := range []string{"ns1", "ns2"} {
 		// Create the modules.
 		_, err := registry.RegisterModule(ctx, ns, "test-module1", []byte("wasm"), ModuleOptions{})
@@ -225,21 +662,22 @@ func testKVSimple(t *testing.T, registry Registry) {
 					// first time.
 
 					// Cant ensure activation when no available servers.
-					_, err = registry.EnsureActivation(ctx, ns, actor, "test-module1")
+					_, err = registry.EnsureActivation(ctx, ns, actor, "test-module1", EnsureActivationOptions{})
 					require.Error(t, err)
 
 					// Heartbeat server so we can activate.
-					_, err = registry.Heartbeat(ctx, "server1", HeartbeatState{
+					heartbeatResult, err := registry.Heartbeat(ctx, "server1", HeartbeatState{
 						NumActivatedActors: 0,
 						Address:            "server1_address",
 					})
 					require.NoError(t, err)
+					server1Version = heartbeatResult.ServerVersion
 				}
 
 				// Same actor ID, but different modules, should end up with separate KV storage.
-				_, err = registry.EnsureActivation(ctx, ns, actor, "test-module1")
+				_, err = registry.EnsureActivation(ctx, ns, actor, "test-module1", EnsureActivationOptions{})
 				require.NoError(t, err)
-				_, err = registry.EnsureActivation(ctx, ns, actor, "test-module2")
+				_, err = registry.EnsureActivation(ctx, ns, actor, "test-module2", EnsureActivationOptions{})
 				require.NoError(t, err)
 
 				for _, module := range []string{"test-module1", "test-module2"} {
@@ -262,7 +700,7 @@ func testKVSimple(t *testing.T, registry Registry) {
 						// Finally now that we've created the actor, created a live server, ensured the
 						// actor is activated on the live server, and initiate the transaction from the
 						// server the actor should be activated on, we can begin a transaction.
-						tr, err = registry.BeginTransaction(ctx, ns, actor, module, rightServer, 1)
+						tr, err = registry.BeginTransaction(ctx, ns, actor, module, rightServer, server1Version)
 						require.NoError(t, err)
 						defer func() {
 							require.NoError(t, tr.Commit(ctx))
@@ -306,3 +744,328 @@ func testKVSimple(t *testing.T, registry Registry) {
 		}
 	}
 }
+
+// testKVDeleteAndIterPrefix ensures that actors can delete and list their KV pairs, that
+// deletes are transactional, and that listing never returns other actors' KV pairs.
+func testKVDeleteAndIterPrefix(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	_, err := registry.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), ModuleOptions{})
+	require.NoError(t, err)
+	heartbeatResult, err := registry.Heartbeat(ctx, "server1", HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	for _, actor := range []string{"a", "ab"} {
+		_, err = registry.EnsureActivation(ctx, "ns1", actor, "test-module", EnsureActivationOptions{})
+		require.NoError(t, err)
+	}
+
+	list := func(tr ActorKVTransaction, prefix string) []string {
+		var kvs []string
+		err := tr.IterPrefix(ctx, []byte(prefix), func(k, v []byte) error {
+			kvs = append(kvs, fmt.Sprintf("%s=%s", k, v))
+			return nil
+		})
+		require.NoError(t, err)
+		return kvs
+	}
+	transact := func(actor string, fn func(tr ActorKVTransaction), commit bool) {
+		tr, err := registry.BeginTransaction(ctx, "ns1", actor, "test-module", "server1", heartbeatResult.ServerVersion)
+		require.NoError(t, err)
+		fn(tr)
+		if commit {
+			require.NoError(t, tr.Commit(ctx))
+		} else {
+			require.NoError(t, tr.Cancel(ctx))
+		}
+	}
+
+	transact("a", func(tr ActorKVTransaction) {
+		for _, k := range []string{"p-2", "q-1", "p-1", "p-\x00"} {
+			require.NoError(t, tr.Put(ctx, []byte(k), []byte("v"+k)))
+		}
+		// Transactions should observe their own writes.
+		require.Equal(t, []string{"p-\x00=vp-\x00", "p-1=vp-1", "p-2=vp-2"}, list(tr, "p-"))
+	}, true)
+
+	transact("ab", func(tr ActorKVTransaction) {
+		// Other actors should not observe the KV pairs, even if their ID shares a prefix.
+		require.Empty(t, list(tr, ""))
+		require.NoError(t, tr.Put(ctx, []byte("p-3"), []byte("vp-3")))
+	}, true)
+
+	transact("a", func(tr ActorKVTransaction) {
+		require.Equal(t, []string{"p-\x00=vp-\x00", "p-1=vp-1", "p-2=vp-2", "q-1=vq-1"}, list(tr, ""))
+		require.NoError(t, tr.Delete(ctx, []byte("p-1")))
+		require.NoError(t, tr.Delete(ctx, []byte("does-not-exist")))
+		_, ok, err := tr.Get(ctx, []byte("p-1"))
+		require.NoError(t, err)
+		require.False(t, ok)
+		require.Equal(t, []string{"p-\x00=vp-\x00", "p-2=vp-2"}, list(tr, "p-"))
+	}, false)
+
+	transact("a", func(tr ActorKVTransaction) {
+		// The delete was rolled back.
+		require.Equal(t, []string{"p-\x00=vp-\x00", "p-1=vp-1", "p-2=vp-2"}, list(tr, "p-"))
+		require.NoError(t, tr.Delete(ctx, []byte("p-1")))
+	}, true)
+
+	transact("a", func(tr ActorKVTransaction) {
+		require.Equal(t, []string{"p-\x00=vp-\x00", "p-2=vp-2"}, list(tr, "p-"))
+		// Deleted keys can be written again.
+		require.NoError(t, tr.Put(ctx, []byte("p-1"), []byte("vp-1")))
+		require.Equal(t, []string{"p-\x00=vp-\x00", "p-1=vp-1", "p-2=vp-2"}, list(tr, "p-"))
+	}, true)
+}
+
+// testKVVersions tests that the versions of actor KV pairs change every time they're
+// written (and never repeat), and that PutIfVersion only writes if the version matches.
+func testKVVersions(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	_, err := registry.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), ModuleOptions{})
+	require.NoError(t, err)
+	heartbeatResult, err := registry.Heartbeat(ctx, "server1", HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	_, err = registry.EnsureActivation(ctx, "ns1", "a", "test-module", EnsureActivationOptions{})
+	require.NoError(t, err)
+
+	var (
+		key      = []byte("k")
+		versions []int64
+	)
+	transact := func(fn func(tr ActorKVTransaction)) {
+		tr, err := registry.BeginTransaction(ctx, "ns1", "a", "test-module", "server1", heartbeatResult.ServerVersion)
+		require.NoError(t, err)
+		fn(tr)
+		require.NoError(t, tr.Commit(ctx))
+	}
+	getVersion := func(expectedValue string) int64 {
+		var version int64
+		transact(func(tr ActorKVTransaction) {
+			v, ver, ok, err := tr.GetWithVersion(ctx, key)
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, expectedValue, string(v))
+			require.NotContains(t, versions, ver)
+			version = ver
+		})
+		versions = append(versions, version)
+		return version
+	}
+
+	transact(func(tr ActorKVTransaction) {
+		_, version, ok, err := tr.GetWithVersion(ctx, key)
+		require.NoError(t, err)
+		require.False(t, ok)
+		require.Equal(t, int64(0), version)
+
+		ok, err = tr.PutIfVersion(ctx, key, []byte("v1"), 1)
+		require.NoError(t, err)
+		require.False(t, ok)
+		ok, err = tr.PutIfVersion(ctx, key, []byte("v1"), 0)
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+	v1 := getVersion("v1")
+	require.True(t, v1 > 0)
+
+	transact(func(tr ActorKVTransaction) {
+		ok, err := tr.PutIfVersion(ctx, key, []byte("v2"), 0)
+		require.NoError(t, err)
+		require.False(t, ok)
+		ok, err = tr.PutIfVersion(ctx, key, []byte("v2"), v1)
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+	v2 := getVersion("v2")
+
+	transact(func(tr ActorKVTransaction) {
+		// Stale versions are rejected.
+		ok, err := tr.PutIfVersion(ctx, key, []byte("v3"), v1)
+		require.NoError(t, err)
+		require.False(t, ok)
+		// Regular writes change the version too.
+		require.NoError(t, tr.Put(ctx, key, []byte("v3")))
+	})
+	v3 := getVersion("v3")
+
+	transact(func(tr ActorKVTransaction) {
+		ok, err := tr.PutIfVersion(ctx, key, []byte("v4"), v2)
+		require.NoError(t, err)
+		require.False(t, ok)
+		require.NoError(t, tr.Delete(ctx, key))
+		_, version, ok, err := tr.GetWithVersion(ctx, key)
+		require.NoError(t, err)
+		require.False(t, ok)
+		require.Equal(t, int64(0), version)
+	})
+
+	// Keys that are written again after being deleted don't reuse old versions.
+	var writtenVersion int64
+	transact(func(tr ActorKVTransaction) {
+		ok, err := tr.PutIfVersion(ctx, key, []byte("v4"), v3)
+		require.NoError(t, err)
+		require.False(t, ok)
+		ok, err = tr.PutIfVersion(ctx, key, []byte("v4"), 0)
+		require.NoError(t, err)
+		require.True(t, ok)
+		_, writtenVersion, ok, err = tr.GetWithVersion(ctx, key)
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+	// The version that the writing transaction reads is the version that is committed.
+	require.Equal(t, writtenVersion, getVersion("v4"))
+}
+
+// testKVIncr tests that counters can be incremented atomically, that increments are
+// rolled back with their transaction, and that they change the version of the counter.
+func testKVIncr(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	_, err := registry.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), ModuleOptions{})
+	require.NoError(t, err)
+	heartbeatResult, err := registry.Heartbeat(ctx, "server1", HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	_, err = registry.EnsureActivation(ctx, "ns1", "a", "test-module", EnsureActivationOptions{})
+	require.NoError(t, err)
+
+	var (
+		key = []byte("counter")
+		tr  ActorKVTransaction
+	)
+	begin := func() {
+		tr, err = registry.BeginTransaction(ctx, "ns1", "a", "test-module", "server1", heartbeatResult.ServerVersion)
+		require.NoError(t, err)
+	}
+	incr := func(delta int64) int64 {
+		value, err := tr.Incr(ctx, key, delta)
+		require.NoError(t, err)
+		return value
+	}
+
+	begin()
+	require.Equal(t, int64(5), incr(5))
+	require.Equal(t, int64(3), incr(-2))
+	require.NoError(t, tr.Commit(ctx))
+
+	begin()
+	v, version, ok, err := tr.GetWithVersion(ctx, key)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, wapcutils.EncodeCounter(3), v)
+	require.Equal(t, int64(4), incr(1))
+	require.NoError(t, tr.Cancel(ctx))
+
+	begin()
+	require.Equal(t, int64(3), incr(0))
+	require.Equal(t, int64(13), incr(10))
+	_, newVersion, _, err := tr.GetWithVersion(ctx, key)
+	require.NoError(t, err)
+	require.NotEqual(t, version, newVersion)
+
+	// Values that aren't counters can't be incremented.
+	require.NoError(t, tr.Put(ctx, key, []byte("not a counter")))
+	_, err = tr.Incr(ctx, key, 1)
+	require.Error(t, err)
+	require.NoError(t, tr.Commit(ctx))
+}
+
+// testReminders tests registering, listing, claiming and unregistering reminders.
+func testReminders(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	var (
+		now   = time.UnixMicro(time.Now().UnixMicro())
+		names = func(reminders []Reminder) []string {
+			var names []string
+			for _, r := range reminders {
+				names = append(names, r.Name)
+			}
+			return names
+		}
+	)
+	require.NoError(t, registry.RegisterReminder(
+		ctx, "ns1", "a", "test-module", "once", now.Add(time.Second), 0))
+	require.NoError(t, registry.RegisterReminder(
+		ctx, "ns1", "a", "test-module", "periodic", now.Add(2*time.Second), time.Minute))
+	// Reminders for other actors (even if they share an ID prefix) should be independent.
+	require.NoError(t, registry.RegisterReminder(
+		ctx, "ns1", "ab", "test-module", "once", now.Add(3*time.Second), 0))
+
+	// Invalid arguments should be rejected.
+	require.Error(t, registry.RegisterReminder(
+		ctx, "ns1", "a", "test-module", "", now, 0))
+	require.Error(t, registry.RegisterReminder(
+		ctx, "ns1", "a", "test-module", "negative", now, -time.Second))
+	_, err := registry.ClaimDueReminders(ctx, now, 0)
+	require.Error(t, err)
+
+	reminders, err := registry.ListReminders(ctx, "ns1", "a", "test-module")
+	require.NoError(t, err)
+	require.Equal(t, []Reminder{
+		{
+			Namespace: "ns1", ActorID: "a", ModuleID: "test-module", Name: "once",
+			DueTime: now.Add(time.Second),
+		},
+		{
+			Namespace: "ns1", ActorID: "a", ModuleID: "test-module", Name: "periodic",
+			DueTime: now.Add(2 * time.Second), Period: time.Minute,
+		},
+	}, reminders)
+
+	// Nothing is due yet.
+	claimed, err := registry.ClaimDueReminders(ctx, now, 10)
+	require.NoError(t, err)
+	require.Empty(t, claimed)
+
+	// Claims should respect the limit and be ordered by due time.
+	claimed, err = registry.ClaimDueReminders(ctx, now.Add(5*time.Second), 1)
+	require.NoError(t, err)
+	require.Equal(t, []Reminder{{
+		Namespace: "ns1", ActorID: "a", ModuleID: "test-module", Name: "once",
+		DueTime: now.Add(time.Second),
+	}}, claimed)
+
+	claimed, err = registry.ClaimDueReminders(ctx, now.Add(5*time.Second), 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"periodic", "once"}, names(claimed))
+	require.Equal(t, "ab", claimed[1].ActorID)
+
+	// Each firing can only be claimed once.
+	claimed, err = registry.ClaimDueReminders(ctx, now.Add(5*time.Second), 10)
+	require.NoError(t, err)
+	require.Empty(t, claimed)
+
+	// One-off reminders are removed once claimed and periodic reminders are rescheduled.
+	reminders, err = registry.ListReminders(ctx, "ns1", "a", "test-module")
+	require.NoError(t, err)
+	require.Equal(t, []string{"periodic"}, names(reminders))
+	require.Equal(t, now.Add(2*time.Second+time.Minute), reminders[0].DueTime)
+	reminders, err = registry.ListReminders(ctx, "ns1", "ab", "test-module")
+	require.NoError(t, err)
+	require.Empty(t, reminders)
+
+	// Missed firings of periodic reminders are skipped.
+	claimed, err = registry.ClaimDueReminders(ctx, now.Add(10*time.Minute), 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"periodic"}, names(claimed))
+	reminders, err = registry.ListReminders(ctx, "ns1", "a", "test-module")
+	require.NoError(t, err)
+	require.Equal(t, now.Add(2*time.Second+10*time.Minute), reminders[0].DueTime)
+
+	// Re-registering a reminder replaces it.
+	require.NoError(t, registry.RegisterReminder(
+		ctx, "ns1", "a", "test-module", "periodic", now.Add(time.Hour), 0))
+	claimed, err = registry.ClaimDueReminders(ctx, now.Add(30*time.Minute), 10)
+	require.NoError(t, err)
+	require.Empty(t, claimed)
+
+	require.NoError(t, registry.UnregisterReminder(ctx, "ns1", "a", "test-module", "periodic"))
+	require.NoError(t, registry.UnregisterReminder(ctx, "ns1", "a", "test-module", "does-not-exist"))
+	reminders, err = registry.ListReminders(ctx, "ns1", "a", "test-module")
+	require.NoError(t, err)
+	require.Empty(t, reminders)
+	claimed, err = registry.ClaimDueReminders(ctx, now.Add(2*time.Hour), 10)
+	require.NoError(t, err)
+	require.Empty(t, claimed)
+}
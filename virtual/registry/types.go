@@ -2,6 +2,8 @@ package registry
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/richardartoul/nola/virtual/types"
 )
@@ -10,6 +12,7 @@ import (
 type Registry interface {
 	ActorStorage
 	ServiceDiscovery
+	ReminderStorage
 
 	// RegisterModule registers the provided module []byte and options with the
 	// provided module ID for subsequent calls to CreateActor().
@@ -47,15 +50,66 @@ type Registry interface {
 	// have been activated. In general, actor activation is handled "lazily" when a
 	// location (server) receives its first invocation for an actor ID that it doesn't
 	// currently have activated.
+	//
+	// Registries that grant activation leases return references that carry the lease
+	// (see types.ActorReference.Lease()). The server that hosts the actor must keep the
+	// lease alive with RenewActivationLease(), otherwise the registry considers the actor
+	// free and subsequent calls will activate it again, potentially on a different server.
+	//
+	// ctx carries the deadline of the invocation that the actor is being activated for
+	// (if any), so registries should stop working on the call and return ctx's error once
+	// it's done instead of activating an actor that nobody is waiting for anymore.
 	EnsureActivation(
 		ctx context.Context,
 		namespace,
 		actorID string,
 		moduleID string,
+		opts EnsureActivationOptions,
+	) ([]types.ActorReference, error)
+
+	// BulkEnsureActivation is the same as EnsureActivation, except it ensures the
+	// activation of many actors in the same namespace and module at once so that
+	// implementations can batch the work into fewer round-trips. The returned results
+	// are in the same order as actorIDs. Errors that only affect a single actor are
+	// reported in the corresponding result instead of failing the entire call.
+	//
+	// Implementations that don't support batching natively can use
+	// BulkEnsureActivationSequential as a fallback.
+	BulkEnsureActivation(
+		ctx context.Context,
+		namespace string,
+		moduleID string,
+		actorIDs []string,
+		opts EnsureActivationOptions,
+	) ([]EnsureActivationResult, error)
+
+	// LookupActivation is a read-only version of EnsureActivation. It returns an
+	// ActorReference that points to the provided actor's current activation if it's
+	// activated on a live server that is not draining, and an empty slice otherwise
+	// (including if the actor does not exist). Unlike EnsureActivation it never creates
+	// the actor or selects a location for it.
+	LookupActivation(
+		ctx context.Context,
+		namespace,
+		actorID string,
+		moduleID string,
 	) ([]types.ActorReference, error)
 
+	// RenewActivationLease extends the activation lease identified by token (see
+	// types.ActivationLease) and returns the renewed lease. It returns an error that
+	// wraps ErrActivationLeaseExpired if the lease has already expired or the actor has
+	// been activated elsewhere since it was granted, in which case the server that held it
+	// must stop hosting the actor.
+	RenewActivationLease(ctx context.Context, token string) (types.ActivationLease, error)
+
 	// GetVersionStamp() returns a monotonically increasing integer that should increase
 	// at a rate of ~ 1 million/s.
+	//
+	// Implementations should derive it from a single logical clock shared by the whole
+	// cluster (like FoundationDB's versionstamps or the Redis server's clock). Some derive
+	// it from the clock of the server that calls it instead (like etcdregistry), in which
+	// case it's only monotonic within a process and comparisons between the versionstamps
+	// observed by different servers are only as accurate as their clocks are synchronized.
 	GetVersionStamp(ctx context.Context) (int64, error)
 
 	// Close closes the registry and releases any resources associated (DB connections, etc).
@@ -66,6 +120,92 @@ type Registry interface {
 	UnsafeWipeAll() error
 }
 
+// VersionStampedRegistry is implemented by the registries that can return the versionstamp
+// at which EnsureActivation() resolved an actor's references as part of the same call, which
+// saves callers that need both a separate round-trip to GetVersionStamp(). The registries
+// returned by NewKVRegistry (and therefore all the KV-backed registries) implement it.
+type VersionStampedRegistry interface {
+	Registry
+
+	// EnsureActivationWithVersionStamp is the same as EnsureActivation, except it also
+	// returns the registry's versionstamp at which the references were resolved. The
+	// versionstamp is 0 if it could not be determined as part of the call, in which case
+	// callers that need it must call GetVersionStamp() instead.
+	EnsureActivationWithVersionStamp(
+		ctx context.Context,
+		namespace,
+		actorID string,
+		moduleID string,
+		opts EnsureActivationOptions,
+	) ([]types.ActorReference, int64, error)
+}
+
+// ensureActivationWithVersionStamp calls EnsureActivationWithVersionStamp() on r if it
+// implements VersionStampedRegistry, and EnsureActivation() with a versionstamp of 0
+// otherwise.
+func ensureActivationWithVersionStamp(
+	ctx context.Context,
+	r Registry,
+	namespace,
+	actorID string,
+	moduleID string,
+	opts EnsureActivationOptions,
+) ([]types.ActorReference, int64, error) {
+	if vsr, ok := r.(VersionStampedRegistry); ok {
+		return vsr.EnsureActivationWithVersionStamp(ctx, namespace, actorID, moduleID, opts)
+	}
+	references, err := r.EnsureActivation(ctx, namespace, actorID, moduleID, opts)
+	return references, 0, err
+}
+
+// ActivationWatcher is implemented by the registries that can notify servers of the
+// changes that invalidate the activations they cached, so that they can resolve them
+// again before their cache entries expire. The registries returned by NewKVRegistry
+// implement it, but only support it if their KV store can watch for changes (see
+// kv.WatchableStore).
+type ActivationWatcher interface {
+	Registry
+
+	// WatchActivations calls onActivationChanged every time the activation of an actor
+	// may have changed and onServerRemoved with the ID of every server that was removed
+	// from the registry (for example because its lease expired), which invalidates the
+	// activations of all the actors on it, until ctx is done or the watch fails. It
+	// returns an error that matches ErrWatchNotSupported if the registry can't watch.
+	WatchActivations(
+		ctx context.Context,
+		onActivationChanged func(ActivationChange),
+		onServerRemoved func(serverID string),
+	) error
+}
+
+// ActivationChange describes a change to the activation of an actor (see
+// ActivationWatcher).
+type ActivationChange struct {
+	// ActorID is the ID of the actor whose activation changed.
+	ActorID types.NamespacedActorID
+	// ServerID, ServerVersion and Generation identify the actor's activation after the
+	// change, like the fields of types.ActorReference with the same names. ServerID is
+	// empty if the actor is not activated anymore (for example because it was deleted) or
+	// if its new activation is not known.
+	ServerID      string
+	ServerVersion int64
+	Generation    uint64
+}
+
+// watchActivations calls WatchActivations() on r if it implements ActivationWatcher, and
+// returns ErrWatchNotSupported otherwise.
+func watchActivations(
+	ctx context.Context,
+	r Registry,
+	onActivationChanged func(ActivationChange),
+	onServerRemoved func(serverID string),
+) error {
+	if w, ok := r.(ActivationWatcher); ok {
+		return w.WatchActivations(ctx, onActivationChanged, onServerRemoved)
+	}
+	return fmt.Errorf("WatchActivations: %w", ErrWatchNotSupported)
+}
+
 // ActorStorage contains the methods for interacting with per-actor durable storage.
 type ActorStorage interface {
 	// BeginTransaction eagerly begins a transaction that allows the Actor to read/write
@@ -78,6 +218,27 @@ type ActorStorage interface {
 		serverID string,
 		serverVersion int64,
 	) (ActorKVTransaction, error)
+
+	// PutInstantiatePayload persists the payload that the actor was instantiated with,
+	// replacing the previous one (if any), so that subsequent activations of the actor
+	// that don't provide a payload can be instantiated with the same one. The payload
+	// is stored separately from the actor's KV storage so it's not visible to the actor.
+	PutInstantiatePayload(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		moduleID string,
+		payload []byte,
+	) error
+
+	// GetInstantiatePayload returns the payload that was persisted for the actor with
+	// PutInstantiatePayload, if any.
+	GetInstantiatePayload(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		moduleID string,
+	) ([]byte, bool, error)
 }
 
 // ActorKVTransaction is the interface exposed by the Registry to Actors so they can perform
@@ -87,9 +248,32 @@ type ActorKVTransaction interface {
 	Put(ctx context.Context, key []byte, value []byte) error
 	// Get is the inverse of Put.
 	Get(ctx context.Context, key []byte) ([]byte, bool, error)
-	// Commit commits the transaction, persisting all Put/Get operations.
+	// Delete deletes the value at the provided key in the actor's KV storage, if any.
+	Delete(ctx context.Context, key []byte) error
+	// IterPrefix calls fn for every KV pair in the actor's KV storage whose key begins
+	// with the provided prefix, in ascending key order, until fn returns an error.
+	IterPrefix(ctx context.Context, prefix []byte, fn func(k, v []byte) error) error
+	// GetWithVersion is the same as Get, except it also returns the version of the
+	// value, which changes every time the key is written. The version is 0 if the key
+	// does not exist. Actors can pass the version to PutIfVersion to implement
+	// compare-and-swap, for example to detect that their state was modified by another
+	// activation of the actor racing with a migration.
+	GetWithVersion(ctx context.Context, key []byte) ([]byte, int64, bool, error)
+	// PutIfVersion is the same as Put, except the value is only stored if the current
+	// version of the key (as returned by GetWithVersion) is expectedVersion, which can
+	// be 0 to store it only if the key does not exist. It returns whether the value was
+	// stored.
+	PutIfVersion(ctx context.Context, key []byte, value []byte, expectedVersion int64) (bool, error)
+	// Incr atomically adds delta to the counter at the provided key and returns its new
+	// value, where a missing key is a counter with a value of 0, so that actors don't have
+	// to Get and Put counters (which costs an extra round trip to the store). Like every
+	// other write, the increment is only persisted when the transaction commits. Counters
+	// are stored as values encoded with wapcutils.EncodeCounter, and Incr fails if the
+	// key holds a value that isn't one.
+	Incr(ctx context.Context, key []byte, delta int64) (int64, error)
+	// Commit commits the transaction, persisting all Put/Delete operations atomically.
 	Commit(ctx context.Context) error
-	// Cancel cancels the transaction, rolling back all Put/Get operations.
+	// Cancel cancels the transaction, rolling back all Put/Delete operations.
 	Cancel(ctx context.Context) error
 }
 
@@ -109,6 +293,73 @@ type ServiceDiscovery interface {
 // CreateActorResult is the result of a call to CreateActor().
 type CreateActorResult struct{}
 
+// EnsureActivationOptions contains the options for a call to EnsureActivation() or
+// BulkEnsureActivation().
+type EnsureActivationOptions struct {
+	// BlacklistedServerIDs contains the IDs of servers that the caller wants to avoid,
+	// for example because they're degraded. Blacklisted servers are treated the same as
+	// draining servers: they're not eligible for new activations and actors that are
+	// currently activated on them are moved to a different server.
+	BlacklistedServerIDs []string
+
+	// AffinityKey is a best-effort hint that new activations of actors that share the
+	// same (non-empty) AffinityKey within a namespace should be placed on the same server,
+	// for example for data locality. Actors are placed by rendezvous hashing the key, so
+	// colocation holds across calls as long as the set of eligible servers doesn't
+	// change. AffinityKey takes precedence over the registry's placement strategy.
+	//
+	// Placement hints never override constraints: draining and blacklisted servers are
+	// never picked, so if the server that an AffinityKey maps to is excluded the actors
+	// are placed on the next server in the hash order instead (they still colocate with
+	// each other). Hints are also only considered when a new activation is created, so
+	// actors that are already activated on an eligible server are not moved.
+	AffinityKey string
+	// AntiAffinityGroup is a best-effort hint that actors that share the same
+	// (non-empty) AntiAffinityGroup within a namespace should be placed on different
+	// servers, for example for fault isolation. If every eligible server already hosts
+	// an actor from the group the hint is ignored and the actor is placed as if it
+	// didn't have one. When both hints are provided the servers that already host
+	// actors from the AntiAffinityGroup are excluded first and AffinityKey is applied to
+	// the remaining ones.
+	AntiAffinityGroup string
+
+	// NumFailoverCandidates is the maximum number of failover candidates that should be
+	// attached to the returned references (see types.ActorReference.FailoverCandidates).
+	// Candidates are other eligible servers that the actor would be placed on, ranked by
+	// rendezvous hashing the actor's identity, so a caller that can't reach the server
+	// that hosts the actor can try them without consulting the registry again. Servers
+	// that are already in the returned references are never candidates, and neither are
+	// servers that are not eligible for new activations (including
+	// BlacklistedServerIDs).
+	//
+	// Candidates are computed at the time of the call and the actor is not activated on
+	// them. Registries that don't support failover candidates ignore this option.
+	NumFailoverCandidates int
+}
+
+// isBlacklisted returns whether serverID is one of the BlacklistedServerIDs.
+func (o EnsureActivationOptions) isBlacklisted(serverID string) bool {
+	for _, blacklisted := range o.BlacklistedServerIDs {
+		if blacklisted == serverID {
+			return true
+		}
+	}
+	return false
+}
+
+// EnsureActivationResult is the result of ensuring the activation of a single actor as
+// part of a call to BulkEnsureActivation().
+type EnsureActivationResult struct {
+	// References is the same as the value returned by EnsureActivation(). It will
+	// only be set if Err is nil.
+	References []types.ActorReference
+	// Err is the error that was encountered ensuring the activation of the actor, if any.
+	Err error
+	// VersionStamp is the registry's versionstamp at which References were resolved, or 0
+	// if the registry does not report it (see VersionStampedRegistry).
+	VersionStamp int64
+}
+
 // ModuleOptions contains the options for a given module.
 type ModuleOptions struct {
 	// AllowEmptyModuleBytes allows a module to be created with empty WASM bytes. This is
@@ -134,6 +385,28 @@ type HeartbeatState struct {
 	NumActivatedActors int
 	// Address is the address at which the server can be reached.
 	Address string
+	// Load is an arbitrary measure of how loaded the server is (CPU, memory, etc) where
+	// higher values indicate more load. It is only compared against the Load reported
+	// by other servers, so all the servers in a cluster must report it the same way.
+	Load float64
+	// Draining indicates that the server is about to shut down. Draining servers are
+	// not picked for new activations, and actors that are activated on them are moved
+	// to other servers the next time their activation is ensured.
+	Draining bool
+	// MaxActivations is the maximum number of actors that the server can host, or 0 if
+	// it's unlimited. Servers whose NumActivatedActors is at (or above) MaxActivations are
+	// not picked for new activations, but the actors that are already activated on them
+	// stay there.
+	MaxActivations int
+	// IncludeLiveServers requests that the registry lists the servers that are currently
+	// alive in HeartbeatResult.LiveServers. It's a property of the request rather than
+	// of the server's state, so it's not persisted.
+	IncludeLiveServers bool `json:"-"`
+}
+
+// isAtCapacity returns whether the server can't host any more actors.
+func (h HeartbeatState) isAtCapacity() bool {
+	return h.MaxActivations > 0 && h.NumActivatedActors >= h.MaxActivations
 }
 
 // HeartbeatResult is the result returned by the Heartbeat() method.
@@ -146,4 +419,20 @@ type HeartbeatResult struct {
 	// ServerVersion is incremented every time a server's heartbeat expires and resumes,
 	// guaranteeing the server's ability to identify periods of inactivity/death for correctness purposes.
 	ServerVersion int64
+	// ActivationLeaseDuration is the duration of the activation leases that the registry
+	// grants, or 0 if it doesn't grant them. Servers use it to know whether they need to
+	// renew the leases of the actors they host.
+	ActivationLeaseDuration time.Duration
+	// LiveServers contains the servers whose heartbeat has not expired (including the one
+	// that heartbeated), sorted by ServerID, if HeartbeatState.IncludeLiveServers was set.
+	// It is nil otherwise, or if the registry doesn't track the servers in the cluster.
+	LiveServers []LiveServer
+}
+
+// LiveServer is a server whose heartbeat has not expired (see HeartbeatResult.LiveServers).
+type LiveServer struct {
+	// ServerID is the ID of the server.
+	ServerID string
+	// Address is the address at which the server can be reached.
+	Address string
 }
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/richardartoul/nola/virtual/types"
 )
@@ -86,6 +87,7 @@ func (v *validator) EnsureActivation(
 	namespace,
 	actorID string,
 	moduleID string,
+	opts EnsureActivationOptions,
 ) ([]types.ActorReference, error) {
 	if err := validateString("namespace", namespace); err != nil {
 		return nil, err
@@ -93,7 +95,68 @@ func (v *validator) EnsureActivation(
 	if err := validateString("actorID", actorID); err != nil {
 		return nil, err
 	}
-	return v.r.EnsureActivation(ctx, namespace, actorID, moduleID)
+	return v.r.EnsureActivation(ctx, namespace, actorID, moduleID, opts)
+}
+
+func (v *validator) EnsureActivationWithVersionStamp(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+	opts EnsureActivationOptions,
+) ([]types.ActorReference, int64, error) {
+	if err := validateString("namespace", namespace); err != nil {
+		return nil, 0, err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return nil, 0, err
+	}
+	return ensureActivationWithVersionStamp(ctx, v.r, namespace, actorID, moduleID, opts)
+}
+
+func (v *validator) BulkEnsureActivation(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorIDs []string,
+	opts EnsureActivationOptions,
+) ([]EnsureActivationResult, error) {
+	if err := validateString("namespace", namespace); err != nil {
+		return nil, err
+	}
+	for _, actorID := range actorIDs {
+		if err := validateString("actorID", actorID); err != nil {
+			return nil, err
+		}
+	}
+	return v.r.BulkEnsureActivation(ctx, namespace, moduleID, actorIDs, opts)
+}
+
+func (v *validator) LookupActivation(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+) ([]types.ActorReference, error) {
+	if err := validateString("namespace", namespace); err != nil {
+		return nil, err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return nil, err
+	}
+	return v.r.LookupActivation(ctx, namespace, actorID, moduleID)
+}
+
+func (v *validator) RenewActivationLease(
+	ctx context.Context,
+	token string,
+) (types.ActivationLease, error) {
+	// Tokens embed the actor's identifiers so they can be longer than the strings that
+	// validateString allows.
+	if token == "" {
+		return types.ActivationLease{}, errors.New("token cannot be empty")
+	}
+	return v.r.RenewActivationLease(ctx, token)
 }
 
 func (v *validator) GetVersionStamp(
@@ -125,6 +188,37 @@ func (v *validator) BeginTransaction(
 	return &kvValidator{tr}, nil
 }
 
+func (v *validator) PutInstantiatePayload(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	payload []byte,
+) error {
+	if err := validateString("namespace", namespace); err != nil {
+		return err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return err
+	}
+	return v.r.PutInstantiatePayload(ctx, namespace, actorID, moduleID, payload)
+}
+
+func (v *validator) GetInstantiatePayload(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+) ([]byte, bool, error) {
+	if err := validateString("namespace", namespace); err != nil {
+		return nil, false, err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return nil, false, err
+	}
+	return v.r.GetInstantiatePayload(ctx, namespace, actorID, moduleID)
+}
+
 func (v *validator) Heartbeat(
 	ctx context.Context,
 	serverID string,
@@ -136,17 +230,184 @@ func (v *validator) Heartbeat(
 	if err := validateString("address", state.Address); err != nil {
 		return HeartbeatResult{}, err
 	}
+	if state.MaxActivations < 0 {
+		return HeartbeatResult{}, fmt.Errorf("MaxActivations must be >= 0, but was: %d", state.MaxActivations)
+	}
 	return v.r.Heartbeat(ctx, serverID, state)
 }
 
+func (v *validator) RegisterReminder(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	name string,
+	dueTime time.Time,
+	period time.Duration,
+) error {
+	if err := validateReminder(namespace, actorID, moduleID, name); err != nil {
+		return err
+	}
+	if period < 0 {
+		return fmt.Errorf("period cannot be negative, but was: %s", period)
+	}
+	return v.r.RegisterReminder(ctx, namespace, actorID, moduleID, name, dueTime, period)
+}
+
+func (v *validator) UnregisterReminder(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	name string,
+) error {
+	if err := validateReminder(namespace, actorID, moduleID, name); err != nil {
+		return err
+	}
+	return v.r.UnregisterReminder(ctx, namespace, actorID, moduleID, name)
+}
+
+func (v *validator) ListReminders(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+) ([]Reminder, error) {
+	if err := validateString("namespace", namespace); err != nil {
+		return nil, err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return nil, err
+	}
+	if err := validateString("moduleID", moduleID); err != nil {
+		return nil, err
+	}
+	return v.r.ListReminders(ctx, namespace, actorID, moduleID)
+}
+
+func (v *validator) ClaimDueReminders(
+	ctx context.Context,
+	now time.Time,
+	limit int,
+) ([]Reminder, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be > 0, but was: %d", limit)
+	}
+	return v.r.ClaimDueReminders(ctx, now, limit)
+}
+
+func (v *validator) ListModules(ctx context.Context) ([]types.NamespacedIDNoType, error) {
+	m, err := v.migratable()
+	if err != nil {
+		return nil, err
+	}
+	return m.ListModules(ctx)
+}
+
+func (v *validator) ListServers(ctx context.Context) ([]ServerPlacement, error) {
+	m, err := v.migratable()
+	if err != nil {
+		return nil, err
+	}
+	return m.ListServers(ctx)
+}
+
+func (v *validator) PutServer(ctx context.Context, server ServerPlacement) error {
+	if err := validateString("serverID", server.ServerID); err != nil {
+		return err
+	}
+	m, err := v.migratable()
+	if err != nil {
+		return err
+	}
+	return m.PutServer(ctx, server)
+}
+
+func (v *validator) ListActorPlacements(ctx context.Context) ([]ActorPlacement, error) {
+	m, err := v.migratable()
+	if err != nil {
+		return nil, err
+	}
+	return m.ListActorPlacements(ctx)
+}
+
+func (v *validator) GetActorPlacement(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+) (ActorPlacement, bool, error) {
+	if err := validateString("namespace", namespace); err != nil {
+		return ActorPlacement{}, false, err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return ActorPlacement{}, false, err
+	}
+	if err := validateString("moduleID", moduleID); err != nil {
+		return ActorPlacement{}, false, err
+	}
+	m, err := v.migratable()
+	if err != nil {
+		return ActorPlacement{}, false, err
+	}
+	return m.GetActorPlacement(ctx, namespace, actorID, moduleID)
+}
+
+func (v *validator) PutActorPlacement(ctx context.Context, placement ActorPlacement) error {
+	if err := validateString("namespace", placement.Namespace); err != nil {
+		return err
+	}
+	if err := validateString("actorID", placement.ActorID); err != nil {
+		return err
+	}
+	if err := validateString("moduleID", placement.ModuleID); err != nil {
+		return err
+	}
+	m, err := v.migratable()
+	if err != nil {
+		return err
+	}
+	return m.PutActorPlacement(ctx, placement)
+}
+
+// migratable returns the wrapped registry if it implements MigratableRegistry.
+func (v *validator) migratable() (MigratableRegistry, error) {
+	m, ok := v.r.(MigratableRegistry)
+	if !ok {
+		return nil, fmt.Errorf("registry: %T does not implement MigratableRegistry", v.r)
+	}
+	return m, nil
+}
+
 func (v *validator) Close(ctx context.Context) error {
 	return v.r.Close(ctx)
 }
 
+func (v *validator) WatchActivations(
+	ctx context.Context,
+	onActivationChanged func(ActivationChange),
+	onServerRemoved func(serverID string),
+) error {
+	return watchActivations(ctx, v.r, onActivationChanged, onServerRemoved)
+}
+
 func (v *validator) UnsafeWipeAll() error {
 	return v.r.UnsafeWipeAll()
 }
 
+func validateReminder(namespace, actorID, moduleID, name string) error {
+	if err := validateString("namespace", namespace); err != nil {
+		return err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return err
+	}
+	if err := validateString("moduleID", moduleID); err != nil {
+		return err
+	}
+	return validateString("name", name)
+}
+
 func validateString(name, x string) error {
 	if x == "" {
 		return fmt.Errorf("%s cannot be empty", name)
@@ -188,6 +449,70 @@ func (k *kvValidator) Get(ctx context.Context, key []byte) ([]byte, bool, error)
 	return k.tr.Get(ctx, key)
 }
 
+func (k *kvValidator) Delete(ctx context.Context, key []byte) error {
+	if len(key) == 0 {
+		return errors.New("key cannot be empty")
+	}
+	if len(key) > 1<<10 {
+		return fmt.Errorf("key cannot be > 1<<10, but was: %d", len(key))
+	}
+
+	return k.tr.Delete(ctx, key)
+}
+
+func (k *kvValidator) GetWithVersion(ctx context.Context, key []byte) ([]byte, int64, bool, error) {
+	if len(key) == 0 {
+		return nil, 0, false, errors.New("key cannot be empty")
+	}
+	if len(key) > 1<<10 {
+		return nil, 0, false, fmt.Errorf("key cannot be > 1<<10, but was: %d", len(key))
+	}
+
+	return k.tr.GetWithVersion(ctx, key)
+}
+
+func (k *kvValidator) PutIfVersion(
+	ctx context.Context,
+	key []byte,
+	value []byte,
+	expectedVersion int64,
+) (bool, error) {
+	if len(key) == 0 {
+		return false, errors.New("key cannot be empty")
+	}
+	if len(key) > 1<<10 {
+		return false, fmt.Errorf("key cannot be > 1<<10, but was: %d", len(key))
+	}
+	if expectedVersion < 0 {
+		return false, fmt.Errorf("expectedVersion cannot be < 0, but was: %d", expectedVersion)
+	}
+
+	return k.tr.PutIfVersion(ctx, key, value, expectedVersion)
+}
+
+func (k *kvValidator) Incr(ctx context.Context, key []byte, delta int64) (int64, error) {
+	if len(key) == 0 {
+		return 0, errors.New("key cannot be empty")
+	}
+	if len(key) > 1<<10 {
+		return 0, fmt.Errorf("key cannot be > 1<<10, but was: %d", len(key))
+	}
+
+	return k.tr.Incr(ctx, key, delta)
+}
+
+func (k *kvValidator) IterPrefix(
+	ctx context.Context,
+	prefix []byte,
+	fn func(k, v []byte) error,
+) error {
+	if len(prefix) > 1<<10 {
+		return fmt.Errorf("prefix cannot be > 1<<10, but was: %d", len(prefix))
+	}
+
+	return k.tr.IterPrefix(ctx, prefix, fn)
+}
+
 func (k *kvValidator) Commit(ctx context.Context) error {
 	return k.tr.Commit(ctx)
 }
@@ -0,0 +1,146 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+func (r *environment) Registry() registry.Registry {
+	return r.registry
+}
+
+func (r *environment) RegisterModule(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	moduleBytes []byte,
+	opts registry.ModuleOptions,
+) (registry.RegisterModuleResult, error) {
+	return r.registry.RegisterModule(ctx, namespace, moduleID, moduleBytes, opts)
+}
+
+func (r *environment) ListActors(
+	ctx context.Context,
+	namespace string,
+) ([]registry.ActorPlacement, error) {
+	if namespace == "" {
+		return nil, errors.New("ListActors: namespace cannot be empty")
+	}
+	m, err := r.migratableRegistry()
+	if err != nil {
+		return nil, fmt.Errorf("ListActors: %w", err)
+	}
+
+	placements, err := m.ListActorPlacements(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ListActors: error listing actors: %w", err)
+	}
+	actors := make([]registry.ActorPlacement, 0, len(placements))
+	for _, placement := range placements {
+		if placement.Namespace == namespace {
+			actors = append(actors, placement)
+		}
+	}
+	return actors, nil
+}
+
+func (r *environment) RebalanceActor(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorID string,
+) ([]types.ActorReference, error) {
+	if namespace == "" {
+		return nil, errors.New("RebalanceActor: namespace cannot be empty")
+	}
+	if actorID == "" {
+		return nil, errors.New("RebalanceActor: actorID cannot be empty")
+	}
+	if moduleID == "" {
+		return nil, errors.New("RebalanceActor: moduleID cannot be empty")
+	}
+	m, err := r.migratableRegistry()
+	if err != nil {
+		return nil, fmt.Errorf("RebalanceActor: %w", err)
+	}
+
+	actor, ok := r.startHandoff(types.NewNamespacedActorID(namespace, actorID, moduleID, types.IDTypeActor))
+	if !ok {
+		return r.rebalanceActor(ctx, m, namespace, moduleID, actorID)
+	}
+
+	// The actor is activated on this server, so its in-memory state is handed off to
+	// wherever it's placed next.
+	var (
+		references   []types.ActorReference
+		rebalanceErr error
+	)
+	err = r.handoffActor(ctx, actor, "rebalance", func(context.Context) (types.ActorReference, error) {
+		references, rebalanceErr = r.rebalanceActor(ctx, m, namespace, moduleID, actorID)
+		if rebalanceErr != nil {
+			return nil, rebalanceErr
+		}
+		return references[0], nil
+	})
+	if rebalanceErr != nil {
+		return nil, rebalanceErr
+	}
+	if err != nil {
+		log.Printf("error handing off rebalanced actor: %s(%s), err: %v", actorID, moduleID, err)
+	}
+	return references, nil
+}
+
+// rebalanceActor implements RebalanceActor() once the arguments have been validated.
+func (r *environment) rebalanceActor(
+	ctx context.Context,
+	m registry.MigratableRegistry,
+	namespace string,
+	moduleID string,
+	actorID string,
+) ([]types.ActorReference, error) {
+	placement, ok, err := m.GetActorPlacement(ctx, namespace, actorID, moduleID)
+	if err != nil {
+		return nil, fmt.Errorf("RebalanceActor: error getting actor: %w", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("RebalanceActor: actor: %s(%s) does not exist", actorID, moduleID)
+	}
+	// Clearing the activation makes the registry place the actor again the next time it's
+	// ensured.
+	placement.ServerID, placement.ServerVersion = "", 0
+	placement.Generation++
+	if err := m.PutActorPlacement(ctx, placement); err != nil {
+		return nil, fmt.Errorf("RebalanceActor: error clearing activation: %w", err)
+	}
+
+	// Resolve the actor at a versionstamp after the change so that neither the cached
+	// activation nor a refresh that was already in flight routes to its old placement.
+	vs, err := r.registry.GetVersionStamp(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("RebalanceActor: error getting versionstamp: %w", err)
+	}
+	references, err := r.activationsCache.ensureActivationAtLeast(ctx, namespace, moduleID, actorID, vs)
+	if err != nil {
+		return nil, fmt.Errorf("RebalanceActor: error placing actor: %w", err)
+	}
+	if len(references) == 0 {
+		return nil, fmt.Errorf("RebalanceActor: actor: %s(%s) was not placed on any server", actorID, moduleID)
+	}
+	return references, nil
+}
+
+// migratableRegistry returns the environment's registry if it supports the admin
+// operations of registry.MigratableRegistry.
+func (r *environment) migratableRegistry() (registry.MigratableRegistry, error) {
+	m, ok := r.registry.(registry.MigratableRegistry)
+	if !ok {
+		return nil, fmt.Errorf("registry: %T does not implement registry.MigratableRegistry", r.registry)
+	}
+	return m, nil
+}
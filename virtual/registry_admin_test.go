@@ -0,0 +1,109 @@
+package virtual
+
+import (
+	"context"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestEnvironmentRegistryAdmin ensures that admin operations can be performed through the
+// environment, and that rebalancing an actor is observed by the environment's cached
+// activations right away.
+func TestEnvironmentRegistryAdmin(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 67
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.Equal(t, reg, env.Registry())
+
+	_, err = env.RegisterModule(ctx, "ns-1", "wasm-module", []byte("wasm"), registry.ModuleOptions{})
+	require.NoError(t, err)
+	moduleBytes, _, err := reg.GetModule(ctx, "ns-1", "wasm-module")
+	require.NoError(t, err)
+	require.Equal(t, []byte("wasm"), moduleBytes)
+
+	for _, namespace := range []string{"ns-1", "ns-2"} {
+		require.NoError(t, env.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: namespace, ID: "test-module"}, testModule{}))
+	}
+	for _, actorID := range []string{"a", "b"} {
+		_, err = env.InvokeActor(ctx, "ns-1", actorID, "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+	}
+	_, err = env.InvokeActor(ctx, "ns-2", "c", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+
+	actors, err := env.ListActors(ctx, "ns-1")
+	require.NoError(t, err)
+	require.Len(t, actors, 2)
+	for _, actor := range actors {
+		require.Equal(t, "test-module", actor.ModuleID)
+		require.Equal(t, "serverID1", actor.ServerID)
+	}
+	_, err = env.ListActors(ctx, "")
+	require.Error(t, err)
+
+	before, err := env.WhereIs(ctx, "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	references, err := env.RebalanceActor(ctx, "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.Len(t, references, 1)
+	require.Equal(t, "serverID1", references[0].ServerID())
+	require.Equal(t, before[0].Generation()+1, references[0].Generation())
+
+	// The actor's activation was invalidated, and the environment routes to its new
+	// activation without waiting for the cache to be refreshed.
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, "1", string(result))
+	result, err = env.InvokeActor(ctx, "ns-1", "b", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, "2", string(result))
+
+	_, err = env.RebalanceActor(ctx, "ns-1", "test-module", "does-not-exist")
+	require.Error(t, err)
+}
+
+// TestEnvironmentRebalanceHandoff ensures that rebalancing an actor that is activated on
+// the environment hands its in-memory state off to its new activation when handoffs are
+// enabled.
+func TestEnvironmentRebalanceHandoff(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 71
+	opts.Handoff.Enabled = true
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	for i := 0; i < 3; i++ {
+		_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+	}
+	before, err := env.WhereIs(ctx, "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	references, err := env.RebalanceActor(ctx, "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.Equal(t, before[0].Generation()+1, references[0].Generation())
+
+	// The new activation was restored from the old one instead of starting cold.
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, "4", string(result))
+	require.Equal(t, 1, env.(*environment).numActivatedActors())
+}
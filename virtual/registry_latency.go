@@ -0,0 +1,134 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// registryLatencyEWMAWeight is the weight of every new sample in the exponentially
+	// weighted moving average of the registry's latency.
+	registryLatencyEWMAWeight = 0.2
+	// defaultMaxSlowRegistryStalenessFactor is the default value of
+	// ActivationsCacheOptions.MaxSlowRegistryStaleness as a multiple of
+	// IdealCacheStaleness.
+	defaultMaxSlowRegistryStalenessFactor = 10
+	// defaultMaxSlowRegistryEnsureTimeoutFactor is the default value of
+	// ActivationsCacheOptions.MaxSlowRegistryEnsureTimeout as a multiple of EnsureTimeout.
+	defaultMaxSlowRegistryEnsureTimeoutFactor = 2
+)
+
+// registryLatencyTracker tracks the exponentially weighted moving average (EWMA) of the
+// latency of the activation cache's calls to the registry.
+type registryLatencyTracker struct {
+	sync.Mutex
+	ewma       time.Duration
+	numSamples uint64
+}
+
+// record adds the latency of a call to the registry that failed with err (if any) to
+// the average. Calls that were canceled by their caller say nothing about the registry's
+// latency so they're ignored.
+func (t *registryLatencyTracker) record(latency time.Duration, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if t.numSamples == 0 {
+		t.ewma = latency
+	} else {
+		t.ewma = time.Duration(
+			registryLatencyEWMAWeight*float64(latency) + (1-registryLatencyEWMAWeight)*float64(t.ewma))
+	}
+	t.numSamples++
+}
+
+func (t *registryLatencyTracker) average() time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	return t.ewma
+}
+
+// recordRegistryLatency records the latency of a call to the registry that started at
+// start and was made with ctx. It's meant to be deferred. Calls that timed out because of
+// their caller's deadline (see withEnsureTimeout) say nothing about the registry's latency
+// so they're ignored.
+func (a *activationsCache) recordRegistryLatency(ctx context.Context, start time.Time, err error) {
+	if exceededCallerDeadline(ctx, err) {
+		return
+	}
+	a.registryLatency.record(time.Since(start), err)
+}
+
+// slowRegistryFactor returns how many times slower than SlowRegistryThreshold the
+// registry currently is, or 1 if it isn't slower (or the detector is disabled).
+func (a *activationsCache) slowRegistryFactor() float64 {
+	if a.opts.SlowRegistryThreshold <= 0 {
+		return 1
+	}
+	latency := a.registryLatency.average()
+	if latency <= a.opts.SlowRegistryThreshold {
+		return 1
+	}
+	return float64(latency) / float64(a.opts.SlowRegistryThreshold)
+}
+
+// ensureTimeout returns the timeout for calls to the registry, which is EnsureTimeout
+// widened proportionally to how slow the registry is, up to MaxSlowRegistryEnsureTimeout.
+func (a *activationsCache) ensureTimeout() time.Duration {
+	return widen(a.opts.EnsureTimeout, a.slowRegistryFactor(), a.opts.MaxSlowRegistryEnsureTimeout)
+}
+
+// callerDeadlineCtxKey is set in the contexts returned by withEnsureTimeout whose deadline
+// is the caller's.
+type callerDeadlineCtxKey struct{}
+
+// withEnsureTimeout returns a context for a call to the registry that is made on behalf of
+// the caller of ctx. The call times out after ensureTimeout(), or at the caller's deadline
+// if it's sooner, so the cache never waits on the registry (and the registry never works
+// on the call) for longer than the caller is willing to wait. The caller's deadline is
+// respected even if ctx is detached from the caller (see detachedContext).
+func (a *activationsCache) withEnsureTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := a.ensureTimeout()
+	deadline, ok := ctx.Deadline()
+	if detached, isDetached := ctx.(detachedContext); isDetached {
+		deadline, ok = detached.Context.Deadline()
+	}
+	if ok {
+		if remaining := time.Until(deadline); remaining < timeout {
+			return context.WithTimeout(context.WithValue(ctx, callerDeadlineCtxKey{}, true), remaining)
+		}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// exceededCallerDeadline returns whether a call to the registry that was made with a
+// context returned by withEnsureTimeout failed with err because the caller's deadline
+// expired, rather than because the registry did not respond within ensureTimeout().
+func exceededCallerDeadline(ctx context.Context, err error) bool {
+	bound, _ := ctx.Value(callerDeadlineCtxKey{}).(bool)
+	return bound && errors.Is(err, context.DeadlineExceeded)
+}
+
+// effectiveStaleness returns the staleness after which entries are refreshed, which is
+// staleness extended proportionally to how slow the registry is, up to
+// MaxSlowRegistryStaleness.
+func (a *activationsCache) effectiveStaleness(staleness time.Duration) time.Duration {
+	return widen(staleness, a.slowRegistryFactor(), a.opts.MaxSlowRegistryStaleness)
+}
+
+// widen multiplies d by factor, but never beyond max (unless d already is).
+func widen(d time.Duration, factor float64, max time.Duration) time.Duration {
+	if factor <= 1 || d <= 0 || d >= max {
+		return d
+	}
+	widened := time.Duration(float64(d) * factor)
+	if widened > max {
+		return max
+	}
+	return widened
+}
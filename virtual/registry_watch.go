@@ -0,0 +1,56 @@
+package virtual
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+)
+
+// registryWatchRetryInterval is the interval at which watchRegistry() watches the
+// registry again after the watch fails.
+const registryWatchRetryInterval = time.Second
+
+// watchRegistry invalidates the activations that are cached by the activations cache as
+// soon as the registry notifies that they changed (see
+// ActivationsCacheOptions.WatchRegistry), until the environment is closed.
+func (r *environment) watchRegistry() {
+	defer close(r.registryWatchClosedCh)
+	if !r.opts.ActivationsCache.WatchRegistry {
+		return
+	}
+	watcher, ok := r.registry.(registry.ActivationWatcher)
+	if !ok {
+		return
+	}
+
+	ctx, cc := context.WithCancel(context.Background())
+	defer cc()
+	go func() {
+		select {
+		case <-r.closeCh:
+			cc()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		err := watcher.WatchActivations(
+			ctx, r.activationsCache.invalidateActivation, r.activationsCache.serverRemoved)
+		if ctx.Err() != nil {
+			return
+		}
+		if registry.IsWatchNotSupportedErr(err) {
+			log.Printf("not watching the registry for activation changes: %v\n", err)
+			return
+		}
+		log.Printf("error watching the registry for activation changes: %v\n", err)
+
+		select {
+		case <-time.After(registryWatchRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestEnvironmentWatchRegistry ensures that environments watch registries that implement
+// registry.ActivationWatcher when ActivationsCacheOptions.WatchRegistry is set, that the
+// watch is retried after it fails, that the changes it receives invalidate the cache, and
+// that the watch is stopped when the environment is closed.
+func TestEnvironmentWatchRegistry(t *testing.T) {
+	var (
+		reg = &watchingTestRegistry{
+			Registry: localregistry.NewLocalRegistry(),
+			watches:  make(chan func(registry.ActivationChange), 1),
+		}
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 74
+	opts.ActivationsCache.WatchRegistry = true
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, &testDeactivatorModule{}))
+
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	cache := env.(*environment).activationsCache
+	cache.c.Wait()
+	meta, err := cache.ensureActivationWithMeta(ctx, "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.True(t, meta.FromCache)
+
+	var onActivationChanged func(registry.ActivationChange)
+	select {
+	case onActivationChanged = <-reg.watches:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the registry to be watched")
+	}
+	require.Equal(t, int64(2), reg.numWatches.Load())
+
+	onActivationChanged(registry.ActivationChange{
+		ActorID: types.NewNamespacedActorID("ns-1", "a", "test-module", types.IDTypeActor),
+	})
+	cache.c.Wait()
+	meta, err = cache.ensureActivationWithMeta(ctx, "ns-1", "test-module", "a")
+	require.NoError(t, err)
+	require.False(t, meta.FromCache)
+
+	require.NoError(t, env.Close())
+	require.True(t, reg.watchStopped.Load())
+}
+
+// watchingTestRegistry is a registry that implements registry.ActivationWatcher. Its first
+// watch fails, and the callbacks of the following ones are sent to watches.
+type watchingTestRegistry struct {
+	registry.Registry
+
+	watches      chan func(registry.ActivationChange)
+	numWatches   atomic.Int64
+	watchStopped atomic.Bool
+}
+
+func (r *watchingTestRegistry) WatchActivations(
+	ctx context.Context,
+	onActivationChanged func(registry.ActivationChange),
+	onServerRemoved func(serverID string),
+) error {
+	if r.numWatches.Add(1) == 1 {
+		return errors.New("watchingTestRegistry: watch failed")
+	}
+	r.watches <- onActivationChanged
+	<-ctx.Done()
+	r.watchStopped.Store(true)
+	return ctx.Err()
+}
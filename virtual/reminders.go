@@ -0,0 +1,149 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+)
+
+const (
+	defaultReminderPollInterval = time.Second
+	// reminderClaimBatchSize is the maximum number of reminders that are claimed from the
+	// registry (and then fired concurrently) at once.
+	reminderClaimBatchSize = 100
+)
+
+func (r *environment) RegisterReminder(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	name string,
+	dueTime time.Time,
+	period time.Duration,
+) error {
+	err := r.registry.RegisterReminder(ctx, namespace, actorID, moduleID, name, dueTime, period)
+	if err != nil {
+		return fmt.Errorf("RegisterReminder: error registering reminder: %w", err)
+	}
+	return nil
+}
+
+func (r *environment) UnregisterReminder(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	name string,
+) error {
+	err := r.registry.UnregisterReminder(ctx, namespace, actorID, moduleID, name)
+	if err != nil {
+		return fmt.Errorf("UnregisterReminder: error unregistering reminder: %w", err)
+	}
+	return nil
+}
+
+func (r *environment) ListReminders(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+) ([]registry.Reminder, error) {
+	reminders, err := r.registry.ListReminders(ctx, namespace, actorID, moduleID)
+	if err != nil {
+		return nil, fmt.Errorf("ListReminders: error listing reminders: %w", err)
+	}
+	return reminders, nil
+}
+
+// remindersLoop periodically claims the reminders that are due from the registry and
+// fires them until the environment is closed.
+func (r *environment) remindersLoop() {
+	defer close(r.remindersClosedCh)
+	ticker := time.NewTicker(r.opts.ReminderPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.fireDueReminders()
+		case <-r.closeCh:
+			return
+		}
+	}
+}
+
+// fireDueReminders claims and fires due reminders in batches until there are no more
+// due reminders (or the environment is closed).
+func (r *environment) fireDueReminders() {
+	for {
+		ctx, cc := context.WithTimeout(context.Background(), heartbeatTimeout)
+		reminders, err := r.registry.ClaimDueReminders(ctx, time.Now(), reminderClaimBatchSize)
+		cc()
+		if err != nil {
+			log.Printf("error claiming due reminders: %v\n", err)
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, reminder := range reminders {
+			wg.Add(1)
+			go func(reminder registry.Reminder) {
+				defer wg.Done()
+				if err := r.fireReminder(reminder); err != nil {
+					log.Printf(
+						"error firing reminder: %s for actor: %s in module: %s and namespace: %s, err: %v\n",
+						reminder.Name, reminder.ActorID, reminder.ModuleID, reminder.Namespace, err)
+				}
+			}(reminder)
+		}
+		wg.Wait()
+
+		if len(reminders) < reminderClaimBatchSize {
+			return
+		}
+		select {
+		case <-r.closeCh:
+			return
+		default:
+		}
+	}
+}
+
+// fireReminder invokes the wapcutils.ReceiveReminderOperationName operation on the actor
+// the reminder belongs to. Reminders are claimed before they're fired so each firing is
+// delivered at most once: if the invocation fails the firing is not retried later.
+func (r *environment) fireReminder(reminder registry.Reminder) error {
+	payload, err := json.Marshal(wapcutils.ReceiveReminderRequest{
+		Name:              reminder.Name,
+		DueTimeUnixMicros: reminder.DueTime.UnixMicro(),
+		PeriodMillis:      reminder.Period.Milliseconds(),
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling reminder payload: %w", err)
+	}
+
+	ctx := context.Background()
+	_, err = r.InvokeActor(
+		ctx, reminder.Namespace, reminder.ActorID, reminder.ModuleID,
+		wapcutils.ReceiveReminderOperationName, payload, types.CreateIfNotExist{})
+	if err == nil {
+		return nil
+	}
+
+	// The actor may have moved to a different server since its activation was cached,
+	// in which case the invocation will keep failing until the cache entry expires. Drop
+	// the entry and try once more so the invocation is routed to the actor's current
+	// location.
+	r.activationsCache.delete(reminder.Namespace, reminder.ModuleID, reminder.ActorID)
+	_, err = r.InvokeActor(
+		ctx, reminder.Namespace, reminder.ActorID, reminder.ModuleID,
+		wapcutils.ReceiveReminderOperationName, payload, types.CreateIfNotExist{})
+	return err
+}
@@ -0,0 +1,125 @@
+package virtual
+
+import (
+	"context"
+	"sync"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+// ReplicaSelectionPolicy controls which of an actor's references the invocations that
+// allow replica reads (see WithReplicaReads) are sent to.
+type ReplicaSelectionPolicy string
+
+const (
+	// ReplicaSelectionPolicyPrimary sends every invocation to the actor's primary
+	// activation, even if it allows replica reads.
+	ReplicaSelectionPolicyPrimary ReplicaSelectionPolicy = "primary"
+	// ReplicaSelectionPolicyRoundRobin spreads replica reads evenly across the actor's
+	// references (including the primary) in order.
+	ReplicaSelectionPolicyRoundRobin ReplicaSelectionPolicy = "round_robin"
+	// ReplicaSelectionPolicyRandom sends every replica read to a randomly chosen
+	// reference of the actor (including the primary).
+	ReplicaSelectionPolicyRandom ReplicaSelectionPolicy = "random"
+	// ReplicaSelectionPolicyLeastRecentlyUsed sends every replica read to the reference
+	// of the actor (including the primary) that was used the longest time ago.
+	ReplicaSelectionPolicyLeastRecentlyUsed ReplicaSelectionPolicy = "least_recently_used"
+)
+
+type replicaReadsCtxKey struct{}
+
+// WithReplicaReads returns a context that indicates that the invocation doesn't mutate
+// the actor's state, so it may be sent to any of the actor's references according to
+// ActivationsCacheOptions.ReplicaSelectionPolicy instead of always being sent to its
+// primary activation. Invocations without it are always sent to the primary.
+func WithReplicaReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, replicaReadsCtxKey{}, true)
+}
+
+func isReplicaReadAllowed(ctx context.Context) bool {
+	allowed, _ := ctx.Value(replicaReadsCtxKey{}).(bool)
+	return allowed
+}
+
+// replicaSelection is the state of the ReplicaSelectionPolicyRoundRobin and
+// ReplicaSelectionPolicyLeastRecentlyUsed policies for a single cached actor. It's
+// stored in the cache's index so it's forgotten once the actor is evicted.
+type replicaSelection struct {
+	sync.Mutex
+	next int
+	// lastUsed maps server ID -> the value of seq when a reference to it was last used.
+	lastUsed map[string]uint64
+	seq      uint64
+}
+
+// selectReference returns the reference of the actor that an invocation with ctx should
+// be sent to. references must be the actor's references, as returned by
+// ensureActivation(), and must not be empty.
+func (a *activationsCache) selectReference(
+	ctx context.Context,
+	namespace,
+	moduleID,
+	actorID string,
+	references []types.ActorReference,
+) types.ActorReference {
+	policy := a.opts.ReplicaSelectionPolicy
+	if len(references) == 1 || !isReplicaReadAllowed(ctx) || policy == ReplicaSelectionPolicyPrimary {
+		return primaryReference(references)
+	}
+
+	if policy == ReplicaSelectionPolicyRandom {
+		return references[a.randInt63n(int64(len(references)))]
+	}
+
+	selection := a.index.replicaSelection(namespace, string(formatActorCacheKey(nil, namespace, moduleID, actorID)))
+	if selection == nil {
+		// The actor is not cached (anymore) so there is nowhere to keep track of the
+		// references that were used.
+		return primaryReference(references)
+	}
+	selection.Lock()
+	defer selection.Unlock()
+	switch policy {
+	case ReplicaSelectionPolicyRoundRobin:
+		ref := references[selection.next%len(references)]
+		selection.next++
+		return ref
+	default:
+		selected := references[0]
+		for _, ref := range references[1:] {
+			if selection.lastUsed[ref.ServerID()] < selection.lastUsed[selected.ServerID()] {
+				selected = ref
+			}
+		}
+		selection.seq++
+		selection.lastUsed[selected.ServerID()] = selection.seq
+		return selected
+	}
+}
+
+// primaryReference returns the reference to the actor's primary activation, which is the
+// first one that is not a replica.
+func primaryReference(references []types.ActorReference) types.ActorReference {
+	for _, ref := range references {
+		if !ref.IsReplica() {
+			return ref
+		}
+	}
+	return references[0]
+}
+
+// replicaSelection returns the replica selection state of the cached key, creating it
+// if necessary, or nil if the key is not cached.
+func (idx *activationsCacheIndex) replicaSelection(namespace, key string) *replicaSelection {
+	idx.Lock()
+	defer idx.Unlock()
+	entry, ok := idx.m[namespace][key]
+	if !ok {
+		return nil
+	}
+	if entry.replicas == nil {
+		entry.replicas = &replicaSelection{lastUsed: make(map[string]uint64)}
+		idx.m[namespace][key] = entry
+	}
+	return entry.replicas
+}
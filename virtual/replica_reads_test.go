@@ -0,0 +1,86 @@
+package virtual
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// replicatedTestCacheRegistry is a testCacheRegistry that returns two extra replicas
+// alongside the primary reference of every actor.
+type replicatedTestCacheRegistry struct {
+	*testCacheRegistry
+}
+
+func (r replicatedTestCacheRegistry) EnsureActivation(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	moduleID string,
+	opts registry.EnsureActivationOptions,
+) ([]types.ActorReference, error) {
+	refs, err := r.testCacheRegistry.EnsureActivation(ctx, namespace, actorID, moduleID, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, serverID := range []string{"replica1", "replica2"} {
+		ref, err := types.NewActorReference(serverID, 1, serverID, namespace, moduleID, actorID, 1)
+		if err != nil {
+			return nil, err
+		}
+		replica, err := types.AsReplica(ref)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, replica)
+	}
+	return refs, nil
+}
+
+func TestActivationsCacheReplicaSelection(t *testing.T) {
+	selectN := func(t *testing.T, policy ReplicaSelectionPolicy, ctx context.Context, n int) []string {
+		reg := replicatedTestCacheRegistry{newTestCacheRegistry(t)}
+		c, err := newActivationsCache(reg, time.Hour, false, ActivationsCacheOptions{
+			ReplicaSelectionPolicy: policy,
+		})
+		require.NoError(t, err)
+		refs, err := c.ensureActivation(context.Background(), "ns-1", "test-module", "a")
+		require.NoError(t, err)
+		require.Len(t, refs, 3)
+		c.c.Wait()
+
+		var serverIDs []string
+		for i := 0; i < n; i++ {
+			serverIDs = append(serverIDs, c.selectReference(ctx, "ns-1", "test-module", "a", refs).ServerID())
+		}
+		return serverIDs
+	}
+	var (
+		reads = WithReplicaReads(context.Background())
+		all   = []string{"serverID1", "replica1", "replica2"}
+	)
+
+	// Invocations that don't allow replica reads always go to the primary.
+	for _, policy := range []ReplicaSelectionPolicy{
+		"", ReplicaSelectionPolicyRoundRobin, ReplicaSelectionPolicyLeastRecentlyUsed,
+	} {
+		require.Equal(t, []string{"serverID1", "serverID1"}, selectN(t, policy, context.Background(), 2))
+	}
+	require.Equal(t, []string{"serverID1", "serverID1"}, selectN(t, ReplicaSelectionPolicyPrimary, reads, 2))
+
+	require.Equal(t, append(all, all...), selectN(t, ReplicaSelectionPolicyRoundRobin, reads, 6))
+	require.Equal(t, append(all, all...), selectN(t, ReplicaSelectionPolicyLeastRecentlyUsed, reads, 6))
+	for _, serverID := range selectN(t, ReplicaSelectionPolicyRandom, reads, 10) {
+		require.Contains(t, all, serverID)
+	}
+
+	_, err := newActivationsCache(newTestCacheRegistry(t), time.Hour, false, ActivationsCacheOptions{
+		ReplicaSelectionPolicy: "unknown",
+	})
+	require.Error(t, err)
+}
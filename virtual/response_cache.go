@@ -0,0 +1,235 @@
+package virtual
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+)
+
+const defaultMaxCachedResponsesPerActor = 128
+
+// mutatingHostOperations contains the operations that are invoked by the host which may
+// modify the actor's state, so they invalidate its cached responses.
+var mutatingHostOperations = map[string]struct{}{
+	wapcutils.ReceiveReminderOperationName:  {},
+	wapcutils.ReceiveTimerOperationName:     {},
+	wapcutils.RestoreOperationName:          {},
+	wapcutils.MembershipChangeOperationName: {},
+}
+
+// ResponseCacheOptions contains the options for caching the responses of operations that
+// are pure reads, which are expensive to compute but remain valid for a while. The
+// responses of a cached operation are remembered by every activation, keyed by a hash of
+// the operation and its payload, and invocations that hit the cache return the remembered
+// response without invoking the actor.
+//
+// Operations are cached if they have a TTL, which is either declared by the module (see
+// wapcutils.OperationDescription.CacheTTLMillis) or configured in OperationTTLs. Cached
+// responses are invalidated when the actor is invoked with an operation that may modify
+// its state: the ones that the module declares with wapcutils.OperationDescription.Mutates
+// (which are never cached either, so modules can opt out of caching per operation), and
+// the host operations that deliver reminders and timers. Since modules that don't describe
+// their operations can't declare which ones mutate state, every operation of theirs that
+// is not cached invalidates the cache.
+//
+// Cached responses are buffered so they're never streamed, and they're forgotten when the
+// actor is deactivated.
+type ResponseCacheOptions struct {
+	// OperationTTLs contains the TTLs of the cached operations of modules, keyed by module
+	// and then by operation. They take precedence over the TTLs that modules declare.
+	OperationTTLs map[types.NamespacedIDNoType]map[string]time.Duration
+	// MaxEntriesPerActor is the maximum number of responses that are cached by each
+	// activated actor. The least recently used responses are forgotten once it's
+	// exceeded.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 128.
+	MaxEntriesPerActor int
+}
+
+// Validate validates the ResponseCacheOptions.
+func (o *ResponseCacheOptions) Validate() error {
+	if o.MaxEntriesPerActor < 0 {
+		return fmt.Errorf("MaxEntriesPerActor must be >= 0, but was: %d", o.MaxEntriesPerActor)
+	}
+	for moduleID, ttls := range o.OperationTTLs {
+		for operation, ttl := range ttls {
+			if ttl < 0 {
+				return fmt.Errorf(
+					"TTL of operation: %s of module: %s/%s must be >= 0, but was: %s",
+					operation, moduleID.Namespace, moduleID.ID, ttl)
+			}
+		}
+	}
+	return nil
+}
+
+// responseCaches creates the response caches of activated actors and aggregates their
+// statistics.
+type responseCaches struct {
+	opts ResponseCacheOptions
+
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	invalidations atomic.Uint64
+}
+
+func newResponseCaches(opts ResponseCacheOptions) *responseCaches {
+	if opts.MaxEntriesPerActor == 0 {
+		opts.MaxEntriesPerActor = defaultMaxCachedResponsesPerActor
+	}
+	return &responseCaches{opts: opts}
+}
+
+// newCache returns the response cache of an activation of the provided module, or nil if
+// none of its operations are cached. description is nil if the module hasn't been
+// described.
+func (r *responseCaches) newCache(
+	moduleID types.NamespacedID,
+	description *moduleDescription,
+) *responseCache {
+	var (
+		ttls     = make(map[string]time.Duration)
+		mutating map[string]struct{}
+	)
+	if description != nil && description.err == nil {
+		mutating = make(map[string]struct{})
+		for _, op := range description.description.Operations {
+			if op.Mutates {
+				mutating[op.Name] = struct{}{}
+			} else if op.CacheTTLMillis > 0 {
+				ttls[op.Name] = time.Duration(op.CacheTTLMillis) * time.Millisecond
+			}
+		}
+	}
+	for operation, ttl := range r.opts.OperationTTLs[types.NewNamespacedIDNoType(moduleID.Namespace, moduleID.ID)] {
+		if _, ok := mutating[operation]; !ok {
+			ttls[operation] = ttl
+		}
+	}
+	for operation, ttl := range ttls {
+		if _, ok := hostOperations[operation]; ok || ttl <= 0 {
+			delete(ttls, operation)
+		}
+	}
+	if len(ttls) == 0 {
+		return nil
+	}
+
+	return &responseCache{
+		caches:     r,
+		ttls:       ttls,
+		mutating:   mutating,
+		maxEntries: r.opts.MaxEntriesPerActor,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// responseCache remembers the responses of the cached operations of a single activated
+// actor. It's an LRU with a per-operation TTL. It's not safe for concurrent use, the
+// actor's lock must be held, except for ttl. All of its methods are no-ops on a nil
+// responseCache.
+type responseCache struct {
+	caches *responseCaches
+	// ttls contains the TTLs of the cached operations. It's immutable.
+	ttls map[string]time.Duration
+	// mutating contains the operations that invalidate the cache, or nil if every
+	// operation that is not cached invalidates it. It's immutable.
+	mutating   map[string]struct{}
+	maxEntries int
+	lru        *list.List
+	entries    map[string]*list.Element
+}
+
+type responseCacheEntry struct {
+	key       string
+	result    []byte
+	expiresAt time.Time
+}
+
+// ttl returns the TTL of the responses of the operation, or 0 if they're not cached.
+func (c *responseCache) ttl(operation string) time.Duration {
+	if c == nil {
+		return 0
+	}
+	return c.ttls[operation]
+}
+
+func (c *responseCache) get(key string, now time.Time) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	elem, ok := c.entries[key]
+	if ok && now.After(elem.Value.(*responseCacheEntry).expiresAt) {
+		c.remove(elem)
+		ok = false
+	}
+	if !ok {
+		c.caches.misses.Add(1)
+		return nil, false
+	}
+	c.caches.hits.Add(1)
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*responseCacheEntry).result, true
+}
+
+func (c *responseCache) put(key string, result []byte, ttl time.Duration, now time.Time) {
+	if c == nil {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&responseCacheEntry{
+		key:       key,
+		result:    result,
+		expiresAt: now.Add(ttl),
+	})
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate forgets every cached response if the operation may modify the actor's state.
+func (c *responseCache) invalidate(operation string) {
+	if c == nil || len(c.entries) == 0 {
+		return
+	}
+	if _, ok := c.ttls[operation]; ok {
+		return
+	}
+	_, isMutatingHostOperation := mutatingHostOperations[operation]
+	if _, isHostOperation := hostOperations[operation]; isHostOperation && !isMutatingHostOperation {
+		return
+	}
+	if _, ok := c.mutating[operation]; c.mutating != nil && !ok && !isMutatingHostOperation {
+		return
+	}
+
+	c.caches.invalidations.Add(1)
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+func (c *responseCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*responseCacheEntry).key)
+}
+
+// responseCacheKey returns the key of the response to the invocation of operation with
+// payload. The operation is length-prefixed so that different (operation, payload) pairs
+// can't produce the same key.
+func responseCacheKey(operation string, payload []byte) string {
+	h := sha256.New()
+	var length [binary.MaxVarintLen64]byte
+	h.Write(length[:binary.PutUvarint(length[:], uint64(len(operation)))])
+	h.Write([]byte(operation))
+	h.Write(payload)
+	return string(h.Sum(nil))
+}
@@ -0,0 +1,177 @@
+package virtual
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+// cachingTestModule is a testModule that declares which of its operations are cached and
+// which ones mutate the actor's state.
+type cachingTestModule struct {
+	testModule
+}
+
+func (m cachingTestModule) Describe(ctx context.Context) (wapcutils.ModuleDescription, error) {
+	return wapcutils.ModuleDescription{
+		Operations: []wapcutils.OperationDescription{
+			{Name: "inc", Mutates: true},
+			{Name: "getCount", CacheTTLMillis: time.Minute.Milliseconds()},
+			{Name: "echo", CacheTTLMillis: 100},
+			{Name: "getStartupWasCalled"},
+		},
+	}, nil
+}
+
+// TestResponseCache ensures that the responses of operations that are declared as cached
+// are returned without invoking the actor until they expire or an operation that mutates
+// the actor's state is invoked.
+func TestResponseCache(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 65
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "caching"}, cachingTestModule{}))
+
+	invoke := func(operation, payload string) string {
+		t.Helper()
+		result, err := env.InvokeActor(
+			ctx, "ns-1", "a", "caching", operation, []byte(payload), types.CreateIfNotExist{})
+		require.NoError(t, err)
+		return string(result)
+	}
+
+	require.Equal(t, "1", invoke("inc", ""))
+	require.Equal(t, "1", invoke("getCount", ""))
+	require.Equal(t, "1", invoke("getCount", ""))
+	// Operations that are neither cached nor mutating don't invalidate the cache.
+	require.Equal(t, "true", invoke("getStartupWasCalled", ""))
+	require.Equal(t, "1", invoke("getCount", ""))
+	stats := env.ActivationStats()
+	require.Equal(t, uint64(2), stats.ResponseCacheHits)
+	require.Equal(t, uint64(1), stats.ResponseCacheMisses)
+	require.Equal(t, uint64(0), stats.ResponseCacheInvalidations)
+
+	// Mutating operations invalidate the cache.
+	require.Equal(t, "2", invoke("inc", ""))
+	require.Equal(t, "2", invoke("getCount", ""))
+	require.Equal(t, uint64(1), env.ActivationStats().ResponseCacheInvalidations)
+
+	// Responses are keyed by their payload, and expire once their TTL elapses.
+	require.Equal(t, "a", invoke("echo", "a"))
+	require.Equal(t, "b", invoke("echo", "b"))
+	require.Equal(t, "a", invoke("echo", "a"))
+	stats = env.ActivationStats()
+	require.Equal(t, uint64(3), stats.ResponseCacheHits)
+	require.Equal(t, uint64(4), stats.ResponseCacheMisses)
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, "a", invoke("echo", "a"))
+	stats = env.ActivationStats()
+	require.Equal(t, uint64(5), stats.ResponseCacheMisses)
+	require.InDelta(t, 3.0/8.0, stats.ResponseCacheHitRatio, 0.001)
+}
+
+// TestResponseCacheConfiguredTTLs ensures that operations can be cached by configuring
+// their TTL, and that every operation that is not cached invalidates the cache of modules
+// that don't describe which operations mutate state.
+func TestResponseCacheConfiguredTTLs(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 66
+	opts.ResponseCache = ResponseCacheOptions{
+		OperationTTLs: map[types.NamespacedIDNoType]map[string]time.Duration{
+			types.NewNamespacedIDNoType("ns-1", "test-module"): {"getCount": time.Minute},
+			// Mutating operations are never cached, even if they're configured.
+			types.NewNamespacedIDNoType("ns-1", "caching"): {"inc": time.Minute},
+		},
+	}
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "caching"}, cachingTestModule{}))
+
+	invoke := func(moduleID, operation string) string {
+		t.Helper()
+		result, err := env.InvokeActor(
+			ctx, "ns-1", "a", moduleID, operation, nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		return string(result)
+	}
+
+	require.Equal(t, "0", invoke("test-module", "getCount"))
+	require.Equal(t, "0", invoke("test-module", "getCount"))
+	require.Equal(t, uint64(1), env.ActivationStats().ResponseCacheHits)
+	require.Equal(t, "true", invoke("test-module", "getStartupWasCalled"))
+	require.Equal(t, uint64(1), env.ActivationStats().ResponseCacheInvalidations)
+	require.Equal(t, "0", invoke("test-module", "getCount"))
+	require.Equal(t, "1", invoke("test-module", "inc"))
+	require.Equal(t, "1", invoke("test-module", "getCount"))
+
+	require.Equal(t, "1", invoke("caching", "inc"))
+	require.Equal(t, "2", invoke("caching", "inc"))
+
+	require.Error(t, (&ResponseCacheOptions{MaxEntriesPerActor: -1}).Validate())
+	require.Error(t, (&ResponseCacheOptions{
+		OperationTTLs: map[types.NamespacedIDNoType]map[string]time.Duration{
+			types.NewNamespacedIDNoType("ns-1", "test-module"): {"getCount": -time.Second},
+		},
+	}).Validate())
+}
+
+// TestResponseCacheLRU ensures that the least recently used responses are forgotten once
+// the cache is full.
+func TestResponseCacheLRU(t *testing.T) {
+	caches := newResponseCaches(ResponseCacheOptions{MaxEntriesPerActor: 2})
+	cache := caches.newCache(
+		types.NewNamespacedID("ns-1", "test-module", types.IDTypeActor),
+		newModuleDescription(wapcutils.ModuleDescription{
+			Operations: []wapcutils.OperationDescription{
+				{Name: "get", CacheTTLMillis: 1000},
+				{Name: "set", Mutates: true},
+			},
+		}))
+	require.Equal(t, time.Second, cache.ttl("get"))
+	require.Zero(t, cache.ttl("set"))
+
+	now := time.Now()
+	for _, payload := range []string{"a", "b"} {
+		cache.put(responseCacheKey("get", []byte(payload)), []byte(payload), time.Second, now)
+	}
+	_, ok := cache.get(responseCacheKey("get", []byte("a")), now)
+	require.True(t, ok)
+	cache.put(responseCacheKey("get", []byte("c")), []byte("c"), time.Second, now)
+	_, ok = cache.get(responseCacheKey("get", []byte("b")), now)
+	require.False(t, ok)
+	_, ok = cache.get(responseCacheKey("get", []byte("a")), now)
+	require.True(t, ok)
+
+	// Keys can't collide by moving bytes between the operation and the payload.
+	require.NotEqual(t, responseCacheKey("ge", []byte("ta")), responseCacheKey("get", []byte("a")))
+
+	// Host operations that may modify the actor's state invalidate the cache.
+	cache.invalidate(wapcutils.SnapshotOperationName)
+	require.Len(t, cache.entries, 2)
+	cache.invalidate(wapcutils.ReceiveTimerOperationName)
+	require.Empty(t, cache.entries)
+
+	// Modules without cached operations don't have a cache.
+	require.Nil(t, caches.newCache(types.NewNamespacedID("ns-1", "other", types.IDTypeActor), nil))
+}
@@ -0,0 +1,342 @@
+package virtual
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// invocationPriorityHeader carries the priority of invocations that are forwarded to
+	// other servers.
+	invocationPriorityHeader = "X-Nola-Priority"
+
+	defaultSchedulerAgingInterval = time.Second
+)
+
+// InvocationPriority is the priority with which an invocation is scheduled when the
+// server is executing EnvironmentOptions.Scheduler.MaxConcurrentInvocations already.
+type InvocationPriority string
+
+const (
+	// InvocationPriorityLow is for invocations that are not latency sensitive, for
+	// example batch jobs.
+	InvocationPriorityLow InvocationPriority = "low"
+	// InvocationPriorityNormal is the default priority.
+	InvocationPriorityNormal InvocationPriority = "normal"
+	// InvocationPriorityHigh is for latency sensitive invocations.
+	InvocationPriorityHigh InvocationPriority = "high"
+)
+
+// invocationPriorities contains the priorities from lowest to highest, so their index is
+// their rank.
+var invocationPriorities = [...]InvocationPriority{
+	InvocationPriorityLow,
+	InvocationPriorityNormal,
+	InvocationPriorityHigh,
+}
+
+// rank returns the rank of p, or -1 if it's not a valid priority.
+func (p InvocationPriority) rank() int {
+	for i, priority := range invocationPriorities {
+		if p == priority {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p InvocationPriority) validate() error {
+	if p.rank() < 0 {
+		return fmt.Errorf(
+			"invalid priority: %q, must be one of: %s, %s or %s",
+			p, InvocationPriorityLow, InvocationPriorityNormal, InvocationPriorityHigh)
+	}
+	return nil
+}
+
+type invocationPriorityCtxKey struct{}
+
+// WithInvocationPriority returns a context that schedules invocations of actors with the
+// provided priority (see SchedulerOptions) instead of the default priority of the actor's
+// namespace. The priority is propagated to the servers that invocations are forwarded
+// to, and it also applies to the invocations that the actor makes while handling the
+// invocation.
+func WithInvocationPriority(ctx context.Context, priority InvocationPriority) context.Context {
+	return context.WithValue(ctx, invocationPriorityCtxKey{}, priority)
+}
+
+func invocationPriorityFromContext(ctx context.Context) (InvocationPriority, bool) {
+	priority, ok := ctx.Value(invocationPriorityCtxKey{}).(InvocationPriority)
+	return priority, ok && priority.rank() >= 0
+}
+
+// injectInvocationPriority adds the priority of ctx (if any) to header so that it is
+// honored by the server that the invocation is forwarded to.
+func injectInvocationPriority(ctx context.Context, header http.Header) {
+	if priority, ok := invocationPriorityFromContext(ctx); ok {
+		header.Set(invocationPriorityHeader, string(priority))
+	}
+}
+
+// extractInvocationPriority is the inverse of injectInvocationPriority. Invalid
+// priorities are ignored.
+func extractInvocationPriority(ctx context.Context, header http.Header) context.Context {
+	priority := InvocationPriority(header.Get(invocationPriorityHeader))
+	if priority.rank() < 0 {
+		return ctx
+	}
+	return WithInvocationPriority(ctx, priority)
+}
+
+// SchedulerOptions contains the options for limiting the number of actor invocations that
+// a server executes concurrently, so that a CPU-bound server prioritizes latency
+// sensitive invocations over the others instead of making all of them contend equally.
+//
+// Once MaxConcurrentInvocations invocations are executing, invocations wait for one of
+// them to complete and the one with the highest priority (see WithInvocationPriority) is
+// executed next, in FIFO order within a priority. To prevent lower priorities from
+// starving, every AgingInterval that an invocation waits raises its priority by one
+// level for the purposes of scheduling.
+//
+// Invocations made by actors of other actors are never queued since the calling actor is
+// already executing, and queuing them could deadlock the server. Invocations are queued
+// while holding the lock of their actor, and the time they spend queued counts towards
+// their deadline but not towards EnvironmentOptions.InvokeTimeout.
+type SchedulerOptions struct {
+	// MaxConcurrentInvocations is the maximum number of actor invocations that the
+	// server executes concurrently. A value of 0 means no limit, in which case
+	// invocations are never queued and priorities have no effect.
+	MaxConcurrentInvocations int
+	// DefaultPriority is the priority of invocations that don't have one and whose
+	// namespace doesn't have a default priority in NamespacePriorities.
+	//
+	// An empty value will be ignored and replaced with InvocationPriorityNormal.
+	DefaultPriority InvocationPriority
+	// NamespacePriorities contains the default priority of the invocations of the actors
+	// of each namespace that override DefaultPriority.
+	NamespacePriorities map[string]InvocationPriority
+	// AgingInterval is how long an invocation must wait to be scheduled as if it had the
+	// next higher priority.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 1 second.
+	AgingInterval time.Duration
+}
+
+func (s *SchedulerOptions) Validate() error {
+	if s.MaxConcurrentInvocations < 0 {
+		return fmt.Errorf("MaxConcurrentInvocations must be >= 0")
+	}
+	if s.DefaultPriority != "" {
+		if err := s.DefaultPriority.validate(); err != nil {
+			return fmt.Errorf("invalid DefaultPriority: %w", err)
+		}
+	}
+	for namespace, priority := range s.NamespacePriorities {
+		if err := priority.validate(); err != nil {
+			return fmt.Errorf("invalid NamespacePriorities for namespace: %s: %w", namespace, err)
+		}
+	}
+	if s.AgingInterval < 0 {
+		return fmt.Errorf("AgingInterval must be >= 0")
+	}
+	return nil
+}
+
+// SchedulerStats contains point-in-time statistics about the scheduling of invocations
+// (see SchedulerOptions).
+type SchedulerStats struct {
+	// MaxConcurrentInvocations is the value of SchedulerOptions.MaxConcurrentInvocations.
+	MaxConcurrentInvocations int
+	// Running is the number of invocations that are currently executing, not counting
+	// the ones that are not subject to scheduling.
+	Running int
+	// QueueDepth is the number of invocations that are currently waiting to be executed
+	// by priority.
+	QueueDepth map[InvocationPriority]int
+	// Scheduled is the total number of invocations that have been executed by priority.
+	Scheduled map[InvocationPriority]uint64
+	// Queued is the total number of invocations that had to wait to be executed by
+	// priority.
+	Queued map[InvocationPriority]uint64
+	// Aged is the total number of invocations that were executed ahead of invocations
+	// with a higher priority because they had been waiting for longer.
+	Aged uint64
+}
+
+// invocationScheduler implements SchedulerOptions.
+type invocationScheduler struct {
+	sync.Mutex
+
+	opts SchedulerOptions
+	now  func() time.Time
+
+	running int
+	// waiting contains the *schedulerWaiter of each priority in FIFO order, indexed by the
+	// rank of the priority.
+	waiting   [len(invocationPriorities)]*list.List
+	scheduled [len(invocationPriorities)]uint64
+	queued    [len(invocationPriorities)]uint64
+	aged      uint64
+}
+
+type schedulerWaiter struct {
+	rank     int
+	queuedAt time.Time
+	readyCh  chan struct{}
+	// ready is set (with the scheduler's lock held) once the waiter is given a slot.
+	ready bool
+}
+
+// newInvocationScheduler returns a scheduler for opts, or nil if invocations are not
+// limited.
+func newInvocationScheduler(opts SchedulerOptions) *invocationScheduler {
+	if opts.MaxConcurrentInvocations == 0 {
+		return nil
+	}
+	if opts.DefaultPriority == "" {
+		opts.DefaultPriority = InvocationPriorityNormal
+	}
+	if opts.AgingInterval == 0 {
+		opts.AgingInterval = defaultSchedulerAgingInterval
+	}
+
+	s := &invocationScheduler{opts: opts, now: time.Now}
+	for i := range s.waiting {
+		s.waiting[i] = list.New()
+	}
+	return s
+}
+
+// priority returns the priority of an invocation of an actor in namespace with ctx.
+func (s *invocationScheduler) priority(ctx context.Context, namespace string) InvocationPriority {
+	if priority, ok := invocationPriorityFromContext(ctx); ok {
+		return priority
+	}
+	if priority, ok := s.opts.NamespacePriorities[namespace]; ok {
+		return priority
+	}
+	return s.opts.DefaultPriority
+}
+
+// acquire waits until the invocation can be executed and returns the function that must
+// be called once it completes. It fails if ctx is done first.
+func (s *invocationScheduler) acquire(
+	ctx context.Context,
+	priority InvocationPriority,
+) (func(), error) {
+	rank := priority.rank()
+
+	s.Lock()
+	if s.running < s.opts.MaxConcurrentInvocations && s.numWaitingWithLock() == 0 {
+		s.running++
+		s.scheduled[rank]++
+		s.Unlock()
+		return s.release, nil
+	}
+
+	w := &schedulerWaiter{rank: rank, queuedAt: s.now(), readyCh: make(chan struct{})}
+	elem := s.waiting[rank].PushBack(w)
+	s.queued[rank]++
+	s.Unlock()
+
+	select {
+	case <-w.readyCh:
+		return s.release, nil
+	case <-ctx.Done():
+		s.Lock()
+		if w.ready {
+			// Raced with being given a slot, hand it over to the next invocation.
+			s.Unlock()
+			s.release()
+		} else {
+			s.waiting[rank].Remove(elem)
+			s.Unlock()
+		}
+		return nil, fmt.Errorf(
+			"invocation with priority: %s was not scheduled before its context was done: %w",
+			priority, ctx.Err())
+	}
+}
+
+// release frees the slot of an invocation that completed, giving it to the next waiting
+// invocation (if any).
+func (s *invocationScheduler) release() {
+	s.Lock()
+	defer s.Unlock()
+
+	next, aged := s.nextWithLock()
+	if next == nil {
+		s.running--
+		return
+	}
+	s.waiting[next.rank].Remove(s.waiting[next.rank].Front())
+	s.scheduled[next.rank]++
+	if aged {
+		s.aged++
+	}
+	next.ready = true
+	close(next.readyCh)
+}
+
+// nextWithLock returns the waiter that should be executed next, which is the oldest
+// waiter with the highest effective rank (its rank plus one for every AgingInterval it
+// has waited), preferring the one with the highest rank on ties. It also returns whether
+// the waiter is executed ahead of waiters with a higher rank.
+func (s *invocationScheduler) nextWithLock() (*schedulerWaiter, bool) {
+	var (
+		now           = s.now()
+		next          *schedulerWaiter
+		nextEffective int
+		highestRank   = -1
+	)
+	for rank := len(s.waiting) - 1; rank >= 0; rank-- {
+		front := s.waiting[rank].Front()
+		if front == nil {
+			continue
+		}
+		if highestRank < 0 {
+			highestRank = rank
+		}
+		w := front.Value.(*schedulerWaiter)
+		effective := w.rank + int(now.Sub(w.queuedAt)/s.opts.AgingInterval)
+		if next == nil || effective > nextEffective {
+			next, nextEffective = w, effective
+		}
+	}
+	return next, next != nil && next.rank < highestRank
+}
+
+func (s *invocationScheduler) numWaitingWithLock() int {
+	n := 0
+	for _, l := range s.waiting {
+		n += l.Len()
+	}
+	return n
+}
+
+func (s *invocationScheduler) stats() SchedulerStats {
+	if s == nil {
+		return SchedulerStats{}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	stats := SchedulerStats{
+		MaxConcurrentInvocations: s.opts.MaxConcurrentInvocations,
+		Running:                  s.running,
+		QueueDepth:               make(map[InvocationPriority]int, len(invocationPriorities)),
+		Scheduled:                make(map[InvocationPriority]uint64, len(invocationPriorities)),
+		Queued:                   make(map[InvocationPriority]uint64, len(invocationPriorities)),
+		Aged:                     s.aged,
+	}
+	for rank, priority := range invocationPriorities {
+		stats.QueueDepth[priority] = s.waiting[rank].Len()
+		stats.Scheduled[priority] = s.scheduled[rank]
+		stats.Queued[priority] = s.queued[rank]
+	}
+	return stats
+}
@@ -0,0 +1,204 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestInvocationSchedulerPriorities ensures that queued invocations are executed in order
+// of priority (FIFO within a priority), and that low priority invocations that have
+// waited for long enough are executed ahead of higher priority ones.
+func TestInvocationSchedulerPriorities(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		nowLock sync.Mutex
+		now     = time.Unix(0, 0)
+		advance = func(d time.Duration) {
+			nowLock.Lock()
+			defer nowLock.Unlock()
+			now = now.Add(d)
+		}
+	)
+	s := newInvocationScheduler(SchedulerOptions{MaxConcurrentInvocations: 1})
+	s.now = func() time.Time {
+		nowLock.Lock()
+		defer nowLock.Unlock()
+		return now
+	}
+
+	release, err := s.acquire(ctx, InvocationPriorityNormal)
+	require.NoError(t, err)
+
+	var (
+		orderLock sync.Mutex
+		order     []string
+		wg        sync.WaitGroup
+	)
+	enqueue := func(name string, priority InvocationPriority) {
+		queued := s.stats().QueueDepth[priority]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := s.acquire(ctx, priority)
+			require.NoError(t, err)
+			orderLock.Lock()
+			order = append(order, name)
+			orderLock.Unlock()
+			release()
+		}()
+		require.Eventually(t, func() bool {
+			return s.stats().QueueDepth[priority] == queued+1
+		}, 5*time.Second, time.Millisecond)
+	}
+	enqueue("low-1", InvocationPriorityLow)
+	enqueue("normal-1", InvocationPriorityNormal)
+	enqueue("high-1", InvocationPriorityHigh)
+	enqueue("low-2", InvocationPriorityLow)
+	enqueue("high-2", InvocationPriorityHigh)
+	require.Equal(t, map[InvocationPriority]int{
+		InvocationPriorityLow:    2,
+		InvocationPriorityNormal: 1,
+		InvocationPriorityHigh:   2,
+	}, s.stats().QueueDepth)
+
+	release()
+	wg.Wait()
+	require.Equal(t, []string{"high-1", "high-2", "normal-1", "low-1", "low-2"}, order)
+	stats := s.stats()
+	require.Equal(t, 0, stats.Running)
+	require.Equal(t, uint64(0), stats.Aged)
+	require.Equal(t, map[InvocationPriority]uint64{
+		InvocationPriorityLow:    2,
+		InvocationPriorityNormal: 2,
+		InvocationPriorityHigh:   2,
+	}, stats.Scheduled)
+	require.Equal(t, map[InvocationPriority]uint64{
+		InvocationPriorityLow:    2,
+		InvocationPriorityNormal: 1,
+		InvocationPriorityHigh:   2,
+	}, stats.Queued)
+
+	// Invocations that waited for long enough jump ahead of higher priorities.
+	order = nil
+	release, err = s.acquire(ctx, InvocationPriorityNormal)
+	require.NoError(t, err)
+	enqueue("low-3", InvocationPriorityLow)
+	advance(3 * defaultSchedulerAgingInterval)
+	enqueue("high-3", InvocationPriorityHigh)
+	release()
+	wg.Wait()
+	require.Equal(t, []string{"low-3", "high-3"}, order)
+	require.Equal(t, uint64(1), s.stats().Aged)
+}
+
+// TestInvocationSchedulerCancellation ensures that invocations whose context is done
+// while they're queued give up and don't take a slot.
+func TestInvocationSchedulerCancellation(t *testing.T) {
+	s := newInvocationScheduler(SchedulerOptions{MaxConcurrentInvocations: 1})
+	release, err := s.acquire(context.Background(), InvocationPriorityNormal)
+	require.NoError(t, err)
+
+	ctx, cc := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cc()
+	_, err = s.acquire(ctx, InvocationPriorityHigh)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 0, s.stats().QueueDepth[InvocationPriorityHigh])
+
+	release()
+	release, err = s.acquire(context.Background(), InvocationPriorityLow)
+	require.NoError(t, err)
+	require.Equal(t, 1, s.stats().Running)
+	release()
+	require.Equal(t, 0, s.stats().Running)
+}
+
+// TestInvocationPriority ensures that the priority of invocations is resolved from the
+// context, the namespace and the default in that order, and that it survives being
+// forwarded to another server.
+func TestInvocationPriority(t *testing.T) {
+	require.Nil(t, newInvocationScheduler(SchedulerOptions{}))
+	s := newInvocationScheduler(SchedulerOptions{
+		MaxConcurrentInvocations: 1,
+		NamespacePriorities:      map[string]InvocationPriority{"batch": InvocationPriorityLow},
+	})
+	ctx := context.Background()
+	require.Equal(t, InvocationPriorityNormal, s.priority(ctx, "ns-1"))
+	require.Equal(t, InvocationPriorityLow, s.priority(ctx, "batch"))
+	highCtx := WithInvocationPriority(ctx, InvocationPriorityHigh)
+	require.Equal(t, InvocationPriorityHigh, s.priority(highCtx, "batch"))
+
+	header := make(http.Header)
+	injectInvocationPriority(highCtx, header)
+	require.Equal(t, InvocationPriorityHigh, s.priority(extractInvocationPriority(ctx, header), "batch"))
+	header.Set(invocationPriorityHeader, "urgent")
+	require.Equal(t, InvocationPriorityLow, s.priority(extractInvocationPriority(ctx, header), "batch"))
+
+	opts := SchedulerOptions{NamespacePriorities: map[string]InvocationPriority{"ns-1": "urgent"}}
+	require.Error(t, opts.Validate())
+}
+
+// TestEnvironmentScheduler ensures that the environment queues invocations once it's
+// executing SchedulerOptions.MaxConcurrentInvocations, and that invocations made by actors
+// are not queued behind their caller.
+func TestEnvironmentScheduler(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 49
+	opts.Scheduler.MaxConcurrentInvocations = 1
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	// Actor-to-actor invocations run in the slot of their caller.
+	marshaled, err := json.Marshal(types.InvokeActorRequest{
+		ModuleID:  "test-module",
+		ActorID:   "b",
+		Operation: "inc",
+	})
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "invokeActor", marshaled, types.CreateIfNotExist{})
+	require.NoError(t, err)
+
+	blockCtx, cancelBlock := context.WithCancel(ctx)
+	blockDoneCh := make(chan struct{})
+	go func() {
+		defer close(blockDoneCh)
+		env.InvokeActor(blockCtx, "ns-1", "a", "test-module", "block", nil, types.CreateIfNotExist{})
+	}()
+	require.Eventually(t, func() bool {
+		return env.SchedulerStats().Running == 1
+	}, 5*time.Second, time.Millisecond)
+
+	highCtx, cc := context.WithTimeout(WithInvocationPriority(ctx, InvocationPriorityHigh), 5*time.Second)
+	defer cc()
+	resultCh := make(chan error, 1)
+	go func() {
+		_, err := env.InvokeActor(highCtx, "ns-1", "b", "test-module", "inc", nil, types.CreateIfNotExist{})
+		resultCh <- err
+	}()
+	require.Eventually(t, func() bool {
+		return env.SchedulerStats().QueueDepth[InvocationPriorityHigh] == 1
+	}, 5*time.Second, time.Millisecond)
+
+	cancelBlock()
+	<-blockDoneCh
+	require.NoError(t, <-resultCh)
+	stats := env.SchedulerStats()
+	require.Equal(t, 1, stats.MaxConcurrentInvocations)
+	require.Equal(t, uint64(1), stats.Queued[InvocationPriorityHigh])
+	require.Equal(t, uint64(1), stats.Scheduled[InvocationPriorityHigh])
+}
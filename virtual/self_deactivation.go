@@ -0,0 +1,48 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+)
+
+type selfDeactivationCtxKey struct{}
+
+// selfDeactivation records whether the actor requested to be deactivated with
+// DeactivateSelf() during a single invocation.
+type selfDeactivation struct {
+	requested atomic.Bool
+}
+
+func withSelfDeactivation(ctx context.Context, d *selfDeactivation) context.Context {
+	return context.WithValue(ctx, selfDeactivationCtxKey{}, d)
+}
+
+// requestSelfDeactivation implements HostCapabilities.DeactivateSelf.
+func requestSelfDeactivation(ctx context.Context) error {
+	d, ok := ctx.Value(selfDeactivationCtxKey{}).(*selfDeactivation)
+	if !ok {
+		return errors.New("DeactivateSelf can only be called while the actor is being invoked")
+	}
+	d.requested.Store(true)
+	return nil
+}
+
+// deactivateSelf closes the actor (running its deactivation hooks) and removes it from the
+// activations map because it requested it with DeactivateSelf(). It's called in a separate
+// goroutine once the invocation that requested it returns so that the caller doesn't have
+// to wait for the deactivation hooks. Invocations that are queued behind it are retried
+// on a new activation.
+func (a *activatedActor) deactivateSelf() {
+	a.Lock()
+	defer a.Unlock()
+	if a._closed {
+		return
+	}
+
+	if err := a.closeWithLock(context.Background()); err != nil {
+		log.Printf("error closing actor: %v that deactivated itself, err: %v", a._reference, err)
+	}
+	a._onSelfDeactivate()
+}
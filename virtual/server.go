@@ -1,7 +1,9 @@
 package virtual
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,35 +16,111 @@ import (
 	"github.com/richardartoul/nola/virtual/types"
 )
 
+// tracerProvider is implemented by environments that trace invocations.
+type tracerProvider interface {
+	tracer() Tracer
+}
+
 type server struct {
 	// Dependencies.
 	registry    registry.Registry
 	environment Environment
+	opts        ServerOptions
+}
+
+// ServerOptions contains the options for the server.
+type ServerOptions struct {
+	// TLSConfig is the TLS configuration of the server. If set, the server only accepts
+	// TLS connections. Use tls.RequireAndVerifyClientCert as the ClientAuth (along with
+	// the CAs that issue the certificates of the other servers and clients as the
+	// ClientCAs) for mutual TLS.
+	TLSConfig *tls.Config
+	// Authenticator authenticates the requests that the server receives. If nil,
+	// requests are not authenticated.
+	Authenticator Authenticator
+	// Authorize authorizes the caller of every invocation (as returned by
+	// Authenticator) for the namespace of the invoked actor. If nil, callers are
+	// authorized for every namespace.
+	Authorize AuthorizeFn
+	// EnableCacheAdminAPI exposes the activation cache admin API, which is meant for
+	// debugging routing issues:
+	//
+	//   - GET /api/v1/cache/stats returns the cache's statistics, including the raw
+	//     metrics of the underlying cache.
+	//   - GET /api/v1/cache/{namespace}/{module}/{actor} returns the actor's cache entry:
+	//     the servers that it's routed to, how stale the entry is and the registry
+	//     versionstamp that it was resolved at.
+	//   - DELETE /api/v1/cache/{namespace}/{module}/{actor} removes the actor's cache
+	//     entry so that its next invocation is resolved against the registry.
+	//
+	// It's disabled by default since it exposes routing internals. Requests are
+	// authenticated and authorized for the actor's namespace like invocations.
+	EnableCacheAdminAPI bool
+	// EnableQuarantineAdminAPI exposes the quarantine admin API (see
+	// EnvironmentOptions.Quarantine):
+	//
+	//   - GET /api/v1/quarantine/{namespace} returns the quarantined actors of the
+	//     namespace.
+	//   - DELETE /api/v1/quarantine/{namespace}/{module}/{actor} releases the actor from
+	//     quarantine, or returns a 404 if it wasn't quarantined.
+	//
+	// It's disabled by default. Requests are authenticated and authorized for the
+	// namespace like invocations.
+	EnableQuarantineAdminAPI bool
 }
 
 // NewServer creates a new server for the actor virtual environment.
 func NewServer(
 	registry registry.Registry,
 	environment Environment,
+) *server {
+	return NewServerWithOptions(registry, environment, ServerOptions{})
+}
+
+// NewServerWithOptions is the same as NewServer, except it accepts options.
+func NewServerWithOptions(
+	registry registry.Registry,
+	environment Environment,
+	opts ServerOptions,
 ) *server {
 	return &server{
 		registry:    registry,
 		environment: environment,
+		opts:        opts,
 	}
 }
 
 // Start starts the server.
 func (s *server) Start(port int) error {
-	http.HandleFunc("/api/v1/register-module", s.registerModule)
-	http.HandleFunc("/api/v1/invoke-actor", s.invoke)
-	http.HandleFunc("/api/v1/invoke-actor-direct", s.invokeDirect)
-	http.HandleFunc("/api/v1/invoke-worker", s.invokeWorker)
-
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
-		return err
+	http.HandleFunc("/api/v1/register-module", s.authenticate(s.registerModule))
+	http.HandleFunc("/api/v1/invoke-actor", s.authenticate(s.invoke))
+	http.HandleFunc("/api/v1/invoke-actor-stream", s.authenticate(s.invokeStream))
+	http.HandleFunc("/api/v1/invoke-actor-direct", s.authenticate(s.invokeDirect))
+	http.HandleFunc("/api/v1/invoke-worker", s.authenticate(s.invokeWorker))
+	http.HandleFunc("/api/v1/invoke-actor-batch", s.authenticate(s.invokeBatch))
+	http.HandleFunc("/api/v1/invoke-actor-direct-batch", s.authenticate(s.invokeDirectBatch))
+	http.HandleFunc("/api/v1/restore-actor-direct", s.authenticate(s.restoreDirect))
+	http.HandleFunc("/api/v1/describe-module", s.authenticate(s.describeModule))
+	// Health checks are not authenticated so they can be used as probes.
+	http.HandleFunc("/api/v1/health", s.health)
+	http.HandleFunc("/api/v1/ready", s.ready)
+	if s.opts.EnableCacheAdminAPI {
+		http.HandleFunc(cacheAdminPathPrefix+"stats", s.authenticate(s.cacheStats))
+		http.HandleFunc(cacheAdminPathPrefix, s.authenticate(s.cacheEntry))
+	}
+	if s.opts.EnableQuarantineAdminAPI {
+		http.HandleFunc(quarantineAdminPathPrefix, s.authenticate(s.quarantine))
 	}
 
-	return nil
+	httpServer := &http.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		TLSConfig: s.opts.TLSConfig,
+	}
+	if s.opts.TLSConfig != nil {
+		// The certificates are provided by the TLS config.
+		return httpServer.ListenAndServeTLS("", "")
+	}
+	return httpServer.ListenAndServe()
 }
 
 // This one is a bit weird because its basically a file upload with some JSON
@@ -53,6 +131,9 @@ func (s *server) registerModule(w http.ResponseWriter, r *http.Request) {
 		namespace = r.Header.Get("namespace")
 		moduleID  = r.Header.Get("module_id")
 	)
+	if !s.authorize(w, r, namespace) {
+		return
+	}
 
 	moduleBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<24))
 	if err != nil {
@@ -91,12 +172,22 @@ type invokeActorRequest struct {
 }
 
 func (s *server) invoke(w http.ResponseWriter, r *http.Request) {
+	s.handleInvoke(w, r, false)
+}
+
+// invokeStream is the same as invoke, except the chunks that the actor sends with
+// StreamSend() are forwarded to the caller as soon as they're produced.
+func (s *server) invokeStream(w http.ResponseWriter, r *http.Request) {
+	s.handleInvoke(w, r, true)
+}
+
+func (s *server) handleInvoke(w http.ResponseWriter, r *http.Request, stream bool) {
 	if err := ensureHijackable(w); err != nil {
 		// Error already written to w.
 		return
 	}
 
-	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<24))
+	jsonBytes, err := readRequestBody(r)
 	if err != nil {
 		w.WriteHeader(500)
 		w.Write([]byte(err.Error()))
@@ -109,6 +200,9 @@ func (s *server) invoke(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	}
+	if !s.authorize(w, r, req.Namespace) {
+		return
+	}
 
 	if len(req.Payload) == 0 && req.PayloadJSON != nil {
 		marshaled, err := json.Marshal(req.PayloadJSON)
@@ -121,19 +215,21 @@ func (s *server) invoke(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// TODO: This should be configurable, probably in a header with some maximum.
-	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx := s.extractRequestContext(r)
+	if stream {
+		ctx = WithStreamingResponse(ctx)
+	}
+	ctx, cc := context.WithTimeout(ctx, 5*time.Second)
 	defer cc()
 	result, err := s.environment.InvokeActorStream(
 		ctx, req.Namespace, req.ActorID, req.ModuleID, req.Operation, req.Payload, req.CreateIfNotExist)
 	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte(err.Error()))
+		writeInvokeError(w, err)
 		return
 	}
 	defer result.Close()
 
-	w.WriteHeader(200)
-	if _, err := io.Copy(w, result); err != nil {
+	if err := s.writeResponse(ctx, w, r, result); err != nil {
 		// If we get any error copying the stream into the response then we
 		// need to terminate the connection to ensure that the caller observes
 		// an error and not a truncated response (that appears successful because
@@ -161,7 +257,7 @@ func (s *server) invokeDirect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<24))
+	jsonBytes, err := readRequestBody(r)
 	if err != nil {
 		w.WriteHeader(500)
 		w.Write([]byte(err.Error()))
@@ -174,9 +270,12 @@ func (s *server) invokeDirect(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	}
+	if !s.authorize(w, r, req.Namespace) {
+		return
+	}
 
 	// TODO: This should be configurable, probably in a header with some maximum.
-	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cc := context.WithTimeout(s.extractRequestContext(r), 5*time.Second)
 	defer cc()
 
 	ref, err := types.NewVirtualActorReference(req.Namespace, req.ModuleID, req.ActorID, uint64(req.Generation))
@@ -190,14 +289,12 @@ func (s *server) invokeDirect(w http.ResponseWriter, r *http.Request) {
 		ctx, req.VersionStamp, req.ServerID, req.ServerVersion, ref,
 		req.Operation, req.Payload, req.CreateIfNotExist)
 	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte(err.Error()))
+		writeInvokeError(w, err)
 		return
 	}
 	defer result.Close()
 
-	w.WriteHeader(200)
-	if _, err := io.Copy(w, result); err != nil {
+	if err := s.writeResponse(ctx, w, r, result); err != nil {
 		// If we get any error copying the stream into the response then we
 		// need to terminate the connection to ensure that the caller observes
 		// an error and not a truncated response (that appears successful because
@@ -206,6 +303,55 @@ func (s *server) invokeDirect(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type restoreActorDirectRequest struct {
+	VersionStamp  int64  `json:"version_stamp"`
+	ServerID      string `json:"server_id"`
+	ServerVersion int64  `json:"server_version"`
+	Namespace     string `json:"namespace"`
+	ModuleID      string `json:"module_id"`
+	ActorID       string `json:"actor_id"`
+	Generation    uint64 `json:"generation"`
+	State         []byte `json:"state"`
+}
+
+func (s *server) restoreDirect(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := readRequestBody(r)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req restoreActorDirectRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !s.authorize(w, r, req.Namespace) {
+		return
+	}
+
+	ctx, cc := context.WithTimeout(s.extractRequestContext(r), 5*time.Second)
+	defer cc()
+
+	ref, err := types.NewVirtualActorReference(req.Namespace, req.ModuleID, req.ActorID, req.Generation)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	err = s.environment.RestoreActorDirect(
+		ctx, req.VersionStamp, req.ServerID, req.ServerVersion, ref, req.State)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(200)
+}
+
 type invokeWorkerRequest struct {
 	Namespace string `json:"namespace"`
 	// TODO: Allow ModuleID to be omitted if the caller provides a WASMExecutable field which contains the
@@ -222,7 +368,7 @@ func (s *server) invokeWorker(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<24))
+	jsonBytes, err := readRequestBody(r)
 	if err != nil {
 		w.WriteHeader(500)
 		w.Write([]byte(err.Error()))
@@ -235,9 +381,12 @@ func (s *server) invokeWorker(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	}
+	if !s.authorize(w, r, req.Namespace) {
+		return
+	}
 
 	// TODO: This should be configurable, probably in a header with some maximum.
-	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cc := context.WithTimeout(s.extractRequestContext(r), 5*time.Second)
 	defer cc()
 
 	result, err := s.environment.InvokeWorkerStream(
@@ -249,8 +398,7 @@ func (s *server) invokeWorker(w http.ResponseWriter, r *http.Request) {
 	}
 	defer result.Close()
 
-	w.WriteHeader(200)
-	if _, err := io.Copy(w, result); err != nil {
+	if err := s.writeResponse(ctx, w, r, result); err != nil {
 		// If we get any error copying the stream into the response then we
 		// need to terminate the connection to ensure that the caller observes
 		// an error and not a truncated response (that appears successful because
@@ -259,6 +407,173 @@ func (s *server) invokeWorker(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type invokeActorBatchRequest struct {
+	Namespace   string            `json:"namespace"`
+	Invocations []BatchInvocation `json:"invocations"`
+}
+
+type invokeActorDirectBatchRequest struct {
+	VersionStamp int64                              `json:"version_stamp"`
+	ServerID     string                             `json:"server_id"`
+	Invocations  []invokeActorDirectBatchInvocation `json:"invocations"`
+}
+
+type invokeActorDirectBatchInvocation struct {
+	ServerVersion    int64                  `json:"server_version"`
+	Namespace        string                 `json:"namespace"`
+	ModuleID         string                 `json:"module_id"`
+	ActorID          string                 `json:"actor_id"`
+	Generation       uint64                 `json:"generation"`
+	Operation        string                 `json:"operation"`
+	Payload          []byte                 `json:"payload"`
+	CreateIfNotExist types.CreateIfNotExist `json:"create_if_not_exist"`
+}
+
+type invokeActorBatchResponse struct {
+	Results []invokeActorBatchResult `json:"results"`
+}
+
+// invokeActorBatchResult is the JSON representation of a BatchInvocationResult. Errors
+// are sent as their message (and category) since they can't be serialized.
+type invokeActorBatchResult struct {
+	Result        []byte `json:"result,omitempty"`
+	Error         string `json:"error,omitempty"`
+	ErrorCategory string `json:"error_category,omitempty"`
+	TrapReason    string `json:"trap_reason,omitempty"`
+}
+
+func newInvokeActorBatchResponse(results []BatchInvocationResult) invokeActorBatchResponse {
+	resp := invokeActorBatchResponse{Results: make([]invokeActorBatchResult, 0, len(results))}
+	for _, result := range results {
+		encoded := invokeActorBatchResult{Result: result.Result}
+		if result.Err != nil {
+			encoded.Error = result.Err.Error()
+			if invokeErr, ok := AsInvokeError(result.Err); ok {
+				encoded.ErrorCategory = string(invokeErr.Category)
+				encoded.TrapReason = invokeErr.TrapReason
+			}
+		}
+		resp.Results = append(resp.Results, encoded)
+	}
+	return resp
+}
+
+func (r invokeActorBatchResponse) results() []BatchInvocationResult {
+	results := make([]BatchInvocationResult, 0, len(r.Results))
+	for _, encoded := range r.Results {
+		result := BatchInvocationResult{Result: encoded.Result}
+		if encoded.Error != "" {
+			result.Err = errors.New(encoded.Error)
+			if encoded.ErrorCategory != "" {
+				result.Err = &InvokeError{
+					Category:   InvokeErrorCategory(encoded.ErrorCategory),
+					TrapReason: encoded.TrapReason,
+					Err:        result.Err,
+				}
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (s *server) invokeBatch(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := readRequestBody(r)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req invokeActorBatchRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !s.authorize(w, r, req.Namespace) {
+		return
+	}
+
+	// TODO: This should be configurable, probably in a header with some maximum.
+	ctx, cc := context.WithTimeout(s.extractRequestContext(r), 5*time.Second)
+	defer cc()
+
+	results, err := s.environment.InvokeActorBatch(ctx, req.Namespace, req.Invocations)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	s.writeBatchResults(ctx, w, r, results)
+}
+
+func (s *server) invokeDirectBatch(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := readRequestBody(r)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req invokeActorDirectBatchRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	authorized := make(map[string]struct{})
+	for _, inv := range req.Invocations {
+		if _, ok := authorized[inv.Namespace]; ok {
+			continue
+		}
+		if !s.authorize(w, r, inv.Namespace) {
+			return
+		}
+		authorized[inv.Namespace] = struct{}{}
+	}
+
+	invocations := make([]DirectBatchInvocation, 0, len(req.Invocations))
+	for _, inv := range req.Invocations {
+		ref, err := types.NewVirtualActorReference(inv.Namespace, inv.ModuleID, inv.ActorID, inv.Generation)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		invocations = append(invocations, DirectBatchInvocation{
+			ServerVersion:    inv.ServerVersion,
+			Reference:        ref,
+			Operation:        inv.Operation,
+			Payload:          inv.Payload,
+			CreateIfNotExist: inv.CreateIfNotExist,
+		})
+	}
+
+	// TODO: This should be configurable, probably in a header with some maximum.
+	ctx, cc := context.WithTimeout(s.extractRequestContext(r), 5*time.Second)
+	defer cc()
+
+	results := s.environment.InvokeActorDirectBatch(ctx, req.VersionStamp, req.ServerID, invocations)
+	s.writeBatchResults(ctx, w, r, results)
+}
+
+func (s *server) writeBatchResults(
+	ctx context.Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	results []BatchInvocationResult,
+) {
+	marshaled, err := json.Marshal(newInvokeActorBatchResponse(results))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	s.writeResponse(ctx, w, r, bytes.NewReader(marshaled))
+}
+
 // ensureHijackable and terminateConnection are used in conjunction to close tcp connections
 // for requests where we've started copying the response stream into the HTTP response body
 // after submitting an HTTP 200 status code, but then encounter an error reading from the
@@ -274,6 +589,37 @@ func ensureHijackable(w http.ResponseWriter) error {
 	return nil
 }
 
+// writeInvokeError writes the error of a failed invocation to w. Invocations that were
+// rejected because the actor exceeded its rate limit are reported with
+// http.StatusTooManyRequests so that callers can tell them apart and back off, and
+// invocations that were rejected because the server is at capacity are reported with
+// http.StatusServiceUnavailable so that callers can reroute them. Invocations that were
+// rejected because the actor's namespace exceeded one of its quotas are also reported with
+// http.StatusTooManyRequests, along with the quota that was exceeded. The category of the
+// error is preserved in the response's headers.
+func writeInvokeError(w http.ResponseWriter, err error) {
+	setInvokeErrorHeaders(w.Header(), err)
+	var (
+		rateLimitedErr   *ActorRateLimitedError
+		quotaExceededErr *NamespaceQuotaExceededError
+	)
+	if errors.As(err, &quotaExceededErr) {
+		setNamespaceQuotaExceeded(w.Header(), quotaExceededErr)
+		w.WriteHeader(http.StatusTooManyRequests)
+	} else if errors.As(err, &rateLimitedErr) {
+		setRetryAfter(w.Header(), rateLimitedErr.RetryAfter)
+		w.WriteHeader(http.StatusTooManyRequests)
+	} else if IsActorMailboxFullErr(err) {
+		w.Header().Set(mailboxFullHeader, "true")
+		w.WriteHeader(http.StatusTooManyRequests)
+	} else if IsServerAtCapacityErr(err) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(500)
+	}
+	w.Write([]byte(err.Error()))
+}
+
 func terminateConnection(w http.ResponseWriter) {
 	conn, _, err := w.(http.Hijacker).Hijack()
 	if err != nil {
@@ -282,3 +628,25 @@ func terminateConnection(w http.ResponseWriter) {
 	}
 	conn.Close()
 }
+
+// extractRequestContext returns a context that contains the trace context and the call
+// chain of the request (if any) so that invocations forwarded from other servers
+// continue the caller's trace and preserve the identity of the invoking actor. It also
+// requests a streaming response if the server that forwarded the invocation did, and
+// preserves the invocation's idempotency key and whether it's a tell.
+//
+// The context is canceled once the client cancels the request (or disconnects) so that
+// invocations stop running on behalf of callers that are no longer waiting for them.
+func (s *server) extractRequestContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if tp, ok := s.environment.(tracerProvider); ok && tp.tracer() != nil {
+		ctx = tp.tracer().Extract(ctx, r.Header)
+	}
+	if r.Header.Get(streamResponseHeader) == "true" {
+		ctx = WithStreamingResponse(ctx)
+	}
+	ctx = extractIdempotencyKey(ctx, r.Header)
+	ctx = extractInvocationPriority(ctx, r.Header)
+	ctx = extractTell(ctx, r.Header)
+	return extractCallChain(ctx, r.Header)
+}
@@ -0,0 +1,142 @@
+package virtual
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+// serverBlacklist keeps track of servers that should be avoided for a bounded amount of
+// time, for example because they're shedding load. Entries are forgotten once their TTL
+// expires so that the servers become eligible again automatically.
+type serverBlacklist struct {
+	sync.Mutex
+
+	// Configuration.
+	now func() time.Time
+
+	// State.
+	// expiresAt maps server ID -> the time at which it should be forgotten.
+	expiresAt map[string]time.Time
+}
+
+func newServerBlacklist(now func() time.Time) *serverBlacklist {
+	return &serverBlacklist{
+		now:       now,
+		expiresAt: make(map[string]time.Time),
+	}
+}
+
+// add blacklists serverID for ttl. Blacklisting a server that is already blacklisted
+// extends its TTL, but never shortens it.
+func (b *serverBlacklist) add(serverID string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	expiresAt := b.now().Add(ttl)
+	if expiresAt.After(b.expiresAt[serverID]) {
+		b.expiresAt[serverID] = expiresAt
+	}
+}
+
+// serverIDs returns the sorted IDs of all the servers that are currently blacklisted,
+// or nil if there are none. Expired entries are removed.
+func (b *serverBlacklist) serverIDs() []string {
+	b.Lock()
+	defer b.Unlock()
+	if len(b.expiresAt) == 0 {
+		return nil
+	}
+
+	var (
+		now       = b.now()
+		serverIDs []string
+	)
+	for serverID, expiresAt := range b.expiresAt {
+		if !now.Before(expiresAt) {
+			delete(b.expiresAt, serverID)
+			continue
+		}
+		serverIDs = append(serverIDs, serverID)
+	}
+	sort.Strings(serverIDs)
+	return serverIDs
+}
+
+// containsAny returns whether any of the references point to a server that is currently
+// blacklisted.
+func (b *serverBlacklist) containsAny(references []types.ActorReference) bool {
+	b.Lock()
+	defer b.Unlock()
+	if len(b.expiresAt) == 0 {
+		return false
+	}
+
+	now := b.now()
+	for _, ref := range references {
+		if expiresAt, ok := b.expiresAt[ref.ServerID()]; ok && now.Before(expiresAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialFailures counts the consecutive failed connections to every server so that servers
+// that are persistently unreachable can be blacklisted.
+type dialFailures struct {
+	sync.Mutex
+
+	// Configuration.
+	threshold int
+
+	// State.
+	n map[string]int
+	// tracked is len(n) so that successful connections, which are the common case, don't
+	// have to acquire the lock when no failures are being tracked.
+	tracked atomic.Int64
+}
+
+func newDialFailures(threshold int) *dialFailures {
+	return &dialFailures{
+		threshold: threshold,
+		n:         make(map[string]int),
+	}
+}
+
+// failed records a failed connection to serverID and returns true if it reached the
+// threshold of consecutive failures, in which case its count is reset. It always returns
+// false if the threshold is 0.
+func (d *dialFailures) failed(serverID string) bool {
+	if d.threshold <= 0 {
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	d.n[serverID]++
+	if d.n[serverID] < d.threshold {
+		d.tracked.Store(int64(len(d.n)))
+		return false
+	}
+	delete(d.n, serverID)
+	d.tracked.Store(int64(len(d.n)))
+	return true
+}
+
+// succeeded records a successful connection to serverID, which resets its count.
+func (d *dialFailures) succeeded(serverID string) {
+	if d.tracked.Load() == 0 {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	delete(d.n, serverID)
+	d.tracked.Store(int64(len(d.n)))
+}
@@ -1,3 +1,79 @@
 package virtual
 
-// TODO: Write tests. For now we have some basic smoke tests via `make run-playground`.
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestServerCancellationPropagation ensures that canceling the context of an invocation
+// that was forwarded to a remote server cancels the invocation on that server too,
+// instead of it running until the server's own timeout.
+func TestServerCancellationPropagation(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+
+	// env2 listens on a real port so that env1 has to forward invocations over HTTP.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	opts2 := defaultOptsGoByte
+	opts2.Discovery.Port = ln.Addr().(*net.TCPAddr).Port
+	env2, err := NewEnvironment(ctx, "serverID2", reg, nil, opts2)
+	require.NoError(t, err)
+	defer env2.Close()
+	require.NoError(t, env2.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	// Activate the actor on env2 before env1 exists so it's the only candidate.
+	_, err = env2.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+
+	localEnvironmentsRouterLock.Lock()
+	delete(localEnvironmentsRouter, env2.(*environment).address)
+	localEnvironmentsRouterLock.Unlock()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/invoke-actor-direct", NewServer(reg, env2).invokeDirect)
+	httpServer := &http.Server{Handler: mux}
+	go httpServer.Serve(ln)
+	defer httpServer.Close()
+
+	opts1 := defaultOptsGoByte
+	opts1.Discovery.Port = 46
+	env1, err := NewEnvironment(ctx, "serverID1", reg, NewHTTPClient(), opts1)
+	require.NoError(t, err)
+	defer env1.Close()
+	require.NoError(t, env1.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	blockCtx, cancelBlock := context.WithCancel(ctx)
+	blockErrCh := make(chan error, 1)
+	go func() {
+		_, err := env1.InvokeActor(blockCtx, "ns-1", "a", "test-module", "block", nil, types.CreateIfNotExist{})
+		blockErrCh <- err
+	}()
+	require.Eventually(t, func() bool {
+		return env2.(*environment).inFlight.Load() == 1
+	}, 5*time.Second, time.Millisecond)
+
+	// The server's timeout is 5 seconds, so the invocation is only freed promptly if the
+	// cancellation is propagated.
+	cancelBlock()
+	require.ErrorIs(t, <-blockErrCh, context.Canceled)
+	require.Eventually(t, func() bool {
+		return env2.(*environment).inFlight.Load() == 0
+	}, time.Second, time.Millisecond)
+
+	// The actor is free to process other invocations.
+	result, err := env1.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), getCount(t, result))
+}
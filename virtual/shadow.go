@@ -0,0 +1,265 @@
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const (
+	defaultShadowTimeout     = 5 * time.Second
+	defaultMaxInFlightShadow = 100
+)
+
+// ShadowOptions contains the options for mirroring a sample of the invocations of actors
+// to shadow actors that are created from a different module (usually a new version of
+// the same module), so that the new version can be validated against production
+// traffic without affecting the results that callers observe.
+//
+// Shadow invocations are sent to the actor with the same ID as the invoked actor in the
+// shadow module. Since actors of different modules are different actors, the shadow
+// actor has its own state and never mutates the state of the invoked actor. Note that
+// the shadow actor's other side effects (invoking other actors, registering reminders,
+// etc) are not isolated so shadow modules should avoid them.
+//
+// Only invocations made with Environment.InvokeActor and Environment.InvokeActorStream
+// are shadowed. Shadow invocations run in the background once the invocation has been
+// dispatched so they don't add latency to it, and they're dropped if MaxInFlight shadow
+// invocations are already running.
+type ShadowOptions struct {
+	// Modules maps the modules whose invocations are shadowed to their shadow module.
+	Modules map[types.NamespacedIDNoType]ShadowTarget
+	// Comparator is called with the results of every shadowed invocation once both the
+	// invocation and its shadow have completed (and the caller has read the entire
+	// result of the invocation). It must be safe for concurrent use.
+	//
+	// If nil, divergences are logged to EnvironmentOptions.Logger at the warn level.
+	Comparator ShadowComparator
+	// Timeout is the maximum amount of time that a shadow invocation, including waiting
+	// for the shadowed invocation to complete, can take before it's discarded.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 5 seconds.
+	Timeout time.Duration
+	// MaxInFlight is the maximum number of shadow invocations that can run at once.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 100.
+	MaxInFlight int
+}
+
+// ShadowTarget is the shadow module of a module.
+type ShadowTarget struct {
+	// ModuleID is the ID of the shadow module. It must be in the same namespace as the
+	// shadowed module.
+	ModuleID string
+	// SampleRate is the fraction of invocations (between 0 and 1) that are shadowed.
+	SampleRate float64
+}
+
+func (s *ShadowOptions) Validate() error {
+	for moduleID, target := range s.Modules {
+		if target.ModuleID == "" {
+			return fmt.Errorf("ModuleID of the shadow of module: %v cannot be empty", moduleID)
+		}
+		if target.ModuleID == moduleID.ID {
+			return fmt.Errorf("module: %v cannot be its own shadow", moduleID)
+		}
+		if !(target.SampleRate >= 0 && target.SampleRate <= 1) {
+			return fmt.Errorf("SampleRate of the shadow of module: %v must be between 0 and 1", moduleID)
+		}
+	}
+	if s.Timeout < 0 {
+		return fmt.Errorf("Timeout must be >= 0")
+	}
+	if s.MaxInFlight < 0 {
+		return fmt.Errorf("MaxInFlight must be >= 0")
+	}
+	return nil
+}
+
+// ShadowComparator compares the results of a shadowed invocation and its shadow.
+type ShadowComparator func(ctx context.Context, result ShadowResult)
+
+// ShadowResult contains the results of a shadowed invocation and its shadow.
+type ShadowResult struct {
+	Namespace      string
+	ActorID        string
+	ModuleID       string
+	ShadowModuleID string
+	Operation      string
+
+	// Result and Err are the result of the shadowed invocation.
+	Result []byte
+	Err    error
+	// ShadowResult and ShadowErr are the result of the shadow invocation.
+	ShadowResult []byte
+	ShadowErr    error
+}
+
+// Diverged returns whether the shadow invocation produced a different result than the
+// shadowed invocation. Errors are only compared by their presence since their messages
+// usually differ.
+func (r ShadowResult) Diverged() bool {
+	if (r.Err == nil) != (r.ShadowErr == nil) {
+		return true
+	}
+	return r.Err == nil && !bytes.Equal(r.Result, r.ShadowResult)
+}
+
+// newLoggingShadowComparator returns a ShadowComparator that logs divergences to logger.
+func newLoggingShadowComparator(logger *slog.Logger) ShadowComparator {
+	return func(ctx context.Context, result ShadowResult) {
+		if !result.Diverged() {
+			return
+		}
+		logger.WarnContext(ctx, "shadow invocation diverged",
+			slog.String("namespace", result.Namespace),
+			slog.String("actor_id", result.ActorID),
+			slog.String("module_id", result.ModuleID),
+			slog.String("shadow_module_id", result.ShadowModuleID),
+			slog.String("operation", result.Operation),
+			slog.Any("err", result.Err),
+			slog.Any("shadow_err", result.ShadowErr),
+			slog.Int("result_len", len(result.Result)),
+			slog.Int("shadow_result_len", len(result.ShadowResult)))
+	}
+}
+
+type shadowCtxKey struct{}
+
+// isShadowInvocation returns whether ctx belongs to a shadow invocation, which are never
+// shadowed themselves.
+func isShadowInvocation(ctx context.Context) bool {
+	return ctx.Value(shadowCtxKey{}) != nil
+}
+
+// shadower mirrors invocations to their shadow module (see ShadowOptions).
+type shadower struct {
+	opts     ShadowOptions
+	inFlight atomic.Int64
+	// invoke invokes the shadow actor.
+	invoke func(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		moduleID string,
+		operation string,
+		payload []byte,
+		create types.CreateIfNotExist,
+	) ([]byte, error)
+}
+
+// shadowedResult is the result of a shadowed invocation, or incomplete if the caller
+// didn't read the entire result.
+type shadowedResult struct {
+	result     []byte
+	err        error
+	incomplete bool
+}
+
+// maybeShadow starts a shadow invocation in the background if the invocation is
+// sampled. If it does, it returns a function that must be called with the result of
+// the shadowed invocation, which is wrapped so that it's compared with the shadow
+// invocation's once the caller has read it.
+func (s *shadower) maybeShadow(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	operation string,
+	payload []byte,
+	create types.CreateIfNotExist,
+) (func(io.ReadCloser, error) (io.ReadCloser, error), bool) {
+	target, ok := s.opts.Modules[types.NewNamespacedIDNoType(namespace, moduleID)]
+	if !ok || isShadowInvocation(ctx) || rand.Float64() >= target.SampleRate {
+		return nil, false
+	}
+	if s.inFlight.Add(1) > int64(s.opts.MaxInFlight) {
+		s.inFlight.Add(-1)
+		return nil, false
+	}
+
+	// The shadow invocation must outlive the invocation, and it must not consume the
+	// invocation's idempotency key or stream its result.
+	ctx = context.WithValue(context.WithoutCancel(ctx), shadowCtxKey{}, true)
+	ctx = withoutIdempotencyKey(withoutStreamingResponse(ctx))
+	ctx, cc := context.WithTimeout(ctx, s.opts.Timeout)
+	var (
+		shadowedCh = make(chan shadowedResult, 1)
+		// The caller may reuse the payload once the invocation returns.
+		payloadCopy = append([]byte(nil), payload...)
+	)
+	go func() {
+		defer s.inFlight.Add(-1)
+		defer cc()
+
+		shadowResult, shadowErr := s.invoke(
+			ctx, namespace, actorID, target.ModuleID, operation, payloadCopy, create)
+		var shadowed shadowedResult
+		select {
+		case shadowed = <-shadowedCh:
+		case <-ctx.Done():
+			return
+		}
+		if shadowed.incomplete {
+			return
+		}
+		s.opts.Comparator(ctx, ShadowResult{
+			Namespace:      namespace,
+			ActorID:        actorID,
+			ModuleID:       moduleID,
+			ShadowModuleID: target.ModuleID,
+			Operation:      operation,
+			Result:         shadowed.result,
+			Err:            shadowed.err,
+			ShadowResult:   shadowResult,
+			ShadowErr:      shadowErr,
+		})
+	}()
+
+	return func(result io.ReadCloser, err error) (io.ReadCloser, error) {
+		if err != nil {
+			shadowedCh <- shadowedResult{err: err}
+			return nil, err
+		}
+		return &shadowTeeReader{ReadCloser: result, shadowedCh: shadowedCh}, nil
+	}, true
+}
+
+// shadowTeeReader buffers the result of a shadowed invocation as the caller reads it so
+// that it can be compared with the result of the shadow invocation.
+type shadowTeeReader struct {
+	io.ReadCloser
+	buf        bytes.Buffer
+	shadowedCh chan<- shadowedResult
+	once       sync.Once
+}
+
+func (r *shadowTeeReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.buf.Write(p[:n])
+	if err == io.EOF {
+		r.complete(shadowedResult{result: r.buf.Bytes()})
+	} else if err != nil {
+		r.complete(shadowedResult{err: err})
+	}
+	return n, err
+}
+
+func (r *shadowTeeReader) Close() error {
+	r.complete(shadowedResult{incomplete: true})
+	return r.ReadCloser.Close()
+}
+
+func (r *shadowTeeReader) complete(result shadowedResult) {
+	r.once.Do(func() {
+		r.shadowedCh <- result
+	})
+}
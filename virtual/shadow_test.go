@@ -0,0 +1,93 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestShadowInvocations ensures that sampled invocations are mirrored to the shadow
+// module without affecting the state of the invoked actor, and that their results are
+// compared.
+func TestShadowInvocations(t *testing.T) {
+	var (
+		reg     = localregistry.NewLocalRegistry()
+		ctx     = context.Background()
+		results = make(chan ShadowResult, 10)
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 34
+	opts.Shadow = ShadowOptions{
+		Modules: map[types.NamespacedIDNoType]ShadowTarget{
+			types.NewNamespacedIDNoType("ns-1", "test-module"): {
+				ModuleID: "test-module-v2", SampleRate: 1,
+			},
+		},
+		Comparator: func(ctx context.Context, result ShadowResult) {
+			results <- result
+		},
+	}
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	for _, moduleID := range []string{"test-module", "test-module-v2"} {
+		require.NoError(t, env.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: "ns-1", ID: moduleID}, testModule{}))
+	}
+
+	inc := func(actorID, moduleID string) int64 {
+		result, err := env.InvokeActor(
+			ctx, "ns-1", actorID, moduleID, "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		return getCount(t, result)
+	}
+	nextResult := func() ShadowResult {
+		select {
+		case result := <-results:
+			return result
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for shadow result")
+			return ShadowResult{}
+		}
+	}
+
+	// The shadow actor has its own state.
+	for i := int64(1); i <= 2; i++ {
+		require.Equal(t, i, inc("a", "test-module"))
+		result := nextResult()
+		require.False(t, result.Diverged(), "%+v", result)
+		require.Equal(t, "test-module-v2", result.ShadowModuleID)
+		require.Equal(t, i, getCount(t, result.ShadowResult))
+	}
+
+	// Invocations of the shadow module are not shadowed, and make the results diverge.
+	require.Equal(t, int64(3), inc("a", "test-module-v2"))
+	require.Equal(t, int64(3), inc("a", "test-module"))
+	result := nextResult()
+	require.True(t, result.Diverged())
+	require.Equal(t, int64(3), getCount(t, result.Result))
+	require.Equal(t, int64(4), getCount(t, result.ShadowResult))
+
+	// Errors are compared too.
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "does-not-exist", nil, types.CreateIfNotExist{})
+	require.Error(t, err)
+	require.False(t, nextResult().Diverged())
+
+	require.Error(t, (&ShadowOptions{Modules: map[types.NamespacedIDNoType]ShadowTarget{
+		types.NewNamespacedIDNoType("ns-1", "test-module"): {ModuleID: "test-module-v2", SampleRate: 2},
+	}}).Validate())
+}
+
+func TestShadowResultDiverged(t *testing.T) {
+	require.False(t, ShadowResult{Result: []byte("a"), ShadowResult: []byte("a")}.Diverged())
+	require.True(t, ShadowResult{Result: []byte("a"), ShadowResult: []byte("b")}.Diverged())
+	require.True(t, ShadowResult{Result: []byte("a"), ShadowErr: errors.New("err")}.Diverged())
+	require.False(t, ShadowResult{Err: errors.New("a"), ShadowErr: errors.New("b")}.Diverged())
+}
@@ -0,0 +1,317 @@
+package virtual
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The header bytes that prefix the values of actor KV pairs that are stored compressed,
+// or uncompressed but would otherwise be mistaken for compressed ones. None of them ever
+// appear in UTF-8 text.
+const (
+	stateHeaderRaw  byte = 0xF5
+	stateHeaderGzip byte = 0xF6
+	stateHeaderZstd byte = 0xF7
+)
+
+// StateCompressionOptions contains the options for compressing the values that actors
+// store in their KV storage, which reduces the storage and network costs of actors with
+// large serialized state. Compression is a property of the actor storage that the
+// environment hands to actors, so it's transparent to modules: values are compressed when
+// they're written and decompressed when they're read, including by KV LIST and KV INCR.
+//
+// Compressed values are prefixed with a header byte that identifies their codec, so the
+// codec can be changed at any time and values that were compressed with a previous one
+// are still decompressed. Values that are stored uncompressed are stored as-is, unless
+// they begin with one of the header bytes (0xF5, 0xF6 or 0xF7) in which case they're
+// prefixed with a header byte as well. Note that this means that once compression is
+// enabled it can't be disabled without rewriting every value, and that values that were
+// written before it was enabled and begin with one of the header bytes are misread.
+//
+// Counters are always incremented with a read and a write while compression is enabled,
+// since the native increments of stores would bypass the header.
+type StateCompressionOptions struct {
+	// Codec is the codec that is used to compress values, either CompressionCodecGzip or
+	// CompressionCodecZstd.
+	//
+	// If empty (CompressionCodecNone), values are not compressed.
+	Codec string
+	// MinSizeBytes is the minimum size of the values that are compressed. Smaller values
+	// are stored uncompressed since compressing them isn't worth the CPU. Values whose
+	// compressed size is not smaller than their size are stored uncompressed as well.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 1KiB.
+	MinSizeBytes int
+}
+
+// Validate validates the StateCompressionOptions.
+func (o *StateCompressionOptions) Validate() error {
+	switch o.Codec {
+	case CompressionCodecNone, CompressionCodecGzip, CompressionCodecZstd:
+	default:
+		return fmt.Errorf("unsupported state compression codec: %s", o.Codec)
+	}
+	if o.MinSizeBytes < 0 {
+		return fmt.Errorf("MinSizeBytes must be >= 0, but was: %d", o.MinSizeBytes)
+	}
+	return nil
+}
+
+// stateCompressor compresses and decompresses the values of actor KV pairs and
+// aggregates statistics about them. All of its methods are safe for concurrent use, and
+// a nil stateCompressor disables compression.
+type stateCompressor struct {
+	opts StateCompressionOptions
+	// zstdEncoder is nil unless the codec is CompressionCodecZstd.
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+
+	bytesWritten     atomic.Uint64
+	bytesStored      atomic.Uint64
+	valuesCompressed atomic.Uint64
+}
+
+// newStateCompressor returns a stateCompressor, or nil if compression is disabled.
+func newStateCompressor(opts StateCompressionOptions) (*stateCompressor, error) {
+	if opts.Codec == CompressionCodecNone {
+		return nil, nil
+	}
+	if opts.MinSizeBytes == 0 {
+		opts.MinSizeBytes = defaultCompressionMinSizeBytes
+	}
+
+	c := &stateCompressor{opts: opts}
+	if opts.Codec == CompressionCodecZstd {
+		encoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating zstd encoder: %w", err)
+		}
+		c.zstdEncoder = encoder
+	}
+	// Values may have been compressed with zstd by a previous codec.
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating zstd decoder: %w", err)
+	}
+	c.zstdDecoder = decoder
+	return c, nil
+}
+
+// wrap returns an ActorStorage that compresses the values of the transactions of store,
+// or store itself if compression is disabled.
+func (c *stateCompressor) wrap(store registry.ActorStorage) registry.ActorStorage {
+	if c == nil {
+		return store
+	}
+	return &compressedActorStorage{ActorStorage: store, c: c}
+}
+
+// encode returns the value that should be stored for value.
+func (c *stateCompressor) encode(value []byte) ([]byte, error) {
+	c.bytesWritten.Add(uint64(len(value)))
+	if len(value) >= c.opts.MinSizeBytes {
+		compressed, err := c.compress(value)
+		if err != nil {
+			return nil, fmt.Errorf("error compressing actor state: %w", err)
+		}
+		if len(compressed) < len(value) {
+			c.valuesCompressed.Add(1)
+			c.bytesStored.Add(uint64(len(compressed)))
+			return compressed, nil
+		}
+	}
+
+	if len(value) > 0 && isStateHeader(value[0]) {
+		value = append([]byte{stateHeaderRaw}, value...)
+	}
+	c.bytesStored.Add(uint64(len(value)))
+	return value, nil
+}
+
+func (c *stateCompressor) compress(value []byte) ([]byte, error) {
+	switch c.opts.Codec {
+	case CompressionCodecGzip:
+		var buf bytes.Buffer
+		buf.WriteByte(stateHeaderGzip)
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(value); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionCodecZstd:
+		return c.zstdEncoder.EncodeAll(value, []byte{stateHeaderZstd}), nil
+	default:
+		return nil, fmt.Errorf("unsupported state compression codec: %s", c.opts.Codec)
+	}
+}
+
+// decode is the inverse of encode.
+func (c *stateCompressor) decode(stored []byte) ([]byte, error) {
+	if len(stored) == 0 || !isStateHeader(stored[0]) {
+		return stored, nil
+	}
+
+	switch stored[0] {
+	case stateHeaderRaw:
+		return stored[1:], nil
+	case stateHeaderGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(stored[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing actor state: %w", err)
+		}
+		defer gz.Close()
+		value, err := io.ReadAll(gz)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing actor state: %w", err)
+		}
+		return value, nil
+	default:
+		value, err := c.zstdDecoder.DecodeAll(stored[1:], nil)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing actor state: %w", err)
+		}
+		return value, nil
+	}
+}
+
+// stats adds the statistics of the compressor to stats.
+func (c *stateCompressor) stats(stats *ActivationStats) {
+	if c == nil {
+		return
+	}
+	stats.StateBytesWritten = c.bytesWritten.Load()
+	stats.StateBytesStored = c.bytesStored.Load()
+	stats.StateValuesCompressed = c.valuesCompressed.Load()
+	if stats.StateBytesWritten > 0 {
+		stats.StateCompressionRatio = float64(stats.StateBytesStored) / float64(stats.StateBytesWritten)
+	}
+}
+
+func isStateHeader(b byte) bool {
+	return b == stateHeaderRaw || b == stateHeaderGzip || b == stateHeaderZstd
+}
+
+// compressedActorStorage is an ActorStorage whose transactions compress the values that
+// they write (see StateCompressionOptions).
+type compressedActorStorage struct {
+	registry.ActorStorage
+	c *stateCompressor
+}
+
+func (s *compressedActorStorage) BeginTransaction(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	serverID string,
+	serverVersion int64,
+) (registry.ActorKVTransaction, error) {
+	tr, err := s.ActorStorage.BeginTransaction(
+		ctx, namespace, actorID, moduleID, serverID, serverVersion)
+	if err != nil {
+		return nil, err
+	}
+	return &compressedActorKVTransaction{ActorKVTransaction: tr, c: s.c}, nil
+}
+
+type compressedActorKVTransaction struct {
+	registry.ActorKVTransaction
+	c *stateCompressor
+}
+
+func (tr *compressedActorKVTransaction) Put(ctx context.Context, key []byte, value []byte) error {
+	stored, err := tr.c.encode(value)
+	if err != nil {
+		return err
+	}
+	return tr.ActorKVTransaction.Put(ctx, key, stored)
+}
+
+func (tr *compressedActorKVTransaction) Get(ctx context.Context, key []byte) ([]byte, bool, error) {
+	stored, ok, err := tr.ActorKVTransaction.Get(ctx, key)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	value, err := tr.c.decode(stored)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (tr *compressedActorKVTransaction) IterPrefix(
+	ctx context.Context,
+	prefix []byte,
+	fn func(k, v []byte) error,
+) error {
+	return tr.ActorKVTransaction.IterPrefix(ctx, prefix, func(k, stored []byte) error {
+		value, err := tr.c.decode(stored)
+		if err != nil {
+			return err
+		}
+		return fn(k, value)
+	})
+}
+
+func (tr *compressedActorKVTransaction) GetWithVersion(
+	ctx context.Context,
+	key []byte,
+) ([]byte, int64, bool, error) {
+	stored, version, ok, err := tr.ActorKVTransaction.GetWithVersion(ctx, key)
+	if err != nil || !ok {
+		return nil, version, ok, err
+	}
+	value, err := tr.c.decode(stored)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return value, version, true, nil
+}
+
+func (tr *compressedActorKVTransaction) PutIfVersion(
+	ctx context.Context,
+	key []byte,
+	value []byte,
+	expectedVersion int64,
+) (bool, error) {
+	stored, err := tr.c.encode(value)
+	if err != nil {
+		return false, err
+	}
+	return tr.ActorKVTransaction.PutIfVersion(ctx, key, stored, expectedVersion)
+}
+
+func (tr *compressedActorKVTransaction) Incr(
+	ctx context.Context,
+	key []byte,
+	delta int64,
+) (int64, error) {
+	v, ok, err := tr.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	var value int64
+	if ok {
+		value, err = wapcutils.DecodeCounter(v)
+		if err != nil {
+			return 0, fmt.Errorf("error decoding counter: %w", err)
+		}
+	}
+	value += delta
+	if err := tr.Put(ctx, key, wapcutils.EncodeCounter(value)); err != nil {
+		return 0, err
+	}
+	return value, nil
+}
@@ -0,0 +1,169 @@
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestStateCompressor ensures that values are only compressed when they're large enough
+// and compressible, and that every value round trips regardless of the codec it was
+// stored with.
+func TestStateCompressor(t *testing.T) {
+	var (
+		compressible   = bytes.Repeat([]byte("state"), 100)
+		incompressible = make([]byte, 500)
+		small          = []byte("small")
+		headerPrefixed = []byte{stateHeaderZstd, 1, 2, 3}
+	)
+	rand.New(rand.NewSource(0)).Read(incompressible)
+
+	var stored [][]byte
+	for _, codec := range []string{CompressionCodecGzip, CompressionCodecZstd} {
+		c, err := newStateCompressor(StateCompressionOptions{Codec: codec, MinSizeBytes: 64})
+		require.NoError(t, err)
+
+		encoded, err := c.encode(compressible)
+		require.NoError(t, err)
+		require.True(t, isStateHeader(encoded[0]))
+		require.Less(t, len(encoded), len(compressible))
+		stored = append(stored, encoded)
+
+		for _, value := range [][]byte{incompressible, small} {
+			encoded, err := c.encode(value)
+			require.NoError(t, err)
+			require.Equal(t, value, encoded)
+		}
+		encoded, err = c.encode(headerPrefixed)
+		require.NoError(t, err)
+		require.Equal(t, append([]byte{stateHeaderRaw}, headerPrefixed...), encoded)
+		stored = append(stored, encoded)
+
+		var stats ActivationStats
+		c.stats(&stats)
+		require.Equal(t, uint64(1), stats.StateValuesCompressed)
+		require.Equal(t, uint64(len(compressible)+len(incompressible)+len(small)+len(headerPrefixed)),
+			stats.StateBytesWritten)
+		require.Less(t, stats.StateCompressionRatio, 1.0)
+	}
+
+	// Values that were stored with a previous codec are still decompressed.
+	c, err := newStateCompressor(StateCompressionOptions{Codec: CompressionCodecGzip})
+	require.NoError(t, err)
+	for i, encoded := range stored {
+		decoded, err := c.decode(encoded)
+		require.NoError(t, err)
+		if i%2 == 0 {
+			require.Equal(t, compressible, decoded)
+		} else {
+			require.Equal(t, headerPrefixed, decoded)
+		}
+	}
+	_, err = c.decode([]byte{stateHeaderGzip, 1, 2, 3})
+	require.Error(t, err)
+
+	nilC, err := newStateCompressor(StateCompressionOptions{})
+	require.NoError(t, err)
+	require.Nil(t, nilC)
+	require.Error(t, (&StateCompressionOptions{Codec: "lz4"}).Validate())
+	require.Error(t, (&StateCompressionOptions{MinSizeBytes: -1}).Validate())
+}
+
+// TestKVHostFunctionsStateCompression ensures that the KV host functions of WASM modules
+// transparently compress and decompress the values that they store.
+func TestKVHostFunctionsStateCompression(t *testing.T) {
+	var (
+		ctx = context.Background()
+		reg = localregistry.NewLocalRegistry()
+	)
+	_, err := reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+	heartbeatResult, err := reg.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	_, err = reg.EnsureActivation(ctx, "ns-1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+
+	c, err := newStateCompressor(StateCompressionOptions{Codec: CompressionCodecZstd, MinSizeBytes: 64})
+	require.NoError(t, err)
+	tr, err := c.wrap(reg).BeginTransaction(ctx, "ns-1", "a", "test-module", "server1", heartbeatResult.ServerVersion)
+	require.NoError(t, err)
+	invokeCtx := context.WithValue(ctx, hostFnActorReferenceCtxKey{}, ref)
+	invokeCtx = context.WithValue(invokeCtx, hostFnActorTxnKey{}, tr)
+	router := newHostFnRouter(reg, nil, nil, nil)
+	call := func(operation string, payload []byte) []byte {
+		resp, err := router(invokeCtx, "", "", operation, payload)
+		require.NoError(t, err)
+		return resp
+	}
+
+	value := bytes.Repeat([]byte("state"), 100)
+	call(wapcutils.KVPutOperationName, wapcutils.EncodePutPayload(nil, []byte("k"), value))
+	require.Equal(t, append([]byte{1}, value...), call(wapcutils.KVGetOperationName, []byte("k")))
+	err = wapcutils.ExtractKVsFromListPayload(
+		call(wapcutils.KVListOperationName, nil), func(k, v []byte) error {
+			require.Equal(t, "k", string(k))
+			require.Equal(t, value, v)
+			return nil
+		})
+	require.NoError(t, err)
+
+	// Counters are incremented through the compressed storage too.
+	for i := 0; i < 300; i++ {
+		call(wapcutils.KVIncrOperationName, wapcutils.EncodeIncrPayload(nil, []byte("c"), 1))
+	}
+	resp := call(wapcutils.KVIncrOperationName, wapcutils.EncodeIncrPayload(nil, []byte("c"), 0))
+	counter, _ := binary.Varint(resp)
+	require.Equal(t, int64(300), counter)
+	require.NoError(t, tr.Commit(ctx))
+
+	// The value is stored compressed.
+	rawTr, err := reg.BeginTransaction(ctx, "ns-1", "a", "test-module", "server1", heartbeatResult.ServerVersion)
+	require.NoError(t, err)
+	stored, ok, err := rawTr.Get(ctx, []byte("k"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, stateHeaderZstd, stored[0])
+	require.Less(t, len(stored), len(value))
+	require.NoError(t, rawTr.Cancel(ctx))
+}
+
+// TestEnvironmentStateCompression ensures that the environment compresses the state that
+// actors store.
+func TestEnvironmentStateCompression(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 69
+	opts.StateCompression = StateCompressionOptions{Codec: CompressionCodecGzip}
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "kvPutCount", []byte("k"), types.CreateIfNotExist{})
+	require.NoError(t, err)
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "kvGet", []byte("k"), types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, "1", string(result))
+
+	stats := env.ActivationStats()
+	require.Equal(t, uint64(1), stats.StateBytesWritten)
+	require.Equal(t, uint64(1), stats.StateBytesStored)
+	require.Equal(t, 1.0, stats.StateCompressionRatio)
+}
@@ -0,0 +1,165 @@
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// streamResponseHeader is the header that is set on requests that are forwarded to other
+// servers when the caller requested a streaming response.
+const streamResponseHeader = "X-Nola-Stream-Response"
+
+var errStreamClosed = errors.New("stream has already been closed")
+
+type streamingRequestedCtxKey struct{}
+
+type streamSenderCtxKey struct{}
+
+// WithStreamingResponse returns a context that requests that the chunks an actor sends
+// with StreamSend() while it is being invoked are streamed to the caller as soon as
+// they're produced, instead of being buffered until the invocation completes. It only
+// affects InvokeActorStream() and InvokeActorDirectStream(), and the context must not
+// be canceled until the returned stream has been read completely.
+//
+// Reads from the returned stream apply backpressure to the actor: StreamSend() blocks
+// until the chunk has been read by the caller. The actor remains locked (I.E it can't
+// process other invocations) until the stream has been read completely or closed, so
+// callers must always close it.
+func WithStreamingResponse(ctx context.Context) context.Context {
+	return context.WithValue(ctx, streamingRequestedCtxKey{}, true)
+}
+
+// withoutStreamingResponse returns a context that undoes WithStreamingResponse for
+// invocations whose results are not returned to the caller as a stream.
+func withoutStreamingResponse(ctx context.Context) context.Context {
+	if !isStreamingRequested(ctx) {
+		return ctx
+	}
+	return context.WithValue(ctx, streamingRequestedCtxKey{}, false)
+}
+
+func isStreamingRequested(ctx context.Context) bool {
+	requested, _ := ctx.Value(streamingRequestedCtxKey{}).(bool)
+	return requested
+}
+
+// streamSend sends chunk to the caller of the invocation that ctx belongs to.
+func streamSend(ctx context.Context, chunk []byte) error {
+	stream, ok := ctx.Value(streamSenderCtxKey{}).(*streamSender)
+	if !ok {
+		return errors.New("StreamSend can only be called during an invocation")
+	}
+	return stream.send(ctx, chunk)
+}
+
+// streamSender receives the chunks that an actor sends with StreamSend() during a single
+// invocation. Chunks are either written to a pipe as they're sent (for streaming
+// responses), or buffered and returned ahead of the invocation's result.
+type streamSender struct {
+	sync.Mutex
+
+	// pw is nil if the chunks are buffered.
+	pw *io.PipeWriter
+	// startedCh is closed when the first chunk is sent to pw.
+	startedCh chan struct{}
+	started   bool
+	done      bool
+	buf       []byte
+}
+
+func newBufferedStreamSender() *streamSender {
+	return &streamSender{}
+}
+
+func newPipeStreamSender() (*streamSender, *io.PipeReader) {
+	pr, pw := io.Pipe()
+	return &streamSender{pw: pw, startedCh: make(chan struct{})}, pr
+}
+
+func (s *streamSender) send(ctx context.Context, chunk []byte) error {
+	s.Lock()
+	if s.done {
+		s.Unlock()
+		return errStreamClosed
+	}
+	if s.pw == nil {
+		s.buf = append(s.buf, chunk...)
+		s.Unlock()
+		return nil
+	}
+	if !s.started {
+		s.started = true
+		close(s.startedCh)
+	}
+	s.Unlock()
+
+	// The write blocks until the chunk is read (which is what applies backpressure to
+	// the actor), so make sure it's interrupted if the invocation is canceled.
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.pw.CloseWithError(ctx.Err())
+			case <-stop:
+			}
+		}()
+	}
+	_, err := s.pw.Write(chunk)
+	return err
+}
+
+// finish must be called once the invocation has completed so that subsequent calls to
+// send() fail. It returns whether any chunk has been sent to the pipe.
+func (s *streamSender) finish() bool {
+	s.Lock()
+	defer s.Unlock()
+	s.done = true
+	return s.started
+}
+
+// prependBuffered returns a stream that contains the buffered chunks (if any) followed by
+// result. Like finish(), it must be called once the invocation has completed.
+func (s *streamSender) prependBuffered(result io.ReadCloser) io.ReadCloser {
+	s.Lock()
+	defer s.Unlock()
+	s.done = true
+	if len(s.buf) == 0 {
+		return result
+	}
+	return readCloser{
+		Reader: io.MultiReader(bytes.NewReader(s.buf), result),
+		Closer: result,
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// flushWriter flushes every write to the underlying http.ResponseWriter so that the
+// chunks of streaming responses are sent to the caller as soon as they're produced.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+// responseWriter returns the writer that the result of the invocation that ctx belongs
+// to should be copied into.
+func responseWriter(ctx context.Context, w http.ResponseWriter) io.Writer {
+	if _, ok := w.(http.Flusher); ok && isStreamingRequested(ctx) {
+		return flushWriter{w: w}
+	}
+	return w
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.w.(http.Flusher).Flush()
+	return n, err
+}
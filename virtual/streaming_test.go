@@ -0,0 +1,214 @@
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestStreamingResponses ensures that chunks sent with StreamSend() are buffered for
+// regular invocations, and streamed (with backpressure) to callers that requested a
+// streaming response, both locally and over HTTP.
+func TestStreamingResponses(t *testing.T) {
+	var (
+		reg    = localregistry.NewLocalRegistry()
+		ctx    = context.Background()
+		module = &testChunkedModule{}
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 16
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "chunked-module"}, module))
+
+	// Without a streaming response the chunks are buffered and precede the response.
+	module.reset()
+	close(module.proceed)
+	result, err := env.InvokeActor(
+		ctx, "ns-1", "a", "chunked-module", "stream", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, "abc", string(result))
+
+	// With a streaming response, the stream is returned as soon as the first chunk is
+	// sent and the actor is paused until the caller reads the next one.
+	module.reset()
+	stream, err := env.InvokeActorStream(
+		WithStreamingResponse(ctx), "ns-1", "a", "chunked-module", "stream", nil,
+		types.CreateIfNotExist{})
+	require.NoError(t, err)
+	requireRead(t, stream, "a")
+	close(module.proceed)
+	// StreamSend() blocks until the second chunk is read.
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 1, module.numSent())
+	require.False(t, module.isDone())
+	rest, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	require.Equal(t, "bc", string(rest))
+	require.NoError(t, stream.Close())
+	require.True(t, module.isDone())
+
+	// Errors that happen before the first chunk are returned directly.
+	_, err = env.InvokeActorStream(
+		WithStreamingResponse(ctx), "ns-1", "a", "chunked-module", "fail", nil,
+		types.CreateIfNotExist{})
+	require.Error(t, err)
+
+	// Closing the stream early fails the actor's next StreamSend() and unlocks it.
+	module.reset()
+	stream, err = env.InvokeActorStream(
+		WithStreamingResponse(ctx), "ns-1", "a", "chunked-module", "stream", nil,
+		types.CreateIfNotExist{})
+	require.NoError(t, err)
+	requireRead(t, stream, "a")
+	require.NoError(t, stream.Close())
+	close(module.proceed)
+	require.Eventually(t, func() bool {
+		return module.isDone()
+	}, 5*time.Second, time.Millisecond)
+	require.Error(t, module.err())
+	module.reset()
+	close(module.proceed)
+	result, err = env.InvokeActor(
+		ctx, "ns-1", "a", "chunked-module", "stream", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, "abc", string(result))
+
+	// Chunks are flushed to HTTP callers as soon as they're produced.
+	module.reset()
+	httpServer := httptest.NewServer(http.HandlerFunc(NewServer(reg, env).invokeStream))
+	defer httpServer.Close()
+	resp, err := http.Post(httpServer.URL, "application/json", bytes.NewReader([]byte(
+		`{"namespace":"ns-1","actor_id":"a","module_id":"chunked-module","operation":"stream"}`)))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	requireRead(t, resp.Body, "a")
+	close(module.proceed)
+	rest, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "bc", string(rest))
+}
+
+func requireRead(t *testing.T, r io.Reader, expected string) {
+	buf := make([]byte, len(expected))
+	_, err := io.ReadFull(r, buf)
+	require.NoError(t, err)
+	require.Equal(t, expected, string(buf))
+}
+
+// testChunkedModule is a module whose actors stream a response in multiple chunks. They
+// wait for proceed to be closed after sending the first chunk.
+type testChunkedModule struct {
+	sync.Mutex
+	proceed chan struct{}
+	sent    int
+	done    bool
+	lastErr error
+}
+
+func (tm *testChunkedModule) Instantiate(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	payload []byte,
+	host HostCapabilities,
+) (Actor, error) {
+	return &testChunkedActor{module: tm, host: host}, nil
+}
+
+func (tm *testChunkedModule) Close(ctx context.Context) error {
+	return nil
+}
+
+func (tm *testChunkedModule) reset() {
+	tm.Lock()
+	defer tm.Unlock()
+	tm.proceed = make(chan struct{})
+	tm.sent = 0
+	tm.done = false
+	tm.lastErr = nil
+}
+
+func (tm *testChunkedModule) numSent() int {
+	tm.Lock()
+	defer tm.Unlock()
+	return tm.sent
+}
+
+func (tm *testChunkedModule) isDone() bool {
+	tm.Lock()
+	defer tm.Unlock()
+	return tm.done
+}
+
+func (tm *testChunkedModule) err() error {
+	tm.Lock()
+	defer tm.Unlock()
+	return tm.lastErr
+}
+
+type testChunkedActor struct {
+	module *testChunkedModule
+	host   HostCapabilities
+}
+
+func (ta *testChunkedActor) Invoke(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+	transaction registry.ActorKVTransaction,
+) ([]byte, error) {
+	switch operation {
+	case wapcutils.StartupOperationName, wapcutils.ShutdownOperationName:
+		return nil, nil
+	case "stream":
+		result, err := ta.stream(ctx)
+		ta.module.Lock()
+		ta.module.done = true
+		ta.module.lastErr = err
+		ta.module.Unlock()
+		return result, err
+	case "fail":
+		return nil, errors.New("testChunkedActor: failed")
+	default:
+		return nil, errors.New("testChunkedActor: unhandled operation: " + operation)
+	}
+}
+
+func (ta *testChunkedActor) stream(ctx context.Context) ([]byte, error) {
+	ta.module.Lock()
+	proceed := ta.module.proceed
+	ta.module.Unlock()
+
+	for i, chunk := range []string{"a", "b"} {
+		if i > 0 {
+			<-proceed
+		}
+		if err := ta.host.StreamSend(ctx, []byte(chunk)); err != nil {
+			return nil, err
+		}
+		ta.module.Lock()
+		ta.module.sent++
+		ta.module.Unlock()
+	}
+	return []byte("c"), nil
+}
+
+func (ta *testChunkedActor) Close(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,465 @@
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const (
+	// tellHeader marks invocations that are forwarded to other servers as tells and
+	// carries their delivery semantics.
+	tellHeader = "X-Nola-Tell"
+	// mailboxFullHeader marks the responses of tells that were rejected because the
+	// actor's mailbox was full, so the error survives being forwarded.
+	mailboxFullHeader = "X-Nola-Mailbox-Full"
+
+	defaultTellMailboxSize    = 1000
+	defaultTellMaxAttempts    = 5
+	defaultTellRetryBackoff   = 100 * time.Millisecond
+	maxTellRetryBackoffFactor = 32
+)
+
+// ErrActorMailboxFull is the error of invocations that are rejected because
+// EnvironmentOptions.MaxMailboxDepth invocations of the actor are waiting already, and of
+// tells that are rejected because TellOptions.MailboxSize tells of the actor are buffered
+// already.
+var ErrActorMailboxFull = errors.New("actor mailbox is full")
+
+// IsActorMailboxFullErr returns a boolean indicating whether the error is (or wraps)
+// ErrActorMailboxFull.
+func IsActorMailboxFullErr(err error) bool {
+	return errors.Is(err, ErrActorMailboxFull)
+}
+
+// TellDelivery describes what happens to tells (see Environment.TellActor) whose delivery
+// fails.
+type TellDelivery string
+
+const (
+	// TellDeliveryAtMostOnce delivers every tell at most once: neither the caller nor
+	// the hosting server retries tells whose delivery fails.
+	TellDeliveryAtMostOnce TellDelivery = "at-most-once"
+	// TellDeliveryAtLeastOnce retries tells (up to TellOptions.MaxAttempts times) until
+	// the actor processes them successfully, so actors must tolerate processing the same
+	// tell more than once. Both the caller (if the tell is not accepted) and the hosting
+	// server (if the actor fails to process it) retry.
+	TellDeliveryAtLeastOnce TellDelivery = "at-least-once"
+)
+
+func (d TellDelivery) validate() error {
+	if d != TellDeliveryAtMostOnce && d != TellDeliveryAtLeastOnce {
+		return fmt.Errorf(
+			"invalid delivery: %q, must be one of: %s or %s",
+			d, TellDeliveryAtMostOnce, TellDeliveryAtLeastOnce)
+	}
+	return nil
+}
+
+// TellOptions contains the options for fire-and-forget invocations of actors (see
+// Environment.TellActor).
+//
+// By default, the server that hosts the actor accepts tells by appending them to the
+// actor's mailbox, which is delivered in FIFO order in the background, and acknowledges
+// them right away. Mailboxes are kept in memory, so the tells that are buffered when
+// the server shuts down (or crashes) are lost regardless of their delivery semantics.
+// With DisableBuffering, the hosting server only acknowledges tells once the actor has
+// processed them instead, so the caller retries at-least-once tells that were lost.
+type TellOptions struct {
+	// Delivery is the delivery semantics of tells that don't specify them with
+	// WithTellDelivery.
+	//
+	// An empty value will be ignored and replaced with TellDeliveryAtMostOnce.
+	Delivery TellDelivery
+	// MailboxSize is the maximum number of tells that are buffered by this server for
+	// each actor it hosts. Tells that are received once an actor's mailbox is full are
+	// rejected with an error for which IsActorMailboxFullErr returns true, which is how
+	// slow actors push back on the callers that tell them.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 1000.
+	MailboxSize int
+	// DisableBuffering disables the mailboxes of this server, so the tells it receives
+	// are delivered (and retried, if they're at-least-once tells) before they're
+	// acknowledged. The caller still doesn't receive the result.
+	DisableBuffering bool
+	// MaxAttempts is the maximum number of times that at-least-once tells are attempted,
+	// both by the caller and by the hosting server.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 5.
+	MaxAttempts int
+	// RetryBackoff is how long the first retry of an at-least-once tell waits. Every
+	// subsequent retry waits twice as long as the previous one, up to 32 times
+	// RetryBackoff.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 100ms.
+	RetryBackoff time.Duration
+}
+
+func (t *TellOptions) Validate() error {
+	if t.Delivery != "" {
+		if err := t.Delivery.validate(); err != nil {
+			return fmt.Errorf("invalid Delivery: %w", err)
+		}
+	}
+	if t.MailboxSize < 0 {
+		return fmt.Errorf("MailboxSize must be >= 0")
+	}
+	if t.MaxAttempts < 0 {
+		return fmt.Errorf("MaxAttempts must be >= 0")
+	}
+	if t.RetryBackoff < 0 {
+		return fmt.Errorf("RetryBackoff must be >= 0")
+	}
+	return nil
+}
+
+// retryBackoff returns how long to wait before the provided attempt (starting from 2).
+func (t *TellOptions) retryBackoff(attempt int) time.Duration {
+	factor := 1 << (attempt - 2)
+	if factor > maxTellRetryBackoffFactor {
+		factor = maxTellRetryBackoffFactor
+	}
+	return time.Duration(factor) * t.RetryBackoff
+}
+
+// TellStats contains point-in-time statistics about the tells that the environment
+// hosts.
+type TellStats struct {
+	// Buffered is the number of tells that are currently in mailboxes.
+	Buffered int
+	// Accepted is the total number of tells that were accepted.
+	Accepted uint64
+	// Rejected is the total number of tells that were rejected because the mailbox of
+	// their actor was full.
+	Rejected uint64
+	// Delivered is the total number of tells that were processed successfully.
+	Delivered uint64
+	// Retried is the total number of times that at-least-once tells whose delivery failed
+	// were delivered again.
+	Retried uint64
+	// Failed is the total number of tells that were given up on, including the ones that
+	// were still buffered when the environment was closed.
+	Failed uint64
+}
+
+type tellDeliveryCtxKey struct{}
+
+// WithTellDelivery returns a context that delivers the tells that it's passed to with
+// the provided semantics instead of TellOptions.Delivery.
+func WithTellDelivery(ctx context.Context, delivery TellDelivery) context.Context {
+	return context.WithValue(ctx, tellDeliveryCtxKey{}, delivery)
+}
+
+func tellDeliveryFromContext(ctx context.Context, defaultDelivery TellDelivery) TellDelivery {
+	delivery, ok := ctx.Value(tellDeliveryCtxKey{}).(TellDelivery)
+	if !ok || delivery.validate() != nil {
+		return defaultDelivery
+	}
+	return delivery
+}
+
+type tellCtxKey struct{}
+
+// withTell returns a context that marks the invocations that it's passed to as tells
+// with the provided delivery semantics.
+func withTell(ctx context.Context, delivery TellDelivery) context.Context {
+	return context.WithValue(ctx, tellCtxKey{}, delivery)
+}
+
+// withoutTell returns a context that undoes withTell so that the invocations that
+// actors make while processing tells are not tells themselves.
+func withoutTell(ctx context.Context) context.Context {
+	if _, ok := tellFromContext(ctx); !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, tellCtxKey{}, TellDelivery(""))
+}
+
+func tellFromContext(ctx context.Context) (TellDelivery, bool) {
+	delivery, _ := ctx.Value(tellCtxKey{}).(TellDelivery)
+	return delivery, delivery != ""
+}
+
+// injectTell marks the request as a tell if ctx is one.
+func injectTell(ctx context.Context, header http.Header) {
+	if delivery, ok := tellFromContext(ctx); ok {
+		header.Set(tellHeader, string(delivery))
+	}
+}
+
+// extractTell is the inverse of injectTell. Invalid delivery semantics are ignored.
+func extractTell(ctx context.Context, header http.Header) context.Context {
+	delivery := TellDelivery(header.Get(tellHeader))
+	if delivery.validate() != nil {
+		return ctx
+	}
+	return withTell(ctx, delivery)
+}
+
+// TellActor implements Environment.
+func (r *environment) TellActor(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	moduleID string,
+	operation string,
+	payload []byte,
+	create types.CreateIfNotExist,
+) error {
+	delivery := tellDeliveryFromContext(ctx, r.opts.Tell.Delivery)
+	ctx = withTell(ctx, delivery)
+	for attempt := 1; ; attempt++ {
+		result, err := r.invokeActorStream(
+			ctx, namespace, actorID, moduleID, operation, payload, create)
+		if err == nil {
+			// The result is empty unless the hosting server has DisableBuffering set,
+			// in which case it's discarded.
+			_, err = io.Copy(io.Discard, result)
+			result.Close()
+			if err == nil {
+				return nil
+			}
+		}
+		err = categorizeInvokeErr(err)
+
+		invokeErr, _ := AsInvokeError(err)
+		if delivery != TellDeliveryAtLeastOnce ||
+			attempt >= r.opts.Tell.MaxAttempts ||
+			!invokeErr.Category.Retryable() {
+			return fmt.Errorf("error telling actor: %w", err)
+		}
+		select {
+		case <-time.After(r.opts.Tell.retryBackoff(attempt + 1)):
+		case <-ctx.Done():
+			return fmt.Errorf("error telling actor: %w", err)
+		}
+	}
+}
+
+func (r *environment) TellStats() TellStats {
+	return r.mailboxes.stats()
+}
+
+// tell is a tell that was accepted by this server.
+type tell struct {
+	reference types.ActorReferenceVirtual
+	operation string
+	payload   []byte
+	create    types.CreateIfNotExist
+	delivery  TellDelivery
+	// priority is the priority that the tell was sent with, if any.
+	priority InvocationPriority
+}
+
+// tellMailboxes contains the mailboxes of the actors that this server hosts. Every
+// mailbox is delivered by its own goroutine, which exits once the mailbox is empty.
+type tellMailboxes struct {
+	sync.Mutex
+
+	opts TellOptions
+	// deliver delivers a tell to the actor on this server.
+	deliver func(ctx context.Context, t *tell) error
+	// redeliver delivers a tell to the actor wherever it's activated, which may not be
+	// this server anymore if its first delivery failed.
+	redeliver func(ctx context.Context, t *tell) error
+
+	mailboxes map[types.NamespacedActorID][]*tell
+	closeCh   chan struct{}
+	closed    bool
+
+	buffered  int
+	accepted  uint64
+	rejected  uint64
+	delivered uint64
+	retried   uint64
+	failed    uint64
+}
+
+func newTellMailboxes(
+	opts TellOptions,
+	deliver func(ctx context.Context, t *tell) error,
+	redeliver func(ctx context.Context, t *tell) error,
+) *tellMailboxes {
+	return &tellMailboxes{
+		opts:      opts,
+		deliver:   deliver,
+		redeliver: redeliver,
+		mailboxes: make(map[types.NamespacedActorID][]*tell),
+		closeCh:   make(chan struct{}),
+	}
+}
+
+// accept accepts a tell that was routed to this server and returns the (empty) result
+// that acknowledges it.
+func (m *tellMailboxes) accept(ctx context.Context, t *tell) (io.ReadCloser, error) {
+	if priority, ok := invocationPriorityFromContext(ctx); ok {
+		t.priority = priority
+	}
+
+	if m.opts.DisableBuffering {
+		m.Lock()
+		m.accepted++
+		m.Unlock()
+		if err := m.deliverWithRetries(withoutTell(ctx), t); err != nil {
+			m.Lock()
+			m.failed++
+			m.Unlock()
+			return nil, err
+		}
+		m.Lock()
+		m.delivered++
+		m.Unlock()
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	id := t.reference.ActorID()
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return nil, errors.New("environment is closed")
+	}
+	mailbox, ok := m.mailboxes[id]
+	if len(mailbox) >= m.opts.MailboxSize {
+		m.rejected++
+		return nil, fmt.Errorf(
+			"error accepting tell for actor: %s, mailbox size: %d: %w",
+			id.ID, m.opts.MailboxSize, ErrActorMailboxFull)
+	}
+	m.mailboxes[id] = append(mailbox, t)
+	m.buffered++
+	m.accepted++
+	if !ok {
+		go m.deliverMailbox(id)
+	}
+	return io.NopCloser(bytes.NewReader(nil)), nil
+}
+
+// deliverMailbox delivers the tells in the mailbox of the provided actor in order until
+// it's empty.
+func (m *tellMailboxes) deliverMailbox(id types.NamespacedActorID) {
+	for {
+		m.Lock()
+		mailbox := m.mailboxes[id]
+		if m.closed || len(mailbox) == 0 {
+			delete(m.mailboxes, id)
+			m.Unlock()
+			return
+		}
+		t := mailbox[0]
+		m.Unlock()
+
+		ctx := context.Background()
+		if t.priority != "" {
+			ctx = WithInvocationPriority(ctx, t.priority)
+		}
+		err := m.deliverWithRetries(ctx, t)
+
+		m.Lock()
+		if m.closed {
+			// close() already accounted for the tells that were buffered.
+			m.Unlock()
+			return
+		}
+		mailbox = m.mailboxes[id]
+		mailbox[0] = nil
+		m.mailboxes[id] = mailbox[1:]
+		m.buffered--
+		if err == nil {
+			m.delivered++
+		} else {
+			m.failed++
+		}
+		m.Unlock()
+	}
+}
+
+// deliverWithRetries delivers the tell, retrying at-least-once tells whose delivery fails.
+func (m *tellMailboxes) deliverWithRetries(ctx context.Context, t *tell) error {
+	err := m.deliver(ctx, t)
+	if t.delivery != TellDeliveryAtLeastOnce {
+		return err
+	}
+	for attempt := 2; err != nil && attempt <= m.opts.MaxAttempts; attempt++ {
+		select {
+		case <-time.After(m.opts.retryBackoff(attempt)):
+		case <-m.closeCh:
+			return err
+		case <-ctx.Done():
+			return err
+		}
+		m.Lock()
+		m.retried++
+		m.Unlock()
+		err = m.redeliver(ctx, t)
+	}
+	return err
+}
+
+// close stops delivering tells. The tells that are still buffered are dropped.
+func (m *tellMailboxes) close() {
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	close(m.closeCh)
+	m.failed += uint64(m.buffered)
+	m.buffered = 0
+}
+
+func (m *tellMailboxes) stats() TellStats {
+	m.Lock()
+	defer m.Unlock()
+	return TellStats{
+		Buffered:  m.buffered,
+		Accepted:  m.accepted,
+		Rejected:  m.rejected,
+		Delivered: m.delivered,
+		Retried:   m.retried,
+		Failed:    m.failed,
+	}
+}
+
+// deliverTell delivers a tell to the actor on this server, unless the server was drained
+// (or the actor was handed off) since the tell was accepted.
+func (r *environment) deliverTell(ctx context.Context, t *tell) error {
+	var (
+		result io.ReadCloser
+		err    error
+	)
+	if r.isMovingAway(t.reference.ActorID()) {
+		result, err = r.rerouteMovedActor(ctx, t.reference, t.operation, t.payload, t.create)
+	} else {
+		r.inFlight.Add(1)
+		defer r.inFlight.Add(-1)
+		result, err = r.activations.invoke(
+			ctx, t.reference, t.operation, t.create.InstantiatePayload, t.payload, false)
+	}
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+	_, err = io.Copy(io.Discard, result)
+	return err
+}
+
+// redeliverTell delivers a tell to the actor wherever it's activated now.
+func (r *environment) redeliverTell(ctx context.Context, t *tell) error {
+	actorID := t.reference.ActorID()
+	result, err := r.invokeActorStream(
+		ctx, actorID.Namespace, actorID.ID, actorID.Module, t.operation, t.payload, t.create)
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+	_, err = io.Copy(io.Discard, result)
+	return err
+}
@@ -0,0 +1,120 @@
+package virtual
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestTellActor ensures that tells return once they're buffered in the actor's mailbox,
+// that they're delivered in the background, and that they're rejected once the mailbox
+// is full.
+func TestTellActor(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 50
+	opts.Tell.MailboxSize = 2
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	// Tells activate the actor.
+	require.NoError(t, env.TellActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{}))
+	require.Eventually(t, func() bool {
+		return env.TellStats().Delivered == 1
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, 1, env.ActivationStats().NumActivatedActors)
+
+	// Tells don't wait for the actor to process them.
+	blockCtx, cancelBlock := context.WithCancel(ctx)
+	blockDoneCh := make(chan struct{})
+	go func() {
+		defer close(blockDoneCh)
+		env.InvokeActor(blockCtx, "ns-1", "a", "test-module", "block", nil, types.CreateIfNotExist{})
+	}()
+	require.Eventually(t, func() bool {
+		return env.(*environment).inFlight.Load() == 1
+	}, 5*time.Second, time.Millisecond)
+	require.NoError(t, env.TellActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{}))
+	require.NoError(t, env.TellActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{}))
+	err = env.TellActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.True(t, IsActorMailboxFullErr(err))
+	invokeErr, ok := AsInvokeError(err)
+	require.True(t, ok)
+	require.True(t, invokeErr.Category.Retryable())
+	require.Equal(t, 2, env.TellStats().Buffered)
+
+	cancelBlock()
+	<-blockDoneCh
+	require.Eventually(t, func() bool {
+		return env.TellStats().Delivered == 3
+	}, 5*time.Second, time.Millisecond)
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "getCount", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(3), getCount(t, result))
+	require.Equal(t, TellStats{Accepted: 3, Rejected: 1, Delivered: 3}, env.TellStats())
+}
+
+// TestTellActorDelivery ensures that at-least-once tells are retried until the actor
+// processes them successfully and that at-most-once tells are not, and that tells are
+// delivered before they're acknowledged when buffering is disabled.
+func TestTellActorDelivery(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 51
+	opts.Tell.RetryBackoff = time.Millisecond
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, testModule{}))
+
+	atLeastOnceCtx := WithTellDelivery(ctx, TellDeliveryAtLeastOnce)
+	require.NoError(t, env.TellActor(
+		atLeastOnceCtx, "ns-1", "a", "test-module", "incAndFailUntil", []byte("3"), types.CreateIfNotExist{}))
+	require.NoError(t, env.TellActor(
+		ctx, "ns-1", "b", "test-module", "incAndFailUntil", []byte("3"), types.CreateIfNotExist{}))
+	require.Eventually(t, func() bool {
+		stats := env.TellStats()
+		return stats.Delivered == 1 && stats.Failed == 1
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, uint64(2), env.TellStats().Retried)
+
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "getCount", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(3), getCount(t, result))
+	result, err = env.InvokeActor(ctx, "ns-1", "b", "test-module", "getCount", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	// Without buffering, tells are delivered (and retried) before they're acknowledged.
+	env.(*environment).mailboxes.opts.DisableBuffering = true
+	require.NoError(t, env.TellActor(
+		atLeastOnceCtx, "ns-1", "c", "test-module", "incAndFailUntil", []byte("2"), types.CreateIfNotExist{}))
+	result, err = env.InvokeActor(ctx, "ns-1", "c", "test-module", "getCount", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), getCount(t, result))
+
+	// Tells survive being forwarded to other servers.
+	header := make(http.Header)
+	injectTell(withTell(ctx, TellDeliveryAtLeastOnce), header)
+	delivery, ok := tellFromContext(extractTell(ctx, header))
+	require.True(t, ok)
+	require.Equal(t, TellDeliveryAtLeastOnce, delivery)
+	_, ok = tellFromContext(withoutTell(extractTell(ctx, header)))
+	require.False(t, ok)
+}
@@ -0,0 +1,259 @@
+// Package testutil contains helpers for testing applications (and modules) that are built
+// on top of NOLA without running any external dependencies.
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual"
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// nextPort is the next port that is assigned to a server of a cluster. Servers of
+// in-process clusters don't listen on their ports, but the ports identify them so they
+// must be unique across all the clusters in the process.
+var nextPort atomic.Int64
+
+func init() {
+	nextPort.Store(50000)
+}
+
+// ClusterOptions contains the options for creating a Cluster.
+type ClusterOptions struct {
+	// NumServers is the number of servers in the cluster.
+	//
+	// A value of 0 will be ignored and replaced with the default value of 3.
+	NumServers int
+	// Registry contains the options for the registry that the servers share.
+	Registry registry.KVRegistryOptions
+	// Environment contains the options for every server in the cluster. The servers are
+	// discovered on the local host, so the discovery options are ignored. Unless
+	// ActivationsCache.Clock is set, the servers' activation caches use the cluster's
+	// Clock so that tests can expire cached activations with AdvanceClock.
+	Environment virtual.EnvironmentOptions
+}
+
+// Cluster is an in-process cluster of servers that share an in-memory registry. Invocations
+// are routed between the servers in-memory (unless
+// EnvironmentOptions.ForceRemoteProcedureCalls is set) exactly like they're routed over
+// the network between real servers, so tests can exercise placement, caching and
+// migration without running any external dependencies.
+type Cluster struct {
+	// Registry is the registry that the servers share.
+	Registry registry.Registry
+	// Clock is the clock of the servers' activation caches (unless
+	// ClusterOptions.Environment.ActivationsCache.Clock was set).
+	Clock *FakeClock
+
+	t         testing.TB
+	servers   []virtual.Environment
+	serverIDs []string
+	closed    []bool
+}
+
+// NewCluster creates a new cluster. The cluster is closed when the test completes.
+func NewCluster(t testing.TB, opts ClusterOptions) *Cluster {
+	t.Helper()
+	if opts.NumServers == 0 {
+		opts.NumServers = 3
+	}
+	require.Greater(t, opts.NumServers, 0, "NumServers must be > 0")
+
+	reg, err := localregistry.NewLocalRegistryWithOptions(opts.Registry)
+	require.NoError(t, err)
+
+	c := &Cluster{
+		Registry: reg,
+		Clock:    NewFakeClock(time.Now()),
+		t:        t,
+	}
+	t.Cleanup(c.Close)
+
+	envOpts := opts.Environment
+	if envOpts.ActivationsCache.Clock == nil {
+		envOpts.ActivationsCache.Clock = c.Clock
+	}
+	for i := 0; i < opts.NumServers; i++ {
+		envOpts.Discovery = virtual.DiscoveryOptions{
+			DiscoveryType: virtual.DiscoveryTypeLocalHost,
+			Port:          int(nextPort.Add(1)),
+		}
+		serverID := fmt.Sprintf("server-%d", i)
+		env, err := virtual.NewEnvironment(context.Background(), serverID, reg, nil, envOpts)
+		require.NoError(t, err)
+		c.servers = append(c.servers, env)
+		c.serverIDs = append(c.serverIDs, serverID)
+		c.closed = append(c.closed, false)
+	}
+	return c
+}
+
+// Server returns the i'th server of the cluster.
+func (c *Cluster) Server(i int) virtual.Environment {
+	return c.servers[i]
+}
+
+// ServerID returns the ID of the i'th server of the cluster.
+func (c *Cluster) ServerID(i int) string {
+	return c.serverIDs[i]
+}
+
+// NumServers returns the number of servers in the cluster (including the ones that were
+// stopped).
+func (c *Cluster) NumServers() int {
+	return len(c.servers)
+}
+
+// RegisterModule registers a WASM module with the registry so that every server can
+// activate its actors.
+func (c *Cluster) RegisterModule(namespace, moduleID string, wasmBytes []byte) {
+	c.t.Helper()
+	_, err := c.Registry.RegisterModule(
+		context.Background(), namespace, moduleID, wasmBytes, registry.ModuleOptions{})
+	require.NoError(c.t, err)
+}
+
+// RegisterModuleFile is the same as RegisterModule, except the module is read from the
+// .wasm file at path.
+func (c *Cluster) RegisterModuleFile(namespace, moduleID, path string) {
+	c.t.Helper()
+	wasmBytes, err := os.ReadFile(path)
+	require.NoError(c.t, err)
+	c.RegisterModule(namespace, moduleID, wasmBytes)
+}
+
+// RegisterGoModule registers a Go module with every server.
+func (c *Cluster) RegisterGoModule(namespace, moduleID string, module virtual.Module) {
+	c.t.Helper()
+	for _, server := range c.servers {
+		require.NoError(c.t, server.RegisterGoModule(
+			types.NamespacedIDNoType{Namespace: namespace, ID: moduleID}, module))
+	}
+}
+
+// InvokeActor invokes the actor through the i'th server, creating it if it doesn't exist.
+// The invocation is routed to whichever server the actor is activated on.
+func (c *Cluster) InvokeActor(
+	ctx context.Context,
+	i int,
+	namespace string,
+	actorID string,
+	moduleID string,
+	operation string,
+	payload []byte,
+) ([]byte, error) {
+	return c.servers[i].InvokeActor(
+		ctx, namespace, actorID, moduleID, operation, payload, types.CreateIfNotExist{})
+}
+
+// AdvanceClock advances the cluster's Clock by d.
+func (c *Cluster) AdvanceClock(d time.Duration) {
+	c.Clock.Advance(d)
+}
+
+// Placement returns the ID of the server that the registry placed the actor on, or an
+// empty string if it's not activated.
+func (c *Cluster) Placement(namespace, actorID, moduleID string) string {
+	c.t.Helper()
+	refs, err := c.Registry.LookupActivation(context.Background(), namespace, actorID, moduleID)
+	require.NoError(c.t, err)
+	if len(refs) == 0 {
+		return ""
+	}
+	return refs[0].ServerID()
+}
+
+// RequirePlacement fails the test unless the registry placed the actor on the server with
+// the provided ID.
+func (c *Cluster) RequirePlacement(namespace, actorID, moduleID, serverID string) {
+	c.t.Helper()
+	require.Equal(
+		c.t, serverID, c.Placement(namespace, actorID, moduleID),
+		"unexpected placement of actor: %s/%s/%s", namespace, moduleID, actorID)
+}
+
+// RequireRoutedTo fails the test unless the i'th server routes invocations of the actor
+// to the server with the provided ID, according to its activation cache (or the registry
+// if the actor is not cached).
+func (c *Cluster) RequireRoutedTo(i int, namespace, actorID, moduleID, serverID string) {
+	c.t.Helper()
+	refs, err := c.servers[i].WhereIs(context.Background(), namespace, moduleID, actorID)
+	require.NoError(c.t, err)
+	require.NotEmpty(c.t, refs, "actor: %s/%s/%s is not activated", namespace, moduleID, actorID)
+	require.Equal(
+		c.t, serverID, refs[0].ServerID(),
+		"unexpected route of actor: %s/%s/%s from server: %s",
+		namespace, moduleID, actorID, c.serverIDs[i])
+}
+
+// RequireActivated fails the test unless the i'th server hosts exactly n actors.
+func (c *Cluster) RequireActivated(i int, n int) {
+	c.t.Helper()
+	require.Equal(
+		c.t, n, c.servers[i].ActivationStats().NumActivatedActors,
+		"unexpected number of actors activated on server: %s", c.serverIDs[i])
+}
+
+// DrainServer drains the i'th server so that its actors are moved to the other servers
+// (see Environment.Drain). The server stays in the cluster until it's stopped.
+func (c *Cluster) DrainServer(ctx context.Context, i int) error {
+	return c.servers[i].Drain(ctx)
+}
+
+// StopServer closes the i'th server without draining it, as if its process crashed. The
+// registry places its actors on other servers once its heartbeat expires.
+func (c *Cluster) StopServer(i int) {
+	c.t.Helper()
+	if c.closed[i] {
+		return
+	}
+	c.closed[i] = true
+	require.NoError(c.t, c.servers[i].Close())
+}
+
+// Close closes all the servers that are still running. It's called automatically when the
+// test completes.
+func (c *Cluster) Close() {
+	for i, server := range c.servers {
+		if !c.closed[i] {
+			c.closed[i] = true
+			server.Close()
+		}
+	}
+}
+
+// FakeClock is a virtual.Clock whose time only moves when Advance is called. It's safe
+// for concurrent use.
+type FakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock creates a new FakeClock that starts at now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the clock's current time.
+func (c *FakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
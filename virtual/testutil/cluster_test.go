@@ -0,0 +1,103 @@
+package testutil
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual"
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClusterWASM(t *testing.T) {
+	ctx := context.Background()
+	c := NewCluster(t, ClusterOptions{})
+	c.RegisterModuleFile("ns-1", "util", "../../testdata/tinygo/util/main.wasm")
+
+	// The actor can be invoked through every server.
+	for i := 0; i < c.NumServers(); i++ {
+		result, err := c.InvokeActor(ctx, i, "ns-1", "a", "util", "inc", nil)
+		require.NoError(t, err)
+		require.Equal(t, strconv.Itoa(i+1), string(result))
+	}
+
+	placement := c.Placement("ns-1", "a", "util")
+	require.NotEmpty(t, placement)
+	for i := 0; i < c.NumServers(); i++ {
+		c.RequireRoutedTo(i, "ns-1", "a", "util", placement)
+	}
+}
+
+// TestClusterDrain ensures that clusters can be used to test migrations.
+func TestClusterDrain(t *testing.T) {
+	ctx := context.Background()
+	c := NewCluster(t, ClusterOptions{
+		NumServers: 2,
+		Registry:   registry.KVRegistryOptions{PlacementStrategy: registry.PlacementStrategyRendezvousHash},
+	})
+	c.RegisterGoModule("ns-1", "counter", counterModule{})
+
+	_, err := c.InvokeActor(ctx, 0, "ns-1", "a", "counter", "inc", nil)
+	require.NoError(t, err)
+	from := c.Placement("ns-1", "a", "counter")
+	fromIdx, toIdx := 0, 1
+	if from != c.ServerID(0) {
+		fromIdx, toIdx = 1, 0
+	}
+	c.RequireActivated(fromIdx, 1)
+	c.RequireActivated(toIdx, 0)
+
+	require.NoError(t, c.DrainServer(ctx, fromIdx))
+	_, err = c.InvokeActor(ctx, toIdx, "ns-1", "a", "counter", "inc", nil)
+	require.NoError(t, err)
+	c.RequirePlacement("ns-1", "a", "counter", c.ServerID(toIdx))
+	c.RequireActivated(fromIdx, 0)
+	c.RequireActivated(toIdx, 1)
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Now()
+	clock := NewFakeClock(start)
+	require.Equal(t, start, clock.Now())
+	clock.Advance(time.Minute)
+	require.Equal(t, start.Add(time.Minute), clock.Now())
+}
+
+type counterModule struct{}
+
+func (counterModule) Instantiate(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	payload []byte,
+	host virtual.HostCapabilities,
+) (virtual.Actor, error) {
+	return &counterActor{}, nil
+}
+
+func (counterModule) Close(ctx context.Context) error {
+	return nil
+}
+
+type counterActor struct {
+	count int
+}
+
+func (a *counterActor) Invoke(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+	transaction registry.ActorKVTransaction,
+) ([]byte, error) {
+	if operation == "inc" {
+		a.count++
+	}
+	return []byte(strconv.Itoa(a.count)), nil
+}
+
+func (a *counterActor) Close(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,116 @@
+package virtual
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var errActorTimersClosed = errors.New("actor activation has been closed")
+
+// actorTimers manages the in-memory timers of a single actor activation. Unlike
+// reminders, timers are not persisted anywhere and they're all cancelled when the
+// activation is closed.
+//
+// actorTimers has its own lock (instead of relying on the activatedActor's) because
+// timers are registered by the actor while it's being invoked, during which the
+// activatedActor's lock is already held.
+type actorTimers struct {
+	sync.Mutex
+
+	closed bool
+	timers map[string]*actorTimer
+	// fire is called (in its own goroutine) every time a timer fires. It is set by the
+	// activatedActor that owns the timers.
+	fire func(t *actorTimer)
+}
+
+type actorTimer struct {
+	name   string
+	period time.Duration
+	t      *time.Timer
+}
+
+func newActorTimers() *actorTimers {
+	return &actorTimers{
+		timers: make(map[string]*actorTimer),
+	}
+}
+
+// register registers a timer with the provided name that fires after due, and then
+// every period after that if period is not 0. If a timer with the same name is already
+// registered then it is replaced.
+func (a *actorTimers) register(name string, due, period time.Duration) error {
+	if name == "" {
+		return errors.New("timer name cannot be empty")
+	}
+	if due < 0 {
+		return fmt.Errorf("timer due time cannot be negative, but was: %s", due)
+	}
+	if period < 0 {
+		return fmt.Errorf("timer period cannot be negative, but was: %s", period)
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if a.closed {
+		return errActorTimersClosed
+	}
+
+	if existing, ok := a.timers[name]; ok {
+		existing.t.Stop()
+	}
+	timer := &actorTimer{name: name, period: period}
+	a.timers[name] = timer
+	timer.t = time.AfterFunc(due, func() {
+		a.fire(timer)
+	})
+	return nil
+}
+
+// unregister cancels the timer with the provided name. It is a no-op if the timer does
+// not exist.
+func (a *actorTimers) unregister(name string) {
+	a.Lock()
+	defer a.Unlock()
+	if existing, ok := a.timers[name]; ok {
+		existing.t.Stop()
+		delete(a.timers, name)
+	}
+}
+
+// isRegistered returns true if the provided timer is still registered, I.E it has not
+// been unregistered or replaced by another timer with the same name.
+func (a *actorTimers) isRegistered(timer *actorTimer) bool {
+	a.Lock()
+	defer a.Unlock()
+	return !a.closed && a.timers[timer.name] == timer
+}
+
+// fired must be called once the callback of a timer has completed. Periodic timers are
+// rescheduled (so that a slow callback never overlaps with the next one) and one-off
+// timers are removed.
+func (a *actorTimers) fired(timer *actorTimer) {
+	a.Lock()
+	defer a.Unlock()
+	if a.closed || a.timers[timer.name] != timer {
+		return
+	}
+	if timer.period > 0 {
+		timer.t.Reset(timer.period)
+	} else {
+		delete(a.timers, timer.name)
+	}
+}
+
+// close cancels all the timers and prevents new ones from being registered.
+func (a *actorTimers) close() {
+	a.Lock()
+	defer a.Unlock()
+	a.closed = true
+	for name, timer := range a.timers {
+		timer.t.Stop()
+		delete(a.timers, name)
+	}
+}
@@ -0,0 +1,130 @@
+package virtual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestTimers ensures that timers fire on the activation that registered them, can be
+// unregistered, and are cancelled when the activation is GC'd.
+func TestTimers(t *testing.T) {
+	var (
+		reg    = localregistry.NewLocalRegistry()
+		ctx    = context.Background()
+		module = &testTimersModule{fired: make(map[string]int)}
+	)
+	opts := defaultOptsGoByte
+	opts.Discovery.Port = 12
+	opts.GCActorsAfterDurationWithNoInvocations = 500 * time.Millisecond
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	require.NoError(t, env.RegisterGoModule(
+		types.NamespacedIDNoType{Namespace: "ns-1", ID: "test-module"}, module))
+
+	registerTimer := func(name string, dueMillis, periodMillis int) {
+		payload, err := json.Marshal(wapcutils.RegisterTimer{
+			Name: name, DueMillis: dueMillis, PeriodMillis: periodMillis})
+		require.NoError(t, err)
+		_, err = env.InvokeActor(
+			ctx, "ns-1", "a", "test-module", "registerTimer", payload, types.CreateIfNotExist{})
+		require.NoError(t, err)
+	}
+
+	registerTimer("once", 10, 0)
+	registerTimer("periodic", 10, 20)
+	registerTimer("cancelled", 200, 0)
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "test-module", "unregisterTimer", []byte("cancelled"), types.CreateIfNotExist{})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return module.numFired("periodic") >= 3
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 1, module.numFired("once"))
+
+	// Timers don't keep the actor activated, and once it's GC'd they stop firing.
+	require.Eventually(t, func() bool {
+		return env.numActivatedActors() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	fired := module.numFired("periodic")
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, fired, module.numFired("periodic"))
+	require.Equal(t, 1, module.numFired("once"))
+	require.Equal(t, 0, module.numFired("cancelled"))
+}
+
+type testTimersModule struct {
+	sync.Mutex
+	fired map[string]int
+}
+
+func (tm *testTimersModule) Instantiate(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	payload []byte,
+	host HostCapabilities,
+) (Actor, error) {
+	return &testTimersActor{module: tm, host: host}, nil
+}
+
+func (tm *testTimersModule) Close(ctx context.Context) error {
+	return nil
+}
+
+func (tm *testTimersModule) numFired(name string) int {
+	tm.Lock()
+	defer tm.Unlock()
+	return tm.fired[name]
+}
+
+type testTimersActor struct {
+	module *testTimersModule
+	host   HostCapabilities
+}
+
+func (ta *testTimersActor) Invoke(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+	transaction registry.ActorKVTransaction,
+) ([]byte, error) {
+	switch operation {
+	case wapcutils.StartupOperationName, wapcutils.ShutdownOperationName:
+		return nil, nil
+	case "registerTimer":
+		var req wapcutils.RegisterTimer
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+		return nil, ta.host.RegisterTimer(ctx, req)
+	case "unregisterTimer":
+		return nil, ta.host.UnregisterTimer(ctx, string(payload))
+	case wapcutils.ReceiveTimerOperationName:
+		var req wapcutils.ReceiveTimerRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+		ta.module.Lock()
+		ta.module.fired[req.Name]++
+		ta.module.Unlock()
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("testTimersActor: unhandled operation: %s", operation)
+	}
+}
+
+func (ta *testTimersActor) Close(ctx context.Context) error {
+	return nil
+}
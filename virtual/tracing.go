@@ -0,0 +1,126 @@
+package virtual
+
+import (
+	"context"
+	"net/http"
+)
+
+const (
+	// AttributeNamespace is the span attribute that contains the actor's namespace.
+	AttributeNamespace = "nola.namespace"
+	// AttributeModuleID is the span attribute that contains the actor's module ID.
+	AttributeModuleID = "nola.module_id"
+	// AttributeActorID is the span attribute that contains the actor's ID.
+	AttributeActorID = "nola.actor_id"
+	// AttributeOperation is the span attribute that contains the invoked operation.
+	AttributeOperation = "nola.operation"
+	// AttributeServerID is the span attribute that contains the ID of the server that
+	// is (or will be) running the invocation.
+	AttributeServerID = "nola.server_id"
+	// AttributeCacheHit is the span attribute that indicates whether the actor's
+	// activation was resolved from the activation cache.
+	AttributeCacheHit = "nola.cache_hit"
+)
+
+// Tracer is the interface that must be implemented to trace invocations. Its methods map
+// directly to the OpenTelemetry API so an OpenTelemetry TracerProvider can be used by
+// wrapping it in a small adapter: Start calls trace.Tracer.Start (converting each
+// Attribute into an attribute.KeyValue), and Inject / Extract call the corresponding
+// methods of a propagation.TextMapPropagator with a propagation.HeaderCarrier.
+type Tracer interface {
+	// Start starts a new span that is a child of the span in ctx (if any) and returns a
+	// context that contains the new span.
+	Start(ctx context.Context, spanName string, attrs ...Attribute) (context.Context, Span)
+	// Inject injects the span context in ctx into the headers of an outgoing request so
+	// that the trace is continued by the server that receives it.
+	Inject(ctx context.Context, header http.Header)
+	// Extract extracts the span context (if any) from the headers of an incoming
+	// request and returns a context that contains it.
+	Extract(ctx context.Context, header http.Header) context.Context
+}
+
+// Span is a single traced operation.
+type Span interface {
+	// SetAttributes sets the provided attributes on the span.
+	SetAttributes(attrs ...Attribute)
+	// RecordError records that the operation failed with the provided error.
+	RecordError(err error)
+	// End completes the span.
+	End()
+}
+
+// Attribute is a key-value pair that describes a span.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// tracerCtxKey is the key that is used to store/retrieve the environment's Tracer from
+// the context so that code that doesn't have access to the environment (like the
+// activations cache and WASM actors) can create child spans.
+type tracerCtxKey struct{}
+
+// withTracer returns a context that contains the provided tracer. If tracer is nil then
+// ctx is returned as-is and no spans will be created.
+func withTracer(ctx context.Context, tracer Tracer) context.Context {
+	if tracer == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tracerCtxKey{}, tracer)
+}
+
+func tracerFromContext(ctx context.Context) (Tracer, bool) {
+	tracer, ok := ctx.Value(tracerCtxKey{}).(Tracer)
+	return tracer, ok
+}
+
+// startSpan starts a span for the provided actor if the context contains a Tracer. The
+// returned span's methods are no-ops otherwise so that tracing has no overhead when it
+// is disabled.
+func startSpan(
+	ctx context.Context,
+	spanName string,
+	namespace string,
+	moduleID string,
+	actorID string,
+) (context.Context, span) {
+	tracer, ok := tracerFromContext(ctx)
+	if !ok {
+		return ctx, span{}
+	}
+	ctx, s := tracer.Start(
+		ctx, spanName,
+		Attribute{Key: AttributeNamespace, Value: namespace},
+		Attribute{Key: AttributeModuleID, Value: moduleID},
+		Attribute{Key: AttributeActorID, Value: actorID})
+	return ctx, span{s}
+}
+
+// span wraps a Span that may be nil (if tracing is disabled). Its methods only allocate
+// if tracing is enabled.
+type span struct {
+	s Span
+}
+
+func (s span) setString(key, value string) {
+	if s.s != nil {
+		s.s.SetAttributes(Attribute{Key: key, Value: value})
+	}
+}
+
+func (s span) setBool(key string, value bool) {
+	if s.s != nil {
+		s.s.SetAttributes(Attribute{Key: key, Value: value})
+	}
+}
+
+// end records err (if it's not nil) and then ends the span.
+func (s span) end(err error) {
+	if s.s == nil {
+		return
+	}
+	if err != nil {
+		s.s.RecordError(err)
+	}
+	s.s.End()
+}
@@ -0,0 +1,186 @@
+package virtual
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestTracing ensures that invocations are traced, including invocations that are
+// forwarded to another server over HTTP.
+func TestTracing(t *testing.T) {
+	var (
+		reg    = localregistry.NewLocalRegistry()
+		ctx    = context.Background()
+		tracer = newTestTracer()
+	)
+	opts := defaultOptsWASM
+	opts.Discovery.Port = 14
+	opts.Tracer = tracer
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	_, err = reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"nola.InvokeActor",
+		"nola.InvokeActor/nola.activationsCache.ensureActivation",
+		"nola.InvokeActor/nola.activationsCache.ensureActivation/nola.activationsCache.ensureActivationAndUpdateCache",
+		"nola.InvokeActor/nola.activationsCache.ensureActivation/nola.activationsCache.ensureActivationAndUpdateCache/nola.registry.EnsureActivation",
+		"nola.InvokeActor/nola.InvokeActorDirect",
+		// The first invocation runs the startup operation too.
+		"nola.InvokeActor/nola.InvokeActorDirect/nola.wasm.Invoke",
+		"nola.InvokeActor/nola.InvokeActorDirect/nola.wasm.Invoke",
+	}, tracer.spanPaths())
+	root := tracer.spans[0]
+	require.Equal(t, "ns-1", root.attrs[AttributeNamespace])
+	require.Equal(t, "test-module", root.attrs[AttributeModuleID])
+	require.Equal(t, "a", root.attrs[AttributeActorID])
+	require.Equal(t, "inc", root.attrs[AttributeOperation])
+	require.Equal(t, "serverID1", root.attrs[AttributeServerID])
+	require.Equal(t, false, tracer.spans[1].attrs[AttributeCacheHit])
+	for _, s := range tracer.spans {
+		require.True(t, s.ended)
+	}
+
+	// Subsequent invocations should hit the activation cache.
+	tracer.reset()
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"nola.InvokeActor",
+		"nola.InvokeActor/nola.activationsCache.ensureActivation",
+		"nola.InvokeActor/nola.InvokeActorDirect",
+		"nola.InvokeActor/nola.InvokeActorDirect/nola.wasm.Invoke",
+	}, tracer.spanPaths())
+	require.Equal(t, true, tracer.spans[1].attrs[AttributeCacheHit])
+
+	// Errors should be recorded.
+	tracer.reset()
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "does-not-exist", nil, types.CreateIfNotExist{})
+	require.Error(t, err)
+	require.Error(t, tracer.spans[0].err)
+
+	// Invocations that are forwarded to another server should continue the trace.
+	tracer.reset()
+	httpServer := httptest.NewServer(http.HandlerFunc(NewServer(reg, env).invokeDirect))
+	defer httpServer.Close()
+	references, err := reg.EnsureActivation(ctx, "ns-1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	ref, err := types.NewActorReference(
+		references[0].ServerID(), references[0].ServerVersion(),
+		strings.TrimPrefix(httpServer.URL, "http://"), "ns-1", "test-module", "a",
+		references[0].Generation())
+	require.NoError(t, err)
+	vs, err := reg.GetVersionStamp(ctx)
+	require.NoError(t, err)
+
+	clientCtx, clientSpan := startSpan(withTracer(ctx, tracer), "client", "ns-1", "test-module", "a")
+	result, err := NewHTTPClient().InvokeActorRemote(
+		clientCtx, vs, ref, "inc", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.NoError(t, result.Close())
+	clientSpan.end(nil)
+	require.Equal(t, []string{
+		"client",
+		"client/nola.InvokeActorDirect",
+		"client/nola.InvokeActorDirect/nola.wasm.Invoke",
+	}, tracer.spanPaths())
+}
+
+const testTracerHeader = "X-Test-Span-Path"
+
+type testSpanCtxKey struct{}
+
+// testTracer is a Tracer that records all spans in memory. Spans are identified by their
+// path (the names of all their ancestors and their own name separated by slashes).
+type testTracer struct {
+	sync.Mutex
+	spans []*testSpan
+}
+
+func newTestTracer() *testTracer {
+	return &testTracer{}
+}
+
+func (t *testTracer) Start(
+	ctx context.Context,
+	spanName string,
+	attrs ...Attribute,
+) (context.Context, Span) {
+	path := spanName
+	if parent, ok := ctx.Value(testSpanCtxKey{}).(string); ok {
+		path = fmt.Sprintf("%s/%s", parent, spanName)
+	}
+	s := &testSpan{path: path, attrs: make(map[string]any)}
+	s.SetAttributes(attrs...)
+
+	t.Lock()
+	t.spans = append(t.spans, s)
+	t.Unlock()
+	return context.WithValue(ctx, testSpanCtxKey{}, path), s
+}
+
+func (t *testTracer) Inject(ctx context.Context, header http.Header) {
+	if path, ok := ctx.Value(testSpanCtxKey{}).(string); ok {
+		header.Set(testTracerHeader, path)
+	}
+}
+
+func (t *testTracer) Extract(ctx context.Context, header http.Header) context.Context {
+	if path := header.Get(testTracerHeader); path != "" {
+		return context.WithValue(ctx, testSpanCtxKey{}, path)
+	}
+	return ctx
+}
+
+func (t *testTracer) spanPaths() []string {
+	t.Lock()
+	defer t.Unlock()
+	var paths []string
+	for _, s := range t.spans {
+		paths = append(paths, s.path)
+	}
+	return paths
+}
+
+func (t *testTracer) reset() {
+	t.Lock()
+	defer t.Unlock()
+	t.spans = nil
+}
+
+type testSpan struct {
+	path  string
+	attrs map[string]any
+	err   error
+	ended bool
+}
+
+func (s *testSpan) SetAttributes(attrs ...Attribute) {
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *testSpan) RecordError(err error) {
+	s.err = err
+}
+
+func (s *testSpan) End() {
+	s.ended = true
+}
@@ -3,6 +3,8 @@ package virtual
 import (
 	"context"
 	"io"
+	"log/slog"
+	"time"
 
 	"github.com/richardartoul/nola/virtual/registry"
 	"github.com/richardartoul/nola/virtual/types"
@@ -52,6 +54,222 @@ type Environment interface {
 		createIfNotExist types.CreateIfNotExist,
 	) (io.ReadCloser, error)
 
+	// InvokeActorBatch invokes many actors of the provided namespace in as few network
+	// round-trips as possible. The activation of every actor is ensured (using the
+	// activation cache) and then the invocations are grouped by the server that they're
+	// routed to so that each server receives a single sub-batch that it executes
+	// concurrently.
+	//
+	// The returned results have the same order as invocations. Errors are reported
+	// per-invocation instead of failing the entire batch, so the returned error is only
+	// set if none of the invocations could be attempted. Note that errors of invocations
+	// that were executed by remote servers only preserve their message.
+	InvokeActorBatch(
+		ctx context.Context,
+		namespace string,
+		invocations []BatchInvocation,
+	) ([]BatchInvocationResult, error)
+
+	// TellActor is the fire-and-forget version of InvokeActor: it returns as soon as the
+	// server that hosts the actor accepts the invocation for delivery instead of once the
+	// actor has processed it, and the result of the invocation is discarded. See
+	// TellOptions for where tells are buffered and WithTellDelivery for their delivery
+	// semantics.
+	//
+	// Tells activate the actor (if create allows it) exactly like invocations do and
+	// count as invocations for the purposes of EnvironmentOptions.ActorIdleTimeout, so an
+	// actor that is only ever told is kept activated while it's being told. Tells that
+	// are buffered don't keep the actor activated, but their delivery activates it again
+	// if it was deactivated in the meantime.
+	//
+	// Tells are delivered in the order in which they're accepted by the hosting server.
+	// If the actor's mailbox is full, the tell is rejected with an error for which
+	// IsActorMailboxFullErr returns true (after the retries of at-least-once tells are
+	// exhausted), and callers should slow down.
+	TellActor(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		moduleID string,
+		operation string,
+		payload []byte,
+		create types.CreateIfNotExist,
+	) error
+
+	// RegisterReminder registers a durable reminder with the provided name for the
+	// provided actor. The reminder is persisted in the registry so it survives server
+	// restarts and actor migrations. At dueTime, and then every period after that if
+	// period is not 0, the wapcutils.ReceiveReminderOperationName operation will be
+	// invoked on the actor with a wapcutils.ReceiveReminderRequest payload, activating
+	// it if necessary. If the actor already has a reminder with the same name it is
+	// replaced.
+	//
+	// Each firing of a reminder is delivered at most once, and firings that are missed
+	// entirely (for example because no server was running) are skipped instead of being
+	// delivered back to back.
+	RegisterReminder(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		moduleID string,
+		name string,
+		dueTime time.Time,
+		period time.Duration,
+	) error
+
+	// UnregisterReminder unregisters the reminder with the provided name for the provided
+	// actor. It is a no-op if the reminder does not exist.
+	UnregisterReminder(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		moduleID string,
+		name string,
+	) error
+
+	// ListReminders lists all of the reminders registered for the provided actor.
+	ListReminders(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		moduleID string,
+	) ([]registry.Reminder, error)
+
+	// PrefetchActivations warms the activation cache for the provided actors so that
+	// subsequent invocations don't have to pay the latency of a cache miss. This is
+	// useful for predictable traffic spikes, like a scheduled job that is about to
+	// invoke a large set of known actors. Keys that are already cached are skipped,
+	// unless their cached entry is stale or is a cached error, in which case they are
+	// resolved again.
+	//
+	// Errors are reported per-key in the returned map (which will be empty if every
+	// key was prefetched successfully) instead of failing the entire batch. Note that
+	// this method is a no-op if the activation cache is disabled.
+	PrefetchActivations(ctx context.Context, keys []ActivationKey) map[ActivationKey]error
+
+	// WhereIs returns the references of the provided actor's current activation, if
+	// any, without activating it or selecting a location for it. Cached references are
+	// returned if there are any, otherwise the registry is consulted with a read-only
+	// lookup. An empty slice is returned if the actor is not currently activated, in
+	// which case its location will only be selected once it's invoked.
+	//
+	// Unlike invocations, WhereIs has no side effects, which makes it useful for routing
+	// dashboards and for batching invocations by server on the client side.
+	WhereIs(
+		ctx context.Context,
+		namespace string,
+		moduleID string,
+		actorID string,
+	) ([]types.ActorReference, error)
+
+	// DescribeModule returns the description of the operations that the actors of the
+	// provided module support, which powers tooling like admin UIs and generated clients.
+	// WASM modules describe themselves by exporting the wapcutils.DescribeOperationName
+	// operation and Go modules by implementing ModuleDescriber. An error for which
+	// IsModuleNotDescribableErr returns true is returned for modules that do neither.
+	//
+	// Descriptions are cached per module. Once a module is described, invocations of
+	// operations that its description doesn't list are rejected (before the actor is
+	// instantiated) with an error for which IsUnknownOperationErr returns true.
+	DescribeModule(
+		ctx context.Context,
+		namespace string,
+		moduleID string,
+	) (wapcutils.ModuleDescription, error)
+
+	// ActivationCacheStats returns point-in-time statistics about the activation cache
+	// so operators can see how full it is and whether evictions are happening.
+	ActivationCacheStats() ActivationCacheStats
+
+	// ActivationStats returns point-in-time statistics about the actors that are
+	// activated in the environment.
+	ActivationStats() ActivationStats
+
+	// ModuleCacheStats returns point-in-time statistics about the compiled WASM module
+	// cache.
+	ModuleCacheStats() ModuleCacheStats
+
+	// SchedulerStats returns point-in-time statistics about the scheduling of
+	// invocations, including the number of invocations that are queued by priority. It
+	// returns the zero value if EnvironmentOptions.Scheduler.MaxConcurrentInvocations is
+	// not set.
+	SchedulerStats() SchedulerStats
+
+	// TellStats returns point-in-time statistics about the tells that were accepted by
+	// the environment for the actors that it hosts.
+	TellStats() TellStats
+
+	// NamespaceStats returns point-in-time statistics about the utilization of the
+	// resources of every namespace that has actors activated (or cached) in the
+	// environment, along with their quotas (see EnvironmentOptions.NamespaceQuotas).
+	NamespaceStats() map[string]NamespaceStats
+
+	// HTTPEgressStats returns point-in-time statistics about the HTTP requests that the
+	// actors of every namespace made through the environment (see
+	// EnvironmentOptions.HTTPEgress).
+	HTTPEgressStats() map[string]HTTPEgressStats
+
+	// QuarantinedActors returns the actors that are currently quarantined on this server
+	// because they trapped too many times (see EnvironmentOptions.Quarantine).
+	QuarantinedActors() []QuarantinedActor
+
+	// UnquarantineActor releases the provided actor from quarantine so that it can be
+	// activated again right away, for example after deploying a fix for its module. It
+	// returns whether the actor was quarantined.
+	UnquarantineActor(namespace, moduleID, actorID string) bool
+
+	// SubscribeLifecycle returns a channel on which the lifecycle events of the actors
+	// (but not the workers) that this server observes are delivered from now on: their
+	// activations, deactivations, migrations and quarantines, and the entries that are
+	// deleted from its activation cache. Events are local to every server so building a
+	// cluster-wide stream requires subscribing on every server.
+	//
+	// The channel is buffered (see EnvironmentOptions.Lifecycle) and publishing never
+	// blocks the server, so events are dropped for subscribers that don't keep up (see
+	// ActivationStats.LifecycleEventsDropped). The channel is closed when the environment
+	// is closed.
+	SubscribeLifecycle() <-chan LifecycleEvent
+
+	// Registry returns the registry that the environment was created with so that
+	// embedding applications can perform admin operations without threading it
+	// separately. It's safe for concurrent use, but changes that are made to actor
+	// placements through it directly are only observed by the environment once its cached
+	// activations are refreshed (see ActivationsCacheOptions), so prefer the methods
+	// below which keep the cache consistent.
+	Registry() registry.Registry
+
+	// RegisterModule registers the WASM module with the provided ID in the registry (see
+	// registry.Registry.RegisterModule).
+	RegisterModule(
+		ctx context.Context,
+		namespace string,
+		moduleID string,
+		moduleBytes []byte,
+		opts registry.ModuleOptions,
+	) (registry.RegisterModuleResult, error)
+
+	// ListActors lists the placement state of every actor in the namespace. It requires
+	// a registry that implements registry.MigratableRegistry (all the KV-backed
+	// registries do).
+	ListActors(ctx context.Context, namespace string) ([]registry.ActorPlacement, error)
+
+	// RebalanceActor forces the actor to be placed again according to the registry's
+	// placement strategy, for example after servers joined the cluster, and returns the
+	// references to its new activation. Its generation is incremented so that its
+	// existing activation is invalidated. The server that hosted it stops doing so once it
+	// fails to renew the activation's lease (if the registry grants leases) or the
+	// activation is idle, and until then the servers that haven't refreshed their cached
+	// activation may still route to it. If the actor is activated on this server and
+	// handoffs are enabled (see EnvironmentOptions.Handoff), this server deactivates it
+	// right away instead and hands its in-memory state off to its new activation. It
+	// requires a registry that implements registry.MigratableRegistry.
+	RebalanceActor(
+		ctx context.Context,
+		namespace string,
+		moduleID string,
+		actorID string,
+	) ([]types.ActorReference, error)
+
 	// InvokeActorDirect is the same as InvokeActor, however, it performs the invocation
 	// "directly".
 	//
@@ -83,6 +301,19 @@ type Environment interface {
 		createIfNotExist types.CreateIfNotExist,
 	) (io.ReadCloser, error)
 
+	// InvokeActorDirectBatch is the same as InvokeActorDirect, except it performs a batch
+	// of invocations concurrently. The returned results have the same order as
+	// invocations.
+	//
+	// This method should only be called if the Registry has indicated that all of the
+	// actors should be activated in this process.
+	InvokeActorDirectBatch(
+		ctx context.Context,
+		versionStamp int64,
+		serverID string,
+		invocations []DirectBatchInvocation,
+	) []BatchInvocationResult
+
 	// InvokeWorker invokes the specified operation from the specified module. Unlike
 	// actors, workers provide no guarantees about single-threaded execution or only
 	// a single instance running at a time. This makes them easier to scale than
@@ -114,6 +345,52 @@ type Environment interface {
 		createIfNotExist types.CreateIfNotExist,
 	) (io.ReadCloser, error)
 
+	// RestoreActorDirect activates the actor on this server with the in-memory state of
+	// its activation on the server that handed it off (see HandoffOptions). It's called
+	// by the server that is being drained with the actor's reference after the registry
+	// moved it here, and it fails if the actor is already activated here.
+	RestoreActorDirect(
+		ctx context.Context,
+		versionStamp int64,
+		serverID string,
+		serverVersion int64,
+		reference types.ActorReferenceVirtual,
+		state []byte,
+	) error
+
+	// Drain prepares the Environment to be shut down with minimal disruption. It stops
+	// the registry from activating new actors on this server (and moves the actors
+	// that are activated here to other servers once their activations are ensured
+	// again), waits for in-flight invocations to complete until ctx is done, and then
+	// deactivates all the actors running their deactivation hooks. Invocations that
+	// are routed to this server afterwards by stale activation caches are rerouted to
+	// the actor's new location. If handoffs are enabled (see HandoffOptions), the
+	// in-memory state of the actors is handed off to their new location when they're
+	// deactivated.
+	//
+	// Once Drain returns the process can be stopped. Note that Close must still be
+	// called to release the Environment's resources.
+	Drain(ctx context.Context) error
+
+	// BlacklistServer makes the Environment route around serverID (for example
+	// because it's degraded or shedding load) until ttl has elapsed. While serverID
+	// is blacklisted the registry will not activate actors on it and actors that are
+	// already activated on it are moved to other servers the next time the
+	// Environment ensures their activation. Once ttl has elapsed serverID is forgotten
+	// and becomes eligible again.
+	BlacklistServer(serverID string, ttl time.Duration)
+
+	// Health reports whether the server can reach the registry, how many actors it
+	// hosts, and whether it's draining. It's meant to back liveness and readiness
+	// probes (the server exposes it at /api/v1/health and /api/v1/ready).
+	Health() HealthStatus
+
+	// ReloadNamespaceConfigs replaces the configuration of every namespace (see
+	// EnvironmentOptions.NamespaceConfigs). Invocations that start afterwards observe
+	// the new configuration, and namespaces that are not in configs no longer have any
+	// configuration.
+	ReloadNamespaceConfigs(configs map[string]NamespaceConfig)
+
 	// Close closes the Environment and all of its associated resources.
 	Close() error
 }
@@ -155,6 +432,44 @@ type RemoteClient interface {
 		payload []byte,
 		create types.CreateIfNotExist,
 	) (io.ReadCloser, error)
+
+	// InvokeActorDirectBatchRemote is the same as InvokeActorRemote, except it performs a
+	// batch of invocations on the server with the provided ID and address. The returned
+	// error is only set if the batch could not be executed at all.
+	InvokeActorDirectBatchRemote(
+		ctx context.Context,
+		versionStamp int64,
+		serverID string,
+		address string,
+		invocations []DirectBatchInvocation,
+	) ([]BatchInvocationResult, error)
+
+	// RestoreActorRemote calls RestoreActorDirect on the server of the provided
+	// reference.
+	RestoreActorRemote(
+		ctx context.Context,
+		versionStamp int64,
+		reference types.ActorReference,
+		state []byte,
+	) error
+}
+
+// RoutingClient is implemented by the RemoteClients (like the one returned by
+// NewHTTPClient) that can send invocations to any server, which then routes them to the
+// server that hosts the actor the same way as Environment.InvokeActor. It's meant for
+// processes that invoke actors but don't run an Environment themselves.
+type RoutingClient interface {
+	// InvokeActorRouted invokes the actor through the server at address.
+	InvokeActorRouted(
+		ctx context.Context,
+		address string,
+		namespace string,
+		actorID string,
+		moduleID string,
+		operation string,
+		payload []byte,
+		create types.CreateIfNotExist,
+	) (io.ReadCloser, error)
 }
 
 // Module represents a "module" / template from which new actors are constructed/instantiated.
@@ -206,11 +521,28 @@ type ActorStream interface {
 	) (io.ReadCloser, error)
 }
 
+// ActorDeactivator is an optional interface that can be implemented by actors that
+// need to flush state or perform cleanup before they're deactivated. Deactivation
+// happens when the actor is GC'd for inactivity, replaced by a newer generation, or
+// when the server stops hosting it (for example because its heartbeat lapsed and the
+// registry may have placed the actor elsewhere).
+//
+// OnDeactivate is invoked before the actor's shutdown operation and before Close. It
+// must return before the context is canceled (see
+// EnvironmentOptions.ActorDeactivationTimeout), otherwise the server will stop waiting
+// for it. WASM actors can achieve the same thing by handling the shutdown operation.
+type ActorDeactivator interface {
+	OnDeactivate(ctx context.Context) error
+}
+
 // HostCapabilities defines the interface of capabilities exposed by the host to the Actor.
 type HostCapabilities interface {
 	KV
 
-	// InvokeActor invokes a function on the specified actor.
+	// InvokeActor invokes a function on the specified actor. The invoked actor can
+	// retrieve the identity of the invoking actor with CallerFromContext(). It fails if
+	// the chain of actor-to-actor invocations would exceed
+	// EnvironmentOptions.MaxInvocationDepth.
 	InvokeActor(context.Context, types.InvokeActorRequest) ([]byte, error)
 
 	// ScheduleSelfTimer is the same as InvokeActor, except the invocation is scheduled
@@ -218,6 +550,86 @@ type HostCapabilities interface {
 	// instantiated / activated in-memory when the timer fires.
 	ScheduleSelfTimer(context.Context, wapcutils.ScheduleSelfTimer) error
 
+	// RegisterTimer registers an in-memory timer on the calling actor's activation. When
+	// the timer fires, the wapcutils.ReceiveTimerOperationName operation is invoked on the
+	// same activation (without going through the registry) with a
+	// wapcutils.ReceiveTimerRequest payload. Registering a timer with the same name as an
+	// existing one replaces it.
+	//
+	// Timers are not durable: they're cancelled when the activation is deactivated, and
+	// they don't count as activity so they never keep an idle actor activated. Use
+	// reminders for invocations that must happen regardless.
+	RegisterTimer(context.Context, wapcutils.RegisterTimer) error
+
+	// UnregisterTimer cancels the timer with the provided name, if it exists.
+	UnregisterTimer(ctx context.Context, name string) error
+
+	// StreamSend sends a chunk of the response of the current invocation to the caller.
+	// It can be called any number of times during an invocation and the chunks precede
+	// the response returned by the actor. If the caller requested a streaming response
+	// (see WithStreamingResponse) the chunk is sent immediately and StreamSend blocks
+	// until the caller has read it, otherwise the chunks are buffered and returned when
+	// the invocation completes.
+	StreamSend(ctx context.Context, chunk []byte) error
+
+	// Log logs msg to EnvironmentOptions.Logger at the provided level. args are
+	// interpreted the same way as the args of slog.Logger.Log and the entry is
+	// annotated with the namespace, module ID and actor ID of the calling actor. It is a
+	// no-op if the logger is not enabled for level.
+	Log(ctx context.Context, level slog.Level, msg string, args ...any)
+
+	// MetricInc increments the counter with the provided name by delta. It is a no-op
+	// if EnvironmentOptions.ActorMetrics.Sink is nil. See ActorMetricsOptions for how
+	// metrics are named, labeled and limited.
+	MetricInc(ctx context.Context, name string, delta float64) error
+
+	// MetricObserve is the same as MetricInc, except it records value in the
+	// distribution (histogram, summary, etc) with the provided name.
+	MetricObserve(ctx context.Context, name string, value float64) error
+
+	// GetConfig returns the value of the provided key in the configuration of the
+	// calling actor's namespace (see EnvironmentOptions.NamespaceConfigs) and whether it
+	// exists. The returned slice must not be modified.
+	GetConfig(ctx context.Context, key string) ([]byte, bool)
+
+	// NewID returns a new ULID: a 26 character string that begins with the time at which
+	// it was generated (with millisecond precision) followed by 80 random bits. The IDs
+	// returned by the same activation are strictly increasing, and IDs are roughly
+	// ordered by time otherwise, which makes them suitable as ordered keys in the actor's
+	// KV storage. Actors that need reproducible randomness instead should use
+	// wapcutils.NewSeededRand.
+	NewID(ctx context.Context) string
+
+	// DeactivateSelf requests that the calling actor's activation is deactivated once the
+	// current invocation returns, as if it had been idle for longer than
+	// EnvironmentOptions.ActorIdleTimeout: its deactivation hooks (OnDeactivate and the
+	// wapcutils.ShutdownOperationName operation) are run and subsequent invocations
+	// activate it again from scratch. It fails if it's not called during an invocation.
+	DeactivateSelf(ctx context.Context) error
+
+	// LastInvokedAt returns the time at which the previous invocation of the calling
+	// actor's activation started (not the current one), or the zero time if the current
+	// invocation is the first one since the actor was activated. Combined with
+	// EnvironmentOptions.ActorIdleTimeout it lets actors make their own decisions based
+	// on how long they've been idle, like archiving themselves. It fails if it's not
+	// called during an invocation.
+	LastInvokedAt(ctx context.Context) (time.Time, error)
+
+	// FencingToken returns the fencing token of the lease that the registry granted the
+	// calling actor's activation (see types.ActivationLease.FencingToken). Tokens
+	// increase every time the actor is activated with a new lease, so external systems
+	// can reject writes from previous (migrated away) activations of the actor by
+	// rejecting writes with a lower token than the highest one they've seen. It fails if
+	// the registry doesn't grant activation leases, or if the actor is no longer
+	// activated on this server.
+	FencingToken(ctx context.Context) (uint64, error)
+
+	// HTTPFetch makes an HTTP request on behalf of the actor and returns its response. The
+	// request is subject to the HTTP egress policy of the actor's namespace (see
+	// EnvironmentOptions.HTTPEgress): requests to hosts that are not allowed, or that
+	// exceed the namespace's rate limit, fail with an *HTTPEgressDeniedError.
+	HTTPFetch(ctx context.Context, req wapcutils.HTTPFetchRequest) (wapcutils.HTTPFetchResponse, error)
+
 	// CustomFn invoke a custom (user defined) host function. This will only work if the
 	// custom host function was registered with the environment when it was instantiated.
 	CustomFn(
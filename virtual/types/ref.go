@@ -10,6 +10,13 @@ type actorRef struct {
 	serverID      string
 	serverVersion int64
 	address       string
+	lease         ActivationLease
+	// failoverCandidates never have failover candidates of their own. It's a pointer so
+	// that actorRef remains comparable.
+	failoverCandidates *[]ActorReference
+	replica            bool
+	// cacheCost is 0 unless the reference was tagged with WithCacheCost.
+	cacheCost int64
 }
 
 // NewActorReference creates an ActorReference.
@@ -21,6 +28,23 @@ func NewActorReference(
 	moduleID string,
 	actorID string,
 	generation uint64,
+) (ActorReference, error) {
+	return NewLeasedActorReference(
+		serverID, serverVersion, address, namespace, moduleID, actorID, generation,
+		ActivationLease{})
+}
+
+// NewLeasedActorReference is the same as NewActorReference, except the reference carries
+// the provided activation lease.
+func NewLeasedActorReference(
+	serverID string,
+	serverVersion int64,
+	address string,
+	namespace string,
+	moduleID string,
+	actorID string,
+	generation uint64,
+	lease ActivationLease,
 ) (ActorReference, error) {
 	virtual, err := NewVirtualActorReference(namespace, moduleID, actorID, generation)
 	if err != nil {
@@ -39,9 +63,54 @@ func NewActorReference(
 		serverID:      serverID,
 		serverVersion: serverVersion,
 		address:       address,
+		lease:         lease,
 	}, nil
 }
 
+// WithFailoverCandidates returns a copy of ref that carries the provided failover
+// candidates. ref must have been created with NewActorReference or
+// NewLeasedActorReference.
+func WithFailoverCandidates(ref ActorReference, candidates []ActorReference) (ActorReference, error) {
+	l, ok := ref.(actorRef)
+	if !ok {
+		return nil, fmt.Errorf("WithFailoverCandidates: unsupported reference type: %T", ref)
+	}
+	for _, candidate := range candidates {
+		if len(candidate.FailoverCandidates()) > 0 {
+			return nil, errors.New("WithFailoverCandidates: candidates cannot have failover candidates")
+		}
+	}
+	l.failoverCandidates = &candidates
+	return l, nil
+}
+
+// AsReplica returns a copy of ref that points to an extra replica of the actor's
+// activation instead of its primary activation. ref must have been created with
+// NewActorReference or NewLeasedActorReference.
+func AsReplica(ref ActorReference) (ActorReference, error) {
+	l, ok := ref.(actorRef)
+	if !ok {
+		return nil, fmt.Errorf("AsReplica: unsupported reference type: %T", ref)
+	}
+	l.replica = true
+	return l, nil
+}
+
+// WithCacheCost returns a copy of ref that is tagged with the provided cache cost (see
+// ActorReferencePhysical.CacheCost). ref must have been created with NewActorReference
+// or NewLeasedActorReference.
+func WithCacheCost(ref ActorReference, cost int64) (ActorReference, error) {
+	l, ok := ref.(actorRef)
+	if !ok {
+		return nil, fmt.Errorf("WithCacheCost: unsupported reference type: %T", ref)
+	}
+	if cost < 1 {
+		return nil, fmt.Errorf("WithCacheCost: cost must be >= 1, but was: %d", cost)
+	}
+	l.cacheCost = cost
+	return l, nil
+}
+
 func (l actorRef) Type() ReferenceType {
 	return ReferenceTypeLocal
 }
@@ -73,3 +142,25 @@ func (l actorRef) Address() string {
 func (l actorRef) Generation() uint64 {
 	return l.virtualRef.Generation()
 }
+
+func (l actorRef) Lease() ActivationLease {
+	return l.lease
+}
+
+func (l actorRef) FailoverCandidates() []ActorReference {
+	if l.failoverCandidates == nil {
+		return nil
+	}
+	return *l.failoverCandidates
+}
+
+func (l actorRef) IsReplica() bool {
+	return l.replica
+}
+
+func (l actorRef) CacheCost() int64 {
+	if l.cacheCost == 0 {
+		return 1
+	}
+	return l.cacheCost
+}
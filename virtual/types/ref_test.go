@@ -2,6 +2,7 @@ package types
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -19,3 +20,60 @@ func TestNewActorReference(t *testing.T) {
 	require.Equal(t, "b", ref.ModuleID().ID)
 	require.Equal(t, uint64(1), ref.Generation())
 }
+
+func TestNewLeasedActorReference(t *testing.T) {
+	ref, err := NewActorReference("server1", 0, "server1path", "a", "b", "c", 1)
+	require.NoError(t, err)
+	require.True(t, ref.Lease().IsZero())
+
+	lease := ActivationLease{Token: "token", Duration: time.Second}
+	ref, err = NewLeasedActorReference("server1", 0, "server1path", "a", "b", "c", 1, lease)
+	require.NoError(t, err)
+	require.Equal(t, lease, ref.Lease())
+	require.False(t, ref.Lease().IsZero())
+}
+
+func TestWithFailoverCandidates(t *testing.T) {
+	ref, err := NewActorReference("server1", 0, "server1path", "a", "b", "c", 1)
+	require.NoError(t, err)
+	require.Empty(t, ref.FailoverCandidates())
+
+	candidate, err := NewActorReference("server2", 0, "server2path", "a", "b", "c", 1)
+	require.NoError(t, err)
+	withCandidates, err := WithFailoverCandidates(ref, []ActorReference{candidate})
+	require.NoError(t, err)
+	require.Equal(t, []ActorReference{candidate}, withCandidates.FailoverCandidates())
+	require.Equal(t, "server1", withCandidates.ServerID())
+	require.Empty(t, ref.FailoverCandidates())
+
+	// Candidates can't be nested.
+	_, err = WithFailoverCandidates(candidate, []ActorReference{withCandidates})
+	require.Error(t, err)
+}
+
+func TestAsReplica(t *testing.T) {
+	ref, err := NewActorReference("server1", 0, "server1path", "a", "b", "c", 1)
+	require.NoError(t, err)
+	require.False(t, ref.IsReplica())
+
+	replica, err := AsReplica(ref)
+	require.NoError(t, err)
+	require.True(t, replica.IsReplica())
+	require.Equal(t, "server1", replica.ServerID())
+	require.False(t, ref.IsReplica())
+}
+
+func TestWithCacheCost(t *testing.T) {
+	ref, err := NewActorReference("server1", 0, "server1path", "a", "b", "c", 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), ref.CacheCost())
+
+	tagged, err := WithCacheCost(ref, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), tagged.CacheCost())
+	require.Equal(t, "server1", tagged.ServerID())
+	require.Equal(t, int64(1), ref.CacheCost())
+
+	_, err = WithCacheCost(ref, 0)
+	require.Error(t, err)
+}
@@ -3,6 +3,9 @@ package types
 // InvokeActorRequest is the JSON struct that represents a request from an existing
 // actor to invoke an operation on another one.
 type InvokeActorRequest struct {
+	// Namespace is the namespace of the target actor. This field is optional and
+	// defaults to the namespace of the invoking actor.
+	Namespace string `json:"namespace"`
 	// ActorID is the ID of the target actor.
 	ActorID string `json:"actor_id"`
 	// ModuleID is the ID of the module for which the actor should be activated.
@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 // ReferenceType is an enum type that indicates what the underlying type of Reference is,
 // see the different ReferenceType's below.
 type ReferenceType string
@@ -46,4 +48,44 @@ type ActorReferencePhysical interface {
 	// ServerVersion is incremented every time a server's heartbeat expires and resumes,
 	// guaranteeing the server's ability to identify periods of inactivity/death for correctness purposes.
 	ServerVersion() int64
+	// Lease is the lease that the registry granted the referenced activation, if any. It
+	// is the zero value if the registry doesn't grant activation leases.
+	Lease() ActivationLease
+	// FailoverCandidates returns references to the same actor on other servers, ranked in
+	// the order in which they should be tried if the referenced server can't be reached.
+	// It is empty unless the registry was asked for candidates (see
+	// registry.EnsureActivationOptions.NumFailoverCandidates).
+	FailoverCandidates() []ActorReference
+	// IsReplica returns whether the reference points to an extra replica of the actor's
+	// activation rather than to its primary activation. Only invocations that don't
+	// mutate the actor's state may be sent to replicas.
+	IsReplica() bool
+	// CacheCost is the cost of caching the reference in an activation cache, relative to
+	// the default cost of 1. References with a higher cost are retained longer when the
+	// cache is full, so the registry (or the caller) can tag the references to actors that
+	// are expensive to resolve again, like singletons and coordinators, with a higher
+	// cost (see WithCacheCost).
+	CacheCost() int64
+}
+
+// ActivationLease is a lease on an actor's activation that the registry grants the server
+// that hosts it. The server must renew the lease with the registry before it expires,
+// otherwise the registry considers the actor free to be activated elsewhere.
+type ActivationLease struct {
+	// Token identifies the lease when it's renewed. It is opaque to everything except
+	// the registry that granted it.
+	Token string
+	// Duration is how long the lease was valid for when it was granted or last renewed.
+	Duration time.Duration
+	// FencingToken increases every time the registry grants the actor a new lease and
+	// stays the same when the lease is renewed, so external systems can reject writes
+	// that carry a lower token than the highest one they've seen to fence off previous
+	// activations of the actor.
+	FencingToken uint64
+}
+
+// IsZero returns whether the lease is the zero value, which indicates that no lease was
+// granted.
+func (l ActivationLease) IsZero() bool {
+	return l.Token == ""
 }
@@ -0,0 +1,588 @@
+package virtual
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"time"
+
+	"github.com/richardartoul/nola/durable"
+	"github.com/richardartoul/nola/durable/durablewazero"
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+)
+
+// hostFnActorReferenceCtxKey is the key that is used to store/retrieve the actor reference
+// field from the context.
+type hostFnActorReferenceCtxKey struct{}
+
+// hostFnActorTxnKey is the key that is used to store/retrieve the actor's per-invocation
+// lazyTransaction from the context.
+type hostFnActorTxnKey struct{}
+
+// hostFnHostCapabilitiesKey is the key that is used to store/retrieve the actor
+// activation's HostCapabilities from the context.
+type hostFnHostCapabilitiesKey struct{}
+
+// hostFnOperationKey is the key that is used to store/retrieve the name of the operation
+// of the current invocation from the context.
+type hostFnOperationKey struct{}
+
+// TODO: Should have some kind of ACL enforcement polic here, but for now allow any module to
+// run any host function.
+func newHostFnRouter(
+	reg registry.Registry,
+	environment Environment,
+	activations *activations,
+	customHostFns map[string]func([]byte) ([]byte, error),
+) durable.HostFn {
+	return recordHostCalls(func(
+		ctx context.Context,
+		wapcBinding string,
+		wapcNamespace string,
+		wapcOperation string,
+		wapcPayload []byte,
+	) ([]byte, error) {
+		actorRef, err := extractActorRef(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error extracting actor reference from context: %w", err)
+		}
+
+		switch wapcOperation {
+		case wapcutils.KVPutOperationName:
+			k, v, err := wapcutils.ExtractKVFromPutPayload(wapcPayload)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting KV from PUT payload: %w", err)
+			}
+
+			tr, err := extractTransaction(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting transaction from context: %w", err)
+			}
+
+			if err := tr.Put(ctx, k, v); err != nil {
+				return nil, fmt.Errorf("error performing PUT against registry: %w", err)
+			}
+
+			return nil, nil
+		case wapcutils.KVGetOperationName:
+			tr, err := extractTransaction(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting transaction from context: %w", err)
+			}
+
+			v, ok, err := tr.Get(ctx, wapcPayload)
+			if err != nil {
+				return nil, fmt.Errorf("error performing GET against registry: %w", err)
+			}
+			if !ok {
+				return []byte{0}, nil
+			} else {
+				// TODO: Avoid these useless allocs.
+				resp := make([]byte, 0, len(v)+1)
+				resp = append(resp, 1)
+				resp = append(resp, v...)
+				return resp, nil
+			}
+
+		case wapcutils.KVDeleteOperationName:
+			tr, err := extractTransaction(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting transaction from context: %w", err)
+			}
+
+			if err := tr.Delete(ctx, wapcPayload); err != nil {
+				return nil, fmt.Errorf("error performing DELETE against registry: %w", err)
+			}
+
+			return nil, nil
+
+		case wapcutils.KVListOperationName:
+			tr, err := extractTransaction(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting transaction from context: %w", err)
+			}
+
+			var resp []byte
+			err = tr.IterPrefix(ctx, wapcPayload, func(k, v []byte) error {
+				resp = wapcutils.AppendKVListEntry(resp, k, v)
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("error performing LIST against registry: %w", err)
+			}
+
+			return resp, nil
+
+		case wapcutils.KVGetWithVersionOperationName:
+			tr, err := extractTransaction(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting transaction from context: %w", err)
+			}
+
+			v, version, ok, err := tr.GetWithVersion(ctx, wapcPayload)
+			if err != nil {
+				return nil, fmt.Errorf("error performing GET-WITH-VERSION against registry: %w", err)
+			}
+			return wapcutils.EncodeGetWithVersionResponse(nil, v, version, ok), nil
+
+		case wapcutils.KVPutIfVersionOperationName:
+			k, v, expectedVersion, err := wapcutils.ExtractPutIfVersionPayload(wapcPayload)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting KV from PUT-IF-VERSION payload: %w", err)
+			}
+
+			tr, err := extractTransaction(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting transaction from context: %w", err)
+			}
+
+			ok, err := tr.PutIfVersion(ctx, k, v, expectedVersion)
+			if err != nil {
+				return nil, fmt.Errorf("error performing PUT-IF-VERSION against registry: %w", err)
+			}
+			if !ok {
+				return []byte{0}, nil
+			}
+			return []byte{1}, nil
+
+		case wapcutils.KVIncrOperationName:
+			k, delta, err := wapcutils.ExtractIncrPayload(wapcPayload)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting key from INCR payload: %w", err)
+			}
+
+			tr, err := extractTransaction(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting transaction from context: %w", err)
+			}
+
+			value, err := tr.Incr(ctx, k, delta)
+			if err != nil {
+				return nil, fmt.Errorf("error performing INCR against registry: %w", err)
+			}
+			return binary.AppendVarint(nil, value), nil
+
+		case wapcutils.RemainingFuelOperationName:
+			remaining, ok := durablewazero.RemainingFuel(ctx)
+			if !ok {
+				remaining = -1
+			}
+			return binary.AppendVarint(nil, remaining), nil
+
+		case wapcutils.InvokeActorOperationName:
+			var req types.InvokeActorRequest
+			if err := json.Unmarshal(wapcPayload, &req); err != nil {
+				return nil, fmt.Errorf("error unmarshaling InvokeActorRequest: %w", err)
+			}
+
+			return invokeActorFromActor(
+				ctx, environment, actorRef, activations.maxInvocationDepth, req)
+
+		case wapcutils.StreamSendOperationName:
+			return nil, streamSend(ctx, wapcPayload)
+
+		case wapcutils.LogOperationName:
+			var req wapcutils.Log
+			if err := json.Unmarshal(wapcPayload, &req); err != nil {
+				return nil, fmt.Errorf("error unmarshaling Log: %w", err)
+			}
+
+			var args []any
+			err := wapcutils.ExtractKVsFromListPayload(req.KVPairs, func(k, v []byte) error {
+				args = append(args, slog.String(string(k), string(v)))
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("error extracting Log KV pairs: %w", err)
+			}
+
+			host, err := extractHostCapabilities(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting host capabilities from context: %w", err)
+			}
+			host.Log(ctx, slog.Level(req.Level), req.Message, args...)
+
+			return nil, nil
+
+		case wapcutils.GetConfigOperationName:
+			host, err := extractHostCapabilities(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting host capabilities from context: %w", err)
+			}
+
+			v, ok := host.GetConfig(ctx, string(wapcPayload))
+			if !ok {
+				return []byte{0}, nil
+			}
+			resp := make([]byte, 0, len(v)+1)
+			resp = append(resp, 1)
+			resp = append(resp, v...)
+			return resp, nil
+
+		case wapcutils.NewIDOperationName:
+			host, err := extractHostCapabilities(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting host capabilities from context: %w", err)
+			}
+
+			return []byte(host.NewID(ctx)), nil
+
+		case wapcutils.MetricIncOperationName, wapcutils.MetricObserveOperationName:
+			var req wapcutils.Metric
+			if err := json.Unmarshal(wapcPayload, &req); err != nil {
+				return nil, fmt.Errorf("error unmarshaling Metric: %w", err)
+			}
+
+			host, err := extractHostCapabilities(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting host capabilities from context: %w", err)
+			}
+			if wapcOperation == wapcutils.MetricIncOperationName {
+				err = host.MetricInc(ctx, req.Name, req.Value)
+			} else {
+				err = host.MetricObserve(ctx, req.Name, req.Value)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("error emitting metric: %w", err)
+			}
+
+			return nil, nil
+
+		case wapcutils.SelfOperationName:
+			marshaled, err := json.Marshal(wapcutils.Self{
+				Namespace: actorRef.Namespace(),
+				ModuleID:  actorRef.ModuleID().ID,
+				ActorID:   actorRef.ActorID().ID,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("error marshaling Self: %w", err)
+			}
+
+			return marshaled, nil
+
+		case wapcutils.InvocationContextOperationName:
+			operation, _ := ctx.Value(hostFnOperationKey{}).(string)
+			invocationCtx := wapcutils.InvocationContext{Operation: operation}
+			if caller, ok := CallerFromContext(ctx); ok {
+				invocationCtx.CallerNamespace = caller.Namespace
+				invocationCtx.CallerModuleID = caller.ModuleID
+				invocationCtx.CallerActorID = caller.ActorID
+			}
+			if deadline, ok := ctx.Deadline(); ok {
+				invocationCtx.DeadlineUnixMs = deadline.UnixMilli()
+			}
+			marshaled, err := json.Marshal(invocationCtx)
+			if err != nil {
+				return nil, fmt.Errorf("error marshaling InvocationContext: %w", err)
+			}
+
+			return marshaled, nil
+
+		case wapcutils.IsCancelledOperationName:
+			if ctx.Err() != nil {
+				return []byte{1}, nil
+			}
+			return []byte{0}, nil
+
+		case wapcutils.DeactivateSelfOperationName:
+			host, err := extractHostCapabilities(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting host capabilities from context: %w", err)
+			}
+
+			return nil, host.DeactivateSelf(ctx)
+
+		case wapcutils.LastInvokedAtOperationName:
+			host, err := extractHostCapabilities(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting host capabilities from context: %w", err)
+			}
+
+			lastInvokedAt, err := host.LastInvokedAt(ctx)
+			if err != nil {
+				return nil, err
+			}
+			var unixMs int64
+			if !lastInvokedAt.IsZero() {
+				unixMs = lastInvokedAt.UnixMilli()
+			}
+			return binary.BigEndian.AppendUint64(nil, uint64(unixMs)), nil
+
+		case wapcutils.FencingTokenOperationName:
+			host, err := extractHostCapabilities(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting host capabilities from context: %w", err)
+			}
+
+			token, err := host.FencingToken(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return binary.BigEndian.AppendUint64(nil, token), nil
+
+		case wapcutils.HTTPFetchOperationName:
+			var req wapcutils.HTTPFetchRequest
+			if err := json.Unmarshal(wapcPayload, &req); err != nil {
+				return nil, fmt.Errorf("error unmarshaling HTTPFetchRequest: %w", err)
+			}
+
+			host, err := extractHostCapabilities(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting host capabilities from context: %w", err)
+			}
+
+			resp, err := host.HTTPFetch(ctx, req)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(&resp)
+
+		case wapcutils.ScheduleSelfTimerOperationName:
+			var req wapcutils.ScheduleSelfTimer
+			if err := json.Unmarshal(wapcPayload, &req); err != nil {
+				return nil, fmt.Errorf(
+					"error unmarshaling ScheduleSelfTimer: %w, payload: %s",
+					err, string(wapcPayload))
+			}
+			if req.Operation == "" {
+				return nil, fmt.Errorf("cant schedule self timer with empty operation name")
+			}
+			if req.AfterMillis <= 0 {
+				return nil, fmt.Errorf("cant schedule self timer with AfterMillis <= 0")
+			}
+
+			// Copy the payload to make sure its safe to retain across invocations.
+			payloadCopy := make([]byte, len(req.Payload))
+			copy(payloadCopy, req.Payload)
+
+			// TODO: When the actor gets GC'd (which is not currently implemented), this
+			//       timer won't get GC'd with it. We should keep track of all outstanding
+			//       timers with the instantiation and terminate them if the actor is
+			//       killed.
+			time.AfterFunc(time.Duration(req.AfterMillis)*time.Millisecond, func() {
+				// TODO: Fix generation number.
+				reader, err := activations.invoke(context.Background(), actorRef, req.Operation, nil, payloadCopy, true)
+				if err == nil {
+					if reader != nil {
+						// This is weird, but the reader can be nil in the case where the actor the timer is
+						// associated with is no longer activated in memory anymore.
+						//
+						// TestScheduleSelfTimersAndGC intentionally triggers this behavior to ensure that timers
+						// never trigger reactivation of deactivated actors.
+						defer reader.Close()
+					}
+				}
+				if err != nil {
+					log.Printf(
+						"error firing timer for actor %s, err: %v\n", actorRef, err)
+				}
+			})
+
+			return nil, nil
+
+		case wapcutils.RegisterTimerOperationName:
+			var req wapcutils.RegisterTimer
+			if err := json.Unmarshal(wapcPayload, &req); err != nil {
+				return nil, fmt.Errorf(
+					"error unmarshaling RegisterTimer: %w, payload: %s",
+					err, string(wapcPayload))
+			}
+
+			host, err := extractHostCapabilities(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting host capabilities from context: %w", err)
+			}
+			if err := host.RegisterTimer(ctx, req); err != nil {
+				return nil, fmt.Errorf("error registering timer: %w", err)
+			}
+
+			return nil, nil
+
+		case wapcutils.UnregisterTimerOperationName:
+			host, err := extractHostCapabilities(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting host capabilities from context: %w", err)
+			}
+			if err := host.UnregisterTimer(ctx, string(wapcPayload)); err != nil {
+				return nil, fmt.Errorf("error unregistering timer: %w", err)
+			}
+
+			return nil, nil
+
+		default:
+			customFn, ok := customHostFns[wapcOperation]
+			if ok {
+				res, err := customFn(wapcPayload)
+				if err != nil {
+					return nil, fmt.Errorf("error running custom host function: %s, err: %w", wapcOperation, err)
+				}
+				return res, nil
+			}
+			return nil, fmt.Errorf(
+				"unknown host function: %s::%s::%s::%s",
+				wapcBinding, wapcNamespace, wapcOperation, wapcPayload)
+		}
+	})
+}
+
+func extractActorRef(ctx context.Context) (types.ActorReferenceVirtual, error) {
+	actorRefIface := ctx.Value(hostFnActorReferenceCtxKey{})
+	if actorRefIface == nil {
+		return nil, fmt.Errorf("wazeroHostFnRouter: could not find non-empty actor reference in context")
+	}
+	actorRef, ok := actorRefIface.(types.ActorReferenceVirtual)
+	if !ok {
+		return nil, fmt.Errorf("wazeroHostFnRouter: wrong type for actor reference in context: %T", actorRef)
+	}
+	return actorRef, nil
+}
+
+func extractTransaction(ctx context.Context) (registry.ActorKVTransaction, error) {
+	trIface := ctx.Value(hostFnActorTxnKey{})
+	if trIface == nil {
+		return nil, fmt.Errorf("wazeroHostFnRouter: could not find non-empty transaction in context")
+	}
+	tr, ok := trIface.(registry.ActorKVTransaction)
+	if !ok {
+		return nil, fmt.Errorf("wazeroHostFnRouter: wrong type for actor ID in context: %T", trIface)
+	}
+	return tr, nil
+}
+
+func extractHostCapabilities(ctx context.Context) (HostCapabilities, error) {
+	hostIface := ctx.Value(hostFnHostCapabilitiesKey{})
+	if hostIface == nil {
+		return nil, fmt.Errorf("wazeroHostFnRouter: could not find non-empty host capabilities in context")
+	}
+	host, ok := hostIface.(HostCapabilities)
+	if !ok {
+		return nil, fmt.Errorf("wazeroHostFnRouter: wrong type for host capabilities in context: %T", hostIface)
+	}
+	return host, nil
+}
+
+type wasmModule struct {
+	cache *moduleCache
+	cm    *compiledModule
+	// fuelLimit is the amount of fuel available to each invocation, or 0 if
+	// invocations are not limited.
+	fuelLimit int64
+	// fileSystems provides the file systems that are mounted into the WASI context of
+	// each actor.
+	fileSystems *actorFileSystems
+	// recorder records the invocations of the module's actors, or nil if they're not
+	// recorded (see RecordingOptions).
+	recorder Recorder
+}
+
+func (w wasmModule) Instantiate(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	instantiatePayload []byte,
+	host HostCapabilities,
+) (Actor, error) {
+	fsys, releaseFS, ok, err := w.fileSystems.acquire(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		ctx = durable.WithFS(ctx, fsys)
+	} else {
+		releaseFS = func(context.Context) {}
+	}
+
+	obj, err := w.cache.instantiate(ctx, w.cm, reference)
+	if err != nil {
+		releaseFS(ctx)
+		return nil, err
+	}
+
+	onClose := func(ctx context.Context) {
+		w.cache.release(ctx, w.cm)
+		releaseFS(ctx)
+	}
+	return wasmActor{obj, reference, host, w.fuelLimit, onClose, w.recorder}, nil
+}
+
+func (w wasmModule) Close(ctx context.Context) error {
+	return nil
+}
+
+type wasmActor struct {
+	obj       durable.Object
+	reference types.ActorReferenceVirtual
+	host      HostCapabilities
+	fuelLimit int64
+	onClose   func(ctx context.Context)
+	recorder  Recorder
+}
+
+func (w wasmActor) Invoke(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+	transaction registry.ActorKVTransaction,
+) (_ []byte, err error) {
+	ctx, span := startSpan(
+		ctx, "nola.wasm.Invoke",
+		w.reference.Namespace(), w.reference.ModuleID().ID, w.reference.ActorID().ID)
+	span.setString(AttributeOperation, operation)
+	defer func() {
+		span.end(err)
+	}()
+
+	// This is required for modules that are using WASM/wazero so we can propagate
+	// the actor ID to invocations of the host's capabilities. The reason this is
+	// required is that the WAPC implementation we're using defines a host router
+	// per-module instead of per-actor, so we use the context.Context to "smuggle"
+	// the actor ID into each invocation. See newHostFnRouter in wasm.go to see
+	// the implementation.
+	ctx = context.WithValue(ctx, hostFnActorReferenceCtxKey{}, w.reference)
+
+	// This is required for modules that are using WASM/wazero so we can propagate a
+	// per-invocation transaction to the hostFnRouter. The reason this is required is
+	// that the WAPC implementation we're using defines a host router per-module
+	// instead of per-actor or per-invocation, so we use the context.Context to
+	// "smuggle" the actor ID into each invocation. See newHostFnRouter in wasm.go
+	// to see the implementation.
+	ctx = context.WithValue(ctx, hostFnActorTxnKey{}, transaction)
+
+	// Same as above, but for the host capabilities of the actor's activation which are
+	// required to manage its timers.
+	ctx = context.WithValue(ctx, hostFnHostCapabilitiesKey{}, w.host)
+
+	// Same as above, but for the name of the operation so that the actor can retrieve the
+	// metadata of the invocation.
+	ctx = context.WithValue(ctx, hostFnOperationKey{}, operation)
+
+	if w.fuelLimit > 0 {
+		ctx = durablewazero.WithFuel(ctx, w.fuelLimit)
+	}
+
+	if w.recorder != nil {
+		return invokeRecorded(ctx, w.recorder, w.reference, operation, payload,
+			func(ctx context.Context) ([]byte, error) {
+				return w.obj.Invoke(ctx, operation, payload)
+			})
+	}
+	return w.obj.Invoke(ctx, operation, payload)
+}
+
+// memorySize returns the size of the actor's linear memory in bytes.
+func (w wasmActor) memorySize() int64 {
+	if sizer, ok := w.obj.(durable.MemorySizer); ok {
+		return int64(sizer.MemorySize())
+	}
+	return 0
+}
+
+func (w wasmActor) Close(ctx context.Context) error {
+	err := w.obj.Close(ctx)
+	w.onClose(ctx)
+	return err
+}
@@ -0,0 +1,289 @@
+package virtual
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestKVHostFunctionsDeleteAndList tests the KV DELETE and LIST host functions that are
+// exposed to WASM modules, including that they're rolled back with the invocation's
+// transaction.
+func TestKVHostFunctionsDeleteAndList(t *testing.T) {
+	var (
+		ctx = context.Background()
+		reg = localregistry.NewLocalRegistry()
+	)
+	_, err := reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+	heartbeatResult, err := reg.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	_, err = reg.EnsureActivation(ctx, "ns-1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+
+	router := newHostFnRouter(reg, nil, nil, nil)
+	invoke := func(fn func(call func(operation string, payload []byte) []byte), commit bool) {
+		tr, err := reg.BeginTransaction(ctx, "ns-1", "a", "test-module", "server1", heartbeatResult.ServerVersion)
+		require.NoError(t, err)
+		invokeCtx := context.WithValue(ctx, hostFnActorReferenceCtxKey{}, ref)
+		invokeCtx = context.WithValue(invokeCtx, hostFnActorTxnKey{}, tr)
+		fn(func(operation string, payload []byte) []byte {
+			resp, err := router(invokeCtx, "", "", operation, payload)
+			require.NoError(t, err)
+			return resp
+		})
+		if commit {
+			require.NoError(t, tr.Commit(ctx))
+		} else {
+			require.NoError(t, tr.Cancel(ctx))
+		}
+	}
+	list := func(call func(operation string, payload []byte) []byte, prefix string) []string {
+		var kvs []string
+		resp := call(wapcutils.KVListOperationName, []byte(prefix))
+		err := wapcutils.ExtractKVsFromListPayload(resp, func(k, v []byte) error {
+			kvs = append(kvs, fmt.Sprintf("%s=%s", k, v))
+			return nil
+		})
+		require.NoError(t, err)
+		return kvs
+	}
+
+	invoke(func(call func(operation string, payload []byte) []byte) {
+		for _, k := range []string{"b-1", "a-2", "a-1"} {
+			call(wapcutils.KVPutOperationName, wapcutils.EncodePutPayload(nil, []byte(k), []byte("v"+k)))
+		}
+		require.Equal(t, []string{"a-1=va-1", "a-2=va-2"}, list(call, "a-"))
+	}, true)
+
+	// Deletes are rolled back if the transaction is canceled.
+	invoke(func(call func(operation string, payload []byte) []byte) {
+		call(wapcutils.KVDeleteOperationName, []byte("a-1"))
+		require.Equal(t, []byte{0}, call(wapcutils.KVGetOperationName, []byte("a-1")))
+		require.Equal(t, []string{"a-2=va-2", "b-1=vb-1"}, list(call, ""))
+	}, false)
+
+	invoke(func(call func(operation string, payload []byte) []byte) {
+		require.Equal(t, []string{"a-1=va-1", "a-2=va-2", "b-1=vb-1"}, list(call, ""))
+		call(wapcutils.KVDeleteOperationName, []byte("a-1"))
+	}, true)
+
+	invoke(func(call func(operation string, payload []byte) []byte) {
+		require.Equal(t, []string{"a-2=va-2"}, list(call, "a-"))
+		require.Empty(t, list(call, "c-"))
+	}, true)
+}
+
+// TestKVHostFunctionsVersions tests the KV GET-WITH-VERSION and PUT-IF-VERSION host
+// functions that allow WASM modules to implement compare-and-swap on their state.
+func TestKVHostFunctionsVersions(t *testing.T) {
+	var (
+		ctx = context.Background()
+		reg = localregistry.NewLocalRegistry()
+	)
+	_, err := reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+	heartbeatResult, err := reg.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	_, err = reg.EnsureActivation(ctx, "ns-1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+
+	tr, err := reg.BeginTransaction(ctx, "ns-1", "a", "test-module", "server1", heartbeatResult.ServerVersion)
+	require.NoError(t, err)
+	invokeCtx := context.WithValue(ctx, hostFnActorReferenceCtxKey{}, ref)
+	invokeCtx = context.WithValue(invokeCtx, hostFnActorTxnKey{}, tr)
+	router := newHostFnRouter(reg, nil, nil, nil)
+	call := func(operation string, payload []byte) []byte {
+		resp, err := router(invokeCtx, "", "", operation, payload)
+		require.NoError(t, err)
+		return resp
+	}
+	getWithVersion := func() ([]byte, int64, bool) {
+		v, version, ok, err := wapcutils.ExtractGetWithVersionResponse(
+			call(wapcutils.KVGetWithVersionOperationName, []byte("k")))
+		require.NoError(t, err)
+		return v, version, ok
+	}
+	putIfVersion := func(value string, expectedVersion int64) []byte {
+		return call(wapcutils.KVPutIfVersionOperationName,
+			wapcutils.EncodePutIfVersionPayload(nil, []byte("k"), []byte(value), expectedVersion))
+	}
+
+	_, version, ok := getWithVersion()
+	require.False(t, ok)
+	require.Equal(t, int64(0), version)
+	require.Equal(t, []byte{1}, putIfVersion("v1", 0))
+	require.Equal(t, []byte{0}, putIfVersion("v2", 0))
+
+	v, version, ok := getWithVersion()
+	require.True(t, ok)
+	require.Equal(t, "v1", string(v))
+	require.Equal(t, []byte{1}, putIfVersion("v2", version))
+	require.Equal(t, []byte{0}, putIfVersion("v3", version))
+	v, _, _ = getWithVersion()
+	require.Equal(t, "v2", string(v))
+	require.NoError(t, tr.Commit(ctx))
+}
+
+// TestKVHostFunctionsIncr ensures that WASM modules can increment counters atomically.
+func TestKVHostFunctionsIncr(t *testing.T) {
+	var (
+		ctx = context.Background()
+		reg = localregistry.NewLocalRegistry()
+	)
+	_, err := reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+	heartbeatResult, err := reg.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	_, err = reg.EnsureActivation(ctx, "ns-1", "a", "test-module", registry.EnsureActivationOptions{})
+	require.NoError(t, err)
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+
+	tr, err := reg.BeginTransaction(ctx, "ns-1", "a", "test-module", "server1", heartbeatResult.ServerVersion)
+	require.NoError(t, err)
+	invokeCtx := context.WithValue(ctx, hostFnActorReferenceCtxKey{}, ref)
+	invokeCtx = context.WithValue(invokeCtx, hostFnActorTxnKey{}, tr)
+	router := newHostFnRouter(reg, nil, nil, nil)
+	incr := func(delta int64) int64 {
+		resp, err := router(
+			invokeCtx, "", "", wapcutils.KVIncrOperationName,
+			wapcutils.EncodeIncrPayload(nil, []byte("k"), delta))
+		require.NoError(t, err)
+		value, n := binary.Varint(resp)
+		require.Equal(t, len(resp), n)
+		return value
+	}
+
+	require.Equal(t, int64(2), incr(2))
+	require.Equal(t, int64(-1), incr(-3))
+	resp, err := router(invokeCtx, "", "", wapcutils.KVGetOperationName, []byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, byte(1), resp[0])
+	value, err := wapcutils.DecodeCounter(resp[1:])
+	require.NoError(t, err)
+	require.Equal(t, int64(-1), value)
+
+	_, err = router(invokeCtx, "", "", wapcutils.KVIncrOperationName, nil)
+	require.Error(t, err)
+	require.NoError(t, tr.Commit(ctx))
+}
+
+// TestIdentityHostFunctions tests the SELF and INVOCATION-CONTEXT host functions that
+// expose the identity of the actor and the metadata of the current invocation to WASM
+// modules.
+func TestIdentityHostFunctions(t *testing.T) {
+	ctx := context.Background()
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+	router := newHostFnRouter(nil, nil, nil, nil)
+	call := func(ctx context.Context, operation string, v any) {
+		ctx = context.WithValue(ctx, hostFnActorReferenceCtxKey{}, ref)
+		resp, err := router(ctx, "", "", operation, nil)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(resp, v))
+	}
+
+	var self wapcutils.Self
+	call(ctx, wapcutils.SelfOperationName, &self)
+	require.Equal(t, wapcutils.Self{Namespace: "ns-1", ModuleID: "test-module", ActorID: "a"}, self)
+
+	// Invocations that are not made by another actor and have no deadline.
+	var invocationCtx wapcutils.InvocationContext
+	call(
+		context.WithValue(ctx, hostFnOperationKey{}, "inc"),
+		wapcutils.InvocationContextOperationName, &invocationCtx)
+	require.Equal(t, wapcutils.InvocationContext{Operation: "inc"}, invocationCtx)
+
+	caller, err := types.NewVirtualActorReference("ns-1", "caller-module", "b", 1)
+	require.NoError(t, err)
+	callerCtx, err := withCaller(ctx, caller, 10)
+	require.NoError(t, err)
+	deadline := time.Now().Add(time.Minute)
+	callerCtx, cc := context.WithDeadline(callerCtx, deadline)
+	defer cc()
+	invocationCtx = wapcutils.InvocationContext{}
+	call(
+		context.WithValue(callerCtx, hostFnOperationKey{}, "getCount"),
+		wapcutils.InvocationContextOperationName, &invocationCtx)
+	require.Equal(t, wapcutils.InvocationContext{
+		Operation:       "getCount",
+		CallerNamespace: "ns-1",
+		CallerModuleID:  "caller-module",
+		CallerActorID:   "b",
+		DeadlineUnixMs:  deadline.UnixMilli(),
+	}, invocationCtx)
+}
+
+// TestIsCancelledHostFunction tests the IS-CANCELLED host function that lets WASM modules
+// abort invocations that have been canceled.
+func TestIsCancelledHostFunction(t *testing.T) {
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+	router := newHostFnRouter(nil, nil, nil, nil)
+	ctx, cc := context.WithCancel(
+		context.WithValue(context.Background(), hostFnActorReferenceCtxKey{}, ref))
+	resp, err := router(ctx, "", "", wapcutils.IsCancelledOperationName, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0}, resp)
+
+	cc()
+	resp, err = router(ctx, "", "", wapcutils.IsCancelledOperationName, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, resp)
+}
+
+// TestDeactivateSelfHostFunction ensures that the DEACTIVATE-SELF host function requests
+// the deactivation of the actor that is being invoked.
+func TestDeactivateSelfHostFunction(t *testing.T) {
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+	router := newHostFnRouter(nil, nil, nil, nil)
+	ctx := context.WithValue(context.Background(), hostFnActorReferenceCtxKey{}, ref)
+	ctx = context.WithValue(ctx, hostFnHostCapabilitiesKey{}, &hostCapabilities{})
+	_, err = router(ctx, "", "", wapcutils.DeactivateSelfOperationName, nil)
+	require.Error(t, err)
+
+	deactivation := &selfDeactivation{}
+	_, err = router(
+		withSelfDeactivation(ctx, deactivation), "", "", wapcutils.DeactivateSelfOperationName, nil)
+	require.NoError(t, err)
+	require.True(t, deactivation.requested.Load())
+}
+
+// TestLastInvokedAtHostFunction ensures that the LAST-INVOKED-AT host function returns the
+// time at which the previous invocation of the actor started.
+func TestLastInvokedAtHostFunction(t *testing.T) {
+	ref, err := types.NewVirtualActorReference("ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+	router := newHostFnRouter(nil, nil, nil, nil)
+	ctx := context.WithValue(context.Background(), hostFnActorReferenceCtxKey{}, ref)
+	ctx = context.WithValue(ctx, hostFnHostCapabilitiesKey{}, &hostCapabilities{})
+	_, err = router(ctx, "", "", wapcutils.LastInvokedAtOperationName, nil)
+	require.Error(t, err)
+
+	resp, err := router(
+		withLastInvokedAt(ctx, time.Time{}), "", "", wapcutils.LastInvokedAtOperationName, nil)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, 8), resp)
+
+	lastInvokedAt := time.UnixMilli(1700000000123)
+	resp, err = router(
+		withLastInvokedAt(ctx, lastInvokedAt), "", "", wapcutils.LastInvokedAtOperationName, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(lastInvokedAt.UnixMilli()), binary.BigEndian.Uint64(resp))
+}
@@ -0,0 +1,56 @@
+//go:build (amd64 || arm64) && !windows && cgo && !wasmtime
+
+package virtual
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/richardartoul/nola/durable/durablewasmer"
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/registry/localregistry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestWasmerRuntime ensures that WASM actors (including their host functions) work
+// with the wasmer runtime and that modules that require features wasmer doesn't
+// support fail to load.
+func TestWasmerRuntime(t *testing.T) {
+	var (
+		reg = localregistry.NewLocalRegistry()
+		ctx = context.Background()
+	)
+	opts := defaultOptsWASM
+	opts.Discovery.Port = 9
+	opts.WASMRuntime = durablewasmer.NewRuntime()
+	opts.Fuel.NamespaceLimits = map[string]int64{"ns-fuel": 1_000_000}
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	for _, ns := range []string{"ns-1", "ns-fuel"} {
+		_, err = reg.RegisterModule(ctx, ns, "test-module", utilWasmBytes, registry.ModuleOptions{})
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < 10; i++ {
+		result, err := env.InvokeActor(ctx, "ns-1", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		require.Equal(t, int64(i+1), getCount(t, result))
+
+		// Exercise the KV host functions.
+		key := []byte(fmt.Sprintf("key-%d", i))
+		_, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "kvPutCount", key, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		result, err = env.InvokeActor(ctx, "ns-1", "a", "test-module", "kvGet", key, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		require.Equal(t, int64(i+1), getCount(t, result))
+	}
+
+	// Fuel metering requires interrupts which wasmer does not support.
+	_, err = env.InvokeActor(ctx, "ns-fuel", "a", "test-module", "inc", nil, types.CreateIfNotExist{})
+	require.True(t, durablewasmer.IsUnsupportedCompileOptionErr(err))
+}
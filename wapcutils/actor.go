@@ -23,3 +23,171 @@ type ScheduleSelfTimer struct {
 	Payload     []byte `json:"payload"`
 	AfterMillis int    `json:"after_millis"`
 }
+
+// RegisterTimer is the JSON struct that represents a request from an actor to register
+// an in-memory timer on its current activation.
+type RegisterTimer struct {
+	// Name is the name of the timer. Registering a timer with the same name as an
+	// existing one replaces it.
+	Name string `json:"name"`
+	// DueMillis is the number of milliseconds after which the timer will fire for the
+	// first time.
+	DueMillis int `json:"due_millis"`
+	// PeriodMillis is the number of milliseconds between subsequent firings of the timer.
+	// A value of 0 indicates the timer only fires once.
+	PeriodMillis int `json:"period_millis"`
+}
+
+// Log is the JSON struct that represents a request from an actor to log a message to the
+// server's logger.
+type Log struct {
+	// Level is the severity of the message. It uses the same values as slog.Level: -4 for
+	// debug, 0 for info, 4 for warn and 8 for error. Messages below the level of the
+	// server's logger are dropped.
+	Level int `json:"level"`
+	// Message is the message to log.
+	Message string `json:"message"`
+	// KVPairs contains structured fields to attach to the message, encoded with
+	// AppendKVListEntry.
+	KVPairs []byte `json:"kv_pairs"`
+}
+
+// Metric is the JSON struct that represents a request from an actor to emit a custom
+// metric.
+type Metric struct {
+	// Name is the name of the metric.
+	Name string `json:"name"`
+	// Value is the delta to increment a counter by, or the value to record in a
+	// distribution.
+	Value float64 `json:"value"`
+}
+
+// HTTPFetchRequest is the JSON struct that represents a request from an actor to make an
+// HTTP request on its behalf (see HTTPFetchOperationName).
+type HTTPFetchRequest struct {
+	// Method is the HTTP method of the request. An empty value indicates GET.
+	Method string `json:"method,omitempty"`
+	// URL is the absolute http or https URL of the request. Its host must be allowed for
+	// the actor's namespace.
+	URL string `json:"url"`
+	// Header contains the headers of the request.
+	Header map[string][]string `json:"header,omitempty"`
+	// Body is the body of the request.
+	Body []byte `json:"body,omitempty"`
+}
+
+// HTTPFetchResponse is the JSON struct that is returned by the HTTPFetchOperationName
+// host function. Responses with any status code are returned, it's up to the actor to
+// decide which ones are errors.
+type HTTPFetchResponse struct {
+	StatusCode int                 `json:"status_code"`
+	Header     map[string][]string `json:"header,omitempty"`
+	Body       []byte              `json:"body,omitempty"`
+}
+
+// Self is the JSON struct that is returned by the SelfOperationName host function. It
+// identifies the calling actor.
+type Self struct {
+	Namespace string `json:"namespace"`
+	ModuleID  string `json:"module_id"`
+	ActorID   string `json:"actor_id"`
+}
+
+// InvocationContext is the JSON struct that is returned by the
+// InvocationContextOperationName host function. It contains the metadata of the current
+// invocation.
+type InvocationContext struct {
+	// Operation is the name of the operation that is being invoked.
+	Operation string `json:"operation"`
+	// CallerNamespace, CallerModuleID and CallerActorID identify the actor that made
+	// the invocation. They're empty if the invocation was not made by another actor
+	// (for example, if it was made by an external client or a timer).
+	CallerNamespace string `json:"caller_namespace,omitempty"`
+	CallerModuleID  string `json:"caller_module_id,omitempty"`
+	CallerActorID   string `json:"caller_actor_id,omitempty"`
+	// DeadlineUnixMs is the time by which the invocation must complete, in milliseconds
+	// since the unix epoch, or 0 if it has no deadline.
+	DeadlineUnixMs int64 `json:"deadline_unix_ms,omitempty"`
+}
+
+// ReceiveTimerRequest is the JSON struct that is provided as the payload of the
+// ReceiveTimerOperationName operation when one of an actor's timers fires.
+type ReceiveTimerRequest struct {
+	// Name is the name of the timer that fired.
+	Name string `json:"name"`
+}
+
+// ReceiveReminderRequest is the JSON struct that is provided as the payload of the
+// ReceiveReminderOperationName operation when one of an actor's reminders fires.
+type ReceiveReminderRequest struct {
+	// Name is the name of the reminder that fired.
+	Name string `json:"name"`
+	// DueTimeUnixMicros is the time at which the reminder was due, in microseconds since
+	// the unix epoch. It may be earlier than the time at which the reminder fired if the
+	// reminder was delayed.
+	DueTimeUnixMicros int64 `json:"due_time_unix_micros"`
+	// PeriodMillis is the period of the reminder, or 0 if the reminder only fires once.
+	PeriodMillis int64 `json:"period_millis"`
+}
+
+// ModuleDescription is the JSON struct that is returned by the DescribeOperationName
+// operation of modules that describe the operations that their actors support.
+type ModuleDescription struct {
+	// Operations contains the operations that the module's actors support. Operations
+	// that are invoked by the host, like StartupOperationName, don't have to be listed.
+	Operations []OperationDescription `json:"operations"`
+	// SubscribeMembershipChanges indicates that the module's actors want to be notified
+	// of changes to the set of servers in the cluster with the
+	// MembershipChangeOperationName operation (see MembershipOptions in the virtual
+	// package).
+	SubscribeMembershipChanges bool `json:"subscribe_membership_changes,omitempty"`
+}
+
+// MembershipChange is the JSON struct that is provided as the payload of the
+// MembershipChangeOperationName operation.
+type MembershipChange struct {
+	// Servers contains the servers that are currently alive, sorted by ServerID.
+	Servers []MembershipServer `json:"servers"`
+	// Joined and Left contain the IDs of the servers that joined and left the cluster
+	// since the previous notification. They're empty in the notification that actors
+	// receive when they're activated, which only contains the current Servers.
+	Joined []string `json:"joined,omitempty"`
+	Left   []string `json:"left,omitempty"`
+}
+
+// MembershipServer is a server in a MembershipChange.
+type MembershipServer struct {
+	ServerID string `json:"server_id"`
+	Address  string `json:"address"`
+}
+
+// OperationDescription describes one of the operations that a module's actors support.
+type OperationDescription struct {
+	// Name is the name of the operation.
+	Name string `json:"name"`
+	// Doc is a human readable description of the operation.
+	Doc string `json:"doc,omitempty"`
+	// Input describes the payload of the operation.
+	Input PayloadDescriptor `json:"input"`
+	// Output describes the response of the operation.
+	Output PayloadDescriptor `json:"output"`
+	// CacheTTLMillis enables response caching for the operation (see ResponseCacheOptions
+	// in the virtual package): its responses are remembered by every activation for this
+	// many milliseconds, keyed by a hash of the payload, and returned without invoking the
+	// actor again. It must only be set for operations that don't modify the actor's state.
+	CacheTTLMillis int64 `json:"cache_ttl_millis,omitempty"`
+	// Mutates indicates that the operation modifies the actor's state, so its responses
+	// are never cached and invoking it invalidates the responses that the actor's
+	// activation has cached.
+	Mutates bool `json:"mutates,omitempty"`
+}
+
+// PayloadDescriptor describes the payload (or the response) of an operation.
+type PayloadDescriptor struct {
+	// ContentType is the encoding of the payload, for example "application/json". An
+	// empty value indicates the payload is opaque bytes.
+	ContentType string `json:"content_type,omitempty"`
+	// Schema describes the structure of the payload, for example with a JSON schema. Its
+	// format depends on ContentType.
+	Schema string `json:"schema,omitempty"`
+}
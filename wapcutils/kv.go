@@ -40,3 +40,134 @@ func EncodePutPayload(dst []byte, key, value []byte) []byte {
 	dst = append(dst, value...)
 	return dst
 }
+
+// EncodePutIfVersionPayload encodes the provided KV pair and expected version into dst
+// (returning a possible re-allocated byte slice) such that it can be decoded by
+// ExtractPutIfVersionPayload.
+func EncodePutIfVersionPayload(dst []byte, key, value []byte, expectedVersion int64) []byte {
+	dst = binary.AppendVarint(dst[:0], expectedVersion)
+	dst = binary.AppendVarint(dst, int64(len(key)))
+	dst = append(dst, key...)
+	dst = append(dst, value...)
+	return dst
+}
+
+// ExtractPutIfVersionPayload extracts the KV pair and expected version encoded by
+// EncodePutIfVersionPayload.
+func ExtractPutIfVersionPayload(payload []byte) ([]byte, []byte, int64, error) {
+	expectedVersion, n := binary.Varint(payload)
+	if n <= 0 {
+		return nil, nil, 0, errors.New(
+			"malformed PUT-IF-VERSION payload, unable to parse expected version varint")
+	}
+	k, v, err := ExtractKVFromPutPayload(payload[n:])
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return k, v, expectedVersion, nil
+}
+
+// EncodeIncrPayload encodes the provided key and delta into dst (returning a possible
+// re-allocated byte slice) such that they can be decoded by ExtractIncrPayload.
+func EncodeIncrPayload(dst []byte, key []byte, delta int64) []byte {
+	dst = binary.AppendVarint(dst[:0], delta)
+	dst = append(dst, key...)
+	return dst
+}
+
+// ExtractIncrPayload extracts the key and delta encoded by EncodeIncrPayload.
+func ExtractIncrPayload(payload []byte) ([]byte, int64, error) {
+	delta, n := binary.Varint(payload)
+	if n <= 0 {
+		return nil, 0, errors.New("malformed INCR payload, unable to parse delta varint")
+	}
+	return payload[n:], delta, nil
+}
+
+// EncodeCounter encodes the value of a counter that is incremented with KV INCR the same
+// way that the host stores it, which is an 8 byte little endian two's complement integer.
+func EncodeCounter(value int64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(value))
+}
+
+// DecodeCounter decodes the value of a counter encoded by EncodeCounter, for example one
+// that was read with KV GET.
+func DecodeCounter(b []byte) (int64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("malformed counter, expected 8 bytes but got: %d", len(b))
+	}
+	return int64(binary.LittleEndian.Uint64(b)), nil
+}
+
+// EncodeGetWithVersionResponse encodes the result of a KV GET-WITH-VERSION into dst
+// (returning a possible re-allocated byte slice) such that it can be decoded by
+// ExtractGetWithVersionResponse. The response is a 0 byte if the key doesn't exist,
+// otherwise it's a 1 byte followed by the version encoded as a varint and the value.
+func EncodeGetWithVersionResponse(dst []byte, value []byte, version int64, ok bool) []byte {
+	if !ok {
+		return append(dst[:0], 0)
+	}
+	dst = append(dst[:0], 1)
+	dst = binary.AppendVarint(dst, version)
+	dst = append(dst, value...)
+	return dst
+}
+
+// ExtractGetWithVersionResponse extracts the value, its version and whether the key
+// exists from a response encoded by EncodeGetWithVersionResponse.
+func ExtractGetWithVersionResponse(payload []byte) ([]byte, int64, bool, error) {
+	if len(payload) == 0 {
+		return nil, 0, false, errors.New("malformed GET-WITH-VERSION response, empty")
+	}
+	if payload[0] == 0 {
+		return nil, 0, false, nil
+	}
+	version, n := binary.Varint(payload[1:])
+	if n <= 0 {
+		return nil, 0, false, errors.New(
+			"malformed GET-WITH-VERSION response, unable to parse version varint")
+	}
+	return payload[1+n:], version, true, nil
+}
+
+// AppendKVListEntry appends the provided KV pair to dst (returning a possible re-allocated
+// byte slice) such that a sequence of pairs can be decoded by ExtractKVsFromListPayload.
+func AppendKVListEntry(dst []byte, key, value []byte) []byte {
+	dst = binary.AppendVarint(dst, int64(len(key)))
+	dst = append(dst, key...)
+	dst = binary.AppendVarint(dst, int64(len(value)))
+	dst = append(dst, value...)
+	return dst
+}
+
+// ExtractKVsFromListPayload calls fn with every KV pair encoded in payload by
+// AppendKVListEntry, in order. The provided slices alias payload.
+func ExtractKVsFromListPayload(payload []byte, fn func(k, v []byte) error) error {
+	for len(payload) > 0 {
+		k, rest, err := extractLengthPrefixed(payload)
+		if err != nil {
+			return fmt.Errorf("malformed LIST payload, error extracting key: %w", err)
+		}
+		v, rest, err := extractLengthPrefixed(rest)
+		if err != nil {
+			return fmt.Errorf("malformed LIST payload, error extracting value: %w", err)
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+		payload = rest
+	}
+	return nil
+}
+
+func extractLengthPrefixed(b []byte) ([]byte, []byte, error) {
+	l, n := binary.Varint(b)
+	if n <= 0 {
+		return nil, nil, errors.New("unable to parse length varint")
+	}
+	if l < 0 || l > int64(len(b)-n) {
+		return nil, nil, fmt.Errorf("length: %d > remaining: %d", l, len(b)-n)
+	}
+	end := n + int(l)
+	return b[n:end], b[end:], nil
+}
@@ -14,3 +14,68 @@ func TestRoundtrip(t *testing.T) {
 	require.Equal(t, k, eK)
 	require.Equal(t, v, eV)
 }
+
+func TestListRoundtrip(t *testing.T) {
+	var (
+		keys    = [][]byte{[]byte("key1"), []byte("key2"), []byte("key3")}
+		values  = [][]byte{[]byte("val1"), nil, []byte("val3")}
+		encoded []byte
+	)
+	for i := range keys {
+		encoded = AppendKVListEntry(encoded, keys[i], values[i])
+	}
+
+	var i int
+	err := ExtractKVsFromListPayload(encoded, func(k, v []byte) error {
+		require.Equal(t, keys[i], k)
+		require.Equal(t, len(values[i]), len(v))
+		i++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(keys), i)
+
+	require.NoError(t, ExtractKVsFromListPayload(nil, func(k, v []byte) error {
+		panic("should not be called")
+	}))
+	require.Error(t, ExtractKVsFromListPayload(encoded[:len(encoded)-1], func(k, v []byte) error {
+		return nil
+	}))
+}
+
+func TestVersionRoundtrip(t *testing.T) {
+	k, v := []byte("key1"), []byte("val1")
+	eK, eV, eVersion, err := ExtractPutIfVersionPayload(EncodePutIfVersionPayload(nil, k, v, 42))
+	require.NoError(t, err)
+	require.Equal(t, k, eK)
+	require.Equal(t, v, eV)
+	require.Equal(t, int64(42), eVersion)
+
+	eV, eVersion, ok, err := ExtractGetWithVersionResponse(EncodeGetWithVersionResponse(nil, v, 42, true))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, v, eV)
+	require.Equal(t, int64(42), eVersion)
+
+	_, _, ok, err = ExtractGetWithVersionResponse(EncodeGetWithVersionResponse(nil, nil, 0, false))
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, _, _, err = ExtractGetWithVersionResponse(nil)
+	require.Error(t, err)
+}
+
+func TestIncrRoundtrip(t *testing.T) {
+	k := []byte("key1")
+	eK, eDelta, err := ExtractIncrPayload(EncodeIncrPayload(nil, k, -42))
+	require.NoError(t, err)
+	require.Equal(t, k, eK)
+	require.Equal(t, int64(-42), eDelta)
+	_, _, err = ExtractIncrPayload(nil)
+	require.Error(t, err)
+
+	value, err := DecodeCounter(EncodeCounter(-7))
+	require.NoError(t, err)
+	require.Equal(t, int64(-7), value)
+	_, err = DecodeCounter([]byte("7"))
+	require.Error(t, err)
+}
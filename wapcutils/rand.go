@@ -0,0 +1,12 @@
+package wapcutils
+
+import "math/rand"
+
+// NewSeededRand returns a source of pseudo-random numbers that always produces the same
+// sequence for the same seed (unlike the global functions of math/rand, which are seeded
+// randomly), so actors can use it for randomness that must be reproducible (for example
+// in tests or when replaying invocations). Actors that need unique IDs should use the
+// NewIDOperationName host function instead.
+func NewSeededRand(seed int64) *rand.Rand {
+	return rand.New(rand.NewSource(seed))
+}
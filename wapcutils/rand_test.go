@@ -0,0 +1,15 @@
+package wapcutils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSeededRand(t *testing.T) {
+	a, b := NewSeededRand(1), NewSeededRand(1)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, a.Int63(), b.Int63())
+	}
+	require.NotEqual(t, NewSeededRand(1).Int63(), NewSeededRand(2).Int63())
+}
@@ -5,6 +5,29 @@ const (
 	KVPutOperationName = "KV-PUT"
 	// KVGetOperationName is the string that indicates the operation in WAPC is a KV GET.
 	KVGetOperationName = "KV-GET"
+	// KVDeleteOperationName is the string that indicates the operation in WAPC is a KV
+	// DELETE.
+	KVDeleteOperationName = "KV-DELETE"
+	// KVListOperationName is the string that indicates the operation in WAPC is a KV LIST,
+	// which returns all the KV pairs whose key begins with the provided prefix, sorted by
+	// key. The response is encoded with AppendKVListEntry.
+	KVListOperationName = "KV-LIST"
+	// KVGetWithVersionOperationName is the string that indicates the operation in WAPC is
+	// a KV GET that also returns the version of the value. The payload is the key. The
+	// response is encoded with EncodeGetWithVersionResponse.
+	KVGetWithVersionOperationName = "KV-GET-WITH-VERSION"
+	// KVPutIfVersionOperationName is the string that indicates the operation in WAPC is a
+	// KV PUT that only succeeds if the current version of the key matches the expected
+	// one. The payload is encoded with EncodePutIfVersionPayload. The response is a single
+	// byte that is 1 if the value was stored and 0 otherwise.
+	KVPutIfVersionOperationName = "KV-PUT-IF-VERSION"
+	// KVIncrOperationName is the string that indicates the operation in WAPC is a KV INCR,
+	// which atomically adds a delta to the counter at a key (a missing key is a counter
+	// with a value of 0) as part of the invocation's transaction. The payload is encoded
+	// with EncodeIncrPayload. The response is the new value of the counter encoded as a
+	// varint. Counters are stored as values encoded with EncodeCounter, so they can be read
+	// with KV GET and decoded with DecodeCounter as well.
+	KVIncrOperationName = "KV-INCR"
 	// CreateActorOperationName is the string that indicates the operation in WAPC is to
 	// create a new actor.
 	CreateActorOperationName = "CREATE-ACTOR"
@@ -22,4 +45,101 @@ const (
 	// ScheduleSelfTimerOperationName is the string that indicates the operation in WAPC is to schedule
 	// a self timer.
 	ScheduleSelfTimerOperationName = "SCHEDULE-SELF-TIMER"
+	// RegisterTimerOperationName is the string that indicates the operation in WAPC is to
+	// register an in-memory timer on the calling actor's activation. The payload is a JSON
+	// encoded RegisterTimer.
+	RegisterTimerOperationName = "REGISTER-TIMER"
+	// UnregisterTimerOperationName is the string that indicates the operation in WAPC is to
+	// cancel one of the calling actor's timers. The payload is the name of the timer.
+	UnregisterTimerOperationName = "UNREGISTER-TIMER"
+	// StreamSendOperationName is the string that indicates the operation in WAPC is to
+	// send a chunk of the response of the current invocation to the caller.
+	StreamSendOperationName = "STREAM-SEND"
+	// RemainingFuelOperationName is the string that indicates the operation in WAPC is to
+	// retrieve the amount of fuel remaining for the current invocation. The response is the
+	// remaining fuel encoded as a varint, or -1 if the invocation's fuel is not limited.
+	RemainingFuelOperationName = "REMAINING-FUEL"
+	// LogOperationName is the string that indicates the operation in WAPC is to log a
+	// message to the server's logger. The payload is a JSON encoded Log.
+	LogOperationName = "LOG"
+	// MetricIncOperationName is the string that indicates the operation in WAPC is to
+	// increment one of the actor's custom counters. The payload is a JSON encoded Metric.
+	MetricIncOperationName = "METRIC-INC"
+	// MetricObserveOperationName is the string that indicates the operation in WAPC is to
+	// record a value in one of the actor's custom distributions. The payload is a JSON
+	// encoded Metric.
+	MetricObserveOperationName = "METRIC-OBSERVE"
+	// GetConfigOperationName is the string that indicates the operation in WAPC is to
+	// retrieve the value of a key in the configuration of the actor's namespace. The
+	// payload is the key. The response is a 0 byte if the key doesn't exist, otherwise
+	// it's a 1 byte followed by the value.
+	GetConfigOperationName = "GET-CONFIG"
+	// NewIDOperationName is the string that indicates the operation in WAPC is to generate
+	// a new ULID on the host (see HostCapabilities.NewID in the virtual package). The
+	// response is the ULID.
+	NewIDOperationName = "NEW-ID"
+	// SelfOperationName is the string that indicates the operation in WAPC is to retrieve
+	// the identity of the calling actor. The response is a JSON encoded Self.
+	SelfOperationName = "SELF"
+	// InvocationContextOperationName is the string that indicates the operation in WAPC is
+	// to retrieve the metadata of the current invocation. The response is a JSON encoded
+	// InvocationContext.
+	InvocationContextOperationName = "INVOCATION-CONTEXT"
+	// IsCancelledOperationName is the string that indicates the operation in WAPC is to check
+	// whether the current invocation has been canceled, for example because the client that
+	// made it canceled its request or its deadline was exceeded. The response is a single
+	// byte that is 1 if it has been canceled and 0 otherwise. Long-running invocations can
+	// use it to abort early.
+	IsCancelledOperationName = "IS-CANCELLED"
+	// DeactivateSelfOperationName is the string that indicates the operation in WAPC is to
+	// request that the calling actor is deactivated once the current invocation returns,
+	// running its deactivation hooks. Subsequent invocations activate it again from
+	// scratch, so actors can use it to release their memory once they know they're done.
+	DeactivateSelfOperationName = "DEACTIVATE-SELF"
+	// FencingTokenOperationName is the string that indicates the operation in WAPC is to
+	// retrieve the fencing token of the calling actor's activation lease (see
+	// HostCapabilities.FencingToken in the virtual package). The response is the token
+	// encoded as an 8 byte big endian uint64.
+	FencingTokenOperationName = "FENCING-TOKEN"
+	// LastInvokedAtOperationName is the string that indicates the operation in WAPC is to
+	// retrieve the time at which the previous invocation of the calling actor's activation
+	// started (see HostCapabilities.LastInvokedAt in the virtual package). The response is
+	// the time in milliseconds since the unix epoch encoded as an 8 byte big endian int64,
+	// which is 0 if the current invocation is the first one of the activation.
+	LastInvokedAtOperationName = "LAST-INVOKED-AT"
+	// HTTPFetchOperationName is the string that indicates the operation in WAPC is to make
+	// an HTTP request from the host on behalf of the calling actor (see
+	// HostCapabilities.HTTPFetch in the virtual package). The payload is a JSON encoded
+	// HTTPFetchRequest and the response is a JSON encoded HTTPFetchResponse.
+	HTTPFetchOperationName = "HTTP-FETCH"
+	// ReceiveReminderOperationName is the name of the operation that is invoked on an actor
+	// when one of its reminders fires. The payload is a JSON encoded ReceiveReminderRequest.
+	ReceiveReminderOperationName = "receiveReminder"
+	// ReceiveTimerOperationName is the name of the operation that is invoked on an actor
+	// when one of its timers fires. The payload is a JSON encoded ReceiveTimerRequest.
+	ReceiveTimerOperationName = "receiveTimer"
+	// SnapshotOperationName is the name of the operation that is invoked on an actor when
+	// it's handed off to another server (see HandoffOptions in the virtual package). The
+	// response is the serialized in-memory state of the actor, which is passed to the
+	// RestoreOperationName operation of its new activation. Actors that don't support it
+	// should return an error, in which case their new activation starts from their
+	// persisted state.
+	SnapshotOperationName = "snapshot"
+	// RestoreOperationName is the name of the operation that is invoked on an actor that
+	// was handed off from another server, after its startup operation and before any
+	// other invocation. The payload is the response of the SnapshotOperationName
+	// operation of its previous activation.
+	RestoreOperationName = "restore"
+	// MembershipChangeOperationName is the name of the operation that is invoked on the
+	// actors of modules that subscribe to membership changes (see
+	// ModuleDescription.SubscribeMembershipChanges) when the set of servers in the
+	// cluster changes, and once when they're activated. The payload is a JSON encoded
+	// MembershipChange.
+	MembershipChangeOperationName = "onMembershipChange"
+	// DescribeOperationName is the name of the optional operation that modules can export
+	// to describe the operations that their actors support (see DescribeModule on the
+	// virtual package's Environment). It's invoked once per module on a fresh instance
+	// that was not started up, with an empty payload, and the response must be a JSON
+	// encoded ModuleDescription.
+	DescribeOperationName = "describe"
 )